@@ -56,27 +56,20 @@ func run(_context *context.Context, identifierLike string, maxFiles int) {
 	params.Set("institution_identifier", "aptrust.org")
 	params.Set("per_page", strconv.Itoa(perPage))
 	params.Set("sort", "date")
-	params.Set("page", "1")
 	if identifierLike != "" {
 		params.Set("identifier_like", identifierLike)
 	}
-	for {
-		resp := _context.PharosClient.GenericFileList(params)
-		if resp.Error != nil {
-			fmt.Fprintln(os.Stderr,
-				"Error getting GenericFile list from Pharos: ",
-				resp.Error)
-			fmt.Fprintln(os.Stderr, resp.Request.URL)
-		}
-		for _, gf := range resp.GenericFiles() {
-			writeCSV(gf)
-			itemsAdded += 1
-		}
-		writer.Flush()
-		if resp.HasNextPage() == false || itemsAdded >= maxFiles {
-			break
-		}
-		params = resp.ParamsForNextPage()
+	iterator := _context.PharosClient.GenericFileIterator(params, true)
+	defer iterator.Close()
+	for itemsAdded < maxFiles && iterator.Next() {
+		writeCSV(iterator.GenericFile())
+		itemsAdded += 1
+	}
+	writer.Flush()
+	if iterator.Err() != nil {
+		fmt.Fprintln(os.Stderr,
+			"Error getting GenericFile list from Pharos: ",
+			iterator.Err())
 	}
 }
 
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/workers"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// apt_exchange runs any subset of the queue workers (apt_fetch,
+// apt_store, apt_record, etc.) in a single process, sharing one
+// context. On SIGINT or SIGTERM, it stops taking new messages and
+// waits for in-flight messages to drain before exiting. Workers that
+// are still busy when the drain timeout expires checkpoint their work
+// and requeue it.
+func main() {
+	pathToConfigFile, workerNames, drainTimeout, pollInterval, metricsPort := parseCommandLine()
+	config, err := models.LoadConfigFile(pathToConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	_context := context.NewContext(config)
+	exchange, err := workers.NewAPTExchange(_context, workerNames)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	_context.MessageLog.Info("apt_exchange starting workers: %s",
+		strings.Join(exchange.WorkerNames, ", "))
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+
+	err = exchange.Start()
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
+	err = _context.ServeMetrics(metricsPort)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
+	if pollInterval > 0 {
+		go queueNewWork(_context, pollInterval)
+	}
+
+	sig := <-sigchan
+	_context.MessageLog.Info("apt_exchange received signal %s", sig)
+	drained := exchange.Stop(drainTimeout)
+	if boltQueue, ok := _context.Queue.(*network.BoltQueue); ok {
+		boltQueue.Close()
+	}
+	_context.LogStats()
+	if !drained {
+		os.Exit(1)
+	}
+}
+
+// queueNewWork runs apt_bucket_reader and apt_queue every interval.
+// You'll want this when using the embedded queue, since those
+// processes can't write to the queue from outside this process.
+func queueNewWork(_context *context.Context, interval time.Duration) {
+	for {
+		bucketReader := workers.NewAPTBucketReader(_context, false)
+		err := bucketReader.Run()
+		if err != nil {
+			_context.MessageLog.Error("Bucket reader: %v", err)
+		}
+		workers.NewAPTQueue(_context, "", false, false).Run()
+		time.Sleep(interval)
+	}
+}
+
+func parseCommandLine() (configFile string, workerNames []string, drainTimeout, pollInterval time.Duration, metricsPort int) {
+	var pathToConfigFile string
+	var workerList string
+	flag.StringVar(&pathToConfigFile, "config", "", "Path to APTrust config file")
+	flag.StringVar(&workerList, "workers", "", "Comma-separated list of workers to run. Default is all.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 5*time.Minute, "How long to wait for in-flight messages on shutdown")
+	flag.DurationVar(&pollInterval, "poll", 0, "If set, run the bucket reader and apt_queue at this interval")
+	flag.IntVar(&metricsPort, "metrics-port", 0, "If set, serve Prometheus metrics on this port")
+	flag.Parse()
+	if pathToConfigFile == "" {
+		printUsage()
+		os.Exit(1)
+	}
+	if workerList != "" {
+		workerNames = strings.Split(workerList, ",")
+	}
+	return pathToConfigFile, workerNames, drainTimeout, pollInterval, metricsPort
+}
+
+// Tell the user about the program.
+func printUsage() {
+	message := `
+apt_exchange: Runs any number of APTrust queue workers in a single process.
+The workers share one config, Pharos client, logger and queue, and each one
+takes its concurrency settings from its own worker section in the config
+file. On SIGINT or SIGTERM, apt_exchange stops taking new messages and waits
+for in-flight messages to drain before it exits. When the drain timeout
+expires, apt_fetch, apt_store, apt_record, apt_restore and apt_file_restore
+save the state of their in-flight work to Pharos and requeue it, so another
+worker can pick up where they left off.
+
+Usage: apt_exchange -config=<path to APTrust config file> \
+                    [-workers=apt_fetch,apt_store,apt_record] \
+                    [-drain-timeout=5m] [-poll=5m] [-metrics-port=9100]
+
+Param -config is required.
+
+Param -workers is a comma-separated list of workers to run. If you omit it,
+apt_exchange runs all of these:
+
+  ` + strings.Join(workers.ExchangeWorkerNames(), "\n  ") + `
+
+Param -drain-timeout is how long to wait for in-flight messages on shutdown.
+The default is 5m. apt_exchange exits with status 1 if messages are still
+in flight after workers checkpoint and requeue their work.
+
+Param -poll tells apt_exchange to run apt_bucket_reader and apt_queue at the
+specified interval. This is off by default. Turn it on when QueueBackend is
+"embedded", because standalone apt_bucket_reader and apt_queue processes
+cannot write to the embedded queue while apt_exchange has it open.
+
+Param -metrics-port tells apt_exchange to serve Prometheus metrics for all
+of its workers at http://<host>:<port>/metrics. This is off by default.
+The MetricsPort settings in the individual worker sections of the config
+file apply only to the standalone worker apps.
+`
+	fmt.Println(message)
+}
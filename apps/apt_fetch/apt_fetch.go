@@ -22,18 +22,22 @@ func main() {
 	_context := context.NewContext(config)
 	_context.MessageLog.Info("Connecting to NSQLookupd at %s", _context.Config.NsqLookupd)
 	_context.MessageLog.Info("NSQDHttpAddress is %s", _context.Config.NsqdHttpAddress)
-	consumer, err := workers.CreateNsqConsumer(_context.Config, &_context.Config.FetchWorker)
-	if err != nil {
-		_context.MessageLog.Fatalf(err.Error())
-	}
 	_context.MessageLog.Info("apt_fetch started")
 
 	fetcher := workers.NewAPTFetcher(_context)
-	consumer.AddHandler(fetcher)
-	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
+	err = _context.Subscribe(&_context.Config.FetchWorker, fetcher)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
+	err = _context.ServeMetrics(_context.Config.FetchWorker.MetricsPort)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
 
-	// This reader blocks until we get an interrupt, so our program does not exit.
-	<-consumer.StopChan
+	// This blocks until we get an interrupt, so our program does not exit.
+	// On SIGINT or SIGTERM, the worker checkpoints and requeues its
+	// in-flight items before we exit.
+	workers.RunUntilSignal(_context, fetcher)
 }
 
 func parseCommandLine() (configFile string) {
@@ -20,18 +20,22 @@ func main() {
 	_context := context.NewContext(config)
 	_context.MessageLog.Info("Connecting to NSQLookupd at %s", _context.Config.NsqLookupd)
 	_context.MessageLog.Info("NSQDHttpAddress is %s", _context.Config.NsqdHttpAddress)
-	consumer, err := workers.CreateNsqConsumer(_context.Config, &_context.Config.FileDeleteWorker)
-	if err != nil {
-		_context.MessageLog.Fatalf(err.Error())
-	}
 	_context.MessageLog.Info("apt_file_delete started")
 
 	deleter := workers.NewAPTFileDeleter(_context)
-	consumer.AddHandler(deleter)
-	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
+	err = _context.Subscribe(&_context.Config.FileDeleteWorker, deleter)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
+	err = _context.ServeMetrics(_context.Config.FileDeleteWorker.MetricsPort)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
 
-	// This reader blocks until we get an interrupt, so our program does not exit.
-	<-consumer.StopChan
+	// This blocks until we get an interrupt, so our program does not exit.
+	// On SIGINT or SIGTERM, this stops the queue and gives in-flight
+	// items a chance to finish before we exit.
+	workers.RunUntilSignal(_context, deleter)
 }
 
 func parseCommandLine() (configFile string) {
@@ -21,18 +21,22 @@ func main() {
 	_context := context.NewContext(config)
 	_context.MessageLog.Info("Connecting to NSQLookupd at %s", _context.Config.NsqLookupd)
 	_context.MessageLog.Info("NSQDHttpAddress is %s", _context.Config.NsqdHttpAddress)
-	consumer, err := workers.CreateNsqConsumer(_context.Config, &_context.Config.FixityWorker)
-	if err != nil {
-		_context.MessageLog.Fatalf(err.Error())
-	}
 	_context.MessageLog.Info("apt_fixity_check started")
 
 	worker := workers.NewAPTFixityChecker(_context)
-	consumer.AddHandler(worker)
-	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
+	err = _context.Subscribe(&_context.Config.FixityWorker, worker)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
+	err = _context.ServeMetrics(_context.Config.FixityWorker.MetricsPort)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
 
-	// This reader blocks until we get an interrupt, so our program does not exit.
-	<-consumer.StopChan
+	// This blocks until we get an interrupt, so our program does not exit.
+	// On SIGINT or SIGTERM, this stops the queue and gives in-flight
+	// items a chance to finish before we exit.
+	workers.RunUntilSignal(_context, worker)
 }
 
 func parseCommandLine() (configFile string) {
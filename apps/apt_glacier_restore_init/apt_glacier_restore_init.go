@@ -23,18 +23,22 @@ func main() {
 	_context := context.NewContext(config)
 	_context.MessageLog.Info("Connecting to NSQLookupd at %s", _context.Config.NsqLookupd)
 	_context.MessageLog.Info("NSQDHttpAddress is %s", _context.Config.NsqdHttpAddress)
-	consumer, err := workers.CreateNsqConsumer(_context.Config, &_context.Config.GlacierRestoreWorker)
-	if err != nil {
-		_context.MessageLog.Fatalf(err.Error())
-	}
 	_context.MessageLog.Info("apt_glacier_restore_init started")
 
 	restorer := workers.NewGlacierRestore(_context)
-	consumer.AddHandler(restorer)
-	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
+	err = _context.Subscribe(&_context.Config.GlacierRestoreWorker, restorer)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
+	err = _context.ServeMetrics(_context.Config.GlacierRestoreWorker.MetricsPort)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
 
-	// This reader blocks until we get an interrupt, so our program does not exit.
-	<-consumer.StopChan
+	// This blocks until we get an interrupt, so our program does not exit.
+	// On SIGINT or SIGTERM, this stops the queue and gives in-flight
+	// items a chance to finish before we exit.
+	workers.RunUntilSignal(_context, restorer)
 }
 
 func parseCommandLine() (configFile string) {
@@ -0,0 +1,120 @@
+package main
+
+import (
+	gocontext "context"
+	"flag"
+	"fmt"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/workers"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// See printUsage for a description.
+func main() {
+	pathToConfigFile, insecureWebhook := parseCommandLine()
+	config, err := models.LoadConfigFile(pathToConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	_context := context.NewContext(config)
+	trigger, err := workers.NewAPTIngestTrigger(_context)
+	if err != nil {
+		_context.MessageLog.Fatalf("Cannot start ingest trigger: %v", err)
+	}
+	trigger.AuthToken = os.Getenv("INGEST_TRIGGER_AUTH_TOKEN")
+	if config.IngestTrigger.Source == "webhook" && trigger.AuthToken == "" && !insecureWebhook {
+		_context.MessageLog.Fatalf("Refusing to start the webhook without INGEST_TRIGGER_AUTH_TOKEN. " +
+			"Use -insecure-webhook to accept notifications from anyone.")
+	}
+	err = _context.ServeMetrics(config.IngestTrigger.MetricsPort)
+	if err != nil {
+		_context.MessageLog.Fatalf(err.Error())
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigchan
+		_context.MessageLog.Info("apt_ingest_trigger received signal %s", sig)
+		cancel()
+	}()
+
+	if config.IngestTrigger.Source == "webhook" {
+		serveWebhook(ctx, _context, trigger)
+	} else {
+		queue, err := network.NewEventQueue(config)
+		if err != nil {
+			_context.MessageLog.Fatalf(err.Error())
+		}
+		_context.MessageLog.Info("apt_ingest_trigger reading notifications from %s queue",
+			config.IngestTrigger.Source)
+		trigger.RunQueue(ctx, queue)
+	}
+	_context.MessageLog.Info("apt_ingest_trigger stopped")
+}
+
+// serveWebhook accepts notifications over HTTP until ctx is done,
+// then lets requests in progress finish.
+func serveWebhook(ctx gocontext.Context, _context *context.Context, trigger *workers.APTIngestTrigger) {
+	server := &http.Server{
+		Addr:    _context.Config.IngestTrigger.ListenAddress,
+		Handler: trigger,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := gocontext.WithTimeout(gocontext.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	_context.MessageLog.Info("apt_ingest_trigger listening for notifications at %s", server.Addr)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		_context.MessageLog.Fatalf("Webhook server failed: %v", err)
+	}
+}
+
+func parseCommandLine() (configFile string, insecureWebhook bool) {
+	var pathToConfigFile string
+	flag.StringVar(&pathToConfigFile, "config", "", "Path to APTrust config file")
+	flag.BoolVar(&insecureWebhook, "insecure-webhook", false,
+		"Run the webhook without INGEST_TRIGGER_AUTH_TOKEN")
+	flag.Parse()
+	if pathToConfigFile == "" {
+		printUsage()
+		os.Exit(1)
+	}
+	return pathToConfigFile, insecureWebhook
+}
+
+// Tell the user about the program.
+func printUsage() {
+	message := `
+apt_ingest_trigger queues bags for ingest as soon as they're uploaded to a
+receiving bucket. It receives S3 ObjectCreated notifications and creates a
+WorkItem and an NSQ entry for each new bag, as apt_bucket_reader does, without
+scanning every receiving bucket. Keep running apt_bucket_reader now and then,
+to catch bags whose notifications were lost.
+
+The IngestTrigger section of the config file says where notifications come
+from. With Source "webhook", it listens for notifications POSTed to
+ListenAddress. Requests must include the token in the env var
+INGEST_TRIGGER_AUTH_TOKEN in the Authorization header. apt_ingest_trigger won't
+start the webhook without that token unless you pass -insecure-webhook, which
+lets anyone who can reach ListenAddress queue bags. With Source "sqs", it reads
+notifications from the SQS queue at SQSQueueURL. With Source "local", it reads
+them from files in LocalQueueDirectory. Use Control-C or SIGTERM to shut down.
+
+Usage: apt_ingest_trigger -config=<absolute path to APTrust config file> [-insecure-webhook]
+
+Param -config is required.
+`
+	fmt.Println(message)
+}
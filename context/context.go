@@ -2,6 +2,7 @@ package context
 
 import (
 	"fmt"
+	"github.com/APTrust/exchange/metrics"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util/logger"
@@ -9,6 +10,7 @@ import (
 	"github.com/op/go-logging"
 	stdlog "log"
 	"os"
+	"sync"
 	"sync/atomic"
 )
 
@@ -24,11 +26,14 @@ type Context struct {
 	JsonLog       *stdlog.Logger
 	NSQClient     *network.NSQClient
 	PharosClient  *network.PharosClient
+	Queue         network.Queue
 	VolumeClient  *network.VolumeClient
 	pathToLogFile string
 	pathToJsonLog string
 	succeeded     int64
 	failed        int64
+	backends      map[string]network.StorageBackend
+	backendMutex  sync.Mutex
 }
 
 /*
@@ -46,6 +51,7 @@ func NewContext(config *models.Config) (context *Context) {
 	context = &Context{
 		succeeded: int64(0),
 		failed:    int64(0),
+		backends:  make(map[string]network.StorageBackend),
 	}
 	context.Config = config
 	context.MessageLog, context.pathToLogFile = logger.InitLogger(config)
@@ -53,9 +59,85 @@ func NewContext(config *models.Config) (context *Context) {
 	context.VolumeClient = network.NewVolumeClient(context.Config.VolumeServicePort)
 	context.NSQClient = network.NewNSQClient(context.Config.NsqdHttpAddress)
 	context.initPharosClient()
+	context.initStorageBackend()
+	context.initQueue()
 	return context
 }
 
+// Initializes the queue that workers read from and publish to.
+func (context *Context) initQueue() {
+	queue, err := network.NewQueue(context.Config)
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Cannot initialize queue: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		context.MessageLog.Fatal(message)
+	}
+	context.Queue = queue
+}
+
+// Makes sure the configured storage backend is one we know about,
+// and that we can create it.
+func (context *Context) initStorageBackend() {
+	_, err := context.newStorageBackend(context.Config.APTrustS3Region)
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Cannot initialize storage backend: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		context.MessageLog.Fatal(message)
+	}
+}
+
+// StorageBackend returns the storage backend workers should use to
+// talk to buckets in the specified region. This is an S3Backend
+// unless config.StorageBackend says otherwise. The local backend
+// ignores region. Backends are cached and shared, so we don't build
+// a new S3 session for every request. The backend is wrapped in a
+// network.MeteredBackend, which reports bytes transferred to
+// metrics.Default.
+func (context *Context) StorageBackend(region string) network.StorageBackend {
+	context.backendMutex.Lock()
+	defer context.backendMutex.Unlock()
+	if context.backends == nil {
+		context.backends = make(map[string]network.StorageBackend)
+	}
+	backend := context.backends[region]
+	if backend == nil {
+		var err error
+		backend, err = context.newStorageBackend(region)
+		if err != nil {
+			// We checked this when we created the context,
+			// so this should never happen.
+			context.MessageLog.Fatalf("Cannot create storage backend: %v", err)
+		}
+		backend = network.NewMeteredBackend(backend, context.storageBackendName())
+		context.backends[region] = backend
+	}
+	return backend
+}
+
+func (context *Context) newStorageBackend(region string) (network.StorageBackend, error) {
+	switch context.Config.StorageBackend {
+	case "", "s3":
+		return network.NewS3Backend(
+			os.Getenv("AWS_ACCESS_KEY_ID"),
+			os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			region,
+			context.Config.S3Endpoint), nil
+	case "local":
+		return network.NewLocalBackend(context.Config.LocalStorageRoot)
+	}
+	return nil, fmt.Errorf("Unknown storage backend '%s'. Use 's3' or 'local'.",
+		context.Config.StorageBackend)
+}
+
+// storageBackendName returns the name of the configured storage
+// backend, for metrics.
+func (context *Context) storageBackendName() string {
+	if context.Config.StorageBackend == "" {
+		return "s3"
+	}
+	return context.Config.StorageBackend
+}
+
 // Initializes a reusable Pharos client.
 func (context *Context) initPharosClient() {
 	pharosClient, err := network.NewPharosClient(
@@ -68,9 +150,26 @@ func (context *Context) initPharosClient() {
 		fmt.Fprintln(os.Stderr, message)
 		context.MessageLog.Fatal(message)
 	}
+	err = pharosClient.SetRetryConfig(context.Config.PharosRetry)
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Cannot initialize Pharos Client: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		context.MessageLog.Fatal(message)
+	}
 	context.PharosClient = pharosClient
 }
 
+// Subscribe subscribes handler to workerConfig's topic on the queue.
+// If the Pharos client has a circuit breaker, handler won't get any
+// messages while the breaker is open.
+func (context *Context) Subscribe(workerConfig *models.WorkerConfig, handler network.MessageHandler) error {
+	breaker := context.PharosClient.CircuitBreaker()
+	if breaker != nil {
+		handler = network.NewPharosPausingHandler(breaker, handler)
+	}
+	return context.Queue.Subscribe(workerConfig, handler)
+}
+
 // Returns the number of work items that succeeded.
 func (context *Context) Succeeded() int64 {
 	return context.succeeded
@@ -84,12 +183,14 @@ func (context *Context) Failed() int64 {
 // Increases the count of successfully processed items by one.
 func (context *Context) IncrementSucceeded() int64 {
 	atomic.AddInt64(&context.succeeded, 1)
+	metrics.WorkItems.Inc("succeeded")
 	return context.succeeded
 }
 
 // Increases the count of unsuccessfully processed items by one.
 func (context *Context) IncrementFailed() int64 {
 	atomic.AddInt64(&context.failed, 1)
+	metrics.WorkItems.Inc("failed")
 	return context.succeeded
 }
 
@@ -109,6 +210,22 @@ func (context *Context) LogStats() {
 		context.Succeeded(), context.Failed())
 }
 
+// ServeMetrics starts an HTTP server on the specified port that
+// serves metrics.Default in Prometheus format at /metrics. This
+// does nothing if port is zero, so workers can call it with their
+// WorkerConfig.MetricsPort whether or not metrics are turned on.
+func (context *Context) ServeMetrics(port int) error {
+	if port == 0 {
+		return nil
+	}
+	server, err := metrics.Default.Serve(fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("Cannot start metrics server on port %d: %v", port, err)
+	}
+	context.MessageLog.Info("Serving metrics at http://%s/metrics", server.Addr)
+	return nil
+}
+
 // GetS3Client returns a Minio client. For url param, do not include
 // protocol. E.g. Use "example.com" not "https://example.com".
 // The Minio client will use https by default.
@@ -1,10 +1,13 @@
 package context_test
 
 import (
+	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -29,6 +32,7 @@ func TestNewContext(t *testing.T) {
 	assert.NotNil(t, _context.Config)
 	assert.NotNil(t, _context.NSQClient)
 	assert.NotNil(t, _context.PharosClient)
+	assert.NotNil(t, _context.Queue)
 	assert.NotNil(t, _context.MessageLog)
 	assert.NotNil(t, _context.JsonLog)
 	assert.Equal(t, expectedPathToLogFile, _context.PathToLogFile())
@@ -63,3 +67,34 @@ func TestGetS3Client(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, client)
 }
+
+func TestStorageBackend(t *testing.T) {
+	configFile := filepath.Join("config", "test.json")
+	appConfig, err := models.LoadConfigFile(configFile)
+	require.Nil(t, err)
+	appConfig.LogToStderr = false
+	_context := context.NewContext(appConfig)
+
+	backend := _context.StorageBackend(constants.AWSVirginia)
+	metered, ok := backend.(*network.MeteredBackend)
+	require.True(t, ok)
+	assert.Equal(t, "s3", metered.Name)
+	s3Backend, ok := metered.StorageBackend.(*network.S3Backend)
+	require.True(t, ok)
+	assert.Equal(t, constants.AWSVirginia, s3Backend.AWSRegion)
+	assert.True(t, backend == _context.StorageBackend(constants.AWSVirginia))
+	assert.False(t, backend == _context.StorageBackend(constants.AWSOregon))
+
+	tempDir, err := ioutil.TempDir("", "context_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	appConfig.StorageBackend = "local"
+	appConfig.LocalStorageRoot = tempDir
+	_context = context.NewContext(appConfig)
+	metered, ok = _context.StorageBackend(constants.AWSVirginia).(*network.MeteredBackend)
+	require.True(t, ok)
+	assert.Equal(t, "local", metered.Name)
+	localBackend, ok := metered.StorageBackend.(*network.LocalBackend)
+	require.True(t, ok)
+	assert.Equal(t, tempDir, localBackend.Root)
+}
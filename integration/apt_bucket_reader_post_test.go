@@ -123,10 +123,12 @@ func testErrors(t *testing.T, expected *stats.APTBucketReaderStats, actual *stat
 // we created in aptrust.integration.test. This test will fail
 // if someone deletes those subdirectories.
 //
-// "Ignoring non-tar file TestBags.zip",
 // "Ignoring TestSubDir/ (subdirectory)",
 // "Ignoring TestSubDir/SubSubDir/ (subdirectory)",
 // "Ignoring TestSubDir/SubSubDir/example.edu.tagsample_good.tar (subdirectory)"
+//
+// TestBags.zip is queued like any other zipped bag, and fails ingest
+// because it isn't a valid bag. See testutil.INTEGRATION_BAD_BAGS.
 func testWarnings(t *testing.T, expected *stats.APTBucketReaderStats, actual *stats.APTBucketReaderStats) {
-	assert.Equal(t, 4, len(actual.Warnings))
+	assert.Equal(t, 3, len(actual.Warnings))
 }
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Default is the registry our workers report to. Each worker process
+// serves it at /metrics when its WorkerConfig.MetricsPort is set.
+var Default = NewRegistry()
+
+// FixityBuckets are the histogram buckets, in seconds, for fixity
+// checks, which stream entire files from S3 and can take a long time.
+var FixityBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600}
+
+var (
+	// MessagesReceived counts the queue messages delivered to our
+	// workers, by topic. The topic tells you the stage: apt_fetch_topic,
+	// apt_store_topic, apt_record_topic, etc.
+	MessagesReceived = Default.NewCounter(
+		"exchange_messages_received_total",
+		"Queue messages delivered to workers, by topic.",
+		"topic")
+
+	// MessagesProcessed counts the queue messages our workers finished
+	// or requeued, by topic. Outcome is "finished" or "requeued".
+	MessagesProcessed = Default.NewCounter(
+		"exchange_messages_processed_total",
+		"Queue messages workers finished or requeued, by topic and outcome.",
+		"topic", "outcome")
+
+	// WorkItems counts the items the process reported as succeeded
+	// or failed through Context.IncrementSucceeded and IncrementFailed.
+	WorkItems = Default.NewCounter(
+		"exchange_work_items_total",
+		"Work items that succeeded or failed.",
+		"outcome")
+
+	// IngestEvents counts the S3 notifications apt_ingest_trigger
+	// handled, one for each record in the notification. Outcome is
+	// "queued" if the record was for a bag that's ready for ingest,
+	// "ignored" if it wasn't, or "error" if we couldn't tell.
+	IngestEvents = Default.NewCounter(
+		"exchange_ingest_events_total",
+		"S3 event notification records handled by the ingest trigger, by outcome.",
+		"outcome")
+
+	// StorageBytes counts bytes uploaded to and downloaded from
+	// S3, Glacier or local storage. Direction is "upload" or
+	// "download". Backend is "s3" or "local".
+	StorageBytes = Default.NewCounter(
+		"exchange_storage_bytes_total",
+		"Bytes transferred to and from preservation storage, by backend, bucket and direction.",
+		"backend", "bucket", "direction")
+
+	// StorageErrors counts failed storage operations. Operation is
+	// put, get, head, delete, list, restore, upload_part or
+	// complete_multipart.
+	StorageErrors = Default.NewCounter(
+		"exchange_storage_errors_total",
+		"Failed storage operations, by backend, bucket and operation.",
+		"backend", "bucket", "operation")
+
+	// FixityCheckDuration records how long each fixity check took.
+	// Outcome is "ok", "mismatch" or "error".
+	FixityCheckDuration = Default.NewHistogram(
+		"exchange_fixity_check_duration_seconds",
+		"Time to calculate fixity of a file in preservation storage, by outcome.",
+		FixityBuckets,
+		"outcome")
+
+	// PharosRequestDuration records the latency of Pharos REST calls.
+	// Endpoint is the resource and action, such as "objects",
+	// "files/create_batch" or "item_state".
+	PharosRequestDuration = Default.NewHistogram(
+		"exchange_pharos_request_duration_seconds",
+		"Latency of Pharos REST requests, by endpoint and method.",
+		DefaultBuckets,
+		"endpoint", "method")
+
+	// PharosRequestErrors counts Pharos REST calls that failed or
+	// returned a status code of 400 or higher.
+	PharosRequestErrors = Default.NewCounter(
+		"exchange_pharos_request_errors_total",
+		"Pharos REST requests that failed or returned an error status, by endpoint and method.",
+		"endpoint", "method")
+
+	// PharosRequestRetries counts Pharos REST calls that the
+	// PharosClient retried after a network error or a 429, 502,
+	// 503 or 504 response.
+	PharosRequestRetries = Default.NewCounter(
+		"exchange_pharos_request_retries_total",
+		"Pharos REST requests retried after a transient failure, by endpoint and method.",
+		"endpoint", "method")
+
+	// PharosCircuitBreakerTrips counts the times the PharosClient's
+	// circuit breaker opened because Pharos looked like it was down.
+	PharosCircuitBreakerTrips = Default.NewCounter(
+		"exchange_pharos_circuit_breaker_trips_total",
+		"Times the Pharos circuit breaker opened.")
+
+	// VolumeReservations counts requests to reserve disk space through
+	// the volume service. Outcome is "granted", "denied" or "error".
+	VolumeReservations = Default.NewCounter(
+		"exchange_volume_reservations_total",
+		"Volume service reservation requests, by outcome.",
+		"outcome")
+
+	// VolumeReservedBytes counts the bytes the volume service granted.
+	VolumeReservedBytes = Default.NewCounter(
+		"exchange_volume_reserved_bytes_total",
+		"Bytes reserved through the volume service.")
+
+	// VolumeReleases counts requests to release reserved disk space.
+	// Outcome is "ok" or "error".
+	VolumeReleases = Default.NewCounter(
+		"exchange_volume_releases_total",
+		"Volume service release requests, by outcome.",
+		"outcome")
+)
+
+// Since returns the number of seconds since start, for recording
+// durations in a Histogram.
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
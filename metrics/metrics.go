@@ -0,0 +1,352 @@
+// Package metrics keeps counters and histograms for our workers and
+// exposes them over HTTP in the Prometheus text format, so we can
+// graph throughput and alert on a stalled pipeline. This is a small,
+// hand-rolled subset of the Prometheus client: counters and histograms
+// with labels, and nothing else.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram buckets, in seconds, for timing
+// network requests.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metric is a counter or histogram that can write itself out in the
+// Prometheus text format.
+type metric interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics and writes them out in the
+// Prometheus text format. It implements http.Handler.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]metric),
+	}
+}
+
+// NewCounter creates a counter and adds it to the registry. Param
+// labelNames lists the names of the labels each value of this counter
+// will have. This panics if the registry already has a metric with
+// the same name, since that's a programming error.
+func (registry *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	counter := &Counter{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]*counterValue),
+	}
+	registry.add(counter)
+	return counter
+}
+
+// NewHistogram creates a histogram and adds it to the registry. Param
+// buckets contains the upper bounds of the histogram buckets, in
+// ascending order. If it's empty, the histogram uses DefaultBuckets.
+func (registry *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	histogram := &Histogram{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		values:     make(map[string]*histogramValue),
+	}
+	registry.add(histogram)
+	return histogram
+}
+
+func (registry *Registry) add(m metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, exists := registry.metrics[m.metricName()]; exists {
+		panic(fmt.Sprintf("Metric %s is already registered", m.metricName()))
+	}
+	registry.metrics[m.metricName()] = m
+}
+
+// WriteText writes all of the registry's metrics to w in the
+// Prometheus text format, sorted by name.
+func (registry *Registry) WriteText(w io.Writer) error {
+	registry.mutex.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = registry.metrics[name]
+	}
+	registry.mutex.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// ServeHTTP writes the registry's metrics in response to an HTTP request.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	registry.WriteText(w)
+}
+
+// Serve starts an HTTP server on address (e.g. ":9100") that serves
+// the registry's metrics at /metrics. It returns an error if it can't
+// listen on address. Otherwise, it serves in the background until the
+// caller closes the returned server.
+func (registry *Registry) Serve(address string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
+
+// Counter is a value that only goes up, such as the number of
+// messages processed or bytes uploaded. Each combination of label
+// values has its own count.
+type Counter struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// Inc adds one to the counter for the specified label values.
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds value to the counter for the specified label values.
+// Negative values are ignored, since counters can't go down. Pass one
+// label value for each label name given to NewCounter, in the same
+// order.
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	key := labelKey(counter.labelNames, labelValues)
+	v := counter.values[key]
+	if v == nil {
+		v = &counterValue{labelValues: labelValues}
+		counter.values[key] = v
+	}
+	v.value += value
+}
+
+// Value returns the current count for the specified label values.
+func (counter *Counter) Value(labelValues ...string) float64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	v := counter.values[labelKey(counter.labelNames, labelValues)]
+	if v == nil {
+		return 0
+	}
+	return v.value
+}
+
+func (counter *Counter) metricName() string {
+	return counter.name
+}
+
+func (counter *Counter) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	writeHeader(w, counter.name, counter.help, "counter")
+	for _, key := range sortedKeys(counter.values) {
+		v := counter.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", counter.name,
+			formatLabels(counter.labelNames, v.labelValues, "", ""),
+			formatValue(v.value))
+	}
+}
+
+// Histogram counts observations, such as request durations, in
+// buckets, and keeps a running sum and count. Each combination of
+// label values has its own buckets.
+type Histogram struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// Observe records value in the histogram for the specified label values.
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	key := labelKey(histogram.labelNames, labelValues)
+	v := histogram.values[key]
+	if v == nil {
+		v = &histogramValue{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(histogram.buckets)),
+		}
+		histogram.values[key] = v
+	}
+	for i, upperBound := range histogram.buckets {
+		if value <= upperBound {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+// Count returns the number of observations for the specified label values.
+func (histogram *Histogram) Count(labelValues ...string) uint64 {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	v := histogram.values[labelKey(histogram.labelNames, labelValues)]
+	if v == nil {
+		return 0
+	}
+	return v.count
+}
+
+// Sum returns the sum of all observations for the specified label values.
+func (histogram *Histogram) Sum(labelValues ...string) float64 {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	v := histogram.values[labelKey(histogram.labelNames, labelValues)]
+	if v == nil {
+		return 0
+	}
+	return v.sum
+}
+
+func (histogram *Histogram) metricName() string {
+	return histogram.name
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	writeHeader(w, histogram.name, histogram.help, "histogram")
+	for _, key := range sortedKeys(histogram.values) {
+		v := histogram.values[key]
+		for i, upperBound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name,
+				formatLabels(histogram.labelNames, v.labelValues, "le", formatValue(upperBound)),
+				v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name,
+			formatLabels(histogram.labelNames, v.labelValues, "le", "+Inf"), v.count)
+		labels := formatLabels(histogram.labelNames, v.labelValues, "", "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, labels, formatValue(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, labels, v.count)
+	}
+}
+
+// labelKey returns the map key for a set of label values. Missing
+// values are treated as empty strings, and extras are ignored.
+func labelKey(labelNames, labelValues []string) string {
+	values := make([]string, len(labelNames))
+	copy(values, labelValues)
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch values := m.(type) {
+	case map[string]*counterValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) {
+	help = strings.Replace(help, `\`, `\\`, -1)
+	help = strings.Replace(help, "\n", `\n`, -1)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+// formatLabels returns labels in the form {name="value",...}. If
+// extraName is not empty, it's added as the last label. Histograms
+// use that for the "le" label on each bucket.
+func formatLabels(labelNames, labelValues []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(labelNames)+1)
+	for i, name := range labelNames {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(value)))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,124 @@
+package metrics_test
+
+import (
+	"bytes"
+	"github.com/APTrust/exchange/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("test_total", "A test counter.", "topic", "outcome")
+	counter.Inc("fetch", "finished")
+	counter.Inc("fetch", "finished")
+	counter.Add(3, "store", "requeued")
+	counter.Add(-5, "store", "requeued")
+	assert.Equal(t, float64(2), counter.Value("fetch", "finished"))
+	assert.Equal(t, float64(3), counter.Value("store", "requeued"))
+	assert.Equal(t, float64(0), counter.Value("record", "finished"))
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, registry.WriteText(buf))
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{topic="fetch",outcome="finished"} 2
+test_total{topic="store",outcome="requeued"} 3
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("bytes_total", "Bytes.\nWith a newline.")
+	counter.Add(1024)
+	buf := &bytes.Buffer{}
+	require.Nil(t, registry.WriteText(buf))
+	expected := `# HELP bytes_total Bytes.\nWith a newline.
+# TYPE bytes_total counter
+bytes_total 1024
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("escape_total", "Escaping.", "label")
+	counter.Inc("say \"hi\"\\\n")
+	buf := &bytes.Buffer{}
+	require.Nil(t, registry.WriteText(buf))
+	assert.Contains(t, buf.String(), `escape_total{label="say \"hi\"\\\n"} 1`)
+}
+
+func TestHistogram(t *testing.T) {
+	registry := metrics.NewRegistry()
+	histogram := registry.NewHistogram("duration_seconds", "Durations.",
+		[]float64{0.5, 1, 5}, "endpoint")
+	histogram.Observe(0.25, "objects")
+	histogram.Observe(0.75, "objects")
+	histogram.Observe(10, "objects")
+	assert.Equal(t, uint64(3), histogram.Count("objects"))
+	assert.Equal(t, 11.0, histogram.Sum("objects"))
+	assert.Equal(t, uint64(0), histogram.Count("files"))
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, registry.WriteText(buf))
+	expected := `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{endpoint="objects",le="0.5"} 1
+duration_seconds_bucket{endpoint="objects",le="1"} 2
+duration_seconds_bucket{endpoint="objects",le="5"} 2
+duration_seconds_bucket{endpoint="objects",le="+Inf"} 3
+duration_seconds_sum{endpoint="objects"} 11
+duration_seconds_count{endpoint="objects"} 3
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestRegistryOrderAndDuplicates(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCounter("b_total", "B.")
+	registry.NewHistogram("a_seconds", "A.", nil)
+	buf := &bytes.Buffer{}
+	require.Nil(t, registry.WriteText(buf))
+	assert.True(t, strings.Index(buf.String(), "a_seconds") < strings.Index(buf.String(), "b_total"))
+	assert.Panics(t, func() { registry.NewCounter("b_total", "Again.") })
+}
+
+func TestServe(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCounter("served_total", "Served.").Inc()
+	server, err := registry.Serve("127.0.0.1:0")
+	require.Nil(t, err)
+	defer server.Close()
+
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, metrics.ContentType, resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Contains(t, string(body), "served_total 1")
+
+	_, err = registry.Serve(server.Addr)
+	assert.NotNil(t, err)
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.Nil(t, metrics.Default.WriteText(buf))
+	for _, name := range []string{
+		"exchange_messages_processed_total",
+		"exchange_storage_bytes_total",
+		"exchange_fixity_check_duration_seconds",
+		"exchange_pharos_request_duration_seconds",
+		"exchange_volume_reservations_total",
+	} {
+		assert.Contains(t, buf.String(), "# TYPE "+name, name)
+	}
+}
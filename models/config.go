@@ -12,6 +12,18 @@ import (
 )
 
 type WorkerConfig struct {
+	// DownloadConcurrency is the number of byte ranges workers
+	// that download from preservation storage, such as apt_restore
+	// and apt_fixity_check, fetch at once for each file. Zero or
+	// one means download each file in a single stream.
+	DownloadConcurrency int
+
+	// DownloadPartSize is the size in bytes of each byte range in
+	// a parallel download. Each download can hold up to
+	// (DownloadConcurrency + 1) * DownloadPartSize bytes in memory.
+	// Zero means use the default of 64MB.
+	DownloadPartSize int64
+
 	// This describes how often the NSQ client should ping
 	// the NSQ server to let it know it's still there. The
 	// setting must be formatted like so:
@@ -50,6 +62,12 @@ type WorkerConfig struct {
 	// so to ensure completion.
 	MessageTimeout string
 
+	// MetricsPort is the port on which the worker serves
+	// Prometheus metrics at /metrics. Leave this at zero to
+	// turn off the metrics server. Workers that run on the
+	// same host need different ports.
+	MetricsPort int
+
 	// Number of go routines used to perform network I/O,
 	// such as fetching files from S3, storing files to S3,
 	// and fetching/storing Fluctus data. If a worker does
@@ -78,6 +96,75 @@ type WorkerConfig struct {
 	WriteTimeout string
 }
 
+// PharosRetryConfig describes how PharosClient retries failed
+// requests, and when it stops talking to Pharos altogether. Durations
+// use the same format as WorkerConfig.HeartbeatInterval.
+type PharosRetryConfig struct {
+	// MaxRetries is the number of times to retry a request that
+	// failed with a network error or with status 429, 502, 503 or
+	// 504. Zero means don't retry. GET, PUT and DELETE requests are
+	// retried on all of those. POST requests are retried only on
+	// 429 and 503, because those mean Pharos didn't do the work.
+	MaxRetries int
+
+	// InitialBackoff is how long to wait before the first retry,
+	// e.g. "500ms". The wait doubles with each retry, up to
+	// MaxBackoff, with some random jitter so that many workers
+	// don't retry all at once. If Pharos sends a Retry-After
+	// header, we wait that long instead.
+	InitialBackoff string
+
+	// MaxBackoff is the longest we'll wait between retries, e.g. "30s".
+	MaxBackoff string
+
+	// BreakerThreshold is the number of failures in a row, counting
+	// retries, that trips the circuit breaker. While the breaker is
+	// open, the client doesn't send requests to Pharos, and workers
+	// stop taking messages from the queue. Zero turns off the
+	// circuit breaker.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the breaker stays open before the
+	// client tries Pharos again, e.g. "1m". If that request fails,
+	// the breaker opens for another cooldown period.
+	BreakerCooldown string
+}
+
+// IngestTriggerConfig describes where apt_ingest_trigger gets the S3
+// notifications that tell it a bag has arrived in a receiving bucket.
+type IngestTriggerConfig struct {
+	// Source is "webhook" to receive notifications over HTTP at
+	// ListenAddress, "sqs" to read them from the SQS queue at
+	// SQSQueueURL, or "local" to read them from JSON files in
+	// LocalQueueDirectory.
+	Source string
+
+	// ListenAddress is the address where the webhook listens,
+	// e.g. ":8560". If the env var INGEST_TRIGGER_AUTH_TOKEN is
+	// set, senders must put that token in the Authorization header.
+	ListenAddress string
+
+	// LocalQueueDirectory is the directory to read notifications from
+	// when Source is "local". Each file is one message.
+	LocalQueueDirectory string
+
+	// MetricsPort is the port where apt_ingest_trigger serves
+	// Prometheus metrics. Zero means don't serve them.
+	MetricsPort int
+
+	// SQSEndpoint is the URL of an SQS-compatible service, such as
+	// ElasticMQ. Leave it empty to talk to AWS.
+	SQSEndpoint string
+
+	// SQSQueueURL is the URL of the SQS queue that receives
+	// notifications from the receiving buckets.
+	SQSQueueURL string
+
+	// SQSRegion is the AWS region of the SQS queue. If this is
+	// empty, we use APTrustS3Region.
+	SQSRegion string
+}
+
 type Config struct {
 	// ActiveConfig is the configuration currently
 	// in use.
@@ -120,6 +207,20 @@ type Config struct {
 	// bucket after successfully processing this bag?
 	DeleteOnSuccess bool
 
+	// EmbeddedQueuePath is the path to the BoltDB file that holds
+	// the embedded work queue. This applies only when QueueBackend
+	// is "embedded".
+	EmbeddedQueuePath string
+
+	// FetchTxtBuckets lists the S3 buckets that s3:// URLs in a
+	// bag's fetch.txt may point to. See ResolveFetchTxt.
+	FetchTxtBuckets []string
+
+	// FetchTxtLocalRoots lists the directories, such as shared
+	// mounts, that file:// URLs in a bag's fetch.txt may point
+	// into. See ResolveFetchTxt.
+	FetchTxtLocalRoots []string
+
 	// Configuration options for apt_fetch
 	FetchWorker WorkerConfig
 
@@ -171,6 +272,17 @@ type Config struct {
 	// Configuration options for apt_glacier_restore
 	GlacierRestoreWorker WorkerConfig
 
+	// IngestTrigger configures apt_ingest_trigger, which queues
+	// bags for ingest as soon as S3 says they've been uploaded.
+	// apt_bucket_reader still runs as a safety net, to catch any
+	// bags whose notifications were lost.
+	IngestTrigger IngestTriggerConfig
+
+	// LocalStorageRoot is the directory under which the local
+	// storage backend keeps its buckets. This applies only when
+	// StorageBackend is "local".
+	LocalStorageRoot string
+
 	// LogDirectory is where we'll write our log files.
 	LogDirectory string
 
@@ -206,6 +318,13 @@ type Config struct {
 	// receiving buckets.
 	MaxFileSize int64
 
+	// MultipartBagWaitHours is how long the bucket reader waits for
+	// all parts of a multipart bag (my_bag.b01.of03.tar, etc.) to
+	// arrive, counting from the most recent upload. After that, it
+	// marks the bag as failed, describing the missing or duplicate
+	// parts. Defaults to 24 if not set.
+	MultipartBagWaitHours int
+
 	// NsqdHttpAddress tells us where to find the NSQ server
 	// where we can read from and write to topics and channels.
 	// It's typically something like "http://localhost:4151"
@@ -221,6 +340,11 @@ type Config struct {
 	// start with a v, like v1, v2.2, etc.
 	PharosAPIVersion string
 
+	// PharosRetry describes how the PharosClient retries failed
+	// requests, and when its circuit breaker stops workers from
+	// processing messages because Pharos is down.
+	PharosRetry PharosRetryConfig
+
 	// PharosURL is the URL of the Pharos server where
 	// we will be recording results and metadata. This should
 	// start with http:// or https://
@@ -230,6 +354,13 @@ type Config struct {
 	// copy files for long-term storage.
 	PreservationBucket string
 
+	// QueueBackend describes how workers receive and publish
+	// work. Use "nsq" (the default if this is empty) to go through
+	// nsqd and nsqlookupd, or "embedded" to use a durable queue in
+	// the BoltDB file at EmbeddedQueuePath. The embedded queue works
+	// only when all of the workers run in a single process.
+	QueueBackend string
+
 	// ReceivingBuckets is a list of S3 receiving buckets to check
 	// for incoming tar files.
 	ReceivingBuckets []string
@@ -249,6 +380,14 @@ type Config struct {
 	// in US East to the replication bucket in USWest2.
 	ReplicationDirectory string
 
+	// ResolveFetchTxt tells apt_fetch to download the files listed
+	// in a holey bag's fetch.txt, and add them to the bag before
+	// validating it. URLs must point into FetchTxtBuckets or
+	// FetchTxtLocalRoots. This works only when the bag validation
+	// config allows fetch.txt, and bags that have one must be plain
+	// tar files. apt_fetch doesn't stream bags when this is on.
+	ResolveFetchTxt bool
+
 	// RestoreDirectory is the directory in which we will
 	// rebuild IntellectualObject before sending them
 	// off to the S3 restoration bucket.
@@ -263,6 +402,11 @@ type Config struct {
 	// Configuration options for apt_restore
 	RestoreWorker WorkerConfig
 
+	// S3Endpoint is the URL of an S3-compatible service, such as
+	// a local MinIO server, that the S3 storage backend should talk
+	// to instead of AWS. Leave this empty to use AWS.
+	S3Endpoint string
+
 	// SkipAlreadyProcessed indicates whether or not the
 	// bucket_reader should  put successfully-processed items into
 	// NSQ for re-processing. This is amost always set to false.
@@ -270,9 +414,22 @@ type Config struct {
 	// items to test code changes.
 	SkipAlreadyProcessed bool
 
+	// StorageBackend describes where workers store, restore, delete
+	// and fixity-check preservation files. Use "s3" (the default if
+	// this is empty) for S3 and Glacier, or "local" to use the local
+	// file system under LocalStorageRoot.
+	StorageBackend string
+
 	// Configuration options for apt_store
 	StoreWorker WorkerConfig
 
+	// StreamIngest tells apt_fetch to validate bags by streaming them
+	// from the receiving bucket, instead of downloading them to
+	// TarDirectory first. apt_store then reads each file straight from
+	// the receiving bucket. Only the bag's .valdb goes on local disk,
+	// so we don't need to reserve space through the volume service.
+	StreamIngest bool
+
 	// TarDirectory is the directory in which we will
 	// untar files from S3. This should be on a volume
 	// with lots of free disk space.
@@ -378,6 +535,24 @@ func (config *Config) ExpandFilePaths() {
 	if err == nil {
 		config.ReplicationDirectory = expanded
 	}
+	expanded, err = fileutil.ExpandTilde(config.LocalStorageRoot)
+	if err == nil {
+		config.LocalStorageRoot = expanded
+	}
+	expanded, err = fileutil.ExpandTilde(config.EmbeddedQueuePath)
+	if err == nil {
+		config.EmbeddedQueuePath = expanded
+	}
+	expanded, err = fileutil.ExpandTilde(config.IngestTrigger.LocalQueueDirectory)
+	if err == nil {
+		config.IngestTrigger.LocalQueueDirectory = expanded
+	}
+	for i, localRoot := range config.FetchTxtLocalRoots {
+		expanded, err = fileutil.ExpandTilde(localRoot)
+		if err == nil {
+			config.FetchTxtLocalRoots[i] = expanded
+		}
+	}
 
 	// Convert bag validation config files from relative to absolute paths.
 	absPath, _ := filepath.Abs(config.BagValidationConfigFile)
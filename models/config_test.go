@@ -47,6 +47,7 @@ func TestLoad(t *testing.T) {
 	assert.Equal(t, 18, len(config.ReceivingBuckets))
 	assert.Equal(t, configFile, config.ActiveConfig)
 	assert.Equal(t, 24, config.BucketReaderCacheHours)
+	assert.Equal(t, "500ms", config.PharosRetry.InitialBackoff)
 }
 
 func TestEnsurePharosConfig(t *testing.T) {
@@ -1,17 +1,16 @@
 package models
 
 import (
-	"github.com/nsqio/go-nsq"
 	"time"
 )
 
 // DeleteState stores information about the state of a file deletion
 // operation.
 type DeleteState struct {
-	// NSQMessage is the NSQ message being processed in this restore
+	// Message is the queue message being processed in this restore
 	// request. Not serialized because it will change each time we
 	// try to process a request.
-	NSQMessage *nsq.Message `json:"-"`
+	Message QueueMessage `json:"-"`
 	// WorkItem is the Pharos WorkItem we're processing.
 	// Not serialized because the Pharos WorkItem record will be
 	// more up-to-date and authoritative.
@@ -31,9 +30,9 @@ type DeleteState struct {
 
 // NewDeleteState creates a new DeleteState object with an empty
 // DeleteSummary.
-func NewDeleteState(message *nsq.Message) *DeleteState {
+func NewDeleteState(message QueueMessage) *DeleteState {
 	return &DeleteState{
-		NSQMessage:    message,
+		Message:       message,
 		DeleteSummary: NewWorkSummary(),
 	}
 }
@@ -9,7 +9,7 @@ import (
 )
 
 func TestNewDeleteState(t *testing.T) {
-	deleteState := models.NewDeleteState(testutil.MakeNsqMessage("999"))
+	deleteState := models.NewDeleteState(testutil.MakeQueueMessage("999"))
 	require.NotNil(t, deleteState)
 	assert.NotNil(t, deleteState.DeleteSummary)
 }
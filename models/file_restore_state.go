@@ -1,7 +1,6 @@
 package models
 
 import (
-	"github.com/nsqio/go-nsq"
 	"time"
 )
 
@@ -9,10 +8,10 @@ import (
 // operation. This entire structure will be converted to JSON and saved
 // as a WorkItemState object in Pharos.
 type FileRestoreState struct {
-	// NSQMessage is the NSQ message being processed in this restore
+	// Message is the queue message being processed in this restore
 	// request. Not serialized because it will change each time we
 	// try to process a request.
-	NSQMessage *nsq.Message `json:"-"`
+	Message QueueMessage `json:"-"`
 	// WorkItem is the Pharos WorkItem we're processing.
 	// Not serialized because the Pharos WorkItem record will be
 	// more up-to-date and authoritative.
@@ -37,9 +36,9 @@ type FileRestoreState struct {
 
 // NewFileRestoreState creates a new FileRestoreState object
 // with empty RestoreSummary.
-func NewFileRestoreState(message *nsq.Message) *FileRestoreState {
+func NewFileRestoreState(message QueueMessage) *FileRestoreState {
 	return &FileRestoreState{
-		NSQMessage:     message,
+		Message:        message,
 		RestoreSummary: NewWorkSummary(),
 	}
 }
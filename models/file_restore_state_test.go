@@ -8,6 +8,6 @@ import (
 )
 
 func TestNewFileRestoreState(t *testing.T) {
-	restoreState := models.NewFileRestoreState(testutil.MakeNsqMessage("999"))
+	restoreState := models.NewFileRestoreState(testutil.MakeQueueMessage("999"))
 	assert.NotNil(t, restoreState.RestoreSummary)
 }
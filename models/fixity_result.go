@@ -2,17 +2,18 @@ package models
 
 import (
 	"fmt"
-	"github.com/nsqio/go-nsq"
+	"github.com/APTrust/exchange/constants"
 	"strings"
 )
 
 // FixityResult descibes the results of fetching a file from S3
-// and verification of the file's sha256 checksum.
+// and verification of the file's sha256 checksum, along with any
+// sha1 or sha512 checksums Pharos has on record.
 type FixityResult struct {
-	// NSQMessage is the NSQ message being processed in this restore
+	// Message is the queue message being processed in this restore
 	// request. Not serialized because it will change each time we
 	// try to process a request.
-	NSQMessage *nsq.Message `json:"-"`
+	Message QueueMessage `json:"-"`
 	// GenericFile is the generic file whose fixity we're going to check.
 	// This file is sitting somewhere on S3.
 	GenericFile *GenericFile
@@ -21,6 +22,10 @@ type FixityResult struct {
 	// Sha256 contains sha256 digest we calculated after downloading
 	// the file. This will be empty initially.
 	Sha256 string
+	// Digests maps algorithm name to the digest we calculated after
+	// downloading the file. This includes sha256, plus sha1 and
+	// sha512 if Pharos has checksums for those algorithms.
+	Digests map[string]string
 	// Error records the error (if any) that occured while trying to
 	// check fixity.
 	Error error
@@ -31,9 +36,9 @@ type FixityResult struct {
 
 // NewFixityResult returns a new empty FixityResult object for the specified
 // GenericFile.
-func NewFixityResult(message *nsq.Message) *FixityResult {
+func NewFixityResult(message QueueMessage) *FixityResult {
 	return &FixityResult{
-		NSQMessage:   message,
+		Message:      message,
 		S3FileExists: false,
 		ErrorIsFatal: false,
 	}
@@ -56,12 +61,39 @@ func (result *FixityResult) BucketAndKey() (string, string, error) {
 
 // PharosSha256 returns the SHA256 checksum that Pharos has on record.
 func (result *FixityResult) PharosSha256() string {
+	return result.PharosDigest(constants.AlgSha256)
+}
+
+// PharosDigest returns the checksum that Pharos has on record for
+// the specified algorithm, or an empty string if Pharos has none.
+func (result *FixityResult) PharosDigest(algorithm string) string {
 	if result.GenericFile == nil {
 		return ""
 	}
-	checksum := result.GenericFile.GetChecksumByAlgorithm("sha256")
+	checksum := result.GenericFile.GetChecksumByAlgorithm(algorithm)
 	if checksum == nil {
 		return ""
 	}
 	return checksum.Digest
 }
+
+// Algorithms returns the list of algorithms we should check for
+// this file. This is always sha256, plus sha1 and sha512 if Pharos
+// has checksums on record for those algorithms.
+func (result *FixityResult) Algorithms() []string {
+	algorithms := []string{constants.AlgSha256}
+	for _, alg := range []string{constants.AlgSha1, constants.AlgSha512} {
+		if result.PharosDigest(alg) != "" {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	return algorithms
+}
+
+// Digest returns the digest we calculated for the specified algorithm.
+func (result *FixityResult) Digest(algorithm string) string {
+	if algorithm == constants.AlgSha256 && result.Sha256 != "" {
+		return result.Sha256
+	}
+	return result.Digests[algorithm]
+}
@@ -30,7 +30,7 @@ func getGenericFile() *models.GenericFile {
 }
 
 func TestBucketAndKey(t *testing.T) {
-	result := models.NewFixityResult(testutil.MakeNsqMessage("999"))
+	result := models.NewFixityResult(testutil.MakeQueueMessage("999"))
 	result.GenericFile = getGenericFile()
 	bucket, key, err := result.BucketAndKey()
 	if err != nil {
@@ -42,7 +42,7 @@ func TestBucketAndKey(t *testing.T) {
 }
 
 func TestBucketAndKeyWithBadUri(t *testing.T) {
-	result := models.NewFixityResult(testutil.MakeNsqMessage("999"))
+	result := models.NewFixityResult(testutil.MakeQueueMessage("999"))
 	result.GenericFile = getGenericFile()
 	result.GenericFile.URI = "http://example.com"
 	_, _, err := result.BucketAndKey()
@@ -53,7 +53,7 @@ func TestBucketAndKeyWithBadUri(t *testing.T) {
 }
 
 func TestBucketAndKeyWithNilFile(t *testing.T) {
-	result := models.NewFixityResult(testutil.MakeNsqMessage("999"))
+	result := models.NewFixityResult(testutil.MakeQueueMessage("999"))
 	_, _, err := result.BucketAndKey()
 	if err == nil {
 		t.Errorf("BucketAndKey() should have returned an error for missing GenericFile")
@@ -62,9 +62,29 @@ func TestBucketAndKeyWithNilFile(t *testing.T) {
 }
 
 func TestPharosSha256(t *testing.T) {
-	result := models.NewFixityResult(testutil.MakeNsqMessage("999"))
+	result := models.NewFixityResult(testutil.MakeQueueMessage("999"))
 	result.GenericFile = getGenericFile()
 	if result.PharosSha256() != sha256sum {
 		t.Errorf("FedoraSha256() should have returned %s", sha256sum)
 	}
 }
+
+func TestFixityResultAlgorithms(t *testing.T) {
+	result := models.NewFixityResult(testutil.MakeQueueMessage("999"))
+	result.GenericFile = getGenericFile()
+	assert.Equal(t, []string{"sha256"}, result.Algorithms())
+
+	result.GenericFile.Checksums = append(result.GenericFile.Checksums, &models.Checksum{
+		Algorithm: "sha512",
+		DateTime:  time.Date(2014, 11, 11, 12, 0, 0, 0, time.UTC),
+		Digest:    "0123456789abcdef",
+	})
+	assert.Equal(t, []string{"sha256", "sha512"}, result.Algorithms())
+	assert.Equal(t, "0123456789abcdef", result.PharosDigest("sha512"))
+	assert.Equal(t, "", result.PharosDigest("sha1"))
+
+	result.Sha256 = sha256sum
+	result.Digests = map[string]string{"sha512": "0123456789abcdef"}
+	assert.Equal(t, sha256sum, result.Digest("sha256"))
+	assert.Equal(t, "0123456789abcdef", result.Digest("sha512"))
+}
@@ -111,6 +111,23 @@ type GenericFile struct {
 	// It may be empty if we're working with a tar file.
 	IngestLocalPath string `json:"ingest_local_path,omitempty"`
 
+	// IngestTarOffset is the offset, in bytes, of this file's contents
+	// within the bag's tar file. When we validate a bag by streaming it
+	// from the receiving bucket, the storer uses this to read the file
+	// straight from the receiving bucket. Zero means unknown.
+	IngestTarOffset int64 `json:"ingest_tar_offset,omitempty"`
+
+	// IngestBagPart is the name of the tar file this file came from,
+	// if the bag was uploaded in parts, e.g. "my_bag.b02.of05.tar".
+	// It's empty for bags uploaded as a single file.
+	IngestBagPart string `json:"ingest_bag_part,omitempty"`
+
+	// IngestPathInBag is the path of this file within the bag, if
+	// the validator normalized the file name to Unicode NFC and the
+	// normalized name is not the same as the name in the bag. It's
+	// empty when the name in the bag is OriginalPath.
+	IngestPathInBag string `json:"ingest_path_in_bag,omitempty"`
+
 	// IngestManifestMd5 is the md5 checksum of this file, as reported
 	// in the bag's manifest-md5.txt file. This may be empty if there
 	// was no md5 checksum file, or if this generic file wasn't listed
@@ -141,6 +158,12 @@ type GenericFile struct {
 	// matches what's in the manifest.
 	IngestSha256VerifiedAt time.Time `json:"ingest_sha_256_verified_at,omitempty"`
 
+	// IngestDigests holds manifest and calculated digests for
+	// algorithms other than md5 and sha256, such as sha1 and sha512,
+	// keyed by algorithm name. Use the IngestDigest and
+	// IngestManifestDigest methods to get digests for any algorithm.
+	IngestDigests map[string]*IngestDigest `json:"ingest_digests,omitempty"`
+
 	// The UUID assigned to this file. This will be its S3 key when we store it.
 	IngestUUID string `json:"ingest_uuid,omitempty"`
 
@@ -221,6 +244,21 @@ type GenericFile struct {
 	FetchErrorMessage string `json:"fetch_error_message,omitempty"`
 }
 
+// IngestDigest describes the digest of a file for a single
+// algorithm, as reported in the bag's manifest and as calculated
+// at ingest.
+type IngestDigest struct {
+	// Manifest is the digest reported in the bag's manifest.
+	Manifest string `json:"manifest,omitempty"`
+	// Calculated is the digest we calculated from the actual file.
+	Calculated string `json:"calculated,omitempty"`
+	// GeneratedAt is when we calculated the digest.
+	GeneratedAt time.Time `json:"generated_at,omitempty"`
+	// VerifiedAt is when we verified that the calculated digest
+	// matches the manifest.
+	VerifiedAt time.Time `json:"verified_at,omitempty"`
+}
+
 func NewGenericFile() *GenericFile {
 	return &GenericFile{
 		Checksums:                   make([]*Checksum, 0),
@@ -249,6 +287,9 @@ func (gf *GenericFile) Clone() *GenericFile {
 	newFile.StorageOption = gf.StorageOption
 	newFile.IngestFileType = gf.IngestFileType
 	newFile.IngestLocalPath = gf.IngestLocalPath
+	newFile.IngestTarOffset = gf.IngestTarOffset
+	newFile.IngestBagPart = gf.IngestBagPart
+	newFile.IngestPathInBag = gf.IngestPathInBag
 	newFile.IngestManifestMd5 = gf.IngestManifestMd5
 	newFile.IngestMd5 = gf.IngestMd5
 	newFile.IngestMd5GeneratedAt = gf.IngestMd5GeneratedAt
@@ -257,6 +298,13 @@ func (gf *GenericFile) Clone() *GenericFile {
 	newFile.IngestSha256 = gf.IngestSha256
 	newFile.IngestSha256GeneratedAt = gf.IngestSha256GeneratedAt
 	newFile.IngestSha256VerifiedAt = gf.IngestSha256VerifiedAt
+	if gf.IngestDigests != nil {
+		newFile.IngestDigests = make(map[string]*IngestDigest, len(gf.IngestDigests))
+		for alg, digest := range gf.IngestDigests {
+			digestCopy := *digest
+			newFile.IngestDigests[alg] = &digestCopy
+		}
+	}
 	newFile.IngestUUID = gf.IngestUUID
 	newFile.IngestUUIDGeneratedAt = gf.IngestUUIDGeneratedAt
 	newFile.IngestStorageURL = gf.IngestStorageURL
@@ -318,6 +366,28 @@ func (gf *GenericFile) OriginalPathWithBagName() (string, error) {
 	return strings.Replace(gf.Identifier, instIdentifier+"/", "", 1), nil
 }
 
+// PathInArchive returns the path of this file within the tar (or zip)
+// file it came from. That's usually the same as OriginalPathWithBagName,
+// but files from a bag that was uploaded in parts are under a directory
+// named after the part, such as "my_bag.b02.of05/data/file.txt", and
+// files whose names the validator normalized are under IngestPathInBag.
+func (gf *GenericFile) PathInArchive() (string, error) {
+	relPath := gf.OriginalPath()
+	if gf.IngestPathInBag != "" {
+		relPath = gf.IngestPathInBag
+	}
+	if gf.IngestBagPart != "" {
+		partDir := constants.SerializedBagSuffix.ReplaceAllString(gf.IngestBagPart, "")
+		return fmt.Sprintf("%s/%s", partDir, relPath), nil
+	}
+	pathWithBagName, err := gf.OriginalPathWithBagName()
+	if err != nil || gf.IngestPathInBag == "" {
+		return pathWithBagName, err
+	}
+	bagDir := strings.TrimSuffix(pathWithBagName, gf.OriginalPath())
+	return bagDir + relPath, nil
+}
+
 // Returns the name of the institution that owns this file.
 func (gf *GenericFile) InstitutionIdentifier() (string, error) {
 	parts := strings.Split(gf.Identifier, "/")
@@ -340,6 +410,108 @@ func (gf *GenericFile) GetChecksumByAlgorithm(algorithm string) *Checksum {
 	return checksum
 }
 
+// ingestDigest returns the IngestDigest for an algorithm other than
+// md5 or sha256, creating it if necessary.
+func (gf *GenericFile) ingestDigest(algorithm string) *IngestDigest {
+	if gf.IngestDigests == nil {
+		gf.IngestDigests = make(map[string]*IngestDigest)
+	}
+	if gf.IngestDigests[algorithm] == nil {
+		gf.IngestDigests[algorithm] = &IngestDigest{}
+	}
+	return gf.IngestDigests[algorithm]
+}
+
+// IngestManifestDigest returns the digest for the specified algorithm
+// from the bag's manifest, or an empty string if the file did not
+// appear in a manifest for that algorithm.
+func (gf *GenericFile) IngestManifestDigest(algorithm string) string {
+	switch algorithm {
+	case constants.AlgMd5:
+		return gf.IngestManifestMd5
+	case constants.AlgSha256:
+		return gf.IngestManifestSha256
+	}
+	if digest, ok := gf.IngestDigests[algorithm]; ok {
+		return digest.Manifest
+	}
+	return ""
+}
+
+// SetIngestManifestDigest sets the manifest digest for the
+// specified algorithm.
+func (gf *GenericFile) SetIngestManifestDigest(algorithm, digest string) {
+	switch algorithm {
+	case constants.AlgMd5:
+		gf.IngestManifestMd5 = digest
+	case constants.AlgSha256:
+		gf.IngestManifestSha256 = digest
+	default:
+		gf.ingestDigest(algorithm).Manifest = digest
+	}
+}
+
+// IngestDigest returns the digest we calculated at ingest for the
+// specified algorithm, or an empty string if we didn't calculate one.
+func (gf *GenericFile) IngestDigest(algorithm string) string {
+	switch algorithm {
+	case constants.AlgMd5:
+		return gf.IngestMd5
+	case constants.AlgSha256:
+		return gf.IngestSha256
+	}
+	if digest, ok := gf.IngestDigests[algorithm]; ok {
+		return digest.Calculated
+	}
+	return ""
+}
+
+// IngestDigestGeneratedAt returns the time we calculated the
+// digest for the specified algorithm.
+func (gf *GenericFile) IngestDigestGeneratedAt(algorithm string) time.Time {
+	switch algorithm {
+	case constants.AlgMd5:
+		return gf.IngestMd5GeneratedAt
+	case constants.AlgSha256:
+		return gf.IngestSha256GeneratedAt
+	}
+	if digest, ok := gf.IngestDigests[algorithm]; ok {
+		return digest.GeneratedAt
+	}
+	return time.Time{}
+}
+
+// SetIngestDigest sets the digest we calculated for the specified
+// algorithm. Param generatedAt may be zero if the caller doesn't
+// need to track when the digest was calculated.
+func (gf *GenericFile) SetIngestDigest(algorithm, digest string, generatedAt time.Time) {
+	switch algorithm {
+	case constants.AlgMd5:
+		gf.IngestMd5 = digest
+		gf.IngestMd5GeneratedAt = generatedAt
+	case constants.AlgSha256:
+		gf.IngestSha256 = digest
+		gf.IngestSha256GeneratedAt = generatedAt
+	default:
+		ingestDigest := gf.ingestDigest(algorithm)
+		ingestDigest.Calculated = digest
+		ingestDigest.GeneratedAt = generatedAt
+	}
+}
+
+// SetIngestDigestVerifiedAt records when we verified that the digest
+// we calculated for the specified algorithm matches the manifest.
+func (gf *GenericFile) SetIngestDigestVerifiedAt(algorithm string, verifiedAt time.Time) {
+	switch algorithm {
+	case constants.AlgMd5:
+		gf.IngestMd5VerifiedAt = verifiedAt
+	case constants.AlgSha256:
+		gf.IngestSha256VerifiedAt = verifiedAt
+	default:
+		gf.ingestDigest(algorithm).VerifiedAt = verifiedAt
+	}
+}
+
 // Returns the LAST checksum with the given digest for this file.
 func (gf *GenericFile) GetChecksumByDigest(digest string) *Checksum {
 	for _, cs := range gf.Checksums {
@@ -636,62 +808,48 @@ func (gf *GenericFile) buildFileIngestEvent() error {
 // this GenericFile. See the notes for IntellectualObject.BuildIngestEvents,
 // as they all apply here. This call is idempotent, so
 // calling it multiple times will not mess up our data.
+//
+// We always record md5 and sha256 checksums. We record checksums
+// for other algorithms, such as sha1 and sha512, only if the bag's
+// manifests included them, since those are the digests depositors
+// will want to check against later.
 func (gf *GenericFile) BuildIngestChecksums() error {
-	err := gf.buildIngestMd5()
-	if err != nil {
-		return err
-	}
-	err = gf.buildIngestSha256()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Creates the initial md5 Checksum record for this file, if
-// it does not already exist.
-func (gf *GenericFile) buildIngestMd5() error {
-	md5 := gf.GetChecksumByAlgorithm(constants.AlgMd5)
-	if md5 == nil {
-		if len(gf.IngestMd5) != 32 {
-			return fmt.Errorf("Cannot create md5 Checksum object: "+
-				"IngestMd5 '%s' is missing or invalid.", gf.IngestMd5)
-		}
-		if gf.IngestMd5GeneratedAt.IsZero() {
-			return fmt.Errorf("Cannot create md5 Checksum object: " +
-				"IngestMd5GeneratedAt is missing.")
+	for _, algorithm := range constants.ChecksumAlgorithms {
+		required := algorithm == constants.AlgMd5 || algorithm == constants.AlgSha256
+		if !required && (gf.IngestManifestDigest(algorithm) == "" || gf.IngestDigest(algorithm) == "") {
+			continue
 		}
-		md5 = &Checksum{
-			Algorithm:     constants.AlgMd5,
-			DateTime:      gf.IngestMd5GeneratedAt,
-			Digest:        gf.IngestMd5,
-			GenericFileId: gf.Id,
+		err := gf.buildIngestChecksum(algorithm)
+		if err != nil {
+			return err
 		}
-		gf.Checksums = append(gf.Checksums, md5)
 	}
 	return nil
 }
 
-// Creates the initial sha256 Checksum record for this file, if
-// it does not already exist.
-func (gf *GenericFile) buildIngestSha256() error {
-	sha256 := gf.GetChecksumByAlgorithm(constants.AlgSha256)
-	if sha256 == nil {
-		if len(gf.IngestSha256) != 64 {
-			return fmt.Errorf("Cannot create sha256 Checksum object: "+
-				"IngestSha256 '%s' is missing or invalid.", gf.IngestSha256)
+// Creates the initial Checksum record for the specified algorithm,
+// if it does not already exist.
+func (gf *GenericFile) buildIngestChecksum(algorithm string) error {
+	checksum := gf.GetChecksumByAlgorithm(algorithm)
+	if checksum == nil {
+		digest := gf.IngestDigest(algorithm)
+		generatedAt := gf.IngestDigestGeneratedAt(algorithm)
+		if len(digest) != constants.DigestLengths[algorithm] {
+			return fmt.Errorf("Cannot create %s Checksum object: "+
+				"Ingest%s '%s' is missing or invalid.", algorithm,
+				strings.Title(algorithm), digest)
 		}
-		if gf.IngestSha256GeneratedAt.IsZero() {
-			return fmt.Errorf("Cannot create sha256 Checksum object: " +
-				"IngestSha256GeneratedAt is missing.")
+		if generatedAt.IsZero() {
+			return fmt.Errorf("Cannot create %s Checksum object: "+
+				"Ingest%sGeneratedAt is missing.", algorithm, strings.Title(algorithm))
 		}
-		sha256 = &Checksum{
-			Algorithm:     constants.AlgSha256,
-			DateTime:      gf.IngestSha256GeneratedAt,
-			Digest:        gf.IngestSha256,
+		checksum = &Checksum{
+			Algorithm:     algorithm,
+			DateTime:      generatedAt,
+			Digest:        digest,
 			GenericFileId: gf.Id,
 		}
-		gf.Checksums = append(gf.Checksums, sha256)
+		gf.Checksums = append(gf.Checksums, checksum)
 	}
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -74,6 +75,32 @@ func TestOriginalPathWithBagName(t *testing.T) {
 	assert.Equal(t, "cin.675812/custom/tag/dir/special_info.xml", origPath)
 }
 
+func TestPathInArchive(t *testing.T) {
+	genericFile := models.GenericFile{}
+	genericFile.IntellectualObjectIdentifier = "uc.edu/cin.675812"
+	genericFile.Identifier = "uc.edu/cin.675812/data/object.properties"
+	pathInArchive, err := genericFile.PathInArchive()
+	require.Nil(t, err)
+	assert.Equal(t, "cin.675812/data/object.properties", pathInArchive)
+
+	genericFile.IngestBagPart = "cin.675812.b02.of05.tar"
+	pathInArchive, err = genericFile.PathInArchive()
+	require.Nil(t, err)
+	assert.Equal(t, "cin.675812.b02.of05/data/object.properties", pathInArchive)
+
+	// The validator normalized the name of this file to NFC.
+	genericFile.Identifier = "uc.edu/cin.675812/data/caf\u00e9.txt"
+	genericFile.IngestPathInBag = "data/cafe\u0301.txt"
+	pathInArchive, err = genericFile.PathInArchive()
+	require.Nil(t, err)
+	assert.Equal(t, "cin.675812.b02.of05/data/cafe\u0301.txt", pathInArchive)
+
+	genericFile.IngestBagPart = ""
+	pathInArchive, err = genericFile.PathInArchive()
+	require.Nil(t, err)
+	assert.Equal(t, "cin.675812/data/cafe\u0301.txt", pathInArchive)
+}
+
 func TestGetChecksumByAlgorithm(t *testing.T) {
 	filename := filepath.Join("testdata", "json_objects", "intel_obj.json")
 	intelObj, err := testutil.LoadIntelObjFixture(filename)
@@ -492,6 +519,54 @@ func TestBuildIngestChecksums(t *testing.T) {
 	assert.Equal(t, 2, len(gf.Checksums))
 }
 
+func TestBuildIngestChecksums_Sha512(t *testing.T) {
+	gf := testutil.MakeGenericFile(0, 0, "test.edu/test_bag/file.txt")
+	sha512 := strings.Repeat("a", 128)
+	gf.SetIngestManifestDigest(constants.AlgSha512, sha512)
+	gf.SetIngestDigest(constants.AlgSha512, sha512, testutil.TEST_TIMESTAMP)
+	err := gf.BuildIngestChecksums()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(gf.Checksums))
+	checksum := gf.GetChecksumByAlgorithm(constants.AlgSha512)
+	require.NotNil(t, checksum)
+	assert.Equal(t, sha512, checksum.Digest)
+	assert.Equal(t, testutil.TEST_TIMESTAMP, checksum.DateTime)
+	assert.Nil(t, gf.GetChecksumByAlgorithm(constants.AlgSha1))
+}
+
+func TestIngestDigestAccessors(t *testing.T) {
+	gf := models.NewGenericFile()
+	now := time.Now().UTC()
+
+	// md5 and sha256 map to the legacy fields
+	gf.SetIngestManifestDigest(constants.AlgMd5, "manifest-md5")
+	gf.SetIngestDigest(constants.AlgMd5, "file-md5", now)
+	gf.SetIngestDigestVerifiedAt(constants.AlgMd5, now)
+	assert.Equal(t, "manifest-md5", gf.IngestManifestMd5)
+	assert.Equal(t, "file-md5", gf.IngestMd5)
+	assert.Equal(t, now, gf.IngestMd5GeneratedAt)
+	assert.Equal(t, now, gf.IngestMd5VerifiedAt)
+	gf.SetIngestDigest(constants.AlgSha256, "file-sha256", now)
+	assert.Equal(t, "file-sha256", gf.IngestSha256)
+	assert.Equal(t, "file-sha256", gf.IngestDigest(constants.AlgSha256))
+
+	// Other algorithms go into IngestDigests
+	assert.Equal(t, "", gf.IngestDigest(constants.AlgSha512))
+	gf.SetIngestManifestDigest(constants.AlgSha512, "manifest-sha512")
+	gf.SetIngestDigest(constants.AlgSha512, "file-sha512", now)
+	gf.SetIngestDigestVerifiedAt(constants.AlgSha512, now)
+	assert.Equal(t, "manifest-sha512", gf.IngestManifestDigest(constants.AlgSha512))
+	assert.Equal(t, "file-sha512", gf.IngestDigest(constants.AlgSha512))
+	assert.Equal(t, now, gf.IngestDigestGeneratedAt(constants.AlgSha512))
+	require.NotNil(t, gf.IngestDigests[constants.AlgSha512])
+	assert.Equal(t, now, gf.IngestDigests[constants.AlgSha512].VerifiedAt)
+
+	clone := gf.Clone()
+	assert.Equal(t, "file-sha512", clone.IngestDigest(constants.AlgSha512))
+	clone.SetIngestDigest(constants.AlgSha512, "changed", now)
+	assert.Equal(t, "file-sha512", gf.IngestDigest(constants.AlgSha512))
+}
+
 func TestPropagateIdsToChildren(t *testing.T) {
 	// Make a generic file with 6 events and 2 checksums
 	gf := testutil.MakeGenericFile(6, 2, "test.edu/test_bag/file.txt")
@@ -576,6 +651,8 @@ func TestGenericFileClone(t *testing.T) {
 	assert.Equal(t, clone.StorageOption, gf.StorageOption)
 	assert.Equal(t, clone.IngestFileType, gf.IngestFileType)
 	assert.Equal(t, clone.IngestLocalPath, gf.IngestLocalPath)
+	assert.Equal(t, clone.IngestTarOffset, gf.IngestTarOffset)
+	assert.Equal(t, clone.IngestBagPart, gf.IngestBagPart)
 	assert.Equal(t, clone.IngestManifestMd5, gf.IngestManifestMd5)
 	assert.Equal(t, clone.IngestMd5GeneratedAt, gf.IngestMd5GeneratedAt)
 	assert.Equal(t, clone.IngestMd5VerifiedAt, gf.IngestMd5VerifiedAt)
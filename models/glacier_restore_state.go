@@ -2,7 +2,6 @@ package models
 
 import (
 	"fmt"
-	"github.com/nsqio/go-nsq"
 	"time"
 )
 
@@ -18,10 +17,10 @@ import (
 // of files, so workers may have to attempt retrieval initialization
 // several times before all requests succeed.
 type GlacierRestoreState struct {
-	// NSQMessage is the NSQ message being processed in this restore
+	// Message is the queue message being processed in this restore
 	// request. Not serialized because it will change each time we
 	// try to process a request.
-	NSQMessage *nsq.Message `json:"-"`
+	Message QueueMessage `json:"-"`
 	// WorkItem is the Pharos WorkItem we're processing.
 	// Not serialized because the Pharos WorkItem record will be
 	// more up-to-date and authoritative.
@@ -43,9 +42,9 @@ type GlacierRestoreState struct {
 }
 
 // NewGlacierRestoreState creates a new GlacierRestoreState object.
-func NewGlacierRestoreState(message *nsq.Message, workItem *WorkItem) *GlacierRestoreState {
+func NewGlacierRestoreState(message QueueMessage, workItem *WorkItem) *GlacierRestoreState {
 	return &GlacierRestoreState{
-		NSQMessage:  message,
+		Message:     message,
 		WorkItem:    workItem,
 		WorkSummary: NewWorkSummary(),
 		Requests:    make([]*GlacierRestoreRequest, 0),
@@ -33,9 +33,9 @@ func getGlacierRestoreRequest(gfIdentifier string, accepted bool) *models.Glacie
 }
 
 func getGlacierRestoreState() *models.GlacierRestoreState {
-	nsqMessage := testutil.MakeNsqMessage("42")
+	message := testutil.MakeQueueMessage("42")
 	workItem := testutil.MakeWorkItem()
-	return models.NewGlacierRestoreState(nsqMessage, workItem)
+	return models.NewGlacierRestoreState(message, workItem)
 }
 
 func TestNewGlacierRestoreState(t *testing.T) {
@@ -10,10 +10,14 @@ import (
 type IngestManifest struct {
 	WorkItemId int
 	// TODO: Get rid of bucket, key, and etag, since they're in WorkItem
-	S3Bucket       string
-	S3Key          string
-	ETag           string
-	BagPath        string
+	S3Bucket string
+	S3Key    string
+	ETag     string
+	BagPath  string
+	// BagParts lists the local paths of all parts of a bag that was
+	// uploaded in parts (my_bag.b01.of03.tar, etc.), in order. The first
+	// is the same as BagPath. This is empty for single-part bags.
+	BagParts       []string
 	DBPath         string
 	FetchResult    *WorkSummary
 	UntarResult    *WorkSummary
@@ -84,9 +88,24 @@ func (manifest *IngestManifest) ClearAllErrors() {
 	manifest.CleanupResult.ClearErrors()
 }
 
+// AllBagPaths returns the paths of all the tar files that make up
+// the bag. That's BagParts for a multipart bag, or BagPath otherwise.
+func (manifest *IngestManifest) AllBagPaths() []string {
+	if len(manifest.BagParts) > 0 {
+		return manifest.BagParts
+	}
+	return []string{manifest.BagPath}
+}
+
 // BagIsOnDisk returns true if the bag (tar file) exists on disk.
+// For multipart bags, all of the parts must be on disk.
 func (manifest *IngestManifest) BagIsOnDisk() bool {
-	return manifest.BagPath != "" && fileutil.FileExists(manifest.BagPath)
+	for _, bagPath := range manifest.AllBagPaths() {
+		if bagPath == "" || !fileutil.FileExists(bagPath) {
+			return false
+		}
+	}
+	return true
 }
 
 // DBExists returns true if the Bolt DB (.valdb file) exists on disk.
@@ -95,14 +114,19 @@ func (manifest *IngestManifest) DBExists() bool {
 }
 
 // SizeOfBagOnDisk returns the size, in bytes, of the bag on disk.
+// For multipart bags, that's the total size of all the parts.
 // This will return an error if the bag does not exist, or if it is
 // a directory or is inaccessible.
 func (manifest *IngestManifest) SizeOfBagOnDisk() (int64, error) {
-	stat, err := os.Stat(manifest.BagPath)
-	if err != nil {
-		return int64(-1), err
+	size := int64(0)
+	for _, bagPath := range manifest.AllBagPaths() {
+		stat, err := os.Stat(bagPath)
+		if err != nil {
+			return int64(-1), err
+		}
+		size += stat.Size()
 	}
-	return stat.Size(), nil
+	return size, nil
 }
 
 // BagHasBeenValidated returns true if the bag has already been validated.
@@ -1,7 +1,6 @@
 package models
 
 import (
-	"github.com/nsqio/go-nsq"
 	"time"
 )
 
@@ -14,31 +13,31 @@ import (
 // resumed, and whether there's anything (like partial files) that need to be
 // cleaned up.
 type IngestState struct {
-	NSQMessage     *nsq.Message `json:"-"`
+	Message        QueueMessage `json:"-"`
 	WorkItem       *WorkItem
 	WorkItemState  *WorkItemState
 	IngestManifest *IngestManifest
 }
 
-// TouchNSQ tells NSQ we're still working on this item.
-func (ingestState *IngestState) TouchNSQ() {
-	if ingestState.NSQMessage != nil {
-		ingestState.NSQMessage.Touch()
+// TouchMessage tells the queue we're still working on this item.
+func (ingestState *IngestState) TouchMessage() {
+	if ingestState.Message != nil {
+		ingestState.Message.Touch()
 	}
 }
 
-// FinishNSQ tells NSQ we're done with this message.
-func (ingestState *IngestState) FinishNSQ() {
-	if ingestState.NSQMessage != nil {
-		ingestState.NSQMessage.Finish()
+// FinishMessage tells the queue we're done with this message.
+func (ingestState *IngestState) FinishMessage() {
+	if ingestState.Message != nil {
+		ingestState.Message.Finish()
 	}
 }
 
-// RequeueNSQ tells NSQ to give this item to give this item to another
+// RequeueMessage tells the queue to give this item to another
 // worker (or perhaps the same worker) after a delay of at least the
 // specified number of milliseconds.
-func (ingestState *IngestState) RequeueNSQ(milliseconds int) {
-	if ingestState.NSQMessage != nil {
-		ingestState.NSQMessage.Requeue(time.Duration(milliseconds) * time.Millisecond)
+func (ingestState *IngestState) RequeueMessage(milliseconds int) {
+	if ingestState.Message != nil {
+		ingestState.Message.Requeue(time.Duration(milliseconds) * time.Millisecond)
 	}
 }
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/APTrust/exchange/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BagPart is one part of a bag that a depositor uploaded in parts.
+type BagPart struct {
+	// Key is the name of the part in the receiving bucket,
+	// e.g. "my_bag.b02.of05.tar".
+	Key          string
+	ETag         string
+	Size         int64
+	LastModified time.Time
+	// PartNumber and TotalParts come from the .bNN.ofNN suffix.
+	// For the key above, they would be 2 and 5.
+	PartNumber int
+	TotalParts int
+}
+
+// MultipartBag collects the parts of a bag that a depositor uploaded
+// as a series of tar files with names like my_bag.b01.of03.tar,
+// my_bag.b02.of03.tar and my_bag.b03.of03.tar. We ingest all of the
+// parts together as a single IntellectualObject, called my_bag.
+type MultipartBag struct {
+	// BagName is the name of the bag, without the .bNN.ofNN suffix.
+	BagName string
+	Parts   []*BagPart
+}
+
+// NewMultipartBag returns a MultipartBag with no parts.
+func NewMultipartBag(bagName string) *MultipartBag {
+	return &MultipartBag{
+		BagName: bagName,
+		Parts:   make([]*BagPart, 0),
+	}
+}
+
+// AddPart adds the object at key to the set. It returns an error if
+// key doesn't look like one of this bag's parts.
+func (bag *MultipartBag) AddPart(key, etag string, size int64, lastModified time.Time) error {
+	partNumber, totalParts, isMultipart := util.MultipartBagPart(key)
+	if !isMultipart || util.CleanBagName(key) != bag.BagName {
+		return fmt.Errorf("%s is not part of multipart bag %s", key, bag.BagName)
+	}
+	bag.Parts = append(bag.Parts, &BagPart{
+		Key:          key,
+		ETag:         strings.Replace(etag, "\"", "", -1),
+		Size:         size,
+		LastModified: lastModified,
+		PartNumber:   partNumber,
+		TotalParts:   totalParts,
+	})
+	return nil
+}
+
+// SortedParts returns the parts in order of part number.
+func (bag *MultipartBag) SortedParts() []*BagPart {
+	parts := make([]*BagPart, len(bag.Parts))
+	copy(parts, bag.Parts)
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts
+}
+
+// Problems describes anything that keeps us from ingesting this bag:
+// missing parts, duplicate parts, and parts that disagree about how
+// many parts there should be. It returns an empty list if we have
+// exactly one of each part.
+func (bag *MultipartBag) Problems() []string {
+	problems := make([]string, 0)
+	if len(bag.Parts) == 0 {
+		return append(problems, fmt.Sprintf("Multipart bag %s has no parts.", bag.BagName))
+	}
+	parts := bag.SortedParts()
+	totalParts := 0
+	partsByNumber := make(map[int][]string)
+	for _, part := range parts {
+		if part.TotalParts > totalParts {
+			totalParts = part.TotalParts
+		}
+		partsByNumber[part.PartNumber] = append(partsByNumber[part.PartNumber], part.Key)
+	}
+	for _, part := range parts {
+		if part.TotalParts != totalParts {
+			problems = append(problems, fmt.Sprintf(
+				"Part %s says bag %s has %d parts, but other parts say it has %d.",
+				part.Key, bag.BagName, part.TotalParts, totalParts))
+		}
+		if part.PartNumber < 1 || part.PartNumber > totalParts {
+			problems = append(problems, fmt.Sprintf(
+				"Part %s has part number %d, but bag %s has %d parts.",
+				part.Key, part.PartNumber, bag.BagName, totalParts))
+		}
+	}
+	for i := 1; i <= totalParts; i++ {
+		keys := partsByNumber[i]
+		if len(keys) == 0 {
+			problems = append(problems, fmt.Sprintf(
+				"Multipart bag %s is missing part %d of %d.", bag.BagName, i, totalParts))
+		} else if len(keys) > 1 {
+			problems = append(problems, fmt.Sprintf(
+				"Multipart bag %s has more than one part %d: %s.",
+				bag.BagName, i, strings.Join(keys, ", ")))
+		}
+	}
+	return problems
+}
+
+// IsComplete returns true if we have exactly one of each part.
+func (bag *MultipartBag) IsComplete() bool {
+	return len(bag.Problems()) == 0
+}
+
+// FirstPartKey returns the key of part one. The ingest WorkItem for
+// the bag uses this as its name. This returns an empty string if
+// part one hasn't arrived.
+func (bag *MultipartBag) FirstPartKey() string {
+	for _, part := range bag.SortedParts() {
+		if part.PartNumber == 1 {
+			return part.Key
+		}
+	}
+	return ""
+}
+
+// Size returns the total size of all parts.
+func (bag *MultipartBag) Size() int64 {
+	size := int64(0)
+	for _, part := range bag.Parts {
+		size += part.Size
+	}
+	return size
+}
+
+// LastModified returns the time the most recent part was uploaded.
+func (bag *MultipartBag) LastModified() time.Time {
+	lastModified := time.Time{}
+	for _, part := range bag.Parts {
+		if part.LastModified.After(lastModified) {
+			lastModified = part.LastModified
+		}
+	}
+	return lastModified
+}
+
+// ETag returns an md5 digest of the ETags of all of the parts, in order.
+// This changes if the depositor replaces any part, so it works like the
+// ETag of a single-part bag when we're checking whether a WorkItem
+// describes the version of the bag that's in the receiving bucket.
+func (bag *MultipartBag) ETag() string {
+	hash := md5.New()
+	for _, part := range bag.SortedParts() {
+		hash.Write([]byte(part.Key + ":" + part.ETag + "\n"))
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
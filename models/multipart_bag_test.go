@@ -0,0 +1,83 @@
+package models_test
+
+import (
+	"github.com/APTrust/exchange/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMultipartBagAddPart(t *testing.T) {
+	bag := models.NewMultipartBag("my_bag")
+	now := time.Now().UTC()
+	require.Nil(t, bag.AddPart("my_bag.b02.of02.tar", "\"etag2\"", 200, now))
+	require.Nil(t, bag.AddPart("my_bag.b01.of02.tar", "etag1", 100, now.Add(-1*time.Hour)))
+	assert.NotNil(t, bag.AddPart("other_bag.b01.of02.tar", "etag", 100, now))
+	assert.NotNil(t, bag.AddPart("my_bag.tar", "etag", 100, now))
+
+	parts := bag.SortedParts()
+	require.Equal(t, 2, len(parts))
+	assert.Equal(t, "my_bag.b01.of02.tar", parts[0].Key)
+	assert.Equal(t, 1, parts[0].PartNumber)
+	assert.Equal(t, 2, parts[0].TotalParts)
+	assert.Equal(t, "etag2", parts[1].ETag)
+
+	assert.Equal(t, "my_bag.b01.of02.tar", bag.FirstPartKey())
+	assert.Equal(t, int64(300), bag.Size())
+	assert.Equal(t, now, bag.LastModified())
+	assert.True(t, bag.IsComplete())
+	assert.Empty(t, bag.Problems())
+}
+
+func TestMultipartBagProblems(t *testing.T) {
+	now := time.Now().UTC()
+	bag := models.NewMultipartBag("my_bag")
+	assert.Equal(t, []string{"Multipart bag my_bag has no parts."}, bag.Problems())
+
+	bag.AddPart("my_bag.b02.of03.tar", "etag2", 100, now)
+	assert.False(t, bag.IsComplete())
+	assert.Equal(t, "", bag.FirstPartKey())
+	assert.Equal(t, []string{
+		"Multipart bag my_bag is missing part 1 of 3.",
+		"Multipart bag my_bag is missing part 3 of 3.",
+	}, bag.Problems())
+
+	bag = models.NewMultipartBag("my_bag")
+	bag.AddPart("my_bag.b01.of02.tar", "etag1", 100, now)
+	bag.AddPart("my_bag.b1.of2.tar", "etag1", 100, now)
+	bag.AddPart("my_bag.b02.of02.tar", "etag2", 100, now)
+	assert.Equal(t, []string{
+		"Multipart bag my_bag has more than one part 1: my_bag.b01.of02.tar, my_bag.b1.of2.tar.",
+	}, bag.Problems())
+
+	bag = models.NewMultipartBag("my_bag")
+	bag.AddPart("my_bag.b01.of02.tar", "etag1", 100, now)
+	bag.AddPart("my_bag.b02.of03.tar", "etag2", 100, now)
+	bag.AddPart("my_bag.b03.of03.tar", "etag3", 100, now)
+	bag.AddPart("my_bag.b04.of03.tar", "etag4", 100, now)
+	assert.Equal(t, []string{
+		"Part my_bag.b01.of02.tar says bag my_bag has 2 parts, but other parts say it has 3.",
+		"Part my_bag.b04.of03.tar has part number 4, but bag my_bag has 3 parts.",
+	}, bag.Problems())
+}
+
+func TestMultipartBagETag(t *testing.T) {
+	now := time.Now().UTC()
+	bag1 := models.NewMultipartBag("my_bag")
+	bag1.AddPart("my_bag.b01.of02.tar", "etag1", 100, now)
+	bag1.AddPart("my_bag.b02.of02.tar", "etag2", 100, now)
+
+	// Order of arrival doesn't matter.
+	bag2 := models.NewMultipartBag("my_bag")
+	bag2.AddPart("my_bag.b02.of02.tar", "etag2", 100, now)
+	bag2.AddPart("my_bag.b01.of02.tar", "etag1", 100, now)
+	assert.Equal(t, bag1.ETag(), bag2.ETag())
+	assert.Equal(t, 32, len(bag1.ETag()))
+
+	// Replacing a part changes the ETag.
+	bag3 := models.NewMultipartBag("my_bag")
+	bag3.AddPart("my_bag.b01.of02.tar", "etag1", 100, now)
+	bag3.AddPart("my_bag.b02.of02.tar", "new_etag2", 100, now)
+	assert.NotEqual(t, bag1.ETag(), bag3.ETag())
+}
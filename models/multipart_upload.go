@@ -0,0 +1,143 @@
+package models
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MultipartUpload records the progress of a multipart upload to S3,
+// Glacier or another storage backend. The storer saves this in the
+// bag's BoltDB after each part, so that if the worker crashes or the
+// item is requeued, the next attempt can resume from the last part
+// that was stored, rather than re-sending the whole file.
+type MultipartUpload struct {
+	// Region, Bucket and Key describe where the object is going.
+	// Region may be empty for backends that don't use it.
+	Region string
+	Bucket string
+	Key    string
+	// UploadId is the id the storage service assigned to this upload.
+	// It's empty until the service has created the upload.
+	UploadId string
+	// FileSize is the total size of the file being uploaded.
+	FileSize int64
+	// PartSize is the size of every part except the last.
+	PartSize int64
+	// Parts lists the parts uploaded so far, in order.
+	Parts []*UploadPart
+	// CreatedAt is when we started this upload.
+	CreatedAt time.Time
+}
+
+// UploadPart describes one part of a multipart upload that the
+// storage service has accepted.
+type UploadPart struct {
+	PartNumber int64
+	ETag       string
+	Size       int64
+}
+
+// NewMultipartUpload returns a new MultipartUpload with no parts.
+func NewMultipartUpload(bucket, key string, fileSize, partSize int64) *MultipartUpload {
+	return &MultipartUpload{
+		Bucket:    bucket,
+		Key:       key,
+		FileSize:  fileSize,
+		PartSize:  partSize,
+		Parts:     make([]*UploadPart, 0),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Matches returns true if this upload is sending a file of fileSize
+// bytes to bucket/key. If it doesn't match, the upload is stale, and
+// we should abort it and start over.
+func (upload *MultipartUpload) Matches(bucket, key string, fileSize int64) bool {
+	return upload.Bucket == bucket && upload.Key == key && upload.FileSize == fileSize
+}
+
+// AddPart records a part the storage service has accepted.
+func (upload *MultipartUpload) AddPart(partNumber int64, etag string, size int64) {
+	upload.Parts = append(upload.Parts, &UploadPart{
+		PartNumber: partNumber,
+		ETag:       etag,
+		Size:       size,
+	})
+}
+
+// HasPart returns true if the storage service has accepted
+// the part with this number.
+func (upload *MultipartUpload) HasPart(partNumber int64) bool {
+	for _, part := range upload.Parts {
+		if part.PartNumber == partNumber {
+			return true
+		}
+	}
+	return false
+}
+
+// PartCount returns the number of parts it takes to upload the
+// whole file.
+func (upload *MultipartUpload) PartCount() int64 {
+	if upload.PartSize < 1 {
+		return 0
+	}
+	return (upload.FileSize + upload.PartSize - 1) / upload.PartSize
+}
+
+// SortedParts returns the uploaded parts in order of part number.
+// Parts uploaded in parallel may finish in any order, but the
+// storage service needs them in order to complete the upload.
+func (upload *MultipartUpload) SortedParts() []*UploadPart {
+	parts := make([]*UploadPart, len(upload.Parts))
+	copy(parts, upload.Parts)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts
+}
+
+// ETag returns the ETag S3 gives an object assembled from the uploaded
+// parts, which is the md5 digest of the parts' md5 digests, followed by
+// a dash and the number of parts. This matches S3 only if each part's
+// ETag is its md5 digest, which is the case unless the bucket uses
+// SSE-KMS encryption.
+func (upload *MultipartUpload) ETag() string {
+	return MultipartETag(upload.SortedParts())
+}
+
+// MultipartETag returns the ETag S3 gives an object assembled from
+// parts, which must be in order.
+func MultipartETag(parts []*UploadPart) string {
+	hash := md5.New()
+	for _, part := range parts {
+		digest, err := hex.DecodeString(part.ETag)
+		if err != nil {
+			return ""
+		}
+		hash.Write(digest)
+	}
+	return fmt.Sprintf("%x-%d", hash.Sum(nil), len(parts))
+}
+
+// NextPartNumber returns the number of the next part to upload.
+// Part numbers start at one.
+func (upload *MultipartUpload) NextPartNumber() int64 {
+	return int64(len(upload.Parts) + 1)
+}
+
+// BytesUploaded returns the number of bytes in all uploaded parts.
+// This is the offset in the file where the next part starts.
+func (upload *MultipartUpload) BytesUploaded() int64 {
+	total := int64(0)
+	for _, part := range upload.Parts {
+		total += part.Size
+	}
+	return total
+}
+
+// IsComplete returns true if all of the file's bytes have been uploaded.
+func (upload *MultipartUpload) IsComplete() bool {
+	return upload.BytesUploaded() >= upload.FileSize
+}
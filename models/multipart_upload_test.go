@@ -0,0 +1,74 @@
+package models_test
+
+import (
+	"github.com/APTrust/exchange/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewMultipartUpload(t *testing.T) {
+	upload := models.NewMultipartUpload("bucket", "key", 250, 100)
+	assert.Equal(t, "bucket", upload.Bucket)
+	assert.Equal(t, "key", upload.Key)
+	assert.Equal(t, int64(250), upload.FileSize)
+	assert.Equal(t, int64(100), upload.PartSize)
+	assert.Empty(t, upload.UploadId)
+	assert.Empty(t, upload.Parts)
+	assert.False(t, upload.CreatedAt.IsZero())
+}
+
+func TestMultipartUploadParts(t *testing.T) {
+	upload := models.NewMultipartUpload("bucket", "key", 250, 100)
+	assert.Equal(t, int64(1), upload.NextPartNumber())
+	assert.Equal(t, int64(0), upload.BytesUploaded())
+	assert.False(t, upload.IsComplete())
+
+	upload.AddPart(1, "etag1", 100)
+	upload.AddPart(2, "etag2", 100)
+	assert.Equal(t, int64(3), upload.NextPartNumber())
+	assert.Equal(t, int64(200), upload.BytesUploaded())
+	assert.False(t, upload.IsComplete())
+
+	upload.AddPart(3, "etag3", 50)
+	assert.Equal(t, int64(250), upload.BytesUploaded())
+	assert.True(t, upload.IsComplete())
+}
+
+func TestMultipartUploadMatches(t *testing.T) {
+	upload := models.NewMultipartUpload("bucket", "key", 250, 100)
+	assert.True(t, upload.Matches("bucket", "key", 250))
+	assert.False(t, upload.Matches("other", "key", 250))
+	assert.False(t, upload.Matches("bucket", "other", 250))
+	assert.False(t, upload.Matches("bucket", "key", 251))
+}
+
+func TestMultipartUploadOutOfOrder(t *testing.T) {
+	upload := models.NewMultipartUpload("bucket", "key", 250, 100)
+	assert.Equal(t, int64(3), upload.PartCount())
+	upload.AddPart(3, "c4ca4238a0b923820dcc509a6f75849b", 50)
+	upload.AddPart(1, "c81e728d9d4c2f636f067f89cc14862c", 100)
+	assert.True(t, upload.HasPart(1))
+	assert.False(t, upload.HasPart(2))
+	assert.True(t, upload.HasPart(3))
+	assert.False(t, upload.IsComplete())
+
+	upload.AddPart(2, "eccbc87e4b5ce2fe28308fd9f2a7baf3", 100)
+	assert.True(t, upload.IsComplete())
+	parts := upload.SortedParts()
+	require.Equal(t, 3, len(parts))
+	for i, part := range parts {
+		assert.Equal(t, int64(i+1), part.PartNumber)
+	}
+	assert.Equal(t, int64(3), upload.Parts[0].PartNumber, "SortedParts should not reorder Parts")
+}
+
+func TestMultipartETag(t *testing.T) {
+	// Parts are "hello" and "world".
+	parts := []*models.UploadPart{
+		{PartNumber: 1, ETag: "5d41402abc4b2a76b9719d911017c592"},
+		{PartNumber: 2, ETag: "7d793037a0760186574b0282f2f435e7"},
+	}
+	assert.Equal(t, "065947336a2f2a95ba8899f3675c3be6-2", models.MultipartETag(parts))
+	assert.Equal(t, "", models.MultipartETag([]*models.UploadPart{{PartNumber: 1, ETag: "not-hex"}}))
+}
@@ -196,19 +196,14 @@ func NewEventGenericFileFixityCheck(checksumVerifiedAt time.Time, fixityAlg, dig
 	if !util.StringListContains(constants.ChecksumAlgorithms, fixityAlg) {
 		return nil, fmt.Errorf("Param fixityAlg '%s' is not valid.", fixityAlg)
 	}
-	if len(digest) != 32 && len(digest) != 64 {
-		return nil, fmt.Errorf("Param digest must have 32 or 64 characters. '%s' doesn't.",
+	if !validDigestLength(digest) {
+		return nil, fmt.Errorf("Param digest must have 32, 40, 64 or 128 characters. '%s' doesn't.",
 			digest)
 	}
 	eventId := uuid.New()
-	object := "Go language crypto/md5"
-	agent := "http://golang.org/pkg/crypto/md5/"
+	object, agent := digestObjectAndAgent(fixityAlg)
 	outcomeInformation := "Fixity matches"
 	outcome := string(constants.StatusSuccess)
-	if fixityAlg == constants.AlgSha256 {
-		object = "Go language crypto/sha256"
-		agent = "http://golang.org/pkg/crypto/sha256/"
-	}
 	if fixityMatched == false {
 		outcome = string(constants.StatusFailed)
 		outcomeInformation = "Fixity did not match"
@@ -226,6 +221,25 @@ func NewEventGenericFileFixityCheck(checksumVerifiedAt time.Time, fixityAlg, dig
 	}, nil
 }
 
+// validDigestLength returns true if digest has the length of
+// a hex-encoded digest for one of our supported algorithms.
+func validDigestLength(digest string) bool {
+	for _, length := range constants.DigestLengths {
+		if len(digest) == length {
+			return true
+		}
+	}
+	return false
+}
+
+// digestObjectAndAgent returns the PremisEvent object and agent
+// describing the Go library that calculates digests for fixityAlg.
+func digestObjectAndAgent(fixityAlg string) (object, agent string) {
+	object = fmt.Sprintf("Go language crypto/%s", fixityAlg)
+	agent = fmt.Sprintf("http://golang.org/pkg/crypto/%s/", fixityAlg)
+	return object, agent
+}
+
 // We generated a sha256 checksum.
 func NewEventGenericFileDigestCalculation(checksumGeneratedAt time.Time, fixityAlg, digest string) (*PremisEvent, error) {
 	if checksumGeneratedAt.IsZero() {
@@ -234,17 +248,12 @@ func NewEventGenericFileDigestCalculation(checksumGeneratedAt time.Time, fixityA
 	if !util.StringListContains(constants.ChecksumAlgorithms, fixityAlg) {
 		return nil, fmt.Errorf("Param fixityAlg '%s' is not valid.", fixityAlg)
 	}
-	if len(digest) != 32 && len(digest) != 64 {
-		return nil, fmt.Errorf("Param digest must have 32 or 64 characters. '%s' doesn't.",
+	if !validDigestLength(digest) {
+		return nil, fmt.Errorf("Param digest must have 32, 40, 64 or 128 characters. '%s' doesn't.",
 			digest)
 	}
 	eventId := uuid.New()
-	object := "Go language crypto/md5"
-	agent := "http://golang.org/pkg/crypto/md5/"
-	if fixityAlg == constants.AlgSha256 {
-		object = "Go language crypto/sha256"
-		agent = "http://golang.org/pkg/crypto/sha256/"
-	}
+	object, agent := digestObjectAndAgent(fixityAlg)
 	return &PremisEvent{
 		Identifier:         eventId.String(),
 		EventType:          constants.EventDigestCalculation,
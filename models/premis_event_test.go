@@ -255,6 +255,18 @@ func TestNewEventGenericFileDigestCalculation(t *testing.T) {
 	assert.Equal(t, "Go language crypto/sha256", event.Object)
 	assert.Equal(t, "http://golang.org/pkg/crypto/sha256/", event.Agent)
 	assert.Equal(t, "Calculated fixity value", event.OutcomeInformation)
+
+	event, err = models.NewEventGenericFileDigestCalculation(testutil.TEST_TIMESTAMP, constants.AlgSha512, digest)
+	if err != nil {
+		t.Errorf("Error creating PremisEvent: %v", err)
+		return
+	}
+	assert.Equal(t, "sha512:"+digest, event.OutcomeDetail)
+	assert.Equal(t, "Go language crypto/sha512", event.Object)
+	assert.Equal(t, "http://golang.org/pkg/crypto/sha512/", event.Agent)
+
+	_, err = models.NewEventGenericFileDigestCalculation(testutil.TEST_TIMESTAMP, constants.AlgSha1, "1234")
+	assert.NotNil(t, err)
 }
 
 func TestNewEventGenericFileIdentifierAssignment(t *testing.T) {
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+)
+
+// QueueMessage is a message a worker receives from a queue. Workers
+// and the state objects that carry a message through the pipeline
+// use this instead of the queue's own message type, so they work the
+// same way with NSQ and with the embedded queue.
+type QueueMessage interface {
+	// ID returns the queue's identifier for this message.
+	ID() string
+	// Body returns the message body. For most workers, this is
+	// a WorkItem id in string format.
+	Body() []byte
+	// Attempts returns the number of times the queue has delivered
+	// this message, including the current delivery.
+	Attempts() uint16
+	// Touch tells the queue the worker is still working on this
+	// message, so it doesn't time out and go to another worker.
+	Touch()
+	// Finish tells the queue the worker is done with this message.
+	Finish()
+	// Requeue tells the queue to deliver this message again after
+	// delay. A negative delay means use the queue's default, which
+	// grows with the number of attempts.
+	Requeue(delay time.Duration)
+	// RequeueWithoutBackoff is like Requeue, but it does not cause
+	// the queue to slow down delivery of other messages.
+	RequeueWithoutBackoff(delay time.Duration)
+	// DisableAutoResponse says the worker will call Finish or Requeue
+	// itself. Otherwise, the queue finishes the message when the handler
+	// returns nil, and requeues it when the handler returns an error.
+	DisableAutoResponse()
+	// HasResponded returns true if the message has been finished
+	// or requeued.
+	HasResponded() bool
+}
@@ -1,7 +1,6 @@
 package models
 
 import (
-	"github.com/nsqio/go-nsq"
 	"time"
 )
 
@@ -9,10 +8,10 @@ import (
 // operation. This entire structure will be converted to JSON and saved
 // as a WorkItemState object in Pharos.
 type RestoreState struct {
-	// NSQMessage is the NSQ message being processed in this restore
+	// Message is the queue message being processed in this restore
 	// request. Not serialized because it will change each time we
 	// try to process a request.
-	NSQMessage *nsq.Message `json:"-"`
+	Message QueueMessage `json:"-"`
 	// WorkItem is the Pharos WorkItem we're processing.
 	// Not serialized because the Pharos WorkItem record will be
 	// more up-to-date and authoritative.
@@ -66,9 +65,9 @@ type RestoreState struct {
 
 // NewRestoreState creates a new RestoreState object with empty
 // PackageSummary, RestoreSummary, and ValidationSummary.
-func NewRestoreState(message *nsq.Message) *RestoreState {
+func NewRestoreState(message QueueMessage) *RestoreState {
 	return &RestoreState{
-		NSQMessage:      message,
+		Message:         message,
 		PackageSummary:  NewWorkSummary(),
 		ValidateSummary: NewWorkSummary(),
 		RecordSummary:   NewWorkSummary(),
@@ -125,25 +124,25 @@ func (restoreState *RestoreState) MostRecentSummary() *WorkSummary {
 	return summary
 }
 
-// TouchNSQ tells NSQ we're still working on this item.
-func (restoreState *RestoreState) TouchNSQ() {
-	if restoreState.NSQMessage != nil {
-		restoreState.NSQMessage.Touch()
+// TouchMessage tells the queue we're still working on this item.
+func (restoreState *RestoreState) TouchMessage() {
+	if restoreState.Message != nil {
+		restoreState.Message.Touch()
 	}
 }
 
-// FinishNSQ tells NSQ we're done with this message.
-func (restoreState *RestoreState) FinishNSQ() {
-	if restoreState.NSQMessage != nil {
-		restoreState.NSQMessage.Finish()
+// FinishMessage tells the queue we're done with this message.
+func (restoreState *RestoreState) FinishMessage() {
+	if restoreState.Message != nil {
+		restoreState.Message.Finish()
 	}
 }
 
-// RequeueNSQ tells NSQ to give this item to give this item to another
+// RequeueMessage tells the queue to give this item to another
 // worker (or perhaps the same worker) after a delay of at least the
 // specified number of milliseconds.
-func (restoreState *RestoreState) RequeueNSQ(milliseconds int) {
-	if restoreState.NSQMessage != nil {
-		restoreState.NSQMessage.Requeue(time.Duration(milliseconds) * time.Millisecond)
+func (restoreState *RestoreState) RequeueMessage(milliseconds int) {
+	if restoreState.Message != nil {
+		restoreState.Message.Requeue(time.Duration(milliseconds) * time.Millisecond)
 	}
 }
@@ -8,7 +8,7 @@ import (
 )
 
 func TestNewRestoreState(t *testing.T) {
-	restoreState := models.NewRestoreState(testutil.MakeNsqMessage("999"))
+	restoreState := models.NewRestoreState(testutil.MakeQueueMessage("999"))
 	assert.NotNil(t, restoreState.PackageSummary)
 	assert.NotNil(t, restoreState.ValidateSummary)
 	assert.NotNil(t, restoreState.CopySummary)
@@ -16,7 +16,7 @@ func TestNewRestoreState(t *testing.T) {
 }
 
 func TestRestoreState_HasErrors(t *testing.T) {
-	restoreState := models.NewRestoreState(testutil.MakeNsqMessage("999"))
+	restoreState := models.NewRestoreState(testutil.MakeQueueMessage("999"))
 	assert.False(t, restoreState.HasErrors())
 
 	restoreState.PackageSummary.AddError("error")
@@ -41,7 +41,7 @@ func TestRestoreState_HasErrors(t *testing.T) {
 }
 
 func TestRestoreState_HasFatalErrors(t *testing.T) {
-	restoreState := models.NewRestoreState(testutil.MakeNsqMessage("999"))
+	restoreState := models.NewRestoreState(testutil.MakeQueueMessage("999"))
 	assert.False(t, restoreState.HasFatalErrors())
 
 	restoreState.PackageSummary.ErrorIsFatal = true
@@ -66,7 +66,7 @@ func TestRestoreState_HasFatalErrors(t *testing.T) {
 }
 
 func TestRestoreState_AllErrorsAsString(t *testing.T) {
-	restoreState := models.NewRestoreState(testutil.MakeNsqMessage("999"))
+	restoreState := models.NewRestoreState(testutil.MakeQueueMessage("999"))
 	assert.False(t, restoreState.HasErrors())
 
 	restoreState.PackageSummary.AddError("error 1")
@@ -81,7 +81,7 @@ func TestRestoreState_AllErrorsAsString(t *testing.T) {
 }
 
 func TestRestoreState_MostRecentSummary(t *testing.T) {
-	restoreState := models.NewRestoreState(testutil.MakeNsqMessage("999"))
+	restoreState := models.NewRestoreState(testutil.MakeQueueMessage("999"))
 	assert.Equal(t, restoreState.PackageSummary, restoreState.MostRecentSummary())
 	restoreState.ValidateSummary.Start()
 	assert.Equal(t, restoreState.ValidateSummary, restoreState.MostRecentSummary())
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Event is an S3 event notification, which S3 sends to an SQS queue,
+// an SNS topic or, for S3-compatible services such as MinIO, a webhook
+// when something happens in a bucket. See
+// https://docs.aws.amazon.com/AmazonS3/latest/dev/notification-content-structure.html
+//
+// S3 sends a test event with no Records when you set up notifications
+// for a bucket.
+type S3Event struct {
+	Records []*S3EventRecord `json:"Records"`
+}
+
+// S3EventRecord describes one thing that happened to one object.
+type S3EventRecord struct {
+	EventVersion string    `json:"eventVersion"`
+	EventSource  string    `json:"eventSource"`
+	AWSRegion    string    `json:"awsRegion"`
+	EventTime    time.Time `json:"eventTime"`
+	EventName    string    `json:"eventName"`
+	S3           S3Entity  `json:"s3"`
+}
+
+// S3Entity is the bucket and object in an S3EventRecord.
+type S3Entity struct {
+	Bucket S3EventBucket `json:"bucket"`
+	Object S3EventObject `json:"object"`
+}
+
+// S3EventBucket is the bucket in an S3EventRecord.
+type S3EventBucket struct {
+	Name string `json:"name"`
+}
+
+// S3EventObject is the object in an S3EventRecord. The Key is URL
+// encoded. Use S3EventRecord.ObjectKey to get the real key.
+type S3EventObject struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"eTag"`
+	VersionId string `json:"versionId"`
+	Sequencer string `json:"sequencer"`
+}
+
+// snsEnvelope is the wrapper SNS puts around a notification when it
+// passes the notification on to an SQS queue.
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// ParseS3Event parses an S3 event notification. If the notification
+// came through SNS, it's wrapped in an SNS envelope, which this
+// removes.
+func ParseS3Event(data []byte) (*S3Event, error) {
+	envelope := &snsEnvelope{}
+	err := json.Unmarshal(data, envelope)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse S3 event: %v", err)
+	}
+	if envelope.Type == "Notification" && envelope.Message != "" {
+		data = []byte(envelope.Message)
+	}
+	event := &S3Event{}
+	err = json.Unmarshal(data, event)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse S3 event: %v", err)
+	}
+	return event, nil
+}
+
+// IsObjectCreated returns true if this record says an object was
+// uploaded or copied into a bucket. AWS event names look like
+// "ObjectCreated:Put". MinIO's look like "s3:ObjectCreated:Put".
+func (record *S3EventRecord) IsObjectCreated() bool {
+	return strings.HasPrefix(strings.TrimPrefix(record.EventName, "s3:"), "ObjectCreated:")
+}
+
+// ObjectKey returns the decoded key of the object. S3 encodes keys the
+// way HTML forms do, so a space comes through as a plus sign.
+func (record *S3EventRecord) ObjectKey() (string, error) {
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		return "", fmt.Errorf("Cannot decode key '%s': %v", record.S3.Object.Key, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,84 @@
+package models_test
+
+import (
+	"encoding/json"
+	"github.com/APTrust/exchange/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+const s3EventJson = `{
+  "Records": [{
+    "eventVersion": "2.1",
+    "eventSource": "aws:s3",
+    "awsRegion": "us-east-1",
+    "eventTime": "2020-10-05T14:21:09.123Z",
+    "eventName": "ObjectCreated:Put",
+    "s3": {
+      "s3SchemaVersion": "1.0",
+      "bucket": {"name": "aptrust.receiving.test.edu"},
+      "object": {
+        "key": "my+bag%281%29.tar",
+        "size": 12800,
+        "eTag": "0bbfb6d4a81c6c2771b8c94b619dcb88",
+        "sequencer": "005F7B2D55D8A1D4B7"
+      }
+    }
+  }]
+}`
+
+func TestParseS3Event(t *testing.T) {
+	event, err := models.ParseS3Event([]byte(s3EventJson))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(event.Records))
+	record := event.Records[0]
+	assert.True(t, record.IsObjectCreated())
+	assert.Equal(t, "us-east-1", record.AWSRegion)
+	assert.Equal(t, time.Date(2020, 10, 5, 14, 21, 9, 123000000, time.UTC), record.EventTime)
+	assert.Equal(t, "aptrust.receiving.test.edu", record.S3.Bucket.Name)
+	assert.EqualValues(t, 12800, record.S3.Object.Size)
+	assert.Equal(t, "0bbfb6d4a81c6c2771b8c94b619dcb88", record.S3.Object.ETag)
+	key, err := record.ObjectKey()
+	require.Nil(t, err)
+	assert.Equal(t, "my bag(1).tar", key)
+
+	// Same event, delivered to SQS through SNS.
+	envelope, err := json.Marshal(map[string]string{
+		"Type":    "Notification",
+		"Message": s3EventJson,
+	})
+	require.Nil(t, err)
+	event, err = models.ParseS3Event(envelope)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(event.Records))
+	assert.Equal(t, "aptrust.receiving.test.edu", event.Records[0].S3.Bucket.Name)
+
+	// S3 sends this when you turn on notifications.
+	event, err = models.ParseS3Event([]byte(`{"Service":"Amazon S3","Event":"s3:TestEvent"}`))
+	require.Nil(t, err)
+	assert.Empty(t, event.Records)
+
+	_, err = models.ParseS3Event([]byte("This isn't JSON"))
+	assert.NotNil(t, err)
+}
+
+func TestS3EventRecordIsObjectCreated(t *testing.T) {
+	record := &models.S3EventRecord{}
+	for _, name := range []string{"ObjectCreated:Put", "ObjectCreated:CompleteMultipartUpload", "s3:ObjectCreated:Copy"} {
+		record.EventName = name
+		assert.True(t, record.IsObjectCreated(), name)
+	}
+	for _, name := range []string{"ObjectRemoved:Delete", "s3:ObjectAccessed:Get", ""} {
+		record.EventName = name
+		assert.False(t, record.IsObjectCreated(), name)
+	}
+}
+
+func TestS3EventRecordObjectKey(t *testing.T) {
+	record := &models.S3EventRecord{}
+	record.S3.Object.Key = "bad%zzkey.tar"
+	_, err := record.ObjectKey()
+	assert.NotNil(t, err)
+}
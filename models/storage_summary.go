@@ -23,6 +23,13 @@ type StorageSummary struct {
 	// bag being processed. This will usually be empty, since we
 	// process bags while they're still tarred.
 	UntarredPath string
+	// S3Bucket and S3Key describe where the bag is in the receiving
+	// bucket, and ETag is the ETag of the version we validated. If
+	// TarFilePath isn't on local disk, because we validated the bag
+	// by streaming it, the storer reads files from here.
+	S3Bucket string
+	S3Key    string
+	ETag     string
 	// GenericFile is the file to be saved in S3/Glacier. The storage
 	// goroutine will update this object directly.
 	GenericFile *GenericFile
@@ -0,0 +1,663 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/metrics"
+	"github.com/APTrust/exchange/models"
+	"github.com/boltdb/bolt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each topic is a bucket in the BoltDB file, with three buckets
+// inside it. The messages bucket holds a boltQueueRecord for each
+// message, keyed by sequence number. The ready bucket indexes messages
+// that are waiting for delivery by the time they become ready, and the
+// in_flight bucket indexes delivered messages by their deadline. Both
+// index keys are the time followed by the sequence number, so a cursor
+// visits them in time order and a claim never has to decode messages
+// that aren't due yet.
+var boltMessagesBucket = []byte("messages")
+var boltReadyBucket = []byte("ready")
+var boltInFlightBucket = []byte("in_flight")
+
+// These match the defaults in go-nsq.
+const defaultBoltQueueMsgTimeout = 60 * time.Second
+const defaultBoltQueueRequeueDelay = 90 * time.Second
+const maxBoltQueueRequeueDelay = 15 * time.Minute
+
+// BoltQueue is a durable Queue that lives in a single BoltDB file.
+// It lets small deployments and test environments run the whole
+// pipeline in one process, without nsqd or nsqlookupd. Because
+// BoltDB locks its file, only one process can use a BoltQueue at
+// a time.
+//
+// Messages survive restarts. Messages that were in flight when
+// the process died are delivered again when the queue reopens,
+// as are messages that a worker does not finish or touch within
+// the worker's MessageTimeout.
+//
+// Unlike NSQ, the BoltQueue has no separate channels. Each message
+// published to a topic goes to exactly one subscriber, which is how
+// Exchange uses NSQ anyway.
+type BoltQueue struct {
+	// PollInterval is how often subscribers check for messages
+	// whose requeue delay has expired.
+	PollInterval time.Duration
+	db           *bolt.DB
+	filePath     string
+	subscribers  []*boltSubscriber
+	mutex        sync.Mutex
+	stopChan     chan struct{}
+	stopOnce     sync.Once
+	waitGroup    sync.WaitGroup
+}
+
+// boltQueueRecord is what we store in the messages bucket for each
+// message.
+type boltQueueRecord struct {
+	Body      string    `json:"body"`
+	Timestamp int64     `json:"timestamp"`
+	Attempts  uint16    `json:"attempts"`
+	ReadyAt   time.Time `json:"ready_at"`
+	InFlight  bool      `json:"in_flight"`
+	Deadline  time.Time `json:"deadline"`
+}
+
+// NewBoltQueue opens the BoltQueue at filePath, creating it if
+// it doesn't already exist.
+func NewBoltQueue(filePath string) (*BoltQueue, error) {
+	if filePath == "" {
+		return nil, fmt.Errorf("BoltQueue requires a file path. Set EmbeddedQueuePath in your config.")
+	}
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filePath, 0644, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open queue file %s: %v", filePath, err)
+	}
+	queue := &BoltQueue{
+		PollInterval: 250 * time.Millisecond,
+		db:           db,
+		filePath:     filePath,
+		subscribers:  make([]*boltSubscriber, 0),
+		stopChan:     make(chan struct{}),
+	}
+	err = queue.recoverInFlight()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return queue, nil
+}
+
+// FilePath returns the path to the BoltDB file.
+func (queue *BoltQueue) FilePath() string {
+	return queue.filePath
+}
+
+// recoverInFlight makes messages that were in flight when the
+// queue was last closed available for delivery again.
+func (queue *BoltQueue) recoverInFlight() error {
+	return queue.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			topic, err := getBoltTopic(tx, string(name), false)
+			if err != nil || topic == nil {
+				return err
+			}
+			seqs := make([]uint64, 0)
+			cursor := topic.inFlight.Cursor()
+			for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+				seqs = append(seqs, boltIndexSeq(key))
+			}
+			for _, seq := range seqs {
+				record, err := topic.getIndexed(seq)
+				if err != nil {
+					return err
+				}
+				if err = topic.unindex(seq, record); err != nil {
+					return err
+				}
+				record.InFlight = false
+				if err = topic.put(seq, record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Enqueue adds a WorkItem id to the specified topic.
+func (queue *BoltQueue) Enqueue(topic string, workItemId int) error {
+	return queue.EnqueueString(topic, strconv.Itoa(workItemId))
+}
+
+// EnqueueString adds string data to the specified topic.
+func (queue *BoltQueue) EnqueueString(topic string, data string) error {
+	if topic == "" {
+		return fmt.Errorf("Cannot enqueue data without a topic.")
+	}
+	now := time.Now().UTC()
+	record := &boltQueueRecord{
+		Body:      data,
+		Timestamp: now.UnixNano(),
+		ReadyAt:   now,
+	}
+	err := queue.db.Update(func(tx *bolt.Tx) error {
+		boltTopic, err := getBoltTopic(tx, topic, true)
+		if err != nil {
+			return err
+		}
+		seq, err := boltTopic.messages.NextSequence()
+		if err != nil {
+			return err
+		}
+		return boltTopic.put(seq, record)
+	})
+	if err != nil {
+		return fmt.Errorf("Error adding data to embedded queue topic %s: %v", topic, err)
+	}
+	queue.wakeSubscribers(topic)
+	return nil
+}
+
+// Depth returns the number of messages in the specified topic,
+// including those that are in flight.
+func (queue *BoltQueue) Depth(topic string) (int, error) {
+	count := 0
+	err := queue.db.View(func(tx *bolt.Tx) error {
+		boltTopic, err := getBoltTopic(tx, topic, false)
+		if boltTopic != nil {
+			count = boltTopic.messages.Stats().KeyN
+		}
+		return err
+	})
+	return count, err
+}
+
+// Subscribe starts delivering messages from workerConfig.NsqTopic
+// to handler. The queue delivers no more than workerConfig.MaxInFlight
+// messages from the topic at once, and it drops messages that have
+// already been attempted workerConfig.MaxAttempts times.
+func (queue *BoltQueue) Subscribe(workerConfig *models.WorkerConfig, handler MessageHandler) error {
+	if workerConfig.NsqTopic == "" {
+		return fmt.Errorf("Cannot subscribe without a topic.")
+	}
+	msgTimeout := defaultBoltQueueMsgTimeout
+	if workerConfig.MessageTimeout != "" {
+		var err error
+		msgTimeout, err = time.ParseDuration(workerConfig.MessageTimeout)
+		if err != nil {
+			return fmt.Errorf("Invalid MessageTimeout for topic %s: %v",
+				workerConfig.NsqTopic, err)
+		}
+	}
+	maxInFlight := workerConfig.MaxInFlight
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	sub := &boltSubscriber{
+		queue:       queue,
+		topic:       workerConfig.NsqTopic,
+		handler:     handler,
+		maxInFlight: maxInFlight,
+		maxAttempts: workerConfig.MaxAttempts,
+		msgTimeout:  msgTimeout,
+		wake:        make(chan struct{}, 1),
+	}
+	queue.mutex.Lock()
+	queue.subscribers = append(queue.subscribers, sub)
+	queue.mutex.Unlock()
+	queue.waitGroup.Add(1)
+	go sub.run()
+	return nil
+}
+
+// Stop stops delivering messages. Workers can still finish, touch
+// and requeue messages they're working on until you call Close.
+func (queue *BoltQueue) Stop() {
+	queue.stopOnce.Do(func() { close(queue.stopChan) })
+}
+
+// Wait blocks until the queue has stopped delivering messages and
+// workers have finished, requeued or timed out on all of the messages
+// it delivered. Messages that time out are delivered again when the
+// queue reopens, so Wait doesn't wait for workers that hang.
+func (queue *BoltQueue) Wait() {
+	<-queue.stopChan
+	queue.waitGroup.Wait()
+	for queue.InFlight() > 0 {
+		time.Sleep(queue.PollInterval)
+	}
+}
+
+// InFlight returns the number of messages this queue has delivered
+// that workers have not yet finished or requeued, and whose timeout
+// hasn't passed. It counts them in the in_flight index, so a message
+// that timed out and went out again counts only once.
+func (queue *BoltQueue) InFlight() int64 {
+	var count int64
+	nowKey := boltIndexKey(time.Now().UTC(), math.MaxUint64)
+	queue.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			topic, err := getBoltTopic(tx, string(name), false)
+			if err != nil || topic == nil {
+				return err
+			}
+			cursor := topic.inFlight.Cursor()
+			for key, _ := cursor.Seek(nowKey); key != nil; key, _ = cursor.Next() {
+				count++
+			}
+			return nil
+		})
+	})
+	return count
+}
+
+// Close stops the queue and closes the BoltDB file.
+func (queue *BoltQueue) Close() error {
+	queue.Stop()
+	queue.waitGroup.Wait()
+	return queue.db.Close()
+}
+
+func (queue *BoltQueue) wakeSubscribers(topic string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for _, sub := range queue.subscribers {
+		if sub.topic == topic {
+			sub.wakeUp()
+		}
+	}
+}
+
+// updateRecord loads the record for message, passes it to fn, and
+// saves the result. If fn returns nil, the record is deleted. This
+// does nothing if the message has been delivered again since the
+// caller received it, so late responses to timed-out messages don't
+// clobber newer deliveries.
+func (queue *BoltQueue) updateRecord(message *boltMessage, fn func(*boltQueueRecord) *boltQueueRecord) {
+	queue.db.Update(func(tx *bolt.Tx) error {
+		topic, err := getBoltTopic(tx, message.sub.topic, false)
+		if err != nil || topic == nil {
+			return err
+		}
+		record, err := topic.get(message.seq)
+		if err != nil || record == nil {
+			return err
+		}
+		if !record.InFlight || record.Attempts != message.attempts {
+			return nil
+		}
+		if err = topic.unindex(message.seq, record); err != nil {
+			return err
+		}
+		record = fn(record)
+		if record == nil {
+			return topic.messages.Delete(boltQueueKey(message.seq))
+		}
+		return topic.put(message.seq, record)
+	})
+}
+
+// boltSubscriber delivers messages from one topic to one handler.
+type boltSubscriber struct {
+	queue       *BoltQueue
+	topic       string
+	handler     MessageHandler
+	maxInFlight int
+	maxAttempts uint16
+	msgTimeout  time.Duration
+	wake        chan struct{}
+}
+
+func (sub *boltSubscriber) wakeUp() {
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *boltSubscriber) run() {
+	defer sub.queue.waitGroup.Done()
+	for {
+		select {
+		case <-sub.queue.stopChan:
+			return
+		default:
+		}
+		sub.deliverReady()
+		select {
+		case <-sub.queue.stopChan:
+			return
+		case <-sub.wake:
+		case <-time.After(sub.queue.PollInterval):
+		}
+	}
+}
+
+// deliverReady claims as many ready messages as the subscriber
+// has room for and passes them to the handler.
+func (sub *boltSubscriber) deliverReady() {
+	messages, failed, err := sub.claimMessages()
+	if err != nil {
+		return
+	}
+	if logger, ok := sub.handler.(FailedMessageLogger); ok {
+		for _, message := range failed {
+			logger.LogFailedMessage(message)
+		}
+	}
+	for _, message := range messages {
+		metrics.MessagesReceived.Inc(sub.topic)
+		err = sub.handler.HandleMessage(message)
+		if !message.IsAutoResponseDisabled() {
+			if err != nil {
+				message.Requeue(-1)
+			} else {
+				message.Finish()
+			}
+		}
+	}
+}
+
+// claimMessages marks ready messages as in flight and returns them.
+// It also returns messages it dropped because they exceeded
+// maxAttempts. Messages whose deadline has passed count as ready,
+// and go out ahead of messages that have never been delivered.
+func (sub *boltSubscriber) claimMessages() (messages, failed []*boltMessage, err error) {
+	messages = make([]*boltMessage, 0)
+	failed = make([]*boltMessage, 0)
+	err = sub.queue.db.Update(func(tx *bolt.Tx) error {
+		topic, err := getBoltTopic(tx, sub.topic, false)
+		if err != nil || topic == nil {
+			return err
+		}
+		now := time.Now().UTC()
+		// Every key with a time at or before now sorts before this.
+		nowKey := boltIndexKey(now, math.MaxUint64)
+
+		inFlight := 0
+		timedOut := make([]uint64, 0)
+		cursor := topic.inFlight.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			if bytes.Compare(key, nowKey) <= 0 {
+				timedOut = append(timedOut, boltIndexSeq(key))
+			} else {
+				inFlight++
+			}
+		}
+		for inFlight < sub.maxInFlight {
+			// Take only as many as we have room for. We can't modify
+			// the index while a cursor is walking it, so we collect
+			// sequence numbers first, and come back for more if some
+			// of these turn out to be over maxAttempts.
+			candidates := timedOut
+			if len(candidates) > sub.maxInFlight-inFlight {
+				candidates = candidates[:sub.maxInFlight-inFlight]
+			}
+			timedOut = timedOut[len(candidates):]
+			if len(candidates) < sub.maxInFlight-inFlight {
+				cursor = topic.ready.Cursor()
+				for key, _ := cursor.First(); key != nil && bytes.Compare(key, nowKey) <= 0; key, _ = cursor.Next() {
+					candidates = append(candidates, boltIndexSeq(key))
+					if len(candidates) == sub.maxInFlight-inFlight {
+						break
+					}
+				}
+			}
+			if len(candidates) == 0 {
+				break
+			}
+			for _, seq := range candidates {
+				record, err := topic.getIndexed(seq)
+				if err != nil {
+					return err
+				}
+				if err = topic.unindex(seq, record); err != nil {
+					return err
+				}
+				record.Attempts++
+				if sub.maxAttempts > 0 && record.Attempts > sub.maxAttempts {
+					if err = topic.messages.Delete(boltQueueKey(seq)); err != nil {
+						return err
+					}
+					failed = append(failed, sub.newMessage(seq, record))
+					continue
+				}
+				record.InFlight = true
+				record.Deadline = now.Add(sub.msgTimeout)
+				if err = topic.put(seq, record); err != nil {
+					return err
+				}
+				messages = append(messages, sub.newMessage(seq, record))
+				inFlight++
+			}
+		}
+		return nil
+	})
+	return messages, failed, err
+}
+
+func (sub *boltSubscriber) newMessage(seq uint64, record *boltQueueRecord) *boltMessage {
+	return &boltMessage{
+		sub:      sub,
+		seq:      seq,
+		body:     []byte(record.Body),
+		attempts: record.Attempts,
+	}
+}
+
+// boltMessage is the models.QueueMessage that a BoltQueue delivers.
+// Touch, Finish and Requeue update the message's record in the
+// BoltDB file. After the first Finish or Requeue, the message
+// ignores further responses.
+type boltMessage struct {
+	sub                  *boltSubscriber
+	seq                  uint64
+	body                 []byte
+	attempts             uint16
+	autoResponseDisabled int32
+	responded            int32
+}
+
+// ID returns the message's sequence number in its topic, as
+// 16 hex digits.
+func (message *boltMessage) ID() string {
+	return fmt.Sprintf("%016x", message.seq)
+}
+
+// Body returns the message body.
+func (message *boltMessage) Body() []byte {
+	return message.body
+}
+
+// Attempts returns the number of times the queue has delivered
+// this message.
+func (message *boltMessage) Attempts() uint16 {
+	return message.attempts
+}
+
+// Touch resets the message's timeout.
+func (message *boltMessage) Touch() {
+	if message.HasResponded() {
+		return
+	}
+	message.sub.queue.updateRecord(message,
+		func(record *boltQueueRecord) *boltQueueRecord {
+			record.Deadline = time.Now().UTC().Add(message.sub.msgTimeout)
+			return record
+		})
+}
+
+// Finish removes the message from the queue.
+func (message *boltMessage) Finish() {
+	if !atomic.CompareAndSwapInt32(&message.responded, 0, 1) {
+		return
+	}
+	metrics.MessagesProcessed.Inc(message.sub.topic, "finished")
+	message.sub.queue.updateRecord(message,
+		func(record *boltQueueRecord) *boltQueueRecord { return nil })
+	message.sub.wakeUp()
+}
+
+// Requeue makes the message available for delivery again after
+// delay. A negative delay means use the default, which increases
+// with the number of attempts.
+func (message *boltMessage) Requeue(delay time.Duration) {
+	if !atomic.CompareAndSwapInt32(&message.responded, 0, 1) {
+		return
+	}
+	metrics.MessagesProcessed.Inc(message.sub.topic, "requeued")
+	if delay < 0 {
+		delay = defaultBoltQueueRequeueDelay * time.Duration(message.attempts)
+		if delay > maxBoltQueueRequeueDelay {
+			delay = maxBoltQueueRequeueDelay
+		}
+	}
+	message.sub.queue.updateRecord(message,
+		func(record *boltQueueRecord) *boltQueueRecord {
+			record.InFlight = false
+			record.ReadyAt = time.Now().UTC().Add(delay)
+			return record
+		})
+	message.sub.wakeUp()
+}
+
+// RequeueWithoutBackoff is the same as Requeue, because the
+// BoltQueue never backs off.
+func (message *boltMessage) RequeueWithoutBackoff(delay time.Duration) {
+	message.Requeue(delay)
+}
+
+// DisableAutoResponse says the handler will finish or requeue
+// the message itself.
+func (message *boltMessage) DisableAutoResponse() {
+	atomic.StoreInt32(&message.autoResponseDisabled, 1)
+}
+
+// IsAutoResponseDisabled returns true if the handler called
+// DisableAutoResponse.
+func (message *boltMessage) IsAutoResponseDisabled() bool {
+	return atomic.LoadInt32(&message.autoResponseDisabled) == 1
+}
+
+// HasResponded returns true if the message has been finished
+// or requeued.
+func (message *boltMessage) HasResponded() bool {
+	return atomic.LoadInt32(&message.responded) == 1
+}
+
+// boltTopic holds the buckets for one topic within a transaction.
+type boltTopic struct {
+	messages *bolt.Bucket
+	ready    *bolt.Bucket
+	inFlight *bolt.Bucket
+}
+
+// getBoltTopic returns the buckets for topic. If create is false
+// and the topic doesn't exist, it returns nil.
+func getBoltTopic(tx *bolt.Tx, topic string, create bool) (*boltTopic, error) {
+	var err error
+	bucket := tx.Bucket([]byte(topic))
+	if bucket == nil {
+		if !create {
+			return nil, nil
+		}
+		if bucket, err = tx.CreateBucket([]byte(topic)); err != nil {
+			return nil, err
+		}
+	}
+	buckets := make([]*bolt.Bucket, 3)
+	for i, name := range [][]byte{boltMessagesBucket, boltReadyBucket, boltInFlightBucket} {
+		buckets[i] = bucket.Bucket(name)
+		if buckets[i] == nil {
+			if !bucket.Writable() {
+				return nil, fmt.Errorf("Embedded queue topic %s is missing its %s bucket", topic, name)
+			}
+			if buckets[i], err = bucket.CreateBucket(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &boltTopic{messages: buckets[0], ready: buckets[1], inFlight: buckets[2]}, nil
+}
+
+// get returns the record for seq, or nil if there isn't one.
+func (topic *boltTopic) get(seq uint64) (*boltQueueRecord, error) {
+	value := topic.messages.Get(boltQueueKey(seq))
+	if value == nil {
+		return nil, nil
+	}
+	record := &boltQueueRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// getIndexed returns the record for seq, which the caller found in
+// one of the indexes. A missing record means the index is corrupt.
+func (topic *boltTopic) getIndexed(seq uint64) (*boltQueueRecord, error) {
+	record, err := topic.get(seq)
+	if err == nil && record == nil {
+		err = fmt.Errorf("Embedded queue index refers to missing message %d", seq)
+	}
+	return record, err
+}
+
+// put saves record and adds it to the ready or in-flight index.
+func (topic *boltTopic) put(seq uint64, record *boltQueueRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err = topic.messages.Put(boltQueueKey(seq), data); err != nil {
+		return err
+	}
+	if record.InFlight {
+		return topic.inFlight.Put(boltIndexKey(record.Deadline, seq), []byte{})
+	}
+	return topic.ready.Put(boltIndexKey(record.ReadyAt, seq), []byte{})
+}
+
+// unindex removes record from the ready or in-flight index.
+// Call this before changing the record's ReadyAt, Deadline or
+// InFlight, or before deleting it.
+func (topic *boltTopic) unindex(seq uint64, record *boltQueueRecord) error {
+	if record.InFlight {
+		return topic.inFlight.Delete(boltIndexKey(record.Deadline, seq))
+	}
+	return topic.ready.Delete(boltIndexKey(record.ReadyAt, seq))
+}
+
+func boltQueueKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// boltIndexKey returns the index key for the message with sequence
+// number seq that becomes ready or times out at time t.
+func boltIndexKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// boltIndexSeq returns the sequence number from an index key.
+func boltIndexSeq(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[8:])
+}
@@ -0,0 +1,369 @@
+package network_test
+
+import (
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// boltTestHandler passes each message it receives to a channel,
+// so tests can decide when to finish, touch or requeue them.
+type boltTestHandler struct {
+	messages chan models.QueueMessage
+	failed   chan models.QueueMessage
+}
+
+func newBoltTestHandler() *boltTestHandler {
+	return &boltTestHandler{
+		messages: make(chan models.QueueMessage, 20),
+		failed:   make(chan models.QueueMessage, 20),
+	}
+}
+
+func (handler *boltTestHandler) HandleMessage(message models.QueueMessage) error {
+	message.DisableAutoResponse()
+	handler.messages <- message
+	return nil
+}
+
+func (handler *boltTestHandler) LogFailedMessage(message models.QueueMessage) {
+	handler.failed <- message
+}
+
+func getBoltQueue(t *testing.T) (*network.BoltQueue, string) {
+	tempDir, err := ioutil.TempDir("", "bolt_queue_test")
+	require.Nil(t, err)
+	queue, err := network.NewBoltQueue(filepath.Join(tempDir, "queue", "queue.db"))
+	require.Nil(t, err)
+	queue.PollInterval = 10 * time.Millisecond
+	return queue, tempDir
+}
+
+func boltWorkerConfig(maxInFlight int, maxAttempts uint16, timeout string) *models.WorkerConfig {
+	return &models.WorkerConfig{
+		NsqTopic:       "test_topic",
+		NsqChannel:     "test_channel",
+		MaxInFlight:    maxInFlight,
+		MaxAttempts:    maxAttempts,
+		MessageTimeout: timeout,
+	}
+}
+
+func nextBoltMessage(t *testing.T, messages chan models.QueueMessage) models.QueueMessage {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Timed out waiting for message")
+	}
+	return nil
+}
+
+func assertNoBoltMessage(t *testing.T, messages chan models.QueueMessage, wait time.Duration) {
+	select {
+	case message := <-messages:
+		assert.Fail(t, "Got unexpected message "+string(message.Body()))
+	case <-time.After(wait):
+	}
+}
+
+func TestNewBoltQueue(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+	assert.Equal(t, filepath.Join(tempDir, "queue", "queue.db"), queue.FilePath())
+
+	_, err := network.NewBoltQueue("")
+	assert.NotNil(t, err)
+}
+
+func TestBoltQueueEnqueueAndFinish(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	require.Nil(t, queue.Enqueue("test_topic", 101))
+	require.Nil(t, queue.EnqueueString("test_topic", "test.edu/bag/data/file.txt"))
+	require.Nil(t, queue.Enqueue("other_topic", 999))
+	assert.NotNil(t, queue.Enqueue("", 1))
+	depth, err := queue.Depth("test_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 2, depth)
+
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(10, 3, "1m"), handler))
+
+	// Messages should arrive in the order we queued them.
+	message := nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "101", string(message.Body()))
+	assert.Equal(t, uint16(1), message.Attempts())
+	message.Touch()
+	message.Finish()
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "test.edu/bag/data/file.txt", string(message.Body()))
+	message.Finish()
+	assertNoBoltMessage(t, handler.messages, 100*time.Millisecond)
+
+	depth, err = queue.Depth("test_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 0, depth)
+	depth, err = queue.Depth("other_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 1, depth)
+
+	// New messages should go to the existing subscriber.
+	require.Nil(t, queue.Enqueue("test_topic", 102))
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "102", string(message.Body()))
+	message.Finish()
+}
+
+func TestBoltQueueRequeue(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	require.Nil(t, queue.Enqueue("test_topic", 101))
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(10, 3, "1m"), handler))
+
+	message := nextBoltMessage(t, handler.messages)
+	message.Requeue(50 * time.Millisecond)
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "101", string(message.Body()))
+	assert.Equal(t, uint16(2), message.Attempts())
+	message.RequeueWithoutBackoff(0)
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, uint16(3), message.Attempts())
+
+	// MaxAttempts is 3, so after this requeue, the message
+	// should go to LogFailedMessage and out of the queue.
+	message.Requeue(0)
+	failed := nextBoltMessage(t, handler.failed)
+	assert.Equal(t, "101", string(failed.Body()))
+	assertNoBoltMessage(t, handler.messages, 100*time.Millisecond)
+	depth, err := queue.Depth("test_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 0, depth)
+}
+
+func TestBoltQueueMaxInFlight(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, queue.Enqueue("test_topic", i))
+	}
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(2, 0, "1m"), handler))
+
+	first := nextBoltMessage(t, handler.messages)
+	nextBoltMessage(t, handler.messages)
+	assertNoBoltMessage(t, handler.messages, 100*time.Millisecond)
+
+	first.Finish()
+	third := nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "3", string(third.Body()))
+}
+
+// Messages requeued with a delay should not hold up messages
+// behind them, and should not be delivered before they're due.
+func TestBoltQueueDelayedMessages(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, queue.Enqueue("test_topic", i))
+	}
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(1, 0, "1m"), handler))
+
+	message := nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "1", string(message.Body()))
+	message.Requeue(time.Hour)
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "2", string(message.Body()))
+	message.Requeue(150 * time.Millisecond)
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "3", string(message.Body()))
+	message.Finish()
+
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "2", string(message.Body()))
+	assert.Equal(t, uint16(2), message.Attempts())
+	message.Finish()
+	assertNoBoltMessage(t, handler.messages, 100*time.Millisecond)
+	depth, err := queue.Depth("test_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 1, depth)
+}
+
+func TestBoltQueueMessageTimeout(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	require.Nil(t, queue.Enqueue("test_topic", 101))
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(10, 0, "100ms"), handler))
+
+	// We don't finish or touch this message, so the queue
+	// should deliver it again after the timeout.
+	stale := nextBoltMessage(t, handler.messages)
+	message := nextBoltMessage(t, handler.messages)
+	assert.Equal(t, uint16(2), message.Attempts())
+
+	// Finishing the timed-out delivery should not remove the
+	// message from the queue.
+	stale.Finish()
+	depth, err := queue.Depth("test_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 1, depth)
+	message.Finish()
+	depth, err = queue.Depth("test_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 0, depth)
+
+	err = queue.Subscribe(boltWorkerConfig(10, 0, "not a duration"), handler)
+	assert.NotNil(t, err)
+}
+
+func TestBoltQueueSurvivesRestart(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+
+	require.Nil(t, queue.Enqueue("test_topic", 101))
+	require.Nil(t, queue.Enqueue("test_topic", 102))
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(1, 0, "1h"), handler))
+	message := nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "101", string(message.Body()))
+
+	// Simulate a crash with 101 in flight.
+	require.Nil(t, queue.Close())
+
+	queue, err := network.NewBoltQueue(queue.FilePath())
+	require.Nil(t, err)
+	defer queue.Close()
+	queue.PollInterval = 10 * time.Millisecond
+	handler = newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(10, 0, "1h"), handler))
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "101", string(message.Body()))
+	assert.Equal(t, uint16(2), message.Attempts())
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "102", string(message.Body()))
+	assert.Equal(t, uint16(1), message.Attempts())
+}
+
+func TestBoltQueueWaitDrainsInFlight(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	require.Nil(t, queue.Enqueue("test_topic", 101))
+	require.Nil(t, queue.Enqueue("test_topic", 102))
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(1, 0, "1m"), handler))
+	message := nextBoltMessage(t, handler.messages)
+	assert.Equal(t, int64(1), queue.InFlight())
+
+	queue.Stop()
+	stopped := make(chan bool)
+	go func() {
+		queue.Wait()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+		assert.Fail(t, "Wait returned while a message was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	message.Finish()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Wait did not return after in-flight message finished")
+	}
+	assert.Equal(t, int64(0), queue.InFlight())
+
+	// Stopped queue should not deliver 102.
+	assertNoBoltMessage(t, handler.messages, 100*time.Millisecond)
+	depth, err := queue.Depth("test_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 1, depth)
+}
+
+func TestBoltQueueWaitAfterTimeout(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	require.Nil(t, queue.Enqueue("test_topic", 101))
+	require.Nil(t, queue.Enqueue("test_topic", 102))
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(boltWorkerConfig(1, 0, "100ms"), handler))
+
+	// The worker never responds to the first delivery of 101,
+	// so it goes out again. It's still only one message.
+	nextBoltMessage(t, handler.messages)
+	message := nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "101", string(message.Body()))
+	assert.Equal(t, uint16(2), message.Attempts())
+	assert.Equal(t, int64(1), queue.InFlight())
+	message.Finish()
+
+	// The worker hangs on 102, too. Wait shouldn't wait for
+	// it past its timeout.
+	message = nextBoltMessage(t, handler.messages)
+	assert.Equal(t, "102", string(message.Body()))
+	queue.Stop()
+	stopped := make(chan bool)
+	go func() {
+		queue.Wait()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Wait did not return after in-flight message timed out")
+	}
+	assert.Equal(t, int64(0), queue.InFlight())
+}
+
+func TestNewQueue(t *testing.T) {
+	config := &models.Config{
+		NsqdHttpAddress: "http://localhost:4151",
+		NsqLookupd:      "localhost:4161",
+	}
+	queue, err := network.NewQueue(config)
+	require.Nil(t, err)
+	nsqQueue, ok := queue.(*network.NSQQueue)
+	require.True(t, ok)
+	assert.Equal(t, "http://localhost:4151", nsqQueue.URL)
+	assert.Equal(t, "localhost:4161", nsqQueue.LookupdAddress)
+
+	tempDir, err := ioutil.TempDir("", "bolt_queue_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	config.QueueBackend = "embedded"
+	config.EmbeddedQueuePath = filepath.Join(tempDir, "queue.db")
+	queue, err = network.NewQueue(config)
+	require.Nil(t, err)
+	boltQueue, ok := queue.(*network.BoltQueue)
+	require.True(t, ok)
+	boltQueue.Close()
+
+	config.QueueBackend = "rabbitmq"
+	_, err = network.NewQueue(config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,246 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventQueue is a queue of S3 event notifications, such as an SQS
+// queue that a receiving bucket sends ObjectCreated events to.
+// Messages stay in the queue until they're deleted. A message that's
+// received but not deleted comes back after a while, so a consumer
+// that fails to process a message can simply leave it alone.
+type EventQueue interface {
+	// Receive waits for messages, and returns the ones that are
+	// available. It may return no messages at all if none arrive
+	// within the queue's wait time, or if ctx is done.
+	Receive(ctx context.Context) ([]*EventMessage, error)
+	// Delete removes a message that's been processed, so it
+	// isn't delivered again.
+	Delete(message *EventMessage) error
+}
+
+// EventMessage is a message from an EventQueue.
+type EventMessage struct {
+	// Body is the message, which should be an S3 event notification.
+	Body string
+	// ReceiptHandle identifies the message when we delete it.
+	ReceiptHandle string
+}
+
+// NewEventQueue returns the EventQueue described by
+// config.IngestTrigger.
+func NewEventQueue(config *models.Config) (EventQueue, error) {
+	triggerConfig := config.IngestTrigger
+	switch triggerConfig.Source {
+	case "sqs":
+		region := triggerConfig.SQSRegion
+		if region == "" {
+			region = config.APTrustS3Region
+		}
+		return NewSQSEventQueue(region, triggerConfig.SQSEndpoint, triggerConfig.SQSQueueURL)
+	case "local":
+		return NewLocalEventQueue(triggerConfig.LocalQueueDirectory)
+	}
+	return nil, fmt.Errorf("Unknown event queue source '%s'. Use 'sqs' or 'local'.",
+		triggerConfig.Source)
+}
+
+// SQSEventQueue is an EventQueue backed by Amazon SQS, or by an
+// SQS-compatible service such as ElasticMQ.
+type SQSEventQueue struct {
+	QueueURL string
+	// WaitTime is how long Receive waits for messages to arrive.
+	// SQS allows up to 20 seconds.
+	WaitTime time.Duration
+	// MaxMessages is the most messages Receive returns at once.
+	// SQS allows up to 10.
+	MaxMessages int64
+	client      *sqs.SQS
+}
+
+// NewSQSEventQueue returns an EventQueue that reads from the SQS queue
+// at queueURL. Param endpoint is the URL of an SQS-compatible service,
+// or empty for AWS. AWS credentials come from the environment.
+func NewSQSEventQueue(region, endpoint, queueURL string) (*SQSEventQueue, error) {
+	if queueURL == "" {
+		return nil, fmt.Errorf("SQSEventQueue requires a queue URL")
+	}
+	// The S3 session settings work for SQS, too.
+	_session, err := GetS3SessionWithEndpoint(region, "", "", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &SQSEventQueue{
+		QueueURL:    queueURL,
+		WaitTime:    20 * time.Second,
+		MaxMessages: 10,
+		client:      sqs.New(_session),
+	}, nil
+}
+
+// Receive long-polls the queue for up to WaitTime.
+func (queue *SQSEventQueue) Receive(ctx context.Context) ([]*EventMessage, error) {
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queue.QueueURL),
+		MaxNumberOfMessages: aws.Int64(queue.MaxMessages),
+		WaitTimeSeconds:     aws.Int64(int64(queue.WaitTime / time.Second)),
+	}
+	output, err := queue.client.ReceiveMessageWithContext(ctx, input)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error receiving messages from %s: %v", queue.QueueURL, err)
+	}
+	messages := make([]*EventMessage, len(output.Messages))
+	for i, message := range output.Messages {
+		messages[i] = &EventMessage{
+			Body:          aws.StringValue(message.Body),
+			ReceiptHandle: aws.StringValue(message.ReceiptHandle),
+		}
+	}
+	return messages, nil
+}
+
+// Delete deletes message from the queue.
+func (queue *SQSEventQueue) Delete(message *EventMessage) error {
+	_, err := queue.client.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queue.QueueURL),
+		ReceiptHandle: aws.String(message.ReceiptHandle),
+	})
+	if err != nil {
+		return fmt.Errorf("Error deleting message from %s: %v", queue.QueueURL, err)
+	}
+	return nil
+}
+
+// LocalEventQueue is an EventQueue that reads messages from files in
+// a directory, one message per file, in order by file name. It stands
+// in for SQS during development and testing, the way LocalBackend
+// stands in for S3. To send a message, write it to a file whose name
+// starts with a dot, then rename the file, so the queue never reads
+// a partial message. Files whose names start with a dot are ignored.
+//
+// Like SQS, the queue hides each message it returns for
+// VisibilityTimeout, and delivers it again after that, unless it's
+// deleted first. Only one LocalEventQueue should read a directory.
+type LocalEventQueue struct {
+	Directory string
+	// PollInterval is how long Receive waits for messages
+	// when there are none.
+	PollInterval time.Duration
+	// VisibilityTimeout is how long a message stays hidden
+	// after Receive returns it.
+	VisibilityTimeout time.Duration
+	// MaxMessages is the most messages Receive returns at once.
+	MaxMessages int
+	hiddenUntil map[string]time.Time
+	mutex       sync.Mutex
+}
+
+// NewLocalEventQueue returns an EventQueue that reads messages from
+// files in directory, creating the directory if necessary.
+func NewLocalEventQueue(directory string) (*LocalEventQueue, error) {
+	if directory == "" {
+		return nil, fmt.Errorf("LocalEventQueue requires a directory")
+	}
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalEventQueue{
+		Directory:         directory,
+		PollInterval:      time.Second,
+		VisibilityTimeout: 30 * time.Second,
+		MaxMessages:       10,
+		hiddenUntil:       make(map[string]time.Time),
+	}, nil
+}
+
+// Receive returns the messages in the directory that aren't hidden.
+// If there are none, it checks again every PollInterval until some
+// arrive or ctx is done.
+func (queue *LocalEventQueue) Receive(ctx context.Context) ([]*EventMessage, error) {
+	for {
+		messages, err := queue.readMessages()
+		if err != nil || len(messages) > 0 {
+			return messages, err
+		}
+		timer := time.NewTimer(queue.PollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil
+		case <-timer.C:
+		}
+	}
+}
+
+// readMessages reads up to MaxMessages visible messages and hides them.
+func (queue *LocalEventQueue) readMessages() ([]*EventMessage, error) {
+	fileInfos, err := ioutil.ReadDir(queue.Directory)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Mode().IsRegular() && !strings.HasPrefix(fileInfo.Name(), ".") {
+			names = append(names, fileInfo.Name())
+		}
+	}
+	sort.Strings(names)
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	// Forget about files that someone else removed.
+	for filePath := range queue.hiddenUntil {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			delete(queue.hiddenUntil, filePath)
+		}
+	}
+	now := time.Now()
+	messages := make([]*EventMessage, 0)
+	for _, name := range names {
+		if len(messages) >= queue.MaxMessages {
+			break
+		}
+		filePath := filepath.Join(queue.Directory, name)
+		if now.Before(queue.hiddenUntil[filePath]) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filePath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return messages, err
+		}
+		queue.hiddenUntil[filePath] = now.Add(queue.VisibilityTimeout)
+		messages = append(messages, &EventMessage{
+			Body:          string(data),
+			ReceiptHandle: filePath,
+		})
+	}
+	return messages, nil
+}
+
+// Delete deletes the message's file.
+func (queue *LocalEventQueue) Delete(message *EventMessage) error {
+	queue.mutex.Lock()
+	delete(queue.hiddenUntil, message.ReceiptHandle)
+	queue.mutex.Unlock()
+	err := os.Remove(message.ReceiptHandle)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
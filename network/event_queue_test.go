@@ -0,0 +1,150 @@
+package network_test
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSQS answers ReceiveMessage and DeleteMessage requests the way
+// SQS does, from an in-memory list of messages.
+type fakeSQS struct {
+	messages map[string]string
+	deleted  []string
+	mutex    sync.Mutex
+}
+
+func (fake *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	r.ParseForm()
+	w.Header().Set("Content-Type", "text/xml")
+	switch r.Form.Get("Action") {
+	case "ReceiveMessage":
+		fmt.Fprint(w, "<ReceiveMessageResponse><ReceiveMessageResult>")
+		for handle, body := range fake.messages {
+			fmt.Fprintf(w, "<Message><MessageId>%s</MessageId><ReceiptHandle>%s</ReceiptHandle>"+
+				"<MD5OfBody>%x</MD5OfBody><Body>%s</Body></Message>",
+				handle, handle, md5.Sum([]byte(body)), body)
+		}
+		fmt.Fprint(w, "</ReceiveMessageResult><ResponseMetadata><RequestId>1</RequestId>"+
+			"</ResponseMetadata></ReceiveMessageResponse>")
+	case "DeleteMessage":
+		handle := r.Form.Get("ReceiptHandle")
+		delete(fake.messages, handle)
+		fake.deleted = append(fake.deleted, handle)
+		fmt.Fprint(w, "<DeleteMessageResponse><ResponseMetadata><RequestId>2</RequestId>"+
+			"</ResponseMetadata></DeleteMessageResponse>")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestSQSEventQueue(t *testing.T) {
+	// The AWS SDK won't send requests without credentials.
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, "fake")
+			defer os.Unsetenv(name)
+		}
+	}
+	fake := &fakeSQS{messages: map[string]string{"handle-1": "Message one"}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	queueURL := server.URL + "/123456789012/receiving-events"
+	queue, err := network.NewSQSEventQueue("us-east-1", server.URL, queueURL)
+	require.Nil(t, err)
+	messages, err := queue.Receive(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	assert.Equal(t, "Message one", messages[0].Body)
+	assert.Equal(t, "handle-1", messages[0].ReceiptHandle)
+
+	require.Nil(t, queue.Delete(messages[0]))
+	assert.Equal(t, []string{"handle-1"}, fake.deleted)
+	messages, err = queue.Receive(context.Background())
+	require.Nil(t, err)
+	assert.Empty(t, messages)
+
+	_, err = network.NewSQSEventQueue("us-east-1", "", "")
+	assert.NotNil(t, err)
+}
+
+func TestLocalEventQueue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "event_queue_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	queue, err := network.NewLocalEventQueue(filepath.Join(tempDir, "events"))
+	require.Nil(t, err)
+	queue.PollInterval = 10 * time.Millisecond
+	queue.VisibilityTimeout = 50 * time.Millisecond
+
+	// No messages: Receive waits until ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	messages, err := queue.Receive(ctx)
+	cancel()
+	require.Nil(t, err)
+	assert.Empty(t, messages)
+
+	for _, name := range []string{"002.json", "001.json", ".003.json"} {
+		filePath := filepath.Join(queue.Directory, name)
+		require.Nil(t, ioutil.WriteFile(filePath, []byte("Message "+name), 0644))
+	}
+	messages, err = queue.Receive(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	assert.Equal(t, "Message 001.json", messages[0].Body)
+	assert.Equal(t, "Message 002.json", messages[1].Body)
+
+	// Messages we received are hidden until the visibility
+	// timeout expires, unless we delete them.
+	require.Nil(t, queue.Delete(messages[0]))
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	hidden, err := queue.Receive(ctx)
+	cancel()
+	require.Nil(t, err)
+	assert.Empty(t, hidden)
+	time.Sleep(50 * time.Millisecond)
+	messages, err = queue.Receive(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	assert.Equal(t, "Message 002.json", messages[0].Body)
+
+	_, err = network.NewLocalEventQueue("")
+	assert.NotNil(t, err)
+}
+
+func TestNewEventQueue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "event_queue_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	config := &models.Config{APTrustS3Region: "us-east-1"}
+	config.IngestTrigger.Source = "local"
+	config.IngestTrigger.LocalQueueDirectory = tempDir
+	queue, err := network.NewEventQueue(config)
+	require.Nil(t, err)
+	assert.IsType(t, &network.LocalEventQueue{}, queue)
+
+	config.IngestTrigger.Source = "sqs"
+	config.IngestTrigger.SQSQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/events"
+	queue, err = network.NewEventQueue(config)
+	require.Nil(t, err)
+	assert.IsType(t, &network.SQSEventQueue{}, queue)
+
+	config.IngestTrigger.Source = "webhook"
+	_, err = network.NewEventQueue(config)
+	assert.NotNil(t, err)
+}
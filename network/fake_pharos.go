@@ -0,0 +1,1131 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakePharos is an in-process, in-memory stand-in for the parts of the
+// Pharos REST API that PharosClient talks to. It runs on an
+// httptest.Server, so tests can run the ingest, restore and delete
+// workers end to end without Rails, Postgres or a network connection.
+//
+// FakePharos starts out empty, except for the institutions you add with
+// AddInstitution. Everything else (WorkItems, objects, files, checksums,
+// events) comes in through the API, just as it would in production.
+// FakePharos is not a complete reimplementation of Pharos. It does just
+// enough validation and filtering to let our workers do their jobs.
+type FakePharos struct {
+	Server         *httptest.Server
+	mutex          sync.Mutex
+	nextId         int
+	institutions   []*models.Institution
+	objects        []*models.IntellectualObject
+	files          []*models.GenericFile
+	checksums      []*models.Checksum
+	events         []*models.PremisEvent
+	workItems      []*models.WorkItem
+	workItemStates []*models.WorkItemState
+}
+
+// NewFakePharos starts a new FakePharos server. Call Close when
+// you're done with it.
+func NewFakePharos() *FakePharos {
+	fake := &FakePharos{nextId: 1000}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handleRequest))
+	return fake
+}
+
+// URL returns the base URL of the fake server, e.g. "http://127.0.0.1:4567".
+func (fake *FakePharos) URL() string {
+	return fake.Server.URL
+}
+
+// Close shuts down the fake server.
+func (fake *FakePharos) Close() {
+	fake.Server.Close()
+}
+
+// Client returns a PharosClient that talks to this fake server.
+func (fake *FakePharos) Client() (*PharosClient, error) {
+	return NewPharosClient(fake.URL(), "v2", "system@aptrust.org", "fake-pharos-key")
+}
+
+// AddInstitution adds an institution to the fake server and returns it
+// with its new Id. Pharos has no API for creating institutions, so tests
+// have to seed them here. If the institution has no receiving or restore
+// bucket, this assigns the standard APTrust bucket names.
+func (fake *FakePharos) AddInstitution(inst *models.Institution) *models.Institution {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	saved := *inst
+	saved.Id = fake.newId()
+	if saved.ReceivingBucket == "" {
+		saved.ReceivingBucket = "aptrust.receiving." + saved.Identifier
+	}
+	if saved.RestoreBucket == "" {
+		saved.RestoreBucket = "aptrust.restore." + saved.Identifier
+	}
+	fake.institutions = append(fake.institutions, &saved)
+	copied := saved
+	return &copied
+}
+
+func (fake *FakePharos) newId() int {
+	fake.nextId++
+	return fake.nextId
+}
+
+// handleRequest routes requests to the handler for each Pharos resource.
+// All routes look like /api/<version>/<resource>/<args...>. We split the
+// escaped path, because identifiers in the URL contain encoded slashes.
+func (fake *FakePharos) handleRequest(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	segments := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	if len(segments) < 3 || segments[0] != "api" {
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+		return
+	}
+	for i, segment := range segments {
+		unescaped, err := url.QueryUnescape(segment)
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Bad URL segment '%s': %v", segment, err)
+			return
+		}
+		segments[i] = unescaped
+	}
+	resource, args := segments[2], segments[3:]
+	switch resource {
+	case "institutions":
+		fake.handleInstitutions(w, r, args)
+	case "objects":
+		fake.handleObjects(w, r, args)
+	case "files":
+		fake.handleFiles(w, r, args)
+	case "checksums":
+		fake.handleChecksums(w, r, args)
+	case "events":
+		fake.handleEvents(w, r, args)
+	case "items":
+		fake.handleWorkItems(w, r, args)
+	case "item_state":
+		fake.handleWorkItemStates(w, r, args)
+	case "notifications":
+		fake.handleNotifications(w, r, args)
+	default:
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// -------------------------------------------------------------------------
+// Institutions
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) handleInstitutions(w http.ResponseWriter, r *http.Request, args []string) {
+	if r.Method != "GET" {
+		writeFakeError(w, http.StatusMethodNotAllowed, "Institutions are read-only")
+		return
+	}
+	if len(args) == 0 {
+		results := make([]interface{}, len(fake.institutions))
+		for i, inst := range fake.institutions {
+			results[i] = inst
+		}
+		writeFakeList(w, r, results)
+		return
+	}
+	inst := fake.findInstitution(args[0])
+	if inst == nil {
+		writeFakeError(w, http.StatusNotFound, "Institution %s not found", args[0])
+		return
+	}
+	writeFakeJson(w, http.StatusOK, inst)
+}
+
+// findInstitution finds an institution by identifier or id.
+func (fake *FakePharos) findInstitution(identifier string) *models.Institution {
+	for _, inst := range fake.institutions {
+		if inst.Identifier == identifier || strconv.Itoa(inst.Id) == identifier {
+			return inst
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) findInstitutionById(id int) *models.Institution {
+	for _, inst := range fake.institutions {
+		if inst.Id == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// -------------------------------------------------------------------------
+// IntellectualObjects
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) handleObjects(w http.ResponseWriter, r *http.Request, args []string) {
+	// Object identifiers always contain a slash, and institution
+	// identifiers never do. GET objects/<institution> is a list request.
+	isList := len(args) == 0 || (len(args) == 1 && !strings.Contains(args[0], "/"))
+	switch {
+	case r.Method == "GET" && isList:
+		institution := ""
+		if len(args) == 1 {
+			institution = args[0]
+		}
+		fake.listObjects(w, r, institution)
+	case r.Method == "GET" && len(args) == 1:
+		fake.getObject(w, r, args[0])
+	case r.Method == "POST" && len(args) == 1:
+		fake.createObject(w, r, args[0])
+	case r.Method == "PUT" && len(args) == 1:
+		fake.updateObject(w, r, args[0])
+	case r.Method == "PUT" && len(args) == 2 && args[1] == "restore":
+		fake.requestObjectRestore(w, r, args[0])
+	case r.Method == "DELETE" && len(args) == 2 && args[1] == "delete":
+		fake.requestObjectDelete(w, r, args[0])
+	case r.Method == "GET" && len(args) == 2 && args[1] == "finish_delete":
+		fake.finishObjectDelete(w, r, args[0])
+	default:
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (fake *FakePharos) findObject(identifier string) *models.IntellectualObject {
+	for _, obj := range fake.objects {
+		if obj.Identifier == identifier {
+			return obj
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) findObjectById(id int) *models.IntellectualObject {
+	for _, obj := range fake.objects {
+		if obj.Id == id {
+			return obj
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) listObjects(w http.ResponseWriter, r *http.Request, institution string) {
+	params := r.URL.Query()
+	state := params.Get("state")
+	if state == "" {
+		state = "A"
+	}
+	results := make([]interface{}, 0)
+	for _, obj := range fake.objects {
+		if (institution != "" && obj.Institution != institution) ||
+			obj.State != state ||
+			!matchesParam(params, "storage_option", obj.StorageOption) ||
+			!matchesParam(params, "name_exact", obj.BagName) ||
+			!strings.Contains(obj.BagName, params.Get("name_contains")) {
+			continue
+		}
+		results = append(results, obj)
+	}
+	writeFakeList(w, r, results)
+}
+
+func (fake *FakePharos) getObject(w http.ResponseWriter, r *http.Request, identifier string) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		writeFakeError(w, http.StatusNotFound, "Object %s not found", identifier)
+		return
+	}
+	params := r.URL.Query()
+	includeAll := params.Get("include_all_relations") == "true"
+	copied := *obj
+	if includeAll || params.Get("include_files") == "true" {
+		copied.GenericFiles = make([]*models.GenericFile, 0)
+		for _, gf := range fake.files {
+			if gf.IntellectualObjectId == obj.Id && gf.State == "A" {
+				copied.GenericFiles = append(copied.GenericFiles,
+					fake.fileWithRelations(gf, includeAll))
+			}
+		}
+	}
+	if includeAll || params.Get("include_events") == "true" {
+		copied.PremisEvents = make([]*models.PremisEvent, 0)
+		for _, event := range fake.events {
+			if event.IntellectualObjectId == obj.Id && event.GenericFileId == 0 {
+				copied.PremisEvents = append(copied.PremisEvents, event)
+			}
+		}
+	}
+	writeFakeJson(w, http.StatusOK, &copied)
+}
+
+func (fake *FakePharos) createObject(w http.ResponseWriter, r *http.Request, institution string) {
+	data := struct {
+		Object *models.IntellectualObjectForPharos `json:"intellectual_object"`
+	}{}
+	if !readFakeJson(w, r, &data) {
+		return
+	}
+	if data.Object == nil || data.Object.Identifier == "" {
+		writeFakeError(w, http.StatusUnprocessableEntity, "Object identifier is required")
+		return
+	}
+	if fake.findObject(data.Object.Identifier) != nil {
+		writeFakeError(w, http.StatusUnprocessableEntity,
+			"Object identifier %s has already been taken", data.Object.Identifier)
+		return
+	}
+	inst := fake.findInstitutionById(data.Object.InstitutionId)
+	if inst == nil {
+		inst = fake.findInstitution(institution)
+	}
+	if inst == nil {
+		writeFakeError(w, http.StatusUnprocessableEntity, "Institution %s not found", institution)
+		return
+	}
+	now := time.Now().UTC()
+	obj := &models.IntellectualObject{
+		Id:            fake.newId(),
+		Institution:   inst.Identifier,
+		InstitutionId: inst.Id,
+		State:         "A",
+		CreatedAt:     now,
+	}
+	copyObjectAttributes(obj, data.Object)
+	obj.UpdatedAt = now
+	fake.objects = append(fake.objects, obj)
+	writeFakeJson(w, http.StatusCreated, obj)
+}
+
+func (fake *FakePharos) updateObject(w http.ResponseWriter, r *http.Request, identifier string) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		writeFakeError(w, http.StatusNotFound, "Object %s not found", identifier)
+		return
+	}
+	data := struct {
+		Object *models.IntellectualObjectForPharos `json:"intellectual_object"`
+	}{}
+	if !readFakeJson(w, r, &data) {
+		return
+	}
+	if data.Object == nil || data.Object.Identifier != obj.Identifier {
+		writeFakeError(w, http.StatusUnprocessableEntity, "Object identifier cannot change")
+		return
+	}
+	copyObjectAttributes(obj, data.Object)
+	obj.UpdatedAt = time.Now().UTC()
+	writeFakeJson(w, http.StatusOK, obj)
+}
+
+func copyObjectAttributes(obj *models.IntellectualObject, data *models.IntellectualObjectForPharos) {
+	obj.Identifier = data.Identifier
+	obj.BagName = data.BagName
+	obj.BagGroupIdentifier = data.BagGroupIdentifier
+	obj.Title = data.Title
+	obj.Description = data.Description
+	obj.AltIdentifier = data.AltIdentifier
+	obj.Access = data.Access
+	obj.DPNUUID = data.DPNUUID
+	obj.ETag = data.ETag
+	obj.StorageOption = data.StorageOption
+	obj.SourceOrganization = data.SourceOrganization
+	obj.BagItProfileIdentifier = data.BagItProfileIdentifier
+	if data.State != "" {
+		obj.State = data.State
+	}
+	if obj.StorageOption == "" {
+		obj.StorageOption = constants.StorageStandard
+	}
+}
+
+// requestObjectRestore creates a restore WorkItem for the object,
+// based on the object's most recent ingest WorkItem.
+func (fake *FakePharos) requestObjectRestore(w http.ResponseWriter, r *http.Request, identifier string) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		writeFakeError(w, http.StatusNotFound, "Object %s not found", identifier)
+		return
+	}
+	item := fake.newRequestedWorkItem(r, obj, constants.ActionRestore)
+	writeFakeJson(w, http.StatusOK, item)
+}
+
+// requestObjectDelete creates one delete WorkItem for each of the
+// object's active files. Deletion requests that come through the
+// API are approved by the API user.
+func (fake *FakePharos) requestObjectDelete(w http.ResponseWriter, r *http.Request, identifier string) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		writeFakeError(w, http.StatusNotFound, "Object %s not found", identifier)
+		return
+	}
+	approver := r.Header.Get("X-Pharos-API-User")
+	for _, gf := range fake.files {
+		if gf.IntellectualObjectId == obj.Id && gf.State == "A" {
+			item := fake.newRequestedWorkItem(r, obj, constants.ActionDelete)
+			item.GenericFileIdentifier = gf.Identifier
+			item.InstitutionalApprover = &approver
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fake *FakePharos) finishObjectDelete(w http.ResponseWriter, r *http.Request, identifier string) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		writeFakeError(w, http.StatusNotFound, "Object %s not found", identifier)
+		return
+	}
+	obj.State = "D"
+	obj.UpdatedAt = time.Now().UTC()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newRequestedWorkItem creates and saves a pending WorkItem for the
+// object, copying bag info from the object's latest ingest WorkItem,
+// as Pharos does.
+func (fake *FakePharos) newRequestedWorkItem(r *http.Request, obj *models.IntellectualObject, action string) *models.WorkItem {
+	now := time.Now().UTC()
+	item := &models.WorkItem{
+		Id:               fake.newId(),
+		ObjectIdentifier: obj.Identifier,
+		Name:             obj.BagName + ".tar",
+		InstitutionId:    obj.InstitutionId,
+		User:             r.Header.Get("X-Pharos-API-User"),
+		Date:             now,
+		Note:             fmt.Sprintf("%s requested", action),
+		Action:           action,
+		Stage:            constants.StageRequested,
+		Status:           constants.StatusPending,
+		Outcome:          "Not started",
+		Retry:            true,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	for i := len(fake.workItems) - 1; i >= 0; i-- {
+		ingestItem := fake.workItems[i]
+		if ingestItem.ObjectIdentifier == obj.Identifier && ingestItem.Action == constants.ActionIngest {
+			item.Name = ingestItem.Name
+			item.Bucket = ingestItem.Bucket
+			item.ETag = ingestItem.ETag
+			item.Size = ingestItem.Size
+			item.BagDate = ingestItem.BagDate
+			break
+		}
+	}
+	fake.workItems = append(fake.workItems, item)
+	return item
+}
+
+// -------------------------------------------------------------------------
+// GenericFiles
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) handleFiles(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case r.Method == "GET" && len(args) == 0:
+		fake.listFiles(w, r)
+	case r.Method == "GET" && len(args) == 1:
+		fake.getFile(w, r, args[0])
+	case r.Method == "POST" && len(args) == 0:
+		fake.createFile(w, r)
+	case r.Method == "PUT" && len(args) == 1:
+		fake.updateFile(w, r, args[0])
+	case r.Method == "POST" && len(args) == 2 && args[1] == "create_batch":
+		fake.createFileBatch(w, r, args[0])
+	case r.Method == "PUT" && len(args) == 2 && args[0] == "restore":
+		fake.requestFileRestore(w, r, args[1])
+	case r.Method == "GET" && len(args) == 2 && args[0] == "finish_delete":
+		fake.finishFileDelete(w, r, args[1])
+	default:
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (fake *FakePharos) findFile(identifier string) *models.GenericFile {
+	for _, gf := range fake.files {
+		if gf.Identifier == identifier {
+			return gf
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) findFileById(id int) *models.GenericFile {
+	for _, gf := range fake.files {
+		if gf.Id == id {
+			return gf
+		}
+	}
+	return nil
+}
+
+// fileWithRelations returns a copy of the GenericFile with its checksums
+// and, optionally, its events. It never changes the saved file.
+func (fake *FakePharos) fileWithRelations(gf *models.GenericFile, includeEvents bool) *models.GenericFile {
+	copied := *gf
+	copied.Checksums = make([]*models.Checksum, 0)
+	for _, cs := range fake.checksums {
+		if cs.GenericFileId == gf.Id {
+			copied.Checksums = append(copied.Checksums, cs)
+		}
+	}
+	copied.PremisEvents = nil
+	if includeEvents {
+		copied.PremisEvents = make([]*models.PremisEvent, 0)
+		for _, event := range fake.events {
+			if event.GenericFileId == gf.Id {
+				copied.PremisEvents = append(copied.PremisEvents, event)
+			}
+		}
+	}
+	return &copied
+}
+
+func (fake *FakePharos) listFiles(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	includeRelations := params.Get("include_relations") == "true"
+	results := make([]interface{}, 0)
+	for _, gf := range fake.files {
+		if !matchesParam(params, "intellectual_object_identifier", gf.IntellectualObjectIdentifier) ||
+			!matchesParam(params, "state", gf.State) ||
+			!matchesParam(params, "storage_option", gf.StorageOption) ||
+			!strings.Contains(gf.Identifier, params.Get("identifier_like")) {
+			continue
+		}
+		if includeRelations {
+			results = append(results, fake.fileWithRelations(gf, true))
+		} else {
+			results = append(results, gf)
+		}
+	}
+	writeFakeList(w, r, results)
+}
+
+func (fake *FakePharos) getFile(w http.ResponseWriter, r *http.Request, identifier string) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		writeFakeError(w, http.StatusNotFound, "GenericFile %s not found", identifier)
+		return
+	}
+	if r.URL.Query().Get("include_relations") == "true" {
+		writeFakeJson(w, http.StatusOK, fake.fileWithRelations(gf, true))
+	} else {
+		writeFakeJson(w, http.StatusOK, gf)
+	}
+}
+
+func (fake *FakePharos) createFile(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		File *models.GenericFileForPharos `json:"generic_file"`
+	}{}
+	if !readFakeJson(w, r, &data) {
+		return
+	}
+	gf, err := fake.saveNewFile(data.File)
+	if err != nil {
+		writeFakeError(w, http.StatusUnprocessableEntity, "%s", err.Error())
+		return
+	}
+	writeFakeJson(w, http.StatusCreated, fake.fileWithRelations(gf, true))
+}
+
+func (fake *FakePharos) createFileBatch(w http.ResponseWriter, r *http.Request, objId string) {
+	batch := make([]*models.GenericFileForPharos, 0)
+	if !readFakeJson(w, r, &batch) {
+		return
+	}
+	// Validate the whole batch before saving anything, since
+	// Pharos saves the batch in a single transaction.
+	for _, data := range batch {
+		err := fake.validateNewFile(data)
+		if err != nil {
+			writeFakeError(w, http.StatusUnprocessableEntity, "%s", err.Error())
+			return
+		}
+		if strconv.Itoa(data.IntellectualObjectId) != objId {
+			writeFakeError(w, http.StatusUnprocessableEntity,
+				"File %s does not belong to object %s", data.Identifier, objId)
+			return
+		}
+	}
+	results := make([]interface{}, len(batch))
+	for i, data := range batch {
+		gf, err := fake.saveNewFile(data)
+		if err != nil {
+			writeFakeError(w, http.StatusUnprocessableEntity, "%s", err.Error())
+			return
+		}
+		results[i] = fake.fileWithRelations(gf, true)
+	}
+	writeFakeJson(w, http.StatusCreated, fakeList(results, nil, nil))
+}
+
+func (fake *FakePharos) validateNewFile(data *models.GenericFileForPharos) error {
+	if data == nil || data.Identifier == "" {
+		return fmt.Errorf("GenericFile identifier is required")
+	}
+	if fake.findFile(data.Identifier) != nil {
+		return fmt.Errorf("GenericFile identifier %s has already been taken", data.Identifier)
+	}
+	if fake.findObjectById(data.IntellectualObjectId) == nil {
+		return fmt.Errorf("IntellectualObject %d not found", data.IntellectualObjectId)
+	}
+	for _, event := range data.PremisEvents {
+		if fake.findEvent(event.Identifier) != nil {
+			return fmt.Errorf("PremisEvent identifier %s has already been taken", event.Identifier)
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) saveNewFile(data *models.GenericFileForPharos) (*models.GenericFile, error) {
+	err := fake.validateNewFile(data)
+	if err != nil {
+		return nil, err
+	}
+	obj := fake.findObjectById(data.IntellectualObjectId)
+	now := time.Now().UTC()
+	gf := &models.GenericFile{
+		Id:                           fake.newId(),
+		IntellectualObjectId:         obj.Id,
+		IntellectualObjectIdentifier: obj.Identifier,
+		State:                        "A",
+		CreatedAt:                    now,
+	}
+	copyFileAttributes(gf, data)
+	gf.UpdatedAt = now
+	fake.files = append(fake.files, gf)
+	fake.saveFileChildren(gf, data)
+	return gf, nil
+}
+
+func (fake *FakePharos) updateFile(w http.ResponseWriter, r *http.Request, identifier string) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		writeFakeError(w, http.StatusNotFound, "GenericFile %s not found", identifier)
+		return
+	}
+	data := struct {
+		File *models.GenericFileForPharos `json:"generic_file"`
+	}{}
+	if !readFakeJson(w, r, &data) {
+		return
+	}
+	if data.File == nil || data.File.Identifier != gf.Identifier {
+		writeFakeError(w, http.StatusUnprocessableEntity, "GenericFile identifier cannot change")
+		return
+	}
+	copyFileAttributes(gf, data.File)
+	gf.UpdatedAt = time.Now().UTC()
+	fake.saveFileChildren(gf, data.File)
+	writeFakeJson(w, http.StatusOK, fake.fileWithRelations(gf, true))
+}
+
+func copyFileAttributes(gf *models.GenericFile, data *models.GenericFileForPharos) {
+	gf.Identifier = data.Identifier
+	gf.FileFormat = data.FileFormat
+	gf.URI = data.URI
+	gf.Size = data.Size
+	gf.StorageOption = data.StorageOption
+	if gf.StorageOption == "" {
+		gf.StorageOption = constants.StorageStandard
+	}
+}
+
+// saveFileChildren saves the new checksums and events that came in
+// as nested attributes of a GenericFile. Checksums and events that
+// already have ids are already saved, and can't be changed.
+func (fake *FakePharos) saveFileChildren(gf *models.GenericFile, data *models.GenericFileForPharos) {
+	for _, cs := range data.Checksums {
+		if cs.Id == 0 {
+			fake.saveNewChecksum(gf, cs)
+		}
+	}
+	for _, event := range data.PremisEvents {
+		if event.Id == 0 && fake.findEvent(event.Identifier) == nil {
+			event.GenericFileId = gf.Id
+			event.GenericFileIdentifier = gf.Identifier
+			event.IntellectualObjectId = gf.IntellectualObjectId
+			event.IntellectualObjectIdentifier = gf.IntellectualObjectIdentifier
+			fake.saveNewEvent(event)
+		}
+	}
+}
+
+func (fake *FakePharos) requestFileRestore(w http.ResponseWriter, r *http.Request, identifier string) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		writeFakeError(w, http.StatusNotFound, "GenericFile %s not found", identifier)
+		return
+	}
+	obj := fake.findObjectById(gf.IntellectualObjectId)
+	item := fake.newRequestedWorkItem(r, obj, constants.ActionRestore)
+	item.GenericFileIdentifier = gf.Identifier
+	writeFakeJson(w, http.StatusOK, item)
+}
+
+func (fake *FakePharos) finishFileDelete(w http.ResponseWriter, r *http.Request, identifier string) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		writeFakeError(w, http.StatusNotFound, "GenericFile %s not found", identifier)
+		return
+	}
+	gf.State = "D"
+	gf.UpdatedAt = time.Now().UTC()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// -------------------------------------------------------------------------
+// Checksums
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) handleChecksums(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case r.Method == "GET" && len(args) == 0:
+		fake.listChecksums(w, r)
+	case r.Method == "GET" && len(args) == 1:
+		for _, cs := range fake.checksums {
+			if strconv.Itoa(cs.Id) == args[0] {
+				writeFakeJson(w, http.StatusOK, cs)
+				return
+			}
+		}
+		writeFakeError(w, http.StatusNotFound, "Checksum %s not found", args[0])
+	case r.Method == "POST" && len(args) == 1:
+		fake.createChecksum(w, r, args[0])
+	default:
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (fake *FakePharos) listChecksums(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var gf *models.GenericFile
+	if params.Get("generic_file_identifier") != "" {
+		gf = fake.findFile(params.Get("generic_file_identifier"))
+		if gf == nil {
+			writeFakeList(w, r, make([]interface{}, 0))
+			return
+		}
+	}
+	matches := make([]*models.Checksum, 0)
+	for _, cs := range fake.checksums {
+		if (gf != nil && cs.GenericFileId != gf.Id) ||
+			!matchesParam(params, "algorithm", cs.Algorithm) {
+			continue
+		}
+		matches = append(matches, cs)
+	}
+	if params.Get("sort") == "datetime DESC" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].DateTime.After(matches[j].DateTime)
+		})
+	}
+	results := make([]interface{}, len(matches))
+	for i, cs := range matches {
+		results[i] = cs
+	}
+	writeFakeList(w, r, results)
+}
+
+func (fake *FakePharos) createChecksum(w http.ResponseWriter, r *http.Request, gfIdentifier string) {
+	gf := fake.findFile(gfIdentifier)
+	if gf == nil {
+		writeFakeError(w, http.StatusNotFound, "GenericFile %s not found", gfIdentifier)
+		return
+	}
+	data := struct {
+		Checksum *models.ChecksumForPharos `json:"checksum"`
+	}{}
+	if !readFakeJson(w, r, &data) {
+		return
+	}
+	if data.Checksum == nil || data.Checksum.Algorithm == "" || data.Checksum.Digest == "" {
+		writeFakeError(w, http.StatusUnprocessableEntity, "Checksum algorithm and digest are required")
+		return
+	}
+	writeFakeJson(w, http.StatusCreated, fake.saveNewChecksum(gf, data.Checksum))
+}
+
+func (fake *FakePharos) saveNewChecksum(gf *models.GenericFile, data *models.ChecksumForPharos) *models.Checksum {
+	now := time.Now().UTC()
+	cs := &models.Checksum{
+		Id:            fake.newId(),
+		GenericFileId: gf.Id,
+		Algorithm:     data.Algorithm,
+		DateTime:      data.DateTime,
+		Digest:        data.Digest,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	fake.checksums = append(fake.checksums, cs)
+	return cs
+}
+
+// -------------------------------------------------------------------------
+// PremisEvents
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) handleEvents(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case r.Method == "GET" && len(args) == 0:
+		fake.listEvents(w, r)
+	case r.Method == "GET" && len(args) == 1:
+		event := fake.findEvent(args[0])
+		if event == nil {
+			writeFakeError(w, http.StatusNotFound, "PremisEvent %s not found", args[0])
+			return
+		}
+		writeFakeJson(w, http.StatusOK, event)
+	case r.Method == "POST" && len(args) == 0:
+		fake.createEvent(w, r)
+	default:
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (fake *FakePharos) findEvent(identifier string) *models.PremisEvent {
+	for _, event := range fake.events {
+		if event.Identifier == identifier {
+			return event
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) listEvents(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	results := make([]interface{}, 0)
+	for _, event := range fake.events {
+		if !matchesParam(params, "object_identifier", event.IntellectualObjectIdentifier) ||
+			!matchesParam(params, "file_identifier", event.GenericFileIdentifier) ||
+			!matchesParam(params, "event_type", event.EventType) {
+			continue
+		}
+		results = append(results, event)
+	}
+	writeFakeList(w, r, results)
+}
+
+func (fake *FakePharos) createEvent(w http.ResponseWriter, r *http.Request) {
+	data := &models.PremisEventForPharos{}
+	if !readFakeJson(w, r, data) {
+		return
+	}
+	if data.Identifier == "" || data.EventType == "" {
+		writeFakeError(w, http.StatusUnprocessableEntity, "PremisEvent identifier and event_type are required")
+		return
+	}
+	if fake.findEvent(data.Identifier) != nil {
+		writeFakeError(w, http.StatusUnprocessableEntity,
+			"PremisEvent identifier %s has already been taken", data.Identifier)
+		return
+	}
+	// Pharos looks up the object and file from their identifiers.
+	if data.GenericFileIdentifier != "" {
+		gf := fake.findFile(data.GenericFileIdentifier)
+		if gf == nil {
+			writeFakeError(w, http.StatusUnprocessableEntity,
+				"GenericFile %s not found", data.GenericFileIdentifier)
+			return
+		}
+		data.GenericFileId = gf.Id
+	}
+	obj := fake.findObject(data.IntellectualObjectIdentifier)
+	if obj == nil {
+		writeFakeError(w, http.StatusUnprocessableEntity,
+			"IntellectualObject %s not found", data.IntellectualObjectIdentifier)
+		return
+	}
+	data.IntellectualObjectId = obj.Id
+	writeFakeJson(w, http.StatusCreated, fake.saveNewEvent(data))
+}
+
+func (fake *FakePharos) saveNewEvent(data *models.PremisEventForPharos) *models.PremisEvent {
+	now := time.Now().UTC()
+	event := &models.PremisEvent{
+		Id:                           fake.newId(),
+		Identifier:                   data.Identifier,
+		EventType:                    data.EventType,
+		DateTime:                     data.DateTime,
+		Detail:                       data.Detail,
+		Outcome:                      data.Outcome,
+		OutcomeDetail:                data.OutcomeDetail,
+		Object:                       data.Object,
+		Agent:                        data.Agent,
+		OutcomeInformation:           data.OutcomeInformation,
+		IntellectualObjectId:         data.IntellectualObjectId,
+		IntellectualObjectIdentifier: data.IntellectualObjectIdentifier,
+		GenericFileId:                data.GenericFileId,
+		GenericFileIdentifier:        data.GenericFileIdentifier,
+		CreatedAt:                    now,
+		UpdatedAt:                    now,
+	}
+	fake.events = append(fake.events, event)
+	return event
+}
+
+// -------------------------------------------------------------------------
+// WorkItems and WorkItemStates
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) handleWorkItems(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case r.Method == "GET" && len(args) == 0:
+		fake.listWorkItems(w, r)
+	case r.Method == "GET" && len(args) == 1:
+		item := fake.findWorkItem(args[0])
+		if item == nil {
+			writeFakeError(w, http.StatusNotFound, "WorkItem %s not found", args[0])
+			return
+		}
+		writeFakeJson(w, http.StatusOK, item)
+	case r.Method == "POST" && len(args) == 0:
+		fake.saveWorkItem(w, r, nil)
+	case r.Method == "PUT" && len(args) == 1:
+		item := fake.findWorkItem(args[0])
+		if item == nil {
+			writeFakeError(w, http.StatusNotFound, "WorkItem %s not found", args[0])
+			return
+		}
+		fake.saveWorkItem(w, r, item)
+	default:
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (fake *FakePharos) findWorkItem(id string) *models.WorkItem {
+	for _, item := range fake.workItems {
+		if strconv.Itoa(item.Id) == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) listWorkItems(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	results := make([]interface{}, 0)
+	for _, item := range fake.workItems {
+		if !matchesParam(params, "name", item.Name) ||
+			!matchesParam(params, "etag", item.ETag) ||
+			!matchesParam(params, "bucket", item.Bucket) ||
+			!matchesParam(params, "object_identifier", item.ObjectIdentifier) ||
+			!matchesParam(params, "file_identifier", item.GenericFileIdentifier) ||
+			!matchesParam(params, "status", item.Status) ||
+			!matchesParam(params, "stage", item.Stage) ||
+			!matchesParam(params, "item_action", item.Action) ||
+			!strings.Contains(item.Name, params.Get("name_contains")) ||
+			(params.Get("node_empty") == "true" && item.Node != "") ||
+			(params.Get("queued") == "false" && item.QueuedAt != nil) {
+			continue
+		}
+		results = append(results, item)
+	}
+	writeFakeList(w, r, results)
+}
+
+// saveWorkItem creates a new WorkItem if item is nil, or updates item.
+// The client never sends work_item_state_id, so we keep the existing one.
+func (fake *FakePharos) saveWorkItem(w http.ResponseWriter, r *http.Request, item *models.WorkItem) {
+	data := &models.WorkItem{}
+	if !readFakeJson(w, r, data) {
+		return
+	}
+	if data.Name == "" || data.Action == "" {
+		writeFakeError(w, http.StatusUnprocessableEntity, "WorkItem name and action are required")
+		return
+	}
+	now := time.Now().UTC()
+	status := http.StatusOK
+	if item == nil {
+		item = &models.WorkItem{Id: fake.newId(), CreatedAt: now}
+		fake.workItems = append(fake.workItems, item)
+		status = http.StatusCreated
+	}
+	data.Id = item.Id
+	data.WorkItemStateId = item.WorkItemStateId
+	data.CreatedAt = item.CreatedAt
+	data.UpdatedAt = now
+	*item = *data
+	writeFakeJson(w, status, item)
+}
+
+func (fake *FakePharos) handleWorkItemStates(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case r.Method == "GET" && len(args) == 1:
+		state := fake.findWorkItemState(args[0])
+		if state == nil {
+			writeFakeError(w, http.StatusNotFound, "WorkItemState %s not found", args[0])
+			return
+		}
+		writeFakeJson(w, http.StatusOK, state)
+	case r.Method == "POST" && len(args) == 0:
+		fake.saveWorkItemState(w, r, nil)
+	case r.Method == "PUT" && len(args) == 1:
+		state := fake.findWorkItemState(args[0])
+		if state == nil {
+			writeFakeError(w, http.StatusNotFound, "WorkItemState %s not found", args[0])
+			return
+		}
+		fake.saveWorkItemState(w, r, state)
+	default:
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (fake *FakePharos) findWorkItemState(id string) *models.WorkItemState {
+	for _, state := range fake.workItemStates {
+		if strconv.Itoa(state.Id) == id {
+			return state
+		}
+	}
+	return nil
+}
+
+// saveWorkItemState creates or updates a WorkItemState. Each WorkItem
+// has at most one state, so a POST for a WorkItem that already has a
+// state updates the existing record, as Pharos does.
+func (fake *FakePharos) saveWorkItemState(w http.ResponseWriter, r *http.Request, state *models.WorkItemState) {
+	data := &models.WorkItemStateForPharos{}
+	if !readFakeJson(w, r, data) {
+		return
+	}
+	item := fake.findWorkItem(strconv.Itoa(data.WorkItemId))
+	if item == nil {
+		writeFakeError(w, http.StatusUnprocessableEntity, "WorkItem %d not found", data.WorkItemId)
+		return
+	}
+	if state == nil && item.WorkItemStateId != nil {
+		state = fake.findWorkItemState(strconv.Itoa(*item.WorkItemStateId))
+	}
+	now := time.Now().UTC()
+	status := http.StatusOK
+	if state == nil {
+		state = &models.WorkItemState{Id: fake.newId(), CreatedAt: now}
+		fake.workItemStates = append(fake.workItemStates, state)
+		status = http.StatusCreated
+	}
+	state.WorkItemId = data.WorkItemId
+	state.Action = data.Action
+	state.State = data.State
+	state.UpdatedAt = now
+	stateId := state.Id
+	item.WorkItemStateId = &stateId
+	writeFakeJson(w, status, state)
+}
+
+func (fake *FakePharos) handleNotifications(w http.ResponseWriter, r *http.Request, args []string) {
+	if r.Method != "GET" || len(args) != 2 || args[0] != "spot_test_restoration" {
+		writeFakeError(w, http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+		return
+	}
+	item := fake.findWorkItem(args[1])
+	if item == nil {
+		writeFakeError(w, http.StatusNotFound, "WorkItem %s not found", args[1])
+		return
+	}
+	writeFakeJson(w, http.StatusOK, item)
+}
+
+// -------------------------------------------------------------------------
+// Utility functions
+// -------------------------------------------------------------------------
+
+// matchesParam returns true if the query param is empty or
+// exactly matches value.
+func matchesParam(params url.Values, name, value string) bool {
+	param := params.Get(name)
+	return param == "" || param == value
+}
+
+func fakeList(results []interface{}, next, previous *string) map[string]interface{} {
+	return map[string]interface{}{
+		"count":    len(results),
+		"next":     next,
+		"previous": previous,
+		"results":  results,
+	}
+}
+
+// writeFakeList writes one page of results, using the page and per_page
+// query params, along with links to the next and previous pages.
+func writeFakeList(w http.ResponseWriter, r *http.Request, results []interface{}) {
+	params := r.URL.Query()
+	page, _ := strconv.Atoi(params.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(params.Get("per_page"))
+	if perPage < 1 {
+		perPage = 100
+	}
+	start := (page - 1) * perPage
+	if start > len(results) {
+		start = len(results)
+	}
+	end := start + perPage
+	if end > len(results) {
+		end = len(results)
+	}
+	pageUrl := func(pageNumber int) *string {
+		params.Set("page", strconv.Itoa(pageNumber))
+		link := fmt.Sprintf("http://%s%s?%s", r.Host, r.URL.Path, params.Encode())
+		return &link
+	}
+	var next, previous *string
+	if end < len(results) {
+		next = pageUrl(page + 1)
+	}
+	if page > 1 {
+		previous = pageUrl(page - 1)
+	}
+	data := fakeList(results[start:end], next, previous)
+	data["count"] = len(results)
+	writeFakeJson(w, http.StatusOK, data)
+}
+
+func writeFakeJson(w http.ResponseWriter, status int, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		writeFakeError(w, http.StatusInternalServerError, "Error encoding JSON: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	jsonData, _ := json.Marshal(map[string]string{
+		"error": fmt.Sprintf(format, a...),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
+
+// readFakeJson parses the request body into data. On error, it writes
+// a 400 response and returns false.
+func readFakeJson(w http.ResponseWriter, r *http.Request, data interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(data)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Error decoding JSON: %v", err)
+		return false
+	}
+	return true
+}
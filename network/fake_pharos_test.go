@@ -0,0 +1,315 @@
+package network_test
+
+import (
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func getFakePharos(t *testing.T) (*network.FakePharos, *network.PharosClient, *models.Institution) {
+	fake := network.NewFakePharos()
+	client, err := fake.Client()
+	require.Nil(t, err)
+	inst := fake.AddInstitution(&models.Institution{
+		Name:       "Test University",
+		BriefName:  "test",
+		Identifier: "test.edu",
+	})
+	return fake, client, inst
+}
+
+// saveFakeObject saves a new object with fileCount files, each having
+// two checksums and two events, and returns the saved object.
+func saveFakeObject(t *testing.T, client *network.PharosClient, inst *models.Institution, fileCount int) *models.IntellectualObject {
+	obj := testutil.MakeIntellectualObject(fileCount, 0, 0, 0)
+	obj.Id = 0
+	obj.Identifier = "test.edu/fake_bag"
+	obj.BagName = "fake_bag"
+	obj.Institution = inst.Identifier
+	obj.InstitutionId = inst.Id
+	resp := client.IntellectualObjectSave(obj)
+	require.Nil(t, resp.Error)
+	savedObj := resp.IntellectualObject()
+	require.NotNil(t, savedObj)
+
+	if fileCount > 0 {
+		files := make([]*models.GenericFile, fileCount)
+		for i := range files {
+			files[i] = testutil.MakeGenericFile(2, 2, savedObj.Identifier)
+			files[i].Id = 0
+			files[i].IntellectualObjectId = savedObj.Id
+			for _, cs := range files[i].Checksums {
+				cs.Id = 0
+			}
+			for _, event := range files[i].PremisEvents {
+				// Not random, so tests can count events by type.
+				event.Id = 0
+				event.EventType = constants.EventFixityCheck
+				event.IntellectualObjectIdentifier = savedObj.Identifier
+			}
+		}
+		resp = client.GenericFileSaveBatch(files)
+		require.Nil(t, resp.Error)
+		require.Equal(t, fileCount, len(resp.GenericFiles()))
+	}
+	return savedObj
+}
+
+func TestFakePharosInstitutions(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+
+	assert.NotEqual(t, 0, inst.Id)
+	assert.Equal(t, "aptrust.receiving.test.edu", inst.ReceivingBucket)
+	assert.Equal(t, "aptrust.restore.test.edu", inst.RestoreBucket)
+
+	resp := client.InstitutionGet("test.edu")
+	require.Nil(t, resp.Error)
+	assert.Equal(t, inst.Id, resp.Institution().Id)
+
+	resp = client.InstitutionList(nil)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, len(resp.Institutions()))
+
+	resp = client.InstitutionGet("bad.edu")
+	assert.NotNil(t, resp.Error)
+	assert.Equal(t, 404, resp.Response.StatusCode)
+}
+
+func TestFakePharosObjectsAndFiles(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+	obj := saveFakeObject(t, client, inst, 3)
+	assert.NotEqual(t, 0, obj.Id)
+	assert.Equal(t, "A", obj.State)
+	assert.Equal(t, "test.edu", obj.Institution)
+
+	// Duplicate identifiers are not allowed.
+	dupe := testutil.MakeIntellectualObject(0, 0, 0, 0)
+	dupe.Id = 0
+	dupe.Identifier = obj.Identifier
+	dupe.Institution = inst.Identifier
+	resp := client.IntellectualObjectSave(dupe)
+	assert.NotNil(t, resp.Error)
+
+	// Plain get has no files or events.
+	resp = client.IntellectualObjectGet(obj.Identifier, false, false)
+	require.Nil(t, resp.Error)
+	assert.Empty(t, resp.IntellectualObject().GenericFiles)
+
+	// Files include their checksums.
+	resp = client.IntellectualObjectGet(obj.Identifier, true, false)
+	require.Nil(t, resp.Error)
+	files := resp.IntellectualObject().GenericFiles
+	require.Equal(t, 3, len(files))
+	assert.Equal(t, 2, len(files[0].Checksums))
+	assert.Empty(t, files[0].PremisEvents)
+
+	resp = client.GenericFileGet(files[0].Identifier, true)
+	require.Nil(t, resp.Error)
+	gf := resp.GenericFile()
+	assert.Equal(t, obj.Identifier, gf.IntellectualObjectIdentifier)
+	assert.Equal(t, 2, len(gf.Checksums))
+	assert.Equal(t, 2, len(gf.PremisEvents))
+	assert.Equal(t, gf.Id, gf.PremisEvents[0].GenericFileId)
+
+	// Update
+	gf.URI = "https://example.com/new-uri"
+	gf.Checksums = nil
+	gf.PremisEvents = nil
+	resp = client.GenericFileSave(gf)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "https://example.com/new-uri", resp.GenericFile().URI)
+	assert.Equal(t, 2, len(resp.GenericFile().Checksums))
+
+	// List with paging
+	params := url.Values{}
+	params.Set("intellectual_object_identifier", obj.Identifier)
+	params.Set("page", "1")
+	params.Set("per_page", "2")
+	resp = client.GenericFileList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 3, resp.Count)
+	assert.Equal(t, 2, len(resp.GenericFiles()))
+	require.True(t, resp.HasNextPage())
+	assert.False(t, resp.HasPreviousPage())
+	resp = client.GenericFileList(resp.ParamsForNextPage())
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, len(resp.GenericFiles()))
+	assert.False(t, resp.HasNextPage())
+	assert.True(t, resp.HasPreviousPage())
+
+	params = url.Values{}
+	params.Set("institution", "test.edu")
+	resp = client.IntellectualObjectList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, len(resp.IntellectualObjects()))
+
+	resp = client.GenericFileGet("test.edu/fake_bag/does not exist", false)
+	assert.NotNil(t, resp.Error)
+	assert.Equal(t, 404, resp.Response.StatusCode)
+}
+
+func TestFakePharosChecksumsAndEvents(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+	obj := saveFakeObject(t, client, inst, 1)
+	resp := client.IntellectualObjectGet(obj.Identifier, true, false)
+	require.Nil(t, resp.Error)
+	gf := resp.IntellectualObject().GenericFiles[0]
+
+	older := &models.Checksum{
+		Algorithm: constants.AlgSha256,
+		DateTime:  time.Now().UTC().Add(-1 * time.Hour),
+		Digest:    "older",
+	}
+	newer := &models.Checksum{
+		Algorithm: constants.AlgSha256,
+		DateTime:  time.Now().UTC(),
+		Digest:    "newer",
+	}
+	for _, cs := range []*models.Checksum{older, newer} {
+		resp = client.ChecksumSave(cs, gf.Identifier)
+		require.Nil(t, resp.Error)
+		assert.Equal(t, gf.Id, resp.Checksum().GenericFileId)
+	}
+	params := url.Values{}
+	params.Set("generic_file_identifier", gf.Identifier)
+	params.Set("algorithm", constants.AlgSha256)
+	params.Set("sort", "datetime DESC")
+	resp = client.ChecksumList(params)
+	require.Nil(t, resp.Error)
+	require.NotEmpty(t, resp.Checksums())
+	assert.Equal(t, "newer", resp.Checksums()[0].Digest)
+
+	event := testutil.MakePremisEvent()
+	event.Id = 0
+	event.EventType = constants.EventDeletion
+	event.IntellectualObjectIdentifier = obj.Identifier
+	event.GenericFileIdentifier = gf.Identifier
+	resp = client.PremisEventSave(event)
+	require.Nil(t, resp.Error)
+	savedEvent := resp.PremisEvent()
+	assert.Equal(t, obj.Id, savedEvent.IntellectualObjectId)
+	assert.Equal(t, gf.Id, savedEvent.GenericFileId)
+
+	resp = client.PremisEventGet(event.Identifier)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, savedEvent.Id, resp.PremisEvent().Id)
+
+	// Event identifiers must be unique.
+	resp = client.PremisEventSave(event)
+	assert.NotNil(t, resp.Error)
+
+	params = url.Values{}
+	params.Set("object_identifier", obj.Identifier)
+	resp = client.PremisEventList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 3, len(resp.PremisEvents()))
+	params.Set("event_type", constants.EventDeletion)
+	resp = client.PremisEventList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, len(resp.PremisEvents()))
+}
+
+func TestFakePharosWorkItems(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+
+	item := testutil.MakeWorkItem()
+	item.Id = 0
+	item.Action = constants.ActionIngest
+	item.InstitutionId = inst.Id
+	resp := client.WorkItemSave(item)
+	require.Nil(t, resp.Error)
+	savedItem := resp.WorkItem()
+	assert.NotEqual(t, 0, savedItem.Id)
+	assert.Nil(t, savedItem.WorkItemStateId)
+
+	// POSTing a state for an item that already has
+	// one updates the existing state.
+	state := &models.WorkItemState{WorkItemId: savedItem.Id, Action: constants.ActionIngest, State: "{}"}
+	resp = client.WorkItemStateSave(state)
+	require.Nil(t, resp.Error)
+	stateId := resp.WorkItemState().Id
+	state.State = `{"updated":true}`
+	resp = client.WorkItemStateSave(state)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, stateId, resp.WorkItemState().Id)
+
+	// Saving the WorkItem does not lose its state id.
+	savedItem.Note = "Updated"
+	resp = client.WorkItemSave(savedItem)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "Updated", resp.WorkItem().Note)
+	require.NotNil(t, resp.WorkItem().WorkItemStateId)
+	assert.Equal(t, stateId, *resp.WorkItem().WorkItemStateId)
+
+	resp = client.WorkItemStateGet(stateId)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, `{"updated":true}`, resp.WorkItemState().State)
+
+	params := url.Values{}
+	params.Set("item_action", constants.ActionIngest)
+	params.Set("name", item.Name)
+	resp = client.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, len(resp.WorkItems()))
+	params.Set("name", "no such name")
+	resp = client.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	assert.Empty(t, resp.WorkItems())
+
+	resp = client.WorkItemStateGet(999999)
+	assert.NotNil(t, resp.Error)
+	assert.Equal(t, 404, resp.Response.StatusCode)
+}
+
+func TestFakePharosRestoreAndDelete(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+	obj := saveFakeObject(t, client, inst, 2)
+
+	resp := client.IntellectualObjectRequestRestore(obj.Identifier)
+	require.Nil(t, resp.Error)
+	restoreItem := resp.WorkItem()
+	assert.Equal(t, constants.ActionRestore, restoreItem.Action)
+	assert.Equal(t, constants.StageRequested, restoreItem.Stage)
+	assert.Equal(t, constants.StatusPending, restoreItem.Status)
+	assert.Equal(t, obj.Identifier, restoreItem.ObjectIdentifier)
+
+	resp = client.IntellectualObjectRequestDelete(obj.Identifier)
+	require.Nil(t, resp.Error)
+	params := url.Values{}
+	params.Set("item_action", constants.ActionDelete)
+	params.Set("object_identifier", obj.Identifier)
+	resp = client.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	deleteItems := resp.WorkItems()
+	require.Equal(t, 2, len(deleteItems))
+	for _, item := range deleteItems {
+		assert.NotEmpty(t, item.GenericFileIdentifier)
+		require.NotNil(t, item.InstitutionalApprover)
+		resp = client.GenericFileFinishDelete(item.GenericFileIdentifier)
+		require.Nil(t, resp.Error)
+	}
+
+	params = url.Values{}
+	params.Set("intellectual_object_identifier", obj.Identifier)
+	params.Set("state", "A")
+	resp = client.GenericFileList(params)
+	require.Nil(t, resp.Error)
+	assert.Empty(t, resp.GenericFiles())
+
+	resp = client.IntellectualObjectFinishDelete(obj.Identifier)
+	require.Nil(t, resp.Error)
+	resp = client.IntellectualObjectGet(obj.Identifier, false, false)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "D", resp.IntellectualObject().State)
+}
@@ -0,0 +1,571 @@
+package network
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localMetadataDir is the directory under LocalBackend.Root where
+// we keep content types, etags and metadata for stored objects.
+const localMetadataDir = ".metadata"
+
+// localMultipartDir is the directory under LocalBackend.Root where
+// we keep the parts of multipart uploads until they're completed.
+const localMultipartDir = ".multipart"
+
+// LocalBackend is a StorageBackend that stores objects on the local
+// file system. Each bucket is a directory under Root, and each key is
+// a file in its bucket's directory. Object metadata lives in JSON
+// files under Root/.metadata. This lets us run ingest and restore
+// against a local directory during development and testing.
+type LocalBackend struct {
+	Root string
+	ctx  context.Context
+}
+
+// NewLocalBackend returns a LocalBackend that stores objects under
+// the root directory, creating that directory if necessary.
+func NewLocalBackend(root string) (*LocalBackend, error) {
+	if root == "" {
+		return nil, fmt.Errorf("LocalBackend requires a root directory")
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(absRoot, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalBackend{Root: absRoot}, nil
+}
+
+// WithContext returns a copy of the backend that stops reading and
+// writing when ctx is cancelled or its deadline passes. Local files
+// don't hang the way network connections do, but this lets tests use
+// a LocalBackend wherever the workers use an S3Backend. If ctx is
+// nil, the copy uses context.Background().
+func (backend *LocalBackend) WithContext(ctx context.Context) StorageBackend {
+	return &LocalBackend{Root: backend.Root, ctx: ctx}
+}
+
+// Context returns the backend's context, which is
+// context.Background() unless the backend came from WithContext.
+func (backend *LocalBackend) Context() context.Context {
+	if backend.ctx == nil {
+		return context.Background()
+	}
+	return backend.ctx
+}
+
+// contextErr returns the error from the backend's context,
+// if it has one and it's done.
+func (backend *LocalBackend) contextErr() error {
+	if backend.ctx == nil {
+		return nil
+	}
+	return backend.ctx.Err()
+}
+
+// Put writes the contents of reader to bucket/key and returns a
+// file:// URL for the stored object.
+func (backend *LocalBackend) Put(bucket, key, contentType string, metadata map[string]string, reader io.Reader, size int64) (string, error) {
+	filePath, err := backend.objectPath(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return "", err
+	}
+	// Write to a temp file and then rename, so readers never
+	// see a partially written object.
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempFile.Name())
+	md5Hash := md5.New()
+	bytesWritten, err := io.Copy(io.MultiWriter(tempFile, md5Hash), backend.contextReader(reader))
+	tempFile.Close()
+	if err != nil {
+		return "", err
+	}
+	if size > 0 && bytesWritten != size {
+		return "", fmt.Errorf("Wrote %d of %d bytes to %s/%s", bytesWritten, size, bucket, key)
+	}
+	err = os.Rename(tempFile.Name(), filePath)
+	if err != nil {
+		return "", err
+	}
+	obj := &StorageObject{
+		Bucket:       bucket,
+		Key:          key,
+		Size:         bytesWritten,
+		ETag:         fmt.Sprintf("%x", md5Hash.Sum(nil)),
+		ContentType:  contentType,
+		LastModified: time.Now().UTC(),
+		Metadata:     make(map[string]string),
+	}
+	for name, value := range metadata {
+		obj.Metadata[strings.ToLower(name)] = value
+	}
+	err = backend.saveMetadata(obj)
+	if err != nil {
+		return "", err
+	}
+	return "file://" + filepath.ToSlash(filePath), nil
+}
+
+// Get returns a reader for the file at bucket/key.
+func (backend *LocalBackend) Get(bucket, key string) (io.ReadCloser, error) {
+	file, err := backend.open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReadCloser{Reader: backend.contextReader(file), Closer: file}, nil
+}
+
+// GetRange returns a reader for length bytes of the file at
+// bucket/key, starting at offset. If etag is not empty, it must
+// match the ETag we saved when the file was put.
+func (backend *LocalBackend) GetRange(bucket, key string, offset, length int64, etag string) (io.ReadCloser, error) {
+	if etag != "" {
+		obj, err := backend.Head(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		if obj.ETag != "" && obj.ETag != strings.Trim(etag, "\"") {
+			return nil, ErrETagMismatch
+		}
+	}
+	file, err := backend.open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader := backend.contextReader(io.LimitReader(file, length))
+	return &limitedReadCloser{Reader: reader, Closer: file}, nil
+}
+
+// open opens the file at bucket/key.
+func (backend *LocalBackend) open(bucket, key string) (*os.File, error) {
+	if err := backend.contextErr(); err != nil {
+		return nil, err
+	}
+	filePath, err := backend.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// contextReader returns reader, or if the backend has a context,
+// a reader that fails once the context is done.
+func (backend *LocalBackend) contextReader(reader io.Reader) io.Reader {
+	if backend.ctx == nil {
+		return reader
+	}
+	return &contextReader{ctx: backend.ctx, reader: reader}
+}
+
+// contextReader is a reader that returns its context's
+// error once the context is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (reader *contextReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(p)
+}
+
+// limitedReadCloser reads all or part of a file, and closes the file.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Head returns information about the file at bucket/key.
+func (backend *LocalBackend) Head(bucket, key string) (*StorageObject, error) {
+	if err := backend.contextErr(); err != nil {
+		return nil, err
+	}
+	filePath, err := backend.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	obj := &StorageObject{
+		Bucket:   bucket,
+		Key:      key,
+		Metadata: make(map[string]string),
+	}
+	metaPath, _ := backend.metadataPath(bucket, key)
+	data, err := ioutil.ReadFile(metaPath)
+	if err == nil {
+		err = json.Unmarshal(data, obj)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse metadata for %s/%s: %v", bucket, key, err)
+		}
+	}
+	// The file itself is the authority on size and modification time,
+	// in case someone copied it into place without calling Put.
+	obj.Size = stat.Size()
+	obj.LastModified = stat.ModTime().UTC()
+	return obj, nil
+}
+
+// Delete deletes the specified keys from bucket. Keys that
+// don't exist are ignored, as they are in S3.
+func (backend *LocalBackend) Delete(bucket string, keys ...string) error {
+	if err := backend.contextErr(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		filePath, err := backend.objectPath(bucket, key)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error deleting key '%s': %v", key, err)
+		}
+		metaPath, _ := backend.metadataPath(bucket, key)
+		os.Remove(metaPath)
+	}
+	return nil
+}
+
+// List returns up to maxKeys objects from bucket whose keys begin
+// with prefix, in key order. If maxKeys is zero, this returns all
+// matching objects. Listing a bucket that does not exist returns
+// an empty list.
+func (backend *LocalBackend) List(bucket, prefix string, maxKeys int64) ([]*StorageObject, error) {
+	bucketPath, err := backend.objectPath(bucket, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	err = filepath.Walk(bucketPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		relPath, err := filepath.Rel(bucketPath, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	if maxKeys > 0 && int64(len(keys)) > maxKeys {
+		keys = keys[:maxKeys]
+	}
+	objects := make([]*StorageObject, len(keys))
+	for i, key := range keys {
+		objects[i], err = backend.Head(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// RequestRestore always succeeds for objects that exist, since
+// local files are never in archival storage.
+func (backend *LocalBackend) RequestRestore(bucket, key, tier string, days int64) (*RestoreStatus, error) {
+	_, err := backend.Head(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &RestoreStatus{
+		Accepted:            true,
+		AlreadyInActiveTier: true,
+	}, nil
+}
+
+// localMultipartUpload is what we save in the upload.json file
+// of each multipart upload's directory.
+type localMultipartUpload struct {
+	Bucket      string
+	Key         string
+	ContentType string
+	Metadata    map[string]string
+	Initiated   time.Time
+}
+
+// CreateMultipartUpload creates a directory to hold the parts of a
+// new multipart upload, and returns the upload id.
+func (backend *LocalBackend) CreateMultipartUpload(bucket, key, contentType string, metadata map[string]string) (string, error) {
+	_, err := backend.objectPath(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	uploadId := uuid.New().String()
+	uploadDir := backend.uploadDir(uploadId)
+	err = os.MkdirAll(uploadDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&localMultipartUpload{
+		Bucket:      bucket,
+		Key:         key,
+		ContentType: contentType,
+		Metadata:    metadata,
+		Initiated:   time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(uploadDir, "upload.json"), data, 0644)
+	if err != nil {
+		return "", err
+	}
+	return uploadId, nil
+}
+
+// UploadPart writes one part of a multipart upload into the upload's
+// directory, and returns the md5 digest of the part as its ETag.
+func (backend *LocalBackend) UploadPart(bucket, key, uploadId string, partNumber int64, reader io.ReadSeeker, size int64) (string, error) {
+	_, err := backend.getMultipartUpload(bucket, key, uploadId)
+	if err != nil {
+		return "", err
+	}
+	if partNumber < 1 || partNumber > MaxUploadParts {
+		return "", fmt.Errorf("Part number %d is out of range", partNumber)
+	}
+	partPath := backend.partPath(uploadId, partNumber)
+	tempFile, err := ioutil.TempFile(filepath.Dir(partPath), ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempFile.Name())
+	md5Hash := md5.New()
+	bytesWritten, err := io.Copy(io.MultiWriter(tempFile, md5Hash), backend.contextReader(reader))
+	tempFile.Close()
+	if err != nil {
+		return "", err
+	}
+	if bytesWritten != size {
+		return "", fmt.Errorf("Wrote %d of %d bytes for part %d of %s/%s",
+			bytesWritten, size, partNumber, bucket, key)
+	}
+	err = os.Rename(tempFile.Name(), partPath)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5Hash.Sum(nil)), nil
+}
+
+// CompleteMultipartUpload concatenates the parts of a multipart
+// upload into bucket/key, deletes the parts, and returns a file://
+// URL for the stored object. Like S3, it gives the object a multipart
+// ETag, rather than the md5 digest of the whole file.
+func (backend *LocalBackend) CompleteMultipartUpload(bucket, key, uploadId string, parts []*models.UploadPart) (string, error) {
+	upload, err := backend.getMultipartUpload(bucket, key, uploadId)
+	if err != nil {
+		return "", err
+	}
+	readers := make([]io.Reader, len(parts))
+	for i, part := range parts {
+		if part.PartNumber != int64(i+1) {
+			return "", fmt.Errorf("Parts must be numbered in order, starting at 1. "+
+				"Part %d is numbered %d.", i+1, part.PartNumber)
+		}
+		file, err := os.Open(backend.partPath(uploadId, part.PartNumber))
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("InvalidPart: Part %d of %s/%s was never uploaded",
+				part.PartNumber, bucket, key)
+		} else if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		md5Hash := md5.New()
+		_, err = io.Copy(md5Hash, file)
+		if err != nil {
+			return "", err
+		}
+		if fmt.Sprintf("%x", md5Hash.Sum(nil)) != part.ETag {
+			return "", fmt.Errorf("InvalidPart: ETag for part %d of %s/%s does not match",
+				part.PartNumber, bucket, key)
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+		readers[i] = file
+	}
+	url, err := backend.Put(bucket, key, upload.ContentType, upload.Metadata,
+		io.MultiReader(readers...), 0)
+	if err != nil {
+		return "", err
+	}
+	obj, err := backend.Head(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	obj.ETag = models.MultipartETag(parts)
+	err = backend.saveMetadata(obj)
+	if err != nil {
+		return "", err
+	}
+	return url, os.RemoveAll(backend.uploadDir(uploadId))
+}
+
+// AbortMultipartUpload deletes a multipart upload and its parts.
+func (backend *LocalBackend) AbortMultipartUpload(bucket, key, uploadId string) error {
+	_, err := backend.getMultipartUpload(bucket, key, uploadId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(backend.uploadDir(uploadId))
+}
+
+// ListMultipartUploads returns the multipart uploads in progress in
+// bucket whose keys begin with prefix, ordered by key.
+func (backend *LocalBackend) ListMultipartUploads(bucket, prefix string) ([]*MultipartUploadInfo, error) {
+	uploads := make([]*MultipartUploadInfo, 0)
+	entries, err := ioutil.ReadDir(filepath.Join(backend.Root, localMultipartDir))
+	if os.IsNotExist(err) {
+		return uploads, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		upload, err := backend.readMultipartUpload(entry.Name())
+		if err != nil {
+			continue
+		}
+		if upload.Bucket == bucket && strings.HasPrefix(upload.Key, prefix) {
+			uploads = append(uploads, &MultipartUploadInfo{
+				Bucket:    upload.Bucket,
+				Key:       upload.Key,
+				UploadId:  entry.Name(),
+				Initiated: upload.Initiated,
+			})
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Key < uploads[j].Key })
+	return uploads, nil
+}
+
+// getMultipartUpload returns the specified upload, or ErrNoSuchUpload
+// if it doesn't exist or belongs to some other bucket/key.
+func (backend *LocalBackend) getMultipartUpload(bucket, key, uploadId string) (*localMultipartUpload, error) {
+	upload, err := backend.readMultipartUpload(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return nil, ErrNoSuchUpload
+	}
+	return upload, nil
+}
+
+func (backend *LocalBackend) readMultipartUpload(uploadId string) (*localMultipartUpload, error) {
+	if _, err := uuid.Parse(uploadId); err != nil {
+		return nil, ErrNoSuchUpload
+	}
+	data, err := ioutil.ReadFile(filepath.Join(backend.uploadDir(uploadId), "upload.json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchUpload
+	} else if err != nil {
+		return nil, err
+	}
+	upload := &localMultipartUpload{}
+	err = json.Unmarshal(data, upload)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse multipart upload %s: %v", uploadId, err)
+	}
+	return upload, nil
+}
+
+func (backend *LocalBackend) uploadDir(uploadId string) string {
+	return filepath.Join(backend.Root, localMultipartDir, uploadId)
+}
+
+func (backend *LocalBackend) partPath(uploadId string, partNumber int64) string {
+	return filepath.Join(backend.uploadDir(uploadId), fmt.Sprintf("part-%05d", partNumber))
+}
+
+// objectPath returns the absolute path to the file for bucket/key.
+// It returns an error if bucket or key would resolve to a path
+// outside of the backend's root directory.
+func (backend *LocalBackend) objectPath(bucket, key string) (string, error) {
+	return backend.safeJoin(backend.Root, bucket, key)
+}
+
+// metadataPath returns the absolute path to the JSON metadata
+// file for bucket/key.
+func (backend *LocalBackend) metadataPath(bucket, key string) (string, error) {
+	return backend.safeJoin(filepath.Join(backend.Root, localMetadataDir), bucket, key+".json")
+}
+
+func (backend *LocalBackend) safeJoin(dir, bucket, key string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, "/\\") || bucket == "." ||
+		bucket == ".." || bucket == localMetadataDir || bucket == localMultipartDir {
+		return "", fmt.Errorf("Invalid bucket name '%s'", bucket)
+	}
+	bucketPath := filepath.Join(dir, bucket)
+	fullPath := filepath.Join(bucketPath, filepath.FromSlash(key))
+	if fullPath != bucketPath && !strings.HasPrefix(fullPath, bucketPath+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Invalid key '%s'", key)
+	}
+	return fullPath, nil
+}
+
+func (backend *LocalBackend) saveMetadata(obj *StorageObject) error {
+	metaPath, err := backend.metadataPath(obj.Bucket, obj.Key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(metaPath), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaPath, data, 0644)
+}
@@ -0,0 +1,385 @@
+package network_test
+
+import (
+	"context"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const localTestContent = "Hello, local storage."
+const localTestMd5 = "0bbfb6d4a81c6c2771b8c94b619dcb88"
+
+func getLocalBackend(t *testing.T) (*network.LocalBackend, string) {
+	tempDir, err := ioutil.TempDir("", "local_backend_test")
+	require.Nil(t, err)
+	backend, err := network.NewLocalBackend(filepath.Join(tempDir, "storage"))
+	require.Nil(t, err)
+	return backend, tempDir
+}
+
+func putLocalTestFile(t *testing.T, backend *network.LocalBackend, key string) string {
+	metadata := map[string]string{
+		"institution": "test.edu",
+		"Bag":         "test.edu/bag",
+	}
+	url, err := backend.Put("preservation", key, "text/plain", metadata,
+		strings.NewReader(localTestContent), int64(len(localTestContent)))
+	require.Nil(t, err)
+	return url
+}
+
+func TestNewLocalBackend(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	assert.True(t, filepath.IsAbs(backend.Root))
+	_, err := os.Stat(backend.Root)
+	assert.Nil(t, err)
+
+	_, err = network.NewLocalBackend("")
+	assert.NotNil(t, err)
+}
+
+func TestLocalBackendPutAndHead(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	url := putLocalTestFile(t, backend, "file1")
+	assert.Equal(t, "file://"+filepath.Join(backend.Root, "preservation", "file1"), url)
+
+	obj, err := backend.Head("preservation", "file1")
+	require.Nil(t, err)
+	assert.Equal(t, "preservation", obj.Bucket)
+	assert.Equal(t, "file1", obj.Key)
+	assert.Equal(t, int64(len(localTestContent)), obj.Size)
+	assert.Equal(t, localTestMd5, obj.ETag)
+	assert.Equal(t, "text/plain", obj.ContentType)
+	assert.False(t, obj.LastModified.IsZero())
+	assert.Equal(t, "test.edu", obj.Metadata["institution"])
+	assert.Equal(t, "test.edu/bag", obj.Metadata["bag"])
+
+	_, err = backend.Head("preservation", "file_does_not_exist")
+	assert.True(t, network.IsNotFound(err))
+
+	// Wrong size should be an error
+	_, err = backend.Put("preservation", "file2", "text/plain", nil,
+		strings.NewReader(localTestContent), 5)
+	assert.NotNil(t, err)
+	_, err = backend.Head("preservation", "file2")
+	assert.True(t, network.IsNotFound(err))
+}
+
+func TestLocalBackendGet(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+
+	reader, err := backend.Get("preservation", "file1")
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Nil(t, err)
+	assert.Equal(t, localTestContent, string(data))
+
+	_, err = backend.Get("preservation", "file_does_not_exist")
+	assert.Equal(t, network.ErrNotFound, err)
+}
+
+func TestLocalBackendGetRange(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+
+	reader, err := backend.GetRange("preservation", "file1", 7, 5, "")
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Nil(t, err)
+	assert.Equal(t, "local", string(data))
+
+	_, err = backend.GetRange("preservation", "file_does_not_exist", 0, 5, "")
+	assert.Equal(t, network.ErrNotFound, err)
+
+	// The range has to come from the version of the file we expect.
+	reader, err = backend.GetRange("preservation", "file1", 7, 5, localTestMd5)
+	require.Nil(t, err)
+	reader.Close()
+	_, err = backend.GetRange("preservation", "file1", 7, 5, "0123456789abcdef0123456789abcdef")
+	assert.True(t, network.IsETagMismatch(err))
+}
+
+func TestLocalBackendList(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	for _, key := range []string{"b_file", "a_file", "c_file", "other"} {
+		putLocalTestFile(t, backend, key)
+	}
+	objects, err := backend.List("preservation", "", 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(objects))
+	assert.Equal(t, "a_file", objects[0].Key)
+	assert.Equal(t, "other", objects[3].Key)
+
+	objects, err = backend.List("preservation", "b_", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(objects))
+	assert.Equal(t, "b_file", objects[0].Key)
+	assert.Equal(t, "test.edu", objects[0].Metadata["institution"])
+
+	objects, err = backend.List("preservation", "", 2)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(objects))
+
+	objects, err = backend.List("empty_bucket", "", 0)
+	require.Nil(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestLocalBackendDelete(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+	putLocalTestFile(t, backend, "file2")
+
+	err := backend.Delete("preservation", "file1", "file_does_not_exist")
+	require.Nil(t, err)
+	_, err = backend.Head("preservation", "file1")
+	assert.True(t, network.IsNotFound(err))
+	_, err = backend.Head("preservation", "file2")
+	assert.Nil(t, err)
+}
+
+func TestLocalBackendRequestRestore(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+
+	status, err := backend.RequestRestore("preservation", "file1", "Standard", 5)
+	require.Nil(t, err)
+	assert.True(t, status.Accepted)
+	assert.True(t, status.AlreadyInActiveTier)
+
+	_, err = backend.RequestRestore("preservation", "file_does_not_exist", "Standard", 5)
+	assert.True(t, network.IsNotFound(err))
+}
+
+func TestLocalBackendInvalidPaths(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	_, err := backend.Put("preservation", "../../escape", "", nil, strings.NewReader("x"), 1)
+	assert.NotNil(t, err)
+	_, err = backend.Put("../escape", "file", "", nil, strings.NewReader("x"), 1)
+	assert.NotNil(t, err)
+	_, err = backend.Get(".metadata", "file")
+	assert.NotNil(t, err)
+}
+
+func TestLocalBackendMultipartUpload(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	metadata := map[string]string{"institution": "test.edu"}
+	uploadId, err := backend.CreateMultipartUpload("preservation", "bigfile", "text/plain", metadata)
+	require.Nil(t, err)
+	require.NotEmpty(t, uploadId)
+
+	uploads, err := backend.ListMultipartUploads("preservation", "big")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(uploads))
+	assert.Equal(t, "bigfile", uploads[0].Key)
+	assert.Equal(t, uploadId, uploads[0].UploadId)
+	assert.False(t, uploads[0].Initiated.IsZero())
+
+	parts := make([]*models.UploadPart, 0)
+	for i, content := range []string{"Hello, ", "local ", "storage."} {
+		partNumber := int64(i + 1)
+		etag, err := backend.UploadPart("preservation", "bigfile", uploadId, partNumber,
+			strings.NewReader(content), int64(len(content)))
+		require.Nil(t, err)
+		parts = append(parts, &models.UploadPart{PartNumber: partNumber, ETag: etag, Size: int64(len(content))})
+	}
+
+	// The object doesn't exist until the upload is complete.
+	_, err = backend.Head("preservation", "bigfile")
+	assert.True(t, network.IsNotFound(err))
+
+	url, err := backend.CompleteMultipartUpload("preservation", "bigfile", uploadId, parts)
+	require.Nil(t, err)
+	assert.Equal(t, "file://"+filepath.Join(backend.Root, "preservation", "bigfile"), url)
+	obj, err := backend.Head("preservation", "bigfile")
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(localTestContent)), obj.Size)
+	assert.Equal(t, models.MultipartETag(parts), obj.ETag)
+	assert.True(t, strings.HasSuffix(obj.ETag, "-3"))
+	assert.Equal(t, "test.edu", obj.Metadata["institution"])
+
+	uploads, err = backend.ListMultipartUploads("preservation", "")
+	require.Nil(t, err)
+	assert.Empty(t, uploads)
+	_, err = backend.UploadPart("preservation", "bigfile", uploadId, 4, strings.NewReader("x"), 1)
+	assert.True(t, network.IsNoSuchUpload(err))
+}
+
+func TestLocalBackendMultipartUploadErrors(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	uploadId, err := backend.CreateMultipartUpload("preservation", "bigfile", "text/plain", nil)
+	require.Nil(t, err)
+
+	// Wrong key or unknown upload id
+	_, err = backend.UploadPart("preservation", "otherfile", uploadId, 1, strings.NewReader("x"), 1)
+	assert.True(t, network.IsNoSuchUpload(err))
+	_, err = backend.UploadPart("preservation", "bigfile", "no-such-upload", 1, strings.NewReader("x"), 1)
+	assert.True(t, network.IsNoSuchUpload(err))
+
+	// Bad part number and short part
+	_, err = backend.UploadPart("preservation", "bigfile", uploadId, 0, strings.NewReader("x"), 1)
+	assert.NotNil(t, err)
+	_, err = backend.UploadPart("preservation", "bigfile", uploadId, 1, strings.NewReader("x"), 2)
+	assert.NotNil(t, err)
+
+	etag, err := backend.UploadPart("preservation", "bigfile", uploadId, 1, strings.NewReader("x"), 1)
+	require.Nil(t, err)
+
+	// Missing part and mismatched ETag
+	parts := []*models.UploadPart{
+		{PartNumber: 1, ETag: etag, Size: 1},
+		{PartNumber: 2, ETag: etag, Size: 1},
+	}
+	_, err = backend.CompleteMultipartUpload("preservation", "bigfile", uploadId, parts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "InvalidPart")
+	parts = []*models.UploadPart{{PartNumber: 1, ETag: "bad-etag", Size: 1}}
+	_, err = backend.CompleteMultipartUpload("preservation", "bigfile", uploadId, parts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "InvalidPart")
+
+	require.Nil(t, backend.AbortMultipartUpload("preservation", "bigfile", uploadId))
+	uploads, err := backend.ListMultipartUploads("preservation", "")
+	require.Nil(t, err)
+	assert.Empty(t, uploads)
+	err = backend.AbortMultipartUpload("preservation", "bigfile", uploadId)
+	assert.True(t, network.IsNoSuchUpload(err))
+}
+
+func TestMultipartPartSize(t *testing.T) {
+	assert.Equal(t, int64(network.BIG_CHUNK_SIZE), network.MultipartPartSize(100))
+	size := int64(5) * 1024 * 1024 * 1024 * 1024
+	partSize := network.MultipartPartSize(size)
+	assert.True(t, partSize*network.MaxUploadParts >= size)
+}
+
+func TestDownloadFromStorage(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+
+	localPath := filepath.Join(tempDir, "downloads", "file1")
+	algorithms := []string{constants.AlgMd5, constants.AlgSha256}
+	bytesCopied, digests, err := network.DownloadFromStorage(
+		backend, "preservation", "file1", localPath, algorithms, network.DownloadOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(localTestContent)), bytesCopied)
+	assert.Equal(t, localTestMd5, digests[constants.AlgMd5])
+	assert.Equal(t, 64, len(digests[constants.AlgSha256]))
+	data, err := ioutil.ReadFile(localPath)
+	require.Nil(t, err)
+	assert.Equal(t, localTestContent, string(data))
+
+	_, digests, err = network.DownloadFromStorage(
+		backend, "preservation", "file1", os.DevNull, []string{constants.AlgSha512}, network.DownloadOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, 128, len(digests[constants.AlgSha512]))
+
+	_, _, err = network.DownloadFromStorage(
+		backend, "preservation", "file_does_not_exist", os.DevNull, algorithms, network.DownloadOptions{})
+	assert.True(t, network.IsNotFound(err))
+}
+
+func TestDownloadFromStorageInRanges(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+
+	// Part size is smaller than the file, and doesn't divide it
+	// evenly, so we get several ranges and a short last one.
+	options := network.DownloadOptions{Concurrency: 3, PartSize: 5}
+	localPath := filepath.Join(tempDir, "downloads", "file1")
+	algorithms := []string{constants.AlgMd5, constants.AlgSha256}
+	bytesCopied, digests, err := network.DownloadFromStorage(
+		backend, "preservation", "file1", localPath, algorithms, options)
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(localTestContent)), bytesCopied)
+	assert.Equal(t, localTestMd5, digests[constants.AlgMd5])
+	data, err := ioutil.ReadFile(localPath)
+	require.Nil(t, err)
+	assert.Equal(t, localTestContent, string(data))
+
+	_, _, err = network.DownloadFromStorage(
+		backend, "preservation", "file_does_not_exist", localPath+"2", algorithms, options)
+	assert.True(t, network.IsNotFound(err))
+	_, err = os.Stat(localPath + "2")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Retrying a download is pointless once the context is done.
+func TestDownloadFromStorageCancelled(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, options := range []network.DownloadOptions{{}, {Concurrency: 3, PartSize: 5}} {
+		_, _, err := network.DownloadFromStorage(backend.WithContext(ctx), "preservation", "file1",
+			os.DevNull, []string{constants.AlgMd5}, options)
+		assert.Equal(t, context.Canceled, err)
+	}
+}
+
+func TestNewDownloadOptions(t *testing.T) {
+	options := network.NewDownloadOptions(models.WorkerConfig{
+		DownloadConcurrency: 4,
+		DownloadPartSize:    1024,
+	})
+	assert.Equal(t, 4, options.Concurrency)
+	assert.Equal(t, int64(1024), options.PartSize)
+}
+
+func TestLocalBackendWithContext(t *testing.T) {
+	backend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	putLocalTestFile(t, backend, "file1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	withContext := backend.WithContext(ctx)
+	reader, err := withContext.Get("preservation", "file1")
+	require.Nil(t, err)
+	buf := make([]byte, 5)
+	_, err = reader.Read(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "Hello", string(buf))
+
+	// Reads in progress stop when the context is cancelled.
+	cancel()
+	_, err = reader.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+	reader.Close()
+
+	_, err = withContext.Get("preservation", "file1")
+	assert.Equal(t, context.Canceled, err)
+	_, err = withContext.Head("preservation", "file1")
+	assert.Equal(t, context.Canceled, err)
+	_, err = withContext.Put("preservation", "file2", "text/plain", nil,
+		strings.NewReader(localTestContent), int64(len(localTestContent)))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, withContext.Delete("preservation", "file1"))
+
+	// The original backend doesn't have the context.
+	_, err = backend.Head("preservation", "file1")
+	assert.Nil(t, err)
+}
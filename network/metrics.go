@@ -0,0 +1,178 @@
+package network
+
+import (
+	"context"
+	"github.com/APTrust/exchange/metrics"
+	"github.com/APTrust/exchange/models"
+	"github.com/nsqio/go-nsq"
+	"io"
+	"time"
+)
+
+// meteredDelegate counts finishes and requeues of NSQ messages, then
+// passes them on to the consumer's own delegate. nsq.Message makes
+// sure we get at most one finish or requeue per delivery.
+type meteredDelegate struct {
+	topic    string
+	delegate nsq.MessageDelegate
+}
+
+func (metered *meteredDelegate) OnFinish(message *nsq.Message) {
+	metrics.MessagesProcessed.Inc(metered.topic, "finished")
+	metered.delegate.OnFinish(message)
+}
+
+func (metered *meteredDelegate) OnRequeue(message *nsq.Message, delay time.Duration, backoff bool) {
+	metrics.MessagesProcessed.Inc(metered.topic, "requeued")
+	metered.delegate.OnRequeue(message, delay, backoff)
+}
+
+func (metered *meteredDelegate) OnTouch(message *nsq.Message) {
+	metered.delegate.OnTouch(message)
+}
+
+// MeteredBackend wraps a StorageBackend to count the bytes it
+// uploads and downloads, and the operations that fail.
+type MeteredBackend struct {
+	StorageBackend
+	// Name identifies the backend in metrics, e.g. "s3" or "local".
+	Name string
+}
+
+// NewMeteredBackend returns a StorageBackend that reports to the
+// default metrics registry under the specified name.
+func NewMeteredBackend(backend StorageBackend, name string) *MeteredBackend {
+	return &MeteredBackend{StorageBackend: backend, Name: name}
+}
+
+// WithContext returns a copy of the backend, bound to ctx, that
+// reports to metrics under the same name.
+func (backend *MeteredBackend) WithContext(ctx context.Context) StorageBackend {
+	return NewMeteredBackend(backend.StorageBackend.WithContext(ctx), backend.Name)
+}
+
+// Put uploads the contents of reader, counting the bytes sent.
+func (backend *MeteredBackend) Put(bucket, key, contentType string, metadata map[string]string, reader io.Reader, size int64) (string, error) {
+	counter := &countingReader{reader: reader}
+	url, err := backend.StorageBackend.Put(bucket, key, contentType, metadata, counter, size)
+	metrics.StorageBytes.Add(float64(counter.bytes), backend.Name, bucket, "upload")
+	backend.countError(err, bucket, "put")
+	return url, err
+}
+
+// Get returns a reader that counts the bytes the caller reads.
+func (backend *MeteredBackend) Get(bucket, key string) (io.ReadCloser, error) {
+	reader, err := backend.StorageBackend.Get(bucket, key)
+	if err != nil {
+		backend.countError(err, bucket, "get")
+		return nil, err
+	}
+	return backend.countDownload(bucket, reader), nil
+}
+
+// countDownload wraps reader to count the bytes downloaded from bucket
+// when the caller closes it.
+func (backend *MeteredBackend) countDownload(bucket string, reader io.ReadCloser) io.ReadCloser {
+	return &countingReadCloser{
+		countingReader: countingReader{reader: reader},
+		closer:         reader,
+		done: func(bytes int64) {
+			metrics.StorageBytes.Add(float64(bytes), backend.Name, bucket, "download")
+		},
+	}
+}
+
+// GetRange returns a reader for part of an object that counts
+// the bytes the caller reads.
+func (backend *MeteredBackend) GetRange(bucket, key string, offset, length int64, etag string) (io.ReadCloser, error) {
+	reader, err := backend.StorageBackend.GetRange(bucket, key, offset, length, etag)
+	if err != nil {
+		backend.countError(err, bucket, "get")
+		return nil, err
+	}
+	return backend.countDownload(bucket, reader), nil
+}
+
+// Head returns information about the object at bucket/key.
+func (backend *MeteredBackend) Head(bucket, key string) (*StorageObject, error) {
+	obj, err := backend.StorageBackend.Head(bucket, key)
+	// Missing objects are an answer, not a failure.
+	if !IsNotFound(err) {
+		backend.countError(err, bucket, "head")
+	}
+	return obj, err
+}
+
+// Delete deletes the specified keys from bucket.
+func (backend *MeteredBackend) Delete(bucket string, keys ...string) error {
+	err := backend.StorageBackend.Delete(bucket, keys...)
+	backend.countError(err, bucket, "delete")
+	return err
+}
+
+// List returns up to maxKeys objects from bucket whose keys begin with prefix.
+func (backend *MeteredBackend) List(bucket, prefix string, maxKeys int64) ([]*StorageObject, error) {
+	objects, err := backend.StorageBackend.List(bucket, prefix, maxKeys)
+	backend.countError(err, bucket, "list")
+	return objects, err
+}
+
+// RequestRestore asks the backend to restore an archived object.
+func (backend *MeteredBackend) RequestRestore(bucket, key, tier string, days int64) (*RestoreStatus, error) {
+	status, err := backend.StorageBackend.RequestRestore(bucket, key, tier, days)
+	backend.countError(err, bucket, "restore")
+	return status, err
+}
+
+// UploadPart sends one part of a multipart upload, counting the bytes sent.
+func (backend *MeteredBackend) UploadPart(bucket, key, uploadId string, partNumber int64, reader io.ReadSeeker, size int64) (string, error) {
+	etag, err := backend.StorageBackend.UploadPart(bucket, key, uploadId, partNumber, reader, size)
+	if err == nil {
+		metrics.StorageBytes.Add(float64(size), backend.Name, bucket, "upload")
+	}
+	backend.countError(err, bucket, "upload_part")
+	return etag, err
+}
+
+// CompleteMultipartUpload assembles the parts of a multipart upload.
+func (backend *MeteredBackend) CompleteMultipartUpload(bucket, key, uploadId string, parts []*models.UploadPart) (string, error) {
+	url, err := backend.StorageBackend.CompleteMultipartUpload(bucket, key, uploadId, parts)
+	backend.countError(err, bucket, "complete_multipart")
+	return url, err
+}
+
+func (backend *MeteredBackend) countError(err error, bucket, operation string) {
+	if err != nil {
+		metrics.StorageErrors.Inc(backend.Name, bucket, operation)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	bytes  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.bytes += int64(n)
+	return n, err
+}
+
+// countingReadCloser counts the bytes read through it, and reports
+// the total to done when the caller closes it.
+type countingReadCloser struct {
+	countingReader
+	closer io.Closer
+	done   func(int64)
+}
+
+func (counter *countingReadCloser) Close() error {
+	if counter.done != nil {
+		counter.done(counter.bytes)
+		counter.done = nil
+	}
+	return counter.closer.Close()
+}
+
+var _ StorageBackend = (*MeteredBackend)(nil)
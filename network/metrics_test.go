@@ -0,0 +1,96 @@
+package network_test
+
+import (
+	"github.com/APTrust/exchange/metrics"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPharosEndpoint(t *testing.T) {
+	endpoints := map[string]string{
+		"/api/v2/institutions/test.edu/":                    "institutions",
+		"/api/v2/objects/test.edu%2Fbag?include_files=true": "objects",
+		"/api/v2/objects/test.edu%2Fbag/restore":            "objects/restore",
+		"/api/v2/objects/test.edu%2Fbag/finish_delete":      "objects/finish_delete",
+		"/api/v2/files/?intellectual_object_identifier=x":   "files",
+		"/api/v2/files/12/create_batch":                     "files/create_batch",
+		"/api/v2/files/finish_delete/test.edu%2Fbag%2Ffile": "files/finish_delete",
+		"/api/v2/items/42/":                                 "items",
+		"/api/v2/item_state/":                               "item_state",
+		"/api/v2/notifications/spot_test_restoration/42/":   "notifications/spot_test_restoration",
+	}
+	for relativeUrl, expected := range endpoints {
+		assert.Equal(t, expected, network.PharosEndpoint(relativeUrl), relativeUrl)
+	}
+}
+
+func TestPharosClientMetrics(t *testing.T) {
+	_, client, _ := getFakePharos(t)
+	count := metrics.PharosRequestDuration.Count("items", "GET")
+	errors := metrics.PharosRequestErrors.Value("items", "GET")
+
+	resp := client.WorkItemGet(999999)
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, count+1, metrics.PharosRequestDuration.Count("items", "GET"))
+	assert.Equal(t, errors+1, metrics.PharosRequestErrors.Value("items", "GET"))
+}
+
+func TestMeteredBackend(t *testing.T) {
+	localBackend, tempDir := getLocalBackend(t)
+	defer os.RemoveAll(tempDir)
+	backend := network.NewMeteredBackend(localBackend, "local")
+	uploaded := metrics.StorageBytes.Value("local", "metered", "upload")
+	downloaded := metrics.StorageBytes.Value("local", "metered", "download")
+	getErrors := metrics.StorageErrors.Value("local", "metered", "get")
+	headErrors := metrics.StorageErrors.Value("local", "metered", "head")
+
+	_, err := backend.Put("metered", "file1", "text/plain", nil,
+		strings.NewReader(localTestContent), int64(len(localTestContent)))
+	require.Nil(t, err)
+	assert.Equal(t, uploaded+float64(len(localTestContent)),
+		metrics.StorageBytes.Value("local", "metered", "upload"))
+
+	// Downloaded bytes are counted when the reader is closed.
+	reader, err := backend.Get("metered", "file1")
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	assert.Equal(t, localTestContent, string(data))
+	require.Nil(t, reader.Close())
+	assert.Equal(t, downloaded+float64(len(localTestContent)),
+		metrics.StorageBytes.Value("local", "metered", "download"))
+
+	_, err = backend.Get("metered", "no_such_file")
+	require.NotNil(t, err)
+	assert.Equal(t, getErrors+1, metrics.StorageErrors.Value("local", "metered", "get"))
+
+	// A missing object is not an error for Head.
+	_, err = backend.Head("metered", "no_such_file")
+	require.True(t, network.IsNotFound(err))
+	assert.Equal(t, headErrors, metrics.StorageErrors.Value("local", "metered", "head"))
+}
+
+func TestQueueMessageMetrics(t *testing.T) {
+	queue, tempDir := getBoltQueue(t)
+	defer os.RemoveAll(tempDir)
+	defer queue.Close()
+
+	config := boltWorkerConfig(10, 0, "1m")
+	config.NsqTopic = "metrics_topic"
+	require.Nil(t, queue.Enqueue("metrics_topic", 1))
+	require.Nil(t, queue.Enqueue("metrics_topic", 2))
+	handler := newBoltTestHandler()
+	require.Nil(t, queue.Subscribe(config, handler))
+
+	nextBoltMessage(t, handler.messages).Finish()
+	nextBoltMessage(t, handler.messages).RequeueWithoutBackoff(0)
+	nextBoltMessage(t, handler.messages).Finish()
+	assert.Equal(t, float64(3), metrics.MessagesReceived.Value("metrics_topic"))
+	assert.Equal(t, float64(2), metrics.MessagesProcessed.Value("metrics_topic", "finished"))
+	assert.Equal(t, float64(1), metrics.MessagesProcessed.Value("metrics_topic", "requeued"))
+}
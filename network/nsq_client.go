@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/nsqio/nsq/nsqd"
@@ -24,6 +25,7 @@ type NSQStatsData struct {
 // stats from the NSQ server at URL.
 type NSQClient struct {
 	URL string
+	ctx context.Context
 }
 
 // NewNSQClient returns a new NSQ client that will connect to the NSQ
@@ -39,6 +41,22 @@ func NewNSQClient(url string) *NSQClient {
 	return &NSQClient{URL: url}
 }
 
+// WithContext returns a copy of the client whose requests are
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *NSQClient) WithContext(ctx context.Context) *NSQClient {
+	return &NSQClient{URL: client.URL, ctx: ctx}
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *NSQClient) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Enqueue posts data to NSQ, which essentially means putting it into a work
 // topic. Param topic is the topic under which you want to queue something.
 // For example, prepare_topic, fixity_topic, etc.
@@ -51,7 +69,12 @@ func (client *NSQClient) Enqueue(topic string, workItemId int) error {
 // EnqueueString posts string data to the specified NSQ topic
 func (client *NSQClient) EnqueueString(topic string, data string) error {
 	url := fmt.Sprintf("%s/pub?topic=%s", client.URL, topic)
-	resp, err := http.Post(url, "text/html", bytes.NewBuffer([]byte(data)))
+	req, err := http.NewRequestWithContext(client.context(), http.MethodPost, url, bytes.NewBuffer([]byte(data)))
+	if err != nil {
+		return fmt.Errorf("Cannot build request to queue data: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/html")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("Nsqd returned an error when queuing data: %v", err)
 	}
@@ -85,7 +108,11 @@ func (client *NSQClient) EnqueueString(topic string, data string) error {
 // /stats/ (with trailing slash) produce a 404.
 func (client *NSQClient) GetStats() (*NSQStatsData, error) {
 	url := fmt.Sprintf("%s/stats?format=json", client.URL)
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(client.context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -2,15 +2,19 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/APTrust/exchange/metrics"
 	"github.com/APTrust/exchange/models"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
+	"time"
 )
 
 // PharosClient supports basic calls to the Pharos Admin REST API.
@@ -22,6 +26,9 @@ type PharosClient struct {
 	apiKey     string
 	httpClient *http.Client
 	transport  *http.Transport
+	retry      PharosRetryPolicy
+	breaker    *CircuitBreaker
+	ctx        context.Context
 }
 
 // NewPharosClient creates a new pharos client. Param hostUrl should
@@ -56,6 +63,50 @@ func NewPharosClient(hostUrl, apiVersion, apiUser, apiKey string) (*PharosClient
 		transport:  transport}, nil
 }
 
+// SetRetryConfig tells the client how to retry failed requests, and
+// when to stop sending requests because Pharos is down. By default,
+// the client tries each request once, and has no circuit breaker.
+func (client *PharosClient) SetRetryConfig(config models.PharosRetryConfig) error {
+	policy, breaker, err := NewPharosRetryPolicy(config)
+	if err != nil {
+		return err
+	}
+	client.retry = policy
+	client.breaker = breaker
+	return nil
+}
+
+// CircuitBreaker returns the client's circuit breaker, which is nil
+// if the client doesn't have one.
+func (client *PharosClient) CircuitBreaker() *CircuitBreaker {
+	return client.breaker
+}
+
+// WithContext returns a copy of the client whose requests use ctx.
+// When ctx is cancelled or its deadline passes, the request in flight
+// is aborted, and no more retries are sent. The copy shares its HTTP
+// client and circuit breaker with the original, so it's cheap to make
+// one for each message a worker handles. If ctx is nil, the copy
+// uses context.Background().
+//
+// The error for a cancelled request is a PharosError with a status
+// code of zero, which IsPharosUnavailable treats as a reason to try
+// again later.
+func (client *PharosClient) WithContext(ctx context.Context) *PharosClient {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// Context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *PharosClient) Context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // InstitutionGet returns the institution with the specified identifier.
 func (client *PharosClient) InstitutionGet(identifier string) *PharosResponse {
 	// Set up the response object
@@ -973,19 +1024,110 @@ func (client *PharosClient) NewJsonRequest(method, absoluteUrl string, requestDa
 //
 // For a description of the other params, see NewJsonRequest.
 //
-// If an error occurs, it will be recorded in resp.Error.
+// If an error occurs, it will be recorded in resp.Error. Callers
+// should check resp.Error before touching resp.Response, which is
+// nil if we never got a response: because the request timed out,
+// because the context was done, or because the circuit breaker was
+// open. DoRequest always sets resp.Request, unless absoluteUrl is
+// not a valid URL, so callers can log the URL of a failed request.
+//
+// DoRequest reports the request's latency, and any error, to
+// metrics.Default under the endpoint returned by PharosEndpoint.
+//
+// If the client came from WithContext, DoRequest stops when the
+// context is done, even in the middle of a request or a retry wait.
 func (client *PharosClient) DoRequest(resp *PharosResponse, method, absoluteUrl string, requestData io.Reader) {
+	endpoint := PharosEndpoint(strings.Replace(absoluteUrl, client.hostUrl, "", 1))
+	start := time.Now()
+	defer func() {
+		metrics.PharosRequestDuration.Observe(metrics.Since(start), endpoint, method)
+		if resp.Error != nil {
+			metrics.PharosRequestErrors.Inc(endpoint, method)
+		}
+	}()
+
+	// Build the request up front, so resp.Request is there even if
+	// we never send it. doRequestOnce builds a new one for each try.
+	resp.Request, resp.Error = client.NewJsonRequest(method, absoluteUrl, nil)
+	if resp.Error != nil {
+		return
+	}
+
+	// Read the request body up front, so we can send it again
+	// if we have to retry.
+	var body []byte
+	if requestData != nil {
+		body, resp.Error = ioutil.ReadAll(requestData)
+		if resp.Error != nil {
+			return
+		}
+	}
+	ctx := client.Context()
+	for retry := 0; ; retry++ {
+		if ctx.Err() != nil {
+			resp.Error = newPharosNetworkError(method, absoluteUrl, ctx.Err())
+			return
+		}
+		if !client.breaker.Allow() {
+			resp.Error = ErrPharosCircuitOpen
+			return
+		}
+		client.doRequestOnce(resp, method, absoluteUrl, body)
+		if resp.Error != nil && ctx.Err() != nil {
+			// We gave up on the request. That doesn't tell us
+			// anything about Pharos, so the breaker doesn't count it.
+			return
+		}
+		if isPharosOutage(resp) {
+			client.breaker.RecordFailure()
+		} else if resp.Response != nil {
+			client.breaker.RecordSuccess()
+		}
+		if retry >= client.retry.MaxRetries || !shouldRetry(method, resp) {
+			return
+		}
+		wait, ok := retryAfter(resp.Response)
+		if !ok {
+			wait = client.retry.Backoff(retry)
+		} else if wait > client.retry.MaxBackoff {
+			// Pharos wants us to wait longer than we're willing to,
+			// so give up now rather than ignore what it asked.
+			return
+		}
+		metrics.PharosRequestRetries.Inc(endpoint, method)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// doRequestOnce makes one attempt at the request DoRequest describes.
+func (client *PharosClient) doRequestOnce(resp *PharosResponse, method, absoluteUrl string, body []byte) {
+	resp.Response = nil
+	resp.data = nil
+	resp.hasBeenRead = false
+
 	// Build the request
+	var requestData io.Reader
+	if body != nil {
+		requestData = bytes.NewReader(body)
+	}
 	request, err := client.NewJsonRequest(method, absoluteUrl, requestData)
-	resp.Request = request
 	resp.Error = err
 	if resp.Error != nil {
+		resp.Request = request
 		return
 	}
+	request = request.WithContext(client.Context())
+	resp.Request = request
 
 	// Issue the HTTP request
-	resp.Response, resp.Error = client.httpClient.Do(request)
-	if resp.Error != nil {
+	resp.Response, err = client.httpClient.Do(request)
+	if err != nil {
+		resp.Error = newPharosNetworkError(method, absoluteUrl, err)
 		return
 	}
 
@@ -999,9 +1141,37 @@ func (client *PharosClient) DoRequest(resp *PharosResponse, method, absoluteUrl
 
 	if resp.Error == nil && resp.Response.StatusCode >= 400 {
 		body, _ := resp.RawResponseData()
-		resp.Error = fmt.Errorf("Server returned status code %d. Body: %s",
-			resp.Response.StatusCode, string(body))
+		resp.Error = newPharosError(method, absoluteUrl, resp.Response, body)
+	}
+}
+
+// pharosActions are the URL path segments that name an action on
+// a Pharos resource, rather than an identifier.
+var pharosActions = map[string]bool{
+	"create_batch":          true,
+	"delete":                true,
+	"finish_delete":         true,
+	"restore":               true,
+	"spot_test_restoration": true,
+}
+
+// PharosEndpoint returns the endpoint name we use in metrics for
+// the specified Pharos URL path. That's the resource name plus any
+// action, without ids, identifiers or query params, so that
+// "/api/v2/objects/test.edu%2Fbag/restore" becomes "objects/restore".
+func PharosEndpoint(relativeUrl string) string {
+	path := strings.SplitN(relativeUrl, "?", 2)[0]
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 2 && segments[0] == "api" {
+		segments = segments[2:]
+	}
+	endpoint := segments[0]
+	for _, segment := range segments[1:] {
+		if pharosActions[segment] {
+			endpoint += "/" + segment
+		}
 	}
+	return endpoint
 }
 
 func escapeFileIdentifier(identifier string) string {
@@ -1,7 +1,9 @@
 package network_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
@@ -1365,3 +1367,21 @@ func workItemStateSaveHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintln(w, string(objJson))
 }
+
+// When the request never goes out, because the context is done, we
+// still know what we would have asked for, but there's no response.
+func TestPharosClientExpiredContext(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(institutionGetHandler))
+	defer testServer.Close()
+	client, err := network.NewPharosClient(testServer.URL, "v2", "user", "key")
+	require.Nil(t, err)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-1*time.Minute))
+	defer cancel()
+	resp := client.WithContext(ctx).InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.True(t, errors.Is(resp.Error, context.DeadlineExceeded), resp.Error.Error())
+	assert.True(t, network.IsPharosUnavailable(resp.Error))
+	assert.Nil(t, resp.Response)
+	require.NotNil(t, resp.Request)
+	assert.Equal(t, testServer.URL+"/api/v2/institutions/college.edu/", resp.RequestURL())
+}
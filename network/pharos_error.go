@@ -0,0 +1,196 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// PharosError is the error in PharosResponse.Error when a request
+// to Pharos failed. If Pharos answered, StatusCode is the HTTP status
+// code, which is 400 or higher, and Body is what Pharos said. If
+// Pharos didn't answer, StatusCode is zero, and Err is the network
+// error.
+//
+// Use the IsPharos* functions to find out what kind of error you
+// have. They work on errors that wrap a PharosError, too.
+type PharosError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+	Err        error
+
+	// ValidationErrors are the errors from a Rails validation failure,
+	// by attribute name, e.g. {"identifier": ["has already been taken"]}.
+	// This is nil unless Pharos returned a validation error.
+	ValidationErrors map[string][]string
+}
+
+// newPharosError returns a PharosError describing the response to
+// a request, with body as the response body. Param absoluteUrl is
+// the URL passed to DoRequest. We don't take it from the request,
+// because NewJsonRequest makes that URL opaque, and it prints
+// without the host.
+func newPharosError(method, absoluteUrl string, response *http.Response, body []byte) *PharosError {
+	pharosErr := &PharosError{
+		Method:     method,
+		URL:        absoluteUrl,
+		StatusCode: response.StatusCode,
+		Body:       string(body),
+	}
+	if response.StatusCode == http.StatusUnprocessableEntity {
+		pharosErr.ValidationErrors = parseValidationErrors(body)
+	}
+	return pharosErr
+}
+
+// newPharosNetworkError returns a PharosError for a request that
+// got no response.
+func newPharosNetworkError(method, absoluteUrl string, err error) *PharosError {
+	return &PharosError{
+		Method: method,
+		URL:    absoluteUrl,
+		Err:    err,
+	}
+}
+
+// parseValidationErrors parses the body of a Rails 422 response,
+// which looks like {"identifier": ["has already been taken"]}, and
+// is sometimes wrapped in {"errors": ...}. It returns nil if the body
+// isn't like that.
+func parseValidationErrors(body []byte) map[string][]string {
+	var wrapped struct {
+		Errors map[string][]string `json:"errors"`
+	}
+	if json.Unmarshal(body, &wrapped) == nil && len(wrapped.Errors) > 0 {
+		return wrapped.Errors
+	}
+	validationErrors := make(map[string][]string)
+	if json.Unmarshal(body, &validationErrors) == nil && len(validationErrors) > 0 {
+		return validationErrors
+	}
+	return nil
+}
+
+// Error returns a description of the error. For errors that came with
+// a response, this includes the status code and the response body.
+func (pharosErr *PharosError) Error() string {
+	if pharosErr.StatusCode == 0 {
+		return pharosErr.Err.Error()
+	}
+	return fmt.Sprintf("Server returned status code %d. Body: %s",
+		pharosErr.StatusCode, pharosErr.Body)
+}
+
+// Unwrap returns the network error, if there was one.
+func (pharosErr *PharosError) Unwrap() error {
+	return pharosErr.Err
+}
+
+// ValidationMessage returns the validation errors as one string,
+// like "identifier has already been taken; size must be greater
+// than 0", sorted by attribute name. It returns an empty string if
+// there are no validation errors.
+func (pharosErr *PharosError) ValidationMessage() string {
+	attrs := make([]string, 0, len(pharosErr.ValidationErrors))
+	for attr := range pharosErr.ValidationErrors {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	messages := make([]string, 0)
+	for _, attr := range attrs {
+		for _, message := range pharosErr.ValidationErrors[attr] {
+			messages = append(messages, attr+" "+message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// AsPharosError returns the PharosError in err, or nil if err
+// isn't and doesn't wrap a PharosError.
+func AsPharosError(err error) *PharosError {
+	var pharosErr *PharosError
+	if errors.As(err, &pharosErr) {
+		return pharosErr
+	}
+	return nil
+}
+
+// pharosStatusCode returns the status code of the PharosError in
+// err, or zero.
+func pharosStatusCode(err error) int {
+	pharosErr := AsPharosError(err)
+	if pharosErr == nil {
+		return 0
+	}
+	return pharosErr.StatusCode
+}
+
+// IsPharosNotFound returns true if Pharos said the record doesn't exist.
+func IsPharosNotFound(err error) bool {
+	return pharosStatusCode(err) == http.StatusNotFound
+}
+
+// IsPharosValidationError returns true if Pharos rejected a record
+// because it isn't valid. See PharosError.ValidationErrors for details.
+func IsPharosValidationError(err error) bool {
+	return pharosStatusCode(err) == http.StatusUnprocessableEntity
+}
+
+// IsPharosConflict returns true if Pharos said the request conflicts
+// with the current state of the record.
+func IsPharosConflict(err error) bool {
+	return pharosStatusCode(err) == http.StatusConflict
+}
+
+// IsPharosUnauthorized returns true if Pharos didn't accept our API
+// credentials, or said we may not do what we asked.
+func IsPharosUnauthorized(err error) bool {
+	status := pharosStatusCode(err)
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// IsPharosUnavailable returns true if Pharos is down, overloaded or
+// unreachable: we couldn't connect, it returned 429, 502, 503 or 504,
+// or the client's circuit breaker is open. These are the errors that
+// may go away if you try again later.
+func IsPharosUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrPharosCircuitOpen) {
+		return true
+	}
+	pharosErr := AsPharosError(err)
+	if pharosErr == nil {
+		return false
+	}
+	switch pharosErr.StatusCode {
+	case 0, http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsPharosFatal returns true if Pharos rejected the request itself,
+// with a 4xx status code, so sending the same request again won't
+// help. That leaves out 408 and 429, which are about timing, and 401
+// and 403, which usually mean our API credentials are wrong. Someone
+// can fix those, and then the request will work.
+func IsPharosFatal(err error) bool {
+	status := pharosStatusCode(err)
+	if status < 400 || status >= 500 {
+		return false
+	}
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusUnauthorized, http.StatusForbidden:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package network_test
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPharosErrorFromResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, `{"identifier":["has already been taken"],"bag_name":["can't be blank","is too short"]}`)
+	}))
+	defer server.Close()
+	client, err := network.NewPharosClient(server.URL, "v2", "user@example.com", "key")
+	require.Nil(t, err)
+
+	resp := client.InstitutionGet("test.edu")
+	require.NotNil(t, resp.Error)
+	pharosErr := network.AsPharosError(resp.Error)
+	require.NotNil(t, pharosErr)
+	assert.Equal(t, 422, pharosErr.StatusCode)
+	assert.Equal(t, "GET", pharosErr.Method)
+	assert.Equal(t, server.URL+"/api/v2/institutions/test.edu/", pharosErr.URL)
+	assert.Equal(t, []string{"has already been taken"}, pharosErr.ValidationErrors["identifier"])
+	assert.Equal(t, "bag_name can't be blank; bag_name is too short; identifier has already been taken",
+		pharosErr.ValidationMessage())
+	assert.True(t, network.IsPharosValidationError(resp.Error))
+	assert.True(t, network.IsPharosFatal(resp.Error))
+	assert.False(t, network.IsPharosUnavailable(resp.Error))
+
+	// The message is the same as it was before we had PharosError.
+	assert.Equal(t, "Server returned status code 422. Body: "+pharosErr.Body, resp.Error.Error())
+
+	// Wrapped errors still work.
+	wrapped := fmt.Errorf("Error getting institution: %w", resp.Error)
+	assert.True(t, network.IsPharosValidationError(wrapped))
+	assert.Equal(t, pharosErr, network.AsPharosError(wrapped))
+}
+
+func TestPharosErrorNotFound(t *testing.T) {
+	fake, client, _ := getFakePharos(t)
+	defer fake.Close()
+	resp := client.WorkItemStateGet(999999)
+	require.NotNil(t, resp.Error)
+	assert.True(t, network.IsPharosNotFound(resp.Error))
+	assert.True(t, network.IsPharosFatal(resp.Error))
+	assert.False(t, network.IsPharosUnavailable(resp.Error))
+	assert.Nil(t, network.AsPharosError(resp.Error).ValidationErrors)
+}
+
+func TestPharosErrorNetwork(t *testing.T) {
+	fake, client, _ := getFakePharos(t)
+	fake.Close()
+	resp := client.InstitutionGet("test.edu")
+	require.NotNil(t, resp.Error)
+	pharosErr := network.AsPharosError(resp.Error)
+	require.NotNil(t, pharosErr)
+	assert.Equal(t, 0, pharosErr.StatusCode)
+	assert.NotNil(t, pharosErr.Err)
+	assert.Equal(t, pharosErr.Err.Error(), pharosErr.Error())
+	assert.True(t, network.IsPharosUnavailable(resp.Error))
+	assert.False(t, network.IsPharosFatal(resp.Error))
+	assert.False(t, network.IsPharosNotFound(resp.Error))
+}
+
+func TestPharosErrorClassification(t *testing.T) {
+	cases := []struct {
+		status       int
+		notFound     bool
+		conflict     bool
+		unauthorized bool
+		unavailable  bool
+		fatal        bool
+	}{
+		{400, false, false, false, false, true},
+		{401, false, false, true, false, false},
+		{403, false, false, true, false, false},
+		{404, true, false, false, false, true},
+		{409, false, true, false, false, true},
+		{429, false, false, false, true, false},
+		{500, false, false, false, false, false},
+		{502, false, false, false, true, false},
+		{503, false, false, false, true, false},
+		{504, false, false, false, true, false},
+	}
+	for _, c := range cases {
+		err := &network.PharosError{StatusCode: c.status}
+		assert.Equal(t, c.notFound, network.IsPharosNotFound(err), "%d", c.status)
+		assert.Equal(t, c.conflict, network.IsPharosConflict(err), "%d", c.status)
+		assert.Equal(t, c.unauthorized, network.IsPharosUnauthorized(err), "%d", c.status)
+		assert.Equal(t, c.unavailable, network.IsPharosUnavailable(err), "%d", c.status)
+		assert.Equal(t, c.fatal, network.IsPharosFatal(err), "%d", c.status)
+	}
+
+	assert.True(t, network.IsPharosUnavailable(network.ErrPharosCircuitOpen))
+	assert.False(t, network.IsPharosFatal(nil))
+	assert.False(t, network.IsPharosUnavailable(fmt.Errorf("Some other error")))
+	assert.Nil(t, network.AsPharosError(fmt.Errorf("Some other error")))
+}
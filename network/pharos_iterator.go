@@ -0,0 +1,367 @@
+package network
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"net/url"
+	"sync"
+)
+
+// DefaultPharosPageSize is the number of records per page that
+// PharosPager asks for, unless the params say otherwise.
+const DefaultPharosPageSize = 100
+
+// PharosPager walks through the pages of results from one of
+// PharosClient's list functions, such as WorkItemList, following the
+// link to the next page until there are no more. If prefetch is true,
+// the pager requests each page while the caller works on the one
+// before it.
+//
+// The pager stops at the first error, which Err returns. Call Close
+// if you stop before the last page, so a prefetching pager doesn't
+// keep requesting pages no one will read.
+type PharosPager struct {
+	list     func(url.Values) *PharosResponse
+	params   url.Values
+	prefetch bool
+	resp     *PharosResponse
+	err      error
+	done     bool
+	pages    chan *PharosResponse
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewPharosPager returns a pager that calls list with params, starting
+// at the page in params, or at page one if params don't say. If params
+// don't include per_page, the pager asks for DefaultPharosPageSize
+// records per page. The pager doesn't change params.
+func NewPharosPager(list func(url.Values) *PharosResponse, params url.Values, prefetch bool) *PharosPager {
+	firstPage := url.Values{}
+	for name, values := range params {
+		firstPage[name] = append([]string{}, values...)
+	}
+	if firstPage.Get("page") == "" {
+		firstPage.Set("page", "1")
+	}
+	if firstPage.Get("per_page") == "" {
+		firstPage.Set("per_page", fmt.Sprintf("%d", DefaultPharosPageSize))
+	}
+	pager := &PharosPager{
+		list:     list,
+		params:   firstPage,
+		prefetch: prefetch,
+		stop:     make(chan struct{}),
+	}
+	if prefetch {
+		pager.pages = make(chan *PharosResponse, 1)
+		go pager.fetchAll()
+	}
+	return pager
+}
+
+// NextPage gets the next page of results, which Response returns.
+// It returns false when there are no more pages, when the pager
+// has been closed, or when a request fails.
+func (pager *PharosPager) NextPage() bool {
+	if pager.done {
+		return false
+	}
+	var resp *PharosResponse
+	if pager.prefetch {
+		var ok bool
+		resp, ok = <-pager.pages
+		if !ok {
+			pager.done = true
+			return false
+		}
+	} else {
+		if pager.params == nil {
+			pager.done = true
+			return false
+		}
+		resp, pager.params = pager.fetch(pager.params)
+	}
+	pager.resp = resp
+	if resp.Error != nil {
+		pager.err = resp.Error
+		pager.done = true
+		return false
+	}
+	return true
+}
+
+// Response returns the most recent page of results.
+func (pager *PharosPager) Response() *PharosResponse {
+	return pager.resp
+}
+
+// Count returns the total number of records on all pages, according
+// to Pharos. This is zero until NextPage has returned the first page.
+func (pager *PharosPager) Count() int {
+	if pager.resp == nil {
+		return 0
+	}
+	return pager.resp.Count
+}
+
+// Err returns the error that stopped the pager, if any.
+func (pager *PharosPager) Err() error {
+	return pager.err
+}
+
+// Close stops the pager. After that, NextPage returns false.
+// It's safe to call Close more than once.
+func (pager *PharosPager) Close() {
+	pager.done = true
+	pager.stopOnce.Do(func() { close(pager.stop) })
+}
+
+// fetch gets one page of results, and returns it along with the
+// params for the next page, which are nil if this is the last page.
+func (pager *PharosPager) fetch(params url.Values) (*PharosResponse, url.Values) {
+	resp := pager.list(params)
+	if resp.Error != nil || !resp.HasNextPage() {
+		return resp, nil
+	}
+	nextPage := resp.ParamsForNextPage()
+	if nextPage == nil {
+		resp.Error = fmt.Errorf("Cannot parse URL of next page: %s", *resp.Next)
+	}
+	return resp, nextPage
+}
+
+// fetchAll gets pages one after another, for a prefetching pager.
+// It stays at most one page ahead of the caller.
+func (pager *PharosPager) fetchAll() {
+	defer close(pager.pages)
+	params := pager.params
+	for params != nil {
+		var resp *PharosResponse
+		resp, params = pager.fetch(params)
+		select {
+		case pager.pages <- resp:
+		case <-pager.stop:
+			return
+		}
+		if resp.Error != nil {
+			return
+		}
+	}
+}
+
+// WorkItemIterator returns the WorkItems from WorkItemList one at a
+// time, across all pages of results. Use it like this:
+//
+//	iterator := client.WorkItemIterator(params, true)
+//	defer iterator.Close()
+//	for iterator.Next() {
+//		workItem := iterator.WorkItem()
+//	}
+//	if iterator.Err() != nil {
+//		...
+//	}
+type WorkItemIterator struct {
+	pager   *PharosPager
+	items   []*models.WorkItem
+	current *models.WorkItem
+}
+
+// WorkItemIterator returns an iterator over the WorkItems matching
+// params. See WorkItemList for a description of the params, and
+// PharosPager for paging and prefetch.
+func (client *PharosClient) WorkItemIterator(params url.Values, prefetch bool) *WorkItemIterator {
+	return &WorkItemIterator{pager: NewPharosPager(client.WorkItemList, params, prefetch)}
+}
+
+// Next moves to the next WorkItem, and returns false if there
+// are no more, or if there was an error.
+func (iterator *WorkItemIterator) Next() bool {
+	for len(iterator.items) == 0 {
+		if !iterator.pager.NextPage() {
+			iterator.current = nil
+			return false
+		}
+		iterator.items = iterator.pager.Response().WorkItems()
+	}
+	iterator.current = iterator.items[0]
+	iterator.items = iterator.items[1:]
+	return true
+}
+
+// WorkItem returns the current WorkItem.
+func (iterator *WorkItemIterator) WorkItem() *models.WorkItem {
+	return iterator.current
+}
+
+// Count returns the total number of matching WorkItems, according
+// to Pharos. This is zero until the first call to Next.
+func (iterator *WorkItemIterator) Count() int {
+	return iterator.pager.Count()
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (iterator *WorkItemIterator) Err() error {
+	return iterator.pager.Err()
+}
+
+// Close stops the iterator.
+func (iterator *WorkItemIterator) Close() {
+	iterator.pager.Close()
+}
+
+// GenericFileIterator returns the GenericFiles from GenericFileList
+// one at a time, across all pages of results. It works like
+// WorkItemIterator.
+type GenericFileIterator struct {
+	pager   *PharosPager
+	files   []*models.GenericFile
+	current *models.GenericFile
+}
+
+// GenericFileIterator returns an iterator over the GenericFiles
+// matching params. See GenericFileList for a description of the
+// params, and PharosPager for paging and prefetch.
+func (client *PharosClient) GenericFileIterator(params url.Values, prefetch bool) *GenericFileIterator {
+	return &GenericFileIterator{pager: NewPharosPager(client.GenericFileList, params, prefetch)}
+}
+
+// Next moves to the next GenericFile, and returns false if there
+// are no more, or if there was an error.
+func (iterator *GenericFileIterator) Next() bool {
+	for len(iterator.files) == 0 {
+		if !iterator.pager.NextPage() {
+			iterator.current = nil
+			return false
+		}
+		iterator.files = iterator.pager.Response().GenericFiles()
+	}
+	iterator.current = iterator.files[0]
+	iterator.files = iterator.files[1:]
+	return true
+}
+
+// GenericFile returns the current GenericFile.
+func (iterator *GenericFileIterator) GenericFile() *models.GenericFile {
+	return iterator.current
+}
+
+// Count returns the total number of matching GenericFiles, according
+// to Pharos. This is zero until the first call to Next.
+func (iterator *GenericFileIterator) Count() int {
+	return iterator.pager.Count()
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (iterator *GenericFileIterator) Err() error {
+	return iterator.pager.Err()
+}
+
+// Close stops the iterator.
+func (iterator *GenericFileIterator) Close() {
+	iterator.pager.Close()
+}
+
+// PremisEventIterator returns the PremisEvents from PremisEventList
+// one at a time, across all pages of results. It works like
+// WorkItemIterator.
+type PremisEventIterator struct {
+	pager   *PharosPager
+	events  []*models.PremisEvent
+	current *models.PremisEvent
+}
+
+// PremisEventIterator returns an iterator over the PremisEvents
+// matching params. See PremisEventList for a description of the
+// params, and PharosPager for paging and prefetch.
+func (client *PharosClient) PremisEventIterator(params url.Values, prefetch bool) *PremisEventIterator {
+	return &PremisEventIterator{pager: NewPharosPager(client.PremisEventList, params, prefetch)}
+}
+
+// Next moves to the next PremisEvent, and returns false if there
+// are no more, or if there was an error.
+func (iterator *PremisEventIterator) Next() bool {
+	for len(iterator.events) == 0 {
+		if !iterator.pager.NextPage() {
+			iterator.current = nil
+			return false
+		}
+		iterator.events = iterator.pager.Response().PremisEvents()
+	}
+	iterator.current = iterator.events[0]
+	iterator.events = iterator.events[1:]
+	return true
+}
+
+// PremisEvent returns the current PremisEvent.
+func (iterator *PremisEventIterator) PremisEvent() *models.PremisEvent {
+	return iterator.current
+}
+
+// Count returns the total number of matching PremisEvents, according
+// to Pharos. This is zero until the first call to Next.
+func (iterator *PremisEventIterator) Count() int {
+	return iterator.pager.Count()
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (iterator *PremisEventIterator) Err() error {
+	return iterator.pager.Err()
+}
+
+// Close stops the iterator.
+func (iterator *PremisEventIterator) Close() {
+	iterator.pager.Close()
+}
+
+// IntellectualObjectIterator returns the IntellectualObjects from
+// IntellectualObjectList one at a time, across all pages of results.
+// It works like WorkItemIterator.
+type IntellectualObjectIterator struct {
+	pager   *PharosPager
+	objects []*models.IntellectualObject
+	current *models.IntellectualObject
+}
+
+// IntellectualObjectIterator returns an iterator over the
+// IntellectualObjects matching params. See IntellectualObjectList for
+// a description of the params, and PharosPager for paging and prefetch.
+func (client *PharosClient) IntellectualObjectIterator(params url.Values, prefetch bool) *IntellectualObjectIterator {
+	return &IntellectualObjectIterator{pager: NewPharosPager(client.IntellectualObjectList, params, prefetch)}
+}
+
+// Next moves to the next IntellectualObject, and returns false if
+// there are no more, or if there was an error.
+func (iterator *IntellectualObjectIterator) Next() bool {
+	for len(iterator.objects) == 0 {
+		if !iterator.pager.NextPage() {
+			iterator.current = nil
+			return false
+		}
+		iterator.objects = iterator.pager.Response().IntellectualObjects()
+	}
+	iterator.current = iterator.objects[0]
+	iterator.objects = iterator.objects[1:]
+	return true
+}
+
+// IntellectualObject returns the current IntellectualObject.
+func (iterator *IntellectualObjectIterator) IntellectualObject() *models.IntellectualObject {
+	return iterator.current
+}
+
+// Count returns the total number of matching IntellectualObjects,
+// according to Pharos. This is zero until the first call to Next.
+func (iterator *IntellectualObjectIterator) Count() int {
+	return iterator.pager.Count()
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (iterator *IntellectualObjectIterator) Err() error {
+	return iterator.pager.Err()
+}
+
+// Close stops the iterator.
+func (iterator *IntellectualObjectIterator) Close() {
+	iterator.pager.Close()
+}
@@ -0,0 +1,144 @@
+package network_test
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+)
+
+// saveFakeWorkItems saves count ingest WorkItems named item_0.tar,
+// item_1.tar, etc.
+func saveFakeWorkItems(t *testing.T, client *network.PharosClient, inst *models.Institution, count int) {
+	for i := 0; i < count; i++ {
+		item := testutil.MakeWorkItem()
+		item.Id = 0
+		item.Name = fmt.Sprintf("item_%d.tar", i)
+		item.Action = constants.ActionIngest
+		item.InstitutionId = inst.Id
+		resp := client.WorkItemSave(item)
+		require.Nil(t, resp.Error)
+	}
+}
+
+func TestWorkItemIterator(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+	saveFakeWorkItems(t, client, inst, 7)
+
+	for _, prefetch := range []bool{false, true} {
+		params := url.Values{}
+		params.Set("item_action", constants.ActionIngest)
+		params.Set("per_page", "3")
+		iterator := client.WorkItemIterator(params, prefetch)
+		names := make(map[string]bool)
+		for iterator.Next() {
+			names[iterator.WorkItem().Name] = true
+		}
+		iterator.Close()
+		require.Nil(t, iterator.Err())
+		assert.Equal(t, 7, len(names), "prefetch = %t", prefetch)
+		assert.Equal(t, 7, iterator.Count())
+		assert.Nil(t, iterator.WorkItem())
+		assert.False(t, iterator.Next())
+
+		// The iterator should not change the caller's params.
+		assert.Equal(t, "", params.Get("page"))
+	}
+
+	// No matches
+	params := url.Values{}
+	params.Set("name", "no such name")
+	iterator := client.WorkItemIterator(params, true)
+	assert.False(t, iterator.Next())
+	assert.Nil(t, iterator.Err())
+	assert.Equal(t, 0, iterator.Count())
+}
+
+func TestWorkItemIteratorClose(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+	saveFakeWorkItems(t, client, inst, 7)
+
+	params := url.Values{}
+	params.Set("per_page", "2")
+	iterator := client.WorkItemIterator(params, true)
+	require.True(t, iterator.Next())
+	require.True(t, iterator.Next())
+	iterator.Close()
+	assert.False(t, iterator.Next())
+	assert.Nil(t, iterator.Err())
+
+	// Closing twice is OK.
+	iterator.Close()
+}
+
+func TestWorkItemIteratorError(t *testing.T) {
+	for _, prefetch := range []bool{false, true} {
+		fake, client, inst := getFakePharos(t)
+		saveFakeWorkItems(t, client, inst, 7)
+
+		params := url.Values{}
+		params.Set("per_page", "2")
+		iterator := client.WorkItemIterator(params, prefetch)
+		require.True(t, iterator.Next())
+		fake.Close()
+		count := 1
+		for iterator.Next() {
+			count++
+		}
+		assert.NotNil(t, iterator.Err(), "prefetch = %t", prefetch)
+		assert.True(t, count < 7)
+		assert.False(t, iterator.Next())
+		iterator.Close()
+	}
+}
+
+func TestGenericFileAndPremisEventIterators(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+	obj := saveFakeObject(t, client, inst, 5)
+
+	params := url.Values{}
+	params.Set("intellectual_object_identifier", obj.Identifier)
+	params.Set("per_page", "2")
+	fileIterator := client.GenericFileIterator(params, true)
+	defer fileIterator.Close()
+	files := 0
+	for fileIterator.Next() {
+		assert.Equal(t, obj.Id, fileIterator.GenericFile().IntellectualObjectId)
+		files++
+	}
+	require.Nil(t, fileIterator.Err())
+	assert.Equal(t, 5, files)
+
+	eventIterator := client.PremisEventIterator(params, false)
+	defer eventIterator.Close()
+	events := 0
+	for eventIterator.Next() {
+		assert.Equal(t, obj.Identifier, eventIterator.PremisEvent().IntellectualObjectIdentifier)
+		events++
+	}
+	require.Nil(t, eventIterator.Err())
+	assert.Equal(t, 10, events)
+}
+
+func TestIntellectualObjectIterator(t *testing.T) {
+	fake, client, inst := getFakePharos(t)
+	defer fake.Close()
+	obj := saveFakeObject(t, client, inst, 0)
+
+	params := url.Values{}
+	params.Set("institution", inst.Identifier)
+	iterator := client.IntellectualObjectIterator(params, true)
+	defer iterator.Close()
+	require.True(t, iterator.Next())
+	assert.Equal(t, obj.Identifier, iterator.IntellectualObject().Identifier)
+	assert.False(t, iterator.Next())
+	assert.Nil(t, iterator.Err())
+}
@@ -119,6 +119,22 @@ func (resp *PharosResponse) RawResponseData() ([]byte, error) {
 	return resp.data, resp.Error
 }
 
+// RequestURL returns the URL of the request, or an empty string if
+// there is no request. Use this to log the URL of a failed request,
+// since resp.Request is nil when absoluteUrl wasn't a valid URL.
+func (resp *PharosResponse) RequestURL() string {
+	if resp.Request == nil || resp.Request.URL == nil {
+		return ""
+	}
+	// NewJsonRequest puts the path in Opaque, to keep encoded
+	// slashes, and URL.String() leaves out the host in that case.
+	requestUrl := resp.Request.URL
+	if requestUrl.Opaque != "" && requestUrl.Host != "" {
+		return requestUrl.Scheme + "://" + requestUrl.Host + requestUrl.Opaque
+	}
+	return requestUrl.String()
+}
+
 // Reads the body of an HTTP response object, closes the stream, and
 // returns a byte array. The body MUST be closed, or you'll wind up
 // with a lot of open network connections.
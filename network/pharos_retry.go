@@ -0,0 +1,360 @@
+package network
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/metrics"
+	"github.com/APTrust/exchange/models"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the durations in models.PharosRetryConfig,
+// for when the config leaves them empty.
+const (
+	DefaultPharosInitialBackoff  = 500 * time.Millisecond
+	DefaultPharosMaxBackoff      = 30 * time.Second
+	DefaultPharosBreakerCooldown = time.Minute
+)
+
+// ErrPharosCircuitOpen is the error PharosClient returns, without
+// sending the request, while its circuit breaker is open.
+var ErrPharosCircuitOpen = fmt.Errorf("Pharos circuit breaker is open. Request was not sent.")
+
+// PharosRetryPolicy says how many times, and how long to wait before,
+// PharosClient retries requests that failed for reasons that may go
+// away on their own. See models.PharosRetryConfig.
+type PharosRetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// NewPharosRetryPolicy returns the retry policy and circuit breaker
+// described by config. The circuit breaker is nil if config doesn't
+// turn it on.
+func NewPharosRetryPolicy(config models.PharosRetryConfig) (PharosRetryPolicy, *CircuitBreaker, error) {
+	policy := PharosRetryPolicy{
+		MaxRetries:     config.MaxRetries,
+		InitialBackoff: DefaultPharosInitialBackoff,
+		MaxBackoff:     DefaultPharosMaxBackoff,
+	}
+	cooldown := DefaultPharosBreakerCooldown
+	var err error
+	if config.InitialBackoff != "" {
+		policy.InitialBackoff, err = time.ParseDuration(config.InitialBackoff)
+		if err != nil {
+			return policy, nil, fmt.Errorf("Invalid PharosRetry.InitialBackoff: %v", err)
+		}
+	}
+	if config.MaxBackoff != "" {
+		policy.MaxBackoff, err = time.ParseDuration(config.MaxBackoff)
+		if err != nil {
+			return policy, nil, fmt.Errorf("Invalid PharosRetry.MaxBackoff: %v", err)
+		}
+	}
+	if config.BreakerCooldown != "" {
+		cooldown, err = time.ParseDuration(config.BreakerCooldown)
+		if err != nil {
+			return policy, nil, fmt.Errorf("Invalid PharosRetry.BreakerCooldown: %v", err)
+		}
+	}
+	var breaker *CircuitBreaker
+	if config.BreakerThreshold > 0 {
+		breaker = NewCircuitBreaker(config.BreakerThreshold, cooldown)
+	}
+	return policy, breaker, nil
+}
+
+// Backoff returns how long to wait before retry number retry, where
+// the first retry is zero. That's InitialBackoff doubled for each
+// retry, up to MaxBackoff, minus up to half of that at random.
+func (policy PharosRetryPolicy) Backoff(retry int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 0; i < retry && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	if backoff <= 1 {
+		return backoff
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)))
+}
+
+// isPharosOutage returns true if resp failed in a way that suggests
+// Pharos, or the network between us and Pharos, is down or overloaded.
+// Those are the failures we retry, and the ones that count against
+// the circuit breaker. A 404 or a 422 means Pharos is fine, and
+// doesn't like the request.
+func isPharosOutage(resp *PharosResponse) bool {
+	return AsPharosError(resp.Error) != nil && IsPharosUnavailable(resp.Error)
+}
+
+// shouldRetry returns true if it's safe to send the request that
+// produced resp again. Pharos didn't act on requests that got a 429
+// or 503, so we can retry any of those. After a network error, a 502
+// or a 504, we can't know whether Pharos acted on the request, so
+// we retry only methods that do the same thing when sent twice.
+func shouldRetry(method string, resp *PharosResponse) bool {
+	if !isPharosOutage(resp) {
+		return false
+	}
+	status := pharosStatusCode(resp.Error)
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the wait time in the response's Retry-After
+// header, which may be a number of seconds or an HTTP date. It
+// returns false if there's no usable Retry-After header.
+func retryAfter(response *http.Response) (time.Duration, bool) {
+	if response == nil {
+		return 0, false
+	}
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		wait := time.Until(when)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// CircuitBreaker stops a PharosClient from sending requests after
+// Threshold outage-type failures in a row. The breaker stays open
+// for Cooldown, then lets requests through again. One success closes
+// it. One more failure opens it for another Cooldown.
+//
+// All of the methods work on a nil CircuitBreaker, which is always
+// closed.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	mutex     sync.Mutex
+}
+
+// NewCircuitBreaker returns a closed circuit breaker that opens after
+// threshold failures in a row, and stays open for cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+	}
+}
+
+// Allow returns true if the breaker is closed, or if it has been
+// open for at least Cooldown.
+func (breaker *CircuitBreaker) Allow() bool {
+	return breaker.OpenFor() == 0
+}
+
+// IsOpen returns true if the breaker has tripped and is in its
+// cooldown period.
+func (breaker *CircuitBreaker) IsOpen() bool {
+	return breaker.OpenFor() > 0
+}
+
+// OpenFor returns how much longer the breaker will stay open,
+// or zero if it's closed.
+func (breaker *CircuitBreaker) OpenFor() time.Duration {
+	if breaker == nil {
+		return 0
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.failures < breaker.Threshold {
+		return 0
+	}
+	remaining := breaker.Cooldown - time.Since(breaker.openedAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// RecordSuccess closes the breaker.
+func (breaker *CircuitBreaker) RecordSuccess() {
+	if breaker == nil {
+		return
+	}
+	breaker.mutex.Lock()
+	breaker.failures = 0
+	breaker.mutex.Unlock()
+}
+
+// RecordFailure counts a failure, and opens the breaker if that makes
+// Threshold failures in a row.
+func (breaker *CircuitBreaker) RecordFailure() {
+	if breaker == nil {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	// Requests that were in flight when the breaker opened
+	// don't keep it open any longer.
+	alreadyOpen := breaker.failures >= breaker.Threshold &&
+		time.Since(breaker.openedAt) < breaker.Cooldown
+	breaker.failures++
+	if breaker.failures >= breaker.Threshold && !alreadyOpen {
+		breaker.openedAt = time.Now()
+		metrics.PharosCircuitBreakerTrips.Inc()
+	}
+}
+
+// PharosPausingHandler is a MessageHandler that holds messages
+// while a CircuitBreaker is open, then passes them on to Handler.
+// It doesn't block while it holds a message, so the queue keeps
+// delivering until the worker has MaxInFlight messages, all of them
+// held here. It touches every message it holds, so none of them
+// time out, and no one burns through the messages' MaxAttempts on
+// requests that can't succeed while Pharos is down.
+type PharosPausingHandler struct {
+	Breaker *CircuitBreaker
+	Handler MessageHandler
+	// TouchInterval is how often to touch the messages while
+	// they're waiting, so the queue doesn't decide they timed out.
+	TouchInterval time.Duration
+	held          []models.QueueMessage
+	mutex         sync.Mutex
+}
+
+// NewPharosPausingHandler returns a handler that holds messages for
+// handler while breaker is open.
+func NewPharosPausingHandler(breaker *CircuitBreaker, handler MessageHandler) *PharosPausingHandler {
+	return &PharosPausingHandler{
+		Breaker:       breaker,
+		Handler:       handler,
+		TouchInterval: 10 * time.Second,
+		held:          make([]models.QueueMessage, 0),
+	}
+}
+
+// HandleMessage passes message to the wrapped handler if the breaker
+// is closed. Otherwise, it holds message until the breaker closes, and
+// the queue's usual response to the wrapped handler's return value
+// comes from the handler instead. Once one message is held, the ones
+// after it are held too, so they're handled in the order they came in.
+func (pausing *PharosPausingHandler) HandleMessage(message models.QueueMessage) error {
+	pausing.mutex.Lock()
+	if len(pausing.held) == 0 && pausing.Breaker.OpenFor() == 0 {
+		pausing.mutex.Unlock()
+		return pausing.Handler.HandleMessage(message)
+	}
+	message.DisableAutoResponse()
+	pausing.held = append(pausing.held, message)
+	if len(pausing.held) == 1 {
+		go pausing.hold()
+	}
+	pausing.mutex.Unlock()
+	return nil
+}
+
+// Held returns the number of messages waiting for the breaker
+// to close.
+func (pausing *PharosPausingHandler) Held() int {
+	pausing.mutex.Lock()
+	defer pausing.mutex.Unlock()
+	return len(pausing.held)
+}
+
+// hold touches the held messages while the breaker is open, and
+// releases them, oldest first, while it's closed.
+func (pausing *PharosPausingHandler) hold() {
+	for {
+		wait := pausing.Breaker.OpenFor()
+		if wait == 0 {
+			if !pausing.releaseNext() {
+				return
+			}
+			continue
+		}
+		if wait > pausing.TouchInterval {
+			wait = pausing.TouchInterval
+		}
+		pausing.mutex.Lock()
+		for _, message := range pausing.held {
+			message.Touch()
+		}
+		pausing.mutex.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// releaseNext releases the oldest held message. It stays on the
+// list until the wrapped handler is done with it, so messages that
+// come in meanwhile wait their turn. It returns false if there are
+// no more messages to release.
+func (pausing *PharosPausingHandler) releaseNext() bool {
+	pausing.mutex.Lock()
+	if len(pausing.held) == 0 {
+		pausing.mutex.Unlock()
+		return false
+	}
+	message := pausing.held[0]
+	pausing.mutex.Unlock()
+	pausing.release(message)
+	pausing.mutex.Lock()
+	defer pausing.mutex.Unlock()
+	pausing.held = pausing.held[1:]
+	return len(pausing.held) > 0
+}
+
+// release passes a held message to the wrapped handler, and then
+// finishes or requeues it, as the queue would have, unless the
+// wrapped handler disabled auto response.
+func (pausing *PharosPausingHandler) release(message models.QueueMessage) {
+	released := &releasedMessage{QueueMessage: message}
+	err := pausing.Handler.HandleMessage(released)
+	if atomic.LoadInt32(&released.autoResponseDisabled) == 1 {
+		return
+	}
+	if err != nil {
+		message.Requeue(-1)
+	} else {
+		message.Finish()
+	}
+}
+
+// releasedMessage is a message PharosPausingHandler held. The handler
+// already disabled the queue's auto response, so this keeps track of
+// whether the wrapped handler wants it disabled too.
+type releasedMessage struct {
+	models.QueueMessage
+	autoResponseDisabled int32
+}
+
+// DisableAutoResponse says the wrapped handler will finish or requeue
+// the message itself.
+func (message *releasedMessage) DisableAutoResponse() {
+	atomic.StoreInt32(&message.autoResponseDisabled, 1)
+}
+
+// LogFailedMessage passes messages that exceeded their max attempts
+// to the wrapped handler, if it's a FailedMessageLogger.
+func (pausing *PharosPausingHandler) LogFailedMessage(message models.QueueMessage) {
+	if logger, ok := pausing.Handler.(FailedMessageLogger); ok {
+		logger.LogFailedMessage(message)
+	}
+}
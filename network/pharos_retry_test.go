@@ -0,0 +1,372 @@
+package network_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const institutionJson = `{"id":1,"name":"Test University","identifier":"test.edu"}`
+
+// flakyPharos returns a server that answers the first failures
+// requests with status, and the rest with an institution. It
+// records the bodies of the requests it receives.
+func flakyPharos(failures int32, status int, retryAfter string) (*httptest.Server, *int32, *[]string) {
+	var count int32
+	bodies := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if atomic.AddInt32(&count, 1) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			fmt.Fprint(w, "Try again later")
+			return
+		}
+		fmt.Fprint(w, institutionJson)
+	}))
+	return server, &count, &bodies
+}
+
+func retryingClient(t *testing.T, serverUrl string, config models.PharosRetryConfig) *network.PharosClient {
+	client, err := network.NewPharosClient(serverUrl, "v2", "user@example.com", "key")
+	require.Nil(t, err)
+	require.Nil(t, client.SetRetryConfig(config))
+	return client
+}
+
+func TestPharosClientRetries(t *testing.T) {
+	for _, status := range []int{429, 502, 503, 504} {
+		server, count, _ := flakyPharos(2, status, "")
+		client := retryingClient(t, server.URL, models.PharosRetryConfig{
+			MaxRetries:     3,
+			InitialBackoff: "1ms",
+			MaxBackoff:     "5ms",
+		})
+		resp := client.InstitutionGet("test.edu")
+		assert.Nil(t, resp.Error, "status %d", status)
+		assert.EqualValues(t, 3, atomic.LoadInt32(count))
+		require.NotNil(t, resp.Institution())
+		assert.Equal(t, "test.edu", resp.Institution().Identifier)
+		server.Close()
+	}
+
+	// Give up after MaxRetries
+	server, count, _ := flakyPharos(10, 502, "")
+	defer server.Close()
+	client := retryingClient(t, server.URL, models.PharosRetryConfig{
+		MaxRetries:     2,
+		InitialBackoff: "1ms",
+	})
+	resp := client.InstitutionGet("test.edu")
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, 502, resp.Response.StatusCode)
+	assert.EqualValues(t, 3, atomic.LoadInt32(count))
+
+	// No retries by default
+	client, err := network.NewPharosClient(server.URL, "v2", "user@example.com", "key")
+	require.Nil(t, err)
+	atomic.StoreInt32(count, 0)
+	resp = client.InstitutionGet("test.edu")
+	assert.NotNil(t, resp.Error)
+	assert.EqualValues(t, 1, atomic.LoadInt32(count))
+}
+
+func TestPharosClientDoesNotRetryClientErrors(t *testing.T) {
+	server, count, _ := flakyPharos(1, 404, "")
+	defer server.Close()
+	client := retryingClient(t, server.URL, models.PharosRetryConfig{
+		MaxRetries:     3,
+		InitialBackoff: "1ms",
+	})
+	resp := client.InstitutionGet("test.edu")
+	assert.NotNil(t, resp.Error)
+	assert.EqualValues(t, 1, atomic.LoadInt32(count))
+}
+
+func TestPharosClientRetriesPost(t *testing.T) {
+	config := models.PharosRetryConfig{MaxRetries: 3, InitialBackoff: "1ms"}
+	item := &models.WorkItem{Name: "bag.tar", Bucket: "aptrust.receiving.test.edu"}
+
+	// Pharos didn't do anything when it returned 503, so we can
+	// resend the POST, with the same body.
+	server, count, bodies := flakyPharos(1, 503, "")
+	client := retryingClient(t, server.URL, config)
+	client.WorkItemSave(item)
+	assert.EqualValues(t, 2, atomic.LoadInt32(count))
+	require.Equal(t, 2, len(*bodies))
+	assert.NotEmpty(t, (*bodies)[0])
+	assert.Equal(t, (*bodies)[0], (*bodies)[1])
+	server.Close()
+
+	// After a 502, we don't know whether Pharos created
+	// the record, so we don't send it again.
+	server, count, _ = flakyPharos(1, 502, "")
+	defer server.Close()
+	client = retryingClient(t, server.URL, config)
+	resp := client.WorkItemSave(item)
+	assert.NotNil(t, resp.Error)
+	assert.EqualValues(t, 1, atomic.LoadInt32(count))
+}
+
+func TestPharosClientHonorsRetryAfter(t *testing.T) {
+	server, count, _ := flakyPharos(1, 429, "1")
+	client := retryingClient(t, server.URL, models.PharosRetryConfig{
+		MaxRetries:     1,
+		InitialBackoff: "1ms",
+		MaxBackoff:     "5s",
+	})
+	start := time.Now()
+	resp := client.InstitutionGet("test.edu")
+	assert.Nil(t, resp.Error)
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.EqualValues(t, 2, atomic.LoadInt32(count))
+	server.Close()
+
+	// If Pharos wants us to wait longer than MaxBackoff,
+	// we give up instead.
+	server, count, _ = flakyPharos(1, 429, "120")
+	defer server.Close()
+	client = retryingClient(t, server.URL, models.PharosRetryConfig{
+		MaxRetries: 1,
+		MaxBackoff: "5s",
+	})
+	resp = client.InstitutionGet("test.edu")
+	assert.NotNil(t, resp.Error)
+	assert.EqualValues(t, 1, atomic.LoadInt32(count))
+}
+
+func TestPharosRetryPolicyBackoff(t *testing.T) {
+	policy := network.PharosRetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max = max * time.Millisecond
+		backoff := policy.Backoff(retry)
+		assert.True(t, backoff >= max/2, "retry %d: %s", retry, backoff)
+		assert.True(t, backoff <= max, "retry %d: %s", retry, backoff)
+	}
+
+	_, _, err := network.NewPharosRetryPolicy(models.PharosRetryConfig{MaxBackoff: "soon"})
+	assert.NotNil(t, err)
+	policy, breaker, err := network.NewPharosRetryPolicy(models.PharosRetryConfig{})
+	require.Nil(t, err)
+	assert.Equal(t, network.DefaultPharosInitialBackoff, policy.InitialBackoff)
+	assert.Nil(t, breaker)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := network.NewCircuitBreaker(2, 50*time.Millisecond)
+	assert.True(t, breaker.Allow())
+	breaker.RecordFailure()
+	assert.True(t, breaker.Allow())
+	breaker.RecordFailure()
+	assert.False(t, breaker.Allow())
+	assert.True(t, breaker.IsOpen())
+	assert.True(t, breaker.OpenFor() > 0)
+
+	// After the cooldown, one failure opens it again...
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, breaker.Allow())
+	breaker.RecordFailure()
+	assert.False(t, breaker.Allow())
+
+	// ...and one success closes it.
+	time.Sleep(60 * time.Millisecond)
+	breaker.RecordSuccess()
+	assert.True(t, breaker.Allow())
+	assert.False(t, breaker.IsOpen())
+
+	// A nil breaker is always closed.
+	var nilBreaker *network.CircuitBreaker
+	nilBreaker.RecordFailure()
+	assert.True(t, nilBreaker.Allow())
+}
+
+func TestPharosClientCircuitBreaker(t *testing.T) {
+	server, count, _ := flakyPharos(100, 503, "")
+	defer server.Close()
+	client := retryingClient(t, server.URL, models.PharosRetryConfig{
+		MaxRetries:       5,
+		InitialBackoff:   "1ms",
+		BreakerThreshold: 3,
+		BreakerCooldown:  "1h",
+	})
+	resp := client.InstitutionGet("test.edu")
+	assert.Equal(t, network.ErrPharosCircuitOpen, resp.Error)
+	assert.EqualValues(t, 3, atomic.LoadInt32(count))
+	assert.True(t, client.CircuitBreaker().IsOpen())
+
+	// No more requests while the breaker is open.
+	resp = client.InstitutionGet("test.edu")
+	assert.Equal(t, network.ErrPharosCircuitOpen, resp.Error)
+	assert.EqualValues(t, 3, atomic.LoadInt32(count))
+
+	// We still have the request, but no response.
+	require.NotNil(t, resp.Request)
+	assert.Equal(t, server.URL+"/api/v2/institutions/test.edu/", resp.RequestURL())
+	assert.Nil(t, resp.Response)
+}
+
+type countingHandler struct {
+	handled int32
+}
+
+func (handler *countingHandler) HandleMessage(message models.QueueMessage) error {
+	atomic.AddInt32(&handler.handled, 1)
+	return nil
+}
+
+// touchCountingMessage counts the times the handler touches it.
+type touchCountingMessage struct {
+	*testutil.TestMessage
+	touches int32
+}
+
+func (message *touchCountingMessage) Touch() {
+	atomic.AddInt32(&message.touches, 1)
+}
+
+// recordingHandler records the bodies of the messages it handles. It
+// fails "bad" messages and leaves "manual" messages for later.
+type recordingHandler struct {
+	bodies []string
+	mutex  sync.Mutex
+}
+
+func (handler *recordingHandler) HandleMessage(message models.QueueMessage) error {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	handler.bodies = append(handler.bodies, string(message.Body()))
+	switch string(message.Body()) {
+	case "bad":
+		return fmt.Errorf("bad message")
+	case "manual":
+		message.DisableAutoResponse()
+	}
+	return nil
+}
+
+func (handler *recordingHandler) Bodies() []string {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return append([]string{}, handler.bodies...)
+}
+
+func TestPharosPausingHandler(t *testing.T) {
+	breaker := network.NewCircuitBreaker(1, 200*time.Millisecond)
+	inner := &countingHandler{}
+	handler := network.NewPharosPausingHandler(breaker, inner)
+	handler.TouchInterval = 10 * time.Millisecond
+	message := &touchCountingMessage{TestMessage: testutil.MakeQueueMessage("1234")}
+
+	// Closed breaker: straight through
+	require.Nil(t, handler.HandleMessage(message))
+	assert.EqualValues(t, 1, inner.handled)
+	assert.EqualValues(t, 0, message.touches)
+
+	// Open breaker: hold the message, touching it, until it closes.
+	breaker.RecordFailure()
+	start := time.Now()
+	require.Nil(t, handler.HandleMessage(message))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&inner.handled))
+	assert.Equal(t, 1, handler.Held())
+	for handler.Held() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&inner.handled))
+	assert.True(t, atomic.LoadInt32(&message.touches) > 1)
+	assert.Equal(t, "finish", message.Operation)
+}
+
+// The queue doesn't wait for the handler to finish one message
+// before delivering the next, so every message the worker has
+// must be held and touched, not just the first.
+func TestPharosPausingHandlerHoldsAllMessages(t *testing.T) {
+	breaker := network.NewCircuitBreaker(1, 200*time.Millisecond)
+	inner := &recordingHandler{}
+	handler := network.NewPharosPausingHandler(breaker, inner)
+	handler.TouchInterval = 10 * time.Millisecond
+	breaker.RecordFailure()
+
+	messages := make([]*touchCountingMessage, 0)
+	for _, body := range []string{"good", "bad", "manual"} {
+		message := &touchCountingMessage{TestMessage: testutil.MakeQueueMessage(body)}
+		require.Nil(t, handler.HandleMessage(message))
+		assert.True(t, message.IsAutoResponseDisabled())
+		messages = append(messages, message)
+	}
+	assert.Equal(t, 3, handler.Held())
+	assert.Empty(t, inner.Bodies())
+
+	// Once the breaker closes, the wrapped handler gets them in
+	// the order they came in, and the pausing handler responds
+	// for it unless it disabled auto response.
+	for handler.Held() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"good", "bad", "manual"}, inner.Bodies())
+	for _, message := range messages {
+		assert.True(t, atomic.LoadInt32(&message.touches) > 1, string(message.Body()))
+	}
+	assert.Equal(t, "finish", messages[0].Operation)
+	assert.Equal(t, "requeue", messages[1].Operation)
+	assert.False(t, messages[2].HasResponded())
+}
+
+func TestPharosClientWithContext(t *testing.T) {
+	// A server that never answers.
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	client := retryingClient(t, server.URL, models.PharosRetryConfig{
+		MaxRetries:       5,
+		InitialBackoff:   "1ms",
+		BreakerThreshold: 1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resp := client.WithContext(ctx).InstitutionGet("test.edu")
+	assert.True(t, time.Since(start) < 5*time.Second)
+	require.NotNil(t, resp.Error)
+	assert.True(t, errors.Is(resp.Error, context.DeadlineExceeded))
+	assert.True(t, network.IsPharosUnavailable(resp.Error))
+
+	// Giving up doesn't mean Pharos is down.
+	assert.False(t, client.CircuitBreaker().IsOpen())
+
+	// A context that's already done stops the request
+	// before it's sent.
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	resp = client.WithContext(cancelled).InstitutionGet("test.edu")
+	assert.True(t, errors.Is(resp.Error, context.Canceled))
+
+	// A nil context is the same as context.Background().
+	assert.NotPanics(t, func() { client.WithContext(nil) })
+}
@@ -0,0 +1,210 @@
+package network
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/metrics"
+	"github.com/APTrust/exchange/models"
+	"github.com/nsqio/go-nsq"
+	"sync"
+	"time"
+)
+
+// Queue is where workers get their work and where they send work
+// on to the next worker in the pipeline.
+//
+// Workers receive work as models.QueueMessage, and they report
+// progress through the message's Touch, Finish and Requeue methods.
+// Touch says the worker is still busy with the message, Finish says
+// it's done, and Requeue says to deliver the message again after some
+// delay. Each queue backend implements those methods in its own way.
+type Queue interface {
+	// Enqueue adds a WorkItem id to the specified topic.
+	Enqueue(topic string, workItemId int) error
+	// EnqueueString adds arbitrary string data to the specified topic.
+	EnqueueString(topic string, data string) error
+	// Subscribe starts delivering messages from workerConfig's
+	// NsqTopic and NsqChannel to handler.
+	Subscribe(workerConfig *models.WorkerConfig, handler MessageHandler) error
+	// Stop stops delivering messages to all subscribers.
+	Stop()
+	// Wait blocks until the queue has stopped.
+	Wait()
+}
+
+// MessageHandler processes the messages a Queue delivers. If
+// HandleMessage returns nil, the queue finishes the message. If it
+// returns an error, the queue requeues the message. Handlers that
+// call DisableAutoResponse must finish or requeue the message
+// themselves.
+type MessageHandler interface {
+	HandleMessage(message models.QueueMessage) error
+}
+
+// FailedMessageLogger is implemented by handlers that want to
+// know when a queue gives up on a message because it has been
+// attempted more than MaxAttempts times.
+type FailedMessageLogger interface {
+	LogFailedMessage(message models.QueueMessage)
+}
+
+// NewQueue returns the Queue described by config.QueueBackend.
+func NewQueue(config *models.Config) (Queue, error) {
+	switch config.QueueBackend {
+	case "", "nsq":
+		return NewNSQQueue(config.NsqdHttpAddress, config.NsqLookupd), nil
+	case "embedded":
+		return NewBoltQueue(config.EmbeddedQueuePath)
+	}
+	return nil, fmt.Errorf("Unknown queue backend '%s'. Use 'nsq' or 'embedded'.",
+		config.QueueBackend)
+}
+
+// NSQQueue is a Queue backed by nsqd. It publishes through nsqd's
+// HTTP interface and subscribes through nsqlookupd.
+type NSQQueue struct {
+	*NSQClient
+	LookupdAddress string
+	consumers      []*nsq.Consumer
+	mutex          sync.Mutex
+}
+
+// NewNSQQueue returns a new NSQQueue that publishes to the nsqd
+// server at nsqdHttpAddress and finds topics through the nsqlookupd
+// server at lookupdAddress.
+func NewNSQQueue(nsqdHttpAddress, lookupdAddress string) *NSQQueue {
+	return &NSQQueue{
+		NSQClient:      NewNSQClient(nsqdHttpAddress),
+		LookupdAddress: lookupdAddress,
+		consumers:      make([]*nsq.Consumer, 0),
+	}
+}
+
+// NewNSQConsumer creates and returns an NSQ consumer for a worker process.
+func NewNSQConsumer(workerConfig *models.WorkerConfig) (*nsq.Consumer, error) {
+	nsqConfig := nsq.NewConfig()
+	nsqConfig.Set("max_in_flight", workerConfig.MaxInFlight)
+	nsqConfig.Set("heartbeat_interval", workerConfig.HeartbeatInterval)
+	nsqConfig.Set("max_attempts", workerConfig.MaxAttempts)
+	nsqConfig.Set("read_timeout", workerConfig.ReadTimeout)
+	nsqConfig.Set("write_timeout", workerConfig.WriteTimeout)
+	nsqConfig.Set("msg_timeout", workerConfig.MessageTimeout)
+	nsqConfig.Set("max_req_timeout", "4h0m")
+	return nsq.NewConsumer(workerConfig.NsqTopic, workerConfig.NsqChannel, nsqConfig)
+}
+
+// Subscribe creates an NSQ consumer for workerConfig's topic and
+// channel, and connects it to nsqlookupd.
+func (queue *NSQQueue) Subscribe(workerConfig *models.WorkerConfig, handler MessageHandler) error {
+	consumer, err := NewNSQConsumer(workerConfig)
+	if err != nil {
+		return err
+	}
+	consumer.AddHandler(&nsqHandler{topic: workerConfig.NsqTopic, handler: handler})
+	err = consumer.ConnectToNSQLookupd(queue.LookupdAddress)
+	if err != nil {
+		return err
+	}
+	queue.mutex.Lock()
+	queue.consumers = append(queue.consumers, consumer)
+	queue.mutex.Unlock()
+	return nil
+}
+
+// Stop stops all of this queue's NSQ consumers.
+func (queue *NSQQueue) Stop() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for _, consumer := range queue.consumers {
+		consumer.Stop()
+	}
+}
+
+// Wait blocks until all of this queue's NSQ consumers have stopped.
+func (queue *NSQQueue) Wait() {
+	queue.mutex.Lock()
+	consumers := make([]*nsq.Consumer, len(queue.consumers))
+	copy(consumers, queue.consumers)
+	queue.mutex.Unlock()
+	for _, consumer := range consumers {
+		<-consumer.StopChan
+	}
+}
+
+// nsqHandler passes the messages an nsq.Consumer receives on to a
+// MessageHandler, and counts them in metrics.
+type nsqHandler struct {
+	topic   string
+	handler MessageHandler
+}
+
+func (adapter *nsqHandler) HandleMessage(message *nsq.Message) error {
+	metrics.MessagesReceived.Inc(adapter.topic)
+	message.Delegate = &meteredDelegate{topic: adapter.topic, delegate: message.Delegate}
+	return adapter.handler.HandleMessage(NewNSQMessage(message))
+}
+
+// LogFailedMessage passes messages that exceeded their max attempts
+// to the wrapped handler, if it's a FailedMessageLogger.
+func (adapter *nsqHandler) LogFailedMessage(message *nsq.Message) {
+	if logger, ok := adapter.handler.(FailedMessageLogger); ok {
+		logger.LogFailedMessage(NewNSQMessage(message))
+	}
+}
+
+// NSQMessage is a models.QueueMessage that wraps an *nsq.Message.
+type NSQMessage struct {
+	message *nsq.Message
+}
+
+// NewNSQMessage returns a QueueMessage for message.
+func NewNSQMessage(message *nsq.Message) *NSQMessage {
+	return &NSQMessage{message: message}
+}
+
+// ID returns the NSQ message id.
+func (m *NSQMessage) ID() string {
+	return string(m.message.ID[:])
+}
+
+// Body returns the message body.
+func (m *NSQMessage) Body() []byte {
+	return m.message.Body
+}
+
+// Attempts returns the number of times NSQ has delivered this message.
+func (m *NSQMessage) Attempts() uint16 {
+	return m.message.Attempts
+}
+
+// Touch resets the message's timeout on nsqd.
+func (m *NSQMessage) Touch() {
+	m.message.Touch()
+}
+
+// Finish tells nsqd we're done with the message.
+func (m *NSQMessage) Finish() {
+	m.message.Finish()
+}
+
+// Requeue tells nsqd to deliver the message again after delay,
+// and backs off the consumer.
+func (m *NSQMessage) Requeue(delay time.Duration) {
+	m.message.Requeue(delay)
+}
+
+// RequeueWithoutBackoff tells nsqd to deliver the message again
+// after delay, without backing off the consumer.
+func (m *NSQMessage) RequeueWithoutBackoff(delay time.Duration) {
+	m.message.RequeueWithoutBackoff(delay)
+}
+
+// DisableAutoResponse stops the consumer from finishing or requeueing
+// the message when the handler returns.
+func (m *NSQMessage) DisableAutoResponse() {
+	m.message.DisableAutoResponse()
+}
+
+// HasResponded returns true if the message has been finished or requeued.
+func (m *NSQMessage) HasResponded() bool {
+	return m.message.HasResponded()
+}
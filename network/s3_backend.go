@@ -0,0 +1,378 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// S3Backend is a StorageBackend that talks to S3 and Glacier, or to
+// an S3-compatible service such as MinIO. It wraps our S3 clients
+// (S3Upload, S3Head, S3ObjectDelete, etc.), and all of those clients
+// share the backend's session, so we don't build a new AWS session
+// for every request.
+type S3Backend struct {
+	AWSRegion string
+	// Endpoint is the URL of an S3-compatible service to talk
+	// to instead of AWS. Leave this empty to talk to AWS.
+	Endpoint        string
+	accessKeyId     string
+	secretAccessKey string
+	session         *session.Session
+	mutex           sync.Mutex
+	ctx             context.Context
+}
+
+// NewS3Backend returns a new S3Backend. Params:
+//
+// accessKeyId     - The AWS Access Key Id used to authenticate with AWS.
+// secretAccessKey - The AWS secret access key.
+// region          - The name of the AWS region to talk to.
+//                   E.g. us-east-1 (VA), us-west-2 (Oregon), or use
+//                   constants.AWSVirginia, constants.AWSOregon
+// endpoint        - The URL of an S3-compatible service, such as a
+//                   local MinIO server. Leave empty to talk to AWS.
+func NewS3Backend(accessKeyId, secretAccessKey, region, endpoint string) *S3Backend {
+	return &S3Backend{
+		AWSRegion:       region,
+		Endpoint:        endpoint,
+		accessKeyId:     accessKeyId,
+		secretAccessKey: secretAccessKey,
+	}
+}
+
+// GetSession returns the S3 session this backend shares among its clients.
+func (backend *S3Backend) GetSession() (*session.Session, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if backend.session == nil {
+		_session, err := GetS3SessionWithEndpoint(backend.AWSRegion,
+			backend.accessKeyId, backend.secretAccessKey, backend.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		backend.session = _session
+	}
+	return backend.session, nil
+}
+
+// WithContext returns a copy of the backend whose requests use ctx,
+// so they're aborted when ctx is cancelled or its deadline passes.
+// The copy shares the original's session. If ctx is nil, the copy
+// uses context.Background().
+func (backend *S3Backend) WithContext(ctx context.Context) StorageBackend {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return &S3Backend{
+		AWSRegion:       backend.AWSRegion,
+		Endpoint:        backend.Endpoint,
+		accessKeyId:     backend.accessKeyId,
+		secretAccessKey: backend.secretAccessKey,
+		session:         backend.session,
+		ctx:             ctx,
+	}
+}
+
+// Context returns the backend's context, which is
+// context.Background() unless the backend came from WithContext.
+func (backend *S3Backend) Context() context.Context {
+	if backend.ctx == nil {
+		return context.Background()
+	}
+	return backend.ctx
+}
+
+// Put uploads the contents of reader to bucket/key and returns
+// the URL of the new S3 object.
+func (backend *S3Backend) Put(bucket, key, contentType string, metadata map[string]string, reader io.Reader, size int64) (string, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return "", err
+	}
+	upload := NewS3Upload(backend.accessKeyId, backend.secretAccessKey,
+		backend.AWSRegion, bucket, key, contentType)
+	upload.session = _session
+	upload = upload.WithContext(backend.Context())
+	for name, value := range metadata {
+		upload.AddMetadata(name, value)
+	}
+	if size > 0 {
+		upload.SendWithSize(reader, size)
+	} else {
+		upload.Send(reader)
+	}
+	if upload.ErrorMessage != "" {
+		return "", errors.New(upload.ErrorMessage)
+	}
+	return upload.Response.Location, nil
+}
+
+// Get returns a reader for the S3 object at bucket/key.
+func (backend *S3Backend) Get(bucket, key string) (io.ReadCloser, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s3.New(_session).GetObjectWithContext(backend.Context(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetRange returns a reader for length bytes of the S3 object
+// at bucket/key, starting at offset. If etag is not empty, S3
+// checks it with an If-Match header.
+func (backend *S3Backend) GetRange(bucket, key string, offset, length int64, etag string) (io.ReadCloser, error) {
+	if length < 1 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	_session, err := backend.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	if etag != "" {
+		params.IfMatch = aws.String(etag)
+	}
+	resp, err := s3.New(_session).GetObjectWithContext(backend.Context(), params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Head returns information about the S3 object at bucket/key.
+func (backend *S3Backend) Head(bucket, key string) (*StorageObject, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	client := NewS3Head(backend.accessKeyId, backend.secretAccessKey,
+		backend.AWSRegion, bucket)
+	client.session = _session
+	client = client.WithContext(backend.Context())
+	client.Head(key)
+	if client.ErrorMessage != "" {
+		return nil, errors.New(client.ErrorMessage)
+	}
+	resp := client.Response
+	obj := &StorageObject{
+		Bucket:      bucket,
+		Key:         key,
+		Size:        aws.Int64Value(resp.ContentLength),
+		ETag:        strings.Replace(aws.StringValue(resp.ETag), "\"", "", -1),
+		ContentType: aws.StringValue(resp.ContentType),
+		Metadata:    make(map[string]string),
+	}
+	if resp.LastModified != nil {
+		obj.LastModified = *resp.LastModified
+	}
+	for name, value := range resp.Metadata {
+		obj.Metadata[strings.ToLower(name)] = util.PointerToString(value)
+	}
+	obj.Restore, err = client.GetRestoreRequestInfo()
+	return obj, err
+}
+
+// Delete deletes the specified keys from the S3 bucket.
+func (backend *S3Backend) Delete(bucket string, keys ...string) error {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return err
+	}
+	client := NewS3ObjectDelete(backend.accessKeyId, backend.secretAccessKey,
+		backend.AWSRegion, bucket, keys)
+	client.session = _session
+	client = client.WithContext(backend.Context())
+	client.DeleteList()
+	if client.ErrorMessage != "" {
+		return errors.New(client.ErrorMessage)
+	}
+	return nil
+}
+
+// List returns up to maxKeys objects from the S3 bucket whose keys
+// begin with prefix. If maxKeys is zero, S3 returns up to 1000 keys.
+// Note that S3 list results do not include content type or metadata.
+func (backend *S3Backend) List(bucket, prefix string, maxKeys int64) ([]*StorageObject, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	client := NewS3ObjectList(backend.accessKeyId, backend.secretAccessKey,
+		backend.AWSRegion, bucket, maxKeys)
+	client.session = _session
+	client = client.WithContext(backend.Context())
+	client.GetList(prefix)
+	if client.ErrorMessage != "" {
+		return nil, errors.New(client.ErrorMessage)
+	}
+	objects := make([]*StorageObject, 0)
+	for _, s3Obj := range client.Response.Contents {
+		obj := &StorageObject{
+			Bucket: bucket,
+			Key:    aws.StringValue(s3Obj.Key),
+			Size:   aws.Int64Value(s3Obj.Size),
+			ETag:   strings.Replace(aws.StringValue(s3Obj.ETag), "\"", "", -1),
+		}
+		if s3Obj.LastModified != nil {
+			obj.LastModified = *s3Obj.LastModified
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// RequestRestore asks S3 to restore an object from Glacier.
+func (backend *S3Backend) RequestRestore(bucket, key, tier string, days int64) (*RestoreStatus, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	client := NewS3Restore(backend.accessKeyId, backend.secretAccessKey,
+		backend.AWSRegion, bucket, key, tier, days)
+	client.session = _session
+	client = client.WithContext(backend.Context())
+	client.Restore()
+	status := &RestoreStatus{
+		Accepted:            client.RequestAccepted(),
+		AlreadyInProgress:   client.RestoreAlreadyInProgress,
+		AlreadyInActiveTier: client.AlreadyInActiveTier,
+		ServiceUnavailable:  client.RequestRejectedServiceUnavailable,
+	}
+	if client.ErrorMessage != "" {
+		return status, errors.New(client.ErrorMessage)
+	}
+	return status, nil
+}
+
+// CreateMultipartUpload starts a multipart upload to S3 and
+// returns the upload id.
+func (backend *S3Backend) CreateMultipartUpload(bucket, key, contentType string, metadata map[string]string) (string, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return "", err
+	}
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Metadata: aws.StringMap(metadata),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	resp, err := s3.New(_session).CreateMultipartUploadWithContext(backend.Context(), input)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.UploadId), nil
+}
+
+// UploadPart sends one part of a multipart upload to S3 and
+// returns the part's ETag.
+func (backend *S3Backend) UploadPart(bucket, key, uploadId string, partNumber int64, reader io.ReadSeeker, size int64) (string, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return "", err
+	}
+	resp, err := s3.New(_session).UploadPartWithContext(backend.Context(), &s3.UploadPartInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadId),
+		PartNumber:    aws.Int64(partNumber),
+		Body:          reader,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(aws.StringValue(resp.ETag), "\"", "", -1), nil
+}
+
+// CompleteMultipartUpload tells S3 to assemble the parts of a
+// multipart upload, and returns the URL of the new S3 object.
+func (backend *S3Backend) CompleteMultipartUpload(bucket, key, uploadId string, parts []*models.UploadPart) (string, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return "", err
+	}
+	completedParts := make([]*s3.CompletedPart, len(parts))
+	for i, part := range parts {
+		completedParts[i] = &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.PartNumber),
+		}
+	}
+	resp, err := s3.New(_session).CompleteMultipartUploadWithContext(backend.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.Location), nil
+}
+
+// AbortMultipartUpload tells S3 to discard a multipart upload
+// and any parts already uploaded.
+func (backend *S3Backend) AbortMultipartUpload(bucket, key, uploadId string) error {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return err
+	}
+	_, err = s3.New(_session).AbortMultipartUploadWithContext(backend.Context(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	})
+	return err
+}
+
+// ListMultipartUploads returns the multipart uploads in progress in
+// the S3 bucket whose keys begin with prefix.
+func (backend *S3Backend) ListMultipartUploads(bucket, prefix string) ([]*MultipartUploadInfo, error) {
+	_session, err := backend.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	uploads := make([]*MultipartUploadInfo, 0)
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	err = s3.New(_session).ListMultipartUploadsPagesWithContext(backend.Context(), input,
+		func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, upload := range page.Uploads {
+				uploads = append(uploads, &MultipartUploadInfo{
+					Bucket:    bucket,
+					Key:       aws.StringValue(upload.Key),
+					UploadId:  aws.StringValue(upload.UploadId),
+					Initiated: aws.TimeValue(upload.Initiated),
+				})
+			}
+			return true
+		})
+	return uploads, err
+}
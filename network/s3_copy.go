@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -19,6 +20,8 @@ type S3Copy struct {
 	accessKeyId       string
 	secretAccessKey   string
 	session           *session.Session
+
+	ctx context.Context
 }
 
 // Sets up a new S3Copy object. Params:
@@ -62,8 +65,27 @@ func (client *S3Copy) GetSession() *session.Session {
 	return client.session
 }
 
+// WithContext returns a copy of the client whose copy is
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *S3Copy) WithContext(ctx context.Context) *S3Copy {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *S3Copy) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Fetch the file from S3.
 func (client *S3Copy) Copy() {
+	ctx := client.context()
 	client.Response = nil
 	_session := client.GetSession()
 	if _session == nil {
@@ -79,7 +101,7 @@ func (client *S3Copy) Copy() {
 		Key:        aws.String(client.DestinationKey),
 	}
 	var err error
-	client.Response, err = service.CopyObject(copyObjectInput)
+	client.Response, err = service.CopyObjectWithContext(ctx, copyObjectInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 		return
@@ -88,7 +110,7 @@ func (client *S3Copy) Copy() {
 		Bucket: aws.String(client.DestinationBucket),
 		Key:    aws.String(client.DestinationKey),
 	}
-	err = service.WaitUntilObjectExists(headObjectInput)
+	err = service.WaitUntilObjectExistsWithContext(ctx, headObjectInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
@@ -1,19 +1,25 @@
 package network
 
 import (
-	"crypto/md5"
-	"crypto/sha256"
+	"context"
 	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
+// DOWNLOAD_PART_SIZE is the default size of the byte ranges we fetch
+// when downloading an object in parallel.
+const DOWNLOAD_PART_SIZE = int64(64 * 1024 * 1024)
+
 type S3Download struct {
 	AWSRegion       string
 	BucketName      string
@@ -23,8 +29,31 @@ type S3Download struct {
 	CalculateSha256 bool
 	Md5Digest       string
 	Sha256Digest    string
-	BytesCopied     int64
-	ErrorMessage    string
+	// Algorithms lists additional digest algorithms (beyond
+	// those specified by CalculateMd5 and CalculateSha256)
+	// to calculate on the download. E.g. constants.AlgSha512.
+	Algorithms []string
+	// Digests maps algorithm name to the digest calculated
+	// on the download, for all algorithms we calculated.
+	Digests      map[string]string
+	BytesCopied  int64
+	ErrorMessage string
+
+	// Concurrency is the number of byte ranges to fetch at once.
+	// If this is greater than one, Fetch downloads the object in
+	// ranges of PartSize bytes and writes them out in order. This
+	// can use up to (Concurrency + 1) * PartSize bytes of memory.
+	// Zero or one means download in a single stream.
+	Concurrency int
+	// PartSize is the size of each byte range in a parallel
+	// download. Defaults to DOWNLOAD_PART_SIZE.
+	PartSize int64
+	// Writer, if not nil, receives the contents of the download.
+	// In that case, we ignore LocalPath.
+	Writer io.Writer
+	// Endpoint is the URL of an S3-compatible service to download
+	// from, such as a local MinIO server. Leave empty for AWS.
+	Endpoint string
 
 	// The response from S3 for the attempted download.
 	// Don't try to read Response.Body, because if this
@@ -35,6 +64,8 @@ type S3Download struct {
 	accessKeyId     string
 	secretAccessKey string
 	session         *session.Session
+
+	ctx context.Context
 }
 
 // Sets up a new S3 download. Params:
@@ -70,8 +101,8 @@ func NewS3Download(accessKeyId, secretAccessKey, region, bucket, key, localPath
 func (client *S3Download) GetSession() *session.Session {
 	if client.session == nil {
 		var err error
-		client.session, err = GetS3Session(client.AWSRegion,
-			client.accessKeyId, client.secretAccessKey)
+		client.session, err = GetS3SessionWithEndpoint(client.AWSRegion,
+			client.accessKeyId, client.secretAccessKey, client.Endpoint)
 		if err != nil {
 			client.ErrorMessage = err.Error()
 		}
@@ -79,8 +110,27 @@ func (client *S3Download) GetSession() *session.Session {
 	return client.session
 }
 
+// WithContext returns a copy of the client whose download is
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *S3Download) WithContext(ctx context.Context) *S3Download {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *S3Download) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Fetch the file from S3.
 func (client *S3Download) Fetch() {
+	ctx := client.context()
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -94,14 +144,23 @@ func (client *S3Download) Fetch() {
 		Key:    aws.String(client.KeyName),
 	}
 
+	if client.Concurrency > 1 {
+		err := client.fetchRanges(ctx, service)
+		if err != nil {
+			client.ErrorMessage = err.Error()
+		}
+		return
+	}
+
 	// Try the download several times. On larger files,
 	// it's common to get a "connection reset by peer"
 	// error, and we'd rather just try again now than
-	// requeue the whole job.
+	// requeue the whole job. We can't take back what we've
+	// already written to the caller's Writer, though.
 	var err error = nil
 	for i := 0; i < 5; i++ {
-		err = client.tryDownload(service, params)
-		if err == nil {
+		err = client.tryDownload(ctx, service, params)
+		if err == nil || ctx.Err() != nil || (client.Writer != nil && client.BytesCopied > 0) {
 			break
 		}
 	}
@@ -120,46 +179,29 @@ func (client *S3Download) Fetch() {
 // hashing algorithms don't provide. When we're working with
 // multi-gigabyte files, we really don't want to have to read them
 // again to produce the checksums.
-func (client *S3Download) tryDownload(service *s3.S3, params *s3.GetObjectInput) error {
-	resp, err := service.GetObject(params)
+func (client *S3Download) tryDownload(ctx context.Context, service *s3.S3, params *s3.GetObjectInput) error {
+	resp, err := service.GetObjectWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	client.Response = resp
 
-	// Create the download directory and open a file for writing.
-	writers := make([]io.Writer, 0)
-	if client.LocalPath == os.DevNull {
-		writers = append(writers, ioutil.Discard)
-	} else {
-		err = os.MkdirAll(filepath.Dir(client.LocalPath), 0755)
-		if err != nil {
-			return err
-		}
-		outputFile, err := os.Create(client.LocalPath)
-		if err != nil {
-			return err
-		}
-		writers = append(writers, outputFile)
-		defer outputFile.Close()
+	output, err := client.openOutput()
+	if err != nil {
+		return err
 	}
+	defer output.Close()
 
 	// Create a writer to write the contents to the file,
 	// and optionally to pass the bitstream through the
-	// md5 and sha256 algorithms while we're at it.
-	var multiWriter io.Writer
-	var md5Hash hash.Hash
-	var sha256Hash hash.Hash
-	if client.CalculateMd5 {
-		md5Hash = md5.New()
-		writers = append(writers, md5Hash)
-	}
-	if client.CalculateSha256 {
-		sha256Hash = sha256.New()
-		writers = append(writers, sha256Hash)
+	// digest algorithms while we're at it.
+	hashes, err := fileutil.NewHashes(client.algorithms())
+	if err != nil {
+		return err
 	}
-	multiWriter = io.MultiWriter(writers...)
+	writers := append([]io.Writer{output}, fileutil.HashWriters(hashes)...)
+	multiWriter := io.MultiWriter(writers...)
 
 	// Copy the file, with several tries. On larger files,
 	// we often get a "connection reset by peer" error.
@@ -167,7 +209,7 @@ func (client *S3Download) tryDownload(service *s3.S3, params *s3.GetObjectInput)
 	// back into the work queue.
 	for attemptNumber := 0; attemptNumber < 5; attemptNumber++ {
 		client.BytesCopied, err = io.Copy(multiWriter, resp.Body)
-		if err == nil {
+		if err == nil || ctx.Err() != nil {
 			break
 		}
 	}
@@ -176,13 +218,253 @@ func (client *S3Download) tryDownload(service *s3.S3, params *s3.GetObjectInput)
 	}
 
 	// Set the checksums, if needed...
-	if client.CalculateMd5 {
-		client.Md5Digest = fmt.Sprintf("%x", md5Hash.Sum(nil))
+	client.Digests = fileutil.HexDigests(hashes)
+	client.Md5Digest = client.Digests[constants.AlgMd5]
+	client.Sha256Digest = client.Digests[constants.AlgSha256]
+
+	// No errors.
+	return nil
+}
+
+// fetchRanges downloads the object in byte ranges of PartSize,
+// fetching up to Concurrency ranges at once, and writes the ranges
+// out in order, so we can still calculate digests in a single pass.
+// We get the object's size from a HEAD request, and make sure we
+// wrote exactly that many bytes.
+func (client *S3Download) fetchRanges(ctx context.Context, service *s3.S3) error {
+	head, err := service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(client.BucketName),
+		Key:    aws.String(client.KeyName),
+	})
+	if err != nil {
+		return err
 	}
-	if client.CalculateSha256 {
-		client.Sha256Digest = fmt.Sprintf("%x", sha256Hash.Sum(nil))
+	size := aws.Int64Value(head.ContentLength)
+
+	// Callers look at Response for the object's S3 attributes,
+	// which are the same in the HEAD response.
+	client.Response = &s3.GetObjectOutput{
+		ContentLength:        head.ContentLength,
+		ContentType:          head.ContentType,
+		ETag:                 head.ETag,
+		LastModified:         head.LastModified,
+		Metadata:             head.Metadata,
+		PartsCount:           head.PartsCount,
+		ServerSideEncryption: head.ServerSideEncryption,
+		StorageClass:         head.StorageClass,
+		VersionId:            head.VersionId,
 	}
 
-	// No errors.
+	output, err := client.openOutput()
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	hashes, err := fileutil.NewHashes(client.algorithms())
+	if err != nil {
+		return err
+	}
+	writers := append([]io.Writer{output}, fileutil.HashWriters(hashes)...)
+
+	// We send the ETag from the HEAD request with each range request,
+	// so S3 will refuse to give us a piece of some newer version of
+	// the object.
+	getRange := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		resp, err := service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(client.BucketName),
+			Key:     aws.String(client.KeyName),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			IfMatch: head.ETag,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	client.BytesCopied, err = CopyRanges(ctx, io.MultiWriter(writers...), size,
+		client.PartSize, client.Concurrency, getRange)
+	if err != nil {
+		return err
+	}
+	if client.BytesCopied != size {
+		return fmt.Errorf("Downloaded %d bytes of %s/%s, but S3 says it has %d",
+			client.BytesCopied, client.BucketName, client.KeyName, size)
+	}
+
+	client.Digests = fileutil.HexDigests(hashes)
+	client.Md5Digest = client.Digests[constants.AlgMd5]
+	client.Sha256Digest = client.Digests[constants.AlgSha256]
 	return nil
 }
+
+// openOutput returns the writer to which we should copy the download.
+// That's client.Writer if it's set. Otherwise, it's the file at
+// LocalPath, which we create along with its directory.
+func (client *S3Download) openOutput() (io.WriteCloser, error) {
+	if client.Writer != nil {
+		return nopWriteCloser{client.Writer}, nil
+	}
+	if client.LocalPath == os.DevNull {
+		return nopWriteCloser{ioutil.Discard}, nil
+	}
+	err := os.MkdirAll(filepath.Dir(client.LocalPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(client.LocalPath)
+}
+
+// RangeGetter returns a reader for bytes start through end (inclusive)
+// of an object. It should give up when ctx is done.
+type RangeGetter func(ctx context.Context, start, end int64) (io.ReadCloser, error)
+
+// CopyRanges copies size bytes to writer in ranges of partSize bytes,
+// calling getRange to fetch up to concurrency ranges at once. Ranges
+// are written to writer in order, so writer can be a hash. Returns the
+// number of bytes written, and the first error from getRange or writer.
+//
+// Each range gets several tries, unless ctx is done, or the object is
+// missing or has changed. After the first error, CopyRanges cancels the
+// ranges still in progress.
+func CopyRanges(ctx context.Context, writer io.Writer, size, partSize int64, concurrency int, getRange RangeGetter) (int64, error) {
+	if partSize < 1 {
+		partSize = DOWNLOAD_PART_SIZE
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mutex sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	// copyError returns the error that stopped the copy: the first
+	// range that failed, or else err, or else the reason ctx is done.
+	copyError := func(err error) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr != nil {
+			return firstErr
+		}
+		if err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+	partCount := (size + partSize - 1) / partSize
+	results := make([]chan rangeResult, partCount)
+	for i := range results {
+		results[i] = make(chan rangeResult, 1)
+	}
+
+	// Tokens limit the number of ranges we're fetching or holding
+	// in memory. We hand one back after writing each range.
+	tokens := make(chan bool, concurrency)
+	go func() {
+		for i := int64(0); i < partCount; i++ {
+			select {
+			case tokens <- true:
+			case <-ctx.Done():
+				return
+			}
+			start := i * partSize
+			end := start + partSize - 1
+			if end >= size {
+				end = size - 1
+			}
+			go func(i, start, end int64) {
+				data, err := readRange(ctx, getRange, start, end)
+				if err != nil {
+					fail(err)
+				}
+				results[i] <- rangeResult{data: data, err: err}
+			}(i, start, end)
+		}
+	}()
+
+	bytesWritten := int64(0)
+	for i := int64(0); i < partCount; i++ {
+		var result rangeResult
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+		}
+		if result.err != nil || ctx.Err() != nil {
+			return bytesWritten, copyError(result.err)
+		}
+		n, err := writer.Write(result.data)
+		bytesWritten += int64(n)
+		if err != nil {
+			return bytesWritten, err
+		}
+		<-tokens
+	}
+	return bytesWritten, nil
+}
+
+// readRange returns bytes start through end (inclusive) from getRange,
+// trying several times.
+func readRange(ctx context.Context, getRange RangeGetter, start, end int64) ([]byte, error) {
+	var err error
+	for attemptNumber := 0; attemptNumber < 5 && ctx.Err() == nil; attemptNumber++ {
+		var reader io.ReadCloser
+		reader, err = getRange(ctx, start, end)
+		if err != nil {
+			if IsNotFound(err) || IsETagMismatch(err) {
+				return nil, err
+			}
+			continue
+		}
+		data := make([]byte, end-start+1)
+		var n int
+		n, err = io.ReadFull(reader, data)
+		reader.Close()
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = fmt.Errorf("Got %d bytes for range %d-%d, expected %d",
+				n, start, end, end-start+1)
+		}
+		if err == nil {
+			return data, nil
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return nil, err
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// algorithms returns the list of digest algorithms to calculate
+// on the download.
+func (client *S3Download) algorithms() []string {
+	algs := make([]string, 0)
+	if client.CalculateMd5 {
+		algs = append(algs, constants.AlgMd5)
+	}
+	if client.CalculateSha256 {
+		algs = append(algs, constants.AlgSha256)
+	}
+	for _, alg := range client.Algorithms {
+		if !util.StringListContains(algs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
@@ -1,14 +1,27 @@
 package network_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // A copy of the test file, virginia.edu.uva-lib_2278801.tar,
@@ -119,3 +132,220 @@ func TestFetchWithChecksums(t *testing.T) {
 	assert.Equal(t, testFileMd5, download.Md5Digest)
 	assert.Equal(t, testFileSha256, download.Sha256Digest)
 }
+
+// rangedTestData is 1000 bytes that aren't the same in every range,
+// so we'll notice if ranges are written out of order.
+func rangedTestData() []byte {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func rangeGetterFor(data []byte) network.RangeGetter {
+	return func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data[start : end+1])), nil
+	}
+}
+
+func TestCopyRanges(t *testing.T) {
+	data := rangedTestData()
+	for _, partSize := range []int64{1, 7, 100, 1000, 5000} {
+		for _, concurrency := range []int{1, 3, 16} {
+			buf := &bytes.Buffer{}
+			n, err := network.CopyRanges(context.Background(), buf, int64(len(data)), partSize, concurrency, rangeGetterFor(data))
+			require.Nil(t, err)
+			assert.Equal(t, int64(len(data)), n)
+			assert.Equal(t, data, buf.Bytes(), "partSize %d, concurrency %d", partSize, concurrency)
+		}
+	}
+
+	// Empty object
+	buf := &bytes.Buffer{}
+	n, err := network.CopyRanges(context.Background(), buf, 0, 100, 4, rangeGetterFor(data))
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestCopyRangesLimitsConcurrency(t *testing.T) {
+	data := rangedTestData()
+	var mutex sync.Mutex
+	active, maxActive := 0, 0
+	getRange := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+		}()
+		return ioutil.NopCloser(bytes.NewReader(data[start : end+1])), nil
+	}
+	_, err := network.CopyRanges(context.Background(), ioutil.Discard, int64(len(data)), 10, 4, getRange)
+	require.Nil(t, err)
+	assert.True(t, maxActive <= 4, "Had %d ranges in flight", maxActive)
+}
+
+func TestCopyRangesErrors(t *testing.T) {
+	data := rangedTestData()
+	var mutex sync.Mutex
+	attempts := make(map[int64]int)
+	failing := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		mutex.Lock()
+		attempts[start]++
+		mutex.Unlock()
+		if start >= 500 {
+			return nil, fmt.Errorf("connection reset by peer")
+		}
+		return ioutil.NopCloser(bytes.NewReader(data[start : end+1])), nil
+	}
+	buf := &bytes.Buffer{}
+	n, err := network.CopyRanges(context.Background(), buf, int64(len(data)), 100, 3, failing)
+	require.NotNil(t, err)
+	assert.Equal(t, "connection reset by peer", err.Error())
+	assert.True(t, n <= 500)
+	assert.Equal(t, data[:n], buf.Bytes())
+	mutex.Lock()
+	maxAttempts := 0
+	for _, count := range attempts {
+		if count > maxAttempts {
+			maxAttempts = count
+		}
+	}
+	mutex.Unlock()
+	assert.Equal(t, 5, maxAttempts, "The failed range should get several tries")
+
+	short := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data[start:end])), nil
+	}
+	_, err = network.CopyRanges(context.Background(), ioutil.Discard, int64(len(data)), 100, 3, short)
+	require.NotNil(t, err)
+	assert.Regexp(t, `^Got 99 bytes for range \d+-\d+, expected 100$`, err.Error())
+
+	// Don't retry ranges of an object that's gone or has changed.
+	for _, rangeErr := range []error{network.ErrNotFound, network.ErrETagMismatch} {
+		tries := 0
+		gone := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+			tries++
+			return nil, rangeErr
+		}
+		_, err = network.CopyRanges(context.Background(), ioutil.Discard, int64(len(data)), 1000, 1, gone)
+		assert.Equal(t, rangeErr, err)
+		assert.Equal(t, 1, tries)
+	}
+}
+
+// When one range fails, CopyRanges should cancel the others,
+// rather than wait for them.
+func TestCopyRangesCancelsOnError(t *testing.T) {
+	data := rangedTestData()
+	getRange := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+		if start == 100 {
+			return nil, network.ErrETagMismatch
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	done := make(chan error)
+	go func() {
+		_, err := network.CopyRanges(context.Background(), ioutil.Discard, int64(len(data)), 100, 3, getRange)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, network.ErrETagMismatch, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "CopyRanges waited for ranges after one failed")
+	}
+
+	// Cancelling the caller's context stops the copy, too.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := network.CopyRanges(ctx, ioutil.Discard, int64(len(data)), 100, 3, getRange)
+	assert.Equal(t, context.Canceled, err)
+}
+
+// fakeS3Server serves HEAD and ranged GET requests for a single
+// object, the way S3 does with path-style addressing.
+func fakeS3Server(bucket, key string, data []byte) *httptest.Server {
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(data))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+bucket+"/"+key {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		start, end := 0, len(data)-1
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			bounds := strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), "-")
+			start, _ = strconv.Atoi(bounds[0])
+			end, _ = strconv.Atoi(bounds[1])
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		w.Write(data[start : end+1])
+	}))
+}
+
+func TestFetchRanges(t *testing.T) {
+	data := rangedTestData()
+	server := fakeS3Server("bucket", "file.tar", data)
+	defer server.Close()
+	tmpDir, err := ioutil.TempDir("", "s3_download_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	download := network.NewS3Download("key", "secret", constants.AWSVirginia,
+		"bucket", "file.tar", filepath.Join(tmpDir, "file.tar"), true, true)
+	download.Endpoint = server.URL
+	download.Concurrency = 4
+	download.PartSize = 64
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+	assert.Equal(t, int64(len(data)), download.BytesCopied)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), download.Md5Digest)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(data)), download.Sha256Digest)
+	require.NotNil(t, download.Response)
+	assert.Equal(t, int64(len(data)), *download.Response.ContentLength)
+	saved, err := ioutil.ReadFile(download.LocalPath)
+	require.Nil(t, err)
+	assert.Equal(t, data, saved)
+
+	// Download to a Writer instead of LocalPath
+	buf := &bytes.Buffer{}
+	download = network.NewS3Download("key", "secret", constants.AWSVirginia,
+		"bucket", "file.tar", "", true, false)
+	download.Endpoint = server.URL
+	download.Concurrency = 3
+	download.PartSize = 300
+	download.Writer = buf
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+	assert.Equal(t, data, buf.Bytes())
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), download.Md5Digest)
+	assert.Empty(t, download.Sha256Digest)
+
+	// Missing object
+	download = network.NewS3Download("key", "secret", constants.AWSVirginia,
+		"bucket", "no-such-file", os.DevNull, true, false)
+	download.Endpoint = server.URL
+	download.Concurrency = 3
+	download.Fetch()
+	assert.NotEmpty(t, download.ErrorMessage)
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/util"
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,6 +20,8 @@ type S3Head struct {
 	session         *session.Session
 	accessKeyId     string
 	secretAccessKey string
+
+	ctx context.Context
 }
 
 // Contains info parsed from x-amz-restore header,
@@ -70,6 +73,24 @@ func (client *S3Head) SetSessionEndpoint(url string) {
 	session.Config.Endpoint = &url
 }
 
+// WithContext returns a copy of the client whose HEAD request is
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *S3Head) WithContext(ctx context.Context) *S3Head {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *S3Head) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Head sends a HEAD request to S3 for the specified key.
 // After calling this, check client.ErrorMessage and client.Response,
 // which contains a HeadObjectOutput struct. See the docs here:
@@ -78,6 +99,7 @@ func (client *S3Head) SetSessionEndpoint(url string) {
 // The most relevant items for us in the HeadObjectOutput struct are
 // ContentLength, ContentType, LastModified, Metadata, and VersionId.
 func (client *S3Head) Head(key string) {
+	ctx := client.context()
 	client.Response = nil
 	client.ErrorMessage = ""
 	_session := client.GetSession()
@@ -98,6 +120,7 @@ func (client *S3Head) Head(key string) {
 	}
 	client.input = params
 	request, response := service.HeadObjectRequest(params)
+	request.SetContext(ctx)
 	err := request.Send()
 	if err != nil {
 		client.ErrorMessage = err.Error()
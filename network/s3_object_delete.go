@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -19,6 +20,8 @@ type S3ObjectDelete struct {
 	session         *session.Session
 	accessKeyId     string
 	secretAccessKey string
+
+	ctx context.Context
 }
 
 // NewS3ObjectDelete returns a new S3ObjectDelete object. Params:
@@ -64,6 +67,24 @@ func (client *S3ObjectDelete) GetSession() *session.Session {
 	return client.session
 }
 
+// WithContext returns a copy of the client whose delete request is
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *S3ObjectDelete) WithContext(ctx context.Context) *S3ObjectDelete {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *S3ObjectDelete) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // DeleteList deletes the list of keys you specified. Check
 // s3ObjectDelete.ErrorMessage afterward to see if anything failed. Detailed
 // errors will be in s3ObjectDelete.Response.Errors. The S3 Error type is
@@ -73,6 +94,7 @@ func (client *S3ObjectDelete) GetSession() *session.Session {
 // get an error, and those keys will be shown as deleted in
 // s3ObjectDelete.Response.Deleted. That's AWS' design decision.
 func (client *S3ObjectDelete) DeleteList() {
+	ctx := client.context()
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -80,9 +102,10 @@ func (client *S3ObjectDelete) DeleteList() {
 	var err error = nil
 	service := s3.New(_session)
 
-	client.Response, err = service.DeleteObjects(client.DeleteObjectsInput)
+	client.Response, err = service.DeleteObjectsWithContext(ctx, client.DeleteObjectsInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
+		return
 	}
 	for _, err := range client.Response.Errors {
 		key := "<nil>"
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -15,6 +16,8 @@ type S3ObjectList struct {
 	session         *session.Session
 	accessKeyId     string
 	secretAccessKey string
+
+	ctx context.Context
 }
 
 // NewS3ObjectList returns an object that will list items in an
@@ -51,6 +54,24 @@ func (client *S3ObjectList) GetSession() *session.Session {
 	return client.session
 }
 
+// WithContext returns a copy of the client whose list request is
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *S3ObjectList) WithContext(ctx context.Context) *S3ObjectList {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *S3ObjectList) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Returns a list of objects from this S3 bucket.
 // If param prefix is not an empty string, this returns
 // only keys with the specified prefix.
@@ -58,6 +79,7 @@ func (client *S3ObjectList) GetSession() *session.Session {
 // you got the complete list. If not, keep calling
 // GetList until IsTruncated == false.
 func (client *S3ObjectList) GetList(prefix string) {
+	ctx := client.context()
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -80,7 +102,7 @@ func (client *S3ObjectList) GetList(prefix string) {
 	if prefix != "" {
 		client.ListObjectsInput.Prefix = &prefix
 	}
-	client.Response, err = service.ListObjects(client.ListObjectsInput)
+	client.Response, err = service.ListObjectsWithContext(ctx, client.ListObjectsInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -27,6 +28,8 @@ type S3Restore struct {
 	// TestURL is the URL of a mock S3 server
 	// for use in unit tests only.
 	TestURL string
+
+	ctx context.Context
 }
 
 // Sets up as S3 restore request, which is for S3 items
@@ -101,8 +104,27 @@ func (client *S3Restore) getTestSession() {
 	}
 }
 
+// WithContext returns a copy of the client whose restore request is
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *S3Restore) WithContext(ctx context.Context) *S3Restore {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *S3Restore) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Restore the archived file from Glacier to S3.
 func (client *S3Restore) Restore() {
+	ctx := client.context()
 	client.Response = nil
 	client.ErrorMessage = ""
 	client.RestoreAlreadyInProgress = false
@@ -124,7 +146,7 @@ func (client *S3Restore) Restore() {
 			},
 		},
 	}
-	resp, err := service.RestoreObject(params)
+	resp, err := service.RestoreObjectWithContext(ctx, params)
 	client.Response = resp
 	client.checkError(err)
 }
@@ -9,14 +9,27 @@ import (
 
 // Returns an S3 session for this objectList.
 func GetS3Session(awsRegion, accessKeyId, secretAccessKey string) (*session.Session, error) {
+	return GetS3SessionWithEndpoint(awsRegion, accessKeyId, secretAccessKey, "")
+}
+
+// GetS3SessionWithEndpoint returns an S3 session that talks to the
+// specified endpoint instead of AWS. This is for S3-compatible services
+// such as MinIO, which expect path-style bucket addressing. If endpoint
+// is empty, this returns a normal AWS session.
+func GetS3SessionWithEndpoint(awsRegion, accessKeyId, secretAccessKey, endpoint string) (*session.Session, error) {
 	creds := credentials.NewEnvCredentials()
 	if accessKeyId != "" && secretAccessKey != "" {
 		creds = credentials.NewStaticCredentials(accessKeyId, secretAccessKey, "")
 	}
-	_session := session.New(&aws.Config{
+	config := &aws.Config{
 		Region:      aws.String(awsRegion),
 		Credentials: creds,
-	})
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	_session := session.New(config)
 	if _session == nil {
 		return nil, fmt.Errorf("AWS Session returned nil")
 	}
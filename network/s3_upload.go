@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io"
@@ -36,6 +37,8 @@ type S3Upload struct {
 	secretAccessKey string
 	partSize        int64
 	concurrency     int
+
+	ctx context.Context
 }
 
 // S3_MIN_CHUNK_SIZE is the minimum chunk size that aws-go-sdk
@@ -104,6 +107,24 @@ func (client *S3Upload) AddMetadata(key, value string) {
 	client.UploadInput.Metadata[key] = &value
 }
 
+// WithContext returns a copy of the client whose upload is
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *S3Upload) WithContext(ctx context.Context) *S3Upload {
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *S3Upload) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Upload a file to S3. If ErrorMessage == "", the upload succeeded.
 // Check S3Upload.Response.Localtion for the item's S3 URL.
 // Caller is responsible for closing the reader.
@@ -117,6 +138,7 @@ func (client *S3Upload) AddMetadata(key, value string) {
 // crash due to lack of memory. (Esp. when we're dealing with 1TB files.)
 // See apt_storer for an example.
 func (client *S3Upload) Send(reader io.Reader) {
+	ctx := client.context()
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -124,7 +146,7 @@ func (client *S3Upload) Send(reader io.Reader) {
 	uploader := s3manager.NewUploader(_session)
 	client.UploadInput.Body = reader
 	var err error
-	client.Response, err = uploader.Upload(client.UploadInput)
+	client.Response, err = uploader.UploadWithContext(ctx, client.UploadInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
@@ -143,6 +165,7 @@ func (client *S3Upload) Send(reader io.Reader) {
 // PT #148913619
 // https://www.pivotaltracker.com/story/show/148913619
 func (client *S3Upload) SendWithSize(reader io.Reader, fileSize int64) {
+	ctx := client.context()
 	chunkSize := (fileSize + int64(1000000)) / int64(10000)
 	if chunkSize < BIG_CHUNK_SIZE {
 		chunkSize = BIG_CHUNK_SIZE
@@ -171,7 +194,7 @@ func (client *S3Upload) SendWithSize(reader io.Reader, fileSize int64) {
 
 	client.UploadInput.Body = reader
 	var err error
-	client.Response, err = uploader.Upload(client.UploadInput)
+	client.Response, err = uploader.UploadWithContext(ctx, client.UploadInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
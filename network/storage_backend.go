@@ -0,0 +1,299 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/util/fileutil"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is the error a StorageBackend returns when the requested
+// object does not exist. The message matches the error code S3 returns,
+// so callers can check for either with IsNotFound.
+var ErrNotFound = errors.New("NoSuchKey: The specified key does not exist.")
+
+// ErrNoSuchUpload is the error a StorageBackend returns when a
+// multipart upload does not exist, because it was completed, aborted
+// or expired. As with ErrNotFound, the message matches S3's error code.
+var ErrNoSuchUpload = errors.New("NoSuchUpload: The specified upload does not exist.")
+
+// ErrETagMismatch is the error a StorageBackend returns when GetRange
+// is asked for a version of an object that is no longer there. As with
+// ErrNotFound, the message matches S3's error code.
+var ErrETagMismatch = errors.New("PreconditionFailed: At least one of the pre-conditions you specified did not hold")
+
+// MaxUploadParts is the most parts S3 allows in a multipart upload.
+const MaxUploadParts = int64(10000)
+
+// StorageBackend describes the storage operations our workers perform
+// on preservation storage and restoration buckets. S3Backend implements
+// this for S3, Glacier and S3-compatible services like MinIO. LocalBackend
+// implements it on the local file system, for development and testing.
+type StorageBackend interface {
+	// Put stores the contents of reader at bucket/key with the
+	// specified content type and metadata, and returns the URL of
+	// the stored object. Param size is the number of bytes in reader,
+	// or zero if unknown.
+	Put(bucket, key, contentType string, metadata map[string]string, reader io.Reader, size int64) (string, error)
+
+	// Get returns a reader for the object at bucket/key. The caller
+	// is responsible for closing it.
+	Get(bucket, key string) (io.ReadCloser, error)
+
+	// GetRange returns a reader for length bytes of the object at
+	// bucket/key, starting at offset. The caller is responsible
+	// for closing it. If etag is not empty and the object's ETag
+	// is different, GetRange returns ErrETagMismatch, so a download
+	// in ranges can't mix pieces of different versions of an object.
+	GetRange(bucket, key string, offset, length int64, etag string) (io.ReadCloser, error)
+
+	// Head returns information about the object at bucket/key,
+	// without its contents.
+	Head(bucket, key string) (*StorageObject, error)
+
+	// Delete deletes the specified keys from bucket. Deleting a key
+	// that does not exist is not an error.
+	Delete(bucket string, keys ...string) error
+
+	// List returns up to maxKeys objects from bucket whose keys begin
+	// with prefix, in key order. If maxKeys is zero, the backend
+	// decides how many keys to return.
+	List(bucket, prefix string, maxKeys int64) ([]*StorageObject, error)
+
+	// RequestRestore asks the backend to restore an archived object
+	// (e.g. from Glacier) so it can be downloaded.
+	RequestRestore(bucket, key, tier string, days int64) (*RestoreStatus, error)
+
+	// CreateMultipartUpload starts a multipart upload to bucket/key
+	// and returns the upload id.
+	CreateMultipartUpload(bucket, key, contentType string, metadata map[string]string) (string, error)
+
+	// UploadPart sends size bytes from reader as part number partNumber
+	// of the specified upload, and returns the part's ETag. Part numbers
+	// start at one. Uploading the same part number twice replaces the
+	// earlier part.
+	UploadPart(bucket, key, uploadId string, partNumber int64, reader io.ReadSeeker, size int64) (string, error)
+
+	// CompleteMultipartUpload assembles parts into a single object
+	// at bucket/key and returns the object's URL.
+	CompleteMultipartUpload(bucket, key, uploadId string, parts []*models.UploadPart) (string, error)
+
+	// AbortMultipartUpload discards the specified upload and its parts.
+	AbortMultipartUpload(bucket, key, uploadId string) error
+
+	// ListMultipartUploads returns the multipart uploads in progress
+	// in bucket whose keys begin with prefix.
+	ListMultipartUploads(bucket, prefix string) ([]*MultipartUploadInfo, error)
+
+	// WithContext returns a copy of the backend whose operations stop
+	// when ctx is cancelled or its deadline passes. That includes
+	// reading from the readers that Get and GetRange return. If ctx
+	// is nil, the copy uses context.Background().
+	WithContext(ctx context.Context) StorageBackend
+
+	// Context returns the backend's context, which is
+	// context.Background() unless the backend came from WithContext.
+	Context() context.Context
+}
+
+// StorageObject describes an object in a StorageBackend.
+type StorageObject struct {
+	Bucket       string
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+	// Metadata keys are always lowercase, e.g. "institution", "md5".
+	Metadata map[string]string
+	// Restore describes the status of any pending or completed
+	// request to restore this object from archival storage.
+	// This may be nil.
+	Restore *RestoreRequestInfo
+}
+
+// MultipartUploadInfo describes a multipart upload in progress.
+type MultipartUploadInfo struct {
+	Bucket    string
+	Key       string
+	UploadId  string
+	Initiated time.Time
+}
+
+// RestoreStatus describes the backend's response to a RequestRestore call.
+type RestoreStatus struct {
+	Accepted            bool
+	AlreadyInProgress   bool
+	AlreadyInActiveTier bool
+	ServiceUnavailable  bool
+}
+
+// IsNotFound returns true if err indicates that a storage object
+// does not exist.
+func IsNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrNotFound ||
+		strings.Contains(err.Error(), "NoSuchKey") ||
+		strings.Contains(err.Error(), "NotFound")
+}
+
+// IsETagMismatch returns true if err indicates that a storage object
+// changed while we were downloading it.
+func IsETagMismatch(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrETagMismatch || strings.Contains(err.Error(), "PreconditionFailed")
+}
+
+// IsNoSuchUpload returns true if err indicates that a multipart
+// upload does not exist.
+func IsNoSuchUpload(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrNoSuchUpload || strings.Contains(err.Error(), "NoSuchUpload")
+}
+
+// MultipartPartSize returns the part size to use for a multipart
+// upload of fileSize bytes. That's BIG_CHUNK_SIZE, unless the file
+// is so big that it would need more than MaxUploadParts parts.
+func MultipartPartSize(fileSize int64) int64 {
+	partSize := (fileSize + MaxUploadParts - 1) / MaxUploadParts
+	if partSize < BIG_CHUNK_SIZE {
+		partSize = BIG_CHUNK_SIZE
+	}
+	return partSize
+}
+
+// DownloadOptions says how DownloadFromStorage fetches an object.
+type DownloadOptions struct {
+	// Concurrency is the number of byte ranges to fetch at once.
+	// If this is greater than one, we fetch the object in ranges
+	// of PartSize bytes, using the backend's GetRange. Zero or one
+	// means download in a single stream.
+	Concurrency int
+	// PartSize is the size of each byte range. Defaults to
+	// DOWNLOAD_PART_SIZE.
+	PartSize int64
+}
+
+// NewDownloadOptions returns the DownloadOptions described by
+// workerConfig's DownloadConcurrency and DownloadPartSize.
+func NewDownloadOptions(workerConfig models.WorkerConfig) DownloadOptions {
+	return DownloadOptions{
+		Concurrency: workerConfig.DownloadConcurrency,
+		PartSize:    workerConfig.DownloadPartSize,
+	}
+}
+
+// DownloadFromStorage copies the object at bucket/key to localPath,
+// calculating digests for the specified algorithms as it goes. If
+// localPath is os.DevNull, this discards the data and just calculates
+// digests, which is what we want for fixity checks. Returns the number
+// of bytes copied and a map of algorithm name to digest.
+//
+// If options.Concurrency is greater than one, this fetches byte
+// ranges in parallel, and writes them out in order, so we still
+// calculate digests in a single pass. That's much faster for the
+// multi-gigabyte files that restore and fixity checking often see.
+//
+// Like S3Download, this tries the download several times. On larger
+// files, it's common to get a "connection reset by peer" error, and
+// we'd rather just try again now than requeue the whole job. It stops
+// trying once the backend's context is done.
+func DownloadFromStorage(backend StorageBackend, bucket, key, localPath string, algorithms []string, options DownloadOptions) (int64, map[string]string, error) {
+	return downloadFromStorage(backend, bucket, key, localPath, algorithms, options, 5)
+}
+
+// DownloadFromStorageWithRetries is the same as DownloadFromStorage
+// with a single stream, but it lets the caller decide how many times
+// to try. Very large bags coming from the receiving buckets sometimes
+// need more attempts. Missing objects are never retried.
+func DownloadFromStorageWithRetries(backend StorageBackend, bucket, key, localPath string, algorithms []string, attempts int) (int64, map[string]string, error) {
+	return downloadFromStorage(backend, bucket, key, localPath, algorithms, DownloadOptions{}, attempts)
+}
+
+func downloadFromStorage(backend StorageBackend, bucket, key, localPath string, algorithms []string, options DownloadOptions, attempts int) (int64, map[string]string, error) {
+	var err error
+	var bytesCopied int64
+	var digests map[string]string
+	for i := 0; i < attempts; i++ {
+		bytesCopied, digests, err = tryDownloadFromStorage(backend, bucket, key, localPath, algorithms, options)
+		if err == nil || IsNotFound(err) || backend.Context().Err() != nil {
+			break
+		}
+	}
+	return bytesCopied, digests, err
+}
+
+func tryDownloadFromStorage(backend StorageBackend, bucket, key, localPath string, algorithms []string, options DownloadOptions) (int64, map[string]string, error) {
+	hashes, err := fileutil.NewHashes(algorithms)
+	if err != nil {
+		return 0, nil, err
+	}
+	// With ranges, we need the object's size and ETag up front.
+	// Getting them before we create the output file also means
+	// a missing object doesn't leave an empty file behind.
+	var obj *StorageObject
+	if options.Concurrency > 1 {
+		obj, err = backend.Head(bucket, key)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	var reader io.ReadCloser
+	if options.Concurrency <= 1 {
+		reader, err = backend.Get(bucket, key)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer reader.Close()
+	}
+	writers := fileutil.HashWriters(hashes)
+	if localPath == os.DevNull {
+		writers = append(writers, ioutil.Discard)
+	} else {
+		err = os.MkdirAll(filepath.Dir(localPath), 0755)
+		if err != nil {
+			return 0, nil, err
+		}
+		outputFile, err := os.Create(localPath)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer outputFile.Close()
+		writers = append(writers, outputFile)
+	}
+	var bytesCopied int64
+	if reader != nil {
+		bytesCopied, err = io.Copy(io.MultiWriter(writers...), reader)
+	} else {
+		getRange := func(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+			return backend.WithContext(ctx).GetRange(bucket, key, start, end-start+1, obj.ETag)
+		}
+		bytesCopied, err = CopyRanges(backend.Context(), io.MultiWriter(writers...), obj.Size,
+			options.PartSize, options.Concurrency, getRange)
+		if err == nil && bytesCopied != obj.Size {
+			err = fmt.Errorf("Downloaded %d bytes of %s/%s, but storage says it has %d",
+				bytesCopied, bucket, key, obj.Size)
+		}
+	}
+	if err != nil {
+		return bytesCopied, nil, err
+	}
+	return bytesCopied, fileutil.HexDigests(hashes), nil
+}
+
+// Make sure our backends implement the interface.
+var _ StorageBackend = (*S3Backend)(nil)
+var _ StorageBackend = (*LocalBackend)(nil)
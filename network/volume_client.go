@@ -1,13 +1,16 @@
 package network
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/APTrust/exchange/metrics"
 	"github.com/APTrust/exchange/models"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +22,7 @@ import (
 // will likely cause other worker tasks to fail due to lack of disk space.
 type VolumeClient struct {
 	serviceUrl string
+	ctx        context.Context
 }
 
 // NewVolumeClient returns a new VolumeClient. Param port is
@@ -37,6 +41,22 @@ func (client *VolumeClient) BaseURL() string {
 	return client.serviceUrl
 }
 
+// WithContext returns a copy of the client whose requests are
+// aborted when ctx is cancelled or its deadline passes. If ctx
+// is nil, the copy uses context.Background().
+func (client *VolumeClient) WithContext(ctx context.Context) *VolumeClient {
+	return &VolumeClient{serviceUrl: client.serviceUrl, ctx: ctx}
+}
+
+// context returns the client's context, which is
+// context.Background() unless the client came from WithContext.
+func (client *VolumeClient) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
 // Ping sends a message to the VolumeService to see if it's running.
 // If the service isn't running, you'll get an error. Otherwise,
 // in the immortal words of Judge Spaulding Smails,
@@ -47,7 +67,14 @@ func (client *VolumeClient) Ping(msTimeout int) error {
 	httpClient := http.Client{
 		Timeout: timeout,
 	}
-	_, err := httpClient.Get(pingUrl)
+	req, err := http.NewRequestWithContext(client.context(), http.MethodGet, pingUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
 	return err
 }
 
@@ -66,7 +93,16 @@ func (client *VolumeClient) Reserve(path string, bytes uint64) (bool, error) {
 		"path":  {path},
 		"bytes": {strconv.FormatUint(bytes, 10)},
 	}
-	return client.doRequest(reserveUrl, params)
+	ok, err := client.doRequest(reserveUrl, params)
+	if err != nil {
+		metrics.VolumeReservations.Inc("error")
+	} else if ok {
+		metrics.VolumeReservations.Inc("granted")
+		metrics.VolumeReservedBytes.Add(float64(bytes))
+	} else {
+		metrics.VolumeReservations.Inc("denied")
+	}
+	return ok, err
 }
 
 // Release tells the VolumeService that you're done with whatever disk space
@@ -80,11 +116,21 @@ func (client *VolumeClient) Release(path string) error {
 		"path": {path},
 	}
 	_, err := client.doRequest(releaseUrl, params)
+	if err != nil {
+		metrics.VolumeReleases.Inc("error")
+	} else {
+		metrics.VolumeReleases.Inc("ok")
+	}
 	return err
 }
 
 func (client *VolumeClient) doRequest(url string, params url.Values) (bool, error) {
-	resp, err := http.PostForm(url, params)
+	req, err := http.NewRequestWithContext(client.context(), http.MethodPost, url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return false, err
 	}
@@ -113,7 +159,11 @@ func (client *VolumeClient) Report(path string) (map[string]uint64, error) {
 		return nil, fmt.Errorf("Path cannot be empty.")
 	}
 	reportUrl := fmt.Sprintf("%s/report/?path=%s", client.serviceUrl, path)
-	resp, err := http.Get(reportUrl)
+	req, err := http.NewRequestWithContext(client.context(), http.MethodGet, reportUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/APTrust/exchange/partner_apps/common"
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/APTrust/exchange/validation"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	opts := parseCommandLine()
+	conf := loadConfig(opts.pathToConfigFile)
+	bagger := makeBagger(opts)
+	tarFilePath, err := bagger.Build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not build bag: ", err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	fmt.Println("Wrote bag to", tarFilePath)
+
+	validator, err := validation.NewValidator(tarFilePath, conf, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating validator: ", err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	summary, err := validator.Validate()
+	cleanup(validator.DBName())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "The validator encountered an error: ", err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	if summary.HasErrors() {
+		fmt.Println("Bag is not valid")
+		fmt.Println(summary.AllErrorsAsString())
+		os.Exit(common.EXIT_BAG_INVALID)
+	}
+	fmt.Println("Bag is valid")
+	os.Exit(common.EXIT_OK)
+}
+
+// loadConfig loads the bag validation config that we check
+// the new bag against.
+func loadConfig(pathToConfigFile string) *validation.BagValidationConfig {
+	configAbsPath, err := filepath.Abs(pathToConfigFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	conf, errors := validation.LoadBagValidationConfig(configAbsPath)
+	if errors != nil && len(errors) > 0 {
+		fmt.Fprintln(os.Stderr, "Could not load bag validation config: ", errors[0])
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	return conf
+}
+
+// makeBagger returns a Bagger with the tags from the template, if
+// there is one, and the command line. Tags on the command line
+// override tags in the template.
+func makeBagger(opts *options) *common.Bagger {
+	sourceDir, err := filepath.Abs(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	bagName := opts.bagName
+	if bagName == "" {
+		bagName = filepath.Base(sourceDir)
+	}
+	bagger := common.NewBagger(sourceDir, opts.outputDir, bagName)
+	if opts.pathToTemplate != "" {
+		err = bagger.LoadTemplate(opts.pathToTemplate)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(common.EXIT_USER_ERR)
+		}
+	}
+	setTagIfNotEmpty(bagger, "aptrust-info.txt", "Title", opts.title)
+	setTagIfNotEmpty(bagger, "aptrust-info.txt", "Access", opts.access)
+	setTagIfNotEmpty(bagger, "aptrust-info.txt", "Description", opts.description)
+	setTagIfNotEmpty(bagger, "aptrust-info.txt", "Storage-Option", opts.storageOption)
+	setTagIfNotEmpty(bagger, "bag-info.txt", "Source-Organization", opts.sourceOrganization)
+	setTagIfNotEmpty(bagger, "bag-info.txt", "Bag-Group-Identifier", opts.bagGroupIdentifier)
+	setTagIfNotEmpty(bagger, "bag-info.txt", "Internal-Sender-Identifier", opts.internalSenderIdentifier)
+	setTagIfNotEmpty(bagger, "bag-info.txt", "Internal-Sender-Description", opts.internalSenderDescription)
+	if bagger.Tags["aptrust-info.txt"]["Title"] == "" || bagger.Tags["aptrust-info.txt"]["Access"] == "" {
+		fmt.Fprintln(os.Stderr, "Bag needs a Title and Access. Set them with --title and "+
+			"--access, or in the template.")
+		os.Exit(common.EXIT_USER_ERR)
+	}
+	return bagger
+}
+
+func setTagIfNotEmpty(bagger *common.Bagger, tagFile, label, value string) {
+	if value != "" {
+		bagger.SetTag(tagFile, label, value)
+	}
+}
+
+func cleanup(filePath string) {
+	if fileutil.LooksSafeToDelete(filePath, 12, 3) {
+		os.Remove(filePath)
+	}
+}
+
+type options struct {
+	pathToConfigFile          string
+	pathToTemplate            string
+	outputDir                 string
+	bagName                   string
+	title                     string
+	access                    string
+	description               string
+	storageOption             string
+	sourceOrganization        string
+	bagGroupIdentifier        string
+	internalSenderIdentifier  string
+	internalSenderDescription string
+}
+
+func parseCommandLine() *options {
+	var help bool
+	var version bool
+	opts := &options{}
+	flag.StringVar(&opts.pathToConfigFile, "config", "", "Path to bag validation config file")
+	flag.StringVar(&opts.pathToTemplate, "template", "", "Path to JSON file with tag values")
+	flag.StringVar(&opts.outputDir, "dir", ".", "Directory in which to write the tarred bag")
+	flag.StringVar(&opts.bagName, "name", "", "Bag name, e.g. virginia.edu.my_bag")
+	flag.StringVar(&opts.title, "title", "", "Title for aptrust-info.txt")
+	flag.StringVar(&opts.access, "access", "", "Access for aptrust-info.txt: Consortia, Institution or Restricted")
+	flag.StringVar(&opts.description, "description", "", "Description for aptrust-info.txt")
+	flag.StringVar(&opts.storageOption, "storage-option", "", "Storage-Option for aptrust-info.txt")
+	flag.StringVar(&opts.sourceOrganization, "source-organization", "", "Source-Organization for bag-info.txt")
+	flag.StringVar(&opts.bagGroupIdentifier, "bag-group-identifier", "", "Bag-Group-Identifier for bag-info.txt")
+	flag.StringVar(&opts.internalSenderIdentifier, "internal-sender-identifier", "", "Internal-Sender-Identifier for bag-info.txt")
+	flag.StringVar(&opts.internalSenderDescription, "internal-sender-description", "", "Internal-Sender-Description for bag-info.txt")
+	flag.BoolVar(&help, "help", false, "Show help")
+	flag.BoolVar(&version, "version", false, "Show version")
+
+	flag.Parse()
+
+	if version {
+		fmt.Println(common.GetVersion())
+		os.Exit(common.EXIT_NO_OP)
+	}
+	if help || opts.pathToConfigFile == "" || flag.Arg(0) == "" {
+		printUsage()
+		os.Exit(common.EXIT_USER_ERR)
+	}
+	return opts
+}
+
+// Tell the user about the program.
+func printUsage() {
+	message := `
+apt_bag builds a tarred APTrust bag from the files in a directory, and
+validates it.
+
+Usage:
+
+apt_bag --config=<config_file> \
+        [--template=<template_file>] \
+        [--dir=<output_dir>] \
+        [--name=<bag_name>] \
+        [--title=<title>] \
+        [--access=<Consortia|Institution|Restricted>] \
+        [--description=<description>] \
+        [--storage-option=<storage_option>] \
+        [--source-organization=<org>] \
+        [--bag-group-identifier=<id>] \
+        [--internal-sender-identifier=<id>] \
+        [--internal-sender-description=<description>] \
+        path_to_directory
+
+apt_bag --help
+apt_bag --version
+
+Options
+
+--access sets Access in aptrust-info.txt. It must be Consortia,
+Institution or Restricted. The bag must have an Access tag, from
+this option or from the template.
+
+--bag-group-identifier, --internal-sender-description,
+--internal-sender-identifier and --source-organization set the tags
+of the same names in bag-info.txt.
+
+--config should be the path to a bag validation config file that
+describes the validation rules. apt_bag validates the bag against it
+after building it. Use the aptrust_bag_validation_config.json file that
+comes with apt_bag. It's the same one APTrust uses during ingest.
+
+--description sets Description in aptrust-info.txt.
+
+--dir is the directory in which to write the tarred bag. It defaults
+to the current directory.
+
+--help prints this help message and exits.
+
+--name is the name of the bag. The bag is written to <name>.tar, and
+untars into a directory called <name>. It defaults to the name of the
+directory you're bagging. APTrust bag names start with your
+institution's domain name, e.g. virginia.edu.my_bag.
+
+--storage-option sets Storage-Option in aptrust-info.txt, e.g. Standard
+or Glacier-OH. If the bag doesn't have one, APTrust uses Standard.
+
+--template is the path to a JSON file that sets tags in bag-info.txt,
+aptrust-info.txt and any other tag files you want to add. Options on
+the command line override tags in the template. For example:
+
+{
+  "bag-info.txt": {
+    "Source-Organization": "University of Virginia"
+  },
+  "aptrust-info.txt": {
+    "Access": "Institution",
+    "Storage-Option": "Standard"
+  }
+}
+
+--title sets Title in aptrust-info.txt. The bag must have a Title, from
+this option or from the template.
+
+--version prints version info and exits.
+
+apt_bag always writes bagit.txt, md5 and sha256 manifests and tag
+manifests, and Bagging-Date and Payload-Oxum in bag-info.txt.
+
+Arguments
+
+The path_to_directory parameter is required. Everything in it goes into
+the bag's data directory.
+
+Exit codes:
+
+0 - Bag was built and is valid
+1 - Bag could not be built or validated, typically because of a problem
+	reading the config file or the files to bag, or writing the tar file.
+2 - Bag was built, but it is not valid.
+3 - Operation could not be completed due to usage error (e.g. missing params)
+
+`
+	fmt.Println(message)
+}
@@ -27,6 +27,8 @@ func main() {
 		true,
 		true,
 	)
+	client.Concurrency = opts.Concurrency
+	client.PartSize = opts.PartSize
 	client.Fetch()
 	result := common.NewDownloadResult(opts, client)
 	output := result.ToText()
@@ -67,6 +69,8 @@ func parseCommandLine() *common.Options {
 	var key string
 	var dir string
 	var outputFormat string
+	var concurrency int
+	var partSizeMB int64
 	var help bool
 	var version bool
 
@@ -76,6 +80,8 @@ func parseCommandLine() *common.Options {
 	flag.StringVar(&key, "key", "", "The key you want to fetch")
 	flag.StringVar(&dir, "dir", "", "Download file to this directory (default is current dir)")
 	flag.StringVar(&outputFormat, "format", "text", "Output format ('text' or 'json')")
+	flag.IntVar(&concurrency, "concurrency", 1, "Number of byte ranges to download at once")
+	flag.Int64Var(&partSizeMB, "part-size", 64, "Size, in megabytes, of each byte range when concurrency > 1")
 	flag.BoolVar(&help, "help", false, "Show help")
 	flag.BoolVar(&version, "version", false, "Show version")
 
@@ -97,6 +103,8 @@ func parseCommandLine() *common.Options {
 		Key:              key,
 		Dir:              dir,
 		OutputFormat:     outputFormat,
+		Concurrency:      concurrency,
+		PartSize:         partSizeMB * 1024 * 1024,
 	}
 
 	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
@@ -122,7 +130,9 @@ apt_download --key=<name/key of object to download> \
              [--config=<path to config file>] \
              [--region=<aws region to connect to>] \
 			 [--dir=<download the object to this dir>] \
-			 [--format=<'text' or 'json'>]
+			 [--format=<'text' or 'json'>] \
+			 [--concurrency=<number of ranges to download at once>] \
+			 [--part-size=<size of each range, in MB>]
 
 apt_download --help
 
@@ -143,6 +153,13 @@ If it can't find your AWS credentials, the download will fail.
   file. If you have no config file, or the restoration bucket isn't
   specified there, then you must specify the bucket on the command line.
 
+--concurrency is the number of byte ranges to download at once. The
+  default is 1, which downloads the file in a single stream. Larger
+  values can make downloads of very large files much faster. The
+  downloader still calculates md5 and sha256 checksums in one pass,
+  and checks that it received as many bytes as S3 says the file has.
+  It holds up to (concurrency + 1) ranges in memory at once.
+
 --config is the optional path to your APTrust partner config file.
   If you omit this, the downloader uses the config at
   ~/.aptrust_partner.conf (Mac/Linux) or %HOMEPATH%\.aptrust_partner.conf
@@ -166,6 +183,9 @@ If it can't find your AWS credentials, the download will fail.
 --key is the name of the item you want to download from S3. This param
   is required.
 
+--part-size is the size, in megabytes, of each byte range when
+  --concurrency is greater than 1. The default is 64.
+
 --region is the S3 region to connect to. This defaults to us-east-1. You
   generally should not have to set this for APTrust downloads,
   but you may set it on the command line to download non-APTrust
@@ -187,6 +207,10 @@ Examples:
 
    apt_download -key="my_bag.tar" -bucket="my.custom.bucket" -dir="/home/joy/downloads"
 
+3. Download a large item, eight 128MB ranges at a time.
+
+   apt_download -key="my_big_bag.tar" -concurrency=8 -part-size=128
+
 Exit codes:
 
 0 - Bag was successfully downloaded.
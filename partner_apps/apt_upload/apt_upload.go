@@ -8,7 +8,6 @@ import (
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/partner_apps/common"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 )
@@ -19,29 +18,27 @@ func main() {
 		fmt.Fprintln(os.Stderr, opts.AllErrorsAsString())
 		os.Exit(common.EXIT_USER_ERR)
 	}
-	uploadClient := network.NewS3Upload(
+	backend := network.NewS3Backend(
 		opts.AccessKeyId,
 		opts.SecretAccessKey,
 		opts.Region,
-		opts.Bucket,
-		opts.Key,
-		opts.ContentType)
-	filestat, err := os.Stat(opts.FileToUpload)
-	exitOnFileError(err)
-	filesize := int64(0)
-	if filestat != nil {
-		filesize = filestat.Size()
-	}
-	file, err := os.Open(opts.FileToUpload)
-	exitOnFileError(err)
-	defer file.Close()
-	if opts.Metadata != nil {
-		for key, value := range opts.Metadata {
-			uploadClient.AddMetadata(strings.ToLower(key), value)
+		"")
+	exitCode := common.EXIT_OK
+	for _, filePath := range opts.FilesToUpload {
+		fileOpts := *opts
+		fileOpts.FileToUpload = filePath
+		if fileOpts.Key == "" {
+			fileOpts.Key = filepath.Base(filePath)
+		}
+		uploader := common.NewUploader(backend, &fileOpts)
+		uploader.OnProgress = func(progress *common.UploadProgress) {
+			printProgress(opts, progress)
+		}
+		result := uploader.Upload()
+		if !printResult(opts, result) {
+			exitCode = common.EXIT_RUNTIME_ERR
 		}
 	}
-	uploadClient.Send(file)
-	exitCode := printResult(opts, uploadClient, filesize)
 	os.Exit(exitCode)
 }
 
@@ -55,15 +52,23 @@ func exitOnFileError(err error) {
 	}
 }
 
-// printResults prints the results of the upload to STDOUT.
-func printResult(opts *common.Options, uploadClient *network.S3Upload, filesize int64) int {
-	headClient := network.NewS3Head(
-		opts.AccessKeyId,
-		opts.SecretAccessKey,
-		opts.Region,
-		opts.Bucket)
-	headClient.Head(opts.Key)
-	result := common.NewUploadResult(opts, uploadClient, headClient, filesize)
+// printProgress prints a line to STDOUT each time S3 accepts a part.
+func printProgress(opts *common.Options, progress *common.UploadProgress) {
+	output := progress.ToText()
+	if opts.OutputFormat == "json" {
+		var err error
+		output, err = progress.ToJson()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+	}
+	fmt.Println(output)
+}
+
+// printResult prints the result of one upload to STDOUT,
+// and returns true if the upload succeeded.
+func printResult(opts *common.Options, result *common.UploadResult) bool {
 	output := result.ToText()
 	if opts.OutputFormat == "json" {
 		var err error
@@ -75,10 +80,7 @@ func printResult(opts *common.Options, uploadClient *network.S3Upload, filesize
 		}
 	}
 	fmt.Println(output)
-	if result.ErrorMessage != "" {
-		return common.EXIT_RUNTIME_ERR
-	}
-	return common.EXIT_OK
+	return result.ErrorMessage == ""
 }
 
 // Get user-specified options from the command line,
@@ -97,6 +99,9 @@ func parseCommandLine() *common.Options {
 	var contentType string
 	var outputFormat string
 	var metadata string
+	var stateDir string
+	var concurrency int
+	var partSizeMB int64
 	var help bool
 	var version bool
 
@@ -107,6 +112,9 @@ func parseCommandLine() *common.Options {
 	flag.StringVar(&contentType, "contentType", "", "The mime type being uploaded (optional)")
 	flag.StringVar(&outputFormat, "format", "text", "Output format ('text' or 'json')")
 	flag.StringVar(&metadata, "metadata", "", "Optional metadata to store in S3")
+	flag.StringVar(&stateDir, "state-dir", "", "Directory for files that track upload progress (default is each file's directory)")
+	flag.IntVar(&concurrency, "concurrency", 4, "Number of parts to upload at once")
+	flag.Int64Var(&partSizeMB, "part-size", 64, "Size, in megabytes, of each part")
 	flag.BoolVar(&help, "help", false, "Show help")
 	flag.BoolVar(&version, "version", false, "Show version")
 
@@ -125,11 +133,23 @@ func parseCommandLine() *common.Options {
 		fmt.Fprintln(os.Stderr, "Please specify a file to upload.")
 		os.Exit(common.EXIT_USER_ERR)
 	}
+	if concurrency < 1 || partSizeMB < 5 {
+		fmt.Fprintln(os.Stderr, "Concurrency must be at least 1, and part size must be at least 5 MB.")
+		os.Exit(common.EXIT_USER_ERR)
+	}
 
-	filePath, err := filepath.Abs(flag.Arg(0))
-	exitOnFileError(err)
-	if key == "" {
-		key = path.Base(filePath)
+	filePaths, err := common.UploadPaths(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(common.EXIT_ITEM_NOT_FOUND)
+	}
+	if len(filePaths) == 0 {
+		fmt.Fprintln(os.Stderr, "There are no files to upload.")
+		os.Exit(common.EXIT_ITEM_NOT_FOUND)
+	}
+	if stateDir != "" {
+		stateDir, err = filepath.Abs(stateDir)
+		exitOnFileError(err)
 	}
 
 	opts := &common.Options{
@@ -138,8 +158,12 @@ func parseCommandLine() *common.Options {
 		Bucket:           bucket,
 		Key:              key,
 		ContentType:      contentType,
-		FileToUpload:     filePath,
+		FileToUpload:     filePaths[0],
+		FilesToUpload:    filePaths,
+		StateDir:         stateDir,
 		OutputFormat:     outputFormat,
+		Concurrency:      concurrency,
+		PartSize:         partSizeMB * 1024 * 1024,
 	}
 
 	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
@@ -158,7 +182,10 @@ func parseCommandLine() *common.Options {
 			fmt.Fprintln(os.Stderr, "Cannot parse metadata JSON:", err)
 			os.Exit(common.EXIT_RUNTIME_ERR)
 		}
-		opts.Metadata = meta
+		opts.Metadata = make(map[string]string)
+		for name, value := range meta {
+			opts.Metadata[strings.ToLower(name)] = value
+		}
 	}
 
 	return opts
@@ -167,11 +194,11 @@ func parseCommandLine() *common.Options {
 // Tell the user about the program.
 func printUsage() {
 	message := `
-apt_upload uploads a file to S3.
+apt_upload uploads files to S3.
 
 Usage:
 
-apt_upload [options] <file>
+apt_upload [options] <file|directory|pattern> [<file|directory|pattern> ...]
 
 apt_upload --bucket=<bucket to upload to> \
            [--config=<path to config file>] \
@@ -180,6 +207,9 @@ apt_upload --bucket=<bucket to upload to> \
 		   [--region=<aws region to connect to>] \
 		   [--key=<name/key of object to upload>] \
 		   [--metadata=<json string>] \
+		   [--concurrency=<number of parts to upload at once>] \
+		   [--part-size=<size of each part, in MB>] \
+		   [--state-dir=<directory for upload state files>] \
 		   <file>
 
 apt_upload --help
@@ -191,7 +221,10 @@ Options:
 Note that option flags may be preceded by either one or two dashes,
 so -option is the same as --option.
 
-Note that file is the only required param. This program will get your
+Note that file is the only required param. It may be a file, a
+directory, in which case apt_upload uploads every file in that
+directory (but not in its subdirectories), or a pattern like
+"bags/*.tar". You may list as many as you like. This program will get your
 AWS credentials from the config file, if it can find one. Otherwise,
 it will get your AWS credentials from the environment variables
 "AWS_ACCESS_KEY_ID" and "AWS_SECRET_ACCESS_KEY". If it can't find your
@@ -220,7 +253,13 @@ AWS credentials, the upload will fail.
   your file will be put into your S3 bucket with the name "my_file.txt".
   Setting the --key option allows you to override that. So if
   -key='file_001.txt', /home/joy/my_file.txt will be saved to your
-  S3 bucket with the name file_001.txt.
+  S3 bucket with the name file_001.txt. You can't use --key when you
+  upload more than one file.
+
+--concurrency is the number of parts of each file to upload at once.
+  The default is 4. apt_upload always uploads files in parts, and
+  checks the ETag S3 returns for each part, and for the whole file,
+  against md5 digests it calculates locally.
 
 --contentType is the optional content type of the file you're uploading.
   If you choose to specify this, it should be in mime type format.
@@ -230,8 +269,10 @@ AWS credentials, the upload will fail.
   If you want to set it, you'll find a full list of mime types at
   https://developer.mozilla.org/en-US/docs/Web/HTTP/Basics_of_HTTP/MIME_types/Complete_list_of_MIME_types
 
---format is the format of the output printed to STDOUT when the upload
-  is complete. Options are 'text' and 'json', and the default is 'text'.
+--format is the format of the output printed to STDOUT. apt_upload
+  prints a line each time S3 accepts a part, and a line with the result
+  of each upload. Options are 'text' and 'json', and the default is
+  'text'. In json format, each line is a separate JSON object.
 
 --metadata allows you to specify optional metadata, in json format, to be
   saved in S3 with your file. A metadata json string should look
@@ -241,6 +282,18 @@ AWS credentials, the upload will fail.
               "Institution":"virginia.edu","Md5":"12345",
               "Sha256":"54321"}'
 
+--part-size is the size, in megabytes, of each part. The default is
+  64, and the minimum is 5. For very large files, apt_upload uses
+  larger parts, because S3 allows no more than 10,000 parts.
+
+--state-dir is the directory in which apt_upload keeps the state file
+  for each upload. The state file records the parts S3 has accepted.
+  If an upload is interrupted, run apt_upload again with the same file
+  and options, and it will upload only the missing parts, as long as
+  the file hasn't changed. The default is the directory of the file
+  you're uploading. The state file is called .<file name>.aptupload,
+  and apt_upload deletes it when the upload is complete.
+
 --version prints version info and exits.
 
 --help prints this help message and exits.
@@ -263,12 +316,16 @@ Examples:
 
    apt_upload --bucket="my.custom.bucket" --key="MySpecialFile.tar" /home/joy/my_bag.tar
 
+4. Upload every tar file in /home/joy/bags, eight 128MB parts at a time
+
+   apt_upload --concurrency=8 --part-size=128 "/home/joy/bags/*.tar"
+
 Exit codes:
 
-0 - Item was successfully uploaded.
-1 - Upload failed.
+0 - All items were successfully uploaded.
+1 - One or more uploads failed.
 3 - Operation could not be completed due to usage error (e.g. missing params)
-4 - File does not exist.
+4 - File does not exist, or no files match the pattern.
 100 - Printed help or version message. No other operations attempted.
 `
 	fmt.Println(message)
@@ -7,28 +7,37 @@ import (
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/util/storage"
 	"github.com/APTrust/exchange/validation"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
+// aptrustProfileInfo describes the BagIt profile that --export-profile
+// writes.
+var aptrustProfileInfo = validation.BagItProfileInfo{
+	BagItProfileIdentifier: "https://raw.githubusercontent.com/APTrust/exchange/master/config/aptrust_bagit_profile.json",
+	SourceOrganization:     "aptrust.org",
+	ExternalDescription:    "BagIt profile for ingesting content into APTrust.",
+	Version:                "2.2",
+	ContactEmail:           "help@aptrust.org",
+}
+
 func main() {
-	pathToConfigFile, pathToOutFile, preserveAttrs := parseCommandLine()
-	configAbsPath, err := filepath.Abs(pathToConfigFile)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(common.EXIT_RUNTIME_ERR)
+	opts := parseCommandLine()
+	conf := loadConfig(opts)
+	if opts.strict {
+		conf.StrictRFC8493 = true
+	}
+	if opts.pathToExportFile != "" {
+		exportProfile(conf, opts.pathToExportFile)
+		os.Exit(common.EXIT_OK)
 	}
 	pathToBag, err := filepath.Abs(flag.Arg(0))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(common.EXIT_RUNTIME_ERR)
 	}
-	conf, errors := validation.LoadBagValidationConfig(configAbsPath)
-	if errors != nil && len(errors) > 0 {
-		fmt.Fprintln(os.Stderr, "Could not load bag validation config: ", errors[0])
-		os.Exit(common.EXIT_RUNTIME_ERR)
-	}
-	validator, err := validation.NewValidator(pathToBag, conf, preserveAttrs)
+	validator, err := validation.NewValidator(pathToBag, conf, opts.preserveAttrs)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error creating validator: ", err.Error())
 		os.Exit(common.EXIT_RUNTIME_ERR)
@@ -40,20 +49,86 @@ func main() {
 	}
 	exitCode := common.EXIT_OK
 	if summary.HasErrors() {
-		cleanup(validator.DBName())
-		fmt.Println("Bag is not valid")
-		fmt.Println(summary.AllErrorsAsString())
 		exitCode = common.EXIT_BAG_INVALID
+	}
+	if opts.format == "text" {
+		if summary.HasErrors() {
+			fmt.Println("Bag is not valid")
+			fmt.Println(summary.AllErrorsAsString())
+		} else {
+			fmt.Println("Bag is valid")
+		}
 	} else {
-		fmt.Println("Bag is valid")
+		printResult(validator.Result(), opts.format)
 	}
-	if pathToOutFile != "" {
-		printOutput(validator, pathToOutFile)
+	if opts.pathToOutFile != "" {
+		printOutput(validator, opts.pathToOutFile)
 	}
 	cleanup(validator.DBName())
 	os.Exit(exitCode)
 }
 
+// loadConfig loads the bag validation config or BagIt profile
+// specified on the command line.
+func loadConfig(opts *options) *validation.BagValidationConfig {
+	var conf *validation.BagValidationConfig
+	var errors []error
+	if opts.pathToProfile != "" {
+		profileAbsPath, err := filepath.Abs(opts.pathToProfile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(common.EXIT_RUNTIME_ERR)
+		}
+		conf, errors = validation.LoadBagValidationConfigFromProfile(profileAbsPath)
+	} else {
+		configAbsPath, err := filepath.Abs(opts.pathToConfigFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(common.EXIT_RUNTIME_ERR)
+		}
+		conf, errors = validation.LoadBagValidationConfig(configAbsPath)
+	}
+	if errors != nil && len(errors) > 0 {
+		fmt.Fprintln(os.Stderr, "Could not load bag validation config: ", errors[0])
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	return conf
+}
+
+// exportProfile writes the bag validation config to pathToExportFile
+// as a BagIt profile.
+func exportProfile(conf *validation.BagValidationConfig, pathToExportFile string) {
+	profile := validation.ExportBagItProfile(conf, aptrustProfileInfo)
+	data, err := profile.ToJSON()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not convert config to BagIt profile: ", err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	err = ioutil.WriteFile(pathToExportFile, append(data, '\n'), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not write BagIt profile: ", err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	fmt.Println("Wrote BagIt profile to", pathToExportFile)
+}
+
+// printResult prints the validation result in the specified format,
+// which is json or junit.
+func printResult(result *validation.ValidationResult, format string) {
+	var data []byte
+	var err error
+	if format == "junit" {
+		data, err = result.ToJUnit()
+	} else {
+		data, err = result.ToJSON()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not format validation result: ", err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
+	}
+	fmt.Println(string(data))
+}
+
 func printOutput(validator *validation.Validator, pathToOutFile string) {
 	file, err := os.Create(pathToOutFile)
 	if err != nil {
@@ -77,12 +152,27 @@ func cleanup(filePath string) {
 	}
 }
 
-func parseCommandLine() (pathToConfigFile, pathToOutFile string, preserveAttrs bool) {
+type options struct {
+	pathToConfigFile string
+	pathToProfile    string
+	pathToExportFile string
+	pathToOutFile    string
+	format           string
+	preserveAttrs    bool
+	strict           bool
+}
+
+func parseCommandLine() *options {
 	var help bool
 	var version bool
-	flag.StringVar(&pathToConfigFile, "config", "", "Path to bag validation config file")
-	flag.StringVar(&pathToOutFile, "outfile", "", "Path to file for dumping JSON output")
-	flag.BoolVar(&preserveAttrs, "attrs", false, "Preserve attributes")
+	opts := &options{}
+	flag.StringVar(&opts.pathToConfigFile, "config", "", "Path to bag validation config file")
+	flag.StringVar(&opts.pathToProfile, "profile", "", "Path to BagIt profile")
+	flag.StringVar(&opts.pathToExportFile, "export-profile", "", "Write config as a BagIt profile to this file")
+	flag.StringVar(&opts.pathToOutFile, "outfile", "", "Path to file for dumping JSON output")
+	flag.StringVar(&opts.format, "format", "text", "Output format: text, json or junit")
+	flag.BoolVar(&opts.preserveAttrs, "attrs", false, "Preserve attributes")
+	flag.BoolVar(&opts.strict, "strict", false, "Check BagIt 1.0 (RFC 8493) rules")
 	flag.BoolVar(&help, "help", false, "Show help")
 	flag.BoolVar(&version, "version", false, "Show version")
 
@@ -92,11 +182,14 @@ func parseCommandLine() (pathToConfigFile, pathToOutFile string, preserveAttrs b
 		fmt.Println(common.GetVersion())
 		os.Exit(common.EXIT_NO_OP)
 	}
-	if help || pathToConfigFile == "" || flag.Arg(0) == "" {
+	hasConfig := (opts.pathToConfigFile == "") != (opts.pathToProfile == "")
+	needsBag := opts.pathToExportFile == ""
+	validFormat := opts.format == "text" || opts.format == "json" || opts.format == "junit"
+	if help || !hasConfig || !validFormat || (needsBag && flag.Arg(0) == "") {
 		printUsage()
 		os.Exit(common.EXIT_USER_ERR)
 	}
-	return pathToConfigFile, pathToOutFile, preserveAttrs
+	return opts
 }
 
 // Tell the user about the program.
@@ -106,11 +199,15 @@ apt_validate validates bags according to the specified config file.
 
 Usage:
 
-apt_validate --config=<config_file> \
+apt_validate --config=<config_file> | --profile=<profile_file> \
              [--attrs=<true|false>] \
+             [--format=<text|json|junit>] \
+             [--strict] \
              [--outfile=<path_to_output_file>] \
              path_to_bag
 
+apt_validate --config=<config_file> --export-profile=<profile_file>
+
 apt_validate --help
 apt_validate --version
 
@@ -123,18 +220,44 @@ The additional information generated by the --attrs flag is used by APTrust
 during the ingest proces. Timestamps and UUIDs change each time you run
 the validator.
 
---config is required and should be the path to a bag validation
-config file that describes the validation rules. An example can be found at
+--config should be the path to a bag validation config file that describes
+the validation rules. An example can be found at
 https://github.com/APTrust/exchange/blob/master/config/aptrust_bag_validation_config.json
-but the config file must exist on the local drive.
+but the config file must exist on the local drive. You must specify either
+--config or --profile, but not both.
+
+--export-profile writes the rules in the --config file to the specified
+file as a BagIt profile (https://bagit-profiles.github.io/bagit-profiles-specification/)
+and exits without validating anything.
+
+--format option is not required. It may be text (the default), json or
+junit. The json and junit formats list each problem the validator
+found with a stable error code (e.g. BAD_DIGEST, FILE_NOT_IN_MANIFEST),
+a severity, and, where they apply, the file path, the manifest and line
+number, and the expected and actual digests. Use junit to show validation
+results in a CI server.
 
 --help prints this help message and exits.
 
+--profile is the path to a BagIt profile in the standard bagit-profiles
+JSON format. The APTrust profile is at
+https://github.com/APTrust/exchange/blob/master/config/aptrust_bagit_profile.json
+Use this instead of --config.
+
 --outfile option is not required. If specified, the validator will dump
 JSON information about the bag and its contents to this file. That info may be
 useful, especially when combined with --attrs=true, in cases where you're trying
 to debug your bagging process.
 
+--strict option is not required. If specified, the validator also
+checks BagIt 1.0 rules (https://tools.ietf.org/html/rfc8493) that the
+config file does not cover: Payload-Oxum in bag-info.txt must match
+the payload's byte and file counts, manifest paths must use forward
+slashes and percent-encode CR, LF and % as %0D, %0A and %25, bagit.txt
+must not start with a byte-order mark, and every payload file must
+appear in every payload manifest. Each problem has its own error code.
+You can also set StrictRFC8493 to true in the config file.
+
 --version prints version info and exits.
 
 Arguments
@@ -0,0 +1,317 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/tarfile"
+	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/util/fileutil"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BagItVersion and BagItEncoding go into the bagit.txt file of the
+// bags that Bagger builds.
+const (
+	BagItVersion  = "0.97"
+	BagItEncoding = "UTF-8"
+)
+
+// BagAlgorithms are the digest algorithms for the manifests and tag
+// manifests of the bags that Bagger builds.
+var BagAlgorithms = []string{constants.AlgMd5, constants.AlgSha256}
+
+// tagOrder lists the tags Bagger writes first in each tag file, in
+// the order it writes them. It writes any other tags after these,
+// in alphabetical order.
+var tagOrder = map[string][]string{
+	"bag-info.txt": []string{
+		"Source-Organization",
+		"Bagging-Date",
+		"Bag-Count",
+		"Bag-Group-Identifier",
+		"Internal-Sender-Description",
+		"Internal-Sender-Identifier",
+		"Payload-Oxum",
+	},
+	"aptrust-info.txt": []string{
+		"Title",
+		"Access",
+		"Description",
+		"Storage-Option",
+	},
+}
+
+// Bagger builds a tarred BagIt bag from a directory. Everything in the
+// directory becomes the bag's payload. Bagger writes bagit.txt,
+// bag-info.txt, aptrust-info.txt, and the manifests and tag manifests
+// listed in BagAlgorithms.
+type Bagger struct {
+	// SourceDir is the directory whose contents become the payload.
+	SourceDir string
+	// OutputDir is the directory in which to write the tar file.
+	OutputDir string
+	// BagName is the name of the bag, such as "virginia.edu.my_bag".
+	// The tar file is BagName plus ".tar", and it untars to a
+	// directory called BagName.
+	BagName string
+	// Tags maps tag file names, such as "aptrust-info.txt", to the
+	// tags in each file. Bagger sets Bagging-Date and Payload-Oxum
+	// in bag-info.txt itself.
+	Tags map[string]map[string]string
+}
+
+// payloadFile is a file that goes into the bag's data directory.
+type payloadFile struct {
+	absPath   string
+	pathInBag string
+	digests   map[string]string
+}
+
+// NewBagger returns a Bagger that bags the files in sourceDir and
+// writes the bag to outputDir/bagName.tar.
+func NewBagger(sourceDir, outputDir, bagName string) *Bagger {
+	return &Bagger{
+		SourceDir: sourceDir,
+		OutputDir: outputDir,
+		BagName:   bagName,
+		Tags: map[string]map[string]string{
+			"bag-info.txt":     make(map[string]string),
+			"aptrust-info.txt": make(map[string]string),
+		},
+	}
+}
+
+// SetTag sets the value of a tag in one of the bag's tag files,
+// replacing any value it already has.
+func (bagger *Bagger) SetTag(tagFile, label, value string) {
+	if bagger.Tags[tagFile] == nil {
+		bagger.Tags[tagFile] = make(map[string]string)
+	}
+	bagger.Tags[tagFile][label] = value
+}
+
+// LoadTemplate sets the tags in the JSON file at pathToTemplate,
+// which maps tag file names to tag labels and values, like this:
+//
+//	{
+//	  "bag-info.txt": { "Source-Organization": "Example University" },
+//	  "aptrust-info.txt": { "Access": "Institution" }
+//	}
+//
+// Tags in the template replace tags that are already set.
+func (bagger *Bagger) LoadTemplate(pathToTemplate string) error {
+	data, err := ioutil.ReadFile(pathToTemplate)
+	if err != nil {
+		return fmt.Errorf("Cannot read template: %v", err)
+	}
+	template := make(map[string]map[string]string)
+	err = json.Unmarshal(data, &template)
+	if err != nil {
+		return fmt.Errorf("Cannot parse template %s: %v", pathToTemplate, err)
+	}
+	for tagFile, tags := range template {
+		if tagFile == "bagit.txt" || strings.Contains(tagFile, "manifest-") || strings.HasPrefix(tagFile, "data/") {
+			return fmt.Errorf("Template cannot set tags in %s", tagFile)
+		}
+		for label, value := range tags {
+			bagger.SetTag(tagFile, label, value)
+		}
+	}
+	return nil
+}
+
+// TarFilePath returns the path of the tar file that Build writes.
+func (bagger *Bagger) TarFilePath() string {
+	return filepath.Join(bagger.OutputDir, bagger.BagName+".tar")
+}
+
+// Build writes the bag to TarFilePath and returns that path. If
+// something goes wrong, Build deletes the partial tar file.
+func (bagger *Bagger) Build() (string, error) {
+	if bagger.BagName == "" {
+		return "", fmt.Errorf("Bag name cannot be empty")
+	}
+	payload, payloadBytes, err := bagger.readPayload()
+	if err != nil {
+		return "", err
+	}
+	bagger.SetTag("bag-info.txt", "Bagging-Date", time.Now().UTC().Format("2006-01-02"))
+	bagger.SetTag("bag-info.txt", "Payload-Oxum", fmt.Sprintf("%d.%d", payloadBytes, len(payload)))
+
+	// Tag files and manifests are small, so we build them in memory.
+	tagFiles := make(map[string][]byte)
+	tagFileNames := []string{"bagit.txt"}
+	tagFiles["bagit.txt"] = []byte(fmt.Sprintf("BagIt-Version: %s\nTag-File-Character-Encoding: %s\n",
+		BagItVersion, BagItEncoding))
+	for _, tagFile := range bagger.tagFileNames() {
+		tagFiles[tagFile] = bagger.tagFileContents(tagFile)
+		tagFileNames = append(tagFileNames, tagFile)
+	}
+	for _, alg := range BagAlgorithms {
+		manifest := fmt.Sprintf("manifest-%s.txt", alg)
+		var contents bytes.Buffer
+		for _, file := range payload {
+			fmt.Fprintf(&contents, "%s  %s\n", file.digests[alg], file.pathInBag)
+		}
+		tagFiles[manifest] = contents.Bytes()
+		tagFileNames = append(tagFileNames, manifest)
+	}
+	for _, alg := range BagAlgorithms {
+		tagManifest := fmt.Sprintf("tagmanifest-%s.txt", alg)
+		var contents bytes.Buffer
+		for _, tagFile := range tagFileNames {
+			digests, _, err := digestsOf(bytes.NewReader(tagFiles[tagFile]))
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&contents, "%s  %s\n", digests[alg], tagFile)
+		}
+		tagFiles[tagManifest] = contents.Bytes()
+	}
+	for _, alg := range BagAlgorithms {
+		tagFileNames = append(tagFileNames, fmt.Sprintf("tagmanifest-%s.txt", alg))
+	}
+
+	err = bagger.writeTarFile(tagFileNames, tagFiles, payload)
+	if err != nil {
+		os.Remove(bagger.TarFilePath())
+		return "", err
+	}
+	return bagger.TarFilePath(), nil
+}
+
+// readPayload lists the files in SourceDir, with their digests,
+// sorted by path. It also returns the total size of the files.
+func (bagger *Bagger) readPayload() ([]*payloadFile, int64, error) {
+	sourceDir, err := filepath.Abs(bagger.SourceDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !fileutil.FileExists(sourceDir) {
+		return nil, 0, fmt.Errorf("Directory %s does not exist", sourceDir)
+	}
+	filePaths, err := fileutil.RecursiveFileList(sourceDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Cannot list files in %s: %v", sourceDir, err)
+	}
+	if len(filePaths) == 0 {
+		return nil, 0, fmt.Errorf("Directory %s has no files to bag", sourceDir)
+	}
+	sort.Strings(filePaths)
+	payload := make([]*payloadFile, 0, len(filePaths))
+	payloadBytes := int64(0)
+	for _, filePath := range filePaths {
+		relPath, err := filepath.Rel(sourceDir, filePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Cannot read %s: %v", filePath, err)
+		}
+		digests, size, err := digestsOf(file)
+		file.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("Cannot calculate digests for %s: %v", filePath, err)
+		}
+		payloadBytes += size
+		payload = append(payload, &payloadFile{
+			absPath:   filePath,
+			pathInBag: "data/" + filepath.ToSlash(relPath),
+			digests:   digests,
+		})
+	}
+	return payload, payloadBytes, nil
+}
+
+// tagFileNames returns the names of the tag files to write, other
+// than bagit.txt: bag-info.txt, aptrust-info.txt, and any others
+// in alphabetical order.
+func (bagger *Bagger) tagFileNames() []string {
+	names := []string{"bag-info.txt", "aptrust-info.txt"}
+	others := make([]string, 0)
+	for tagFile := range bagger.Tags {
+		if tagFile != "bag-info.txt" && tagFile != "aptrust-info.txt" {
+			others = append(others, tagFile)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// tagFileContents returns the contents of a tag file. Tags listed in
+// tagOrder come first, and then the others in alphabetical order.
+// Tags with empty values are omitted.
+func (bagger *Bagger) tagFileContents(tagFile string) []byte {
+	tags := bagger.Tags[tagFile]
+	labels := make([]string, 0, len(tags))
+	for _, label := range tagOrder[tagFile] {
+		if _, ok := tags[label]; ok {
+			labels = append(labels, label)
+		}
+	}
+	others := make([]string, 0)
+	for label := range tags {
+		if !util.StringListContains(tagOrder[tagFile], label) {
+			others = append(others, label)
+		}
+	}
+	sort.Strings(others)
+	labels = append(labels, others...)
+	var contents bytes.Buffer
+	for _, label := range labels {
+		if tags[label] != "" {
+			fmt.Fprintf(&contents, "%s: %s\n", label, tags[label])
+		}
+	}
+	return contents.Bytes()
+}
+
+// writeTarFile writes the tag files, and then the payload files,
+// into the tar file.
+func (bagger *Bagger) writeTarFile(tagFileNames []string, tagFiles map[string][]byte, payload []*payloadFile) error {
+	writer := tarfile.NewWriter(bagger.TarFilePath())
+	err := writer.Open()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, tagFile := range tagFileNames {
+		contents := tagFiles[tagFile]
+		err = writer.AddFromReader(bytes.NewReader(contents), bagger.BagName+"/"+tagFile, int64(len(contents)), now)
+		if err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	for _, file := range payload {
+		err = writer.AddToArchive(file.absPath, bagger.BagName+"/"+file.pathInBag)
+		if err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// digestsOf returns the BagAlgorithms digests of what's in reader,
+// and the number of bytes it read.
+func digestsOf(reader io.Reader) (map[string]string, int64, error) {
+	hashes, err := fileutil.NewHashes(BagAlgorithms)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(io.MultiWriter(fileutil.HashWriters(hashes)...), reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fileutil.HexDigests(hashes), size, nil
+}
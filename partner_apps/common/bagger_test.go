@@ -0,0 +1,112 @@
+package common_test
+
+import (
+	"github.com/APTrust/exchange/partner_apps/common"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// makePayloadDir creates a temp dir with a few files to bag.
+// The caller should delete it.
+func makePayloadDir(t *testing.T) string {
+	tempDir, err := ioutil.TempDir("", "bagger_test")
+	require.Nil(t, err)
+	sourceDir := filepath.Join(tempDir, "source")
+	require.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "images"), 0755))
+	files := map[string]string{
+		"README.txt":       "Read me first",
+		"notes.txt":        "Some notes",
+		"images/photo.jpg": "Not really a photo",
+	}
+	for name, contents := range files {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(sourceDir, name), []byte(contents), 0644))
+	}
+	return tempDir
+}
+
+func TestBaggerBuild(t *testing.T) {
+	tempDir := makePayloadDir(t)
+	defer os.RemoveAll(tempDir)
+
+	bagger := common.NewBagger(filepath.Join(tempDir, "source"), tempDir, "example.edu.my_bag")
+	bagger.SetTag("aptrust-info.txt", "Title", "My Bag")
+	bagger.SetTag("aptrust-info.txt", "Access", "Institution")
+	bagger.SetTag("aptrust-info.txt", "Storage-Option", "Standard")
+	bagger.SetTag("bag-info.txt", "Source-Organization", "Example University")
+	tarFilePath, err := bagger.Build()
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join(tempDir, "example.edu.my_bag.tar"), tarFilePath)
+	assert.Equal(t, "41.3", bagger.Tags["bag-info.txt"]["Payload-Oxum"])
+	assert.NotEmpty(t, bagger.Tags["bag-info.txt"]["Bagging-Date"])
+
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	conf.StrictRFC8493 = true
+	validator, err := validation.NewValidator(tarFilePath, conf, false)
+	require.Nil(t, err)
+	summary, err := validator.Validate()
+	os.Remove(validator.DBName())
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+}
+
+func TestBaggerBuildErrors(t *testing.T) {
+	tempDir := makePayloadDir(t)
+	defer os.RemoveAll(tempDir)
+
+	// No such directory
+	bagger := common.NewBagger(filepath.Join(tempDir, "no_such_dir"), tempDir, "example.edu.my_bag")
+	_, err := bagger.Build()
+	assert.NotNil(t, err)
+
+	// No bag name
+	bagger = common.NewBagger(filepath.Join(tempDir, "source"), tempDir, "")
+	_, err = bagger.Build()
+	assert.NotNil(t, err)
+
+	// Nowhere to write the tar file
+	bagger = common.NewBagger(filepath.Join(tempDir, "source"), filepath.Join(tempDir, "no_such_dir"), "example.edu.my_bag")
+	_, err = bagger.Build()
+	assert.NotNil(t, err)
+}
+
+func TestBaggerLoadTemplate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "bagger_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	templatePath := filepath.Join(tempDir, "template.json")
+	template := `{
+		"bag-info.txt": { "Source-Organization": "Example University" },
+		"aptrust-info.txt": { "Access": "Consortia", "Title": "From Template" },
+		"custom-tags.txt": { "Department": "Special Collections" }
+	}`
+	require.Nil(t, ioutil.WriteFile(templatePath, []byte(template), 0644))
+
+	bagger := common.NewBagger(tempDir, tempDir, "example.edu.my_bag")
+	bagger.SetTag("aptrust-info.txt", "Title", "From Flag")
+	require.Nil(t, bagger.LoadTemplate(templatePath))
+	assert.Equal(t, "Example University", bagger.Tags["bag-info.txt"]["Source-Organization"])
+	assert.Equal(t, "Consortia", bagger.Tags["aptrust-info.txt"]["Access"])
+	assert.Equal(t, "From Template", bagger.Tags["aptrust-info.txt"]["Title"])
+	assert.Equal(t, "Special Collections", bagger.Tags["custom-tags.txt"]["Department"])
+
+	// Templates can't set tags in bagit.txt or the manifests.
+	for _, tagFile := range []string{"bagit.txt", "manifest-md5.txt", "tagmanifest-sha256.txt", "data/file.txt"} {
+		template = `{ "` + tagFile + `": { "Label": "Value" } }`
+		require.Nil(t, ioutil.WriteFile(templatePath, []byte(template), 0644))
+		err = bagger.LoadTemplate(templatePath)
+		require.NotNil(t, err, tagFile)
+		assert.Equal(t, "Template cannot set tags in "+tagFile, err.Error())
+	}
+
+	require.Nil(t, ioutil.WriteFile(templatePath, []byte("{ not json"), 0644))
+	assert.NotNil(t, bagger.LoadTemplate(templatePath))
+	assert.NotNil(t, bagger.LoadTemplate(filepath.Join(tempDir, "no_such_file.json")))
+}
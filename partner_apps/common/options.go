@@ -66,8 +66,22 @@ type Options struct {
 	// FileToUpload is the path the file that should be uploaded to S3.
 	// This is required for apt_upload only, and is ignored elsewhere.
 	FileToUpload string
+	// FilesToUpload lists the files apt_upload should upload, when
+	// the user asks it to upload more than one. apt_upload uploads
+	// each of these in turn as FileToUpload.
+	FilesToUpload []string
+	// StateDir is the directory in which apt_upload keeps the state
+	// files that let it resume interrupted uploads. If empty, each
+	// state file goes in the same directory as the file it describes.
+	StateDir string
 	// PharosURL is the URL of the Pharos production or demo system.
 	PharosURL string
+	// Concurrency is the number of parts to transfer at once.
+	// For apt_download, one means download in a single stream.
+	Concurrency int
+	// PartSize is the size, in bytes, of each part when transferring
+	// a file in parts.
+	PartSize int64
 	// OutputFormat specifies how the program should print its results
 	// to STDOUT. Options are "text" and "json".
 	OutputFormat string
@@ -156,9 +170,12 @@ func (opts *Options) VerifyRequiredUploadOptions() {
 	if opts.SecretAccessKey == "" {
 		opts.addError("Cannot find AWS_SECRET_ACCESS_KEY in environment or config file")
 	}
-	if opts.FileToUpload == "" {
+	if opts.FileToUpload == "" && len(opts.FilesToUpload) == 0 {
 		opts.addError("You must specify a file to upload")
 	}
+	if opts.Key != "" && len(opts.FilesToUpload) > 1 {
+		opts.addError("Param -key cannot be used when uploading more than one file")
+	}
 }
 
 // VerifyRequiredListOptions checks to see that all
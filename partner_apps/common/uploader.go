@@ -0,0 +1,449 @@
+package common
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadStateSuffix is the suffix of the state files in which
+// Uploader records the progress of each upload.
+const UploadStateSuffix = ".aptupload"
+
+// Uploader sends a file to S3 as a multipart upload, several parts at
+// a time. After S3 accepts each part, Uploader records it in a state
+// file. If the upload is interrupted, running it again with the same
+// state file sends only the parts S3 doesn't have yet.
+//
+// Uploader checks the ETag S3 returns for each part against the md5
+// digest of the part, and the ETag of the finished object against the
+// digests of all the parts.
+type Uploader struct {
+	// Backend talks to S3.
+	Backend network.StorageBackend
+	// Region, Bucket and Key describe where the file is going.
+	Region string
+	Bucket string
+	Key    string
+	// ContentType and Metadata are optional.
+	ContentType string
+	Metadata    map[string]string
+	// FilePath is the path to the file to upload.
+	FilePath string
+	// StateFile is the path to the file that records which parts
+	// S3 has accepted.
+	StateFile string
+	// Concurrency is the number of parts to send at once.
+	Concurrency int
+	// PartSize is the size of each part. Uploader uses larger parts
+	// if the file would otherwise need more than network.MaxUploadParts.
+	PartSize int64
+	// OnProgress, if not nil, is called each time S3 accepts a part.
+	// Uploader never calls it from more than one goroutine at a time.
+	OnProgress func(*UploadProgress)
+
+	mutex sync.Mutex
+	state *uploadState
+}
+
+// uploadState is what Uploader saves in its state file.
+type uploadState struct {
+	Upload *models.MultipartUpload
+	// FileModTime is the modification time of the file when the
+	// upload started. If the file changes, we have to start over.
+	FileModTime time.Time
+}
+
+// UploadProgress describes how much of a file Uploader has sent.
+type UploadProgress struct {
+	File          string `json:"file"`
+	Bucket        string `json:"bucket"`
+	Key           string `json:"key"`
+	PartNumber    int64  `json:"part_number"`
+	PartsDone     int64  `json:"parts_done"`
+	PartCount     int64  `json:"part_count"`
+	BytesUploaded int64  `json:"bytes_uploaded"`
+	FileSize      int64  `json:"file_size"`
+}
+
+// NewUploader returns an Uploader that sends opts.FileToUpload to
+// opts.Bucket/opts.Key. The state file goes in opts.StateDir, or
+// next to the file if opts.StateDir is empty.
+func NewUploader(backend network.StorageBackend, opts *Options) *Uploader {
+	return &Uploader{
+		Backend:     backend,
+		Region:      opts.Region,
+		Bucket:      opts.Bucket,
+		Key:         opts.Key,
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
+		FilePath:    opts.FileToUpload,
+		StateFile:   UploadStateFile(opts.FileToUpload, opts.StateDir),
+		Concurrency: opts.Concurrency,
+		PartSize:    opts.PartSize,
+	}
+}
+
+// UploadStateFile returns the path of the state file for an upload
+// of filePath. If stateDir is empty, the state file goes in the same
+// directory as filePath.
+func UploadStateFile(filePath, stateDir string) string {
+	if stateDir == "" {
+		stateDir = filepath.Dir(filePath)
+	}
+	return filepath.Join(stateDir, "."+filepath.Base(filePath)+UploadStateSuffix)
+}
+
+// UploadPaths expands the paths on apt_upload's command line into a
+// sorted list of files to upload. Each path may be a file; a directory,
+// in which case we upload the files in it, but not in its
+// subdirectories; or a glob pattern, which Windows shells don't expand
+// for us. UploadPaths skips hidden files, like upload state files.
+func UploadPaths(paths []string) ([]string, error) {
+	files := make([]string, 0)
+	for _, pattern := range paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Bad pattern '%s': %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No files match '%s'", pattern)
+		}
+		for _, match := range matches {
+			fileInfo, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !fileInfo.IsDir() {
+				files = append(files, match)
+				continue
+			}
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+	for i, file := range files {
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = absPath
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Upload sends the file to S3, resuming an earlier upload if the
+// state file describes one, and returns the result. If the upload
+// fails, the result's ErrorMessage says why, and the state file
+// stays behind so that the next attempt can resume.
+func (uploader *Uploader) Upload() *UploadResult {
+	result := &UploadResult{
+		Region:        uploader.Region,
+		Bucket:        uploader.Bucket,
+		Key:           uploader.Key,
+		CopiedFrom:    uploader.FilePath,
+		S3ContentType: uploader.ContentType,
+	}
+	location, err := uploader.upload()
+	if err != nil {
+		result.ErrorMessage = err.Error()
+		return result
+	}
+	result.S3Location = location
+	result.S3UploadId = uploader.state.Upload.UploadId
+	result.S3PartsCount = int64(len(uploader.state.Upload.Parts))
+	storageObj, err := uploader.Backend.Head(uploader.Bucket, uploader.Key)
+	if err != nil {
+		result.ErrorMessage = fmt.Sprintf("Cannot get info about uploaded file: %v", err)
+		return result
+	}
+	result.S3ContentLength = storageObj.Size
+	result.S3ContentType = storageObj.ContentType
+	result.S3ETag = storageObj.ETag
+	result.S3LastModified = storageObj.LastModified
+	if storageObj.Size != uploader.state.Upload.FileSize {
+		result.ErrorMessage = fmt.Sprintf("Local file has size %d, but S3 object has size %d",
+			uploader.state.Upload.FileSize, storageObj.Size)
+	} else if storageObj.ETag != uploader.state.Upload.ETag() {
+		result.ErrorMessage = fmt.Sprintf("S3 object has ETag %s, but the parts we sent "+
+			"should produce ETag %s", storageObj.ETag, uploader.state.Upload.ETag())
+	}
+	return result
+}
+
+// upload sends any parts S3 doesn't have yet, completes the
+// multipart upload, and returns the location of the new object.
+func (uploader *Uploader) upload() (string, error) {
+	file, err := os.Open(uploader.FilePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", uploader.FilePath)
+	}
+	err = uploader.startOrResume(fileInfo)
+	if err != nil {
+		return "", err
+	}
+	err = uploader.sendParts(file)
+	if err != nil {
+		if network.IsNoSuchUpload(err) {
+			// The upload expired or someone aborted it.
+			// Start a new one next time.
+			os.Remove(uploader.StateFile)
+		}
+		return "", err
+	}
+	upload := uploader.state.Upload
+	location, err := uploader.Backend.CompleteMultipartUpload(upload.Bucket, upload.Key,
+		upload.UploadId, upload.SortedParts())
+	if err != nil {
+		if network.IsNoSuchUpload(err) || strings.Contains(err.Error(), "InvalidPart") {
+			// We can't finish this upload, so start over next time.
+			os.Remove(uploader.StateFile)
+		}
+		return "", fmt.Errorf("Error completing upload: %v", err)
+	}
+	os.Remove(uploader.StateFile)
+	return location, nil
+}
+
+// startOrResume loads the upload described in the state file, if it
+// is still in progress and it's for the same version of the same file.
+// Otherwise, it aborts that upload and starts a new one.
+func (uploader *Uploader) startOrResume(fileInfo os.FileInfo) error {
+	state, err := uploader.loadState()
+	if err != nil {
+		return err
+	}
+	if state != nil && uploader.canResume(state, fileInfo) {
+		uploader.state = state
+		return nil
+	}
+	if state != nil && state.Upload.UploadId != "" {
+		// Best effort. If this fails, S3 lifecycle rules should
+		// clean up the orphaned parts.
+		uploader.Backend.AbortMultipartUpload(state.Upload.Bucket, state.Upload.Key, state.Upload.UploadId)
+	}
+	partSize := uploader.PartSize
+	minPartSize := (fileInfo.Size() + network.MaxUploadParts - 1) / network.MaxUploadParts
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if partSize < 1 {
+		return fmt.Errorf("Part size must be greater than zero")
+	}
+	upload := models.NewMultipartUpload(uploader.Bucket, uploader.Key, fileInfo.Size(), partSize)
+	upload.Region = uploader.Region
+	upload.UploadId, err = uploader.Backend.CreateMultipartUpload(uploader.Bucket, uploader.Key,
+		uploader.ContentType, uploader.Metadata)
+	if err != nil {
+		return fmt.Errorf("Error starting multipart upload: %v", err)
+	}
+	uploader.state = &uploadState{
+		Upload:      upload,
+		FileModTime: fileInfo.ModTime(),
+	}
+	return uploader.saveState()
+}
+
+// canResume returns true if state describes an upload of this version
+// of the file to the same bucket and key, and S3 still has it.
+func (uploader *Uploader) canResume(state *uploadState, fileInfo os.FileInfo) bool {
+	upload := state.Upload
+	if upload.UploadId == "" || upload.PartSize < 1 ||
+		!upload.Matches(uploader.Bucket, uploader.Key, fileInfo.Size()) ||
+		!state.FileModTime.Equal(fileInfo.ModTime()) {
+		return false
+	}
+	inProgress, err := uploader.Backend.ListMultipartUploads(upload.Bucket, upload.Key)
+	if err != nil {
+		return false
+	}
+	for _, info := range inProgress {
+		if info.Key == upload.Key && info.UploadId == upload.UploadId {
+			return true
+		}
+	}
+	return false
+}
+
+// sendParts sends the parts that S3 doesn't have yet, Concurrency
+// parts at a time. It stops sending new parts after the first error.
+func (uploader *Uploader) sendParts(file *os.File) error {
+	upload := uploader.state.Upload
+	partCount := upload.PartCount()
+	if partCount == 0 {
+		partCount = 1 // S3 needs one part, even for an empty file.
+	}
+	pending := make([]int64, 0, partCount)
+	for partNumber := int64(1); partNumber <= partCount; partNumber++ {
+		if !upload.HasPart(partNumber) {
+			pending = append(pending, partNumber)
+		}
+	}
+	partNumbers := make(chan int64)
+	errors := make(chan error, len(pending))
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	concurrency := uploader.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range partNumbers {
+				select {
+				case <-stop:
+					continue // another part failed
+				default:
+				}
+				err := uploader.sendPart(file, partNumber)
+				if err != nil {
+					errors <- err
+					stopOnce.Do(func() { close(stop) })
+				}
+			}
+		}()
+	}
+	func() {
+		defer close(partNumbers)
+		for _, partNumber := range pending {
+			select {
+			case partNumbers <- partNumber:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errors)
+	return <-errors
+}
+
+// sendPart sends one part of the file, checks the ETag S3 returns,
+// and records the part in the state file.
+func (uploader *Uploader) sendPart(file *os.File, partNumber int64) error {
+	upload := uploader.state.Upload
+	offset := (partNumber - 1) * upload.PartSize
+	size := upload.PartSize
+	if offset+size > upload.FileSize {
+		size = upload.FileSize - offset
+	}
+	section := io.NewSectionReader(file, offset, size)
+	md5Hash := md5.New()
+	_, err := io.Copy(md5Hash, section)
+	if err != nil {
+		return fmt.Errorf("Error reading part %d: %v", partNumber, err)
+	}
+	localMd5 := fmt.Sprintf("%x", md5Hash.Sum(nil))
+	_, err = section.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	etag, err := uploader.Backend.UploadPart(upload.Bucket, upload.Key, upload.UploadId,
+		partNumber, section, size)
+	if err != nil {
+		return fmt.Errorf("Error uploading part %d: %v", partNumber, err)
+	}
+	if etag != localMd5 {
+		return fmt.Errorf("S3 returned ETag %s for part %d, but its md5 is %s",
+			etag, partNumber, localMd5)
+	}
+
+	uploader.mutex.Lock()
+	defer uploader.mutex.Unlock()
+	upload.AddPart(partNumber, etag, size)
+	err = uploader.saveState()
+	if err != nil {
+		return fmt.Errorf("Error saving upload progress: %v", err)
+	}
+	if uploader.OnProgress != nil {
+		uploader.OnProgress(&UploadProgress{
+			File:          uploader.FilePath,
+			Bucket:        upload.Bucket,
+			Key:           upload.Key,
+			PartNumber:    partNumber,
+			PartsDone:     int64(len(upload.Parts)),
+			PartCount:     upload.PartCount(),
+			BytesUploaded: upload.BytesUploaded(),
+			FileSize:      upload.FileSize,
+		})
+	}
+	return nil
+}
+
+// loadState returns the state saved in the state file,
+// or nil if there is no state file.
+func (uploader *Uploader) loadState() (*uploadState, error) {
+	data, err := ioutil.ReadFile(uploader.StateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Cannot read upload state file: %v", err)
+	}
+	state := &uploadState{}
+	err = json.Unmarshal(data, state)
+	if err != nil || state.Upload == nil {
+		// Someone has mangled the file. Start over.
+		return nil, nil
+	}
+	return state, nil
+}
+
+// saveState writes the state file. It writes to a temp file and
+// renames that, so an interrupted write can't leave a partial file.
+func (uploader *Uploader) saveState() error {
+	data, err := json.Marshal(uploader.state)
+	if err != nil {
+		return err
+	}
+	tempFile := uploader.StateFile + ".tmp"
+	err = ioutil.WriteFile(tempFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile, uploader.StateFile)
+}
+
+// ToJson returns a JSON representation of the progress.
+func (progress *UploadProgress) ToJson() (string, error) {
+	jsonBytes, err := json.Marshal(progress)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonBytes), err
+}
+
+// ToText returns a plain-text representation of the progress.
+func (progress *UploadProgress) ToText() string {
+	return fmt.Sprintf("[PART] Uploaded part %d of '%s' (%d of %d parts, %d of %d bytes)",
+		progress.PartNumber, progress.File, progress.PartsDone, progress.PartCount,
+		progress.BytesUploaded, progress.FileSize)
+}
@@ -0,0 +1,209 @@
+package common_test
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/partner_apps/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const uploadTestContent = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// flakyBackend is a LocalBackend that counts the parts it receives,
+// and fails to upload the parts in failParts.
+type flakyBackend struct {
+	*network.LocalBackend
+	failParts map[int64]bool
+	partsSent int
+	mutex     sync.Mutex
+}
+
+func (backend *flakyBackend) UploadPart(bucket, key, uploadId string, partNumber int64, reader io.ReadSeeker, size int64) (string, error) {
+	backend.mutex.Lock()
+	backend.partsSent++
+	backend.mutex.Unlock()
+	if backend.failParts[partNumber] {
+		return "", fmt.Errorf("Connection reset by peer")
+	}
+	return backend.LocalBackend.UploadPart(bucket, key, uploadId, partNumber, reader, size)
+}
+
+// getUploader returns an Uploader that sends a 36-byte file to a
+// LocalBackend in 10-byte parts. The caller should delete the temp dir.
+func getUploader(t *testing.T) (*common.Uploader, *flakyBackend, string) {
+	tempDir, err := ioutil.TempDir("", "uploader_test")
+	require.Nil(t, err)
+	localBackend, err := network.NewLocalBackend(filepath.Join(tempDir, "s3"))
+	require.Nil(t, err)
+	backend := &flakyBackend{LocalBackend: localBackend, failParts: make(map[int64]bool)}
+	filePath := filepath.Join(tempDir, "my_bag.tar")
+	require.Nil(t, ioutil.WriteFile(filePath, []byte(uploadTestContent), 0644))
+	opts := getOpts()
+	opts.Key = "my_bag.tar"
+	opts.FileToUpload = filePath
+	opts.Concurrency = 3
+	opts.PartSize = 10
+	opts.ContentType = "application/x-tar"
+	return common.NewUploader(backend, opts), backend, tempDir
+}
+
+func TestUploaderUpload(t *testing.T) {
+	uploader, backend, tempDir := getUploader(t)
+	defer os.RemoveAll(tempDir)
+	progress := make([]*common.UploadProgress, 0)
+	uploader.OnProgress = func(p *common.UploadProgress) {
+		progress = append(progress, p)
+	}
+
+	result := uploader.Upload()
+	require.Empty(t, result.ErrorMessage)
+	assert.Equal(t, "test.bucket", result.Bucket)
+	assert.Equal(t, "my_bag.tar", result.Key)
+	assert.EqualValues(t, len(uploadTestContent), result.S3ContentLength)
+	assert.EqualValues(t, 4, result.S3PartsCount)
+	assert.True(t, strings.HasSuffix(result.S3ETag, "-4"))
+	assert.Equal(t, "application/x-tar", result.S3ContentType)
+	assert.NotEmpty(t, result.S3UploadId)
+	assert.Equal(t, 4, backend.partsSent)
+
+	reader, err := backend.Get("test.bucket", "my_bag.tar")
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.Nil(t, err)
+	assert.Equal(t, uploadTestContent, string(data))
+
+	require.Equal(t, 4, len(progress))
+	last := progress[3]
+	assert.EqualValues(t, 4, last.PartsDone)
+	assert.EqualValues(t, 4, last.PartCount)
+	assert.EqualValues(t, len(uploadTestContent), last.BytesUploaded)
+	assert.EqualValues(t, len(uploadTestContent), last.FileSize)
+
+	// State file should be gone once the upload is complete.
+	assert.False(t, fileExists(uploader.StateFile))
+}
+
+func TestUploaderResume(t *testing.T) {
+	uploader, backend, tempDir := getUploader(t)
+	defer os.RemoveAll(tempDir)
+	uploader.Concurrency = 1
+	backend.failParts[3] = true
+
+	result := uploader.Upload()
+	assert.Equal(t, "Error uploading part 3: Connection reset by peer", result.ErrorMessage)
+	assert.True(t, fileExists(uploader.StateFile))
+	assert.Equal(t, 3, backend.partsSent)
+
+	// The next attempt sends only the parts that are missing.
+	backend.failParts = make(map[int64]bool)
+	backend.partsSent = 0
+	uploader = resumeUploader(uploader, backend)
+	result = uploader.Upload()
+	require.Empty(t, result.ErrorMessage)
+	assert.Equal(t, 2, backend.partsSent)
+	assert.EqualValues(t, 4, result.S3PartsCount)
+	assert.False(t, fileExists(uploader.StateFile))
+	uploads, err := backend.ListMultipartUploads("test.bucket", "")
+	require.Nil(t, err)
+	assert.Empty(t, uploads)
+}
+
+func TestUploaderRestartsWhenFileChanges(t *testing.T) {
+	uploader, backend, tempDir := getUploader(t)
+	defer os.RemoveAll(tempDir)
+	backend.failParts[4] = true
+	result := uploader.Upload()
+	assert.NotEmpty(t, result.ErrorMessage)
+
+	// A new version of the file means starting over,
+	// and discarding the old upload.
+	later := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(uploader.FilePath, later, later))
+	backend.failParts = make(map[int64]bool)
+	backend.partsSent = 0
+	uploader = resumeUploader(uploader, backend)
+	result = uploader.Upload()
+	require.Empty(t, result.ErrorMessage)
+	assert.Equal(t, 4, backend.partsSent)
+	uploads, err := backend.ListMultipartUploads("test.bucket", "")
+	require.Nil(t, err)
+	assert.Empty(t, uploads)
+}
+
+func TestUploaderEmptyFile(t *testing.T) {
+	uploader, _, tempDir := getUploader(t)
+	defer os.RemoveAll(tempDir)
+	require.Nil(t, ioutil.WriteFile(uploader.FilePath, []byte{}, 0644))
+	result := uploader.Upload()
+	require.Empty(t, result.ErrorMessage)
+	assert.EqualValues(t, 0, result.S3ContentLength)
+	assert.EqualValues(t, 1, result.S3PartsCount)
+}
+
+func TestUploadStateFile(t *testing.T) {
+	assert.Equal(t, filepath.Join("bags", ".my_bag.tar.aptupload"),
+		common.UploadStateFile(filepath.Join("bags", "my_bag.tar"), ""))
+	assert.Equal(t, filepath.Join("state", ".my_bag.tar.aptupload"),
+		common.UploadStateFile(filepath.Join("bags", "my_bag.tar"), "state"))
+}
+
+func TestUploadPaths(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "uploader_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	require.Nil(t, os.MkdirAll(filepath.Join(tempDir, "bags", "subdir"), 0755))
+	for _, name := range []string{"b.tar", "a.tar", ".a.tar.aptupload", "notes.txt", "subdir/c.tar"} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(tempDir, "bags", name), []byte("x"), 0644))
+	}
+	bagsDir := filepath.Join(tempDir, "bags")
+
+	files, err := common.UploadPaths([]string{bagsDir})
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(bagsDir, "a.tar"),
+		filepath.Join(bagsDir, "b.tar"),
+		filepath.Join(bagsDir, "notes.txt"),
+	}, files)
+
+	files, err = common.UploadPaths([]string{filepath.Join(bagsDir, "*.tar"), filepath.Join(bagsDir, "subdir", "c.tar")})
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(bagsDir, "a.tar"),
+		filepath.Join(bagsDir, "b.tar"),
+		filepath.Join(bagsDir, "subdir", "c.tar"),
+	}, files)
+
+	_, err = common.UploadPaths([]string{filepath.Join(bagsDir, "*.zip")})
+	assert.NotNil(t, err)
+}
+
+// resumeUploader returns a new Uploader like the old one, as if the
+// user ran apt_upload again.
+func resumeUploader(old *common.Uploader, backend *flakyBackend) *common.Uploader {
+	return &common.Uploader{
+		Backend:     backend,
+		Region:      old.Region,
+		Bucket:      old.Bucket,
+		Key:         old.Key,
+		ContentType: old.ContentType,
+		FilePath:    old.FilePath,
+		StateFile:   old.StateFile,
+		Concurrency: old.Concurrency,
+		PartSize:    old.PartSize,
+	}
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
@@ -13,7 +13,8 @@ WIKI_URL = "https://aptrust.github.io/userguide/partner_tools/"
 LICENSE = "Apache-2.0"
 EMAIL = "help@aptrust.org"
 
-@apps = ['apt_check_ingest',
+@apps = ['apt_bag',
+        'apt_check_ingest',
         'apt_delete',
         'apt_download',
         'apt_list',
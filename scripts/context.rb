@@ -32,11 +32,13 @@ class Context
 	  'apt_bucket_reader' => App.new('apt_bucket_reader', 'application'),
       'apt_dump_files' => App.new('apt_dump_files', 'application'),
       'apt_dump_valdb' => App.new('apt_dump_valdb', 'application'),
+	  'apt_exchange' => App.new('apt_exchange', 'service'),
 	  'apt_fetch' => App.new('apt_fetch', 'service'),
 	  'apt_file_delete' => App.new('apt_file_delete', 'service'),
 	  'apt_file_restore' => App.new('apt_file_restore', 'service'),
 	  'apt_fixity_check' => App.new('apt_fixity_check', 'service'),
 	  'apt_glacier_restore_init' => App.new('apt_glacier_restore_init', 'service'),
+	  'apt_ingest_trigger' => App.new('apt_ingest_trigger', 'service'),
 	  'apt_json_extractor' => App.new('apt_json_extractor', 'application'),
 	  'apt_queue' => App.new('apt_queue', 'application'),
 	  'apt_queue_fixity' => App.new('apt_queue_fixity', 'application'),
@@ -4,13 +4,23 @@ import (
 	"archive/tar"
 	"fmt"
 	"github.com/APTrust/exchange/platform"
+	"github.com/APTrust/exchange/util/fileutil"
 	"io"
 	"os"
+	"time"
 )
 
+// tarBlockSize is the size of a tar header, and the unit in which
+// tar pads file data.
+const tarBlockSize = 512
+
 type Writer struct {
 	PathToTarFile string
 	tarWriter     *tar.Writer
+	tarFile       *os.File
+	// appendOffset is where the first new entry starts, if we
+	// opened an existing tar file with OpenForAppend.
+	appendOffset int64
 }
 
 func NewWriter(pathToTarFile string) *Writer {
@@ -24,13 +34,118 @@ func (writer *Writer) Open() error {
 	if err != nil {
 		return fmt.Errorf("Error creating tar file: %v", err)
 	}
+	writer.tarFile = tarFile
+	writer.tarWriter = tar.NewWriter(tarFile)
+	return nil
+}
+
+// OpenForAppend opens an existing tar file, so we can add entries
+// after the ones it already has. The new entries overwrite the
+// end-of-archive marker, and Close writes a new one.
+func (writer *Writer) OpenForAppend() error {
+	offset, err := endOfEntries(writer.PathToTarFile)
+	if err != nil {
+		return fmt.Errorf("Error reading tar file: %v", err)
+	}
+	tarFile, err := os.OpenFile(writer.PathToTarFile, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Error opening tar file: %v", err)
+	}
+	if _, err = tarFile.Seek(offset, io.SeekStart); err != nil {
+		tarFile.Close()
+		return fmt.Errorf("Error seeking to end of tar file: %v", err)
+	}
+	writer.tarFile = tarFile
 	writer.tarWriter = tar.NewWriter(tarFile)
+	writer.appendOffset = offset
 	return nil
 }
 
+// endOfEntries returns the offset of the byte after the last entry
+// in the tar file at pathToTarFile, which is where the end-of-archive
+// marker starts.
+func endOfEntries(pathToTarFile string) (int64, error) {
+	iterator, err := fileutil.NewTarFileIterator(pathToTarFile)
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+	offset := int64(0)
+	for {
+		_, fileSummary, err := iterator.Next()
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return 0, err
+		}
+		padding := (tarBlockSize - fileSummary.Size%tarBlockSize) % tarBlockSize
+		offset = fileSummary.DataOffset + fileSummary.Size + padding
+	}
+}
+
 func (writer *Writer) Close() error {
+	var err error
 	if writer.tarWriter != nil {
-		return writer.tarWriter.Close()
+		err = writer.tarWriter.Close()
+	}
+	if writer.tarFile != nil {
+		closeErr := writer.tarFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		writer.tarFile = nil
+	}
+	return err
+}
+
+// Abort removes the entries added since OpenForAppend, restores the
+// end-of-archive marker, and closes the tar file. Call this if
+// something goes wrong while appending, so the tar file isn't left
+// half-written.
+func (writer *Writer) Abort() error {
+	if writer.tarFile == nil {
+		return fmt.Errorf("Tar file is not open")
+	}
+	defer func() {
+		writer.tarFile.Close()
+		writer.tarFile = nil
+		writer.tarWriter = nil
+	}()
+	if err := writer.tarFile.Truncate(writer.appendOffset); err != nil {
+		return fmt.Errorf("Error truncating tar file: %v", err)
+	}
+	endOfArchive := make([]byte, 2*tarBlockSize)
+	if _, err := writer.tarFile.WriteAt(endOfArchive, writer.appendOffset); err != nil {
+		return fmt.Errorf("Error writing end of tar file: %v", err)
+	}
+	return nil
+}
+
+// AddFromReader adds size bytes from reader to the tar archive as a
+// regular file at pathWithinArchive. It returns an error if reader
+// has more or fewer than size bytes.
+func (writer *Writer) AddFromReader(reader io.Reader, pathWithinArchive string, size int64, modTime time.Time) error {
+	if writer.tarWriter == nil {
+		return fmt.Errorf("Underlying TarWriter is nil. Has it been opened?")
+	}
+	header := &tar.Header{
+		Name:     pathWithinArchive,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := writer.tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	bytesWritten, err := io.Copy(writer.tarWriter, reader)
+	if err != nil {
+		return fmt.Errorf("Error copying %s into tar archive after %d of %d bytes: %v",
+			pathWithinArchive, bytesWritten, size, err)
+	}
+	if bytesWritten != size {
+		return fmt.Errorf("AddFromReader() copied only %d of %d bytes for %s",
+			bytesWritten, size, pathWithinArchive)
 	}
 	return nil
 }
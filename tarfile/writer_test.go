@@ -5,6 +5,8 @@ import (
 	//	"fmt"
 	"github.com/APTrust/exchange/tarfile"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -12,6 +14,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewWriter(t *testing.T) {
@@ -137,6 +140,72 @@ func TestAddToArchiveWithBadFilePath(t *testing.T) {
 	assert.True(t, strings.Contains(err.Error(), "no such file or directory"))
 }
 
+func TestOpenForAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarwriter_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tempFilePath := filepath.Join(dir, "test_file.tar")
+	w := tarfile.NewWriter(tempFilePath)
+	require.Nil(t, w.Open())
+	require.Nil(t, w.AddToArchive(pathToTestFile("cleanup_result.json"), "bag/file1.json"))
+	require.Nil(t, w.Close())
+
+	w = tarfile.NewWriter(tempFilePath)
+	require.Nil(t, w.OpenForAppend())
+	err = w.AddFromReader(strings.NewReader("Hello"), "bag/data/hello.txt", 5, time.Now())
+	assert.Nil(t, err)
+	err = w.AddFromReader(strings.NewReader("Too long"), "bag/data/too_long.txt", 3, time.Now())
+	assert.NotNil(t, err)
+	require.Nil(t, w.Close())
+	assert.Equal(t, []string{"bag/file1.json", "bag/data/hello.txt", "bag/data/too_long.txt"},
+		filesInArchive(t, tempFilePath))
+
+	// Appending again should pick up after the last entry.
+	w = tarfile.NewWriter(tempFilePath)
+	require.Nil(t, w.OpenForAppend())
+	err = w.AddFromReader(strings.NewReader(""), "bag/data/empty.txt", 0, time.Now())
+	assert.Nil(t, err)
+	require.Nil(t, w.Close())
+	assert.Equal(t, 4, len(filesInArchive(t, tempFilePath)))
+}
+
+func TestAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarwriter_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	tempFilePath := filepath.Join(dir, "test_file.tar")
+	w := tarfile.NewWriter(tempFilePath)
+	require.Nil(t, w.Open())
+	require.Nil(t, w.AddToArchive(pathToTestFile("cleanup_result.json"), "bag/file1.json"))
+	require.Nil(t, w.Close())
+
+	w = tarfile.NewWriter(tempFilePath)
+	assert.NotNil(t, w.Abort())
+	require.Nil(t, w.OpenForAppend())
+	err = w.AddFromReader(strings.NewReader("Too short"), "bag/data/too_short.txt", 100, time.Now())
+	assert.NotNil(t, err)
+	require.Nil(t, w.Abort())
+	assert.Equal(t, []string{"bag/file1.json"}, filesInArchive(t, tempFilePath))
+}
+
+// filesInArchive returns the names of the entries in a tar file.
+func filesInArchive(t *testing.T, pathToTarFile string) []string {
+	file, err := os.Open(pathToTarFile)
+	require.Nil(t, err)
+	defer file.Close()
+	names := make([]string, 0)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		names = append(names, header.Name)
+	}
+	return names
+}
+
 func pathToTestFile(name string) string {
 	_, filename, _, _ := runtime.Caller(0)
 	testDataPath, _ := filepath.Abs(path.Join(filepath.Dir(filename), "..", "testdata", "json_objects"))
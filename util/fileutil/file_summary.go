@@ -17,4 +17,8 @@ type FileSummary struct {
 	IsRegularFile bool
 	Uid           int
 	Gid           int
+	// DataOffset is the offset, in bytes, of the file's contents
+	// within the tar archive it came from. This is zero for files
+	// that didn't come from a tar archive.
+	DataOffset int64
 }
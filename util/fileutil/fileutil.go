@@ -2,11 +2,12 @@ package fileutil
 
 import (
 	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
-	"github.com/APTrust/exchange/util"
 	"hash"
 	"io"
 	"io/ioutil"
@@ -130,22 +131,66 @@ func LooksSafeToDelete(dir string, minLength, minSeparators int) bool {
 	return len(dir) >= minLength && separatorCount >= minSeparators
 }
 
-// CalculateChecksum calculates the md5 or sha256 checksum of a file.
+// NewHash returns a new hash.Hash for the specified algorithm, which
+// should be one of the algorithms in constants.ChecksumAlgorithms.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case constants.AlgMd5:
+		return md5.New(), nil
+	case constants.AlgSha1:
+		return sha1.New(), nil
+	case constants.AlgSha256:
+		return sha256.New(), nil
+	case constants.AlgSha512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("Unsupported algorithm: %s", algorithm)
+}
+
+// NewHashes returns a map of hash.Hash objects for the specified
+// algorithms, keyed by algorithm name. This is useful for calculating
+// several digests in a single pass with io.MultiWriter. It returns an
+// error if any of the algorithms is not supported.
+func NewHashes(algorithms []string) (map[string]hash.Hash, error) {
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	for _, algorithm := range algorithms {
+		_hash, err := NewHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashes[algorithm] = _hash
+	}
+	return hashes, nil
+}
+
+// HashWriters returns the hashes in a list of io.Writers
+// that can be passed to io.MultiWriter.
+func HashWriters(hashes map[string]hash.Hash) []io.Writer {
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, _hash := range hashes {
+		writers = append(writers, _hash)
+	}
+	return writers
+}
+
+// HexDigests returns the hex-encoded digests of the hashes,
+// keyed by algorithm name.
+func HexDigests(hashes map[string]hash.Hash) map[string]string {
+	digests := make(map[string]string, len(hashes))
+	for algorithm, _hash := range hashes {
+		digests[algorithm] = fmt.Sprintf("%x", _hash.Sum(nil))
+	}
+	return digests
+}
+
+// CalculateChecksum calculates the checksum of a file.
 // Param pathToFile is the path the file, and algorithm should be one
-// of constants.AlgMd5 or constante.AlgSha256. Returns the hex-encoded
-// digest or an error.
+// of the algorithms in constants.ChecksumAlgorithms. Returns the
+// hex-encoded digest or an error.
 func CalculateChecksum(pathToFile, algorithm string) (string, error) {
-	if !util.StringListContains(constants.ChecksumAlgorithms, algorithm) {
-		return "", fmt.Errorf("Unsupported algorithm: %s", algorithm)
-	}
-	var _hash hash.Hash = nil
-	if algorithm == constants.AlgMd5 {
-		_hash = md5.New()
-	} else if algorithm == constants.AlgSha256 {
-		_hash = sha256.New()
-	} else {
-		// In case we someday add a new algorithm to constants.ChecksumAlgorithms
-		return "", fmt.Errorf("Need to write in support for new digest algorithm %s", algorithm)
+	_hash, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
 	}
 	inputFile, err := os.Open(pathToFile)
 	if err != nil {
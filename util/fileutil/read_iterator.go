@@ -1,7 +1,10 @@
 package fileutil
 
 import (
+	"fmt"
 	"io"
+
+	"github.com/APTrust/exchange/constants"
 )
 
 // ReadIterator is an interface that allows TarFileIterator and
@@ -10,3 +13,33 @@ type ReadIterator interface {
 	Next() (io.ReadCloser, *FileSummary, error)
 	GetTopLevelDirNames() []string
 }
+
+// ArchiveIterator is a ReadIterator over a serialized bag. It's
+// implemented by TarFileIterator and ZipFileIterator.
+type ArchiveIterator interface {
+	ReadIterator
+	Find(originalPathWithBagName string) (io.ReadCloser, error)
+	Close()
+}
+
+// NewArchiveIterator returns an iterator for the serialized bag at
+// pathToArchive, based on its file extension, which must be .tar,
+// .tar.gz, .tgz or .zip.
+func NewArchiveIterator(pathToArchive string) (ArchiveIterator, error) {
+	var iter ArchiveIterator
+	var err error
+	switch constants.SerializedBagSuffix.FindString(pathToArchive) {
+	case ".tar":
+		iter, err = NewTarFileIterator(pathToArchive)
+	case ".tar.gz", ".tgz":
+		iter, err = NewTarGzipFileIterator(pathToArchive)
+	case ".zip":
+		iter, err = NewZipFileIterator(pathToArchive)
+	default:
+		err = fmt.Errorf("%s is not a tar, tar.gz, tgz or zip file", pathToArchive)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
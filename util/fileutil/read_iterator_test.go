@@ -0,0 +1,34 @@
+package fileutil_test
+
+import (
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewArchiveIterator(t *testing.T) {
+	bags := map[string]interface{}{
+		"example.edu.tagsample_good.tar":       &fileutil.TarFileIterator{},
+		"example.edu.tagsample_good.tar.gz":    &fileutil.TarFileIterator{},
+		"example.edu.sample_bad_checksums.tgz": &fileutil.TarFileIterator{},
+		"example.edu.tagsample_good.zip":       &fileutil.ZipFileIterator{},
+	}
+	for bagName, expectedType := range bags {
+		iter, err := fileutil.NewArchiveIterator(zipTestBagPath(bagName))
+		require.Nil(t, err, bagName)
+		assert.IsType(t, expectedType, iter, bagName)
+		_, summary, err := iter.Next()
+		assert.Nil(t, err, bagName)
+		assert.NotNil(t, summary, bagName)
+		iter.Close()
+	}
+
+	iter, err := fileutil.NewArchiveIterator(zipTestBagPath("example.edu.tagsample_good"))
+	assert.NotNil(t, err)
+	assert.Nil(t, iter)
+
+	iter, err = fileutil.NewArchiveIterator(zipTestBagPath("no_such_bag.zip"))
+	assert.NotNil(t, err)
+	assert.Nil(t, iter)
+}
@@ -2,6 +2,7 @@ package fileutil
 
 import (
 	"archive/tar"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
@@ -13,6 +14,7 @@ import (
 type TarFileIterator struct {
 	tarReader        *tar.Reader
 	file             *os.File
+	counter          *countingReader
 	topLevelDirNames []string
 }
 
@@ -23,13 +25,44 @@ func NewTarFileIterator(pathToTarFile string) (*TarFileIterator, error) {
 	if err != nil {
 		return nil, err
 	}
+	iter := NewTarStreamIterator(file)
+	iter.file = file
+	return iter, nil
+}
+
+// NewTarGzipFileIterator returns a TarFileIterator for a gzipped tar
+// file (.tar.gz or .tgz). Because the contents are compressed, the
+// FileSummaries it returns have no DataOffset.
+func NewTarGzipFileIterator(pathToTarGzFile string) (*TarFileIterator, error) {
+	file, err := os.Open(pathToTarGzFile)
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Cannot read %s as gzip: %v", pathToTarGzFile, err)
+	}
 	return &TarFileIterator{
-		tarReader:        tar.NewReader(file),
+		tarReader:        tar.NewReader(gzipReader),
 		file:             file,
 		topLevelDirNames: make([]string, 0),
 	}, nil
 }
 
+// NewTarStreamIterator returns a TarFileIterator that reads a tar
+// archive from reader, which may be a network stream. Like any
+// TarFileIterator, it's forward-only. Closing the iterator does
+// not close reader.
+func NewTarStreamIterator(reader io.Reader) *TarFileIterator {
+	counter := &countingReader{reader: reader}
+	return &TarFileIterator{
+		tarReader:        tar.NewReader(counter),
+		counter:          counter,
+		topLevelDirNames: make([]string, 0),
+	}
+}
+
 // Next returns an open reader for the next file, along with a FileSummary.
 // Returns io.EOF when it reaches the last file.
 func (iter *TarFileIterator) Next() (io.ReadCloser, *FileSummary, error) {
@@ -55,6 +88,13 @@ func (iter *TarFileIterator) Next() (io.ReadCloser, *FileSummary, error) {
 		Uid:           header.Uid,
 		Gid:           header.Gid,
 	}
+	// The tar reader reads headers a block at a time, and
+	// never reads ahead, so the next byte it reads is the
+	// first byte of this file. We don't count bytes in
+	// compressed archives, where the offset would be meaningless.
+	if iter.counter != nil {
+		fs.DataOffset = iter.counter.bytesRead
+	}
 
 	// Wrap our tar reader in a TarReadCloser. When the caller
 	// calls Read() on this object, it will read to the end
@@ -140,3 +180,16 @@ func (tarReadCloser TarReadCloser) Read(p []byte) (int, error) {
 func (tarReadCloser TarReadCloser) Close() error {
 	return nil // noop
 }
+
+// countingReader counts the bytes read through it, so we can
+// tell where each file starts within the archive.
+type countingReader struct {
+	reader    io.Reader
+	bytesRead int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.bytesRead += int64(n)
+	return n, err
+}
@@ -1,10 +1,12 @@
 package fileutil_test
 
 import (
+	"bytes"
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -140,3 +142,74 @@ func TestTFIFind(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, readCloser)
 }
+
+func TestTarStreamIterator(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	tarFilePath, _ := filepath.Abs(path.Join(filepath.Dir(filename),
+		"..", "..", "testdata", "unit_test_bags", "example.edu.tagsample_good.tar"))
+	tarFile, err := os.Open(tarFilePath)
+	require.Nil(t, err)
+	defer tarFile.Close()
+
+	// Read the whole tar file into memory, so we can check that
+	// DataOffset points to the start of each file's contents.
+	data, err := ioutil.ReadAll(tarFile)
+	require.Nil(t, err)
+	tfi := fileutil.NewTarStreamIterator(bytes.NewReader(data))
+	fileCount := 0
+	for {
+		reader, fileSummary, err := tfi.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		if !fileSummary.IsRegularFile {
+			continue
+		}
+		fileCount++
+		require.True(t, fileSummary.DataOffset > 0, fileSummary.RelPath)
+		contents, err := ioutil.ReadAll(reader)
+		require.Nil(t, err)
+		end := fileSummary.DataOffset + fileSummary.Size
+		assert.Equal(t, data[fileSummary.DataOffset:end], contents, fileSummary.RelPath)
+	}
+	assert.True(t, fileCount > 0)
+	assert.Equal(t, []string{"example.edu.tagsample_good"}, tfi.GetTopLevelDirNames())
+}
+
+func TestTarGzipFileIterator(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	bagDir, _ := filepath.Abs(path.Join(filepath.Dir(filename),
+		"..", "..", "testdata", "unit_test_bags"))
+	tgz, err := fileutil.NewTarGzipFileIterator(path.Join(bagDir, "example.edu.tagsample_good.tar.gz"))
+	require.Nil(t, err)
+	defer tgz.Close()
+	tfi, err := fileutil.NewTarFileIterator(path.Join(bagDir, "example.edu.tagsample_good.tar"))
+	require.Nil(t, err)
+	defer tfi.Close()
+
+	// The gzipped tar should contain exactly what the plain tar does,
+	// but without data offsets, since those would point into the
+	// uncompressed stream.
+	for {
+		tarReader, tarSummary, tarErr := tfi.Next()
+		tgzReader, tgzSummary, tgzErr := tgz.Next()
+		require.Equal(t, tarErr, tgzErr)
+		if tarErr == io.EOF {
+			break
+		}
+		assert.Equal(t, tarSummary.RelPath, tgzSummary.RelPath)
+		assert.Equal(t, tarSummary.Size, tgzSummary.Size)
+		assert.Equal(t, tarSummary.IsRegularFile, tgzSummary.IsRegularFile)
+		assert.Equal(t, int64(0), tgzSummary.DataOffset)
+		tarData, err := ioutil.ReadAll(tarReader)
+		require.Nil(t, err)
+		tgzData, err := ioutil.ReadAll(tgzReader)
+		require.Nil(t, err)
+		assert.Equal(t, tarData, tgzData, tarSummary.RelPath)
+	}
+	assert.Equal(t, []string{"example.edu.tagsample_good"}, tgz.GetTopLevelDirNames())
+
+	_, err = fileutil.NewTarGzipFileIterator(path.Join(bagDir, "example.edu.tagsample_good.tar"))
+	assert.NotNil(t, err)
+}
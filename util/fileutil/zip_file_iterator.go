@@ -0,0 +1,115 @@
+package fileutil
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ZipFileIterator lets us read zipped bags without having to unzip
+// them. Like TarFileIterator, it returns files in the order they
+// appear in the archive.
+type ZipFileIterator struct {
+	zipReader        *zip.ReadCloser
+	index            int
+	current          io.ReadCloser
+	topLevelDirNames []string
+}
+
+// NewZipFileIterator returns a new ZipFileIterator. Param pathToZipFile
+// should be an absolute path to the zip file.
+func NewZipFileIterator(pathToZipFile string) (*ZipFileIterator, error) {
+	zipReader, err := zip.OpenReader(pathToZipFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ZipFileIterator{
+		zipReader:        zipReader,
+		topLevelDirNames: make([]string, 0),
+	}, nil
+}
+
+// Next returns an open reader for the next file, along with a FileSummary.
+// Returns io.EOF when it reaches the last file. The reader is valid only
+// until the next call to Next or Close.
+func (iter *ZipFileIterator) Next() (io.ReadCloser, *FileSummary, error) {
+	iter.closeCurrent()
+	if iter.index >= len(iter.zipReader.File) {
+		return nil, nil, io.EOF
+	}
+	zipFile := iter.zipReader.File[iter.index]
+	iter.index++
+	iter.setTopLevelDirName(zipFile.Name)
+	finfo := zipFile.FileInfo()
+	// Path to file, minus the top-level directory name,
+	// which is the name of the bag.
+	relPathInArchive := (strings.Join(strings.Split(zipFile.Name, "/")[1:], "/"))
+	fs := &FileSummary{
+		RelPath:       relPathInArchive,
+		AbsPath:       "",
+		Mode:          finfo.Mode(),
+		Size:          int64(zipFile.UncompressedSize64),
+		ModTime:       zipFile.Modified,
+		IsDir:         finfo.IsDir(),
+		IsRegularFile: finfo.Mode().IsRegular(),
+	}
+	if fs.IsDir {
+		return nil, fs, nil
+	}
+	reader, err := zipFile.Open()
+	if err != nil {
+		return nil, fs, fmt.Errorf("Cannot read %s from zip file: %v", zipFile.Name, err)
+	}
+	iter.current = reader
+	return reader, fs, nil
+}
+
+// Find returns an open reader for the file with the specified name,
+// or an error if that file cannot be found. Caller is responsible
+// for closing the reader. Param originalPathWithBagName should
+// come from genericFile.OriginalPathWithBagName().
+func (iter *ZipFileIterator) Find(originalPathWithBagName string) (io.ReadCloser, error) {
+	for _, zipFile := range iter.zipReader.File {
+		if zipFile.Name == originalPathWithBagName {
+			return zipFile.Open()
+		}
+	}
+	return nil, fmt.Errorf("File '%s' not found in archive", originalPathWithBagName)
+}
+
+// Keep track of any top-level directory names we encounter.
+// See TarFileIterator.setTopLevelDirName.
+func (iter *ZipFileIterator) setTopLevelDirName(name string) {
+	topLevelDir := strings.Split(name, "/")[0]
+	for i := range iter.topLevelDirNames {
+		if iter.topLevelDirNames[i] == topLevelDir {
+			return
+		}
+	}
+	iter.topLevelDirNames = append(iter.topLevelDirNames, topLevelDir)
+}
+
+// GetTopLevelDirNames returns the names of the top level directories to
+// which the zip file expands. For APTrust purposes, the zip file should
+// expand to one directory whose name matches that of the zip file, minus
+// the .zip extension.
+//
+// Note that you should read the entire zip file before calling
+// this; otherwise, you may not get all the top-level dir names.
+func (iter *ZipFileIterator) GetTopLevelDirNames() []string {
+	return iter.topLevelDirNames
+}
+
+// Close closes the underlying zip file.
+func (iter *ZipFileIterator) Close() {
+	iter.closeCurrent()
+	iter.zipReader.Close()
+}
+
+func (iter *ZipFileIterator) closeCurrent() {
+	if iter.current != nil {
+		iter.current.Close()
+		iter.current = nil
+	}
+}
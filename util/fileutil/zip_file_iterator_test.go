@@ -0,0 +1,96 @@
+package fileutil_test
+
+import (
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func zipTestBagPath(bagName string) string {
+	_, filename, _, _ := runtime.Caller(0)
+	bagPath, _ := filepath.Abs(path.Join(filepath.Dir(filename),
+		"..", "..", "testdata", "unit_test_bags", bagName))
+	return bagPath
+}
+
+func TestNewZipFileIterator(t *testing.T) {
+	zfi, err := fileutil.NewZipFileIterator(zipTestBagPath("example.edu.tagsample_good.zip"))
+	require.Nil(t, err)
+	assert.NotNil(t, zfi)
+	zfi.Close()
+
+	_, err = fileutil.NewZipFileIterator(zipTestBagPath("example.edu.tagsample_good.tar"))
+	assert.NotNil(t, err)
+}
+
+func TestZFINext(t *testing.T) {
+	zfi, err := fileutil.NewZipFileIterator(zipTestBagPath("example.edu.tagsample_good.zip"))
+	require.Nil(t, err)
+	defer zfi.Close()
+	tfi, err := fileutil.NewTarFileIterator(zipTestBagPath("example.edu.tagsample_good.tar"))
+	require.Nil(t, err)
+	defer tfi.Close()
+
+	// The zip file was made from the tar file, so it should
+	// have the same files, in the same order.
+	fileCount := 0
+	for {
+		tarReader, tarSummary, tarErr := tfi.Next()
+		zipReader, zipSummary, zipErr := zfi.Next()
+		require.Equal(t, tarErr, zipErr)
+		if tarErr == io.EOF {
+			break
+		}
+		assert.Equal(t, tarSummary.RelPath, zipSummary.RelPath)
+		assert.Equal(t, tarSummary.IsDir, zipSummary.IsDir)
+		assert.Equal(t, tarSummary.IsRegularFile, zipSummary.IsRegularFile)
+		assert.Empty(t, zipSummary.AbsPath)
+		assert.False(t, zipSummary.ModTime.IsZero())
+		if zipSummary.IsDir {
+			assert.Nil(t, zipReader)
+			continue
+		}
+		fileCount++
+		assert.Equal(t, tarSummary.Size, zipSummary.Size)
+		tarData, err := ioutil.ReadAll(tarReader)
+		require.Nil(t, err)
+		zipData, err := ioutil.ReadAll(zipReader)
+		require.Nil(t, err)
+		assert.Equal(t, tarData, zipData, zipSummary.RelPath)
+	}
+	assert.True(t, fileCount > 0)
+}
+
+func TestZFIGetTopLevelDirNames(t *testing.T) {
+	zfi, err := fileutil.NewZipFileIterator(zipTestBagPath("example.edu.sample_wrong_folder_name.zip"))
+	require.Nil(t, err)
+	defer zfi.Close()
+	for {
+		_, _, err := zfi.Next()
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, []string{"wrong_folder_name"}, zfi.GetTopLevelDirNames())
+}
+
+func TestZFIFind(t *testing.T) {
+	zfi, err := fileutil.NewZipFileIterator(zipTestBagPath("example.edu.tagsample_good.zip"))
+	require.Nil(t, err)
+	defer zfi.Close()
+
+	readCloser, err := zfi.Find("example.edu.tagsample_good/junk_file.txt")
+	require.Nil(t, err)
+	assert.NotNil(t, readCloser)
+	readCloser.Close()
+
+	readCloser, err = zfi.Find("this-file-does-not-exist")
+	assert.NotNil(t, err)
+	assert.Nil(t, readCloser)
+}
@@ -14,6 +14,7 @@ import (
 
 const FILE_BUCKET = "files"
 const OBJ_BUCKET = "objects"
+const UPLOAD_BUCKET = "uploads"
 
 // BoltDB represents a bolt database, which is a single-file key-value
 // store. Our validator uses this to track information about the files
@@ -58,6 +59,10 @@ func (boltDB *BoltDB) initBuckets() error {
 		if err != nil {
 			return fmt.Errorf("Error creating object bucket: %s", err)
 		}
+		_, err = tx.CreateBucketIfNotExists([]byte(UPLOAD_BUCKET))
+		if err != nil {
+			return fmt.Errorf("Error creating upload bucket: %s", err)
+		}
 		return nil
 	})
 	return err
@@ -86,12 +91,16 @@ func (boltDB *BoltDB) ObjectIdentifier() string {
 	return string(key)
 }
 
-// Save saves a value to the bolt database.
+// Save saves a value to the bolt database. IntellectualObjects
+// go into the object bucket, MultipartUploads go into the upload
+// bucket, and everything else goes into the file bucket.
 func (boltDB *BoltDB) Save(key string, value interface{}) error {
-	_, isIntelObj := value.(*models.IntellectualObject)
 	bucketName := FILE_BUCKET
-	if isIntelObj {
+	switch value.(type) {
+	case *models.IntellectualObject:
 		bucketName = OBJ_BUCKET
+	case *models.MultipartUpload:
+		bucketName = UPLOAD_BUCKET
 	}
 	var byteSlice []byte
 	buf := bytes.NewBuffer(byteSlice)
@@ -152,6 +161,53 @@ func (boltDB *BoltDB) GetGenericFile(key string) (*models.GenericFile, error) {
 	return gf, err
 }
 
+// GetMultipartUpload returns the MultipartUpload saved under key.
+// If key is not found, this returns nil and no error.
+func (boltDB *BoltDB) GetMultipartUpload(key string) (*models.MultipartUpload, error) {
+	var err error
+	upload := &models.MultipartUpload{}
+	err = boltDB.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(UPLOAD_BUCKET))
+		value := bucket.Get([]byte(key))
+		if len(value) > 0 {
+			buf := bytes.NewBuffer(value)
+			decoder := gob.NewDecoder(buf)
+			err = decoder.Decode(upload)
+		} else {
+			upload = nil
+		}
+		return err
+	})
+	return upload, err
+}
+
+// DeleteMultipartUpload deletes the MultipartUpload saved under key.
+// Deleting a key that doesn't exist is not an error.
+func (boltDB *BoltDB) DeleteMultipartUpload(key string) error {
+	return boltDB.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(UPLOAD_BUCKET)).Delete([]byte(key))
+	})
+}
+
+// MultipartUploads returns all of the MultipartUploads in the
+// database, keyed by the keys they were saved under.
+func (boltDB *BoltDB) MultipartUploads() (map[string]*models.MultipartUpload, error) {
+	uploads := make(map[string]*models.MultipartUpload)
+	err := boltDB.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(UPLOAD_BUCKET))
+		return bucket.ForEach(func(k, v []byte) error {
+			upload := &models.MultipartUpload{}
+			err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(upload)
+			if err != nil {
+				return err
+			}
+			uploads[string(k)] = upload
+			return nil
+		})
+	})
+	return uploads, err
+}
+
 // ForEach calls the specified function for each key in the database's
 // file bucket.
 func (boltDB *BoltDB) ForEach(fn func(k, v []byte) error) error {
@@ -165,3 +165,42 @@ func TestBoltDB_DumpJson(t *testing.T) {
 		assert.Equal(t, 2, len(gf.Checksums))
 	}
 }
+
+func TestBoltDB_MultipartUploads(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "boltdb_test")
+	require.Nil(t, err)
+	defer tempFile.Close()
+	defer os.Remove(tempFile.Name())
+
+	bolt, err := storage.NewBoltDB(tempFile.Name())
+	require.Nil(t, err)
+	defer bolt.Close()
+
+	upload := models.NewMultipartUpload("preservation", "uuid-1", 300, 100)
+	upload.UploadId = "upload-1"
+	upload.AddPart(1, "etag-1", 100)
+	require.Nil(t, bolt.Save("s3:test.edu/bag/data/file.txt", upload))
+	require.Nil(t, bolt.Save("glacier:test.edu/bag/data/file.txt",
+		models.NewMultipartUpload("replication", "uuid-1", 300, 100)))
+
+	restored, err := bolt.GetMultipartUpload("s3:test.edu/bag/data/file.txt")
+	require.Nil(t, err)
+	require.NotNil(t, restored)
+	assert.Equal(t, "upload-1", restored.UploadId)
+	require.Equal(t, 1, len(restored.Parts))
+	assert.Equal(t, "etag-1", restored.Parts[0].ETag)
+
+	// Uploads should not show up as files.
+	assert.Equal(t, 0, bolt.FileCount())
+
+	uploads, err := bolt.MultipartUploads()
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(uploads))
+	assert.Equal(t, "replication", uploads["glacier:test.edu/bag/data/file.txt"].Bucket)
+
+	require.Nil(t, bolt.DeleteMultipartUpload("s3:test.edu/bag/data/file.txt"))
+	require.Nil(t, bolt.DeleteMultipartUpload("no such key"))
+	restored, err = bolt.GetMultipartUpload("s3:test.edu/bag/data/file.txt")
+	require.Nil(t, err)
+	assert.Nil(t, restored)
+}
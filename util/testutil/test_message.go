@@ -0,0 +1,111 @@
+package testutil
+
+import (
+	"sync"
+	"time"
+)
+
+// TestMessage is a models.QueueMessage for unit tests. It records
+// the last thing the worker did with the message, so tests can
+// check whether the worker finished, requeued or touched it.
+type TestMessage struct {
+	MessageID   string
+	MessageBody []byte
+	Attempt     uint16
+	Delay       time.Duration
+	Backoff     bool
+	// Operation is "finish", "requeue" or "touch".
+	Operation            string
+	autoResponseDisabled bool
+	responded            bool
+	mutex                sync.Mutex
+}
+
+// MakeQueueMessage returns a TestMessage with the specified body.
+// For our purposes, param body should usually be an integer in
+// string format, like "1234" or "999".
+func MakeQueueMessage(body string) *TestMessage {
+	return &TestMessage{
+		MessageID:   "0123456789ABCDEF",
+		MessageBody: []byte(body),
+		Attempt:     1,
+	}
+}
+
+// ID returns the message id.
+func (message *TestMessage) ID() string {
+	return message.MessageID
+}
+
+// Body returns the message body.
+func (message *TestMessage) Body() []byte {
+	return message.MessageBody
+}
+
+// Attempts returns the number of times the message has been delivered.
+func (message *TestMessage) Attempts() uint16 {
+	return message.Attempt
+}
+
+// Touch records a touch.
+func (message *TestMessage) Touch() {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	if !message.responded {
+		message.Operation = "touch"
+	}
+}
+
+// Finish records a finish.
+func (message *TestMessage) Finish() {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	if !message.responded {
+		message.responded = true
+		message.Operation = "finish"
+	}
+}
+
+// Requeue records a requeue with backoff.
+func (message *TestMessage) Requeue(delay time.Duration) {
+	message.requeue(delay, true)
+}
+
+// RequeueWithoutBackoff records a requeue without backoff.
+func (message *TestMessage) RequeueWithoutBackoff(delay time.Duration) {
+	message.requeue(delay, false)
+}
+
+func (message *TestMessage) requeue(delay time.Duration, backoff bool) {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	if !message.responded {
+		message.responded = true
+		message.Operation = "requeue"
+		message.Delay = delay
+		message.Backoff = backoff
+	}
+}
+
+// DisableAutoResponse records that the worker will respond to
+// the message itself.
+func (message *TestMessage) DisableAutoResponse() {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	message.autoResponseDisabled = true
+}
+
+// IsAutoResponseDisabled returns true if the worker called
+// DisableAutoResponse.
+func (message *TestMessage) IsAutoResponseDisabled() bool {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	return message.autoResponseDisabled
+}
+
+// HasResponded returns true if the message was finished or requeued.
+func (message *TestMessage) HasResponded() bool {
+	message.mutex.Lock()
+	defer message.mutex.Unlock()
+	return message.responded
+}
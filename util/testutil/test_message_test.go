@@ -0,0 +1,39 @@
+package testutil_test
+
+import (
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var _ models.QueueMessage = (*testutil.TestMessage)(nil)
+
+func TestTestMessageFinish(t *testing.T) {
+	message := testutil.MakeQueueMessage("hello")
+	assert.Equal(t, []byte("hello"), message.Body())
+	message.Touch()
+	assert.Equal(t, "touch", message.Operation)
+	assert.False(t, message.HasResponded())
+	message.Finish()
+	assert.Equal(t, "finish", message.Operation)
+	assert.True(t, message.HasResponded())
+
+	// Only the first response counts.
+	message.Requeue(time.Minute)
+	assert.Equal(t, "finish", message.Operation)
+}
+
+func TestTestMessageRequeue(t *testing.T) {
+	message := testutil.MakeQueueMessage("hello")
+	message.Requeue(time.Minute * 3)
+	assert.Equal(t, "requeue", message.Operation)
+	assert.Equal(t, time.Minute*3, message.Delay)
+	assert.True(t, message.Backoff)
+
+	message = testutil.MakeQueueMessage("hello")
+	message.RequeueWithoutBackoff(time.Minute)
+	assert.Equal(t, "requeue", message.Operation)
+	assert.False(t, message.Backoff)
+}
@@ -81,25 +81,48 @@ func RestorationBucketFor(institution string, restoreToTestBuckets bool) (bucket
 
 // BagNameFromTarFileName returns the bag name of the specified tar file.
 // This works even for tar files with names like 'test.edu.my_bag.b01.of12.tar'.
-// That will return 'test.edu.my_bag'.
+// That will return 'test.edu.my_bag'. It also works for bags serialized
+// as .zip, .tar.gz or .tgz.
 func BagNameFromTarFileName(pathToTarFile string) string {
 	fileName := path.Base(pathToTarFile)
 	return CleanBagName(fileName)
 }
 
-// CleanBagName returns the clean bag name. That's the tar file name minus
-// the tar extension and any ".bagN.ofN" suffix.
+// CleanBagName returns the clean bag name. That's the file name minus
+// the serialization extension (.tar, .tar.gz, .tgz or .zip) and any
+// ".bagN.ofN" suffix.
 func CleanBagName(bagName string) string {
-	// Strip the .tar suffix
-	nameWithoutTar := bagName
-	if strings.HasSuffix(bagName, ".tar") {
-		nameWithoutTar = bagName[0 : len(bagName)-4]
-	}
+	// Strip the .tar, .zip, etc. suffix
+	nameWithoutSuffix := constants.SerializedBagSuffix.ReplaceAllString(bagName, "")
 	// Now get rid of the .b001.of200 suffix if this is a multi-part bag.
-	cleanName := constants.MultipartSuffix.ReplaceAll([]byte(nameWithoutTar), []byte(""))
+	cleanName := constants.MultipartSuffix.ReplaceAll([]byte(nameWithoutSuffix), []byte(""))
 	return string(cleanName)
 }
 
+// SerializationSuffix returns the extension of a serialized bag,
+// such as ".tar", ".tar.gz", ".tgz" or ".zip". It returns an empty
+// string if fileName doesn't look like a serialized bag.
+func SerializationSuffix(fileName string) string {
+	return constants.SerializedBagSuffix.FindString(fileName)
+}
+
+// MultipartBagPart returns the part number and total number of parts
+// of a bag uploaded in parts, such as "my_bag.b04.of12.tar", which is
+// part 4 of 12. Param isMultipart will be false if fileName doesn't
+// have a .bNN.ofNN suffix.
+func MultipartBagPart(fileName string) (partNumber, totalParts int, isMultipart bool) {
+	nameWithoutSuffix := constants.SerializedBagSuffix.ReplaceAllString(path.Base(fileName), "")
+	suffix := constants.MultipartSuffix.FindString(nameWithoutSuffix)
+	if suffix == "" {
+		return 0, 0, false
+	}
+	_, err := fmt.Sscanf(suffix, ".b%d.of%d", &partNumber, &totalParts)
+	if err != nil {
+		return 0, 0, false
+	}
+	return partNumber, totalParts, true
+}
+
 // Min returns the minimum of x or y. The Math package has this function
 // but you have to cast to floats.
 func Min(x, y int) int {
@@ -35,6 +35,15 @@ func TestBagNameFromTarFileName(t *testing.T) {
 
 	name = util.BagNameFromTarFileName("/mnt/apt/data/uc.edu/photos.bag22.b1.of12.tar")
 	assert.Equal(t, "photos.bag22", name)
+
+	name = util.BagNameFromTarFileName("/mnt/apt/data/uc.edu/photos.bag22.zip")
+	assert.Equal(t, "photos.bag22", name)
+
+	name = util.BagNameFromTarFileName("/mnt/apt/data/uc.edu/photos.bag22.tar.gz")
+	assert.Equal(t, "photos.bag22", name)
+
+	name = util.BagNameFromTarFileName("/mnt/apt/data/uc.edu/photos.bag22.tgz")
+	assert.Equal(t, "photos.bag22", name)
 }
 
 func TestCleanBagName(t *testing.T) {
@@ -51,6 +60,32 @@ func TestCleanBagName(t *testing.T) {
 	}
 }
 
+func TestSerializationSuffix(t *testing.T) {
+	assert.Equal(t, ".tar", util.SerializationSuffix("photos.bag22.tar"))
+	assert.Equal(t, ".tar.gz", util.SerializationSuffix("photos.bag22.tar.gz"))
+	assert.Equal(t, ".tgz", util.SerializationSuffix("photos.bag22.tgz"))
+	assert.Equal(t, ".zip", util.SerializationSuffix("photos.bag22.zip"))
+	assert.Equal(t, "", util.SerializationSuffix("photos.bag22.gz"))
+	assert.Equal(t, "", util.SerializationSuffix("photos.bag22"))
+}
+
+func TestMultipartBagPart(t *testing.T) {
+	part, total, ok := util.MultipartBagPart("photos.bag22.b04.of12.tar")
+	assert.True(t, ok)
+	assert.Equal(t, 4, part)
+	assert.Equal(t, 12, total)
+
+	part, total, ok = util.MultipartBagPart("/mnt/uc.edu/photos.bag22.b001.of200.tar.gz")
+	assert.True(t, ok)
+	assert.Equal(t, 1, part)
+	assert.Equal(t, 200, total)
+
+	_, _, ok = util.MultipartBagPart("photos.bag22.tar")
+	assert.False(t, ok)
+	_, _, ok = util.MultipartBagPart("photos.b04.of12.bag22.tar")
+	assert.False(t, ok)
+}
+
 func TestMin(t *testing.T) {
 	if util.Min(10, 12) != 10 {
 		t.Error("Min() thinks 12 is less than 10")
@@ -20,6 +20,40 @@ const (
 
 var presenceValues = []string{REQUIRED, OPTIONAL, FORBIDDEN}
 
+// Formats that TagSpec.Format can require a tag value to have.
+const (
+	// FORMAT_DATE is an ISO-8601 date, like 2018-06-01, or date
+	// and time, like 2018-06-01T14:30:00Z or 2018-06-01T14:30:00-0400.
+	FORMAT_DATE = "date"
+	// FORMAT_INTEGER is a whole number, like 42 or -7.
+	FORMAT_INTEGER = "integer"
+	// FORMAT_NUMBER is any decimal number, like 42 or 3.14.
+	FORMAT_NUMBER = "number"
+	// FORMAT_BAG_COUNT is a BagIt Bag-Count, like "1 of 3" or
+	// "2 of ?" when the total is unknown.
+	FORMAT_BAG_COUNT = "bag-count"
+	// FORMAT_PAYLOAD_OXUM is a BagIt Payload-Oxum, which is the
+	// payload's octet count and file count, like 279164409832.1198.
+	FORMAT_PAYLOAD_OXUM = "payload-oxum"
+)
+
+// Policies for FileNameCollisionPolicy.
+const (
+	// COLLISION_WARN reports file name collisions as warnings,
+	// which don't make the bag invalid.
+	COLLISION_WARN = "warn"
+	// COLLISION_REJECT reports file name collisions as errors.
+	COLLISION_REJECT = "reject"
+	// COLLISION_NORMALIZE converts file names to Unicode NFC, so that
+	// names that differ only by normalization refer to the same file.
+	// Collisions that normalization can't resolve are errors.
+	COLLISION_NORMALIZE = "normalize"
+)
+
+var collisionPolicies = []string{COLLISION_WARN, COLLISION_REJECT, COLLISION_NORMALIZE}
+
+var formatValues = []string{FORMAT_DATE, FORMAT_INTEGER, FORMAT_NUMBER, FORMAT_BAG_COUNT, FORMAT_PAYLOAD_OXUM}
+
 // FileSpec defines whether files at a specified path within
 // the bag are required, optional, or forbidden.
 type FileSpec struct {
@@ -48,6 +82,20 @@ type TagSpec struct {
 	EmptyOK bool
 	// Describes which values are allowed (case-insensitive).
 	AllowedValues []string
+	// Pattern is a regex that non-empty values must match. The regex
+	// must match the whole value, so "\d+" won't match "12a".
+	Pattern string
+	// Regex compiled internally from Pattern.
+	PatternRegex *regexp.Regexp
+	// Format is the type of value the tag must have, if any:
+	// FORMAT_DATE, FORMAT_INTEGER, FORMAT_NUMBER, FORMAT_BAG_COUNT
+	// or FORMAT_PAYLOAD_OXUM. Empty values are not checked.
+	Format string
+	// MinCount and MaxCount limit how many times the tag may appear
+	// in FilePath. Zero means no limit, so set MaxCount to 1 for a
+	// tag that may appear at most once.
+	MinCount int
+	MaxCount int
 }
 
 // Valid tells you whether this TagSpec is valid.
@@ -55,6 +103,30 @@ func (tagspec *TagSpec) Valid() bool {
 	return ValidPresenceValue(tagspec.Presence) && tagspec.FilePath != ""
 }
 
+// TagRule makes a tag required or forbidden, depending on the value
+// of another tag. For example, a rule with IfTag "Access", IfValues
+// ["Restricted"], ThenTag "Internal-Sender-Identifier" and ThenPresence
+// REQUIRED says that restricted bags must have an internal identifier.
+type TagRule struct {
+	// IfTag is the tag whose value triggers the rule. The rule
+	// applies when IfTag is present with a non-empty value.
+	IfTag string
+	// IfValues, if not empty, narrows the rule to bags where IfTag
+	// has one of these values (case-insensitive).
+	IfValues []string
+	// IfPattern, if not empty, narrows the rule to bags where IfTag
+	// has a value that matches this regex. Like TagSpec.Pattern, it
+	// must match the whole value.
+	IfPattern string
+	// Regex compiled internally from IfPattern.
+	IfPatternRegex *regexp.Regexp
+	// ThenTag is the tag that must be present, or must not be.
+	ThenTag string
+	// ThenPresence is REQUIRED or FORBIDDEN. A required tag must
+	// have a non-empty value.
+	ThenPresence string
+}
+
 // Returns true if value is a valid presence value.
 func ValidPresenceValue(value string) bool {
 	return util.StringListContains(presenceValues, value)
@@ -100,6 +172,34 @@ type BagValidationConfig struct {
 	FileNamePattern string
 	// Regex compiled internally from FileNamePattern.
 	FileNameRegex *regexp.Regexp
+	// AcceptBagItVersion lists the values of BagIt-Version in bagit.txt
+	// that we'll accept. If this is empty, we accept any version.
+	AcceptBagItVersion []string
+	// Serialization describes whether the bag must be serialized
+	// (e.g. tarred). It can be REQUIRED, OPTIONAL, or FORBIDDEN.
+	// An empty value means OPTIONAL.
+	Serialization string
+	// AcceptSerialization lists the mime types of the serialization
+	// formats we'll accept, such as "application/tar". If this is
+	// empty, we accept any format the validator can read.
+	AcceptSerialization []string
+	// TagRules describe tags whose presence depends on the values
+	// of other tags.
+	TagRules []TagRule
+	// FileNameCollisionPolicy says what to do about files whose names
+	// differ only by Unicode normalization (NFC vs. NFD) or by case,
+	// either within the bag or from files already in preservation
+	// storage. These overwrite each other when restored to macOS or
+	// Windows. This can be COLLISION_WARN, COLLISION_REJECT or
+	// COLLISION_NORMALIZE. If it's empty, we don't check.
+	FileNameCollisionPolicy string
+	// StrictRFC8493 turns on checks for BagIt 1.0 (RFC 8493) rules
+	// that go beyond what APTrust requires: Payload-Oxum must match
+	// the payload, manifest paths must percent-encode CR, LF and %,
+	// and may not use backslashes, bagit.txt may not start with a
+	// byte-order mark, and every payload file must appear in every
+	// payload manifest. See https://tools.ietf.org/html/rfc8493.
+	StrictRFC8493 bool
 }
 
 func NewBagValidationConfig() *BagValidationConfig {
@@ -115,12 +215,40 @@ func NewBagValidationConfig() *BagValidationConfig {
 
 func (config *BagValidationConfig) ValidateConfig() []error {
 	errors := make([]error, 0)
-	for _, tagSpec := range config.TagSpecs {
+	for tagName, tagSpec := range config.TagSpecs {
 		if !tagSpec.Valid() {
 			errors = append(errors, fmt.Errorf(
 				"TagSpec for file '%s' requires non-empty FilePath and valid presence value.",
 				tagSpec.FilePath))
 		}
+		if tagSpec.Format != "" && !util.StringListContains(formatValues, tagSpec.Format) {
+			errors = append(errors, fmt.Errorf(
+				"TagSpec for tag '%s' has unknown format '%s'. Valid formats: %s.",
+				tagName, tagSpec.Format, strings.Join(formatValues, ", ")))
+		}
+		if tagSpec.MinCount < 0 || tagSpec.MaxCount < 0 ||
+			(tagSpec.MaxCount > 0 && tagSpec.MinCount > tagSpec.MaxCount) {
+			errors = append(errors, fmt.Errorf(
+				"TagSpec for tag '%s' has invalid MinCount %d and MaxCount %d.",
+				tagName, tagSpec.MinCount, tagSpec.MaxCount))
+		}
+	}
+	if config.FileNameCollisionPolicy != "" &&
+		!util.StringListContains(collisionPolicies, config.FileNameCollisionPolicy) {
+		errors = append(errors, fmt.Errorf(
+			"FileNameCollisionPolicy '%s' is not valid. Valid policies: %s.",
+			config.FileNameCollisionPolicy, strings.Join(collisionPolicies, ", ")))
+	}
+	for i, rule := range config.TagRules {
+		if rule.IfTag == "" || rule.ThenTag == "" ||
+			(rule.ThenPresence != REQUIRED && rule.ThenPresence != FORBIDDEN) {
+			errors = append(errors, fmt.Errorf(
+				"TagRule %d requires IfTag, ThenTag, and ThenPresence of required or forbidden.", i))
+		}
+	}
+	if config.Serialization != "" && !ValidPresenceValue(config.Serialization) {
+		errors = append(errors, fmt.Errorf(
+			"Serialization '%s' is not a valid presence value.", config.Serialization))
 	}
 	return errors
 }
@@ -148,6 +276,43 @@ func (config *BagValidationConfig) CompileFileNameRegex() error {
 	return err
 }
 
+// CompileTagPatterns compiles the Pattern regex of each TagSpec and
+// the IfPattern regex of each TagRule. If you load your validation
+// config from a file, LoadBagValidationConfig calls this for you.
+func (config *BagValidationConfig) CompileTagPatterns() error {
+	for tagName, tagSpec := range config.TagSpecs {
+		if tagSpec.Pattern == "" {
+			continue
+		}
+		regex, err := compileWholeValueRegex(tagSpec.Pattern)
+		if err != nil {
+			return fmt.Errorf("Cannot compile regex for tag '%s' Pattern '%s': %v",
+				tagName, tagSpec.Pattern, err)
+		}
+		tagSpec.PatternRegex = regex
+		config.TagSpecs[tagName] = tagSpec
+	}
+	for i := range config.TagRules {
+		rule := &config.TagRules[i]
+		if rule.IfPattern == "" {
+			continue
+		}
+		regex, err := compileWholeValueRegex(rule.IfPattern)
+		if err != nil {
+			return fmt.Errorf("Cannot compile regex for TagRule %d IfPattern '%s': %v",
+				i, rule.IfPattern, err)
+		}
+		rule.IfPatternRegex = regex
+	}
+	return nil
+}
+
+// compileWholeValueRegex compiles pattern so that it matches only
+// whole values, not substrings.
+func compileWholeValueRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
 func LoadBagValidationConfig(pathToConfigFile string) (*BagValidationConfig, []error) {
 	errors := make([]error, 0)
 	var file []byte
@@ -180,5 +345,9 @@ func LoadBagValidationConfig(pathToConfigFile string) (*BagValidationConfig, []e
 	if regexErr != nil {
 		configErrors = append(configErrors, regexErr)
 	}
+	regexErr = bagValidationConfig.CompileTagPatterns()
+	if regexErr != nil {
+		configErrors = append(configErrors, regexErr)
+	}
 	return bagValidationConfig, configErrors
 }
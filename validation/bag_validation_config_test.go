@@ -154,3 +154,65 @@ func TestCompileFileNameRegex(t *testing.T) {
 	assert.Equal(t, constants.PosixFileNamePattern, conf.FileNameRegex)
 
 }
+
+func TestValidateConfig_TagConstraints(t *testing.T) {
+	conf := validation.NewBagValidationConfig()
+	conf.TagSpecs["Bagging-Date"] = validation.TagSpec{
+		FilePath: "bag-info.txt",
+		Presence: validation.OPTIONAL,
+		Format:   validation.FORMAT_DATE,
+		MaxCount: 1,
+	}
+	conf.TagRules = []validation.TagRule{
+		{IfTag: "Access", IfValues: []string{"Restricted"}, ThenTag: "Internal-Sender-Identifier",
+			ThenPresence: validation.REQUIRED},
+	}
+	assert.Empty(t, conf.ValidateConfig())
+
+	conf.TagSpecs["Bag-Count"] = validation.TagSpec{
+		FilePath: "bag-info.txt",
+		Presence: validation.OPTIONAL,
+		Format:   "roman-numeral",
+	}
+	conf.TagSpecs["Bag-Size"] = validation.TagSpec{
+		FilePath: "bag-info.txt",
+		Presence: validation.OPTIONAL,
+		MinCount: 2,
+		MaxCount: 1,
+	}
+	conf.TagRules = append(conf.TagRules, validation.TagRule{IfTag: "Access", ThenTag: "Title",
+		ThenPresence: validation.OPTIONAL})
+	errors := conf.ValidateConfig()
+	require.Equal(t, 3, len(errors))
+	messages := make([]string, len(errors))
+	for i, err := range errors {
+		messages[i] = err.Error()
+	}
+	assert.Contains(t, messages, "TagSpec for tag 'Bag-Count' has unknown format 'roman-numeral'. "+
+		"Valid formats: date, integer, number, bag-count, payload-oxum.")
+	assert.Contains(t, messages, "TagSpec for tag 'Bag-Size' has invalid MinCount 2 and MaxCount 1.")
+	assert.Contains(t, messages, "TagRule 1 requires IfTag, ThenTag, and ThenPresence of required or forbidden.")
+}
+
+func TestCompileTagPatterns(t *testing.T) {
+	conf := validation.NewBagValidationConfig()
+	conf.TagSpecs["Internal-Sender-Identifier"] = validation.TagSpec{
+		FilePath: "bag-info.txt",
+		Presence: validation.OPTIONAL,
+		Pattern:  `uva-\d+`,
+	}
+	conf.TagRules = []validation.TagRule{{IfTag: "Bag-Count", IfPattern: `\d+ of \d+`}}
+	require.Nil(t, conf.CompileTagPatterns())
+	regex := conf.TagSpecs["Internal-Sender-Identifier"].PatternRegex
+	require.NotNil(t, regex)
+	assert.True(t, regex.MatchString("uva-1234"))
+	assert.False(t, regex.MatchString("uva-1234-b"))
+	assert.False(t, regex.MatchString("xuva-1234"))
+	require.NotNil(t, conf.TagRules[0].IfPatternRegex)
+	assert.True(t, conf.TagRules[0].IfPatternRegex.MatchString("1 of 2"))
+
+	conf.TagRules[0].IfPattern = "ThisPatternIsInvalid[-"
+	err := conf.CompileTagPatterns()
+	require.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Cannot compile regex for TagRule 0"))
+}
@@ -0,0 +1,374 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/util/fileutil"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BagItProfileVersion is the version of the bagit-profiles spec
+// that ExportBagItProfile writes.
+// See https://bagit-profiles.github.io/bagit-profiles-specification/
+const BagItProfileVersion = "1.3.0"
+
+// knownBagItVersions are the versions of the BagIt spec the
+// validator knows how to read.
+var knownBagItVersions = []string{"0.96", "0.97", "1.0"}
+
+var manifestNamePattern = "manifest-%s.txt"
+var tagManifestNamePattern = "tagmanifest-%s.txt"
+
+var manifestNameRegex = regexp.MustCompile(`^manifest-(\w+)\.txt$`)
+var tagManifestNameRegex = regexp.MustCompile(`^tagmanifest-(\w+)\.txt$`)
+
+// BagItProfileInfo describes the profile itself: who publishes it,
+// where to find it, and which version of it this is.
+type BagItProfileInfo struct {
+	BagItProfileIdentifier string `json:"BagIt-Profile-Identifier"`
+	BagItProfileVersion    string `json:"BagIt-Profile-Version"`
+	SourceOrganization     string `json:"Source-Organization"`
+	ExternalDescription    string `json:"External-Description"`
+	Version                string `json:"Version"`
+	ContactName            string `json:"Contact-Name,omitempty"`
+	ContactEmail           string `json:"Contact-Email,omitempty"`
+}
+
+// ProfileTagDef describes a single tag in a BagIt profile.
+type ProfileTagDef struct {
+	// Required indicates whether the tag must be present
+	// and have a non-empty value.
+	Required bool `json:"required"`
+	// Values lists the allowed values for the tag. If this
+	// is empty, any value is allowed.
+	Values []string `json:"values,omitempty"`
+	// Repeatable indicates whether the tag may appear more than
+	// once. The spec says a missing value means true.
+	Repeatable *bool `json:"repeatable,omitempty"`
+	// Description is a human-readable description of the tag.
+	Description string `json:"description,omitempty"`
+}
+
+// BagItProfile is a BagIt profile as described in the community
+// bagit-profiles spec at
+// https://bagit-profiles.github.io/bagit-profiles-specification/.
+// DART uses the same format.
+type BagItProfile struct {
+	BagItProfileInfo     BagItProfileInfo         `json:"BagIt-Profile-Info"`
+	BagInfo              map[string]ProfileTagDef `json:"Bag-Info"`
+	ManifestsRequired    []string                 `json:"Manifests-Required"`
+	ManifestsAllowed     []string                 `json:"Manifests-Allowed,omitempty"`
+	AllowFetchTxt        bool                     `json:"Allow-Fetch.txt"`
+	Serialization        string                   `json:"Serialization"`
+	AcceptSerialization  []string                 `json:"Accept-Serialization"`
+	AcceptBagItVersion   []string                 `json:"Accept-BagIt-Version"`
+	TagManifestsRequired []string                 `json:"Tag-Manifests-Required"`
+	TagManifestsAllowed  []string                 `json:"Tag-Manifests-Allowed,omitempty"`
+	TagFilesRequired     []string                 `json:"Tag-Files-Required"`
+	// TagFileInfo is an APTrust extension to the bagit-profiles spec.
+	// It describes tags in tag files other than bag-info.txt, such as
+	// aptrust-info.txt. The key is the path of the tag file, and the
+	// value has the same format as BagInfo. Other consumers of the
+	// profile will ignore this.
+	TagFileInfo map[string]map[string]ProfileTagDef `json:"Tag-File-Info,omitempty"`
+}
+
+// NewBagItProfile returns a new, empty BagItProfile.
+func NewBagItProfile() *BagItProfile {
+	return &BagItProfile{
+		BagInfo:              make(map[string]ProfileTagDef),
+		ManifestsRequired:    make([]string, 0),
+		AcceptSerialization:  make([]string, 0),
+		AcceptBagItVersion:   make([]string, 0),
+		TagManifestsRequired: make([]string, 0),
+		TagFilesRequired:     make([]string, 0),
+		TagFileInfo:          make(map[string]map[string]ProfileTagDef),
+	}
+}
+
+// LoadBagItProfile loads a BagIt profile from the JSON file at
+// pathToProfile. As with LoadBagValidationConfig, relative paths
+// are considered relative to EXCHANGE_HOME.
+func LoadBagItProfile(pathToProfile string) (*BagItProfile, error) {
+	var file []byte
+	absPath, err := filepath.Abs(pathToProfile)
+	if err == nil && absPath == pathToProfile {
+		file, err = ioutil.ReadFile(pathToProfile)
+	} else {
+		file, err = fileutil.LoadRelativeFile(pathToProfile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading BagIt profile '%s': %v", pathToProfile, err)
+	}
+	profile := NewBagItProfile()
+	err = json.Unmarshal(file, profile)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing JSON from BagIt profile '%s': %v", pathToProfile, err)
+	}
+	return profile, nil
+}
+
+// LoadBagValidationConfigFromProfile loads the BagIt profile at
+// pathToProfile and converts it to a BagValidationConfig. Like
+// LoadBagValidationConfig, it returns a list of errors, which
+// will be empty if the profile is valid.
+func LoadBagValidationConfigFromProfile(pathToProfile string) (*BagValidationConfig, []error) {
+	profile, err := LoadBagItProfile(pathToProfile)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return profile.ToBagValidationConfig()
+}
+
+// ToJSON returns the profile as pretty-printed JSON.
+func (profile *BagItProfile) ToJSON() ([]byte, error) {
+	return json.MarshalIndent(profile, "", "    ")
+}
+
+// ToBagValidationConfig converts this profile to a BagValidationConfig
+// that the Validator can enforce. The returned list of errors describes
+// problems with the profile, and will be empty if the profile is valid.
+//
+// Manifests-Allowed and Tag-Manifests-Allowed become forbidden file specs
+// for the manifests and tag manifests of every other algorithm the
+// validator supports. The validator can't recognize manifests for
+// algorithms it doesn't support, so it can't reject those.
+func (profile *BagItProfile) ToBagValidationConfig() (*BagValidationConfig, []error) {
+	errors := make([]error, 0)
+	config := NewBagValidationConfig()
+	config.AllowFetchTxt = profile.AllowFetchTxt
+	config.AllowMiscTopLevelFiles = true
+	config.AllowMiscDirectories = true
+	config.FileNamePattern = "PERMISSIVE"
+	config.AcceptBagItVersion = profile.AcceptBagItVersion
+	config.AcceptSerialization = profile.AcceptSerialization
+
+	config.Serialization = strings.ToLower(profile.Serialization)
+	if config.Serialization == "" {
+		config.Serialization = OPTIONAL
+	}
+
+	for _, tagFile := range profile.TagFilesRequired {
+		config.FileSpecs[tagFile] = FileSpec{Presence: REQUIRED}
+	}
+	// bagit.txt is always required and always parsed, so we
+	// can check the BagIt-Version.
+	config.FileSpecs["bagit.txt"] = FileSpec{Presence: REQUIRED, ParseAsTagFile: true}
+
+	for _, alg := range profile.ManifestsRequired {
+		alg = strings.ToLower(alg)
+		config.FileSpecs[fmt.Sprintf(manifestNamePattern, alg)] = FileSpec{Presence: REQUIRED}
+		profile.addRequiredAlgorithm(config, alg, &errors)
+	}
+	for _, alg := range profile.TagManifestsRequired {
+		alg = strings.ToLower(alg)
+		config.FileSpecs[fmt.Sprintf(tagManifestNamePattern, alg)] = FileSpec{Presence: REQUIRED}
+		profile.addRequiredAlgorithm(config, alg, &errors)
+	}
+	profile.forbidManifests(config, manifestNamePattern,
+		profile.ManifestsAllowed, profile.ManifestsRequired, "Manifests", &errors)
+	profile.forbidManifests(config, tagManifestNamePattern,
+		profile.TagManifestsAllowed, profile.TagManifestsRequired, "Tag-Manifests", &errors)
+
+	// If the profile doesn't restrict which manifests are allowed,
+	// the bag may include manifests for any algorithm, so we
+	// calculate every digest we know how to verify.
+	allowedAlgs := profile.ManifestsAllowed
+	if len(allowedAlgs) == 0 {
+		allowedAlgs = constants.ChecksumAlgorithms
+	}
+	for _, alg := range allowedAlgs {
+		alg = strings.ToLower(alg)
+		if util.StringListContains(constants.ChecksumAlgorithms, alg) &&
+			!util.StringListContains(config.FixityAlgorithms, alg) {
+			config.FixityAlgorithms = append(config.FixityAlgorithms, alg)
+		}
+	}
+
+	profile.addTagSpecs(config, "bag-info.txt", profile.BagInfo)
+	for tagFile, tagDefs := range profile.TagFileInfo {
+		profile.addTagSpecs(config, tagFile, tagDefs)
+	}
+
+	errors = append(errors, config.ValidateConfig()...)
+	regexErr := config.CompileFileNameRegex()
+	if regexErr != nil {
+		errors = append(errors, regexErr)
+	}
+	return config, errors
+}
+
+// addRequiredAlgorithm adds alg to the config's list of fixity
+// algorithms, if it's not already there. It adds an error to errors
+// if the validator doesn't support the algorithm.
+func (profile *BagItProfile) addRequiredAlgorithm(config *BagValidationConfig, alg string, errors *[]error) {
+	if !util.StringListContains(constants.ChecksumAlgorithms, alg) {
+		*errors = append(*errors, fmt.Errorf(
+			"Profile requires unsupported digest algorithm '%s'.", alg))
+		return
+	}
+	if !util.StringListContains(config.FixityAlgorithms, alg) {
+		config.FixityAlgorithms = append(config.FixityAlgorithms, alg)
+	}
+}
+
+// forbidManifests adds a forbidden file spec for the manifest of each
+// supported algorithm that is not in allowed. If allowed is empty,
+// manifests for any algorithm are allowed. It adds an error to errors
+// for each required algorithm that is not allowed. Param fieldName is
+// the profile field prefix used in error messages.
+func (profile *BagItProfile) forbidManifests(config *BagValidationConfig, namePattern string, allowed, required []string, fieldName string, errors *[]error) {
+	if len(allowed) == 0 {
+		return
+	}
+	allowedAlgs := make([]string, len(allowed))
+	for i, alg := range allowed {
+		allowedAlgs[i] = strings.ToLower(alg)
+	}
+	for _, alg := range required {
+		if !util.StringListContains(allowedAlgs, strings.ToLower(alg)) {
+			*errors = append(*errors, fmt.Errorf(
+				"%s-Required includes '%s', which is not in %s-Allowed.", fieldName, alg, fieldName))
+		}
+	}
+	for _, alg := range constants.ChecksumAlgorithms {
+		if !util.StringListContains(allowedAlgs, alg) {
+			config.FileSpecs[fmt.Sprintf(namePattern, alg)] = FileSpec{Presence: FORBIDDEN}
+		}
+	}
+}
+
+// addTagSpecs converts the profile's tag definitions for a single
+// tag file to TagSpecs. If any of the tags are defined, the tag
+// file must be parsed.
+func (profile *BagItProfile) addTagSpecs(config *BagValidationConfig, tagFile string, tagDefs map[string]ProfileTagDef) {
+	if len(tagDefs) == 0 {
+		return
+	}
+	fileSpec, ok := config.FileSpecs[tagFile]
+	if !ok {
+		fileSpec = FileSpec{Presence: OPTIONAL}
+	}
+	fileSpec.ParseAsTagFile = true
+	config.FileSpecs[tagFile] = fileSpec
+	for tagName, tagDef := range tagDefs {
+		presence := OPTIONAL
+		if tagDef.Required {
+			presence = REQUIRED
+		}
+		tagSpec := TagSpec{
+			FilePath:      tagFile,
+			Presence:      presence,
+			EmptyOK:       !tagDef.Required,
+			AllowedValues: tagDef.Values,
+		}
+		if tagDef.Repeatable != nil && !*tagDef.Repeatable {
+			tagSpec.MaxCount = 1
+		}
+		config.TagSpecs[tagName] = tagSpec
+	}
+}
+
+// readableSerializationTypes returns the primary mime type of each
+// serialization format the validator can read, in sorted order.
+func readableSerializationTypes() []string {
+	mimeTypes := make([]string, 0, len(serializationFormats))
+	for _, types := range serializationFormats {
+		if !util.StringListContains(mimeTypes, types[0]) {
+			mimeTypes = append(mimeTypes, types[0])
+		}
+	}
+	sort.Strings(mimeTypes)
+	return mimeTypes
+}
+
+// ExportBagItProfile converts a BagValidationConfig into a BagIt profile,
+// so that depositors can check their bags against the same rules we use
+// with any tool that understands BagIt profiles. Param info describes
+// the profile itself.
+//
+// Some of our rules, such as FileNamePattern, forbidden files and tags,
+// and tag patterns, formats and rules, have no equivalent in the
+// bagit-profiles spec, so they are not exported. Since our config allows
+// manifests for any algorithm, the profile does not list Manifests-Allowed
+// or Tag-Manifests-Allowed. If the config accepts any BagIt version,
+// the profile lists the versions the validator knows how to read.
+func ExportBagItProfile(config *BagValidationConfig, info BagItProfileInfo) *BagItProfile {
+	profile := NewBagItProfile()
+	if info.BagItProfileVersion == "" {
+		info.BagItProfileVersion = BagItProfileVersion
+	}
+	profile.BagItProfileInfo = info
+	profile.AllowFetchTxt = config.AllowFetchTxt
+	profile.Serialization = config.Serialization
+	if profile.Serialization == "" {
+		profile.Serialization = OPTIONAL
+	}
+	if len(config.AcceptBagItVersion) > 0 {
+		profile.AcceptBagItVersion = config.AcceptBagItVersion
+	} else {
+		profile.AcceptBagItVersion = knownBagItVersions
+	}
+	// The spec requires Accept-Serialization unless serialization is
+	// forbidden. An empty list in our config means we accept any format
+	// the validator can read, so we list those.
+	if len(config.AcceptSerialization) > 0 {
+		profile.AcceptSerialization = config.AcceptSerialization
+	} else if profile.Serialization != FORBIDDEN {
+		profile.AcceptSerialization = readableSerializationTypes()
+	}
+
+	filePaths := make([]string, 0, len(config.FileSpecs))
+	for filePath := range config.FileSpecs {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+	for _, filePath := range filePaths {
+		fileSpec := config.FileSpecs[filePath]
+		if fileSpec.Presence == FORBIDDEN {
+			continue
+		}
+		if match := manifestNameRegex.FindStringSubmatch(filePath); match != nil {
+			alg := match[1]
+			if fileSpec.Presence == REQUIRED {
+				profile.ManifestsRequired = append(profile.ManifestsRequired, alg)
+			}
+		} else if match := tagManifestNameRegex.FindStringSubmatch(filePath); match != nil {
+			alg := match[1]
+			if fileSpec.Presence == REQUIRED {
+				profile.TagManifestsRequired = append(profile.TagManifestsRequired, alg)
+			}
+		} else if fileSpec.Presence == REQUIRED {
+			profile.TagFilesRequired = append(profile.TagFilesRequired, filePath)
+		}
+	}
+
+	for tagName, tagSpec := range config.TagSpecs {
+		if tagSpec.Presence == FORBIDDEN {
+			continue
+		}
+		tagDef := ProfileTagDef{
+			Required: tagSpec.Presence == REQUIRED && !tagSpec.EmptyOK,
+			Values:   tagSpec.AllowedValues,
+		}
+		if tagSpec.MaxCount == 1 {
+			repeatable := false
+			tagDef.Repeatable = &repeatable
+		}
+		if tagSpec.FilePath == "bag-info.txt" {
+			profile.BagInfo[tagName] = tagDef
+			continue
+		}
+		if profile.TagFileInfo[tagSpec.FilePath] == nil {
+			profile.TagFileInfo[tagSpec.FilePath] = make(map[string]ProfileTagDef)
+		}
+		profile.TagFileInfo[tagSpec.FilePath][tagName] = tagDef
+	}
+	return profile
+}
@@ -0,0 +1,226 @@
+package validation_test
+
+import (
+	"encoding/json"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path"
+	"testing"
+)
+
+var aptrustProfilePath = path.Join("config", "aptrust_bagit_profile.json")
+
+func getProfileConfig(t *testing.T) *validation.BagValidationConfig {
+	conf, errors := validation.LoadBagValidationConfigFromProfile(aptrustProfilePath)
+	require.Empty(t, errors)
+	require.NotNil(t, conf)
+	return conf
+}
+
+func validateWithConfig(t *testing.T, bagName string, conf *validation.BagValidationConfig) *models.WorkSummary {
+	validator, err := validation.NewValidator(getBagPath(t, bagName), conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	return summary
+}
+
+func TestLoadBagItProfile(t *testing.T) {
+	profile, err := validation.LoadBagItProfile(aptrustProfilePath)
+	require.Nil(t, err)
+	require.NotNil(t, profile)
+	assert.Equal(t, "aptrust.org", profile.BagItProfileInfo.SourceOrganization)
+	assert.Equal(t, []string{"md5"}, profile.ManifestsRequired)
+	assert.False(t, profile.AllowFetchTxt)
+	assert.Equal(t, "optional", profile.Serialization)
+	assert.Equal(t, 3, len(profile.TagFilesRequired))
+	require.NotNil(t, profile.TagFileInfo["aptrust-info.txt"])
+	assert.True(t, profile.TagFileInfo["aptrust-info.txt"]["Title"].Required)
+	assert.Equal(t, 3, len(profile.TagFileInfo["aptrust-info.txt"]["Access"].Values))
+
+	_, err = validation.LoadBagItProfile(path.Join("config", "file_does_not_exist.json"))
+	assert.NotNil(t, err)
+}
+
+func TestBagItProfileToBagValidationConfig(t *testing.T) {
+	conf := getProfileConfig(t)
+	assert.False(t, conf.AllowFetchTxt)
+	assert.Equal(t, validation.OPTIONAL, conf.Serialization)
+	assert.Equal(t, []string{"md5", "sha1", "sha256", "sha512"}, conf.FixityAlgorithms)
+
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["manifest-md5.txt"].Presence)
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["bagit.txt"].Presence)
+	assert.True(t, conf.FileSpecs["bagit.txt"].ParseAsTagFile)
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["aptrust-info.txt"].Presence)
+	assert.True(t, conf.FileSpecs["aptrust-info.txt"].ParseAsTagFile)
+
+	assert.Equal(t, "aptrust-info.txt", conf.TagSpecs["Title"].FilePath)
+	assert.Equal(t, validation.REQUIRED, conf.TagSpecs["Title"].Presence)
+	assert.False(t, conf.TagSpecs["Title"].EmptyOK)
+	assert.Equal(t, validation.OPTIONAL, conf.TagSpecs["Description"].Presence)
+	assert.True(t, conf.TagSpecs["Description"].EmptyOK)
+	assert.Equal(t, 3, len(conf.TagSpecs["Access"].AllowedValues))
+}
+
+func TestBagItProfileToBagValidationConfig_Errors(t *testing.T) {
+	profile := validation.NewBagItProfile()
+	profile.ManifestsRequired = []string{"md5", "blake2b"}
+	profile.Serialization = "sometimes"
+	_, errors := profile.ToBagValidationConfig()
+	require.Equal(t, 2, len(errors))
+	assert.Equal(t, "Profile requires unsupported digest algorithm 'blake2b'.", errors[0].Error())
+	assert.Equal(t, "Serialization 'sometimes' is not a valid presence value.", errors[1].Error())
+}
+
+// The profile we publish in the config directory should always
+// match the config we use for ingest.
+func TestExportBagItProfile(t *testing.T) {
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	published, err := validation.LoadBagItProfile(aptrustProfilePath)
+	require.Nil(t, err)
+
+	profile := validation.ExportBagItProfile(conf, published.BagItProfileInfo)
+	assert.Equal(t, []string{"md5"}, profile.ManifestsRequired)
+	assert.Empty(t, profile.TagManifestsRequired)
+	assert.Equal(t, []string{"aptrust-info.txt", "bag-info.txt", "bagit.txt"}, profile.TagFilesRequired)
+	assert.Equal(t, 4, len(profile.TagFileInfo["aptrust-info.txt"]))
+
+	exported, err := profile.ToJSON()
+	require.Nil(t, err)
+	publishedJson, err := fileutil.LoadRelativeFile(aptrustProfilePath)
+	require.Nil(t, err)
+	var expected, actual interface{}
+	require.Nil(t, json.Unmarshal(publishedJson, &expected))
+	require.Nil(t, json.Unmarshal(exported, &actual))
+	assert.Equal(t, expected, actual,
+		"config/aptrust_bagit_profile.json is out of date. Regenerate it with apt_validate --export-profile.")
+}
+
+// Accept-BagIt-Version and the other fields the spec requires must
+// appear in the exported JSON, even when our config doesn't restrict them.
+func TestExportBagItProfile_RequiredFields(t *testing.T) {
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	exported, err := validation.ExportBagItProfile(conf, validation.BagItProfileInfo{}).ToJSON()
+	require.Nil(t, err)
+	var actual map[string]interface{}
+	require.Nil(t, json.Unmarshal(exported, &actual))
+	assert.Equal(t, []interface{}{"0.96", "0.97", "1.0"}, actual["Accept-BagIt-Version"])
+	assert.Equal(t, []interface{}{"application/gzip", "application/tar", "application/zip"},
+		actual["Accept-Serialization"])
+	info := actual["BagIt-Profile-Info"].(map[string]interface{})
+	assert.Equal(t, validation.BagItProfileVersion, info["BagIt-Profile-Version"])
+
+	exported, err = validation.ExportBagItProfile(validation.NewBagValidationConfig(), validation.BagItProfileInfo{}).ToJSON()
+	require.Nil(t, err)
+	actual = nil
+	require.Nil(t, json.Unmarshal(exported, &actual))
+	assert.Equal(t, []interface{}{"0.96", "0.97", "1.0"}, actual["Accept-BagIt-Version"])
+
+	conf.AcceptBagItVersion = []string{"1.0"}
+	profile := validation.ExportBagItProfile(conf, validation.BagItProfileInfo{})
+	assert.Equal(t, []string{"1.0"}, profile.AcceptBagItVersion)
+}
+
+func TestValidator_WithBagItProfile(t *testing.T) {
+	conf := getProfileConfig(t)
+	summary := validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	summary = validateWithConfig(t, "example.edu.tagsample_bad.tar", conf)
+	assert.True(t, util.StringListContains(summary.Errors, err_3))
+	assert.True(t, util.StringListContains(summary.Errors, err_4))
+}
+
+func TestValidator_ManifestsAllowed(t *testing.T) {
+	profile, err := validation.LoadBagItProfile(aptrustProfilePath)
+	require.Nil(t, err)
+	profile.ManifestsAllowed = []string{"md5", "sha256"}
+	profile.TagManifestsAllowed = []string{"md5", "sha256"}
+	conf, errors := profile.ToBagValidationConfig()
+	require.Empty(t, errors)
+	assert.Equal(t, validation.FORBIDDEN, conf.FileSpecs["manifest-sha1.txt"].Presence)
+	assert.Equal(t, validation.FORBIDDEN, conf.FileSpecs["tagmanifest-sha512.txt"].Presence)
+	summary := validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	profile.ManifestsAllowed = []string{"md5"}
+	profile.TagManifestsAllowed = []string{"sha256"}
+	conf, errors = profile.ToBagValidationConfig()
+	require.Empty(t, errors)
+	summary = validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.True(t, util.StringListContains(summary.Errors,
+		"Bag contains forbidden file 'manifest-sha256.txt'."))
+	assert.True(t, util.StringListContains(summary.Errors,
+		"Bag contains forbidden file 'tagmanifest-md5.txt'."))
+
+	profile.ManifestsAllowed = []string{"sha256"}
+	_, errors = profile.ToBagValidationConfig()
+	require.Equal(t, 1, len(errors))
+	assert.Equal(t, "Manifests-Required includes 'md5', which is not in Manifests-Allowed.", errors[0].Error())
+}
+
+func TestValidator_AcceptBagItVersion(t *testing.T) {
+	conf := getProfileConfig(t)
+	conf.AcceptBagItVersion = []string{"0.97", "1.0"}
+	summary := validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	conf.AcceptBagItVersion = []string{"1.0"}
+	summary = validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.True(t, util.StringListContains(summary.Errors,
+		"BagIt-Version '0.97' is not accepted. Accepted versions: 1.0"))
+}
+
+func TestValidator_Serialization(t *testing.T) {
+	conf := getProfileConfig(t)
+	conf.Serialization = validation.FORBIDDEN
+	summary := validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.True(t, util.StringListContains(summary.Errors,
+		"Bag must not be serialized, but it is a .tar file."))
+
+	conf.Serialization = validation.REQUIRED
+	conf.AcceptSerialization = []string{"application/zip"}
+	summary = validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.True(t, util.StringListContains(summary.Errors,
+		"Serialization format .tar is not accepted. Accepted formats: application/zip"))
+
+	conf.AcceptSerialization = []string{"application/tar"}
+	summary = validateWithConfig(t, "example.edu.tagsample_good.tar", conf)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	conf.AcceptSerialization = []string{"application/zip"}
+	summary = validateWithConfig(t, "example.edu.tagsample_good.zip", conf)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	conf.AcceptSerialization = []string{"application/tar"}
+	summary = validateWithConfig(t, "example.edu.tagsample_good.tar.gz", conf)
+	assert.True(t, util.StringListContains(summary.Errors,
+		"Serialization format .tar.gz is not accepted. Accepted formats: application/tar"))
+
+	conf.AcceptSerialization = []string{"application/gzip"}
+	summary = validateWithConfig(t, "example.edu.tagsample_good.tar.gz", conf)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+}
+
+func TestBagItProfile_Repeatable(t *testing.T) {
+	notRepeatable := false
+	profile := validation.NewBagItProfile()
+	profile.BagInfo["Bagging-Date"] = validation.ProfileTagDef{Required: true, Repeatable: &notRepeatable}
+	profile.BagInfo["Contact-Name"] = validation.ProfileTagDef{}
+	conf, errors := profile.ToBagValidationConfig()
+	require.Empty(t, errors)
+	assert.Equal(t, 1, conf.TagSpecs["Bagging-Date"].MaxCount)
+	assert.Equal(t, 0, conf.TagSpecs["Contact-Name"].MaxCount)
+
+	exported := validation.ExportBagItProfile(conf, validation.BagItProfileInfo{})
+	require.NotNil(t, exported.BagInfo["Bagging-Date"].Repeatable)
+	assert.False(t, *exported.BagInfo["Bagging-Date"].Repeatable)
+	assert.Nil(t, exported.BagInfo["Contact-Name"].Repeatable)
+}
@@ -0,0 +1,116 @@
+package validation
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FetchTxtFile is the name of the tag file that lists payload files
+// a holey bag doesn't contain, and says where to get them.
+const FetchTxtFile = "fetch.txt"
+
+// UnknownFetchLength is the Length of a FetchItem whose line in
+// fetch.txt has "-" instead of a length.
+const UnknownFetchLength = int64(-1)
+
+// fetchLineRegex splits a line of fetch.txt into URL, length and
+// file path. The file path is the rest of the line, since it may
+// contain spaces.
+var fetchLineRegex = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(.+)$`)
+
+// FetchItem is one line of a bag's fetch.txt file.
+type FetchItem struct {
+	// URL is where to get the file, e.g. "s3://bucket/key" or
+	// "file:///mnt/shared/file.pdf".
+	URL string
+	// Length is the size of the file in bytes, or UnknownFetchLength
+	// if fetch.txt doesn't say.
+	Length int64
+	// FilePath is where the file belongs in the bag, relative to the
+	// bag's root directory, e.g. "data/images/photo.jpg".
+	FilePath string
+	// LineNumber is the line of fetch.txt that describes this item,
+	// starting at 1.
+	LineNumber int
+}
+
+// ParseFetchTxt parses the contents of fetch.txt. Each line has a URL,
+// a length in bytes (or "-" if the length is unknown) and a file path,
+// separated by whitespace. RFC 8493 says the file path must be in the
+// payload directory, and must encode CR, LF and % as %0D, %0A and %25.
+//
+// ParseFetchTxt returns the items it could parse, along with an
+// error for each line it couldn't.
+func ParseFetchTxt(reader io.Reader) ([]*FetchItem, []*ValidationError) {
+	items := make([]*FetchItem, 0)
+	validationErrors := make([]*ValidationError, 0)
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		lineNum += 1
+		if lineNum == 1 {
+			line = strings.TrimPrefix(line, utf8BOM)
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		item, validationError := parseFetchLine(line, lineNum)
+		if validationError != nil {
+			validationError.Manifest = FetchTxtFile
+			validationError.LineNumber = lineNum
+			validationErrors = append(validationErrors, validationError)
+			continue
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		validationErrors = append(validationErrors,
+			NewValidationError(ErrReadError, "Error reading %s: %v", FetchTxtFile, err))
+	}
+	return items, validationErrors
+}
+
+// parseFetchLine parses one line of fetch.txt.
+func parseFetchLine(line string, lineNum int) (*FetchItem, *ValidationError) {
+	data := fetchLineRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if data == nil {
+		return nil, NewValidationError(ErrFetchTxtSyntax,
+			"Unable to parse data from line %d of %s: %s", lineNum, FetchTxtFile, line)
+	}
+	item := &FetchItem{
+		URL:        data[1],
+		Length:     UnknownFetchLength,
+		LineNumber: lineNum,
+	}
+	if data[2] != "-" {
+		length, err := strconv.ParseInt(data[2], 10, 64)
+		if err != nil || length < 0 {
+			return nil, NewValidationError(ErrFetchTxtSyntax,
+				"Length '%s' on line %d of %s is not a number of bytes or '-'",
+				data[2], lineNum, FetchTxtFile)
+		}
+		item.Length = length
+	}
+	filePath, ok := decodeManifestPath(data[3])
+	if !ok {
+		validationError := NewValidationError(ErrPathEncoding,
+			"File path '%s' in %s contains a percent sign that is not encoded as %%25",
+			data[3], FetchTxtFile)
+		validationError.FilePath = data[3]
+		return nil, validationError
+	}
+	item.FilePath = filePath
+	if !strings.HasPrefix(filePath, "data/") || path.Clean(filePath) != filePath {
+		validationError := NewValidationError(ErrFetchTxtSyntax,
+			"File path '%s' on line %d of %s is not in the payload directory",
+			filePath, lineNum, FetchTxtFile)
+		validationError.FilePath = filePath
+		return nil, validationError
+	}
+	return item, nil
+}
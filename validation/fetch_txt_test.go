@@ -0,0 +1,58 @@
+package validation_test
+
+import (
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParseFetchTxt(t *testing.T) {
+	fetchTxt := "s3://bucket/key/photo.jpg 1234 data/images/photo.jpg\r\n" +
+		"\n" +
+		"file:///mnt/shared/notes.txt\t-\tdata/my notes%25.txt\n"
+	items, validationErrors := validation.ParseFetchTxt(strings.NewReader(fetchTxt))
+	assert.Empty(t, validationErrors)
+	require.Equal(t, 2, len(items))
+
+	assert.Equal(t, "s3://bucket/key/photo.jpg", items[0].URL)
+	assert.EqualValues(t, 1234, items[0].Length)
+	assert.Equal(t, "data/images/photo.jpg", items[0].FilePath)
+	assert.Equal(t, 1, items[0].LineNumber)
+
+	assert.Equal(t, "file:///mnt/shared/notes.txt", items[1].URL)
+	assert.Equal(t, validation.UnknownFetchLength, items[1].Length)
+	assert.Equal(t, "data/my notes%.txt", items[1].FilePath)
+	assert.Equal(t, 3, items[1].LineNumber)
+}
+
+func TestParseFetchTxt_Errors(t *testing.T) {
+	fetchTxt := "s3://bucket/key data/file.txt\n" +
+		"s3://bucket/key many data/file.txt\n" +
+		"s3://bucket/key -1 data/file.txt\n" +
+		"s3://bucket/key 10 bag-info.txt\n" +
+		"s3://bucket/key 10 data/../bag-info.txt\n" +
+		"s3://bucket/key 10 data/100%.txt\n" +
+		"s3://bucket/key 10 data/good.txt\n"
+	items, validationErrors := validation.ParseFetchTxt(strings.NewReader(fetchTxt))
+	require.Equal(t, 1, len(items))
+	assert.Equal(t, "data/good.txt", items[0].FilePath)
+
+	require.Equal(t, 6, len(validationErrors))
+	for i, validationError := range validationErrors {
+		assert.Equal(t, "fetch.txt", validationError.Manifest)
+		assert.Equal(t, i+1, validationError.LineNumber)
+	}
+	assert.Equal(t, validation.ErrFetchTxtSyntax, validationErrors[0].Code)
+	assert.Equal(t, "Unable to parse data from line 1 of fetch.txt: s3://bucket/key data/file.txt",
+		validationErrors[0].Message)
+	assert.Equal(t, "Length 'many' on line 2 of fetch.txt is not a number of bytes or '-'",
+		validationErrors[1].Message)
+	assert.Equal(t, validation.ErrFetchTxtSyntax, validationErrors[2].Code)
+	assert.Equal(t, "File path 'bag-info.txt' on line 4 of fetch.txt is not in the payload directory",
+		validationErrors[3].Message)
+	assert.Equal(t, validation.ErrFetchTxtSyntax, validationErrors[4].Code)
+	assert.Equal(t, validation.ErrPathEncoding, validationErrors[5].Code)
+	assert.Equal(t, "data/100%.txt", validationErrors[5].FilePath)
+}
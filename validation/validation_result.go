@@ -0,0 +1,288 @@
+package validation
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrorCode identifies the kind of problem the validator found.
+// Codes are stable, so tools can filter and count them without
+// parsing error messages, which may change.
+type ErrorCode string
+
+const (
+	ErrBackslashPath          ErrorCode = "BACKSLASH_PATH"
+	ErrBadDigest              ErrorCode = "BAD_DIGEST"
+	ErrBagItBOM               ErrorCode = "BAGIT_BOM"
+	ErrBagItVersion           ErrorCode = "BAGIT_VERSION"
+	ErrCaseCollision          ErrorCode = "CASE_COLLISION"
+	ErrDuplicatePayloadFile   ErrorCode = "DUPLICATE_PAYLOAD_FILE"
+	ErrFetchItemMissing       ErrorCode = "FETCH_ITEM_MISSING"
+	ErrFetchTxtNotAllowed     ErrorCode = "FETCH_TXT_NOT_ALLOWED"
+	ErrFetchTxtSyntax         ErrorCode = "FETCH_TXT_SYNTAX"
+	ErrFileNotInBag           ErrorCode = "FILE_NOT_IN_BAG"
+	ErrFileNotInEveryManifest ErrorCode = "FILE_NOT_IN_EVERY_MANIFEST"
+	ErrFileNotInManifest      ErrorCode = "FILE_NOT_IN_MANIFEST"
+	ErrForbiddenFile          ErrorCode = "FORBIDDEN_FILE"
+	ErrForbiddenTag           ErrorCode = "FORBIDDEN_TAG"
+	ErrIllegalFileName        ErrorCode = "ILLEGAL_FILE_NAME"
+	ErrInternal               ErrorCode = "INTERNAL_ERROR"
+	ErrManifestConflict       ErrorCode = "MANIFEST_CONFLICT"
+	ErrManifestSyntax         ErrorCode = "MANIFEST_SYNTAX"
+	ErrNormalizationCollision ErrorCode = "NORMALIZATION_COLLISION"
+	ErrNoPayloadManifest      ErrorCode = "NO_PAYLOAD_MANIFEST"
+	ErrPathEncoding           ErrorCode = "PATH_ENCODING"
+	ErrPayloadOxum            ErrorCode = "PAYLOAD_OXUM"
+	ErrReadError              ErrorCode = "READ_ERROR"
+	ErrRequiredFileMissing    ErrorCode = "REQUIRED_FILE_MISSING"
+	ErrRequiredTagMissing     ErrorCode = "REQUIRED_TAG_MISSING"
+	ErrSerialization          ErrorCode = "SERIALIZATION"
+	ErrTagCount               ErrorCode = "TAG_COUNT"
+	ErrTagFileSyntax          ErrorCode = "TAG_FILE_SYNTAX"
+	ErrTagValueMissing        ErrorCode = "TAG_VALUE_MISSING"
+	ErrTagRule                ErrorCode = "TAG_RULE"
+	ErrTagValueFormat         ErrorCode = "TAG_VALUE_FORMAT"
+	ErrTagValueNotAllowed     ErrorCode = "TAG_VALUE_NOT_ALLOWED"
+	ErrTagValuePattern        ErrorCode = "TAG_VALUE_PATTERN"
+	ErrTopLevelFolder         ErrorCode = "TOP_LEVEL_FOLDER"
+	ErrUnsupportedAlgorithm   ErrorCode = "UNSUPPORTED_ALGORITHM"
+)
+
+// Severity says whether a problem makes the bag invalid.
+type Severity string
+
+const (
+	// SeverityError means the bag is invalid.
+	SeverityError Severity = "error"
+	// SeverityWarning means the bag is valid, but something
+	// about it may not be what the depositor intended.
+	SeverityWarning Severity = "warning"
+)
+
+// MaxResultErrors is the most errors a ValidationResult will hold.
+// Bags with thousands of bad files would otherwise use a lot of
+// memory. See PT #146289839.
+const MaxResultErrors = 1000
+
+// ValidationError describes a single problem with a bag. Fields that
+// don't apply to a problem are empty. For example, FilePath is empty
+// for a missing tag, and Expected and Actual are set only for bad
+// digests.
+type ValidationError struct {
+	Code     ErrorCode `json:"code"`
+	Severity Severity  `json:"severity"`
+	// Message is the same text that appears in the WorkSummary.
+	Message string `json:"message"`
+	// FilePath is the path of the affected file, relative to the
+	// bag's root directory, e.g. "data/images/photo.jpg".
+	FilePath string `json:"file_path,omitempty"`
+	// Manifest is the manifest or tag file where we found the
+	// problem, and LineNumber is the line within it, starting at 1.
+	Manifest   string `json:"manifest,omitempty"`
+	LineNumber int    `json:"line_number,omitempty"`
+	// Algorithm, Expected and Actual describe digest mismatches.
+	// Expected is the digest in the manifest, and Actual is the
+	// digest we calculated.
+	Algorithm string `json:"algorithm,omitempty"`
+	Expected  string `json:"expected,omitempty"`
+	Actual    string `json:"actual,omitempty"`
+}
+
+// NewValidationError returns a ValidationError with severity
+// SeverityError and a message built from format and args.
+func NewValidationError(code ErrorCode, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Code:     code,
+		Severity: SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// ValidationResult is the typed set of problems the validator found
+// in a bag. Unlike the WorkSummary, which holds only messages, it
+// lets tools filter and count problems by code, severity and file.
+type ValidationResult struct {
+	BagPath       string             `json:"bag_path"`
+	ObjIdentifier string             `json:"obj_identifier"`
+	Valid         bool               `json:"valid"`
+	StartedAt     time.Time          `json:"started_at"`
+	FinishedAt    time.Time          `json:"finished_at"`
+	Errors        []*ValidationError `json:"errors"`
+	// Truncated is true if the validator found more than
+	// MaxResultErrors problems, and we dropped the rest.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// NewValidationResult returns an empty result for the bag at bagPath.
+func NewValidationResult(bagPath, objIdentifier string) *ValidationResult {
+	return &ValidationResult{
+		BagPath:       bagPath,
+		ObjIdentifier: objIdentifier,
+		Valid:         true,
+		Errors:        make([]*ValidationError, 0),
+	}
+}
+
+// Add adds a problem to the result. Problems with SeverityError
+// make the bag invalid.
+func (result *ValidationResult) Add(validationError *ValidationError) {
+	if validationError.Severity == SeverityError {
+		result.Valid = false
+	}
+	if len(result.Errors) >= MaxResultErrors {
+		result.Truncated = true
+		return
+	}
+	result.Errors = append(result.Errors, validationError)
+}
+
+// ErrorsWithCode returns the problems that have the specified code.
+func (result *ValidationResult) ErrorsWithCode(code ErrorCode) []*ValidationError {
+	matches := make([]*ValidationError, 0)
+	for _, validationError := range result.Errors {
+		if validationError.Code == code {
+			matches = append(matches, validationError)
+		}
+	}
+	return matches
+}
+
+// ErrorsWithSeverity returns the problems that have the specified severity.
+func (result *ValidationResult) ErrorsWithSeverity(severity Severity) []*ValidationError {
+	matches := make([]*ValidationError, 0)
+	for _, validationError := range result.Errors {
+		if validationError.Severity == severity {
+			matches = append(matches, validationError)
+		}
+	}
+	return matches
+}
+
+// CountByCode returns the number of problems with each code.
+func (result *ValidationResult) CountByCode() map[ErrorCode]int {
+	counts := make(map[ErrorCode]int)
+	for _, validationError := range result.Errors {
+		counts[validationError.Code]++
+	}
+	return counts
+}
+
+// ToJSON returns the result as indented JSON.
+func (result *ValidationResult) ToJSON() ([]byte, error) {
+	return json.MarshalIndent(result, "", "  ")
+}
+
+// junitTestSuites and the types below describe the JUnit XML format
+// that CI servers understand.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Detail  string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// ToJUnit returns the result as JUnit XML, with one failed test case
+// for each error and one skipped test case for each warning. A valid
+// bag with no warnings gets a single passing test case. Test cases
+// are sorted by code, so CI servers group like problems together.
+func (result *ValidationResult) ToJUnit() ([]byte, error) {
+	suite := junitTestSuite{
+		Name:  result.ObjIdentifier,
+		Time:  fmt.Sprintf("%.3f", result.FinishedAt.Sub(result.StartedAt).Seconds()),
+		Cases: make([]junitTestCase, 0),
+	}
+	if !result.StartedAt.IsZero() {
+		suite.Timestamp = result.StartedAt.Format(time.RFC3339)
+	}
+	validationErrors := make([]*ValidationError, len(result.Errors))
+	copy(validationErrors, result.Errors)
+	sort.SliceStable(validationErrors, func(i, j int) bool {
+		return validationErrors[i].Code < validationErrors[j].Code
+	})
+	for _, validationError := range validationErrors {
+		name := string(validationError.Code)
+		if validationError.FilePath != "" {
+			name += " " + validationError.FilePath
+		}
+		testCase := junitTestCase{ClassName: result.ObjIdentifier, Name: name}
+		if validationError.Severity == SeverityWarning {
+			testCase.Skipped = &junitSkipped{Message: validationError.Message}
+			suite.Skipped++
+		} else {
+			testCase.Failure = &junitFailure{
+				Type:    string(validationError.Code),
+				Message: validationError.Message,
+				Detail:  validationError.detail(),
+			}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	if len(suite.Cases) == 0 {
+		suite.Cases = append(suite.Cases, junitTestCase{ClassName: result.ObjIdentifier, Name: "valid"})
+	}
+	suite.Tests = len(suite.Cases)
+	suites := junitTestSuites{
+		Name:     "apt_validate",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Suites:   []junitTestSuite{suite},
+	}
+	data, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// detail describes where the problem is, for the body of a JUnit failure.
+func (validationError *ValidationError) detail() string {
+	detail := ""
+	if validationError.FilePath != "" {
+		detail += fmt.Sprintf("File: %s\n", validationError.FilePath)
+	}
+	if validationError.Manifest != "" {
+		detail += fmt.Sprintf("Manifest: %s\n", validationError.Manifest)
+	}
+	if validationError.LineNumber > 0 {
+		detail += fmt.Sprintf("Line: %d\n", validationError.LineNumber)
+	}
+	if validationError.Algorithm != "" {
+		detail += fmt.Sprintf("Algorithm: %s\n", validationError.Algorithm)
+	}
+	if validationError.Expected != "" || validationError.Actual != "" {
+		detail += fmt.Sprintf("Expected: %s\nActual: %s\n", validationError.Expected, validationError.Actual)
+	}
+	return detail
+}
@@ -0,0 +1,148 @@
+package validation_test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestValidationResult_FromBadBag(t *testing.T) {
+	validator := validatorWithOptionalSpec(t, "example.edu.sample_bad_checksums.tar")
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+
+	result := validator.Result()
+	require.NotNil(t, result)
+	assert.False(t, result.Valid)
+	assert.Equal(t, "example.edu.sample_bad_checksums", result.ObjIdentifier)
+	assert.False(t, result.StartedAt.IsZero())
+	assert.False(t, result.FinishedAt.IsZero())
+
+	// Every error in the summary is in the result.
+	messages := make([]string, len(result.Errors))
+	for i, validationError := range result.Errors {
+		messages[i] = validationError.Message
+	}
+	assert.ElementsMatch(t, summary.Errors, messages)
+
+	badDigests := result.ErrorsWithCode(validation.ErrBadDigest)
+	require.Equal(t, 4, len(badDigests))
+	assert.Equal(t, 4, result.CountByCode()[validation.ErrBadDigest])
+	for _, badDigest := range badDigests {
+		if badDigest.FilePath != "data/datastream-DC" {
+			continue
+		}
+		assert.Equal(t, validation.SeverityError, badDigest.Severity)
+		assert.Equal(t, "manifest-md5.txt", badDigest.Manifest)
+		assert.Equal(t, 1, badDigest.LineNumber)
+		assert.Equal(t, "md5", badDigest.Algorithm)
+		assert.Equal(t, "44d85cf4810d6c6fe877BlahBlahBlah", badDigest.Expected)
+		assert.Equal(t, "44d85cf4810d6c6fe87750117633e461", badDigest.Actual)
+	}
+}
+
+func TestValidationResult_FromGoodBag(t *testing.T) {
+	validator := getValidator(t, "example.edu.tagsample_good.tar", false)
+	defer deleteFile(validator.DBName())
+	_, err := validator.Validate()
+	require.Nil(t, err)
+	result := validator.Result()
+	assert.True(t, result.Valid)
+	assert.Empty(t, result.ErrorsWithSeverity(validation.SeverityError))
+}
+
+func TestValidationResult_Add(t *testing.T) {
+	result := validation.NewValidationResult("/path/to/bag.tar", "bag")
+	warning := validation.NewValidationError(validation.ErrUnsupportedAlgorithm, "Not verifying %s", "manifest-md4.txt")
+	warning.Severity = validation.SeverityWarning
+	result.Add(warning)
+	assert.True(t, result.Valid)
+	assert.Equal(t, "Not verifying manifest-md4.txt", warning.Message)
+
+	result.Add(validation.NewValidationError(validation.ErrNoPayloadManifest, "Bag contains no payload manifest."))
+	assert.False(t, result.Valid)
+	assert.Equal(t, 1, len(result.ErrorsWithSeverity(validation.SeverityWarning)))
+	assert.Equal(t, 1, len(result.ErrorsWithSeverity(validation.SeverityError)))
+
+	for i := 0; i < validation.MaxResultErrors; i++ {
+		result.Add(validation.NewValidationError(validation.ErrBadDigest, "Bad digest %d", i))
+	}
+	assert.Equal(t, validation.MaxResultErrors, len(result.Errors))
+	assert.True(t, result.Truncated)
+}
+
+func TestValidationResult_ToJSON(t *testing.T) {
+	result := validation.NewValidationResult("/path/to/bag.tar", "bag")
+	badDigest := validation.NewValidationError(validation.ErrBadDigest, "Bad md5 digest for 'data/file.txt'")
+	badDigest.FilePath = "data/file.txt"
+	badDigest.Manifest = "manifest-md5.txt"
+	badDigest.LineNumber = 3
+	badDigest.Algorithm = "md5"
+	badDigest.Expected = "1234"
+	badDigest.Actual = "5678"
+	result.Add(badDigest)
+
+	data, err := result.ToJSON()
+	require.Nil(t, err)
+	parsed := &validation.ValidationResult{}
+	require.Nil(t, json.Unmarshal(data, parsed))
+	assert.False(t, parsed.Valid)
+	require.Equal(t, 1, len(parsed.Errors))
+	assert.Equal(t, *badDigest, *parsed.Errors[0])
+	assert.True(t, strings.Contains(string(data), `"code": "BAD_DIGEST"`))
+	assert.True(t, strings.Contains(string(data), `"line_number": 3`))
+}
+
+func TestValidationResult_ToJUnit(t *testing.T) {
+	result := validation.NewValidationResult("/path/to/bag.tar", "bag")
+	data, err := result.ToJUnit()
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "<?xml"))
+	assert.True(t, strings.Contains(string(data), `<testcase classname="bag" name="valid"></testcase>`))
+
+	badDigest := validation.NewValidationError(validation.ErrBadDigest, "Bad md5 digest for 'data/file.txt'")
+	badDigest.FilePath = "data/file.txt"
+	badDigest.LineNumber = 3
+	result.Add(badDigest)
+	warning := validation.NewValidationError(validation.ErrUnsupportedAlgorithm, "Not verifying manifest-md4.txt")
+	warning.Severity = validation.SeverityWarning
+	result.Add(warning)
+
+	data, err = result.ToJUnit()
+	require.Nil(t, err)
+	suites := struct {
+		Tests    int `xml:"tests,attr"`
+		Failures int `xml:"failures,attr"`
+		Suites   []struct {
+			Name    string `xml:"name,attr"`
+			Skipped int    `xml:"skipped,attr"`
+			Cases   []struct {
+				Name    string `xml:"name,attr"`
+				Failure *struct {
+					Type    string `xml:"type,attr"`
+					Message string `xml:"message,attr"`
+					Detail  string `xml:",chardata"`
+				} `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}{}
+	require.Nil(t, xml.Unmarshal(data, &suites))
+	assert.Equal(t, 2, suites.Tests)
+	assert.Equal(t, 1, suites.Failures)
+	require.Equal(t, 1, len(suites.Suites))
+	assert.Equal(t, "bag", suites.Suites[0].Name)
+	assert.Equal(t, 1, suites.Suites[0].Skipped)
+	require.Equal(t, 2, len(suites.Suites[0].Cases))
+	failedCase := suites.Suites[0].Cases[0]
+	assert.Equal(t, "BAD_DIGEST data/file.txt", failedCase.Name)
+	require.NotNil(t, failedCase.Failure)
+	assert.Equal(t, "BAD_DIGEST", failedCase.Failure.Type)
+	assert.Equal(t, "Bad md5 digest for 'data/file.txt'", failedCase.Failure.Message)
+	assert.Equal(t, "File: data/file.txt\nLine: 3\n", failedCase.Failure.Detail)
+	assert.Nil(t, suites.Suites[0].Cases[1].Failure)
+}
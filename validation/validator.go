@@ -2,11 +2,10 @@ package validation
 
 import (
 	"bufio"
-	"crypto/md5"
-	"crypto/sha256"
+	"bytes"
 	"fmt"
-	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"regexp"
@@ -21,12 +20,30 @@ import (
 	"github.com/APTrust/exchange/util/storage"
 	"github.com/google/uuid"
 	"github.com/op/go-logging"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
 const VALIDATION_DB_SUFFIX = ".valdb"
 
 var TAR_SUFFIX = regexp.MustCompile("\\.tar$")
 
+// utf8BOM is the UTF-8 byte-order mark.
+const utf8BOM = "\uFEFF"
+
+// manifestAlgRegex extracts the digest algorithm from the name
+// of a payload or tag manifest.
+var manifestAlgRegex = regexp.MustCompile(`^(?:tag)?manifest-(\w+)\.txt$`)
+
+// serializationFormats maps the file extensions of serialized bags
+// that the validator can read to their mime types.
+var serializationFormats = map[string][]string{
+	".tar":    []string{"application/tar", "application/x-tar"},
+	".tar.gz": []string{"application/gzip", "application/x-gzip"},
+	".tgz":    []string{"application/gzip", "application/x-gzip"},
+	".zip":    []string{"application/zip", "application/x-zip-compressed"},
+}
+
 // Validator validates a BagIt bag using a BagValidationConfig
 // object, which describes the bag's requirements.
 type Validator struct {
@@ -41,8 +58,14 @@ type Validator struct {
 	tagManifests               []string
 	requiredFiles              []string
 	forbiddenFiles             []string
-	calculateMd5               bool
-	calculateSha256            bool
+	algorithms                 []string
+
+	// ExistingFilePaths lists the original paths of files already in
+	// preservation storage for this object, such as the active files
+	// of a previous version in Pharos. If the config has a
+	// FileNameCollisionPolicy, the validator checks new file names
+	// against these.
+	ExistingFilePaths []string
 
 	// Note that we can have only one open reference to the BoltDB
 	// at a time. If some other piece of code has this DB open,
@@ -50,6 +73,38 @@ type Validator struct {
 	// has it open, others will not be able to open it.
 	db *storage.BoltDB
 
+	// reader supplies the contents of a tarred bag that we're
+	// validating as a stream, rather than from a file on disk.
+	// See NewStreamValidator.
+	reader io.Reader
+	// parseBuffers holds the contents of manifests and tag files
+	// that we'll parse after we've read through a streamed bag.
+	parseBuffers []*parseBuffer
+
+	// bagParts lists the paths to the tar files of a multipart bag.
+	// See NewMultipartValidator. currentPart is the path to the part
+	// we're reading, and partDigests holds the digests of the tag
+	// files in each part, keyed by part name and relative path.
+	bagParts    []string
+	currentPart string
+	partDigests map[string]map[string]string
+
+	// result holds the typed version of the errors in summary.
+	// badDigestLines tells us where in the manifests we found each
+	// digest that doesn't match the file, keyed by GenericFile
+	// identifier and algorithm.
+	result         *ValidationResult
+	badDigestLines map[string]manifestLine
+
+	// payloadBytes and payloadFileCount describe the payload we
+	// actually found, for comparison with Payload-Oxum.
+	payloadBytes     int64
+	payloadFileCount int64
+
+	// fetchItems lists the entries in fetch.txt, if the config
+	// allows it. See verifyFetchItems.
+	fetchItems []*FetchItem
+
 	// This is a late addition, hacked in to help diagnose
 	// some issues in validating very large bags. When we rewrite
 	// the validator to work with DART-style bagit profiles, it
@@ -58,8 +113,8 @@ type Validator struct {
 }
 
 // NewValidator creates a new Validator. Param pathToBag
-// should be an absolute path to either the tarred bag (.tar file)
-// or to the untarred bag (a directory). Param bagValidationConfig
+// should be an absolute path to either the serialized bag (a .tar,
+// .tar.gz, .tgz or .zip file) or to the untarred bag (a directory). Param bagValidationConfig
 // defines what we need to validate, in addition to the checksums in the
 // manifests. If param preserveExtendedAttributes is true, the validator
 // will preserve special data attributes used by the APTrust ingest
@@ -68,18 +123,97 @@ type Validator struct {
 // file lists and checksums, and will delete the .valdb database when
 // it's finished.
 func NewValidator(pathToBag string, bagValidationConfig *BagValidationConfig, preserveExtendedAttributes bool) (*Validator, error) {
-	err := validateParams(pathToBag, bagValidationConfig)
+	if !fileutil.FileExists(pathToBag) {
+		return nil, fmt.Errorf("Bag does not exist at %s", pathToBag)
+	}
+	return newValidator(pathToBag, bagValidationConfig, preserveExtendedAttributes)
+}
+
+// NewStreamValidator creates a Validator that reads a tarred bag
+// from reader, which may be a stream from S3. The validator reads
+// the stream only once, so the bag never has to be on local disk.
+// Param pathToBag is where the tar file would be if we had downloaded
+// it. It doesn't have to exist, but the validator uses it to name the
+// bag and the .valdb database, which it creates in the same directory.
+// Other params are the same as for NewValidator.
+func NewStreamValidator(pathToBag string, reader io.Reader, bagValidationConfig *BagValidationConfig, preserveExtendedAttributes bool) (*Validator, error) {
+	if reader == nil {
+		return nil, fmt.Errorf("Param reader cannot be nil")
+	}
+	if !TAR_SUFFIX.MatchString(pathToBag) {
+		return nil, fmt.Errorf("Can only stream tarred bags, and %s is not a tar file", pathToBag)
+	}
+	validator, err := newValidator(pathToBag, bagValidationConfig, preserveExtendedAttributes)
 	if err != nil {
 		return nil, err
 	}
-	calculateMd5 := util.StringListContains(bagValidationConfig.FixityAlgorithms, constants.AlgMd5)
-	calculateSha256 := util.StringListContains(bagValidationConfig.FixityAlgorithms, constants.AlgSha256)
+	validator.reader = reader
+	validator.parseBuffers = make([]*parseBuffer, 0)
+	return validator, nil
+}
+
+// NewMultipartValidator creates a Validator for a bag that was uploaded
+// in parts, like my_bag.b01.of03.tar, my_bag.b02.of03.tar and
+// my_bag.b03.of03.tar. Param pathsToParts lists the paths to all of
+// the parts, in order. The validator treats the parts as a single bag,
+// named my_bag. Manifests and payload files may be in any part, but no
+// payload file may appear in more than one part. Each part must untar
+// to a directory with the same name as the part, minus the .tar
+// extension. Other params are the same as for NewValidator.
+func NewMultipartValidator(pathsToParts []string, bagValidationConfig *BagValidationConfig, preserveExtendedAttributes bool) (*Validator, error) {
+	if len(pathsToParts) == 0 {
+		return nil, fmt.Errorf("Param pathsToParts cannot be empty")
+	}
+	for _, pathToPart := range pathsToParts {
+		if !fileutil.FileExists(pathToPart) {
+			return nil, fmt.Errorf("Bag part does not exist at %s", pathToPart)
+		}
+		if util.SerializationSuffix(pathToPart) == "" {
+			return nil, fmt.Errorf("Bag part %s is not a serialized bag", pathToPart)
+		}
+	}
+	validator, err := newValidator(pathsToParts[0], bagValidationConfig, preserveExtendedAttributes)
+	if err != nil {
+		return nil, err
+	}
+	validator.bagParts = pathsToParts
+	validator.partDigests = make(map[string]map[string]string)
+	return validator, nil
+}
+
+func newValidator(pathToBag string, bagValidationConfig *BagValidationConfig, preserveExtendedAttributes bool) (*Validator, error) {
+	err := validateParams(bagValidationConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Calculate digests only for the algorithms we support,
+	// in the order they appear in constants.ChecksumAlgorithms.
+	algorithms := make([]string, 0)
+	for _, alg := range constants.ChecksumAlgorithms {
+		if util.StringListContains(bagValidationConfig.FixityAlgorithms, alg) {
+			algorithms = append(algorithms, alg)
+		}
+	}
 	tagFilesToParse := make([]string, 0)
 	for pathToFile, filespec := range bagValidationConfig.FileSpecs {
 		if filespec.ParseAsTagFile {
 			tagFilesToParse = append(tagFilesToParse, pathToFile)
 		}
 	}
+	// We can't check the BagIt version without parsing bagit.txt.
+	if len(bagValidationConfig.AcceptBagItVersion) > 0 &&
+		!util.StringListContains(tagFilesToParse, "bagit.txt") {
+		tagFilesToParse = append(tagFilesToParse, "bagit.txt")
+	}
+	// Strict mode checks bagit.txt for a byte-order mark and
+	// Payload-Oxum in bag-info.txt.
+	if bagValidationConfig.StrictRFC8493 {
+		for _, tagFile := range []string{"bagit.txt", "bag-info.txt"} {
+			if !util.StringListContains(tagFilesToParse, tagFile) {
+				tagFilesToParse = append(tagFilesToParse, tagFile)
+			}
+		}
+	}
 	validator := &Validator{
 		PathToBag:                  pathToBag,
 		BagValidationConfig:        bagValidationConfig,
@@ -91,18 +225,16 @@ func NewValidator(pathToBag string, bagValidationConfig *BagValidationConfig, pr
 		tagFilesToParse:            tagFilesToParse,
 		requiredFiles:              make([]string, 0),
 		forbiddenFiles:             make([]string, 0),
-		calculateMd5:               calculateMd5,
-		calculateSha256:            calculateSha256,
+		algorithms:                 algorithms,
+		result:                     NewValidationResult(pathToBag, util.CleanBagName(path.Base(pathToBag))),
+		badDigestLines:             make(map[string]manifestLine),
 	}
 	return validator, nil
 }
 
-// validateParams returns an error if there's a problem with the parameters
-// pathToBag or bagValidationConfig.
-func validateParams(pathToBag string, bagValidationConfig *BagValidationConfig) error {
-	if !fileutil.FileExists(pathToBag) {
-		return fmt.Errorf("Bag does not exist at %s", pathToBag)
-	}
+// validateParams returns an error if there's a problem with
+// bagValidationConfig.
+func validateParams(bagValidationConfig *BagValidationConfig) error {
 	if bagValidationConfig == nil {
 		return fmt.Errorf("Param bagValidationConfig cannot be nil")
 	}
@@ -118,32 +250,78 @@ func validateParams(pathToBag string, bagValidationConfig *BagValidationConfig)
 	if err != nil {
 		return fmt.Errorf("Error in BagValidationConfig: %v", err)
 	}
+	err = bagValidationConfig.CompileTagPatterns()
+	if err != nil {
+		return fmt.Errorf("Error in BagValidationConfig: %v", err)
+	}
 	return nil
 }
 
 // DBName returns the name of the BoltDB file where the validator keeps
 // track of validation data.
 func (validator *Validator) DBName() string {
-	bagPath := validator.PathToBag
-	if strings.HasSuffix(bagPath, ".tar") {
-		bagPath = bagPath[0 : len(bagPath)-4]
-	}
+	bagPath := constants.SerializedBagSuffix.ReplaceAllString(validator.PathToBag, "")
 	if strings.HasSuffix(bagPath, string(os.PathSeparator)) {
 		bagPath = bagPath[0 : len(bagPath)-1]
 	}
 	return fmt.Sprintf("%s%s", bagPath, VALIDATION_DB_SUFFIX)
 }
 
-// getIterator returns either a tar file iterator or a filesystem
-// iterator, depending on whether we're reading a tarred bag or
-// an untarred one.
+// getIterator returns either an archive iterator or a filesystem
+// iterator, depending on whether we're reading a serialized bag
+// (tar, tar.gz, tgz or zip) or an untarred one. For multipart
+// bags, this returns an iterator for the current part.
 func (validator *Validator) getIterator() (fileutil.ReadIterator, error) {
-	if strings.HasSuffix(validator.PathToBag, ".tar") {
-		return fileutil.NewTarFileIterator(validator.PathToBag)
+	if validator.reader != nil {
+		return fileutil.NewTarStreamIterator(validator.reader), nil
+	}
+	if validator.isMultipart() {
+		return fileutil.NewArchiveIterator(validator.currentPart)
+	}
+	if validator.isSerialized() {
+		return fileutil.NewArchiveIterator(validator.PathToBag)
 	}
 	return fileutil.NewFileSystemIterator(validator.PathToBag)
 }
 
+// isMultipart returns true if we're validating a bag that was
+// uploaded in parts.
+func (validator *Validator) isMultipart() bool {
+	return len(validator.bagParts) > 0
+}
+
+// partsToRead returns the paths of the tar files we need to read.
+// For a multipart bag, that's all of the parts. Otherwise, it's
+// just the bag.
+func (validator *Validator) partsToRead() []string {
+	if validator.isMultipart() {
+		return validator.bagParts
+	}
+	return []string{validator.PathToBag}
+}
+
+// partName returns the file name of the part we're reading,
+// or an empty string if the bag isn't multipart.
+func (validator *Validator) partName() string {
+	if !validator.isMultipart() {
+		return ""
+	}
+	return path.Base(validator.currentPart)
+}
+
+// isSerialized returns true if the bag is a tar, tar.gz, tgz
+// or zip file, rather than a directory.
+func (validator *Validator) isSerialized() bool {
+	return util.SerializationSuffix(validator.PathToBag) != ""
+}
+
+// closeIterator closes iterator if it has an open archive.
+func closeIterator(iterator fileutil.ReadIterator) {
+	if archive, ok := iterator.(fileutil.ArchiveIterator); ok {
+		archive.Close()
+	}
+}
+
 // Validate reads and validates the bag, and returns a ValidationResult with
 // the IntellectualObject and any errors encountered during validation.
 func (validator *Validator) Validate() (*models.WorkSummary, error) {
@@ -154,18 +332,42 @@ func (validator *Validator) Validate() (*models.WorkSummary, error) {
 	defer db.Close()
 	validator.db = db
 	validator.summary.Start()
+	validator.result.ObjIdentifier = validator.ObjIdentifier
+	validator.result.StartedAt = validator.summary.StartedAt
 	validator.summary.Attempted = true
 	validator.summary.AttemptNumber += 1
 	validator.readBag()
 	validator.verifyManifestPresent()
+	validator.verifySerialization()
 	validator.verifyTopLevelFolder()
 	validator.verifyFileSpecs()
 	validator.verifyTagSpecs()
+	validator.verifyTagRules()
+	validator.verifyBagItVersion()
+	validator.verifyPayloadOxum()
+	validator.verifyFetchItems()
 	validator.verifyGenericFiles()
 	validator.summary.Finish()
+	validator.result.FinishedAt = validator.summary.FinishedAt
 	return validator.summary, nil
 }
 
+// Result returns the problems found by Validate, with codes and
+// details that tools can filter on. The WorkSummary that Validate
+// returns has the same errors as plain messages.
+func (validator *Validator) Result() *ValidationResult {
+	return validator.result
+}
+
+// addError records a problem in the ValidationResult. Errors (but
+// not warnings) also go into the WorkSummary.
+func (validator *Validator) addError(validationError *ValidationError) {
+	validator.result.Add(validationError)
+	if validationError.Severity == SeverityError {
+		validator.summary.AddError("%s", validationError.Message)
+	}
+}
+
 // readBag reads through the contents of the bag and creates a list of
 // GenericFiles. This function creates a lightweight record of the
 // IntellectualObject in the db, and a for each file in the bag
@@ -177,7 +379,7 @@ func (validator *Validator) readBag() {
 	// In refactor, don't call anything for side effects!
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Could not init object: %v", err)
+		validator.addError(NewValidationError(ErrInternal, "Could not init object: %v", err))
 		return
 	}
 	validator.intelObj = obj
@@ -193,7 +395,7 @@ func (validator *Validator) readBag() {
 
 	err = validator.db.Save(obj.Identifier, obj)
 	if err != nil {
-		validator.summary.AddError("Could not save intelObj metadata: %v", err)
+		validator.addError(NewValidationError(ErrInternal, "Could not save intelObj metadata: %v", err))
 	}
 	validator.log(fmt.Sprintf("Finished reading %s", validator.PathToBag))
 }
@@ -220,7 +422,7 @@ func (validator *Validator) getIntellectualObject() (*models.IntellectualObject,
 func (validator *Validator) initIntellectualObject() (*models.IntellectualObject, error) {
 	obj := models.NewIntellectualObject()
 	obj.Identifier = validator.ObjIdentifier
-	if strings.HasSuffix(validator.PathToBag, ".tar") {
+	if validator.isSerialized() {
 		obj.IngestTarFilePath = validator.PathToBag
 	} else {
 		obj.IngestUntarredPath = validator.PathToBag
@@ -231,25 +433,60 @@ func (validator *Validator) initIntellectualObject() (*models.IntellectualObject
 
 // addFiles adds a record for each file to our validation database.
 func (validator *Validator) addFiles() {
-	validator.log(fmt.Sprintf("Creating file records for %s", validator.PathToBag))
+	validator.intelObj.IngestTopLevelDirNames = make([]string, 0)
+	for _, bagPath := range validator.partsToRead() {
+		validator.currentPart = bagPath
+		if !validator.addFilesFromPart() {
+			break
+		}
+	}
+	validator.intelObj.IngestManifests = validator.manifests
+	validator.intelObj.IngestTagManifests = validator.tagManifests
+}
+
+// addFilesFromPart adds a record for each file in the current part
+// of the bag. For bags that aren't multipart, the current part is
+// the whole bag. Returns false if we hit an error that should stop
+// validation.
+func (validator *Validator) addFilesFromPart() bool {
+	validator.log(fmt.Sprintf("Creating file records for %s", validator.currentPart))
 	iterator, err := validator.getIterator()
 	if err != nil {
-		validator.summary.AddError("Error getting file iterator: %v", err)
-		return
+		validator.addError(NewValidationError(ErrReadError, "Error getting file iterator: %v", err))
+		return false
 	}
+	defer closeIterator(iterator)
 	for {
 		err := validator.addFile(iterator)
 		if err != nil && (err == io.EOF || err.Error() == "EOF") {
 			break // readIterator hit the end of the list
 		} else if err != nil {
-			validator.summary.AddError("Error reading bag: %s", err.Error())
+			validator.addError(NewValidationError(ErrReadError, "Error reading bag: %s", err.Error()))
 			validator.summary.ErrorIsFatal = true
-			break // PT #146289839: Stop on error, or memory usage explodes.
+			return false // PT #146289839: Stop on error, or memory usage explodes.
+		}
+	}
+	validator.intelObj.IngestTopLevelDirNames = append(
+		validator.intelObj.IngestTopLevelDirNames, iterator.GetTopLevelDirNames()...)
+	if validator.isMultipart() {
+		validator.verifyPartFolder(iterator.GetTopLevelDirNames())
+	}
+	return true
+}
+
+// verifyPartFolder ensures that the current part of a multipart bag
+// untars to a directory with the same name as the part. We check this
+// as we read each part, since the IntellectualObject keeps only the
+// combined list of top-level directories.
+func (validator *Validator) verifyPartFolder(dirNames []string) {
+	expectedDirName := constants.SerializedBagSuffix.ReplaceAllString(validator.partName(), "")
+	for _, dirName := range dirNames {
+		if dirName != expectedDirName {
+			validator.addError(NewValidationError(ErrTopLevelFolder,
+				"Bag part %s should untar to directory '%s', not '%s'",
+				validator.partName(), expectedDirName, dirName))
 		}
 	}
-	validator.intelObj.IngestTopLevelDirNames = iterator.GetTopLevelDirNames()
-	validator.intelObj.IngestManifests = validator.manifests
-	validator.intelObj.IngestTagManifests = validator.tagManifests
 }
 
 // addFile adds a record for a single file to our validation database.
@@ -263,7 +500,10 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 	}
 
 	gf := models.NewGenericFile()
-	gf.Identifier = fmt.Sprintf("%s/%s", validator.ObjIdentifier, fileSummary.RelPath)
+	gf.Identifier = validator.gfIdentifier(fileSummary.RelPath)
+	if gf.Identifier != fmt.Sprintf("%s/%s", validator.ObjIdentifier, fileSummary.RelPath) {
+		gf.IngestPathInBag = fileSummary.RelPath
+	}
 
 	// Unfortunately, we need this to compute gf.OriginalPath()
 	gf.IntellectualObjectIdentifier = validator.ObjIdentifier
@@ -272,6 +512,40 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 	// This is not the same as setting the file's mime type.
 	validator.setFileType(gf, fileSummary)
 
+	// A file may appear in only one part of a multipart bag, except
+	// for tag files and manifests, which each part may have. We keep
+	// the record from the first part that has the file, and just
+	// note the digests of tag files and manifests in later parts.
+	isDuplicate := false
+	if validator.isMultipart() || validator.normalizesFileNames() {
+		gf.IngestBagPart = validator.partName()
+		existingFile, err := validator.db.GetGenericFile(gf.Identifier)
+		if err != nil {
+			return err
+		}
+		if existingFile != nil && pathInBag(existingFile) != fileSummary.RelPath {
+			validationError := NewValidationError(ErrNormalizationCollision,
+				"Files '%s' and '%s' have the same name after Unicode normalization",
+				pathInBag(existingFile), fileSummary.RelPath)
+			validationError.FilePath = fileSummary.RelPath
+			validator.addError(validationError)
+			return nil
+		}
+		if existingFile != nil && gf.IngestFileType == constants.PAYLOAD_FILE {
+			validationError := NewValidationError(ErrDuplicatePayloadFile,
+				"Payload file '%s' appears in both %s and %s",
+				gf.OriginalPath(), existingFile.IngestBagPart, gf.IngestBagPart)
+			validationError.FilePath = gf.OriginalPath()
+			validator.addError(validationError)
+			return nil
+		}
+		isDuplicate = existingFile != nil
+	}
+	if gf.IngestFileType == constants.PAYLOAD_FILE {
+		validator.payloadBytes += fileSummary.Size
+		validator.payloadFileCount += 1
+	}
+
 	// The following info is used by the APTrust ingest process,
 	// but is not relevant to anyone doing validation outside
 	// the APTrust organization.
@@ -283,6 +557,7 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 		gf.IngestNeedsSave = true                // default until proven otherwise
 		gf.IngestUUID = _uuid.String()
 		gf.IngestUUIDGeneratedAt = time.Now().UTC()
+		gf.IngestTarOffset = fileSummary.DataOffset
 		gf.IngestFileUid = fileSummary.Uid
 		gf.IngestFileGid = fileSummary.Gid
 		validator.setMimeType(gf)
@@ -302,7 +577,30 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 	// basic bag validation. Even if checksum calculation fails (which
 	// has not yet happened), we still want to keep a record of the
 	// GenericFile in the validation DB for later reporting purposes.
-	checksumError := validator.calculateChecksums(reader, gf)
+	//
+	// When we're reading a stream, we can't come back later to parse
+	// manifests and tag files, so we keep a copy of them as we go.
+	var fileReader io.Reader = reader
+	var buffer *parseBuffer
+	if validator.reader != nil && validator.shouldParse(fileSummary.RelPath) {
+		buffer = &parseBuffer{fileSummary: fileSummary}
+		fileReader = io.TeeReader(reader, &buffer.data)
+		validator.parseBuffers = append(validator.parseBuffers, buffer)
+	}
+	checksumError := validator.calculateChecksums(fileReader, gf)
+	if buffer != nil && checksumError == nil {
+		_, checksumError = io.Copy(ioutil.Discard, fileReader)
+	}
+	if validator.isMultipart() && gf.IngestFileType != constants.PAYLOAD_FILE {
+		digests := make(map[string]string)
+		for _, alg := range validator.algorithms {
+			digests[alg] = gf.IngestDigest(alg)
+		}
+		validator.partDigests[gf.IngestBagPart+"/"+fileSummary.RelPath] = digests
+	}
+	if isDuplicate {
+		return checksumError
+	}
 	saveError := validator.db.Save(gf.Identifier, gf)
 	if checksumError != nil {
 		return checksumError
@@ -310,37 +608,50 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 	return saveError
 }
 
+// gfIdentifier returns the identifier of the GenericFile for the file
+// at relPath within the bag. If the config says to normalize file
+// names, the identifier uses the NFC form of relPath.
+func (validator *Validator) gfIdentifier(relPath string) string {
+	if validator.normalizesFileNames() {
+		relPath = norm.NFC.String(relPath)
+	}
+	return fmt.Sprintf("%s/%s", validator.ObjIdentifier, relPath)
+}
+
+// normalizesFileNames returns true if the config says to convert
+// file names to Unicode NFC.
+func (validator *Validator) normalizesFileNames() bool {
+	return validator.BagValidationConfig.FileNameCollisionPolicy == COLLISION_NORMALIZE
+}
+
+// pathInBag returns the path of gf within the bag, which may not
+// be its OriginalPath if we normalized its name.
+func pathInBag(gf *models.GenericFile) string {
+	if gf.IngestPathInBag != "" {
+		return gf.IngestPathInBag
+	}
+	return gf.OriginalPath()
+}
+
 // calculateChecksums calculates the checksums on the given GenericFile.
 // Depending on the config options, we may calculate multiple checksums
 // in a single pass. (One of the perks of golang's MultiWriter.)
 func (validator *Validator) calculateChecksums(reader io.Reader, gf *models.GenericFile) error {
-	hashes := make([]io.Writer, 0)
-	var md5Hash hash.Hash
-	var sha256Hash hash.Hash
-	if validator.calculateMd5 {
-		md5Hash = md5.New()
-		hashes = append(hashes, md5Hash)
-	}
-	if validator.calculateSha256 {
-		sha256Hash = sha256.New()
-		hashes = append(hashes, sha256Hash)
-	}
-	if len(hashes) > 0 {
-		multiWriter := io.MultiWriter(hashes...)
-		io.Copy(multiWriter, reader)
-		utcNow := time.Now().UTC()
-		if md5Hash != nil {
-			gf.IngestMd5 = fmt.Sprintf("%x", md5Hash.Sum(nil))
-			if validator.PreserveExtendedAttributes {
-				gf.IngestMd5GeneratedAt = utcNow
-			}
-		}
-		if sha256Hash != nil {
-			gf.IngestSha256 = fmt.Sprintf("%x", sha256Hash.Sum(nil))
-			if validator.PreserveExtendedAttributes {
-				gf.IngestSha256GeneratedAt = utcNow
-			}
-		}
+	if len(validator.algorithms) == 0 {
+		return nil
+	}
+	hashes, err := fileutil.NewHashes(validator.algorithms)
+	if err != nil {
+		return err
+	}
+	multiWriter := io.MultiWriter(fileutil.HashWriters(hashes)...)
+	io.Copy(multiWriter, reader)
+	generatedAt := time.Time{}
+	if validator.PreserveExtendedAttributes {
+		generatedAt = time.Now().UTC()
+	}
+	for alg, digest := range fileutil.HexDigests(hashes) {
+		gf.SetIngestDigest(alg, digest, generatedAt)
 	}
 	return nil
 }
@@ -353,11 +664,15 @@ func (validator *Validator) setFileType(gf *models.GenericFile, fileSummary *fil
 	if strings.HasPrefix(fileSummary.RelPath, "tagmanifest-") {
 		gf.IngestFileType = constants.TAG_MANIFEST
 		gf.FileFormat = "text/plain"
-		validator.tagManifests = append(validator.tagManifests, fileSummary.RelPath)
+		if !util.StringListContains(validator.tagManifests, fileSummary.RelPath) {
+			validator.tagManifests = append(validator.tagManifests, fileSummary.RelPath)
+		}
 	} else if strings.HasPrefix(fileSummary.RelPath, "manifest-") {
 		gf.IngestFileType = constants.PAYLOAD_MANIFEST
 		gf.FileFormat = "text/plain"
-		validator.manifests = append(validator.manifests, fileSummary.RelPath)
+		if !util.StringListContains(validator.manifests, fileSummary.RelPath) {
+			validator.manifests = append(validator.manifests, fileSummary.RelPath)
+		}
 	} else if strings.HasPrefix(fileSummary.RelPath, "data/") {
 		gf.IngestFileType = constants.PAYLOAD_FILE
 	} else {
@@ -368,15 +683,31 @@ func (validator *Validator) setFileType(gf *models.GenericFile, fileSummary *fil
 // parseFiles parses files that the bagging config says to parse,
 // like manifests and certain tag files.
 func (validator *Validator) parseFiles() {
-	validator.log(fmt.Sprintf("Parsing tag files and manifests in %s", validator.PathToBag))
+	if validator.reader != nil {
+		validator.log(fmt.Sprintf("Parsing tag files and manifests in %s", validator.PathToBag))
+		validator.parseBufferedFiles()
+		return
+	}
+	for _, bagPath := range validator.partsToRead() {
+		validator.currentPart = bagPath
+		validator.parseFilesInPart()
+	}
+}
+
+// parseFilesInPart parses the manifests and tag files in the current
+// part of the bag. For bags that aren't multipart, the current part
+// is the whole bag.
+func (validator *Validator) parseFilesInPart() {
+	validator.log(fmt.Sprintf("Parsing tag files and manifests in %s", validator.currentPart))
 	// We have to get a new iterator here, because if we're
 	// dealing with a TarFileIterator (which is likely), it's
 	// forward-only. We can't rewind it.
 	readIterator, err := validator.getIterator()
 	if err != nil {
-		validator.summary.AddError("Error getting file iterator: %v", err)
+		validator.addError(NewValidationError(ErrReadError, "Error getting file iterator: %v", err))
 		return
 	}
+	defer closeIterator(readIterator)
 	for {
 		// Don't use "defer reader.Close()" because the readers
 		// won't be closed until we exit the enclosing funcion,
@@ -405,7 +736,7 @@ func (validator *Validator) parseFiles() {
 			} else {
 				msg = err.Error()
 			}
-			validator.summary.AddError(msg)
+			validator.addError(NewValidationError(ErrReadError, "%s", msg))
 			if len(validator.summary.Errors) > 100 {
 				if reader != nil {
 					reader.Close()
@@ -425,17 +756,17 @@ func (validator *Validator) parseFiles() {
 
 		// At this point, we should have an open reader
 		// pointing to a legitimate file.
-		gfIdentifier := fmt.Sprintf("%s/%s", validator.ObjIdentifier, fileSummary.RelPath)
+		gfIdentifier := validator.gfIdentifier(fileSummary.RelPath)
 		gf, err := validator.db.GetGenericFile(gfIdentifier)
 		if err != nil {
-			validator.summary.AddError("Error finding '%s' in validation db: %v", gfIdentifier, err)
+			validator.addError(NewValidationError(ErrInternal, "Error finding '%s' in validation db: %v", gfIdentifier, err))
 			if reader != nil {
 				reader.Close()
 			}
 			continue
 		}
 		if gf == nil {
-			validator.summary.AddError("Cannot find '%s' in validation db", gfIdentifier)
+			validator.addError(NewValidationError(ErrInternal, "Cannot find '%s' in validation db", gfIdentifier))
 			if reader != nil {
 				reader.Close()
 			}
@@ -448,11 +779,46 @@ func (validator *Validator) parseFiles() {
 	}
 }
 
+// parseBufferedFiles parses the manifests and tag files we copied
+// while reading a streamed bag, in the order they appeared in the bag.
+func (validator *Validator) parseBufferedFiles() {
+	for _, buffer := range validator.parseBuffers {
+		gfIdentifier := validator.gfIdentifier(buffer.fileSummary.RelPath)
+		gf, err := validator.db.GetGenericFile(gfIdentifier)
+		if err != nil {
+			validator.addError(NewValidationError(ErrInternal, "Error finding '%s' in validation db: %v", gfIdentifier, err))
+			continue
+		}
+		if gf == nil {
+			validator.addError(NewValidationError(ErrInternal, "Cannot find '%s' in validation db", gfIdentifier))
+			continue
+		}
+		validator.parseFile(ioutil.NopCloser(&buffer.data), gf, buffer.fileSummary)
+	}
+	validator.parseBuffers = nil
+}
+
+// shouldParse returns true if the file at relFilePath is a manifest,
+// tag manifest, or tag file that we need to parse. This works only
+// after setFileType has seen the file.
+func (validator *Validator) shouldParse(relFilePath string) bool {
+	return util.StringListContains(validator.tagFilesToParse, relFilePath) ||
+		util.StringListContains(validator.manifests, relFilePath) ||
+		util.StringListContains(validator.tagManifests, relFilePath) ||
+		validator.parsesFetchTxt(relFilePath)
+}
+
+// parsesFetchTxt returns true if relFilePath is fetch.txt, and the
+// config allows fetch.txt, so we need to check its entries.
+func (validator *Validator) parsesFetchTxt(relFilePath string) bool {
+	return relFilePath == FetchTxtFile && validator.BagValidationConfig.AllowFetchTxt
+}
+
 func (validator *Validator) setStorageOption() {
 	validator.log(fmt.Sprintf("Setting storage option for %s", validator.PathToBag))
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Error getting IntelObj from validation db: %v", err)
+		validator.addError(NewValidationError(ErrInternal, "Error getting IntelObj from validation db: %v", err))
 		return
 	}
 	obj.StorageOption = constants.StorageStandard
@@ -464,20 +830,20 @@ func (validator *Validator) setStorageOption() {
 	// Save obj with new StorageOption
 	err = validator.db.Save(obj.Identifier, obj)
 	if err != nil {
-		validator.summary.AddError("Error saving IntelObj '%s' to db: %v", obj.Identifier, err)
+		validator.addError(NewValidationError(ErrInternal, "Error saving IntelObj '%s' to db: %v", obj.Identifier, err))
 	}
 
 	gfIdentifiers := validator.db.FileIdentifiers()
 	for _, gfIdentifier := range gfIdentifiers {
 		gf, err := validator.db.GetGenericFile(gfIdentifier)
 		if err != nil {
-			validator.summary.AddError("Error getting file %s from validation db: %v", gfIdentifier, err)
+			validator.addError(NewValidationError(ErrInternal, "Error getting file %s from validation db: %v", gfIdentifier, err))
 			return
 		}
 		gf.StorageOption = obj.StorageOption
 		err = validator.db.Save(gfIdentifier, gf)
 		if err != nil {
-			validator.summary.AddError("Error saving generic file '%s' to db: %v", gfIdentifier, err)
+			validator.addError(NewValidationError(ErrInternal, "Error saving generic file '%s' to db: %v", gfIdentifier, err))
 		}
 	}
 }
@@ -488,6 +854,11 @@ func (validator *Validator) setStorageOption() {
 // a no-op.
 func (validator *Validator) parseFile(reader io.ReadCloser, gf *models.GenericFile, fileSummary *fileutil.FileSummary) {
 	parseAsTagFile := util.StringListContains(validator.tagFilesToParse, fileSummary.RelPath)
+	// Each part of a multipart bag may have its own copy of a tag
+	// file. We parse only the copy whose record we kept.
+	if parseAsTagFile && gf.IngestBagPart != validator.partName() {
+		return
+	}
 	parseAsManifest := util.StringListContains(validator.manifests, fileSummary.RelPath) ||
 		util.StringListContains(validator.tagManifests, fileSummary.RelPath)
 
@@ -496,9 +867,23 @@ func (validator *Validator) parseFile(reader io.ReadCloser, gf *models.GenericFi
 	} else if parseAsManifest {
 		// Get the checksums out of the manifest.
 		validator.parseManifest(reader, fileSummary)
+	} else if validator.parsesFetchTxt(fileSummary.RelPath) && gf.IngestBagPart == validator.partName() {
+		validator.parseFetchTxt(reader)
 	}
 }
 
+// parseFetchTxt records the entries in fetch.txt. In strict mode,
+// it also reports lines that don't follow RFC 8493.
+func (validator *Validator) parseFetchTxt(reader io.Reader) {
+	items, validationErrors := ParseFetchTxt(reader)
+	if validator.BagValidationConfig.StrictRFC8493 {
+		for _, validationError := range validationErrors {
+			validator.addError(validationError)
+		}
+	}
+	validator.fetchItems = items
+}
+
 // parseTags parses the tags in a bagit-format tag file. That's a plain-text
 // file with names and values separated by a colon.
 //
@@ -506,18 +891,31 @@ func (validator *Validator) parseFile(reader io.ReadCloser, gf *models.GenericFi
 func (validator *Validator) parseTags(reader io.Reader, relFilePath string) {
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Error getting IntelObj from validation db: %v", err)
+		validator.addError(NewValidationError(ErrInternal, "Error getting IntelObj from validation db: %v", err))
 		return
 	}
 	if obj == nil {
-		validator.summary.AddError("IntelObj '%s' is missing from validation db", validator.ObjIdentifier)
+		validator.addError(NewValidationError(ErrInternal, "IntelObj '%s' is missing from validation db", validator.ObjIdentifier))
 		return
 	}
 	re := regexp.MustCompile(`^(\S*\:)?(\s*.*)?$`)
 	scanner := bufio.NewScanner(reader)
 	var tag *models.Tag
+	lineNum := 0
 	for scanner.Scan() {
 		line := scanner.Text()
+		lineNum += 1
+		// Editors on Windows like to start UTF-8 files with a
+		// byte-order mark. Don't let it become part of the first tag.
+		if lineNum == 1 && strings.HasPrefix(line, utf8BOM) {
+			line = strings.TrimPrefix(line, utf8BOM)
+			if relFilePath == "bagit.txt" && validator.BagValidationConfig.StrictRFC8493 {
+				validationError := NewValidationError(ErrBagItBOM, "bagit.txt must not start with a byte-order mark.")
+				validationError.FilePath = relFilePath
+				validationError.LineNumber = lineNum
+				validator.addError(validationError)
+			}
+		}
 		if strings.TrimSpace(line) == "" {
 			continue
 		}
@@ -539,19 +937,24 @@ func (validator *Validator) parseTags(reader io.Reader, relFilePath string) {
 				validator.SetIntelObjTagValue(obj, tag)
 			}
 		} else {
-			validator.summary.AddError("Unable to parse tag data from line: '%s'", line)
+			validationError := NewValidationError(ErrTagFileSyntax, "Unable to parse tag data from line: '%s'", line)
+			validationError.FilePath = relFilePath
+			validationError.LineNumber = lineNum
+			validator.addError(validationError)
 		}
 	}
 	if tag != nil && tag.Label != "" {
 		obj.IngestTags = append(obj.IngestTags, tag)
 	}
 	if scanner.Err() != nil {
-		validator.summary.AddError("Error reading tag file '%s': %v",
+		validationError := NewValidationError(ErrReadError, "Error reading tag file '%s': %v",
 			relFilePath, scanner.Err().Error())
+		validationError.FilePath = relFilePath
+		validator.addError(validationError)
 	}
 	err = validator.db.Save(validator.ObjIdentifier, obj)
 	if err != nil {
-		validator.summary.AddError("Could not save IntelObj after parsing tags: %v", err)
+		validator.addError(NewValidationError(ErrInternal, "Could not save IntelObj after parsing tags: %v", err))
 	}
 }
 
@@ -600,22 +1003,24 @@ func (validator *Validator) SetIntelObjTagValue(obj *models.IntellectualObject,
 // TODO: Move this into a separate file and make it more generic.
 func (validator *Validator) parseManifest(reader io.Reader, fileSummary *fileutil.FileSummary) {
 	alg := ""
-	if strings.Contains(fileSummary.RelPath, constants.AlgSha256) {
-		alg = constants.AlgSha256
-	} else if strings.Contains(fileSummary.RelPath, constants.AlgMd5) {
-		alg = constants.AlgMd5
-	} else {
-		fmt.Fprintln(os.Stderr, "Not verifying checksums in", fileSummary.RelPath,
-			"- unsupported algorithm. Will still verify any md5 or sha256 checksums. "+
-				"Bag ", validator.PathToBag)
+	if match := manifestAlgRegex.FindStringSubmatch(fileSummary.RelPath); match != nil {
+		alg = strings.ToLower(match[1])
+	}
+	if !util.StringListContains(validator.algorithms, alg) {
+		warning := NewValidationError(ErrUnsupportedAlgorithm,
+			"Not verifying checksums in %s: unsupported algorithm", fileSummary.RelPath)
+		warning.Severity = SeverityWarning
+		warning.Manifest = fileSummary.RelPath
+		warning.Algorithm = alg
+		validator.addError(warning)
 		return
 	}
 	re := regexp.MustCompile(`^(\S*)\s*(.*)`)
 	scanner := bufio.NewScanner(reader)
-	lineNum := 1
+	lineNum := 0
 	for scanner.Scan() {
-		updateGenericFile := false
 		line := scanner.Text()
+		lineNum += 1
 		if strings.TrimSpace(line) == "" {
 			continue
 		}
@@ -623,41 +1028,163 @@ func (validator *Validator) parseManifest(reader io.Reader, fileSummary *fileuti
 			data := re.FindStringSubmatch(line)
 			digest := data[1]
 			filePath := data[2]
+			if validator.BagValidationConfig.StrictRFC8493 {
+				filePath = validator.checkManifestPath(filePath, manifestLine{fileSummary.RelPath, lineNum})
+			}
 
-			gfIdentifier := fmt.Sprintf("%s/%s", validator.ObjIdentifier, filePath)
+			gfIdentifier := validator.gfIdentifier(filePath)
 			genericFile, err := validator.db.GetGenericFile(gfIdentifier)
 			if err != nil {
-				validator.summary.AddError("Error finding generic file '%s' in db: %v", gfIdentifier, err)
+				validator.addError(NewValidationError(ErrInternal, "Error finding generic file '%s' in db: %v", gfIdentifier, err))
 			}
 			if genericFile == nil {
-				validator.summary.AddError(
+				validationError := NewValidationError(ErrFileNotInBag,
 					"File '%s' in manifest '%s' is missing from bag",
 					filePath, fileSummary.RelPath)
+				validationError.FilePath = filePath
+				validationError.Manifest = fileSummary.RelPath
+				validationError.LineNumber = lineNum
+				validator.addError(validationError)
 				continue
 			}
 
-			// If we got a digest from this line of the manifest,
-			// set it on the GenericFile and save the record back
-			// to the database.
-			if alg == constants.AlgMd5 {
-				genericFile.IngestManifestMd5 = digest
-				updateGenericFile = true
-			} else if alg == constants.AlgSha256 {
-				genericFile.IngestManifestSha256 = digest
-				updateGenericFile = true
+			// A tag manifest in one part of a multipart bag describes
+			// the tag files in that part.
+			if validator.isMultipart() && genericFile.IngestFileType != constants.PAYLOAD_FILE &&
+				genericFile.IngestBagPart != validator.partName() {
+				validator.verifyPartDigest(alg, digest, filePath, manifestLine{fileSummary.RelPath, lineNum})
+				continue
 			}
-			if updateGenericFile {
-				err = validator.db.Save(gfIdentifier, genericFile)
-				if err != nil {
-					validator.summary.AddError("Error saving generic file '%s' to db: %v", gfIdentifier, err)
-				}
+			previousDigest := genericFile.IngestManifestDigest(alg)
+			if validator.isMultipart() && previousDigest != "" && previousDigest != digest {
+				validationError := NewValidationError(ErrManifestConflict,
+					"Manifests disagree about %s digest for '%s': '%s' vs. '%s'",
+					alg, filePath, previousDigest, digest)
+				validationError.FilePath = filePath
+				validationError.Manifest = fileSummary.RelPath
+				validationError.LineNumber = lineNum
+				validationError.Algorithm = alg
+				validationError.Expected = previousDigest
+				validationError.Actual = digest
+				validator.addError(validationError)
+			}
+			if digest != genericFile.IngestDigest(alg) {
+				validator.badDigestLines[gfIdentifier+"|"+alg] = manifestLine{fileSummary.RelPath, lineNum}
+			}
+
+			// Set the digest from this line of the manifest
+			// on the GenericFile and save the record back
+			// to the database.
+			genericFile.SetIngestManifestDigest(alg, digest)
+			err = validator.db.Save(gfIdentifier, genericFile)
+			if err != nil {
+				validator.addError(NewValidationError(ErrInternal, "Error saving generic file '%s' to db: %v", gfIdentifier, err))
 			}
 		} else {
-			validator.summary.AddError(fmt.Sprintf(
+			validationError := NewValidationError(ErrManifestSyntax,
 				"Unable to parse data from line %d of manifest %s: %s",
-				lineNum, fileSummary.RelPath, line))
+				lineNum, fileSummary.RelPath, line)
+			validationError.Manifest = fileSummary.RelPath
+			validationError.LineNumber = lineNum
+			validator.addError(validationError)
 		}
-		lineNum += 1
+	}
+}
+
+// manifestLine is a line in a manifest.
+type manifestLine struct {
+	manifest   string
+	lineNumber int
+}
+
+// checkManifestPath reports file paths in a manifest that break the
+// RFC 8493 rules: paths must use forward slashes, and must encode
+// CR, LF and % as %0D, %0A and %25. It returns the decoded path.
+func (validator *Validator) checkManifestPath(filePath string, location manifestLine) string {
+	if strings.Contains(filePath, "\\") {
+		validationError := NewValidationError(ErrBackslashPath,
+			"File path '%s' in manifest '%s' contains a backslash. Use forward slashes to separate directories.",
+			filePath, location.manifest)
+		validationError.FilePath = filePath
+		validationError.Manifest = location.manifest
+		validationError.LineNumber = location.lineNumber
+		validator.addError(validationError)
+	}
+	decodedPath, ok := decodeManifestPath(filePath)
+	if !ok {
+		validationError := NewValidationError(ErrPathEncoding,
+			"File path '%s' in manifest '%s' contains a percent sign that is not encoded as %%25",
+			filePath, location.manifest)
+		validationError.FilePath = filePath
+		validationError.Manifest = location.manifest
+		validationError.LineNumber = location.lineNumber
+		validator.addError(validationError)
+	}
+	return decodedPath
+}
+
+// decodeManifestPath decodes %0D, %0A and %25 in a manifest path.
+// RFC 8493 says only those characters may be percent-encoded, so it
+// returns false if the path has a percent sign that doesn't start one
+// of them. Percent signs it can't decode stay as they are.
+func decodeManifestPath(filePath string) (string, bool) {
+	if !strings.Contains(filePath, "%") {
+		return filePath, true
+	}
+	ok := true
+	var decoded strings.Builder
+	for i := 0; i < len(filePath); i++ {
+		if filePath[i] != '%' {
+			decoded.WriteByte(filePath[i])
+			continue
+		}
+		encoded := ""
+		if i+3 <= len(filePath) {
+			encoded = strings.ToUpper(filePath[i : i+3])
+		}
+		switch encoded {
+		case "%0D":
+			decoded.WriteByte('\r')
+		case "%0A":
+			decoded.WriteByte('\n')
+		case "%25":
+			decoded.WriteByte('%')
+		default:
+			decoded.WriteByte('%')
+			ok = false
+			continue
+		}
+		i += 2
+	}
+	return decoded.String(), ok
+}
+
+// verifyPartDigest compares the digest that a manifest in the current
+// part of a multipart bag lists for a tag file to the digest of that
+// tag file in the same part.
+func (validator *Validator) verifyPartDigest(alg, manifestDigest, filePath string, location manifestLine) {
+	digests, ok := validator.partDigests[validator.partName()+"/"+filePath]
+	if !ok {
+		validationError := NewValidationError(ErrFileNotInBag,
+			"File '%s' in manifest '%s' is missing from %s",
+			filePath, location.manifest, validator.partName())
+		validationError.FilePath = filePath
+		validationError.Manifest = location.manifest
+		validationError.LineNumber = location.lineNumber
+		validator.addError(validationError)
+		return
+	}
+	if digests[alg] != manifestDigest {
+		validationError := NewValidationError(ErrBadDigest,
+			"Bad %s digest for '%s' in %s: manifest says '%s', file digest is '%s'",
+			alg, filePath, validator.partName(), manifestDigest, digests[alg])
+		validationError.FilePath = filePath
+		validationError.Manifest = location.manifest
+		validationError.LineNumber = location.lineNumber
+		validationError.Algorithm = alg
+		validationError.Expected = manifestDigest
+		validationError.Actual = digests[alg]
+		validator.addError(validationError)
 	}
 }
 
@@ -667,10 +1194,35 @@ func (validator *Validator) parseManifest(reader io.Reader, fileSummary *fileuti
 func (validator *Validator) verifyManifestPresent() {
 	validator.log(fmt.Sprintf("Verifying manifests present for %s", validator.PathToBag))
 	if len(validator.manifests) == 0 {
-		validator.summary.AddError("Bag contains no payload manifest.")
+		validator.addError(NewValidationError(ErrNoPayloadManifest, "Bag contains no payload manifest."))
 	}
 }
 
+// verifySerialization ensures the bag is serialized if the config
+// requires it, and is not serialized if the config forbids it. If the
+// bag is serialized, the format must be one the config accepts.
+func (validator *Validator) verifySerialization() {
+	validator.log(fmt.Sprintf("Verifying serialization for %s", validator.PathToBag))
+	config := validator.BagValidationConfig
+	ext := util.SerializationSuffix(validator.PathToBag)
+	mimeTypes, isSerialized := serializationFormats[ext]
+	if config.Serialization == REQUIRED && !isSerialized {
+		validator.addError(NewValidationError(ErrSerialization, "Bag must be serialized, but it is a directory."))
+	} else if config.Serialization == FORBIDDEN && isSerialized {
+		validator.addError(NewValidationError(ErrSerialization, "Bag must not be serialized, but it is a %s file.", ext))
+	}
+	if !isSerialized || len(config.AcceptSerialization) == 0 {
+		return
+	}
+	for _, mimeType := range mimeTypes {
+		if util.StringListContains(config.AcceptSerialization, mimeType) {
+			return
+		}
+	}
+	validator.addError(NewValidationError(ErrSerialization, "Serialization format %s is not accepted. Accepted formats: %s",
+		ext, strings.Join(config.AcceptSerialization, ", ")))
+}
+
 // verifyTopLevelFolder ensures the top-level folder inside a tar file
 // has the same name as the bag. There should be exactly one top-level
 // folder whose name is the same as the bag. Anything else is an error.
@@ -678,7 +1230,7 @@ func (validator *Validator) verifyTopLevelFolder() {
 	validator.log(fmt.Sprintf("Verifying top-level folder for %s", validator.PathToBag))
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Can't get object: %v", err)
+		validator.addError(NewValidationError(ErrInternal, "Can't get object: %v", err))
 		return
 	}
 	if obj.IngestTarFilePath == "" {
@@ -692,14 +1244,17 @@ func (validator *Validator) verifyTopLevelFolder() {
 		parts := strings.Split(obj.IngestTarFilePath, "\\")
 		baseName = parts[len(parts)-1]
 	}
-	expectedDirName := TAR_SUFFIX.ReplaceAllString(baseName, "")
+	expectedDirName := constants.SerializedBagSuffix.ReplaceAllString(baseName, "")
 	dirNames := obj.IngestTopLevelDirNames
+	if validator.isMultipart() {
+		return // see verifyPartFolder
+	}
 	if dirNames != nil {
 		for _, dirName := range dirNames {
 			if dirName != expectedDirName {
-				validator.summary.AddError(
+				validator.addError(NewValidationError(ErrTopLevelFolder,
 					"Tarred bag should untar to directory '%s', not '%s'",
-					expectedDirName, dirName)
+					expectedDirName, dirName))
 			}
 		}
 	}
@@ -711,9 +1266,13 @@ func (validator *Validator) verifyFileSpecs() {
 	validator.log(fmt.Sprintf("Checking required/forbidden files for %s", validator.PathToBag))
 	for gfPath, fileSpec := range validator.BagValidationConfig.FileSpecs {
 		if fileSpec.Presence == REQUIRED && !util.StringListContains(validator.requiredFiles, gfPath) {
-			validator.summary.AddError("Required file '%s' is missing.", gfPath)
+			validationError := NewValidationError(ErrRequiredFileMissing, "Required file '%s' is missing.", gfPath)
+			validationError.FilePath = gfPath
+			validator.addError(validationError)
 		} else if fileSpec.Presence == FORBIDDEN && util.StringListContains(validator.forbiddenFiles, gfPath) {
-			validator.summary.AddError("Bag contains forbidden file '%s'.", gfPath)
+			validationError := NewValidationError(ErrForbiddenFile, "Bag contains forbidden file '%s'.", gfPath)
+			validationError.FilePath = gfPath
+			validator.addError(validationError)
 		}
 
 	}
@@ -724,14 +1283,18 @@ func (validator *Validator) verifyTagSpecs() {
 	validator.log(fmt.Sprintf("Verifying tags for %s", validator.PathToBag))
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Cannot get object metadata from db: %v", err)
+		validator.addError(NewValidationError(ErrInternal, "Cannot get object metadata from db: %v", err))
 		return
 	}
 	for tagName, tagSpec := range validator.BagValidationConfig.TagSpecs {
 		tags := obj.FindTag(tagName)
 		if tagSpec.Presence == FORBIDDEN {
-			validator.summary.AddError("Forbidden tag '%s' found in file '%s'.",
-				tagName, tags[0].SourceFile)
+			if len(tags) > 0 {
+				validationError := NewValidationError(ErrForbiddenTag, "Forbidden tag '%s' found in file '%s'.",
+					tagName, tags[0].SourceFile)
+				validationError.FilePath = tags[0].SourceFile
+				validator.addError(validationError)
+			}
 			continue
 		}
 		if tagSpec.Presence == REQUIRED {
@@ -740,6 +1303,151 @@ func (validator *Validator) verifyTagSpecs() {
 		if tags != nil && tagSpec.AllowedValues != nil && len(tagSpec.AllowedValues) > 0 {
 			validator.checkAllowedTagValue(tagName, tags, tagSpec)
 		}
+		tagsInFile := make([]*models.Tag, 0)
+		for _, tag := range tags {
+			if tag.SourceFile == tagSpec.FilePath {
+				tagsInFile = append(tagsInFile, tag)
+			}
+		}
+		validator.checkTagCount(tagName, tagsInFile, tagSpec)
+		validator.checkTagValueFormat(tagName, tagsInFile, tagSpec)
+	}
+}
+
+// verifyTagRules ensures that tags required or forbidden by the
+// values of other tags are present or absent.
+func (validator *Validator) verifyTagRules() {
+	if len(validator.BagValidationConfig.TagRules) == 0 {
+		return
+	}
+	validator.log(fmt.Sprintf("Verifying tag rules for %s", validator.PathToBag))
+	obj, err := validator.getIntellectualObject()
+	if err != nil {
+		validator.addError(NewValidationError(ErrInternal, "Cannot get object metadata from db: %v", err))
+		return
+	}
+	for _, rule := range validator.BagValidationConfig.TagRules {
+		triggerValue := ""
+		for _, tag := range obj.FindTag(rule.IfTag) {
+			value := strings.TrimSpace(tag.Value)
+			if value != "" && tagRuleApplies(rule, value) {
+				triggerValue = value
+				break
+			}
+		}
+		if triggerValue == "" {
+			continue
+		}
+		thenTagHasValue := false
+		thenTagFile := ""
+		for _, tag := range obj.FindTag(rule.ThenTag) {
+			thenTagFile = tag.SourceFile
+			if strings.TrimSpace(tag.Value) != "" {
+				thenTagHasValue = true
+				break
+			}
+		}
+		if rule.ThenPresence == REQUIRED && !thenTagHasValue {
+			validator.addError(NewValidationError(ErrTagRule,
+				"Tag '%s' is required when tag '%s' is '%s'.",
+				rule.ThenTag, rule.IfTag, triggerValue))
+		} else if rule.ThenPresence == FORBIDDEN && thenTagFile != "" {
+			validationError := NewValidationError(ErrTagRule,
+				"Tag '%s' is not allowed when tag '%s' is '%s'.",
+				rule.ThenTag, rule.IfTag, triggerValue)
+			validationError.FilePath = thenTagFile
+			validator.addError(validationError)
+		}
+	}
+}
+
+// tagRuleApplies returns true if value meets the rule's IfValues
+// and IfPattern conditions.
+func tagRuleApplies(rule TagRule, value string) bool {
+	if len(rule.IfValues) > 0 {
+		valueMatches := false
+		for _, ifValue := range rule.IfValues {
+			if strings.EqualFold(strings.TrimSpace(ifValue), value) {
+				valueMatches = true
+				break
+			}
+		}
+		if !valueMatches {
+			return false
+		}
+	}
+	return rule.IfPatternRegex == nil || rule.IfPatternRegex.MatchString(value)
+}
+
+// verifyBagItVersion ensures that bagit.txt declares one of the
+// BagIt versions listed in the config's AcceptBagItVersion.
+func (validator *Validator) verifyBagItVersion() {
+	acceptVersions := validator.BagValidationConfig.AcceptBagItVersion
+	if len(acceptVersions) == 0 {
+		return
+	}
+	validator.log(fmt.Sprintf("Verifying BagIt version for %s", validator.PathToBag))
+	obj, err := validator.getIntellectualObject()
+	if err != nil {
+		validator.addError(NewValidationError(ErrInternal, "Cannot get object metadata from db: %v", err))
+		return
+	}
+	version := ""
+	for _, tag := range obj.FindTag("BagIt-Version") {
+		if tag.SourceFile == "bagit.txt" {
+			version = strings.TrimSpace(tag.Value)
+			break
+		}
+	}
+	if version == "" {
+		validator.addError(NewValidationError(ErrBagItVersion, "bagit.txt is missing or does not specify a BagIt-Version."))
+	} else if !util.StringListContains(acceptVersions, version) {
+		validator.addError(NewValidationError(ErrBagItVersion, "BagIt-Version '%s' is not accepted. Accepted versions: %s",
+			version, strings.Join(acceptVersions, ", ")))
+	}
+}
+
+// verifyPayloadOxum ensures that the Payload-Oxum in bag-info.txt,
+// if there is one, matches the number of bytes and files in the
+// payload. We check this only in strict RFC 8493 mode.
+func (validator *Validator) verifyPayloadOxum() {
+	if !validator.BagValidationConfig.StrictRFC8493 {
+		return
+	}
+	validator.log(fmt.Sprintf("Verifying Payload-Oxum for %s", validator.PathToBag))
+	obj, err := validator.getIntellectualObject()
+	if err != nil {
+		validator.addError(NewValidationError(ErrInternal, "Cannot get object metadata from db: %v", err))
+		return
+	}
+	oxum := ""
+	for _, tag := range obj.FindTag("Payload-Oxum") {
+		if tag.SourceFile == "bag-info.txt" {
+			oxum = strings.TrimSpace(tag.Value)
+			break
+		}
+	}
+	if oxum == "" {
+		return // Payload-Oxum is recommended, not required
+	}
+	var byteCount, fileCount int64
+	_, err = fmt.Sscanf(oxum, "%d.%d", &byteCount, &fileCount)
+	if err != nil || fmt.Sprintf("%d.%d", byteCount, fileCount) != oxum {
+		validationError := NewValidationError(ErrPayloadOxum,
+			"Payload-Oxum '%s' in bag-info.txt should be <octet count>.<file count>", oxum)
+		validationError.FilePath = "bag-info.txt"
+		validator.addError(validationError)
+		return
+	}
+	actual := fmt.Sprintf("%d.%d", validator.payloadBytes, validator.payloadFileCount)
+	if oxum != actual {
+		validationError := NewValidationError(ErrPayloadOxum,
+			"Payload-Oxum in bag-info.txt is '%s', but payload contains %d bytes in %d files",
+			oxum, validator.payloadBytes, validator.payloadFileCount)
+		validationError.FilePath = "bag-info.txt"
+		validationError.Expected = oxum
+		validationError.Actual = actual
+		validator.addError(validationError)
 	}
 }
 
@@ -747,7 +1455,7 @@ func (validator *Validator) verifyTagSpecs() {
 // It adds and error to the WorkSummary if not.
 func (validator *Validator) checkRequiredTag(tagName string, tags []*models.Tag, tagSpec TagSpec) {
 	if tags == nil {
-		validator.summary.AddError("Required tag '%s' is missing.", tagName)
+		validator.addError(NewValidationError(ErrRequiredTagMissing, "Required tag '%s' is missing.", tagName))
 		return
 	}
 	if !tagSpec.EmptyOK {
@@ -759,7 +1467,7 @@ func (validator *Validator) checkRequiredTag(tagName string, tags []*models.Tag,
 			}
 		}
 		if !tagHasValue {
-			validator.summary.AddError("Value for tag '%s' is missing.", tagName)
+			validator.addError(NewValidationError(ErrTagValueMissing, "Value for tag '%s' is missing.", tagName))
 		}
 	}
 }
@@ -770,18 +1478,149 @@ func (validator *Validator) checkRequiredTag(tagName string, tags []*models.Tag,
 func (validator *Validator) checkAllowedTagValue(tagName string, tags []*models.Tag, tagSpec TagSpec) {
 	valueOk := false
 	lastValue := ""
+	sourceFile := ""
 	for _, value := range tagSpec.AllowedValues {
 		for _, tag := range tags {
 			lcValue := strings.TrimSpace(strings.ToLower(value))
 			tagValue := strings.TrimSpace(strings.ToLower(tag.Value))
 			lastValue = tagValue
+			sourceFile = tag.SourceFile
 			if lcValue == tagValue {
 				valueOk = true
 			}
 		}
 	}
 	if !valueOk {
-		validator.summary.AddError("Tag '%s' has illegal value '%s'.", tagName, lastValue)
+		validationError := NewValidationError(ErrTagValueNotAllowed, "Tag '%s' has illegal value '%s'.", tagName, lastValue)
+		validationError.FilePath = sourceFile
+		validator.addError(validationError)
+	}
+}
+
+// checkTagCount ensures that a tag appears in its tag file no fewer
+// than MinCount and no more than MaxCount times.
+func (validator *Validator) checkTagCount(tagName string, tags []*models.Tag, tagSpec TagSpec) {
+	count := len(tags)
+	if tagSpec.MaxCount > 0 && count > tagSpec.MaxCount {
+		validationError := NewValidationError(ErrTagCount,
+			"Tag '%s' appears %d times in '%s', but may appear at most %d times.",
+			tagName, count, tagSpec.FilePath, tagSpec.MaxCount)
+		validationError.FilePath = tagSpec.FilePath
+		validator.addError(validationError)
+	} else if tagSpec.MinCount > 0 && count < tagSpec.MinCount {
+		validationError := NewValidationError(ErrTagCount,
+			"Tag '%s' appears %d times in '%s', but must appear at least %d times.",
+			tagName, count, tagSpec.FilePath, tagSpec.MinCount)
+		validationError.FilePath = tagSpec.FilePath
+		validator.addError(validationError)
+	}
+}
+
+// checkTagValueFormat ensures that each non-empty value of a tag
+// matches the TagSpec's Pattern and Format.
+func (validator *Validator) checkTagValueFormat(tagName string, tags []*models.Tag, tagSpec TagSpec) {
+	for _, tag := range tags {
+		value := strings.TrimSpace(tag.Value)
+		if value == "" {
+			continue
+		}
+		if tagSpec.PatternRegex != nil && !tagSpec.PatternRegex.MatchString(value) {
+			validationError := NewValidationError(ErrTagValuePattern,
+				"Tag '%s' has value '%s', which does not match pattern '%s'.",
+				tagName, value, tagSpec.Pattern)
+			validationError.FilePath = tag.SourceFile
+			validator.addError(validationError)
+		}
+		if tagSpec.Format != "" && !validTagValueFormat(tagSpec.Format, value) {
+			validationError := NewValidationError(ErrTagValueFormat,
+				"Tag '%s' has value '%s', which is not a valid %s.",
+				tagName, value, tagFormatDescriptions[tagSpec.Format])
+			validationError.FilePath = tag.SourceFile
+			validator.addError(validationError)
+		}
+	}
+}
+
+// tagFormatDescriptions describes each TagSpec.Format for error messages.
+var tagFormatDescriptions = map[string]string{
+	FORMAT_DATE:         "ISO-8601 date",
+	FORMAT_INTEGER:      "integer",
+	FORMAT_NUMBER:       "number",
+	FORMAT_BAG_COUNT:    "Bag-Count (e.g. '1 of 3' or '1 of ?')",
+	FORMAT_PAYLOAD_OXUM: "Payload-Oxum (<octet count>.<file count>)",
+}
+
+// isoDateLayouts are the forms of ISO-8601 dates that FORMAT_DATE
+// accepts. Fractional seconds are allowed after the seconds in any
+// of the date-time layouts.
+var isoDateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+}
+
+var integerRegex = regexp.MustCompile(`^[-+]?\d+$`)
+var numberRegex = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)$`)
+var bagCountRegex = regexp.MustCompile(`^(\d+)\s+of\s+(\d+|\?)$`)
+var payloadOxumRegex = regexp.MustCompile(`^\d+\.\d+$`)
+
+// validTagValueFormat returns true if value has the specified format.
+func validTagValueFormat(format, value string) bool {
+	switch format {
+	case FORMAT_DATE:
+		for _, layout := range isoDateLayouts {
+			if _, err := time.Parse(layout, value); err == nil {
+				return true
+			}
+		}
+		return false
+	case FORMAT_INTEGER:
+		return integerRegex.MatchString(value)
+	case FORMAT_NUMBER:
+		return numberRegex.MatchString(value)
+	case FORMAT_BAG_COUNT:
+		match := bagCountRegex.FindStringSubmatch(value)
+		if match == nil {
+			return false
+		}
+		var number, total int
+		fmt.Sscanf(match[1], "%d", &number)
+		if number < 1 {
+			return false
+		}
+		if match[2] == "?" {
+			return true
+		}
+		fmt.Sscanf(match[2], "%d", &total)
+		return number <= total
+	case FORMAT_PAYLOAD_OXUM:
+		return payloadOxumRegex.MatchString(value)
+	}
+	return true
+}
+
+// verifyFetchItems makes sure the bag contains every file listed in
+// fetch.txt. A holey bag is valid only after someone (like apt_fetch,
+// with Config.ResolveFetchTxt) has fetched those files into it. The
+// payload manifests cover fetched files like any others, so
+// verifyGenericFiles checks their digests.
+func (validator *Validator) verifyFetchItems() {
+	for _, item := range validator.fetchItems {
+		gfIdentifier := validator.gfIdentifier(item.FilePath)
+		gf, err := validator.db.GetGenericFile(gfIdentifier)
+		if err != nil {
+			validator.addError(NewValidationError(ErrInternal, "Error finding generic file '%s' in db: %v", gfIdentifier, err))
+			continue
+		}
+		if gf == nil {
+			validationError := NewValidationError(ErrFetchItemMissing,
+				"File '%s' in %s is missing from bag", item.FilePath, FetchTxtFile)
+			validationError.FilePath = item.FilePath
+			validationError.Manifest = FetchTxtFile
+			validationError.LineNumber = item.LineNumber
+			validator.addError(validationError)
+		}
 	}
 }
 
@@ -791,63 +1630,88 @@ func (validator *Validator) checkAllowedTagValue(tagName string, tags []*models.
 func (validator *Validator) verifyGenericFiles() {
 	validator.log(fmt.Sprintf("Verifying generic files for %s", validator.PathToBag))
 	detail := validator.fileValidationDetail()
+	var fileNames *fileNameIndex
+	if validator.BagValidationConfig.FileNameCollisionPolicy != "" {
+		fileNames = newFileNameIndex(validator.ExistingFilePaths)
+	}
+	payloadManifestAlgs := validator.payloadManifestAlgorithms()
 	gfIdentifiers := validator.db.FileIdentifiers()
 	validator.log(fmt.Sprintf("Housekeeping DB %d has files for %s", len(gfIdentifiers), validator.PathToBag))
 	count := 0
 	for _, gfIdentifier := range gfIdentifiers {
 		gf, err := validator.db.GetGenericFile(gfIdentifier)
 		if err != nil {
-			validator.summary.AddError("Cannot get GenericFile %s from BoltDB: %v", gfIdentifier, err)
+			validator.addError(NewValidationError(ErrInternal, "Cannot get GenericFile %s from BoltDB: %v", gfIdentifier, err))
 			validator.summary.ErrorIsFatal = true
 			return
 		}
 		// Flag illegal fetch.txt
 		if gf.OriginalPath() == "fetch.txt" && validator.BagValidationConfig.AllowFetchTxt == false {
-			validator.summary.AddError("Bag contains a fetch.txt file, but the profile does not allow it.")
+			validationError := NewValidationError(ErrFetchTxtNotAllowed, "Bag contains a fetch.txt file, but the profile does not allow it.")
+			validationError.FilePath = gf.OriginalPath()
+			validator.addError(validationError)
 		}
 
-		// Md5 digests
-		if gf.IngestManifestMd5 != "" && gf.IngestManifestMd5 != gf.IngestMd5 {
-			validator.summary.AddError(
-				"Bad md5 digest for '%s': manifest says '%s', file digest is '%s'",
-				gf.OriginalPath(), gf.IngestManifestMd5, gf.IngestMd5)
-		} else {
-			gf.IngestMd5VerifiedAt = time.Now().UTC()
-		}
-		// Sha256 digests
-		if gf.IngestManifestSha256 != "" && gf.IngestManifestSha256 != gf.IngestSha256 {
-			validator.summary.AddError(
-				"Bad sha256 digest for '%s': manifest says '%s', file digest is '%s'",
-				gf.OriginalPath(), gf.IngestManifestSha256, gf.IngestSha256)
-		} else {
-			gf.IngestSha256VerifiedAt = time.Now().UTC()
+		// Compare digests for each algorithm
+		inAnyManifest := false
+		for _, alg := range validator.algorithms {
+			manifestDigest := gf.IngestManifestDigest(alg)
+			fileDigest := gf.IngestDigest(alg)
+			if manifestDigest != "" {
+				inAnyManifest = true
+			}
+			if manifestDigest != "" && manifestDigest != fileDigest {
+				validationError := NewValidationError(ErrBadDigest,
+					"Bad %s digest for '%s': manifest says '%s', file digest is '%s'",
+					alg, gf.OriginalPath(), manifestDigest, fileDigest)
+				validationError.FilePath = gf.OriginalPath()
+				validationError.Algorithm = alg
+				validationError.Expected = manifestDigest
+				validationError.Actual = fileDigest
+				location := validator.badDigestLines[gf.Identifier+"|"+alg]
+				validationError.Manifest = location.manifest
+				validationError.LineNumber = location.lineNumber
+				validator.addError(validationError)
+			} else {
+				gf.SetIngestDigestVerifiedAt(alg, time.Now().UTC())
+			}
 		}
 		// No manifest entry?
-		if gf.IngestFileType == constants.PAYLOAD_FILE &&
-			gf.IngestManifestMd5 == "" && gf.IngestManifestSha256 == "" {
-			validator.summary.AddError(
-				"File '%s' does not appear in any payload manifest (md5 or sha256)",
-				gf.OriginalPath())
+		if gf.IngestFileType == constants.PAYLOAD_FILE && !inAnyManifest {
+			validationError := NewValidationError(ErrFileNotInManifest,
+				"File '%s' does not appear in any payload manifest (%s)",
+				gf.OriginalPath(), strings.Join(validator.algorithms, " or "))
+			validationError.FilePath = gf.OriginalPath()
+			validator.addError(validationError)
+		} else if gf.IngestFileType == constants.PAYLOAD_FILE && validator.BagValidationConfig.StrictRFC8493 {
+			validator.verifyInEveryManifest(gf, payloadManifestAlgs)
+		}
+		if fileNames != nil {
+			validator.checkFileNameCollision(fileNames, gf)
 		}
 		// Make sure name is valid
 		if util.ContainsControlCharacter(gf.OriginalPath()) ||
 			util.LooksLikeEscapedControl(gf.OriginalPath()) {
-			validator.summary.AddError(
+			validationError := NewValidationError(ErrIllegalFileName,
 				"File name '%s' contains an illegal unicode control character",
 				gf.OriginalPath())
+			validationError.FilePath = gf.OriginalPath()
+			validator.addError(validationError)
 		} else if validator.BagValidationConfig.FileNameRegex != nil {
 			for _, pathComponent := range strings.Split(gf.OriginalPath(), "/") {
 				if !validator.BagValidationConfig.FileNameRegex.MatchString(pathComponent) {
-					validator.summary.AddError(
+					validationError := NewValidationError(ErrIllegalFileName,
 						"Filename '%s' is not valid according to %s",
 						gf.OriginalPath(), detail)
+					validationError.FilePath = gf.OriginalPath()
+					validator.addError(validationError)
 				}
 			}
 		}
 		err = validator.db.Save(gf.Identifier, gf)
 		if err != nil {
-			validator.summary.AddError("Cannot save GenericFile %s to db after comparing checksums",
-				gf.Identifier)
+			validator.addError(NewValidationError(ErrInternal, "Cannot save GenericFile %s to db after comparing checksums",
+				gf.Identifier))
 		}
 		count += 1
 		if count%1000 == 0 {
@@ -856,6 +1720,124 @@ func (validator *Validator) verifyGenericFiles() {
 	}
 }
 
+// payloadManifestAlgorithms returns the algorithms of the payload
+// manifests in the bag that we can verify.
+func (validator *Validator) payloadManifestAlgorithms() []string {
+	algs := make([]string, 0)
+	for _, manifest := range validator.manifests {
+		match := manifestAlgRegex.FindStringSubmatch(manifest)
+		if match == nil {
+			continue
+		}
+		alg := strings.ToLower(match[1])
+		if util.StringListContains(validator.algorithms, alg) && !util.StringListContains(algs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// verifyInEveryManifest ensures that a payload file appears in every
+// payload manifest, as RFC 8493 requires.
+func (validator *Validator) verifyInEveryManifest(gf *models.GenericFile, algs []string) {
+	for _, alg := range algs {
+		if gf.IngestManifestDigest(alg) == "" {
+			validationError := NewValidationError(ErrFileNotInEveryManifest,
+				"File '%s' does not appear in payload manifest manifest-%s.txt",
+				gf.OriginalPath(), alg)
+			validationError.FilePath = gf.OriginalPath()
+			validationError.Manifest = fmt.Sprintf("manifest-%s.txt", alg)
+			validationError.Algorithm = alg
+			validator.addError(validationError)
+		}
+	}
+}
+
+// fileNameIndex lets us find file names that differ only by Unicode
+// normalization or by case.
+type fileNameIndex struct {
+	// byNFC maps the NFC form of each name to the name.
+	byNFC map[string]string
+	// byFold maps the case-folded NFC form of each name to the name.
+	byFold map[string]string
+	// existing lists the names of files already in preservation storage.
+	existing map[string]bool
+	// folder does full Unicode case folding, so that names like
+	// "Straße" and "STRASSE" collide. A Caser keeps state, so each
+	// index gets its own.
+	folder cases.Caser
+}
+
+func newFileNameIndex(existingFilePaths []string) *fileNameIndex {
+	index := &fileNameIndex{
+		byNFC:    make(map[string]string),
+		byFold:   make(map[string]string),
+		existing: make(map[string]bool),
+		folder:   cases.Fold(),
+	}
+	for _, filePath := range existingFilePaths {
+		index.existing[filePath] = true
+		index.add(filePath)
+	}
+	return index
+}
+
+func (index *fileNameIndex) add(filePath string) {
+	nfc := norm.NFC.String(filePath)
+	if _, ok := index.byNFC[nfc]; !ok {
+		index.byNFC[nfc] = filePath
+	}
+	fold := index.fold(nfc)
+	if _, ok := index.byFold[fold]; !ok {
+		index.byFold[fold] = filePath
+	}
+}
+
+// fold returns the case-folded NFC form of nfc.
+func (index *fileNameIndex) fold(nfc string) string {
+	return norm.NFC.String(index.folder.String(nfc))
+}
+
+// checkFileNameCollision reports a problem if the name of gf differs
+// only by Unicode normalization or case from the name of another file
+// in the bag or in preservation storage. A file with exactly the same
+// name as a file in preservation storage is a new version of that
+// file, not a collision.
+func (validator *Validator) checkFileNameCollision(index *fileNameIndex, gf *models.GenericFile) {
+	filePath := gf.OriginalPath()
+	nfc := norm.NFC.String(filePath)
+	var validationError *ValidationError
+	if other, ok := index.byNFC[nfc]; ok && other != filePath {
+		if index.existing[other] {
+			validationError = NewValidationError(ErrNormalizationCollision,
+				"File '%s' has the same name after Unicode normalization as '%s', "+
+					"which is already in preservation storage", filePath, other)
+		} else {
+			validationError = NewValidationError(ErrNormalizationCollision,
+				"Files '%s' and '%s' have the same name after Unicode normalization",
+				other, filePath)
+		}
+	} else if other, ok := index.byFold[index.fold(nfc)]; ok && norm.NFC.String(other) != nfc {
+		if index.existing[other] {
+			validationError = NewValidationError(ErrCaseCollision,
+				"File '%s' has a name that differs only by case from '%s', "+
+					"which is already in preservation storage", filePath, other)
+		} else {
+			validationError = NewValidationError(ErrCaseCollision,
+				"Files '%s' and '%s' have names that differ only by case", other, filePath)
+		}
+	}
+	index.add(filePath)
+	if validationError == nil {
+		return
+	}
+	validationError.FilePath = filePath
+	if validator.BagValidationConfig.FileNameCollisionPolicy == COLLISION_WARN {
+		validationError.Severity = SeverityWarning
+	}
+	validator.addError(validationError)
+}
+
 // fileValidationDetail returns a specific description of the file name
 // validation rules in effect.
 func (validator *Validator) fileValidationDetail() string {
@@ -888,3 +1870,10 @@ func (validator *Validator) log(message string) {
 		validator.Logger.Info("[validator] %s", message)
 	}
 }
+
+// parseBuffer holds a copy of a manifest or tag file from a streamed
+// bag, which we'll parse after reading through the whole bag.
+type parseBuffer struct {
+	fileSummary *fileutil.FileSummary
+	data        bytes.Buffer
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/APTrust/exchange/validation"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -202,6 +203,39 @@ func TestValidator_FromTarFile_BagInvalid(t *testing.T) {
 	assert.True(t, util.StringListContains(summary.Errors, err_8))
 }
 
+// Read valid bags from zip and gzipped tar files.
+func TestValidator_FromZipAndGzip_BagValid(t *testing.T) {
+	for _, bagName := range []string{"example.edu.tagsample_good.zip", "example.edu.tagsample_good.tar.gz"} {
+		validator := getValidator(t, bagName, true)
+		assert.Equal(t, "example.edu.tagsample_good", validator.ObjIdentifier)
+		assert.True(t, strings.HasSuffix(validator.DBName(), "example.edu.tagsample_good.valdb"))
+		summary, err := validator.Validate()
+		deleteFile(validator.DBName())
+		assert.Nil(t, err)
+		require.NotNil(t, summary)
+		assert.False(t, summary.HasErrors(), bagName+": "+summary.AllErrorsAsString())
+	}
+}
+
+// Checksum and top-level folder rules apply to every serialization.
+func TestValidator_FromZipAndGzip_BagInvalid(t *testing.T) {
+	validator := validatorWithOptionalSpec(t, "example.edu.sample_bad_checksums.tgz")
+	summary, err := validator.Validate()
+	deleteFile(validator.DBName())
+	assert.Nil(t, err)
+	require.NotNil(t, summary)
+	assert.Equal(t, 5, len(summary.Errors))
+	assert.True(t, util.StringListContains(summary.Errors, "Bad md5 digest for 'data/datastream-DC': manifest says '44d85cf4810d6c6fe877BlahBlahBlah', file digest is '44d85cf4810d6c6fe87750117633e461'"))
+
+	validator = validatorWithOptionalSpec(t, "example.edu.sample_wrong_folder_name.zip")
+	summary, err = validator.Validate()
+	deleteFile(validator.DBName())
+	assert.Nil(t, err)
+	require.NotNil(t, summary)
+	assert.Equal(t, 1, len(summary.Errors))
+	assert.True(t, util.StringListContains(summary.Errors, "Tarred bag should untar to directory 'example.edu.sample_wrong_folder_name', not 'wrong_folder_name'"))
+}
+
 // Read a valid bag from a directory
 func TestValidator_FromDirectory_BagValid(t *testing.T) {
 	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
@@ -753,3 +787,591 @@ func TestNewValidator_SetIntelObjTagValue(t *testing.T) {
 	validator.SetIntelObjTagValue(obj, internalSenderDescription)
 	assert.Equal(t, description.Value, obj.Description)
 }
+
+// Make sure we can validate a bag whose only payload manifest
+// is manifest-sha512.txt.
+func TestValidator_Sha512OnlyBag(t *testing.T) {
+	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
+	require.Nil(t, err)
+	if tempDir != "" {
+		defer os.RemoveAll(tempDir)
+	}
+	for _, name := range []string{"manifest-md5.txt", "manifest-sha256.txt",
+		"tagmanifest-md5.txt", "tagmanifest-sha256.txt"} {
+		require.Nil(t, os.Remove(filepath.Join(bagPath, name)))
+	}
+	dataFiles := []string{"data/datastream-DC", "data/datastream-descMetadata",
+		"data/datastream-MARC", "data/datastream-RELS-EXT"}
+	manifestLines := make([]string, 0)
+	for _, name := range dataFiles {
+		digest, err := fileutil.CalculateChecksum(filepath.Join(bagPath, name), constants.AlgSha512)
+		require.Nil(t, err)
+		manifestLines = append(manifestLines, digest+"  "+name)
+	}
+	manifestPath := filepath.Join(bagPath, "manifest-sha512.txt")
+	err = ioutil.WriteFile(manifestPath, []byte(strings.Join(manifestLines, "\n")+"\n"), 0644)
+	require.Nil(t, err)
+
+	// The APTrust config still requires manifest-md5.txt.
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	validator, err := validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.True(t, util.StringListContains(summary.Errors,
+		"Required file 'manifest-md5.txt' is missing."), summary.AllErrorsAsString())
+
+	conf, errors = validation.LoadBagValidationConfig(path.Join("config", "example_any_manifest_bag_validation_config.json"))
+	require.Empty(t, errors)
+	validator, err = validation.NewValidator(bagPath, conf, true)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	gf, err := db.GetGenericFile("example.edu.tagsample_good/data/datastream-DC")
+	db.Close()
+	require.Nil(t, err)
+	require.NotNil(t, gf)
+	assert.Equal(t, 128, len(gf.IngestManifestDigest(constants.AlgSha512)))
+	assert.Equal(t, gf.IngestManifestDigest(constants.AlgSha512), gf.IngestDigest(constants.AlgSha512))
+	assert.Equal(t, 40, len(gf.IngestDigest(constants.AlgSha1)))
+
+	// Now corrupt one of the digests.
+	manifestLines[0] = strings.Repeat("0", 128) + "  " + dataFiles[0]
+	err = ioutil.WriteFile(manifestPath, []byte(strings.Join(manifestLines, "\n")+"\n"), 0644)
+	require.Nil(t, err)
+	validator, err = validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(summary.Errors), summary.AllErrorsAsString())
+	assert.True(t, strings.HasPrefix(summary.Errors[0],
+		"Bad sha512 digest for 'data/datastream-DC': manifest says '000000"))
+}
+
+// getStreamValidator returns a validator that reads the named test bag
+// through a stream, with its .valdb in tempDir.
+func getStreamValidator(t *testing.T, bagName, tempDir string) (*validation.Validator, *os.File) {
+	tarFile, err := os.Open(getBagPath(t, bagName))
+	require.Nil(t, err)
+	validator, err := validation.NewStreamValidator(filepath.Join(tempDir, bagName),
+		tarFile, getConfig(t), true)
+	require.Nil(t, err)
+	return validator, tarFile
+}
+
+func TestNewStreamValidator(t *testing.T) {
+	_, err := validation.NewStreamValidator("/no/such/bag.tar", nil, getConfig(t), true)
+	assert.NotNil(t, err)
+	_, err = validation.NewStreamValidator("/no/such/bag", strings.NewReader(""), getConfig(t), true)
+	assert.NotNil(t, err)
+
+	// The bag doesn't have to exist on disk.
+	validator, err := validation.NewStreamValidator("/no/such/bag.tar", strings.NewReader(""), getConfig(t), true)
+	require.Nil(t, err)
+	assert.Equal(t, "/no/such/bag.valdb", validator.DBName())
+}
+
+func TestStreamValidator_BagValid(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stream_validator")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	validator, tarFile := getStreamValidator(t, "example.edu.tagsample_good.tar", tempDir)
+	defer tarFile.Close()
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	boltDB, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	require.NotNil(t, boltDB)
+	defer boltDB.Close()
+	obj, err := boltDB.GetIntellectualObject("example.edu.tagsample_good")
+	require.Nil(t, err)
+	require.NotNil(t, obj)
+	assert.NotEmpty(t, obj.Title)
+	assert.NotEmpty(t, obj.Access)
+	assert.Equal(t, 10, len(obj.IngestTags))
+	assert.Equal(t, []string{"example.edu.tagsample_good"}, obj.IngestTopLevelDirNames)
+
+	identifiers := boltDB.FileIdentifiers()
+	require.NotEmpty(t, identifiers)
+	for _, identifier := range identifiers {
+		gf, err := boltDB.GetGenericFile(identifier)
+		require.Nil(t, err)
+		assert.NotEmpty(t, gf.IngestMd5, identifier)
+		assert.NotEmpty(t, gf.IngestSha256, identifier)
+		assert.True(t, gf.IngestTarOffset > 0, identifier)
+	}
+}
+
+// A streamed bag should get exactly the same errors as the same bag
+// read from disk.
+func TestStreamValidator_BagInvalid(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stream_validator")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	validator, tarFile := getStreamValidator(t, "example.edu.tagsample_bad.tar", tempDir)
+	defer tarFile.Close()
+	streamSummary, err := validator.Validate()
+	require.Nil(t, err)
+
+	validator = getValidator(t, "example.edu.tagsample_bad.tar", true)
+	defer deleteFile(validator.DBName())
+	fileSummary, err := validator.Validate()
+	require.Nil(t, err)
+
+	require.True(t, streamSummary.HasErrors())
+	assert.ElementsMatch(t, fileSummary.Errors, streamSummary.Errors)
+}
+
+// The parts of a multipart bag validate together as one bag.
+// Our multipart test bags have no tag manifests.
+func multipartConfig(t *testing.T) *validation.BagValidationConfig {
+	bagValidationConfig, err := getValidationConfig()
+	require.Nil(t, err)
+	bagValidationConfig.FileSpecs["tagmanifest-md5.txt"] = validation.FileSpec{Presence: "OPTIONAL"}
+	return bagValidationConfig
+}
+
+func TestMultipartValidator_BagValid(t *testing.T) {
+	parts := []string{
+		getBagPath(t, "example.edu.multipart.b01.of02.tar"),
+		getBagPath(t, "example.edu.multipart.b02.of02.tar"),
+	}
+	validator, err := validation.NewMultipartValidator(parts, multipartConfig(t), true)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	assert.Equal(t, "example.edu.multipart", validator.ObjIdentifier)
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	defer db.Close()
+	obj, err := db.GetIntellectualObject("example.edu.multipart")
+	require.Nil(t, err)
+	require.NotNil(t, obj)
+	assert.Equal(t, []string{"example.edu.multipart.b01.of02", "example.edu.multipart.b02.of02"},
+		obj.IngestTopLevelDirNames)
+	assert.Equal(t, []string{"manifest-md5.txt"}, obj.IngestManifests)
+
+	expectedParts := map[string]string{
+		"example.edu.multipart/data/multipart_file01.xml": "example.edu.multipart.b01.of02.tar",
+		"example.edu.multipart/data/multipart_file04.txt": "example.edu.multipart.b02.of02.tar",
+		"example.edu.multipart/bag-info.txt":              "example.edu.multipart.b01.of02.tar",
+	}
+	for identifier, partName := range expectedParts {
+		gf, err := db.GetGenericFile(identifier)
+		require.Nil(t, err)
+		require.NotNil(t, gf, identifier)
+		assert.Equal(t, partName, gf.IngestBagPart)
+		if gf.IngestFileType == constants.PAYLOAD_FILE {
+			assert.NotEmpty(t, gf.IngestManifestDigest(constants.AlgMd5), identifier)
+		}
+	}
+}
+
+func TestMultipartValidator_BagInvalid(t *testing.T) {
+	_, err := validation.NewMultipartValidator(nil, multipartConfig(t), true)
+	assert.NotNil(t, err)
+	_, err = validation.NewMultipartValidator([]string{"/no/such/bag.b01.of02.tar"}, multipartConfig(t), true)
+	assert.NotNil(t, err)
+
+	// Copy part one so it looks like part two.
+	tempDir, err := ioutil.TempDir("", "multipart_validator")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	data, err := ioutil.ReadFile(getBagPath(t, "example.edu.multipart.b01.of02.tar"))
+	require.Nil(t, err)
+	copyOfPartOne := filepath.Join(tempDir, "example.edu.multipart.b02.of02.tar")
+	require.Nil(t, ioutil.WriteFile(copyOfPartOne, data, 0644))
+
+	parts := []string{getBagPath(t, "example.edu.multipart.b01.of02.tar"), copyOfPartOne}
+	validator, err := validation.NewMultipartValidator(parts, multipartConfig(t), true)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"Payload file 'data/multipart_file01.xml' appears in both example.edu.multipart.b01.of02.tar and example.edu.multipart.b02.of02.tar",
+		"Payload file 'data/multipart_file02.txt' appears in both example.edu.multipart.b01.of02.tar and example.edu.multipart.b02.of02.tar",
+		"Bag part example.edu.multipart.b02.of02.tar should untar to directory 'example.edu.multipart.b02.of02', not 'example.edu.multipart.b01.of02'",
+	}, summary.Errors)
+}
+
+// strictBag untars a good test bag without its tag manifests, adds a
+// payload file whose name needs percent-encoding, and returns the path
+// to the bag and a config for strict RFC 8493 validation.
+func strictBag(t *testing.T) (string, string, *validation.BagValidationConfig) {
+	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
+	require.Nil(t, err)
+	for _, name := range []string{"tagmanifest-md5.txt", "tagmanifest-sha256.txt"} {
+		require.Nil(t, os.Remove(filepath.Join(bagPath, name)))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagPath, "data", "50%.txt"), []byte("half\n"), 0644))
+	for _, alg := range []string{constants.AlgMd5, constants.AlgSha256} {
+		digest, err := fileutil.CalculateChecksum(filepath.Join(bagPath, "data", "50%.txt"), alg)
+		require.Nil(t, err)
+		appendToFile(t, filepath.Join(bagPath, "manifest-"+alg+".txt"), digest+"  data/50%25.txt\n")
+	}
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	conf.StrictRFC8493 = true
+	return tempDir, bagPath, conf
+}
+
+func appendToFile(t *testing.T, filePath, text string) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, err)
+	_, err = file.WriteString(text)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+}
+
+func TestValidator_StrictRFC8493_BagValid(t *testing.T) {
+	tempDir, bagPath, conf := strictBag(t)
+	defer os.RemoveAll(tempDir)
+	// 13821 bytes in the original four files, plus 5 in 50%.txt.
+	appendToFile(t, filepath.Join(bagPath, "bag-info.txt"), "Payload-Oxum: 13826.5\n")
+
+	validator, err := validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+}
+
+func TestValidator_StrictRFC8493_BagInvalid(t *testing.T) {
+	tempDir, bagPath, conf := strictBag(t)
+	defer os.RemoveAll(tempDir)
+	appendToFile(t, filepath.Join(bagPath, "bag-info.txt"), "Payload-Oxum: 13821.4\n")
+	bagitTxt, err := ioutil.ReadFile(filepath.Join(bagPath, "bagit.txt"))
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagPath, "bagit.txt"),
+		append([]byte("\xEF\xBB\xBF"), bagitTxt...), 0644))
+	appendToFile(t, filepath.Join(bagPath, "manifest-md5.txt"),
+		"44d85cf4810d6c6fe87750117633e461  data\\datastream-DC\n")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagPath, "data", "100%.txt"), []byte("full\n"), 0644))
+	digest, err := fileutil.CalculateChecksum(filepath.Join(bagPath, "data", "100%.txt"), constants.AlgMd5)
+	require.Nil(t, err)
+	appendToFile(t, filepath.Join(bagPath, "manifest-md5.txt"), digest+"  data/100%.txt\n")
+
+	validator, err := validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	require.True(t, summary.HasErrors())
+	counts := validator.Result().CountByCode()
+	assert.Equal(t, 1, counts[validation.ErrPayloadOxum], summary.AllErrorsAsString())
+	assert.Equal(t, 1, counts[validation.ErrBagItBOM], summary.AllErrorsAsString())
+	assert.Equal(t, 1, counts[validation.ErrBackslashPath], summary.AllErrorsAsString())
+	assert.Equal(t, 1, counts[validation.ErrPathEncoding], summary.AllErrorsAsString())
+	assert.Equal(t, 1, counts[validation.ErrFileNotInEveryManifest], summary.AllErrorsAsString())
+	assert.Contains(t, summary.Errors,
+		"Payload-Oxum in bag-info.txt is '13821.4', but payload contains 13831 bytes in 6 files")
+	assert.Contains(t, summary.Errors,
+		"File 'data/100%.txt' does not appear in payload manifest manifest-sha256.txt")
+	notInEveryManifest := validator.Result().ErrorsWithCode(validation.ErrFileNotInEveryManifest)[0]
+	assert.Equal(t, "data/100%.txt", notInEveryManifest.FilePath)
+
+	// The BOM doesn't stop us from reading the BagIt version.
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	obj, err := db.GetIntellectualObject("example.edu.tagsample_good")
+	db.Close()
+	require.Nil(t, err)
+	require.NotEmpty(t, obj.FindTag("BagIt-Version"))
+
+	// Without strict mode, we don't check any of these.
+	conf.StrictRFC8493 = false
+	validator, err = validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	_, err = validator.Validate()
+	require.Nil(t, err)
+	counts = validator.Result().CountByCode()
+	for _, code := range []validation.ErrorCode{validation.ErrPayloadOxum, validation.ErrBagItBOM,
+		validation.ErrBackslashPath, validation.ErrPathEncoding, validation.ErrFileNotInEveryManifest} {
+		assert.Equal(t, 0, counts[code], string(code))
+	}
+}
+
+// tagConstraintValidator returns a validator for example.edu.tagsample_good
+// that enforces the specified tag specs and rules in addition to the
+// APTrust config.
+func tagConstraintValidator(t *testing.T, tagSpecs map[string]validation.TagSpec, tagRules []validation.TagRule) *validation.Validator {
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	for tagName, tagSpec := range tagSpecs {
+		conf.TagSpecs[tagName] = tagSpec
+	}
+	conf.TagRules = tagRules
+	validator, err := validation.NewValidator(getBagPath(t, "example.edu.tagsample_good.tar"), conf, false)
+	require.Nil(t, err)
+	return validator
+}
+
+func TestValidator_TagConstraints_BagValid(t *testing.T) {
+	tagSpecs := map[string]validation.TagSpec{
+		"Bagging-Date": {FilePath: "bag-info.txt", Presence: validation.REQUIRED,
+			Format: validation.FORMAT_DATE, MaxCount: 1},
+		"Bag-Count": {FilePath: "bag-info.txt", Presence: validation.OPTIONAL,
+			Format: validation.FORMAT_BAG_COUNT},
+		"Internal-Sender-Identifier": {FilePath: "bag-info.txt", Presence: validation.OPTIONAL,
+			Pattern: `uva-internal-id-\d{4}`},
+		"Payload-Oxum": {FilePath: "bag-info.txt", Presence: validation.FORBIDDEN},
+	}
+	tagRules := []validation.TagRule{
+		{IfTag: "Access", IfValues: []string{"institution"}, ThenTag: "Source-Organization",
+			ThenPresence: validation.REQUIRED},
+		{IfTag: "Access", IfValues: []string{"Restricted"}, ThenTag: "Bag-Group-Identifier",
+			ThenPresence: validation.FORBIDDEN},
+	}
+	validator := tagConstraintValidator(t, tagSpecs, tagRules)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+}
+
+func TestValidator_TagConstraints_BagInvalid(t *testing.T) {
+	tagSpecs := map[string]validation.TagSpec{
+		"Bagging-Date": {FilePath: "bag-info.txt", Presence: validation.REQUIRED,
+			Format: validation.FORMAT_INTEGER},
+		"Source-Organization": {FilePath: "bag-info.txt", Presence: validation.REQUIRED,
+			MinCount: 2},
+		"Internal-Sender-Identifier": {FilePath: "bag-info.txt", Presence: validation.OPTIONAL,
+			Pattern: `\d+`},
+	}
+	tagRules := []validation.TagRule{
+		{IfTag: "Bag-Count", IfPattern: `1 of \d+`, ThenTag: "Bag-Size",
+			ThenPresence: validation.REQUIRED},
+		{IfTag: "Source-Organization", ThenTag: "Bag-Group-Identifier",
+			ThenPresence: validation.FORBIDDEN},
+	}
+	validator := tagConstraintValidator(t, tagSpecs, tagRules)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"Tag 'Bagging-Date' has value '2014-04-14T11:55:26.17-0400', which is not a valid integer.",
+		"Tag 'Source-Organization' appears 1 times in 'bag-info.txt', but must appear at least 2 times.",
+		"Tag 'Internal-Sender-Identifier' has value 'uva-internal-id-0001', which does not match pattern '\\d+'.",
+		"Tag 'Bag-Size' is required when tag 'Bag-Count' is '1 of 1'.",
+		"Tag 'Bag-Group-Identifier' is not allowed when tag 'Source-Organization' is 'virginia.edu'.",
+	}, summary.Errors)
+	counts := validator.Result().CountByCode()
+	assert.Equal(t, 1, counts[validation.ErrTagValueFormat])
+	assert.Equal(t, 1, counts[validation.ErrTagCount])
+	assert.Equal(t, 1, counts[validation.ErrTagValuePattern])
+	assert.Equal(t, 2, counts[validation.ErrTagRule])
+}
+
+// collisionBag untars a good test bag without its tag manifests, and
+// adds payload files whose names collide with others. It returns the
+// temp dir and the path to the bag.
+func collisionBag(t *testing.T, fileNames ...string) (string, string) {
+	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
+	require.Nil(t, err)
+	for _, name := range []string{"tagmanifest-md5.txt", "tagmanifest-sha256.txt"} {
+		require.Nil(t, os.Remove(filepath.Join(bagPath, name)))
+	}
+	for _, fileName := range fileNames {
+		filePath := filepath.Join(bagPath, "data", fileName)
+		require.Nil(t, ioutil.WriteFile(filePath, []byte(fileName), 0644))
+		for _, alg := range []string{constants.AlgMd5, constants.AlgSha256} {
+			digest, err := fileutil.CalculateChecksum(filePath, alg)
+			require.Nil(t, err)
+			appendToFile(t, filepath.Join(bagPath, "manifest-"+alg+".txt"), digest+"  data/"+fileName+"\n")
+		}
+	}
+	return tempDir, bagPath
+}
+
+func collisionValidator(t *testing.T, bagPath, policy string, existingFilePaths []string) *validation.Validator {
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	conf.FileNameCollisionPolicy = policy
+	validator, err := validation.NewValidator(bagPath, conf, true)
+	require.Nil(t, err)
+	validator.ExistingFilePaths = existingFilePaths
+	return validator
+}
+
+// NFC and NFD forms of café.txt.
+const cafeNFC = "caf\u00e9.txt"
+const cafeNFD = "cafe\u0301.txt"
+
+func TestValidator_FileNameCollisions(t *testing.T) {
+	tempDir, bagPath := collisionBag(t, cafeNFC, cafeNFD, "README.txt", "readme.txt")
+	defer os.RemoveAll(tempDir)
+
+	// Warnings don't make the bag invalid.
+	validator := collisionValidator(t, bagPath, validation.COLLISION_WARN, nil)
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	deleteFile(validator.DBName())
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	warnings := validator.Result().ErrorsWithSeverity(validation.SeverityWarning)
+	require.Equal(t, 2, len(warnings))
+	messages := []string{warnings[0].Message, warnings[1].Message}
+	assert.ElementsMatch(t, []string{
+		"Files 'data/README.txt' and 'data/readme.txt' have names that differ only by case",
+		"Files 'data/" + cafeNFD + "' and 'data/" + cafeNFC + "' have the same name after Unicode normalization",
+	}, messages)
+
+	validator = collisionValidator(t, bagPath, validation.COLLISION_REJECT, nil)
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	deleteFile(validator.DBName())
+	assert.Equal(t, 2, len(summary.Errors), summary.AllErrorsAsString())
+	counts := validator.Result().CountByCode()
+	assert.Equal(t, 1, counts[validation.ErrCaseCollision])
+	assert.Equal(t, 1, counts[validation.ErrNormalizationCollision])
+
+	// Normalizing can't turn two files into one.
+	validator = collisionValidator(t, bagPath, validation.COLLISION_NORMALIZE, nil)
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	deleteFile(validator.DBName())
+	counts = validator.Result().CountByCode()
+	assert.Equal(t, 1, counts[validation.ErrCaseCollision], summary.AllErrorsAsString())
+	assert.Equal(t, 1, counts[validation.ErrNormalizationCollision], summary.AllErrorsAsString())
+
+	// Without a policy, we don't check.
+	validator = collisionValidator(t, bagPath, "", nil)
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	deleteFile(validator.DBName())
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	assert.Empty(t, validator.Result().Errors)
+}
+
+// Case folding is more than lower-casing. Lower-case "STRASSE" is
+// "strasse", but lower-case "Straße" is still "straße".
+func TestValidator_FileNameCollisions_CaseFolding(t *testing.T) {
+	tempDir, bagPath := collisionBag(t, "Stra\u00dfe.txt", "STRASSE.txt")
+	defer os.RemoveAll(tempDir)
+	validator := collisionValidator(t, bagPath, validation.COLLISION_REJECT, nil)
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	deleteFile(validator.DBName())
+	require.Equal(t, 1, len(summary.Errors), summary.AllErrorsAsString())
+	assert.Equal(t, 1, validator.Result().CountByCode()[validation.ErrCaseCollision])
+}
+
+func TestValidator_FileNameCollisions_ExistingFiles(t *testing.T) {
+	tempDir, bagPath := collisionBag(t, cafeNFD)
+	defer os.RemoveAll(tempDir)
+
+	// A file with the same name as an existing file is a new version.
+	validator := collisionValidator(t, bagPath, validation.COLLISION_REJECT,
+		[]string{"data/datastream-DC", "data/" + cafeNFD})
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	deleteFile(validator.DBName())
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	validator = collisionValidator(t, bagPath, validation.COLLISION_REJECT,
+		[]string{"data/DATASTREAM-DC", "data/" + cafeNFC})
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	deleteFile(validator.DBName())
+	assert.ElementsMatch(t, []string{
+		"File 'data/datastream-DC' has a name that differs only by case from 'data/DATASTREAM-DC', which is already in preservation storage",
+		"File 'data/" + cafeNFD + "' has the same name after Unicode normalization as 'data/" + cafeNFC + "', which is already in preservation storage",
+	}, summary.Errors)
+
+	// Normalizing makes the NFD file a new version of the NFC file.
+	validator = collisionValidator(t, bagPath, validation.COLLISION_NORMALIZE,
+		[]string{"data/" + cafeNFC})
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	gf, err := db.GetGenericFile("example.edu.tagsample_good/data/" + cafeNFC)
+	db.Close()
+	require.Nil(t, err)
+	require.NotNil(t, gf)
+	assert.Equal(t, "data/"+cafeNFD, gf.IngestPathInBag)
+	assert.NotEmpty(t, gf.IngestManifestDigest(constants.AlgMd5))
+}
+
+// holeyBag returns a bag whose fetch.txt lists data/fetched.txt,
+// which is in the payload manifests but not in the bag.
+func holeyBag(t *testing.T) (string, string, *validation.BagValidationConfig) {
+	tempDir, bagPath := collisionBag(t, "fetched.txt")
+	require.Nil(t, os.Remove(filepath.Join(bagPath, "data", "fetched.txt")))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagPath, "fetch.txt"),
+		[]byte("file:///mnt/shared/fetched.txt 11 data/fetched.txt\n"), 0644))
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	conf.AllowFetchTxt = true
+	return tempDir, bagPath, conf
+}
+
+func TestValidator_FetchTxt(t *testing.T) {
+	tempDir, bagPath, conf := holeyBag(t)
+	defer os.RemoveAll(tempDir)
+
+	validator, err := validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	_, err = validator.Validate()
+	deleteFile(validator.DBName())
+	require.Nil(t, err)
+	result := validator.Result()
+	assert.False(t, result.Valid)
+	missing := result.ErrorsWithCode(validation.ErrFetchItemMissing)
+	require.Equal(t, 1, len(missing))
+	assert.Equal(t, "File 'data/fetched.txt' in fetch.txt is missing from bag", missing[0].Message)
+	assert.Equal(t, "data/fetched.txt", missing[0].FilePath)
+	assert.Equal(t, "fetch.txt", missing[0].Manifest)
+	assert.Equal(t, 1, missing[0].LineNumber)
+
+	// Once someone fetches the file, the bag is valid.
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagPath, "data", "fetched.txt"), []byte("fetched.txt"), 0644))
+	validator, err = validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	summary, err := validator.Validate()
+	deleteFile(validator.DBName())
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+}
+
+func TestValidator_FetchTxt_Strict(t *testing.T) {
+	tempDir, bagPath, conf := holeyBag(t)
+	defer os.RemoveAll(tempDir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagPath, "data", "fetched.txt"), []byte("fetched.txt"), 0644))
+	appendToFile(t, filepath.Join(bagPath, "fetch.txt"), "s3://bucket/key 10 ../outside.txt\n")
+
+	// Only strict mode reports syntax errors in fetch.txt.
+	validator, err := validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	_, err = validator.Validate()
+	deleteFile(validator.DBName())
+	require.Nil(t, err)
+	assert.Empty(t, validator.Result().ErrorsWithCode(validation.ErrFetchTxtSyntax))
+
+	conf.StrictRFC8493 = true
+	validator, err = validation.NewValidator(bagPath, conf, false)
+	require.Nil(t, err)
+	_, err = validator.Validate()
+	deleteFile(validator.DBName())
+	require.Nil(t, err)
+	syntaxErrors := validator.Result().ErrorsWithCode(validation.ErrFetchTxtSyntax)
+	require.Equal(t, 1, len(syntaxErrors))
+	assert.Equal(t, 2, syntaxErrors[0].LineNumber)
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -20,6 +19,10 @@ import (
 // sensible, cache Ingest WorkItems up to this many hours old.
 const DEFAULT_CACHE_HOURS = 24
 
+// If Config.MultipartBagWaitHours isn't set, wait this many hours
+// for the missing parts of a multipart bag before we give up on it.
+const DEFAULT_MULTIPART_WAIT_HOURS = 24
+
 // How many S3 keys should we fetch in each batch when
 // we're getting the contents of a bucket?
 const MAX_KEYS = 1000
@@ -88,9 +91,6 @@ func (reader *APTBucketReader) cacheInstitutions() error {
 		}
 		return resp.Error
 	}
-	if resp.Response.StatusCode != 200 {
-		return reader.processPharosError(resp)
-	}
 	for _, inst := range resp.Institutions() {
 		reader.Institutions[inst.Identifier] = inst
 		if reader.stats != nil {
@@ -113,43 +113,24 @@ func (reader *APTBucketReader) cacheRecentIngestItems() error {
 	}
 	createdAfter := time.Now().Add(time.Duration(-1*hours) * time.Hour).UTC()
 	params := url.Values{}
-	params.Add("page", "1")
-	params.Add("per_page", "100") // change to 4 to test hasMoreResults loop
+	params.Add("per_page", "100")
 	params.Add("item_action", constants.ActionIngest)
 	params.Add("created_after", createdAfter.Format(time.RFC3339))
-	hasMoreResults := true
-	for hasMoreResults {
-		resp := reader.Context.PharosClient.WorkItemList(params)
-		if resp.Error != nil {
-			if reader.stats != nil {
-				reader.stats.AddError(resp.Error.Error())
-			}
-			return resp.Error
-		}
-		if resp.Response.StatusCode != 200 {
-			return reader.processPharosError(resp)
-		}
-		reader.Context.MessageLog.Debug("%s", resp.Request.URL.String())
-		for _, workItem := range resp.WorkItems() {
-			hashKey := reader.makeHashKey(workItem.Name, workItem.ETag)
-			reader.RecentIngestItems[hashKey] = workItem
-			if reader.stats != nil {
-				reader.stats.AddWorkItem("WorkItemsCached", workItem)
-			}
+	iterator := reader.Context.PharosClient.WorkItemIterator(params, true)
+	defer iterator.Close()
+	for iterator.Next() {
+		workItem := iterator.WorkItem()
+		hashKey := reader.makeHashKey(workItem.Name, workItem.ETag)
+		reader.RecentIngestItems[hashKey] = workItem
+		if reader.stats != nil {
+			reader.stats.AddWorkItem("WorkItemsCached", workItem)
 		}
-		if resp.Next != nil {
-			pageNum, err := strconv.Atoi(params.Get("page"))
-			if err != nil {
-				msg := fmt.Sprintf("Page number '%s' doesn't look like a number!", params.Get("page"))
-				if reader.stats != nil {
-					reader.stats.AddError(msg)
-				}
-				return fmt.Errorf(msg)
-			}
-			params.Set("page", strconv.Itoa(pageNum+1))
-		} else {
-			hasMoreResults = false
+	}
+	if iterator.Err() != nil {
+		if reader.stats != nil {
+			reader.stats.AddError(iterator.Err().Error())
 		}
+		return iterator.Err()
 	}
 	reader.Context.MessageLog.Info("Loaded %d recent ingest WorkItems", len(reader.RecentIngestItems))
 	return nil
@@ -189,6 +170,8 @@ func (reader *APTBucketReader) processBucket(bucketName string) {
 		os.Getenv("AWS_SECRET_ACCESS_KEY"),
 		reader.Context.Config.APTrustS3Region,
 		bucketName, MAX_KEYS)
+	// We can't process a multipart bag until we've seen all its parts.
+	multipartBags := make(map[string]*models.MultipartBag)
 	keepFetching := true
 	for keepFetching {
 		s3ObjList.GetList("")
@@ -200,37 +183,143 @@ func (reader *APTBucketReader) processBucket(bucketName string) {
 			break
 		}
 		for _, s3Object := range s3ObjList.Response.Contents {
-			// Skip items in nested directories. Unfortunately, the prefix
-			// filter for s3.ListObjectsInput does not allow you to specify
-			// patterns or things you want to exclude.
-			if strings.Contains(*s3Object.Key, "/") {
-				msg := fmt.Sprintf("Ignoring %s (subdirectory)", *s3Object.Key)
-				reader.Context.MessageLog.Info(msg)
-				if reader.stats != nil {
-					reader.stats.AddWarning(msg)
-				}
-				continue
-			}
-			// Skip non-tar files
-			if !strings.HasSuffix(*s3Object.Key, ".tar") {
-				msg := fmt.Sprintf("Ignoring non-tar file %s", *s3Object.Key)
-				reader.Context.MessageLog.Info(msg)
-				if reader.stats != nil {
-					reader.stats.AddWarning(msg)
-				}
+			if !reader.isBagKey(*s3Object.Key) {
 				continue
 			}
-			// Ok, it's not in a nested directory, so let's process it.
 			if reader.stats != nil {
 				reader.stats.AddS3Item(fmt.Sprintf("%s/%s", bucketName, *s3Object.Key))
 			}
-			reader.processS3Object(s3Object, bucketName)
+			if _, _, isMultipart := util.MultipartBagPart(*s3Object.Key); isMultipart {
+				reader.addBagPart(multipartBags, s3Object)
+				continue
+			}
+			err := reader.processS3Object(s3Object, bucketName)
+			if network.IsPharosUnavailable(err) {
+				// Every other object would fail the same way,
+				// after the same retries. Try again next run.
+				msg := fmt.Sprintf("Skipping the rest of bucket %s because "+
+					"Pharos is unavailable: %v", bucketName, err)
+				reader.Context.MessageLog.Error(msg)
+				if reader.stats != nil {
+					reader.stats.AddError(msg)
+				}
+				return
+			}
 		}
 		keepFetching = *s3ObjList.Response.IsTruncated
 	}
+	for _, bag := range multipartBags {
+		reader.processMultipartBag(bag, bucketName)
+	}
 }
 
-func (reader *APTBucketReader) processS3Object(s3Object *s3.Object, bucketName string) {
+// isBagKey returns true if key looks like a bag we should ingest,
+// and logs the reason if it doesn't.
+func (reader *APTBucketReader) isBagKey(key string) bool {
+	msg := ""
+	if strings.Contains(key, "/") {
+		// Skip items in nested directories. Unfortunately, the prefix
+		// filter for s3.ListObjectsInput does not allow you to specify
+		// patterns or things you want to exclude.
+		msg = fmt.Sprintf("Ignoring %s (subdirectory)", key)
+	} else if util.SerializationSuffix(key) == "" {
+		// Skip anything that isn't a tar, tar.gz, tgz or zip file
+		msg = fmt.Sprintf("Ignoring non-bag file %s", key)
+	}
+	if msg == "" {
+		return true
+	}
+	reader.Context.MessageLog.Info(msg)
+	if reader.stats != nil {
+		reader.stats.AddWarning(msg)
+	}
+	return false
+}
+
+// addBagPart adds s3Object to the multipart bag it belongs to.
+func (reader *APTBucketReader) addBagPart(multipartBags map[string]*models.MultipartBag, s3Object *s3.Object) {
+	bagName := util.CleanBagName(*s3Object.Key)
+	bag := multipartBags[bagName]
+	if bag == nil {
+		bag = models.NewMultipartBag(bagName)
+		multipartBags[bagName] = bag
+	}
+	err := bag.AddPart(*s3Object.Key, *s3Object.ETag, *s3Object.Size, *s3Object.LastModified)
+	if err != nil {
+		reader.Context.MessageLog.Warning(err.Error())
+	}
+}
+
+// processMultipartBag queues a multipart bag for ingest once all of
+// its parts have arrived. The bag's WorkItem takes its name from part
+// one. If parts are still missing or duplicated after
+// Config.MultipartBagWaitHours, we record a failed WorkItem that
+// describes the problem, so the depositor can see it.
+func (reader *APTBucketReader) processMultipartBag(bag *models.MultipartBag, bucketName string) {
+	if bag.IsComplete() {
+		reader.processS3Object(multipartS3Object(bag, bag.FirstPartKey()), bucketName)
+		return
+	}
+	waitHours := reader.Context.Config.MultipartBagWaitHours
+	if waitHours < 1 {
+		waitHours = DEFAULT_MULTIPART_WAIT_HOURS
+	}
+	problems := strings.Join(bag.Problems(), " ")
+	if time.Since(bag.LastModified()) < time.Duration(waitHours)*time.Hour {
+		msg := fmt.Sprintf("Waiting for multipart bag %s/%s to be complete: %s",
+			bucketName, bag.BagName, problems)
+		reader.Context.MessageLog.Info(msg)
+		if reader.stats != nil {
+			reader.stats.AddWarning(msg)
+		}
+		return
+	}
+	// Part one may be missing, so name the WorkItem after
+	// the first part we do have.
+	key := bag.FirstPartKey()
+	if key == "" {
+		key = bag.SortedParts()[0].Key
+	}
+	s3Object := multipartS3Object(bag, key)
+	workItem, err := reader.findWorkItem(key, *s3Object.ETag)
+	if err != nil || workItem != nil {
+		// We already recorded this failure, or we can't tell whether
+		// we did. Either way, errors are logged at source.
+		return
+	}
+	workItem = reader.newWorkItem(bucketName, s3Object)
+	if workItem == nil {
+		return
+	}
+	workItem.Note = "Multipart bag is incomplete: " + problems
+	workItem.Status = constants.StatusFailed
+	workItem.Outcome = fmt.Sprintf("Gave up waiting for missing parts after %d hours", waitHours)
+	workItem.Retry = false
+	if reader.saveNewWorkItem(workItem) != nil {
+		reader.Context.MessageLog.Warning("Multipart bag %s/%s is incomplete: %s",
+			bucketName, bag.BagName, problems)
+	}
+}
+
+// multipartS3Object returns an s3.Object that describes all of the parts
+// of bag as if they were a single object named key.
+func multipartS3Object(bag *models.MultipartBag, key string) *s3.Object {
+	etag := bag.ETag()
+	size := bag.Size()
+	lastModified := bag.LastModified()
+	return &s3.Object{
+		Key:          &key,
+		ETag:         &etag,
+		Size:         &size,
+		LastModified: &lastModified,
+	}
+}
+
+// processS3Object creates a WorkItem for s3Object, if it doesn't already
+// have one, and queues it for ingest. It returns an error if we may
+// have failed to do that because Pharos or NSQ let us down. Errors are
+// logged at source.
+func (reader *APTBucketReader) processS3Object(s3Object *s3.Object, bucketName string) error {
 	if reader.Context.Config.MaxFileSize > int64(0) && *s3Object.Size > reader.Context.Config.MaxFileSize {
 		msg := fmt.Sprintf("Skipping %s/%s because size %d is greater than "+
 			"current max file size %d", bucketName, *s3Object.Key, *s3Object.Size,
@@ -239,7 +328,7 @@ func (reader *APTBucketReader) processS3Object(s3Object *s3.Object, bucketName s
 			reader.stats.AddWarning(msg)
 		}
 		reader.Context.MessageLog.Debug(msg)
-		return
+		return nil
 	}
 	workItem, err := reader.findWorkItem(*s3Object.Key, *s3Object.ETag)
 	if err != nil {
@@ -251,14 +340,14 @@ func (reader *APTBucketReader) processS3Object(s3Object *s3.Object, bucketName s
 		if reader.stats != nil {
 			reader.stats.AddWarning(msg)
 		}
-		return
+		return err
 	}
 	// A.D. added 2019-09-23: Requeue ingest if prior WorkItem was cancelled.
 	if workItem == nil || workItem.Status == constants.StatusCancelled {
 		workItem = reader.createWorkItem(bucketName, s3Object)
 		if workItem == nil {
 			// Error logged and statted at source.
-			return
+			return fmt.Errorf("Could not create WorkItem for %s/%s", bucketName, *s3Object.Key)
 		}
 	}
 	// Queue the item in NSQ if necessary. This will go into the fetch
@@ -267,9 +356,13 @@ func (reader *APTBucketReader) processS3Object(s3Object *s3.Object, bucketName s
 	if (workItem.QueuedAt == nil || workItem.QueuedAt.IsZero()) &&
 		workItem.Action == constants.ActionIngest &&
 		workItem.Stage == constants.StageReceive {
-		reader.addToNSQ(workItem)
+		err = reader.addToNSQ(workItem)
+		if err != nil {
+			return err
+		}
 		reader.markAsQueued(workItem)
 	}
+	return nil
 }
 
 func (reader *APTBucketReader) findWorkItem(key, etag string) (*models.WorkItem, error) {
@@ -289,17 +382,15 @@ func (reader *APTBucketReader) findWorkItem(key, etag string) (*models.WorkItem,
 	//params.Add("bag_date", lastModified.Format(time.RFC3339))
 	resp := reader.Context.PharosClient.WorkItemList(params)
 	if resp.Error != nil {
-		errMsg := fmt.Sprintf("Error getting WorkItem for name '%s', etag '%s': %v",
+		// Wrap the Pharos error, so processBucket can tell
+		// whether Pharos is down.
+		err := fmt.Errorf("Error getting WorkItem for name '%s', etag '%s': %w",
 			params.Get("name"), params.Get("etag"), resp.Error)
-		reader.Context.MessageLog.Debug("%s", resp.Request.URL.String())
-		reader.Context.MessageLog.Error(errMsg)
+		reader.Context.MessageLog.Debug("%s", resp.RequestURL())
+		reader.Context.MessageLog.Error(err.Error())
 		if reader.stats != nil {
-			reader.stats.AddError(errMsg)
+			reader.stats.AddError(err.Error())
 		}
-		return nil, fmt.Errorf(errMsg)
-	}
-	if resp.Response.StatusCode != 200 {
-		err := reader.processPharosError(resp)
 		return nil, err
 	}
 	workItem := resp.WorkItem()
@@ -314,8 +405,19 @@ func (reader *APTBucketReader) findWorkItem(key, etag string) (*models.WorkItem,
 	return workItem, nil
 }
 
+// createWorkItem creates a WorkItem in Pharos for the ingest of s3Object.
 func (reader *APTBucketReader) createWorkItem(bucket string, s3Object *s3.Object) *models.WorkItem {
-	// Create a WorkItem in Pharos
+	workItem := reader.newWorkItem(bucket, s3Object)
+	if workItem == nil {
+		return nil
+	}
+	return reader.saveNewWorkItem(workItem)
+}
+
+// newWorkItem returns a new ingest WorkItem for s3Object, without
+// saving it. Returns nil if we can't tell which institution owns
+// the bucket.
+func (reader *APTBucketReader) newWorkItem(bucket string, s3Object *s3.Object) *models.WorkItem {
 	institution := reader.Institutions[util.OwnerOf(bucket)]
 	if institution == nil {
 		errMsg := fmt.Sprintf("Cannot find institution record for item %s/%s. "+
@@ -342,49 +444,50 @@ func (reader *APTBucketReader) createWorkItem(bucket string, s3Object *s3.Object
 	workItem.Status = constants.StatusPending
 	workItem.Outcome = "Item is pending ingest"
 	workItem.Retry = true
+	return workItem
+}
+
+// saveNewWorkItem saves workItem to Pharos and returns the saved record,
+// or nil on error.
+func (reader *APTBucketReader) saveNewWorkItem(workItem *models.WorkItem) *models.WorkItem {
 	resp := reader.Context.PharosClient.WorkItemSave(workItem)
 
 	if resp.Error != nil {
 		errMsg := fmt.Sprintf("Error creating WorkItem for name '%s', etag '%s', time '%s': %v",
 			workItem.Name, workItem.ETag, workItem.BagDate, resp.Error)
-		reader.Context.MessageLog.Debug("%s", resp.Request.URL.String())
+		reader.Context.MessageLog.Debug("%s", resp.RequestURL())
 		reader.Context.MessageLog.Error(errMsg)
 		if reader.stats != nil {
 			reader.stats.AddError(errMsg)
 		}
 		return nil
 	}
-	if resp.Response.StatusCode != 201 {
-		reader.processPharosError(resp)
-		return nil
-	}
 
 	savedWorkItem := resp.WorkItem()
 	reader.Context.MessageLog.Debug("Created WorkItem with id %d for %s/%s in Pharos",
-		savedWorkItem.Id, bucket, *s3Object.Key)
+		savedWorkItem.Id, workItem.Bucket, workItem.Name)
 	if reader.stats != nil {
 		reader.stats.AddWorkItem("WorkItemsCreated", savedWorkItem)
 	}
 	return savedWorkItem
 }
 
-func (reader *APTBucketReader) addToNSQ(workItem *models.WorkItem) {
-	client := network.NewNSQClient(reader.Context.Config.NsqdHttpAddress)
-	err := client.Enqueue(reader.Context.Config.FetchWorker.NsqTopic, workItem.Id)
+func (reader *APTBucketReader) addToNSQ(workItem *models.WorkItem) error {
+	err := reader.Context.Queue.Enqueue(reader.Context.Config.FetchWorker.NsqTopic, workItem.Id)
 	if err != nil {
 		msg := fmt.Sprintf("Error sending WorkItem %d to NSQ: %v", workItem.Id, err)
 		if reader.stats != nil {
 			reader.stats.AddError(msg)
 		}
 		reader.Context.MessageLog.Error(msg)
-		return
+		return fmt.Errorf(msg)
 	}
 	reader.Context.MessageLog.Info("Added WorkItem id %d to NSQ (%s/%s)",
 		workItem.Id, workItem.Bucket, workItem.Name)
 	if reader.stats != nil {
 		reader.stats.AddWorkItem("WorkItemsQueued", workItem)
 	}
-	return
+	return nil
 }
 
 func (reader *APTBucketReader) markAsQueued(workItem *models.WorkItem) *models.WorkItem {
@@ -394,40 +497,19 @@ func (reader *APTBucketReader) markAsQueued(workItem *models.WorkItem) *models.W
 	if resp.Error != nil {
 		errMsg := fmt.Sprintf("Error setting QueuedAt for WorkItem with id %d: %v",
 			workItem.Id, resp.Error)
-		reader.Context.MessageLog.Debug("%s", resp.Request.URL.String())
+		reader.Context.MessageLog.Debug("%s", resp.RequestURL())
 		reader.Context.MessageLog.Error(errMsg)
 		if reader.stats != nil {
 			reader.stats.AddError(errMsg)
 		}
 		return nil
 	}
-	if resp.Response.StatusCode != 200 {
-		reader.processPharosError(resp)
-		return nil
-	}
 	if reader.stats != nil {
 		reader.stats.AddWorkItem("WorkItemsMarkedAsQueued", workItem)
 	}
 	return resp.WorkItem()
 }
 
-func (reader *APTBucketReader) processPharosError(resp *network.PharosResponse) error {
-	respBody := ""
-	bytesRead, readErr := resp.RawResponseData()
-	if readErr == nil {
-		respBody = string(bytesRead)
-	} else {
-		respBody = fmt.Sprintf("[Could not read response body: %v]", readErr)
-	}
-	msg := fmt.Sprintf("%s %s returned status code %d. Response body: %s",
-		resp.Request.Method, resp.Request.URL, resp.Response.StatusCode, respBody)
-	reader.Context.MessageLog.Error(msg)
-	if reader.stats != nil {
-		reader.stats.AddError(msg)
-	}
-	return fmt.Errorf(msg)
-}
-
 func (reader *APTBucketReader) GetStats() *stats.APTBucketReaderStats {
 	return reader.stats
 }
@@ -0,0 +1,163 @@
+package workers
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExchangeWorker describes a queue worker that apt_exchange can run.
+type ExchangeWorker struct {
+	// Config returns the worker's settings from the config file.
+	Config func(*models.Config) *models.WorkerConfig
+	// New creates the worker.
+	New func(*context.Context) network.MessageHandler
+}
+
+// ExchangeWorkers lists the workers that apt_exchange can run,
+// by the name of the standalone app that runs each one.
+var ExchangeWorkers = map[string]ExchangeWorker{
+	"apt_fetch": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.FetchWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewAPTFetcher(_context) },
+	},
+	"apt_store": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.StoreWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewAPTStorer(_context) },
+	},
+	"apt_record": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.RecordWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewAPTRecorder(_context) },
+	},
+	"apt_restore": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.RestoreWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewAPTRestorer(_context) },
+	},
+	"apt_file_restore": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.FileRestoreWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewAPTFileRestorer(_context) },
+	},
+	"apt_file_delete": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.FileDeleteWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewAPTFileDeleter(_context) },
+	},
+	"apt_fixity_check": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.FixityWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewAPTFixityChecker(_context) },
+	},
+	"apt_glacier_restore_init": {
+		Config: func(config *models.Config) *models.WorkerConfig { return &config.GlacierRestoreWorker },
+		New:    func(_context *context.Context) network.MessageHandler { return NewGlacierRestore(_context) },
+	},
+}
+
+// ExchangeWorkerNames returns the names of all the workers
+// apt_exchange can run, in alphabetical order.
+func ExchangeWorkerNames() []string {
+	names := make([]string, 0, len(ExchangeWorkers))
+	for name := range ExchangeWorkers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// APTExchange runs any number of queue workers in a single process.
+// The workers share one Context, and so one config, PharosClient,
+// logger and queue. Each worker takes its concurrency settings
+// (MaxInFlight, Workers, NetworkConnections, etc.) from its own
+// WorkerConfig.
+type APTExchange struct {
+	Context     *context.Context
+	WorkerNames []string
+	Workers     map[string]network.MessageHandler
+}
+
+// NewAPTExchange returns an APTExchange that will run the named
+// workers. See ExchangeWorkerNames for valid names. If workerNames
+// is empty, this runs all of them.
+func NewAPTExchange(_context *context.Context, workerNames []string) (*APTExchange, error) {
+	if len(workerNames) == 0 {
+		workerNames = ExchangeWorkerNames()
+	}
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(workerNames))
+	for _, name := range workerNames {
+		name = strings.TrimSpace(name)
+		if _, ok := ExchangeWorkers[name]; !ok {
+			return nil, fmt.Errorf("Unknown worker '%s'. Valid workers are: %s",
+				name, strings.Join(ExchangeWorkerNames(), ", "))
+		}
+		if !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	return &APTExchange{
+		Context:     _context,
+		WorkerNames: names,
+		Workers:     make(map[string]network.MessageHandler),
+	}, nil
+}
+
+// Start creates each worker and subscribes it to its queue topic.
+func (exchange *APTExchange) Start() error {
+	for _, name := range exchange.WorkerNames {
+		exchangeWorker := ExchangeWorkers[name]
+		workerConfig := exchangeWorker.Config(exchange.Context.Config)
+		worker := exchangeWorker.New(exchange.Context)
+		err := exchange.Context.Subscribe(workerConfig, worker)
+		if err != nil {
+			return fmt.Errorf("Cannot start %s: %v", name, err)
+		}
+		exchange.Workers[name] = worker
+		exchange.Context.MessageLog.Info("Started %s on topic %s (max in flight %d)",
+			name, workerConfig.NsqTopic, workerConfig.MaxInFlight)
+	}
+	return nil
+}
+
+// Stop tells the queue to stop delivering messages, then waits up to
+// timeout for the workers to finish or requeue the messages they're
+// working on. If messages are still in flight after that, Stop tells
+// each worker that can checkpoint its work to save state and requeue
+// its messages, and waits a little longer. It returns true if all
+// in-flight messages drained.
+func (exchange *APTExchange) Stop(timeout time.Duration) bool {
+	exchange.Context.MessageLog.Info("Stopping queue. Waiting up to %s for in-flight messages.", timeout)
+	exchange.Context.Queue.Stop()
+	drained := make(chan struct{})
+	go func() {
+		exchange.Context.Queue.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		exchange.Context.MessageLog.Info("All in-flight messages drained.")
+		return true
+	case <-time.After(timeout):
+		exchange.Context.MessageLog.Warning("Timed out waiting for in-flight messages to drain. " +
+			"Checkpointing and requeueing in-flight work.")
+	}
+	for _, name := range exchange.WorkerNames {
+		if worker, ok := exchange.Workers[name]; ok {
+			CheckpointAll(worker)
+		}
+	}
+	checkpointTimeout := SHUTDOWN_DRAIN_TIMEOUT
+	if timeout < checkpointTimeout {
+		checkpointTimeout = timeout
+	}
+	select {
+	case <-drained:
+		exchange.Context.MessageLog.Info("All in-flight messages requeued.")
+		return true
+	case <-time.After(checkpointTimeout):
+		exchange.Context.MessageLog.Warning("Timed out waiting for checkpointed messages to drain.")
+		return false
+	}
+}
@@ -0,0 +1,84 @@
+package workers_test
+
+import (
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// stuckHandler accepts messages and never finishes them.
+type stuckHandler struct{}
+
+func (handler *stuckHandler) HandleMessage(message models.QueueMessage) error {
+	message.DisableAutoResponse()
+	return nil
+}
+
+func TestExchangeWorkerNames(t *testing.T) {
+	names := workers.ExchangeWorkerNames()
+	assert.Equal(t, 8, len(names))
+	assert.Equal(t, "apt_fetch", names[0])
+	config := &models.Config{}
+	for _, name := range names {
+		assert.NotNil(t, workers.ExchangeWorkers[name].Config(config), name)
+	}
+}
+
+func TestNewAPTExchange(t *testing.T) {
+	env := newE2EEnv(t, "embedded")
+	defer env.Close()
+
+	exchange, err := workers.NewAPTExchange(env.Context, nil)
+	require.Nil(t, err)
+	assert.Equal(t, workers.ExchangeWorkerNames(), exchange.WorkerNames)
+
+	exchange, err = workers.NewAPTExchange(env.Context, []string{"apt_store", " apt_fetch", "apt_store"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"apt_store", "apt_fetch"}, exchange.WorkerNames)
+
+	_, err = workers.NewAPTExchange(env.Context, []string{"apt_fetch", "apt_bogus"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "apt_bogus")
+}
+
+func TestAPTExchangeIngest(t *testing.T) {
+	env := newE2EEnv(t, "embedded")
+	defer env.Close()
+	config := env.Context.Config
+
+	exchange, err := workers.NewAPTExchange(env.Context,
+		[]string{"apt_fetch", "apt_store", "apt_record"})
+	require.Nil(t, err)
+	require.Nil(t, exchange.Start())
+	assert.Equal(t, 3, len(exchange.Workers))
+
+	item := env.queueIngest(t)
+	require.Nil(t, env.Context.Queue.Enqueue(config.FetchWorker.NsqTopic, item.Id))
+	manifest := env.waitForIngestResult(t, item.Id, func(m *models.IngestManifest) *models.WorkSummary { return m.RecordResult })
+	require.False(t, manifest.HasErrors(), manifest.AllErrorsAsString())
+
+	assert.True(t, exchange.Stop(10*time.Second))
+	assert.Equal(t, int64(0), env.Context.Queue.(*network.BoltQueue).InFlight())
+}
+
+func TestAPTExchangeStopTimesOut(t *testing.T) {
+	env := newE2EEnv(t, "embedded")
+	defer env.Close()
+
+	// Hold a message in flight with a handler that never responds.
+	queue := env.Context.Queue.(*network.BoltQueue)
+	handler := &stuckHandler{}
+	require.Nil(t, queue.Subscribe(&models.WorkerConfig{NsqTopic: "stuck_topic", MaxInFlight: 1}, handler))
+	require.Nil(t, queue.Enqueue("stuck_topic", 1))
+	for queue.InFlight() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	exchange, err := workers.NewAPTExchange(env.Context, []string{"apt_fetch"})
+	require.Nil(t, err)
+	assert.False(t, exchange.Stop(200*time.Millisecond))
+}
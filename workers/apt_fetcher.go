@@ -1,6 +1,8 @@
 package workers
 
 import (
+	gocontext "context"
+	"crypto/md5"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
@@ -10,9 +12,12 @@ import (
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/util/storage"
 	"github.com/APTrust/exchange/validation"
-	"github.com/nsqio/go-nsq"
+	"hash"
+	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -25,11 +30,13 @@ type APTFetcher struct {
 	ValidationChannel   chan *models.IngestState
 	CleanupChannel      chan *models.IngestState
 	RecordChannel       chan *models.IngestState
+	InFlight            *InFlightRegistry
 }
 
 func NewAPTFetcher(_context *context.Context) *APTFetcher {
 	fetcher := &APTFetcher{
-		Context: _context,
+		Context:  _context,
+		InFlight: NewInFlightRegistry(),
 	}
 
 	// Patch for https://trello.com/c/Ep4pKzZB
@@ -63,7 +70,7 @@ func NewAPTFetcher(_context *context.Context) *APTFetcher {
 }
 
 // This is the callback that NSQ workers use to handle messages from NSQ.
-func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
+func (fetcher *APTFetcher) HandleMessage(message models.QueueMessage) error {
 
 	log := fetcher.Context.MessageLog
 
@@ -74,11 +81,28 @@ func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
 		fetcher.Context.MessageLog.Error(err.Error())
 		return err
 	}
+	if !fetcher.InFlight.Add(message, func() {
+		checkpointIngestState(ingestState, fetcher.Context, ingestState.IngestManifest.FetchResult)
+	}) {
+		return nil
+	}
+	// Once the item goes into one of our channels, record() says
+	// when we're done with it.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			fetcher.InFlight.Done(message)
+		}
+	}()
 
 	// If etag doesn't match, there's a newer version in the receiving
 	// bucket, and we should cancel this WorkItem.
 	fetcher.assertETagMatch(ingestState)
+	if ingestState.WorkItem.Status != constants.StatusCancelled {
+		fetcher.assertNotDuplicate(ingestState)
+	}
 	if ingestState.WorkItem.Status == constants.StatusCancelled {
+		handedOff = true
 		fetcher.CleanupChannel <- ingestState
 		return nil
 	}
@@ -118,15 +142,28 @@ func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
 		log.Info(ingestState.WorkItem.MsgAlreadyOnDisk())
 		if ingestState.IngestManifest.BagHasBeenValidated() {
 			log.Info(ingestState.WorkItem.MsgAlreadyValidated())
+			handedOff = true
 			fetcher.CleanupChannel <- ingestState
 			return nil
 		} else {
 			log.Info(ingestState.WorkItem.MsgGoingToValidation())
+			handedOff = true
 			fetcher.ValidationChannel <- ingestState
 			return nil
 		}
 	}
 
+	// When streaming, there's no tar file on disk, but we can still
+	// skip validation if we've already done it.
+	if fetcher.canStream(ingestState) &&
+		ingestState.IngestManifest.BagHasBeenValidated() &&
+		fileutil.FileExists(ingestState.IngestManifest.DBPath) {
+		log.Info(ingestState.WorkItem.MsgAlreadyValidated())
+		handedOff = true
+		fetcher.CleanupChannel <- ingestState
+		return nil
+	}
+
 	// In case we're loading a previously failed fetch attempt
 	ingestState.IngestManifest.ClearAllErrors()
 
@@ -148,8 +185,10 @@ func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
 	message.DisableAutoResponse()
 
 	// Reserve disk space to download this item, or requeue it
-	// if we can't get the disk space.
-	if fetcher.Context.Config.UseVolumeService && !fetcher.reserveSpaceForDownload(ingestState) {
+	// if we can't get the disk space. We don't download anything
+	// when we're streaming.
+	if fetcher.Context.Config.UseVolumeService && !fetcher.canStream(ingestState) &&
+		!fetcher.reserveSpaceForDownload(ingestState) {
 		err = MarkWorkItemRequeued(ingestState, fetcher.Context)
 		if err != nil {
 			fetcher.Context.MessageLog.Error(
@@ -162,33 +201,60 @@ func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
 
 	log.Info(ingestState.WorkItem.MsgGoingToFetch())
 
+	handedOff = true
 	fetcher.FetchChannel <- ingestState
 
 	// Return no error, so NSQ knows we're OK.
 	return nil
 }
 
+// CheckpointAndRequeue saves the state of all in-flight items to
+// Pharos and requeues them. Call this when the process is shutting down.
+func (fetcher *APTFetcher) CheckpointAndRequeue() {
+	fetcher.InFlight.CheckpointAndRequeue()
+}
+
 // -------------------------------------------------------------------------
 // Step 1 of 4: Fetch
 //
 // fetch copies the file from S3 to our local staging area.
 // If all goes well, the file will wind up in
 // ingestState.IngestManifest.BagPath
+//
+// If Config.StreamIngest is on, this just looks up the bag in the
+// receiving bucket, and validate streams it from there.
 // -------------------------------------------------------------------------
 func (fetcher *APTFetcher) fetch() {
 	for ingestState := range fetcher.FetchChannel {
 		// Tell NSQ we're working on this
-		ingestState.TouchNSQ()
+		ingestState.TouchMessage()
 
 		ingestState.IngestManifest.FetchResult.Start()
 		ingestState.IngestManifest.FetchResult.Attempted = true
 		ingestState.IngestManifest.FetchResult.AttemptNumber += 1
 
-		obj, err := fetcher.downloadFile(ingestState)
+		// If the download hangs, give up before NSQ does,
+		// so we can requeue the item and say why.
+		ctx, cancel := fetcher.InFlight.StageContext(ingestState.Message, fetcher.Context.Config.FetchWorker)
+		var obj *models.IntellectualObject
+		var err error
+		if fetcher.canStream(ingestState) {
+			obj, err = fetcher.prepareToStream(ctx, ingestState)
+		} else {
+			obj, err = fetcher.downloadFile(ctx, ingestState)
+		}
+		cancel()
 
 		// Download may have taken 1 second or 3 hours.
 		// Remind NSQ that we're still on this.
-		ingestState.TouchNSQ()
+		ingestState.TouchMessage()
+
+		if err == nil && fetcher.resolvesFetchTxt() {
+			ctx, cancel = fetcher.InFlight.StageContext(ingestState.Message, fetcher.Context.Config.FetchWorker)
+			fetcher.resolveFetchTxt(ctx, ingestState)
+			cancel()
+			ingestState.TouchMessage()
+		}
 
 		if err != nil {
 			ingestState.IngestManifest.FetchResult.AddError(err.Error())
@@ -211,7 +277,14 @@ func (fetcher *APTFetcher) fetch() {
 func (fetcher *APTFetcher) validate() {
 	for ingestState := range fetcher.ValidationChannel {
 		// Don't time us out, NSQ!
-		ingestState.TouchNSQ()
+		ingestState.TouchMessage()
+
+		// If we couldn't find the bag in the receiving bucket,
+		// there's nothing to stream. FetchResult has the errors.
+		if fetcher.canStream(ingestState) && ingestState.IngestManifest.FetchResult.HasErrors() {
+			fetcher.CleanupChannel <- ingestState
+			continue
+		}
 
 		// Tell Pharos that we've started to validate item.
 		// Let's NOT quit if there's an error here. In that case, Pharos
@@ -222,10 +295,49 @@ func (fetcher *APTFetcher) validate() {
 
 		// Validate the bag.
 		objIdentifier, _ := ingestState.IngestManifest.ObjectIdentifier()
-		validator, err := validation.NewValidator(
-			ingestState.IngestManifest.BagPath,
-			fetcher.BagValidationConfig,
-			true) // true means preserve ingest attributes in db
+		ctx, cancel := fetcher.InFlight.StageContext(ingestState.Message, fetcher.Context.Config.FetchWorker)
+
+		// To catch file name collisions with a previous version of
+		// this bag, we need the names of the files already stored.
+		var existingFilePaths []string
+		if fetcher.BagValidationConfig.FileNameCollisionPolicy != "" {
+			var err error
+			existingFilePaths, err = ActiveFilePaths(fetcher.Context.PharosClient.WithContext(ctx), objIdentifier)
+			if err != nil {
+				cancel()
+				ingestState.IngestManifest.ValidateResult.AddError(err.Error())
+				fetcher.CleanupChannel <- ingestState
+				continue
+			}
+		}
+
+		var validator *validation.Validator
+		var stream *bagStream
+		var err error
+		if fetcher.canStream(ingestState) {
+			stream, err = fetcher.openBagStream(ctx, ingestState)
+			if err == nil {
+				validator, err = validation.NewStreamValidator(
+					ingestState.IngestManifest.BagPath,
+					stream,
+					fetcher.BagValidationConfig,
+					true) // true means preserve ingest attributes in db
+				if err != nil {
+					stream.body.Close()
+					stream = nil
+				}
+			}
+		} else if IsMultipartBag(ingestState.WorkItem) {
+			validator, err = validation.NewMultipartValidator(
+				ingestState.IngestManifest.AllBagPaths(),
+				fetcher.BagValidationConfig,
+				true) // true means preserve ingest attributes in db
+		} else {
+			validator, err = validation.NewValidator(
+				ingestState.IngestManifest.BagPath,
+				fetcher.BagValidationConfig,
+				true) // true means preserve ingest attributes in db
+		}
 		if err != nil {
 			// Could not create a BagValidator. Should this be fatal?
 			ingestState.IngestManifest.ValidateResult.AddError(err.Error())
@@ -247,6 +359,7 @@ func (fetcher *APTFetcher) validate() {
 			// has the extension .valdb instead of .tar.
 			fetcher.Context.MessageLog.Info("Validating %s", ingestState.IngestManifest.BagPath)
 			validator.ObjIdentifier = objIdentifier
+			validator.ExistingFilePaths = existingFilePaths
 			summary, err := validator.Validate()
 			fetcher.Context.MessageLog.Info("Finished validating %s", ingestState.IngestManifest.BagPath)
 
@@ -268,7 +381,11 @@ func (fetcher *APTFetcher) validate() {
 			}
 			ingestState.IngestManifest.ValidateResult = summary
 		}
-		ingestState.TouchNSQ()
+		if stream != nil {
+			fetcher.finishBagStream(ingestState, stream)
+		}
+		cancel()
+		ingestState.TouchMessage()
 		fetcher.CleanupChannel <- ingestState
 	}
 }
@@ -292,11 +409,13 @@ func (fetcher *APTFetcher) cleanup() {
 		// a newer version of this bag got into the receiving bucket,
 		// and another worker may be ingesting it now. If we delete the
 		// bag, the other worker won't be able to complete its tasks.
-		if hasErrors && fileutil.FileExists(tarFile) && ingestState.WorkItem.Status != constants.StatusCancelled {
+		stagedFileExists := fileutil.FileExists(tarFile) ||
+			fileutil.FileExists(ingestState.IngestManifest.DBPath)
+		if hasErrors && stagedFileExists && ingestState.WorkItem.Status != constants.StatusCancelled {
 			// Most likely bad md5 digest, but perhaps also a partial download.
 			fetcher.Context.MessageLog.Info("Deleting %s due to download error: %s",
 				tarFile, ingestState.IngestManifest.AllErrorsAsString())
-			DeleteFileFromStaging(ingestState.IngestManifest.BagPath, fetcher.Context)
+			DeleteBagFromStaging(ingestState.IngestManifest, fetcher.Context)
 			DeleteFileFromStaging(ingestState.IngestManifest.DBPath, fetcher.Context)
 		}
 		fetcher.RecordChannel <- ingestState
@@ -319,17 +438,25 @@ func (fetcher *APTFetcher) record() {
 		itsTimeToGiveUp := (ingestState.IngestManifest.HasFatalErrors() ||
 			(ingestState.IngestManifest.HasErrors() && attemptNumber >= maxAttempts))
 
+		// If we're shutting down, errors are probably from cancelled
+		// downloads. Don't count them as an attempt. CheckpointAndRequeue
+		// saves the state and requeues the message.
+		if fetcher.InFlight.Stopping() && ingestState.IngestManifest.HasErrors() {
+			fetcher.InFlight.Done(ingestState.Message)
+			continue
+		}
+
 		if ingestState.WorkItem.Status == constants.StatusCancelled {
-			ingestState.FinishNSQ()
+			ingestState.FinishMessage()
 			MarkWorkItemCancelled(ingestState, fetcher.Context)
 		} else if itsTimeToGiveUp {
-			ingestState.FinishNSQ()
+			ingestState.FinishMessage()
 			MarkWorkItemFailed(ingestState, fetcher.Context)
 		} else if ingestState.IngestManifest.HasErrors() {
-			ingestState.RequeueNSQ(30000)
+			ingestState.RequeueMessage(30000)
 			MarkWorkItemRequeued(ingestState, fetcher.Context)
 		} else {
-			ingestState.FinishNSQ()
+			ingestState.FinishMessage()
 			MarkWorkItemSucceeded(ingestState, fetcher.Context, constants.StageStore)
 			PushToQueue(ingestState, fetcher.Context, fetcher.Context.Config.StoreWorker.NsqTopic)
 		}
@@ -338,6 +465,7 @@ func (fetcher *APTFetcher) record() {
 		// of this item to the local JSON log.
 		LogJson(ingestState, fetcher.Context.JsonLog)
 		RecordWorkItemState(ingestState, fetcher.Context, ingestState.IngestManifest.FetchResult)
+		fetcher.InFlight.Done(ingestState.Message)
 	}
 }
 
@@ -377,20 +505,54 @@ func (fetcher *APTFetcher) canSkipFetchAndValidate(ingestState *models.IngestSta
 		fileutil.FileExists(ingestState.IngestManifest.BagPath))
 }
 
+// canStream returns true if we should validate this bag by streaming
+// it from the receiving bucket, rather than downloading it. That requires
+// Config.StreamIngest, and works only for plain tar files. The storer
+// reads files straight out of the receiving bucket at their offsets in
+// the tar file, and there are no such offsets in zip or gzipped bags,
+// so we download those. We also download multipart bags, since the
+// validator has to read all of the parts, and all bags when we resolve
+// fetch.txt, since we have to add the fetched files to the tar file.
+func (fetcher *APTFetcher) canStream(ingestState *models.IngestState) bool {
+	return fetcher.Context.Config.StreamIngest &&
+		TAR_SUFFIX.MatchString(ingestState.WorkItem.Name) &&
+		!IsMultipartBag(ingestState.WorkItem) &&
+		!fetcher.resolvesFetchTxt()
+}
+
+// resolvesFetchTxt returns true if we should fetch the files listed
+// in a bag's fetch.txt. See Config.ResolveFetchTxt.
+func (fetcher *APTFetcher) resolvesFetchTxt() bool {
+	return fetcher.Context.Config.ResolveFetchTxt &&
+		fetcher.BagValidationConfig.AllowFetchTxt
+}
+
+// resolveFetchTxt downloads the files listed in the fetch.txt of each
+// tar file we downloaded, and adds them to the tar file, so we can
+// validate and store them like any other payload file. Problems with
+// fetch.txt go into the FetchResult.
+func (fetcher *APTFetcher) resolveFetchTxt(ctx gocontext.Context, ingestState *models.IngestState) {
+	config := fetcher.Context.Config
+	resolver := NewFetchTxtResolver(
+		fetcher.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx),
+		config.FetchTxtBuckets,
+		config.FetchTxtLocalRoots)
+	for _, bagPath := range ingestState.IngestManifest.AllBagPaths() {
+		count := resolver.Resolve(bagPath, ingestState.IngestManifest.FetchResult)
+		if count > 0 {
+			fetcher.Context.MessageLog.Info("Fetched %d files listed in fetch.txt of %s",
+				count, bagPath)
+		}
+	}
+}
+
 // assertEtagMatch checks to see if the etag on the WorkItem matches
 // the etag of the item in the receiving bucket. We get mismatches when
 // a depositor uploads a new bag before we've finished ingesting the
 // old one. This happens during long ingest backlogs.
 func (fetcher *APTFetcher) assertETagMatch(ingestState *models.IngestState) {
-	s3Client := network.NewS3Head(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		constants.AWSVirginia,
-		ingestState.WorkItem.Bucket)
-	s3Client.Head(ingestState.WorkItem.Name)
-
-	if s3Client.Response != nil && s3Client.Response.ETag != nil {
-		etag := strings.Replace(util.PointerToString(s3Client.Response.ETag), "\"", "", -1)
+	etag, err := fetcher.currentETag(ingestState)
+	if err == nil && etag != "" {
 		if etag != ingestState.WorkItem.ETag {
 			msg := fmt.Sprintf("Ingest services cancelled this ingest because WorkItem etag is %s and etag of item in receiving bucket is %s. There should be a separate WorkItem to ingest the newer version that's currently in the bucket.", ingestState.WorkItem.ETag, etag)
 			ingestState.IngestManifest.FetchResult.AddError(msg)
@@ -404,75 +566,253 @@ func (fetcher *APTFetcher) assertETagMatch(ingestState *models.IngestState) {
 	}
 }
 
-// Download the file, and update the IngestManifest while we're at it.
-func (fetcher *APTFetcher) downloadFile(ingestState *models.IngestState) (*models.IntellectualObject, error) {
-
-	downloader := fetcher.getDownloader(ingestState)
+// assertNotDuplicate cancels this WorkItem if an older WorkItem is
+// still ingesting the same version of the same bag. That happens when
+// apt_ingest_trigger and apt_bucket_reader see a new bag at the same
+// time, and both create a WorkItem for it. The oldest one wins.
+func (fetcher *APTFetcher) assertNotDuplicate(ingestState *models.IngestState) {
+	workItem := ingestState.WorkItem
+	params := url.Values{}
+	params.Add("item_action", constants.ActionIngest)
+	params.Add("name", workItem.Name)
+	params.Add("etag", workItem.ETag)
+	params.Add("bucket", workItem.Bucket)
+	resp := fetcher.Context.PharosClient.WorkItemList(params)
+	if resp.Error != nil {
+		fetcher.Context.MessageLog.Warning(
+			"While checking for duplicate ingests of %s (Work Item %d), got error: %v",
+			workItem.Name, workItem.Id, resp.Error)
+		return
+	}
+	for _, item := range resp.WorkItems() {
+		if item.Id < workItem.Id &&
+			(item.Status == constants.StatusPending || item.Status == constants.StatusStarted) {
+			msg := fmt.Sprintf("Ingest services cancelled this ingest because WorkItem %d is already ingesting the same version of this bag.", item.Id)
+			ingestState.IngestManifest.FetchResult.AddError(msg)
+			ingestState.IngestManifest.FetchResult.ErrorIsFatal = true
+			workItem.Note = msg
+			workItem.Status = constants.StatusCancelled
+			return
+		}
+	}
+}
 
-	// It's fairly common for very large bags to fail more than
-	// once on transient network errors (e.g. "Connection reset by peer")
-	// So we give this several tries.
-	for i := 0; i < 10; i++ {
-		succeeded, errorIsFatal := fetcher.tryDownload(downloader, ingestState, i)
-		if succeeded || errorIsFatal {
-			break
+// currentETag returns the ETag of the bag in the receiving bucket.
+// For multipart bags, that's the combined ETag of all the parts,
+// which is what the bucket reader puts on the WorkItem.
+func (fetcher *APTFetcher) currentETag(ingestState *models.IngestState) (string, error) {
+	backend := fetcher.Context.StorageBackend(constants.AWSVirginia)
+	if IsMultipartBag(ingestState.WorkItem) {
+		bag, err := ListBagParts(backend, ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
+		if err != nil || len(bag.Parts) == 0 {
+			return "", err
 		}
+		return bag.ETag(), nil
 	}
+	storageObj, err := backend.Head(ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
+	if err != nil {
+		return "", err
+	}
+	return storageObj.ETag, nil
+}
 
-	// Return now if we failed.
-	if downloader.ErrorMessage != "" {
-		return nil, fmt.Errorf("Error fetching %s/%s: %v",
+// Download the file, and update the IngestManifest while we're at it.
+func (fetcher *APTFetcher) downloadFile(ctx gocontext.Context, ingestState *models.IngestState) (*models.IntellectualObject, error) {
+	if IsMultipartBag(ingestState.WorkItem) {
+		return fetcher.downloadParts(ctx, ingestState)
+	}
+	backend := fetcher.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx)
+	storageObj, err := backend.Head(ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
+	if err == nil {
+		// It's fairly common for very large bags to fail more than
+		// once on transient network errors (e.g. "Connection reset by peer")
+		// So we give this several tries.
+		var bytesCopied int64
+		var digests map[string]string
+		bytesCopied, digests, err = network.DownloadFromStorageWithRetries(
+			backend,
 			ingestState.WorkItem.Bucket,
 			ingestState.WorkItem.Name,
-			downloader.ErrorMessage)
+			ingestState.IngestManifest.BagPath,
+			[]string{constants.AlgMd5}, // calculate md5 checksum on the entire tar file
+			10)
+		if err == nil {
+			fetcher.Context.MessageLog.Info("Fetched %s/%s",
+				ingestState.WorkItem.Bucket,
+				ingestState.WorkItem.Name)
+			return fetcher.buildObject(storageObj, bytesCopied, digests[constants.AlgMd5], ingestState), nil
+		}
 	}
 
-	return fetcher.buildObject(downloader, ingestState), nil
-}
-
-func (fetcher *APTFetcher) getDownloader(ingestState *models.IngestState) *network.S3Download {
-	return network.NewS3Download(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		constants.AWSVirginia,
+	// If we get here, we failed.
+	fetcher.Context.MessageLog.Warning("Error fetching %s/%s: %v - will not retry",
+		ingestState.WorkItem.Bucket,
+		ingestState.WorkItem.Name,
+		err)
+	if network.IsNotFound(err) {
+		ingestState.IngestManifest.FetchResult.ErrorIsFatal = true
+	}
+	return nil, fmt.Errorf("Error fetching %s/%s: %v",
 		ingestState.WorkItem.Bucket,
 		ingestState.WorkItem.Name,
-		ingestState.IngestManifest.BagPath,
-		true,  // calculate md5 checksum on the entire tar file
-		false, // calculate sha256 checksum on the entire tar file
-	)
+		err)
 }
 
-func (fetcher *APTFetcher) tryDownload(downloader *network.S3Download, ingestState *models.IngestState, attemptNumber int) (bool, bool) {
-	succeeded := false
-	errorIsFatal := false
-	downloader.ErrorMessage = "" // clear before each attempt
-	downloader.Fetch()
-	if downloader.ErrorMessage == "" {
-		fetcher.Context.MessageLog.Info("Fetched %s/%s after %d attempts",
-			ingestState.WorkItem.Bucket,
-			ingestState.WorkItem.Name,
-			attemptNumber+1)
-		succeeded = true
-	} else {
-		retryMessage := "will retry"
-		if attemptNumber >= 9 {
-			retryMessage = "will not retry - too many failed attempts"
+// downloadParts downloads all parts of a multipart bag into the
+// directory where BagPath is, and records their paths in the
+// IngestManifest. It's a fatal error if any part is missing or
+// duplicated, since the bucket reader should have caught that.
+func (fetcher *APTFetcher) downloadParts(ctx gocontext.Context, ingestState *models.IngestState) (*models.IntellectualObject, error) {
+	backend := fetcher.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx)
+	bucket := ingestState.WorkItem.Bucket
+	bag, err := ListBagParts(backend, bucket, ingestState.WorkItem.Name)
+	if err != nil {
+		return nil, err
+	}
+	problems := bag.Problems()
+	if len(problems) > 0 {
+		ingestState.IngestManifest.FetchResult.ErrorIsFatal = true
+		return nil, fmt.Errorf("Multipart bag %s/%s is incomplete: %s",
+			bucket, bag.BagName, strings.Join(problems, " "))
+	}
+	stagingDir := filepath.Dir(ingestState.IngestManifest.BagPath)
+	bagParts := make([]string, 0)
+	bytesCopied := int64(0)
+	for _, part := range bag.SortedParts() {
+		localPath := filepath.Join(stagingDir, part.Key)
+		partBytes, _, err := network.DownloadFromStorageWithRetries(
+			backend, bucket, part.Key, localPath, []string{constants.AlgMd5}, 10)
+		if err != nil {
+			if network.IsNotFound(err) {
+				ingestState.IngestManifest.FetchResult.ErrorIsFatal = true
+			}
+			return nil, fmt.Errorf("Error fetching %s/%s: %v", bucket, part.Key, err)
 		}
-		fetcher.Context.MessageLog.Warning("Error fetching %s/%s: %s - %s",
-			ingestState.WorkItem.Bucket,
-			ingestState.WorkItem.Name,
-			downloader.ErrorMessage,
-			retryMessage)
-		if strings.Contains(downloader.ErrorMessage, "NoSuchKey") {
+		fetcher.Context.MessageLog.Info("Fetched %s/%s", bucket, part.Key)
+		ingestState.TouchMessage()
+		bagParts = append(bagParts, localPath)
+		bytesCopied += partBytes
+	}
+	ingestState.IngestManifest.BagParts = bagParts
+	storageObj := &network.StorageObject{
+		Bucket:       bucket,
+		Key:          ingestState.WorkItem.Name,
+		Size:         bag.Size(),
+		ETag:         bag.ETag(),
+		LastModified: bag.LastModified(),
+	}
+	// There's no md5 digest for the bag as a whole, so we don't pass one.
+	return fetcher.buildObject(storageObj, bytesCopied, "", ingestState), nil
+}
+
+// prepareToStream gets what we need to know about the bag from the
+// receiving bucket, without downloading it. The validator will stream
+// the bag from there.
+func (fetcher *APTFetcher) prepareToStream(ctx gocontext.Context, ingestState *models.IngestState) (*models.IntellectualObject, error) {
+	backend := fetcher.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx)
+	storageObj, err := backend.Head(ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
+	if err != nil {
+		if network.IsNotFound(err) {
 			ingestState.IngestManifest.FetchResult.ErrorIsFatal = true
-			errorIsFatal = true
 		}
+		return nil, fmt.Errorf("Error getting info about %s/%s: %v",
+			ingestState.WorkItem.Bucket,
+			ingestState.WorkItem.Name,
+			err)
+	}
+	// The .valdb goes where the tar file would have gone.
+	err = os.MkdirAll(filepath.Dir(ingestState.IngestManifest.DBPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	fetcher.Context.MessageLog.Info("Will stream %s/%s (%d bytes) from receiving bucket",
+		ingestState.WorkItem.Bucket, ingestState.WorkItem.Name, storageObj.Size)
+	return fetcher.buildObject(storageObj, storageObj.Size, "", ingestState), nil
+}
+
+// bagStream is the bag we're reading from the receiving bucket.
+// It calculates the md5 digest of the whole tar file as we read it,
+// as downloadFile would.
+type bagStream struct {
+	body      io.ReadCloser
+	reader    io.Reader
+	md5Hash   hash.Hash
+	bytesRead int64
+	// err is the first error we got reading from the receiving
+	// bucket, as opposed to an error in the bag itself.
+	err error
+}
+
+func (stream *bagStream) Read(p []byte) (int, error) {
+	n, err := stream.reader.Read(p)
+	stream.bytesRead += int64(n)
+	if err != nil && err != io.EOF && stream.err == nil {
+		stream.err = err
+	}
+	return n, err
+}
+
+// openBagStream opens the bag in the receiving bucket for reading.
+func (fetcher *APTFetcher) openBagStream(ctx gocontext.Context, ingestState *models.IngestState) (*bagStream, error) {
+	backend := fetcher.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx)
+	body, err := backend.Get(ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Error streaming %s/%s: %v",
+			ingestState.WorkItem.Bucket, ingestState.WorkItem.Name, err)
+	}
+	md5Hash := md5.New()
+	return &bagStream{
+		body:    body,
+		reader:  io.TeeReader(body, md5Hash),
+		md5Hash: md5Hash,
+	}, nil
+}
+
+// finishBagStream reads whatever the validator left in the stream
+// (usually just the padding at the end of the tar file), closes it,
+// and records the size and md5 digest of the tar file on the object
+// in the .valdb.
+func (fetcher *APTFetcher) finishBagStream(ingestState *models.IngestState, stream *bagStream) {
+	io.Copy(ioutil.Discard, stream)
+	stream.body.Close()
+
+	// If the network let us down, the validator may have reported
+	// errors in a perfectly good bag. Try again later.
+	if stream.err != nil {
+		summary := ingestState.IngestManifest.ValidateResult
+		summary.AddError("Error streaming %s/%s after %d bytes: %v",
+			ingestState.WorkItem.Bucket, ingestState.WorkItem.Name,
+			stream.bytesRead, stream.err)
+		summary.ErrorIsFatal = false
+		summary.Retry = true
+		return
+	}
+	db, err := storage.NewBoltDB(ingestState.IngestManifest.DBPath)
+	if err != nil || db == nil {
+		fetcher.Context.MessageLog.Warning("Can't open %s to record md5 of %s: %v",
+			ingestState.IngestManifest.DBPath, ingestState.WorkItem.Name, err)
+		return
+	}
+	defer db.Close()
+	objIdentifier, _ := ingestState.IngestManifest.ObjectIdentifier()
+	obj, err := db.GetIntellectualObject(objIdentifier)
+	if err != nil || obj == nil {
+		fetcher.Context.MessageLog.Warning("Can't find %s in %s to record md5: %v",
+			objIdentifier, ingestState.IngestManifest.DBPath, err)
+		return
+	}
+	obj.IngestSize = stream.bytesRead
+	obj.IngestLocalMd5 = fmt.Sprintf("%x", stream.md5Hash.Sum(nil))
+	err = db.Save(obj.Identifier, obj)
+	if err != nil {
+		fetcher.Context.MessageLog.Warning("Can't save md5 of %s to %s: %v",
+			objIdentifier, ingestState.IngestManifest.DBPath, err)
 	}
-	return succeeded, errorIsFatal
+	fetcher.Context.MessageLog.Info("Streamed %d bytes of %s/%s",
+		stream.bytesRead, ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
 }
 
-func (fetcher *APTFetcher) buildObject(downloader *network.S3Download, ingestState *models.IngestState) *models.IntellectualObject {
+func (fetcher *APTFetcher) buildObject(storageObj *network.StorageObject, bytesCopied int64, md5Digest string, ingestState *models.IngestState) *models.IntellectualObject {
 	obj := &models.IntellectualObject{}
 	instIdentifier := util.OwnerOf(ingestState.WorkItem.Bucket)
 	obj.BagName = util.CleanBagName(ingestState.WorkItem.Name)
@@ -483,9 +823,9 @@ func (fetcher *APTFetcher) buildObject(downloader *network.S3Download, ingestSta
 	obj.IngestS3Key = ingestState.WorkItem.Name
 	obj.IngestTarFilePath = ingestState.IngestManifest.BagPath
 	obj.ETag = ingestState.WorkItem.ETag
-	obj.IngestSize = downloader.BytesCopied
-	obj.IngestRemoteMd5 = *downloader.Response.ETag
-	obj.IngestLocalMd5 = downloader.Md5Digest
+	obj.IngestSize = bytesCopied
+	obj.IngestRemoteMd5 = storageObj.ETag
+	obj.IngestLocalMd5 = md5Digest
 
 	// Standard storage is the default. The Storage-Option tag in
 	// aptrust-info.txt can override this when the validator parses
@@ -506,7 +846,7 @@ func (fetcher *APTFetcher) buildObject(downloader *network.S3Download, ingestSta
 	//
 	// This code seems logically incorrect and should be reviewed
 	// for removal.
-	obj.IngestMd5Verifiable = strings.Contains(downloader.Md5Digest, "-")
+	obj.IngestMd5Verifiable = strings.Contains(md5Digest, "-")
 	if obj.IngestMd5Verifiable {
 		obj.IngestMd5Verified = obj.IngestRemoteMd5 == obj.IngestLocalMd5
 	}
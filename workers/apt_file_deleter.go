@@ -1,14 +1,13 @@
 package workers
 
 import (
+	gocontext "context"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
-	"github.com/nsqio/go-nsq"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 )
@@ -69,12 +68,19 @@ func NewAPTFileDeleter(_context *context.Context) *APTFileDeleter {
 }
 
 // This is the callback that NSQ workers use to handle messages from NSQ.
-func (deleter *APTFileDeleter) HandleMessage(message *nsq.Message) error {
+func (deleter *APTFileDeleter) HandleMessage(message models.QueueMessage) error {
 	// Build the RestoreState object by fetching WorkItem and IntellectualObject
 	// from Pharos.
 	deleteState, err := deleter.buildState(message)
 	if err != nil {
 		deleter.Context.MessageLog.Error(err.Error())
+		if network.IsPharosFatal(err) {
+			// The WorkItem or the file isn't there, or Pharos
+			// won't give it to us. Requeuing won't change that.
+			deleter.Context.MessageLog.Error("Giving up on message %s", string(message.Body()))
+			message.Finish()
+			return nil
+		}
 		return err
 	}
 
@@ -109,6 +115,7 @@ func (deleter *APTFileDeleter) delete() {
 		deleteState.DeleteSummary.AttemptNumber += 1
 		deleteState.DeleteSummary.Start()
 
+		ctx, cancel := StageContext(deleter.Context.Config.FileDeleteWorker)
 		fileUUID, err := deleteState.GenericFile.PreservationStorageFileName()
 		if err != nil {
 			deleteState.DeleteSummary.AddError(err.Error())
@@ -116,10 +123,10 @@ func (deleter *APTFileDeleter) delete() {
 			storageOption := deleteState.GenericFile.StorageOption
 			// Standard storage requires two deletions from two separate buckets.
 			if storageOption == constants.StorageStandard {
-				deleter.deleteFromStandardStorage(deleteState, fileUUID)
+				deleter.deleteFromStandardStorage(ctx, deleteState, fileUUID)
 			} else {
 				if deleteState.DeletedFromPrimaryAt.IsZero() {
-					deleter.deleteFromStorage(deleteState, storageOption)
+					deleter.deleteFromStorage(ctx, deleteState, storageOption)
 				} else {
 					deleter.Context.MessageLog.Info("File %s (%s) was previously "+
 						"deleted from %s storage",
@@ -127,25 +134,26 @@ func (deleter *APTFileDeleter) delete() {
 				}
 			}
 		}
+		cancel()
 		deleteState.DeleteSummary.Finish()
 		deleter.PostProcessChannel <- deleteState
 	}
 }
 
 // Delete from Standard storage, which includes an S3 copy and a Glacier copy.
-func (deleter *APTFileDeleter) deleteFromStandardStorage(deleteState *models.DeleteState, fileUUID string) {
+func (deleter *APTFileDeleter) deleteFromStandardStorage(ctx gocontext.Context, deleteState *models.DeleteState, fileUUID string) {
 	// In some cases, we may have deleted the file on a
 	// previous run, then failed to record the deletion
 	// event.
 	if deleteState.DeletedFromPrimaryAt.IsZero() {
-		deleter.deleteFromStorage(deleteState, "s3")
+		deleter.deleteFromStorage(ctx, deleteState, "s3")
 	} else {
 		deleter.Context.MessageLog.Info("File %s (%s) was previously "+
 			"deleted from primary storage",
 			deleteState.GenericFile.Identifier, fileUUID)
 	}
 	if deleteState.DeletedFromSecondaryAt.IsZero() {
-		deleter.deleteFromStorage(deleteState, "glacier")
+		deleter.deleteFromStorage(ctx, deleteState, "glacier")
 	} else {
 		deleter.Context.MessageLog.Info("File %s (%s) was previously "+
 			"deleted from secondary storage",
@@ -172,7 +180,7 @@ func (deleter *APTFileDeleter) postProcess() {
 	}
 }
 
-func (deleter *APTFileDeleter) deleteFromStorage(deleteState *models.DeleteState, fromWhere string) {
+func (deleter *APTFileDeleter) deleteFromStorage(ctx gocontext.Context, deleteState *models.DeleteState, fromWhere string) {
 	// Find the key we'll need to delete.
 	key, err := deleteState.GenericFile.PreservationStorageFileName()
 	if err != nil {
@@ -207,15 +215,12 @@ func (deleter *APTFileDeleter) deleteFromStorage(deleteState *models.DeleteState
 		deleteState.DeleteSummary.ErrorIsFatal = true
 		return
 	}
-	client := network.NewS3ObjectDelete(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region, bucket, keys)
-	client.DeleteList()
-	if client.ErrorMessage != "" {
+	backend := deleter.Context.StorageBackend(region).WithContext(ctx)
+	err = backend.Delete(bucket, keys...)
+	if err != nil {
 		msg := fmt.Sprintf("Error deleting %s from %s: %v",
 			deleteState.GenericFile.Identifier,
-			fromWhere, client.ErrorMessage)
+			fromWhere, err)
 		deleteState.DeleteSummary.AddError(msg)
 	} else {
 		if fromWhere == "s3" {
@@ -231,7 +236,7 @@ func (deleter *APTFileDeleter) deleteFromStorage(deleteState *models.DeleteState
 	}
 }
 
-func (deleter *APTFileDeleter) buildState(message *nsq.Message) (*models.DeleteState, error) {
+func (deleter *APTFileDeleter) buildState(message models.QueueMessage) (*models.DeleteState, error) {
 	deleteState := models.NewDeleteState(message)
 	workItem, err := GetWorkItem(message, deleter.Context)
 	if err != nil {
@@ -244,7 +249,7 @@ func (deleter *APTFileDeleter) buildState(message *nsq.Message) (*models.DeleteS
 	}
 	resp := deleter.Context.PharosClient.GenericFileGet(workItem.GenericFileIdentifier, false)
 	if resp.Error != nil {
-		return nil, fmt.Errorf("Error getting generic file '%s': %v",
+		return nil, fmt.Errorf("Error getting generic file '%s': %w",
 			workItem.GenericFileIdentifier, resp.Error)
 	}
 	gf := resp.GenericFile()
@@ -286,11 +291,11 @@ func (deleter *APTFileDeleter) finishWithError(deleteState *models.DeleteState)
 	if deleteState.DeleteSummary.ErrorIsFatal {
 		deleter.Context.MessageLog.Error("Deletion of %s failed",
 			deleteState.GenericFile.Identifier)
-		deleteState.NSQMessage.Finish()
+		deleteState.Message.Finish()
 	} else {
 		deleter.Context.MessageLog.Warning("Requeuing %s",
 			deleteState.GenericFile.Identifier)
-		deleteState.NSQMessage.Requeue(1 * time.Minute)
+		deleteState.Message.Requeue(1 * time.Minute)
 	}
 }
 
@@ -312,7 +317,7 @@ func (deleter *APTFileDeleter) finishWithSuccess(deleteState *models.DeleteState
 	deleteState.WorkItem.Status = constants.StatusSuccess
 	deleteState.WorkItem.Stage = constants.StageResolve
 	deleter.saveWorkItem(deleteState)
-	deleteState.NSQMessage.Finish()
+	deleteState.Message.Finish()
 }
 
 func (deleter *APTFileDeleter) recordFileDeletionEvent(deleteState *models.DeleteState) {
@@ -348,6 +353,9 @@ func (deleter *APTFileDeleter) recordFileDeletionEvent(deleteState *models.Delet
 			msg += fmt.Sprintf(" - Pharos response: %s", string(bytes))
 		}
 		deleteState.DeleteSummary.AddError(msg)
+		if network.IsPharosFatal(resp.Error) {
+			deleteState.DeleteSummary.ErrorIsFatal = true
+		}
 		return
 	} else {
 		deleter.Context.MessageLog.Info("Saved deletion event %s for file %s",
@@ -360,6 +368,9 @@ func (deleter *APTFileDeleter) markFileDeleted(deleteState *models.DeleteState)
 	if resp.Error != nil {
 		deleteState.DeleteSummary.AddError("Error marking %s as deleted: %v",
 			deleteState.GenericFile.Identifier, resp.Error)
+		if network.IsPharosFatal(resp.Error) {
+			deleteState.DeleteSummary.ErrorIsFatal = true
+		}
 	}
 }
 
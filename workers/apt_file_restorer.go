@@ -1,6 +1,7 @@
 package workers
 
 import (
+	gocontext "context"
 	"encoding/json"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
@@ -8,7 +9,6 @@ import (
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util"
-	"github.com/nsqio/go-nsq"
 	"os"
 	"time"
 )
@@ -25,11 +25,15 @@ type APTFileRestorer struct {
 	// the outcome of the restoration in Pharos and finish or
 	// requeue the NSQ message.
 	PostProcessChannel chan *models.FileRestoreState
+	// InFlight tracks the messages we're working on, so we can
+	// checkpoint and requeue them when the process shuts down.
+	InFlight *InFlightRegistry
 }
 
 func NewAPTFileRestorer(_context *context.Context) *APTFileRestorer {
 	restorer := &APTFileRestorer{
-		Context: _context,
+		Context:  _context,
+		InFlight: NewInFlightRegistry(),
 	}
 
 	// Patch for https://trello.com/c/Ep4pKzZB
@@ -51,7 +55,7 @@ func NewAPTFileRestorer(_context *context.Context) *APTFileRestorer {
 }
 
 // This is the callback that NSQ workers use to handle messages from NSQ.
-func (restorer *APTFileRestorer) HandleMessage(message *nsq.Message) error {
+func (restorer *APTFileRestorer) HandleMessage(message models.QueueMessage) error {
 	message.DisableAutoResponse()
 	// Build the FileRestoreState object by fetching WorkItem and IntellectualObject
 	// from Pharos.
@@ -60,6 +64,9 @@ func (restorer *APTFileRestorer) HandleMessage(message *nsq.Message) error {
 		restorer.Context.MessageLog.Error(err.Error())
 		return err
 	}
+	if !restorer.InFlight.Add(message, func() { restorer.checkpoint(restoreState) }) {
+		return nil
+	}
 
 	restoreState.RestoreSummary.ClearErrors()
 	restoreState.WorkItem.Note = "Starting file restore process"
@@ -70,22 +77,46 @@ func (restorer *APTFileRestorer) HandleMessage(message *nsq.Message) error {
 	return nil
 }
 
+// CheckpointAndRequeue resets the WorkItems for all in-flight
+// restorations and requeues them. Call this when the process is
+// shutting down.
+func (restorer *APTFileRestorer) CheckpointAndRequeue() {
+	restorer.InFlight.CheckpointAndRequeue()
+}
+
+// checkpoint resets the WorkItem for an in-flight restoration,
+// so another worker can pick it up.
+func (restorer *APTFileRestorer) checkpoint(restoreState *models.FileRestoreState) {
+	restorer.Context.MessageLog.Info("Checkpointing WorkItem %d (%s) for shutdown",
+		restoreState.WorkItem.Id, restoreState.WorkItem.GenericFileIdentifier)
+	restoreState.WorkItem.Date = time.Now().UTC()
+	restoreState.WorkItem.Status = constants.StatusPending
+	restoreState.WorkItem.Stage = constants.StageRequested
+	restoreState.WorkItem.Note = MSG_SHUTDOWN_REQUEUE
+	restoreState.WorkItem.Node = ""
+	restoreState.WorkItem.Pid = 0
+	restoreState.WorkItem.StageStartedAt = nil
+	restorer.saveWorkItem(restoreState, true)
+}
+
 func (restorer *APTFileRestorer) restore() {
 	for restoreState := range restorer.RestoreChannel {
 		restoreState.RestoreSummary.Attempted = true
 		restoreState.RestoreSummary.AttemptNumber += 1
 		restoreState.RestoreSummary.Start()
 
-		if restorer.alreadyRestored(restoreState) {
+		ctx, cancel := restorer.InFlight.StageContext(restoreState.Message, restorer.Context.Config.FileRestoreWorker)
+		if restorer.alreadyRestored(ctx, restoreState) {
 			restorationBucket := util.RestorationBucketFor(restoreState.IntellectualObject.Institution,
 				restorer.Context.Config.RestoreToTestBuckets)
 			restorer.Context.MessageLog.Info("File %s has already been restored to %s",
 				restoreState.GenericFile.Identifier, restorationBucket)
 		} else {
-			restoreState.NSQMessage.Touch()
-			restorer.copyToRestorationBucket(restoreState)
-			restoreState.NSQMessage.Touch()
+			restoreState.Message.Touch()
+			restorer.copyToRestorationBucket(ctx, restoreState)
+			restoreState.Message.Touch()
 		}
+		cancel()
 
 		restoreState.RestoreSummary.Finish()
 		restorer.PostProcessChannel <- restoreState
@@ -94,15 +125,23 @@ func (restorer *APTFileRestorer) restore() {
 
 func (restorer *APTFileRestorer) postProcess() {
 	for restoreState := range restorer.PostProcessChannel {
+		// If we're shutting down, errors are probably from a cancelled
+		// copy. Don't count them as an attempt. CheckpointAndRequeue
+		// resets the WorkItem and requeues the message.
+		if restorer.InFlight.Stopping() && restoreState.RestoreSummary.HasErrors() {
+			restorer.InFlight.Done(restoreState.Message)
+			continue
+		}
 		if restoreState.RestoreSummary.HasErrors() {
 			restorer.finishWithError(restoreState)
 		} else {
 			restorer.finishWithSuccess(restoreState)
 		}
+		restorer.InFlight.Done(restoreState.Message)
 	}
 }
 
-func (restorer *APTFileRestorer) copyToRestorationBucket(restoreState *models.FileRestoreState) {
+func (restorer *APTFileRestorer) copyToRestorationBucket(ctx gocontext.Context, restoreState *models.FileRestoreState) {
 	sourceRegion, sourceBucket, err := restorer.Context.Config.StorageRegionAndBucketFor(restoreState.GenericFile.StorageOption)
 	if err != nil {
 		restoreState.RestoreSummary.AddError(err.Error())
@@ -127,7 +166,7 @@ func (restorer *APTFileRestorer) copyToRestorationBucket(restoreState *models.Fi
 		sourceBucket,
 		fileUUID,
 		restorationBucket,
-		restoreState.GenericFile.Identifier)
+		restoreState.GenericFile.Identifier).WithContext(ctx)
 	copier.Copy()
 	if copier.ErrorMessage != "" {
 		restoreState.RestoreSummary.AddError("Error copying to restoration bucket: %s",
@@ -138,14 +177,14 @@ func (restorer *APTFileRestorer) copyToRestorationBucket(restoreState *models.Fi
 	restoreState.CopiedToRestorationAt = time.Now().UTC()
 }
 
-func (restorer *APTFileRestorer) alreadyRestored(restoreState *models.FileRestoreState) bool {
+func (restorer *APTFileRestorer) alreadyRestored(ctx gocontext.Context, restoreState *models.FileRestoreState) bool {
 	restorationBucket := util.RestorationBucketFor(restoreState.IntellectualObject.Institution,
 		restorer.Context.Config.RestoreToTestBuckets)
 	client := network.NewS3Head(
 		os.Getenv("AWS_ACCESS_KEY_ID"),
 		os.Getenv("AWS_SECRET_ACCESS_KEY"),
 		restorer.Context.Config.APTrustS3Region,
-		restorationBucket)
+		restorationBucket).WithContext(ctx)
 	client.Head(restoreState.GenericFile.Identifier)
 	if client.Response != nil && client.ErrorMessage == "" {
 		sizeInS3 := int64(-1)
@@ -163,7 +202,7 @@ func (restorer *APTFileRestorer) alreadyRestored(restoreState *models.FileRestor
 	return false
 }
 
-func (restorer *APTFileRestorer) buildState(message *nsq.Message) (*models.FileRestoreState, error) {
+func (restorer *APTFileRestorer) buildState(message models.QueueMessage) (*models.FileRestoreState, error) {
 	restoreState := models.NewFileRestoreState(message)
 	workItem, err := GetWorkItem(message, restorer.Context)
 	if err != nil {
@@ -237,11 +276,11 @@ func (restorer *APTFileRestorer) finishWithError(restoreState *models.FileRestor
 	if restoreState.RestoreSummary.ErrorIsFatal {
 		restorer.Context.MessageLog.Error("Restoration of %s failed",
 			restoreState.GenericFile.Identifier)
-		restoreState.NSQMessage.Finish()
+		restoreState.Message.Finish()
 	} else {
 		restorer.Context.MessageLog.Warning("Requeuing %s",
 			restoreState.GenericFile.Identifier)
-		restoreState.NSQMessage.Requeue(1 * time.Minute)
+		restoreState.Message.Requeue(1 * time.Minute)
 	}
 }
 
@@ -257,7 +296,7 @@ func (restorer *APTFileRestorer) finishWithSuccess(restoreState *models.FileRest
 	restoreState.WorkItem.Status = constants.StatusSuccess
 	restoreState.WorkItem.Stage = constants.StageResolve
 	restorer.saveWorkItem(restoreState, true)
-	restoreState.NSQMessage.Finish()
+	restoreState.Message.Finish()
 }
 
 func (restorer *APTFileRestorer) saveWorkItem(restoreState *models.FileRestoreState, logJson bool) {
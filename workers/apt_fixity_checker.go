@@ -1,12 +1,14 @@
 package workers
 
 import (
+	gocontext "context"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/metrics"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
-	"github.com/nsqio/go-nsq"
+	"github.com/google/uuid"
 	"os"
 	"strings"
 	"time"
@@ -59,13 +61,21 @@ func NewAPTFixityChecker(_context *context.Context) *APTFixityChecker {
 // where the message.Body is a WorkItem.Id (int as string), messages in the
 // apt_fixity queue contain a GenericFile.Identifier. So the entire message body
 // will be something like "georgetown.edu/georgetown.edu.10822_707412".
-func (checker *APTFixityChecker) HandleMessage(message *nsq.Message) error {
+func (checker *APTFixityChecker) HandleMessage(message models.QueueMessage) error {
 	fixityResult := checker.buildFixityResult(message)
 	if fixityResult.Error != nil {
-		checker.Context.MessageLog.Error("Cannot process %s: %v",
-			string(message.Body), fixityResult.Error.Error())
-		message.Finish()
-		return nil // Should we return an error to NSQ?
+		if fixityResult.ErrorIsFatal {
+			checker.Context.MessageLog.Error("Cannot process %s: %v (FATAL)",
+				string(message.Body()), fixityResult.Error.Error())
+			message.Finish()
+		} else {
+			// Pharos is down or having trouble. Try again later,
+			// rather than skip this file's fixity check.
+			checker.Context.MessageLog.Error("Cannot process %s: %v (transient)",
+				string(message.Body()), fixityResult.Error.Error())
+			message.Requeue(1 * time.Minute)
+		}
+		return nil
 	}
 
 	if fixityResult.GenericFile.StorageOption != constants.StorageStandard {
@@ -105,12 +115,16 @@ func (checker *APTFixityChecker) HandleMessage(message *nsq.Message) error {
 	return nil
 }
 
-// checkFixity calls the downloader to calculate the sha256 digest of the
+// checkFixity calls the downloader to calculate the digests of the
 // file in S3.
 func (checker *APTFixityChecker) checkFixity() {
 	for fixityResult := range checker.FixityChannel {
 		// Here's where we do the actual digest calculation.
-		checker.getFixityValueOfS3File(fixityResult)
+		start := time.Now()
+		ctx, cancel := StageContext(checker.Context.Config.FixityWorker)
+		checker.getFixityValueOfS3File(ctx, fixityResult)
+		cancel()
+		metrics.FixityCheckDuration.Observe(metrics.Since(start), fixityOutcome(fixityResult))
 		if fixityResult.Error != nil {
 			checker.PostProcessChannel <- fixityResult
 		} else {
@@ -119,40 +133,76 @@ func (checker *APTFixityChecker) checkFixity() {
 	}
 }
 
-// record records a PremisEvent in Pharos saying when this fixity check
-// was performed and whether it succeeded.
+// record records a PremisEvent in Pharos for each algorithm we checked,
+// saying when this fixity check was performed and whether it succeeded.
 func (checker *APTFixityChecker) record() {
 	for fixityResult := range checker.RecordChannel {
-		// Create PREMIS event saying whether fixity event
-		// succeeded or failed.
-		event, err := models.NewEventGenericFileFixityCheck(
-			time.Now().UTC(),
-			constants.AlgSha256,
-			fixityResult.Sha256,
-			fixityResult.Sha256 == fixityResult.PharosSha256())
-		if err != nil {
-			fixityResult.Error = fmt.Errorf("Could not create Premis Event for %s: %v",
-				fixityResult.GenericFile.Identifier, err)
-		} else {
-			event.IntellectualObjectId = fixityResult.GenericFile.IntellectualObjectId
-			event.IntellectualObjectIdentifier = fixityResult.GenericFile.IntellectualObjectIdentifier
-			event.GenericFileId = fixityResult.GenericFile.Id
-			event.GenericFileIdentifier = fixityResult.GenericFile.Identifier
-			resp := checker.Context.PharosClient.PremisEventSave(event)
-			if resp.Error != nil {
-				fixityResult.Error = fmt.Errorf("After completing fixity check for %s, "+
-					"could not save PremisEvent to Pharos: %v. Event data: %v",
-					fixityResult.GenericFile.Identifier, resp.Error, event)
-			} else {
-				checker.Context.MessageLog.Info("Completing fixity check for %s, "+
-					"and saved PremisEvent %s to Pharos",
-					fixityResult.GenericFile.Identifier, event.Identifier)
+		ctx, cancel := StageContext(checker.Context.Config.FixityWorker)
+		for _, alg := range fixityResult.Algorithms() {
+			checker.recordEvent(ctx, fixityResult, alg)
+			if fixityResult.Error != nil {
+				break
 			}
 		}
+		cancel()
 		checker.PostProcessChannel <- fixityResult
 	}
 }
 
+// recordEvent creates a PREMIS event saying whether the fixity check
+// for the specified algorithm succeeded or failed, and saves it to Pharos.
+// If we already saved the event on an earlier attempt to process this
+// message, this doesn't save it again.
+func (checker *APTFixityChecker) recordEvent(ctx gocontext.Context, fixityResult *models.FixityResult, alg string) {
+	event, err := models.NewEventGenericFileFixityCheck(
+		time.Now().UTC(),
+		alg,
+		fixityResult.Digest(alg),
+		fixityResult.Digest(alg) == fixityResult.PharosDigest(alg))
+	if err != nil {
+		fixityResult.Error = fmt.Errorf("Could not create Premis Event for %s: %v",
+			fixityResult.GenericFile.Identifier, err)
+		return
+	}
+	event.Identifier = fixityEventIdentifier(fixityResult, alg)
+	resp := checker.Context.PharosClient.WithContext(ctx).PremisEventGet(event.Identifier)
+	if resp.Error == nil {
+		checker.Context.MessageLog.Info("PremisEvent %s for %s fixity check of %s "+
+			"was saved on an earlier attempt", event.Identifier, alg,
+			fixityResult.GenericFile.Identifier)
+		return
+	} else if !network.IsPharosNotFound(resp.Error) {
+		fixityResult.Error = fmt.Errorf("After completing %s fixity check for %s, "+
+			"could not tell whether PremisEvent %s was already saved: %v",
+			alg, fixityResult.GenericFile.Identifier, event.Identifier, resp.Error)
+		return
+	}
+	event.IntellectualObjectId = fixityResult.GenericFile.IntellectualObjectId
+	event.IntellectualObjectIdentifier = fixityResult.GenericFile.IntellectualObjectIdentifier
+	event.GenericFileId = fixityResult.GenericFile.Id
+	event.GenericFileIdentifier = fixityResult.GenericFile.Identifier
+	resp = checker.Context.PharosClient.WithContext(ctx).PremisEventSave(event)
+	if resp.Error != nil {
+		fixityResult.Error = fmt.Errorf("After completing %s fixity check for %s, "+
+			"could not save PremisEvent to Pharos: %v. Event data: %v",
+			alg, fixityResult.GenericFile.Identifier, resp.Error, event)
+	} else {
+		checker.Context.MessageLog.Info("Completing %s fixity check for %s, "+
+			"and saved PremisEvent %s to Pharos",
+			alg, fixityResult.GenericFile.Identifier, event.Identifier)
+	}
+}
+
+// fixityEventIdentifier returns the identifier of the PREMIS event for
+// the alg fixity check in fixityResult. The queue keeps a message's ID
+// when it delivers the message again, so every attempt to process the
+// message gets the same identifiers.
+func fixityEventIdentifier(fixityResult *models.FixityResult, alg string) string {
+	name := fmt.Sprintf("fixity:%s:%s:%s", fixityResult.Message.ID(),
+		fixityResult.GenericFile.Identifier, alg)
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+}
+
 // postProcess does some logging and tells NSQ to either finish
 // the message or requeue it.
 func (checker *APTFixityChecker) postProcess() {
@@ -161,35 +211,38 @@ func (checker *APTFixityChecker) postProcess() {
 		if fixityResult.Error != nil {
 			if fixityResult.ErrorIsFatal {
 				checker.Context.MessageLog.Error("%s (FATAL)", fixityResult.Error.Error())
-				fixityResult.NSQMessage.Finish()
+				fixityResult.Message.Finish()
 			} else {
 				checker.Context.MessageLog.Error("%s (transient)", fixityResult.Error.Error())
-				fixityResult.NSQMessage.Requeue(1 * time.Minute)
+				fixityResult.Message.Requeue(1 * time.Minute)
 			}
 		} else {
-			if fixityResult.PharosSha256() == fixityResult.Sha256 {
-				checker.Context.MessageLog.Info("Fixity check complete for %s. Fixity %s matches.",
-					fixityResult.GenericFile.Identifier, fixityResult.Sha256)
-			} else {
-				checker.Context.MessageLog.Warning("Fixity check complete for %s. S3 fixity %s "+
-					"DOES NOT MATCH PHAROS FIXITY %s",
-					fixityResult.GenericFile.Identifier, fixityResult.Sha256,
-					fixityResult.PharosSha256())
+			for _, alg := range fixityResult.Algorithms() {
+				if fixityResult.PharosDigest(alg) == fixityResult.Digest(alg) {
+					checker.Context.MessageLog.Info("Fixity check complete for %s. %s fixity %s matches.",
+						fixityResult.GenericFile.Identifier, alg, fixityResult.Digest(alg))
+				} else {
+					checker.Context.MessageLog.Warning("Fixity check complete for %s. S3 %s fixity %s "+
+						"DOES NOT MATCH PHAROS FIXITY %s",
+						fixityResult.GenericFile.Identifier, alg, fixityResult.Digest(alg),
+						fixityResult.PharosDigest(alg))
+				}
 			}
-			fixityResult.NSQMessage.Finish()
+			fixityResult.Message.Finish()
 		}
 		checker.ItemsInProcess.Delete(fixityResult.GenericFile.Identifier)
 		checker.Context.MessageLog.Info("Removed %s from items in process", fixityResult.GenericFile.Identifier)
 	}
 }
 
-// getFixityValueOfS3File calculates the sha256 digest of an S3 file.
+// getFixityValueOfS3File calculates the sha256 digest of an S3 file,
+// along with sha1 and sha512 digests if Pharos has those on record.
 // The downloader streams the file from S3 to /dev/null, because
 // we don't need to have the file on disk. We can calculate the
 // digest from the stream. We get the file from S3/Virginia, not
 // Glacier/Oregon! When this is done, the fixity value will be in
-// fixityResult.Sha256.
-func (checker *APTFixityChecker) getFixityValueOfS3File(fixityResult *models.FixityResult) {
+// fixityResult.Sha256, and all digests will be in fixityResult.Digests.
+func (checker *APTFixityChecker) getFixityValueOfS3File(ctx gocontext.Context, fixityResult *models.FixityResult) {
 	bucket, key, err := fixityResult.BucketAndKey()
 	if err != nil {
 		fixityResult.Error = fmt.Errorf("Can't get S3 bucket and key names for %s: %v",
@@ -197,42 +250,53 @@ func (checker *APTFixityChecker) getFixityValueOfS3File(fixityResult *models.Fix
 		fixityResult.ErrorIsFatal = true
 		return
 	}
-	downloader := network.NewS3Download(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		constants.AWSVirginia,
-		bucket,      // should be S3 preservation bucket
-		key,         // s3 key to fetch
-		"/dev/null", // local path at which to save the s3 file
-		false,       // don't calculate md5 digest
-		true)        // do calculate sha256 digest
-	downloader.Fetch()
-	if downloader.ErrorMessage != "" {
+	// bucket should be S3 preservation bucket. We don't need to save
+	// the file anywhere, since we're only calculating digests.
+	backend := checker.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx)
+	_, digests, err := network.DownloadFromStorage(backend, bucket, key,
+		os.DevNull, fixityResult.Algorithms(),
+		network.NewDownloadOptions(checker.Context.Config.FixityWorker))
+	if err != nil {
 		fixityResult.Error = fmt.Errorf("Error fetching file %s (%s/%s) from S3: %s",
-			fixityResult.GenericFile.Identifier, bucket, key,
-			downloader.ErrorMessage)
-		if strings.Contains(downloader.ErrorMessage, "NoSuchKey") {
+			fixityResult.GenericFile.Identifier, bucket, key, err.Error())
+		if network.IsNotFound(err) {
 			fixityResult.ErrorIsFatal = true
 		}
 		return
 	}
 	fixityResult.S3FileExists = true
-	fixityResult.Sha256 = downloader.Sha256Digest
+	fixityResult.Sha256 = digests[constants.AlgSha256]
+	fixityResult.Digests = digests
 	return
 }
 
+// fixityOutcome describes the result of a fixity check for metrics:
+// "error" if we couldn't calculate fixity, "mismatch" if any digest
+// doesn't match what Pharos has on record, and "ok" otherwise.
+func fixityOutcome(fixityResult *models.FixityResult) string {
+	if fixityResult.Error != nil {
+		return "error"
+	}
+	for _, alg := range fixityResult.Algorithms() {
+		if fixityResult.Digest(alg) != fixityResult.PharosDigest(alg) {
+			return "mismatch"
+		}
+	}
+	return "ok"
+}
+
 // buildFixityResult builds the manifest that we'll need to record
 // the fixity check process and its outcome.
-func (checker *APTFixityChecker) buildFixityResult(message *nsq.Message) *models.FixityResult {
+func (checker *APTFixityChecker) buildFixityResult(message models.QueueMessage) *models.FixityResult {
 	fixityResult := models.NewFixityResult(message)
-	gfIdentifier := strings.TrimSpace(string(message.Body))
+	gfIdentifier := strings.TrimSpace(string(message.Body()))
 	// Get GenericFile with checksums (param includeRelations = true)
 	resp := checker.Context.PharosClient.GenericFileGet(gfIdentifier, true)
 	if resp.Error != nil {
 		fixityResult.Error = fmt.Errorf("Can't get generic file '%s' from Pharos: %v", gfIdentifier, resp.Error.Error())
-		if resp.Response == nil || resp.Response.StatusCode == 404 {
-			fixityResult.ErrorIsFatal = true
-		}
+		// If the file is gone, there's nothing to check. Anything else,
+		// including Pharos being unavailable, may clear up on retry.
+		fixityResult.ErrorIsFatal = network.IsPharosNotFound(resp.Error)
 		return fixityResult
 	}
 	fixityResult.GenericFile = resp.GenericFile()
@@ -0,0 +1,83 @@
+package workers_test
+
+import (
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/APTrust/exchange/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixity checker gives up on files Pharos doesn't have, but
+// tries again later if it can't reach Pharos.
+func TestFixityCheckerPharosErrors(t *testing.T) {
+	env := newPharosTestEnv(t)
+	defer env.Close()
+	checker := workers.NewAPTFixityChecker(env.Context)
+
+	message := testutil.MakeQueueMessage("test.edu/bag/data/no_such_file.txt")
+	require.Nil(t, checker.HandleMessage(message))
+	assert.Equal(t, "finish", message.Operation)
+
+	env.Pharos.Close()
+	message = testutil.MakeQueueMessage("test.edu/bag/data/no_such_file.txt")
+	require.Nil(t, checker.HandleMessage(message))
+	assert.Equal(t, "requeue", message.Operation)
+}
+
+// runFixityCheck runs a fixity check for message and waits for
+// the checker to finish or requeue it.
+func runFixityCheck(t *testing.T, checker *workers.APTFixityChecker, message *testutil.TestMessage) {
+	require.Nil(t, checker.HandleMessage(message))
+	deadline := time.Now().Add(e2eTimeout)
+	for !message.HasResponded() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Equal(t, "finish", message.Operation)
+}
+
+// The queue delivers a message again if the checker requeues it, or
+// if the checker dies before it finishes. Processing the message
+// again shouldn't record the same fixity checks twice.
+func TestFixityCheckerRetryDoesNotDuplicateEvents(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	env.ingest(t)
+	env.Context.Config.MaxDaysSinceFixityCheck = 0
+	var gfIdentifier string
+	for _, gf := range env.getObjectWithFiles(t).GenericFiles {
+		if strings.Contains(gf.Identifier, "/data/") {
+			gfIdentifier = gf.Identifier
+			break
+		}
+	}
+	require.NotEmpty(t, gfIdentifier)
+	countEvents := func() int {
+		params := url.Values{}
+		params.Set("file_identifier", gfIdentifier)
+		params.Set("event_type", constants.EventFixityCheck)
+		resp := env.Context.PharosClient.PremisEventList(params)
+		require.Nil(t, resp.Error)
+		return len(resp.PremisEvents())
+	}
+	before := countEvents()
+
+	checker := workers.NewAPTFixityChecker(env.Context)
+	runFixityCheck(t, checker, testutil.MakeQueueMessage(gfIdentifier))
+	afterFirst := countEvents()
+	assert.True(t, afterFirst > before)
+
+	// Same message delivered again.
+	runFixityCheck(t, checker, testutil.MakeQueueMessage(gfIdentifier))
+	assert.Equal(t, afterFirst, countEvents())
+
+	// A new message is a new fixity check.
+	message := testutil.MakeQueueMessage(gfIdentifier)
+	message.MessageID = "FEDCBA9876543210"
+	runFixityCheck(t, checker, message)
+	assert.Equal(t, afterFirst+(afterFirst-before), countEvents())
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util"
-	"github.com/nsqio/go-nsq"
 	"net/url"
 	"strings"
 	"time"
@@ -84,7 +83,7 @@ func NewGlacierRestore(_context *context.Context) *APTGlacierRestoreInit {
 }
 
 // This is the callback that NSQ workers use to handle messages from NSQ.
-func (restorer *APTGlacierRestoreInit) HandleMessage(message *nsq.Message) error {
+func (restorer *APTGlacierRestoreInit) HandleMessage(message models.QueueMessage) error {
 	message.DisableAutoResponse()
 	workItem, err := GetWorkItem(message, restorer.Context)
 	if err != nil {
@@ -101,7 +100,7 @@ func (restorer *APTGlacierRestoreInit) HandleMessage(message *nsq.Message) error
 	return nil
 }
 
-func (restorer *APTGlacierRestoreInit) GetGlacierRestoreState(message *nsq.Message, workItem *models.WorkItem) (*models.GlacierRestoreState, error) {
+func (restorer *APTGlacierRestoreInit) GetGlacierRestoreState(message models.QueueMessage, workItem *models.WorkItem) (*models.GlacierRestoreState, error) {
 	state := models.NewGlacierRestoreState(message, workItem)
 	if workItem.WorkItemStateId != nil && *workItem.WorkItemStateId != 0 {
 		workItemState, err := GetWorkItemState(workItem, restorer.Context, false)
@@ -113,7 +112,7 @@ func (restorer *APTGlacierRestoreInit) GetGlacierRestoreState(message *nsq.Messa
 			if err != nil {
 				return nil, err
 			}
-			state.NSQMessage = message
+			state.Message = message
 			state.WorkItem = workItem
 		}
 	}
@@ -179,7 +178,10 @@ func (restorer *APTGlacierRestoreInit) RestoreRequestNeeded(state *models.Glacie
 	if err != nil {
 		return needsRestoreRequest, err
 	}
+	ctx, cancel := StageContext(restorer.Context.Config.GlacierRestoreWorker)
+	s3Client = s3Client.WithContext(ctx)
 	s3Client.Head(fileUUID)
+	cancel()
 
 	// Status 409: Conflict is an expected response.
 	// It means a restore request has already been initiated.
@@ -296,7 +298,7 @@ func (restorer *APTGlacierRestoreInit) Cleanup() {
 				if !restorer.HasPendingRestoreRequest(state) {
 					restorer.CreateRestoreWorkItem(state)
 				}
-				state.NSQMessage.Finish()
+				state.Message.Finish()
 			} else if state.WorkSummary.AttemptNumber >= restorer.Context.Config.GlacierRestoreWorker.MaxAttempts {
 				restorer.FinishWithMaxAttemptsExceeded(state, report)
 			} else if report.AllRetrievalsInitiated() {
@@ -386,7 +388,7 @@ func (restorer *APTGlacierRestoreInit) FinishWithError(state *models.GlacierRest
 	state.WorkItem.Status = constants.StatusFailed
 	state.WorkItem.Retry = false
 	state.WorkItem.NeedsAdminReview = true
-	state.NSQMessage.Finish()
+	state.Message.Finish()
 }
 
 func (restorer *APTGlacierRestoreInit) FinishWithMaxAttemptsExceeded(state *models.GlacierRestoreState, report *models.GlacierRequestReport) {
@@ -416,7 +418,7 @@ func (restorer *APTGlacierRestoreInit) RequeueForAdditionalRequests(state *model
 	state.WorkItem.Status = constants.StatusStarted
 	state.WorkItem.Retry = true
 	state.WorkItem.NeedsAdminReview = false
-	state.NSQMessage.RequeueWithoutBackoff(1 * time.Minute)
+	state.Message.RequeueWithoutBackoff(1 * time.Minute)
 }
 
 // requeueToCheckState: We call this when we know we've requested
@@ -445,7 +447,7 @@ func (restorer *APTGlacierRestoreInit) RequeueToCheckState(state *models.Glacier
 		restorer.Context.MessageLog.Error("Setting longer polling interval because "+
 			"WorkItem %d is in Glacier Deep Archive.", state.WorkItem.Id)
 	}
-	state.NSQMessage.RequeueWithoutBackoff(recheckInterval)
+	state.Message.RequeueWithoutBackoff(recheckInterval)
 }
 
 // createRestoreWorkItem: We call this to create a normal WorkItem
@@ -611,7 +613,10 @@ func (restorer *APTGlacierRestoreInit) InitializeRetrieval(state *models.Glacier
 	}
 	now := time.Now().UTC()
 	estimatedDeletionFromS3 := now.AddDate(0, 0, DAYS_TO_KEEP_IN_S3)
+	ctx, cancel := StageContext(restorer.Context.Config.GlacierRestoreWorker)
+	restoreClient = restoreClient.WithContext(ctx)
 	restoreClient.Restore()
+	cancel()
 	if restoreClient.ErrorMessage != "" {
 		state.WorkSummary.AddError("Glacier retrieval request returned an error for %s at %s: %v",
 			gf.Identifier, gf.URI, restoreClient.ErrorMessage)
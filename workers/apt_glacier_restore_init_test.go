@@ -119,9 +119,9 @@ func getTestComponents(t *testing.T, fileOrObject string) (*workers.APTGlacierRe
 	} else {
 		workItem = getFileWorkItem(TEST_ID, objIdentifier, objIdentifier+"/file1.txt")
 	}
-	nsqMessage := testutil.MakeNsqMessage(fmt.Sprintf("%d", TEST_ID))
+	message := testutil.MakeQueueMessage(fmt.Sprintf("%d", TEST_ID))
 
-	state, err := worker.GetGlacierRestoreState(nsqMessage, workItem)
+	state, err := worker.GetGlacierRestoreState(message, workItem)
 	require.Nil(t, err)
 	require.NotNil(t, state)
 	return worker, state
@@ -142,14 +142,14 @@ func TestGetGlacierRestoreState(t *testing.T) {
 
 	NumberOfRequestsToIncludeInState = 0
 	worker.Context.PharosClient = getPharosClientForTest(pharosTestServer.URL)
-	state, err := worker.GetGlacierRestoreState(state.NSQMessage, state.WorkItem)
+	state, err := worker.GetGlacierRestoreState(state.Message, state.WorkItem)
 	require.Nil(t, err)
 	require.NotNil(t, state)
 	assert.NotNil(t, state.WorkSummary)
 	assert.Empty(t, state.Requests)
 
 	NumberOfRequestsToIncludeInState = 10
-	state, err = worker.GetGlacierRestoreState(state.NSQMessage, state.WorkItem)
+	state, err = worker.GetGlacierRestoreState(state.Message, state.WorkItem)
 	require.Nil(t, err)
 	require.NotNil(t, state)
 	assert.NotNil(t, state.WorkSummary)
@@ -316,7 +316,7 @@ func TestGetGenericFile(t *testing.T) {
 	worker, state := getTestComponents(t, "file")
 	require.Nil(t, state.GenericFile)
 
-	state, err := worker.GetGlacierRestoreState(state.NSQMessage, state.WorkItem)
+	state, err := worker.GetGlacierRestoreState(state.Message, state.WorkItem)
 	require.Nil(t, err)
 	require.NotNil(t, state)
 	require.Nil(t, state.GenericFile)
@@ -364,12 +364,11 @@ func TestSaveWorkItemState(t *testing.T) {
 
 func TestFinishWithError(t *testing.T) {
 	worker, state := getTestComponents(t, "object")
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
+	message := state.Message.(*testutil.TestMessage)
 	state.WorkSummary.AddError("Error 1")
 	state.WorkSummary.AddError("Error 2")
 	worker.FinishWithError(state)
-	assert.Equal(t, "finish", delegate.Operation)
+	assert.Equal(t, "finish", message.Operation)
 	assert.Equal(t, state.WorkSummary.AllErrorsAsString(), state.WorkItem.Note)
 	assert.Equal(t, constants.StatusFailed, state.WorkItem.Status)
 	assert.False(t, state.WorkItem.Retry)
@@ -378,11 +377,10 @@ func TestFinishWithError(t *testing.T) {
 
 func TestRequeueForAdditionalRequests(t *testing.T) {
 	worker, state := getTestComponents(t, "object")
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
+	message := state.Message.(*testutil.TestMessage)
 	worker.RequeueForAdditionalRequests(state)
-	assert.Equal(t, "requeue", delegate.Operation)
-	assert.Equal(t, 1*time.Minute, delegate.Delay)
+	assert.Equal(t, "requeue", message.Operation)
+	assert.Equal(t, 1*time.Minute, message.Delay)
 	assert.Equal(t, "Requeued to make additional Glacier restore requests.", state.WorkItem.Note)
 	assert.Equal(t, constants.StatusStarted, state.WorkItem.Status)
 	assert.True(t, state.WorkItem.Retry)
@@ -391,11 +389,10 @@ func TestRequeueForAdditionalRequests(t *testing.T) {
 
 func TestRequeueToCheckState(t *testing.T) {
 	worker, state := getTestComponents(t, "object")
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
+	message := state.Message.(*testutil.TestMessage)
 	worker.RequeueToCheckState(state)
-	assert.Equal(t, "requeue", delegate.Operation)
-	assert.Equal(t, 2*time.Hour, delegate.Delay)
+	assert.Equal(t, "requeue", message.Operation)
+	assert.Equal(t, 2*time.Hour, message.Delay)
 	assert.Equal(t, "Requeued to check on status of Glacier restore requests.", state.WorkItem.Note)
 	assert.Equal(t, constants.StatusStarted, state.WorkItem.Status)
 	assert.True(t, state.WorkItem.Retry)
@@ -449,8 +446,6 @@ func TestRequestAllFiles(t *testing.T) {
 
 func TestRequestFile(t *testing.T) {
 	worker, state := getTestComponents(t, "file")
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
 
 	gf, err := worker.GetGenericFile(state)
 	assert.Nil(t, err)
@@ -492,7 +487,7 @@ func TestGetRequestDetails(t *testing.T) {
 	worker, state := getTestComponents(t, "file")
 	require.Nil(t, state.GenericFile)
 
-	state, err := worker.GetGlacierRestoreState(state.NSQMessage, state.WorkItem)
+	state, err := worker.GetGlacierRestoreState(state.Message, state.WorkItem)
 	require.Nil(t, err)
 	require.NotNil(t, state)
 	require.Nil(t, state.GenericFile)
@@ -551,7 +546,7 @@ func TestGetRequestRecord(t *testing.T) {
 	worker, state := getTestComponents(t, "file")
 	require.Nil(t, state.GenericFile)
 
-	state, err := worker.GetGlacierRestoreState(state.NSQMessage, state.WorkItem)
+	state, err := worker.GetGlacierRestoreState(state.Message, state.WorkItem)
 	require.Nil(t, err)
 	require.NotNil(t, state)
 	require.Nil(t, state.GenericFile)
@@ -599,7 +594,7 @@ func TestInitializeRetrieval(t *testing.T) {
 	worker, state := getTestComponents(t, "file")
 	require.Nil(t, state.GenericFile)
 
-	state, err := worker.GetGlacierRestoreState(state.NSQMessage, state.WorkItem)
+	state, err := worker.GetGlacierRestoreState(state.Message, state.WorkItem)
 	require.Nil(t, err)
 	require.NotNil(t, state)
 	require.Nil(t, state.GenericFile)
@@ -654,8 +649,7 @@ func TestInitializeRetrieval(t *testing.T) {
 
 //	worker, state := getTestComponents(t, "object")
 //	//state.IntellectualObject = testutil.MakeIntellectualObject(12, 0, 0, 0)
-//	delegate := testutil.NewNSQTestDelegate()
-//	state.NSQMessage.Delegate = delegate
+//	message := state.Message.(*testutil.TestMessage)
 
 //	// Create a post-test channel to check the state of various
 //	// items after they've gone through the entire workflow.
@@ -675,8 +669,8 @@ func TestInitializeRetrieval(t *testing.T) {
 //				assert.True(t, req.RequestAccepted)
 //				assert.False(t, req.IsAvailableInS3)
 //			}
-//			assert.Equal(t, "requeue", delegate.Operation)
-//			assert.Equal(t, 1*time.Minute, delegate.Delay)
+//			assert.Equal(t, "requeue", message.Operation)
+//			assert.Equal(t, 1*time.Minute, message.Delay)
 //			assert.Equal(t, "Requeued to make additional Glacier restore requests.", state.WorkItem.Note)
 //			assert.Equal(t, constants.StatusStarted, state.WorkItem.Status)
 //			assert.True(t, state.WorkItem.Retry)
@@ -695,8 +689,7 @@ func TestGlacierAcceptNow(t *testing.T) {
 
 	worker, state := getTestComponents(t, "object")
 	state.IntellectualObject = testutil.MakeIntellectualObject(12, 0, 0, 0)
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
+	message := state.Message.(*testutil.TestMessage)
 
 	worker.PostTestChannel = make(chan *models.GlacierRestoreState)
 	var wg sync.WaitGroup
@@ -714,8 +707,8 @@ func TestGlacierAcceptNow(t *testing.T) {
 				assert.True(t, req.RequestAccepted)
 				assert.False(t, req.IsAvailableInS3)
 			}
-			assert.Equal(t, "requeue", delegate.Operation)
-			assert.Equal(t, 2*time.Hour, delegate.Delay)
+			assert.Equal(t, "requeue", message.Operation)
+			assert.Equal(t, 2*time.Hour, message.Delay)
 			assert.Equal(t, "Requeued to check on status of Glacier restore requests.", state.WorkItem.Note)
 			assert.Equal(t, constants.StatusStarted, state.WorkItem.Status)
 			assert.True(t, state.WorkItem.Retry)
@@ -737,8 +730,7 @@ func TestGlacierAcceptNow(t *testing.T) {
 
 //	worker, state := getTestComponents(t, "object")
 //	state.IntellectualObject = testutil.MakeIntellectualObject(12, 0, 0, 0)
-//	delegate := testutil.NewNSQTestDelegate()
-//	state.NSQMessage.Delegate = delegate
+//	message := state.Message.(*testutil.TestMessage)
 
 //	worker.PostTestChannel = make(chan *models.GlacierRestoreState)
 //	var wg sync.WaitGroup
@@ -756,8 +748,8 @@ func TestGlacierAcceptNow(t *testing.T) {
 //				assert.True(t, req.RequestAccepted)
 //				assert.False(t, req.IsAvailableInS3)
 //			}
-//			assert.Equal(t, "requeue", delegate.Operation)
-//			assert.Equal(t, 1*time.Minute, delegate.Delay)
+//			assert.Equal(t, "requeue", message.Operation)
+//			assert.Equal(t, 1*time.Minute, message.Delay)
 //			assert.Equal(t, "Requeued to make additional Glacier restore requests.", state.WorkItem.Note)
 //			assert.Equal(t, constants.StatusStarted, state.WorkItem.Status)
 //			assert.True(t, state.WorkItem.Retry)
@@ -776,8 +768,7 @@ func TestGlacierInProgressHead(t *testing.T) {
 
 	worker, state := getTestComponents(t, "object")
 	state.IntellectualObject = testutil.MakeIntellectualObject(12, 0, 0, 0)
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
+	message := state.Message.(*testutil.TestMessage)
 
 	worker.PostTestChannel = make(chan *models.GlacierRestoreState)
 	var wg sync.WaitGroup
@@ -795,8 +786,8 @@ func TestGlacierInProgressHead(t *testing.T) {
 				assert.True(t, req.RequestAccepted)
 				assert.False(t, req.IsAvailableInS3)
 			}
-			assert.Equal(t, "requeue", delegate.Operation)
-			assert.Equal(t, 2*time.Hour, delegate.Delay)
+			assert.Equal(t, "requeue", message.Operation)
+			assert.Equal(t, 2*time.Hour, message.Delay)
 			assert.Equal(t, "Requeued to check on status of Glacier restore requests.", state.WorkItem.Note)
 			assert.Equal(t, constants.StatusStarted, state.WorkItem.Status)
 			assert.True(t, state.WorkItem.Retry)
@@ -815,8 +806,7 @@ func TestGlacierInProgressGlacier(t *testing.T) {
 
 	worker, state := getTestComponents(t, "object")
 	state.IntellectualObject = testutil.MakeIntellectualObject(12, 0, 0, 0)
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
+	message := state.Message.(*testutil.TestMessage)
 
 	worker.PostTestChannel = make(chan *models.GlacierRestoreState)
 	var wg sync.WaitGroup
@@ -834,8 +824,8 @@ func TestGlacierInProgressGlacier(t *testing.T) {
 				assert.True(t, req.RequestAccepted)
 				assert.False(t, req.IsAvailableInS3)
 			}
-			assert.Equal(t, "requeue", delegate.Operation)
-			assert.Equal(t, 2*time.Hour, delegate.Delay)
+			assert.Equal(t, "requeue", message.Operation)
+			assert.Equal(t, 2*time.Hour, message.Delay)
 			assert.Equal(t, "Requeued to check on status of Glacier restore requests.", state.WorkItem.Note)
 			assert.Equal(t, constants.StatusStarted, state.WorkItem.Status)
 			assert.True(t, state.WorkItem.Retry)
@@ -855,8 +845,7 @@ func TestGlacierCompleted(t *testing.T) {
 
 	worker, state := getTestComponents(t, "object")
 	state.IntellectualObject = testutil.MakeIntellectualObject(12, 0, 0, 0)
-	delegate := testutil.NewNSQTestDelegate()
-	state.NSQMessage.Delegate = delegate
+	message := state.Message.(*testutil.TestMessage)
 
 	worker.PostTestChannel = make(chan *models.GlacierRestoreState)
 	var wg sync.WaitGroup
@@ -874,7 +863,7 @@ func TestGlacierCompleted(t *testing.T) {
 				assert.True(t, req.RequestAccepted)
 				assert.True(t, req.IsAvailableInS3)
 			}
-			assert.Equal(t, "finish", delegate.Operation)
+			assert.Equal(t, "finish", message.Operation)
 			assert.Equal(t, "All files have been moved from Glacier to S3. Created new WorkItem #0 to finish restoration.", state.WorkItem.Note)
 			assert.Equal(t, constants.StatusSuccess, state.WorkItem.Status)
 			assert.True(t, state.WorkItem.Retry)
@@ -0,0 +1,291 @@
+package workers
+
+import (
+	gocontext "context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/metrics"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxIngestEventSize is the largest S3 notification the ingest
+// trigger's webhook accepts. Real notifications are a few KB.
+const MaxIngestEventSize = 1024 * 1024
+
+// How long to wait after the event queue returns an error before
+// trying it again.
+const ingestTriggerErrorWait = 5 * time.Second
+
+// Don't reload institutions from Pharos more often than this when
+// notifications come in from buckets we don't know about.
+const institutionRefreshInterval = time.Minute
+
+// APTIngestTrigger queues bags for ingest as soon as they're uploaded.
+// It receives S3 ObjectCreated notifications from the receiving buckets,
+// either through an HTTP webhook (see ServeHTTP) or from an EventQueue
+// such as SQS (see RunQueue). For each new bag, it creates an ingest
+// WorkItem and adds it to the fetch topic, just as APTBucketReader does.
+// It asks Pharos only about the bags in the notifications, rather than
+// checking everything in every receiving bucket.
+//
+// Notifications can be lost, so APTBucketReader should still run now
+// and then to pick up anything the trigger missed. Both check Pharos
+// for an existing WorkItem before creating one, so a bag isn't queued
+// again when S3 sends the same notification more than once. They run
+// in separate processes, though, so if both see a new bag at the same
+// time, each may create a WorkItem for it. APTFetcher cancels all but
+// the oldest of those.
+type APTIngestTrigger struct {
+	Context *context.Context
+	// AuthToken is the token webhook senders must put in the
+	// Authorization header, by itself or after "Bearer ". If it's
+	// empty, the webhook accepts requests from anyone, so
+	// apt_ingest_trigger won't run that way without -insecure-webhook.
+	AuthToken            string
+	reader               *APTBucketReader
+	institutionsLoadedAt time.Time
+	mutex                sync.Mutex
+}
+
+// NewAPTIngestTrigger returns a new ingest trigger. It loads the list
+// of institutions from Pharos, so it knows who owns which receiving
+// bucket.
+func NewAPTIngestTrigger(_context *context.Context) (*APTIngestTrigger, error) {
+	trigger := &APTIngestTrigger{
+		Context: _context,
+		reader:  NewAPTBucketReader(_context, false),
+	}
+	err := trigger.reader.cacheInstitutions()
+	if err != nil {
+		return nil, err
+	}
+	trigger.institutionsLoadedAt = time.Now()
+	return trigger, nil
+}
+
+// ServeHTTP handles S3 notifications POSTed to the webhook. It responds
+// with 200 once the bags in the notification are queued, or if there's
+// nothing to queue, and with 503 if queueing failed, so the sender will
+// try again.
+func (trigger *APTIngestTrigger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !trigger.authorized(r) {
+		trigger.Context.MessageLog.Warning("Rejected notification from %s: bad auth token",
+			r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxIngestEventSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	event, err := models.ParseS3Event(data)
+	if err != nil {
+		trigger.Context.MessageLog.Warning("Rejected notification from %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = trigger.ProcessEvent(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+// authorized returns true if the request has the right auth token.
+func (trigger *APTIngestTrigger) authorized(r *http.Request) bool {
+	if trigger.AuthToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(trigger.AuthToken)) == 1
+}
+
+// RunQueue processes notifications from queue until ctx is done.
+// Messages are deleted once the bags they describe are queued. If
+// queueing fails, the message stays in the queue, which delivers it
+// again later. Messages that aren't S3 notifications are deleted,
+// since trying them again won't help.
+func (trigger *APTIngestTrigger) RunQueue(ctx gocontext.Context, queue network.EventQueue) {
+	for ctx.Err() == nil {
+		messages, err := queue.Receive(ctx)
+		if err != nil {
+			trigger.Context.MessageLog.Error(err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(ingestTriggerErrorWait):
+			}
+			continue
+		}
+		for _, message := range messages {
+			trigger.processMessage(queue, message)
+		}
+	}
+}
+
+// processMessage processes one message from queue, and deletes it
+// unless it needs to be tried again.
+func (trigger *APTIngestTrigger) processMessage(queue network.EventQueue, message *network.EventMessage) {
+	event, err := models.ParseS3Event([]byte(message.Body))
+	if err != nil {
+		trigger.Context.MessageLog.Error("Discarding message: %v. Message: %s", err, message.Body)
+	} else if err = trigger.ProcessEvent(event); err != nil {
+		trigger.Context.MessageLog.Warning("Will retry notification when the queue "+
+			"delivers it again: %v", err)
+		return
+	}
+	err = queue.Delete(message)
+	if err != nil {
+		trigger.Context.MessageLog.Error(err.Error())
+	}
+}
+
+// ProcessEvent queues the bags described in event's ObjectCreated
+// records. It ignores other records, and files that aren't bags or
+// aren't in receiving buckets. It returns an error if it may have
+// failed to queue a bag.
+func (trigger *APTIngestTrigger) ProcessEvent(event *models.S3Event) error {
+	trigger.mutex.Lock()
+	defer trigger.mutex.Unlock()
+	errors := make([]string, 0)
+	for _, record := range event.Records {
+		err := trigger.processRecord(record)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// processRecord queues the bag described in record, if there is one,
+// and counts the record in metrics.IngestEvents.
+func (trigger *APTIngestTrigger) processRecord(record *models.S3EventRecord) error {
+	queued, err := trigger.queueRecord(record)
+	if err != nil {
+		metrics.IngestEvents.Inc("error")
+	} else if queued {
+		metrics.IngestEvents.Inc("queued")
+	} else {
+		metrics.IngestEvents.Inc("ignored")
+	}
+	return err
+}
+
+// queueRecord returns true if record describes a bag that's ready
+// for ingest, which it then queues.
+func (trigger *APTIngestTrigger) queueRecord(record *models.S3EventRecord) (bool, error) {
+	if !record.IsObjectCreated() {
+		return false, nil
+	}
+	bucket := record.S3.Bucket.Name
+	key, err := record.ObjectKey()
+	if err != nil {
+		trigger.Context.MessageLog.Warning("Ignoring notification for bucket %s: %v", bucket, err)
+		return false, nil
+	}
+	if !trigger.isReceivingBucket(bucket) {
+		trigger.Context.MessageLog.Warning("Ignoring %s/%s: not a receiving bucket", bucket, key)
+		return false, nil
+	}
+	if !trigger.reader.isBagKey(key) {
+		return false, nil
+	}
+	trigger.Context.MessageLog.Info("Received notification for %s/%s", bucket, key)
+	if _, _, isMultipart := util.MultipartBagPart(key); isMultipart {
+		return trigger.queueMultipartBag(bucket, key)
+	}
+	etag := record.S3.Object.ETag
+	size := record.S3.Object.Size
+	lastModified := record.EventTime
+	s3Object := &s3.Object{
+		Key:          &key,
+		ETag:         &etag,
+		Size:         &size,
+		LastModified: &lastModified,
+	}
+	return true, trigger.reader.processS3Object(s3Object, bucket)
+}
+
+// queueMultipartBag queues the multipart bag that key is part of,
+// if all of its parts have arrived. If they haven't, the notification
+// for the last part to arrive will queue it. APTBucketReader is the
+// one that gives up on bags whose parts never arrive.
+func (trigger *APTIngestTrigger) queueMultipartBag(bucket, key string) (bool, error) {
+	bagName := util.CleanBagName(key)
+	backend := trigger.Context.StorageBackend(trigger.Context.Config.APTrustS3Region)
+	objects, err := backend.List(bucket, bagName+".b", MAX_KEYS)
+	if err != nil {
+		msg := fmt.Sprintf("Cannot list parts of multipart bag %s/%s: %v", bucket, bagName, err)
+		trigger.Context.MessageLog.Error(msg)
+		return false, fmt.Errorf(msg)
+	}
+	bag := models.NewMultipartBag(bagName)
+	for _, obj := range objects {
+		if util.CleanBagName(obj.Key) != bagName {
+			continue
+		}
+		err = bag.AddPart(obj.Key, obj.ETag, obj.Size, obj.LastModified)
+		if err != nil {
+			trigger.Context.MessageLog.Warning(err.Error())
+		}
+	}
+	if !bag.IsComplete() {
+		trigger.Context.MessageLog.Info("Waiting for multipart bag %s/%s to be complete: %s",
+			bucket, bagName, strings.Join(bag.Problems(), " "))
+		return false, nil
+	}
+	return true, trigger.reader.processS3Object(multipartS3Object(bag, bag.FirstPartKey()), bucket)
+}
+
+// isReceivingBucket returns true if bucket is an institution's
+// receiving bucket. If it's not, and we haven't loaded institutions
+// for a while, we check again, in case the bucket belongs to a new
+// institution.
+func (trigger *APTIngestTrigger) isReceivingBucket(bucket string) bool {
+	if trigger.knownReceivingBucket(bucket) {
+		return true
+	}
+	if time.Since(trigger.institutionsLoadedAt) < institutionRefreshInterval {
+		return false
+	}
+	trigger.institutionsLoadedAt = time.Now()
+	err := CacheBucketNames(trigger.Context)
+	if err == nil {
+		err = trigger.reader.cacheInstitutions()
+	}
+	if err != nil {
+		trigger.Context.MessageLog.Error("Cannot reload institutions: %v", err)
+		return false
+	}
+	return trigger.knownReceivingBucket(bucket)
+}
+
+// knownReceivingBucket returns true if bucket is the receiving bucket
+// of one of the institutions we loaded, or, for integration tests, if
+// it's in Config.ReceivingBuckets.
+func (trigger *APTIngestTrigger) knownReceivingBucket(bucket string) bool {
+	for _, inst := range trigger.reader.Institutions {
+		if inst.ReceivingBucket == bucket {
+			return true
+		}
+	}
+	return util.StringListContains(trigger.Context.Config.ReceivingBuckets, bucket)
+}
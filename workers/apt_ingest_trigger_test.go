@@ -0,0 +1,222 @@
+package workers_test
+
+import (
+	gocontext "context"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putAndNotify puts a file into bucket, and returns the S3 notification
+// for it.
+func (env *e2eEnv) putAndNotify(t *testing.T, bucket, key string) string {
+	_, err := env.Backend.Put(bucket, key, "application/x-tar", nil,
+		strings.NewReader("Contents of "+key), 0)
+	require.Nil(t, err)
+	obj, err := env.Backend.Head(bucket, key)
+	require.Nil(t, err)
+	return s3Notification("ObjectCreated:Put", bucket, key, obj.ETag, obj.Size)
+}
+
+func s3Notification(eventName, bucket, key, etag string, size int64) string {
+	return fmt.Sprintf(`{"Records": [{"eventVersion": "2.1", "eventSource": "aws:s3",
+"eventTime": "%s", "eventName": "%s", "s3": {"bucket": {"name": "%s"},
+"object": {"key": "%s", "size": %d, "eTag": "%s"}}}]}`,
+		time.Now().UTC().Format(time.RFC3339), eventName, bucket,
+		url.QueryEscape(key), size, etag)
+}
+
+func postNotification(trigger *workers.APTIngestTrigger, body, authorization string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	trigger.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// findIngestItems returns the ingest WorkItems named name.
+func (env *e2eEnv) findIngestItems(t *testing.T, name string) []*models.WorkItem {
+	params := url.Values{}
+	params.Set("name", name)
+	params.Set("item_action", constants.ActionIngest)
+	resp := env.Context.PharosClient.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	return resp.WorkItems()
+}
+
+func TestIngestTriggerWebhook(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	trigger, err := workers.NewAPTIngestTrigger(env.Context)
+	require.Nil(t, err)
+
+	notification := env.putAndNotify(t, e2eReceivingBucket, "my bag.tar")
+	recorder := postNotification(trigger, notification, "")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	items := env.findIngestItems(t, "my bag.tar")
+	require.Equal(t, 1, len(items))
+	item := items[0]
+	assert.Equal(t, e2eReceivingBucket, item.Bucket)
+	assert.Equal(t, constants.StageReceive, item.Stage)
+	assert.Equal(t, constants.StatusPending, item.Status)
+	assert.EqualValues(t, len("Contents of my bag.tar"), item.Size)
+	require.NotNil(t, item.QueuedAt)
+	env.assertPublished(t, env.Context.Config.FetchWorker.NsqTopic, item.Id)
+
+	// The same notification again doesn't queue the bag again.
+	recorder = postNotification(trigger, notification, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 1, len(env.findIngestItems(t, "my bag.tar")))
+
+	// These aren't bags waiting for ingest.
+	ignored := []string{
+		env.putAndNotify(t, e2eReceivingBucket, "notes.txt"),
+		env.putAndNotify(t, e2eReceivingBucket, "subdir/bag.tar"),
+		env.putAndNotify(t, e2eRestoreBucket, "restored_bag.tar"),
+		s3Notification("ObjectRemoved:Delete", e2eReceivingBucket, "gone.tar", "", 0),
+		`{"Service":"Amazon S3","Event":"s3:TestEvent"}`,
+	}
+	for _, notification := range ignored {
+		recorder = postNotification(trigger, notification, "")
+		assert.Equal(t, http.StatusOK, recorder.Code, notification)
+	}
+	assert.Empty(t, env.Published)
+	assert.Empty(t, env.findIngestItems(t, "restored_bag.tar"))
+
+	recorder = postNotification(trigger, "This isn't JSON", "")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder = httptest.NewRecorder()
+	trigger.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	// If we can't queue the bag, the sender should try again.
+	env.NsqServer.Close()
+	notification = env.putAndNotify(t, e2eReceivingBucket, "bag2.tar")
+	recorder = postNotification(trigger, notification, "")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestIngestTriggerWebhookAuth(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	trigger, err := workers.NewAPTIngestTrigger(env.Context)
+	require.Nil(t, err)
+	trigger.AuthToken = "secret"
+
+	notification := env.putAndNotify(t, e2eReceivingBucket, "bag1.tar")
+	for _, authorization := range []string{"", "wrong", "Bearer wrong"} {
+		recorder := postNotification(trigger, notification, authorization)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, authorization)
+	}
+	assert.Empty(t, env.findIngestItems(t, "bag1.tar"))
+	for _, authorization := range []string{"secret", "Bearer secret"} {
+		recorder := postNotification(trigger, notification, authorization)
+		assert.Equal(t, http.StatusOK, recorder.Code, authorization)
+	}
+	assert.Equal(t, 1, len(env.findIngestItems(t, "bag1.tar")))
+}
+
+func TestIngestTriggerMultipartBag(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	trigger, err := workers.NewAPTIngestTrigger(env.Context)
+	require.Nil(t, err)
+
+	// Nothing to do until all the parts are here.
+	notification := env.putAndNotify(t, e2eReceivingBucket, "my_bag.b02.of02.tar")
+	recorder := postNotification(trigger, notification, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, env.Published)
+
+	notification = env.putAndNotify(t, e2eReceivingBucket, "my_bag.b01.of02.tar")
+	recorder = postNotification(trigger, notification, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	items := env.findIngestItems(t, "my_bag.b01.of02.tar")
+	require.Equal(t, 1, len(items))
+	assert.EqualValues(t, len("Contents of my_bag.b01.of02.tar")*2, items[0].Size)
+	env.assertPublished(t, env.Context.Config.FetchWorker.NsqTopic, items[0].Id)
+}
+
+func TestIngestTriggerRunQueue(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	trigger, err := workers.NewAPTIngestTrigger(env.Context)
+	require.Nil(t, err)
+	queue, err := network.NewLocalEventQueue(filepath.Join(env.TempDir, "events"))
+	require.Nil(t, err)
+	queue.PollInterval = 10 * time.Millisecond
+
+	notification := env.putAndNotify(t, e2eReceivingBucket, "bag1.tar")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(queue.Directory, "001.json"),
+		[]byte(notification), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(queue.Directory, "002.json"),
+		[]byte("This isn't JSON"), 0644))
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	done := make(chan struct{})
+	go func() {
+		trigger.RunQueue(ctx, queue)
+		close(done)
+	}()
+	items := env.findIngestItems(t, "bag1.tar")
+	for i := 0; i < 100 && len(items) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		items = env.findIngestItems(t, "bag1.tar")
+	}
+	require.Equal(t, 1, len(items))
+	env.assertPublished(t, env.Context.Config.FetchWorker.NsqTopic, items[0].Id)
+	cancel()
+	<-done
+
+	// Both messages are gone: one was processed, and one
+	// will never make sense.
+	files, err := ioutil.ReadDir(queue.Directory)
+	require.Nil(t, err)
+	assert.Empty(t, files)
+
+	// Messages we couldn't process stay in the queue.
+	env.NsqServer.Close()
+	notification = env.putAndNotify(t, e2eReceivingBucket, "bag2.tar")
+	messagePath := filepath.Join(queue.Directory, "003.json")
+	require.Nil(t, ioutil.WriteFile(messagePath, []byte(notification), 0644))
+	ctx, cancel = gocontext.WithTimeout(gocontext.Background(), 200*time.Millisecond)
+	defer cancel()
+	trigger.RunQueue(ctx, queue)
+	_, err = os.Stat(messagePath)
+	assert.Nil(t, err)
+}
+
+// If the trigger and the bucket reader both create a WorkItem for
+// the same bag, the fetcher should cancel the newer one.
+func TestIngestTriggerDuplicateWorkItem(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	item1 := env.queueIngest(t)
+	item2 := env.queueIngest(t)
+	require.Equal(t, item1.ETag, item2.ETag)
+
+	fetcher := workers.NewAPTFetcher(env.Context)
+	require.Nil(t, fetcher.HandleMessage(e2eMessage(item2.Id)))
+	item := env.waitForCompletion(t, item2.Id)
+	assert.Equal(t, constants.StatusCancelled, item.Status)
+	assert.Contains(t, item.Note, fmt.Sprintf("WorkItem %d is already ingesting", item1.Id))
+
+	// The older WorkItem goes ahead.
+	env.fetch(t, item1)
+}
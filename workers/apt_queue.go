@@ -15,7 +15,7 @@ const UNKNOWN_TOPIC = "unknown_topic"
 
 type APTQueue struct {
 	Context      *context.Context
-	NSQClient    *network.NSQClient
+	Queue        network.Queue
 	topic        string
 	stats        *stats.APTQueueStats
 	dryRun       bool
@@ -38,10 +38,9 @@ func NewAPTQueue(_context *context.Context, topic string, enableStats, dryRun bo
 		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
 	}
 
-	nsqClient := network.NewNSQClient(_context.Config.NsqdHttpAddress)
 	aptQueue := &APTQueue{
 		Context:      _context,
-		NSQClient:    nsqClient,
+		Queue:        _context.Queue,
 		topic:        topic,
 		statsEnabled: enableStats,
 		dryRun:       dryRun,
@@ -61,25 +60,28 @@ func (aptQueue *APTQueue) Run() {
 	params.Set("status", constants.StatusPending)
 	params.Set("retry", "true")
 	params.Set("node_empty", "true")
-	params.Set("page", "1")
 	params.Set("per_page", "100")
-	for {
-		resp := aptQueue.Context.PharosClient.WorkItemList(params)
-		aptQueue.Context.MessageLog.Info("GET %s", resp.Request.URL)
-		if resp.Error != nil {
-			aptQueue.recordError(
-				"Error getting WorkItem list from Pharos: %s",
-				resp.Error)
+	// No prefetch, because marking items as queued changes
+	// which items are on the following pages.
+	iterator := aptQueue.Context.PharosClient.WorkItemIterator(params, false)
+	defer iterator.Close()
+	for iterator.Next() {
+		item := iterator.WorkItem()
+		if !aptQueue.addToNSQ(item) {
+			continue
 		}
-		for _, item := range resp.WorkItems() {
-			if aptQueue.addToNSQ(item) {
-				aptQueue.markAsQueued(item)
-			}
+		err := aptQueue.markAsQueued(item)
+		if network.IsPharosUnavailable(err) {
+			// Items we queue now can't be marked as queued, so the
+			// next run would queue them again. Stop here instead.
+			aptQueue.recordError("Stopping because Pharos is unavailable")
+			return
 		}
-		if resp.HasNextPage() == false {
-			break
-		}
-		params = resp.ParamsForNextPage()
+	}
+	if iterator.Err() != nil {
+		aptQueue.recordError(
+			"Error getting WorkItem list from Pharos: %s",
+			iterator.Err())
 	}
 }
 
@@ -113,7 +115,7 @@ func (aptQueue *APTQueue) addToNSQ(workItem *models.WorkItem) bool {
 			workItem.Stage, workItem.Status, topic)
 		return false
 	}
-	err := aptQueue.NSQClient.Enqueue(topic, workItem.Id)
+	err := aptQueue.Queue.Enqueue(topic, workItem.Id)
 	if err != nil {
 		aptQueue.recordError("Error sending WorkItem %d %s (%s/%s/%s) - to %s: %v",
 			workItem.Id, identifier, workItem.Action,
@@ -128,7 +130,9 @@ func (aptQueue *APTQueue) addToNSQ(workItem *models.WorkItem) bool {
 	return true
 }
 
-func (aptQueue *APTQueue) markAsQueued(workItem *models.WorkItem) *models.WorkItem {
+// markAsQueued tells Pharos that workItem is in the queue. It returns
+// the Pharos error, if there was one, after logging it.
+func (aptQueue *APTQueue) markAsQueued(workItem *models.WorkItem) error {
 	utcNow := time.Now().UTC()
 	workItem.Date = utcNow
 	workItem.QueuedAt = &utcNow
@@ -136,30 +140,14 @@ func (aptQueue *APTQueue) markAsQueued(workItem *models.WorkItem) *models.WorkIt
 	if resp.Error != nil {
 		aptQueue.recordError("Error setting QueuedAt for WorkItem with id %d: %v",
 			workItem.Id, resp.Error)
-		return nil
-	}
-	if resp.Response.StatusCode != 200 {
-		aptQueue.processPharosError(resp)
-		return nil
+		return resp.Error
 	}
 	aptQueue.Context.MessageLog.Info("Marked WorkItem id %d (%s/%s/%s) as queued in Pharos",
 		workItem.Id, workItem.Action, workItem.Stage, workItem.Status)
 	if aptQueue.stats != nil {
 		aptQueue.stats.AddItemMarkedAsQueued(workItem)
 	}
-	return resp.WorkItem()
-}
-
-func (aptQueue *APTQueue) processPharosError(resp *network.PharosResponse) {
-	respBody := ""
-	bytesRead, aptQueuer := resp.RawResponseData()
-	if aptQueuer == nil {
-		respBody = string(bytesRead)
-	} else {
-		respBody = fmt.Sprintf("[Could not read response body: %v]", aptQueuer)
-	}
-	aptQueue.recordError("%s %s returned status code %d. Response body: %s",
-		resp.Request.Method, resp.Request.URL, resp.Response.StatusCode, respBody)
+	return nil
 }
 
 func (aptQueue *APTQueue) recordError(format string, a ...interface{}) {
@@ -14,7 +14,7 @@ import (
 
 type APTQueueFixity struct {
 	Context        *context.Context
-	NSQClient      *network.NSQClient
+	Queue          network.Queue
 	maxFiles       int
 	identifierLike string
 	nsqTopic       string
@@ -27,7 +27,6 @@ type APTQueueFixity struct {
 // to select files we know exist.
 func NewAPTQueueFixity(_context *context.Context, identifierLike string, maxFiles int) *APTQueueFixity {
 	_context.MessageLog.Info("NSQ address: %s", _context.Config.NsqdHttpAddress)
-	nsqClient := network.NewNSQClient(_context.Config.NsqdHttpAddress)
 
 	// Patch for https://trello.com/c/Ep4pKzZB
 	err := CacheBucketNames(_context)
@@ -37,7 +36,7 @@ func NewAPTQueueFixity(_context *context.Context, identifierLike string, maxFile
 
 	aptQueue := &APTQueueFixity{
 		Context:        _context,
-		NSQClient:      nsqClient,
+		Queue:          _context.Queue,
 		maxFiles:       maxFiles,
 		identifierLike: identifierLike,
 		nsqTopic:       _context.Config.FixityWorker.NsqTopic,
@@ -67,7 +66,6 @@ func (aptQueue *APTQueueFixity) Run() {
 	params.Set("not_checked_since", sinceWhen.Format(time.RFC3339))
 	params.Set("per_page", strconv.Itoa(perPage))
 	params.Set("storage_option", constants.StorageStandard)
-	params.Set("page", "1")
 	params.Set("sort", "last_fixity_check") // takes advantage of SQL index
 	if aptQueue.identifierLike != "" {
 		params.Set("identifier_like", aptQueue.identifierLike)
@@ -75,28 +73,22 @@ func (aptQueue *APTQueueFixity) Run() {
 			"Queuing only files whose identifier contains %s",
 			aptQueue.identifierLike)
 	}
-	for {
-		resp := aptQueue.Context.PharosClient.GenericFileList(params)
-		aptQueue.Context.MessageLog.Info("GET %s", resp.Request.URL)
-		if resp.Error != nil {
-			aptQueue.Context.MessageLog.Error(
-				"Error getting GenericFile list from Pharos: %s",
-				resp.Error)
+	iterator := aptQueue.Context.PharosClient.GenericFileIterator(params, false)
+	defer iterator.Close()
+	for itemsAdded < aptQueue.maxFiles && iterator.Next() {
+		if aptQueue.addToNSQ(iterator.GenericFile()) {
+			itemsAdded += 1
 		}
-		for _, gf := range resp.GenericFiles() {
-			if aptQueue.addToNSQ(gf) {
-				itemsAdded += 1
-			}
-		}
-		if resp.HasNextPage() == false || itemsAdded >= aptQueue.maxFiles {
-			break
-		}
-		params = resp.ParamsForNextPage()
+	}
+	if iterator.Err() != nil {
+		aptQueue.Context.MessageLog.Error(
+			"Error getting GenericFile list from Pharos: %s",
+			iterator.Err())
 	}
 }
 
 func (aptQueue *APTQueueFixity) addToNSQ(gf *models.GenericFile) bool {
-	err := aptQueue.NSQClient.EnqueueString(aptQueue.nsqTopic, gf.Identifier)
+	err := aptQueue.Queue.EnqueueString(aptQueue.nsqTopic, gf.Identifier)
 	if err != nil {
 		aptQueue.Context.MessageLog.Error("Error sending '%s' to %s: %v",
 			gf.Identifier, aptQueue.nsqTopic, err)
@@ -1,14 +1,13 @@
 package workers
 
 import (
+	gocontext "context"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util/storage"
-	"github.com/nsqio/go-nsq"
-	"os"
 	"strings"
 	"time"
 )
@@ -25,11 +24,13 @@ type APTRecorder struct {
 	Context        *context.Context
 	RecordChannel  chan *models.IngestState
 	CleanupChannel chan *models.IngestState
+	InFlight       *InFlightRegistry
 }
 
 func NewAPTRecorder(_context *context.Context) *APTRecorder {
 	recorder := &APTRecorder{
-		Context: _context,
+		Context:  _context,
+		InFlight: NewInFlightRegistry(),
 	}
 
 	// Patch for https://trello.com/c/Ep4pKzZB
@@ -51,13 +52,26 @@ func NewAPTRecorder(_context *context.Context) *APTRecorder {
 }
 
 // This is the callback that NSQ workers use to handle messages from NSQ.
-func (recorder *APTRecorder) HandleMessage(message *nsq.Message) error {
+func (recorder *APTRecorder) HandleMessage(message models.QueueMessage) error {
 	log := recorder.Context.MessageLog
 	ingestState, err := GetIngestState(message, recorder.Context, false)
 	if err != nil {
 		recorder.Context.MessageLog.Error(err.Error())
 		return err
 	}
+	if !recorder.InFlight.Add(message, func() {
+		checkpointIngestState(ingestState, recorder.Context, ingestState.IngestManifest.RecordResult)
+	}) {
+		return nil
+	}
+	// Once the item goes into the record channel, cleanup() says
+	// when we're done with it.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			recorder.InFlight.Done(message)
+		}
+	}()
 
 	// Skip this if it's already being worked on.
 	if ingestState.WorkItem.IsInProgress() {
@@ -85,19 +99,28 @@ func (recorder *APTRecorder) HandleMessage(message *nsq.Message) error {
 	recorder.Context.MessageLog.Info("Putting %s/%s into record channel",
 		ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key)
 
+	handedOff = true
 	recorder.RecordChannel <- ingestState
 
 	// Return no error, so NSQ knows we're OK.
 	return nil
 }
 
+// CheckpointAndRequeue saves the state of all in-flight items to
+// Pharos and requeues them. Call this when the process is shutting down.
+func (recorder *APTRecorder) CheckpointAndRequeue() {
+	recorder.InFlight.CheckpointAndRequeue()
+}
+
 // Step 1: Record data in Pharos
 func (recorder *APTRecorder) record() {
 	for ingestState := range recorder.RecordChannel {
 		ingestState.IngestManifest.RecordResult.Start()
 		ingestState.IngestManifest.RecordResult.Attempted = true
 		ingestState.IngestManifest.RecordResult.AttemptNumber += 1
-		recorder.saveAllPharosData(ingestState)
+		ctx, cancel := recorder.InFlight.StageContext(ingestState.Message, recorder.Context.Config.RecordWorker)
+		recorder.saveAllPharosData(ctx, ingestState)
+		cancel()
 		recorder.CleanupChannel <- ingestState
 	}
 }
@@ -111,13 +134,21 @@ func (recorder *APTRecorder) cleanup() {
 		itsTimeToGiveUp := (ingestState.IngestManifest.HasFatalErrors() ||
 			(ingestState.IngestManifest.HasErrors() && attemptNumber >= maxAttempts))
 
+		// If we're shutting down, errors are probably from cancelled
+		// requests. Don't count them as an attempt. CheckpointAndRequeue
+		// saves the state and requeues the message.
+		if recorder.InFlight.Stopping() && ingestState.IngestManifest.RecordResult.HasErrors() {
+			recorder.InFlight.Done(ingestState.Message)
+			continue
+		}
+
 		if itsTimeToGiveUp {
 			recorder.logFailure(ingestState)
-			ingestState.FinishNSQ()
+			ingestState.FinishMessage()
 			MarkWorkItemFailed(ingestState, recorder.Context)
 		} else if ingestState.IngestManifest.RecordResult.HasErrors() {
 			recorder.logRequeue(ingestState)
-			ingestState.RequeueNSQ(1000)
+			ingestState.RequeueMessage(1000)
 			MarkWorkItemRequeued(ingestState, recorder.Context)
 		} else {
 			MarkWorkItemStarted(ingestState, recorder.Context, constants.StageCleanup,
@@ -129,19 +160,20 @@ func (recorder *APTRecorder) cleanup() {
 			recorder.deleteBagFromReceivingBucket(ingestState)
 
 			// Remove both the bag and the validation DB (unless we're running integration tests)
-			DeleteFileFromStaging(ingestState.IngestManifest.BagPath, recorder.Context)
+			DeleteBagFromStaging(ingestState.IngestManifest, recorder.Context)
 			if recorder.Context.Config.DeleteOnSuccess == true {
 				DeleteFileFromStaging(ingestState.IngestManifest.DBPath, recorder.Context)
 			}
 
 			MarkWorkItemSucceeded(ingestState, recorder.Context, constants.StageCleanup)
-			ingestState.FinishNSQ()
+			ingestState.FinishMessage()
 		}
 
 		// Save our WorkItemState
 		ingestState.IngestManifest.RecordResult.Finish()
 		LogJson(ingestState, recorder.Context.JsonLog)
 		RecordWorkItemState(ingestState, recorder.Context, ingestState.IngestManifest.RecordResult)
+		recorder.InFlight.Done(ingestState.Message)
 	}
 }
 
@@ -153,7 +185,7 @@ func (recorder *APTRecorder) cleanup() {
 // in Pharos and which were not. This was a problem in the old
 // system, where record failured were common, and PREMIS events
 // often wound up being recorded twice.
-func (recorder *APTRecorder) saveAllPharosData(ingestState *models.IngestState) {
+func (recorder *APTRecorder) saveAllPharosData(ctx gocontext.Context, ingestState *models.IngestState) {
 	db, err := storage.NewBoltDB(ingestState.IngestManifest.DBPath)
 	if db == nil {
 		// Happens when a prior worker process is killed,
@@ -187,7 +219,7 @@ func (recorder *APTRecorder) saveAllPharosData(ingestState *models.IngestState)
 
 	// Save the IntellectualObject
 	if ingestState.IngestManifest.Object.Id == 0 {
-		recorder.saveIntellectualObject(ingestState, obj)
+		recorder.saveIntellectualObject(ctx, ingestState, obj)
 		if ingestState.IngestManifest.RecordResult.HasErrors() {
 			recorder.logSaveError(ingestState)
 			return
@@ -205,10 +237,10 @@ func (recorder *APTRecorder) saveAllPharosData(ingestState *models.IngestState)
 		return
 	}
 
-	recorder.saveFiles(ingestState, obj, db)
+	recorder.saveFiles(ctx, ingestState, obj, db)
 }
 
-func (recorder *APTRecorder) saveFiles(ingestState *models.IngestState, obj *models.IntellectualObject, db *storage.BoltDB) {
+func (recorder *APTRecorder) saveFiles(ctx gocontext.Context, ingestState *models.IngestState, obj *models.IntellectualObject, db *storage.BoltDB) {
 	offset := 0
 	for {
 		batch := db.FileIdentifierBatch(offset, GENERIC_FILE_BATCH_SIZE)
@@ -246,8 +278,8 @@ func (recorder *APTRecorder) saveFiles(ingestState *models.IngestState, obj *mod
 		}
 
 		// Save this batch of files in Pharos
-		recorder.createGenericFiles(ingestState, newFiles)
-		recorder.updateGenericFiles(ingestState, existingFiles)
+		recorder.createGenericFiles(ctx, ingestState, newFiles)
+		recorder.updateGenericFiles(ctx, ingestState, existingFiles)
 
 		// Update the GenericFile records in BoltDB
 		recorder.saveGenericFilesInBoltDB(ingestState, db, newFiles)
@@ -261,12 +293,21 @@ func (recorder *APTRecorder) saveFiles(ingestState *models.IngestState, obj *mod
 
 }
 
-func (recorder *APTRecorder) saveIntellectualObject(ingestState *models.IngestState, obj *models.IntellectualObject) {
+func (recorder *APTRecorder) saveIntellectualObject(ctx gocontext.Context, ingestState *models.IngestState, obj *models.IntellectualObject) {
 	// If we're ingesting a new version of a previously ingested bag,
 	// we'll want to update the old record. Otherwise, we'll create a
 	// new one. 99.99% of the time, Pharos will return a 404 here, because
 	// it's a new ingest.
-	resp := recorder.Context.PharosClient.IntellectualObjectGet(obj.Identifier, false, false)
+	pharosClient := recorder.Context.PharosClient.WithContext(ctx)
+	resp := pharosClient.IntellectualObjectGet(obj.Identifier, false, false)
+	if resp.Error != nil && !network.IsPharosNotFound(resp.Error) {
+		// If we can't tell whether the object exists, we might create
+		// a duplicate, so try again later.
+		ingestState.IngestManifest.RecordResult.AddError(
+			"Error checking whether %s is already in Pharos: %v",
+			obj.Identifier, resp.Error)
+		return
+	}
 	existingObject := resp.IntellectualObject()
 	if existingObject != nil {
 		// PharosClient will know to update, rather than create,
@@ -279,9 +320,9 @@ func (recorder *APTRecorder) saveIntellectualObject(ingestState *models.IngestSt
 	// Pharos with State = "D", and now we're re-ingesting a new version of it.
 	obj.State = "A"
 
-	resp = recorder.Context.PharosClient.IntellectualObjectSave(obj)
+	resp = pharosClient.IntellectualObjectSave(obj)
 	if resp.Error != nil {
-		ingestState.IngestManifest.RecordResult.AddError(resp.Error.Error())
+		recorder.addPharosError(ingestState, "Error saving IntellectualObject "+obj.Identifier, resp.Error)
 		return
 	}
 	savedObject := resp.IntellectualObject()
@@ -300,11 +341,27 @@ func (recorder *APTRecorder) saveIntellectualObject(ingestState *models.IngestSt
 	ingestState.IngestManifest.Object.CreatedAt = savedObject.CreatedAt
 	ingestState.IngestManifest.Object.UpdatedAt = savedObject.UpdatedAt
 
-	recorder.savePremisEventsForObject(ingestState, obj)
+	recorder.savePremisEventsForObject(ctx, ingestState, obj)
+}
+
+// addPharosError adds a Pharos error to the RecordResult. Errors that
+// won't go away if we send the same data again, such as validation
+// errors, are fatal. Errors from Pharos being down are not.
+func (recorder *APTRecorder) addPharosError(ingestState *models.IngestState, message string, err error) {
+	pharosErr := network.AsPharosError(err)
+	if pharosErr != nil && pharosErr.ValidationMessage() != "" {
+		ingestState.IngestManifest.RecordResult.AddError("%s: Pharos says %s",
+			message, pharosErr.ValidationMessage())
+	} else {
+		ingestState.IngestManifest.RecordResult.AddError("%s: %v", message, err)
+	}
+	if network.IsPharosFatal(err) {
+		ingestState.IngestManifest.RecordResult.ErrorIsFatal = true
+	}
 }
 
 // createGenericFiles creates new GenericFile records in Pharos
-func (recorder *APTRecorder) createGenericFiles(ingestState *models.IngestState, files []*models.GenericFile) {
+func (recorder *APTRecorder) createGenericFiles(ctx gocontext.Context, ingestState *models.IngestState, files []*models.GenericFile) {
 	if len(files) == 0 {
 		return
 	}
@@ -314,7 +371,7 @@ func (recorder *APTRecorder) createGenericFiles(ingestState *models.IngestState,
 		fileMap[gf.Identifier] = gf
 		identifiers[i] = gf.Identifier
 	}
-	resp := recorder.Context.PharosClient.GenericFileSaveBatch(files)
+	resp := recorder.Context.PharosClient.WithContext(ctx).GenericFileSaveBatch(files)
 	if resp.Error != nil {
 		body, _ := resp.RawResponseData()
 		recorder.Context.MessageLog.Error(
@@ -322,7 +379,7 @@ func (recorder *APTRecorder) createGenericFiles(ingestState *models.IngestState,
 			string(body))
 		recorder.Context.MessageLog.Error(
 			"File identifiers in failed batch:\b%s", strings.Join(identifiers, ", "))
-		ingestState.IngestManifest.RecordResult.AddError(resp.Error.Error())
+		recorder.addPharosError(ingestState, "Error saving batch of GenericFiles", resp.Error)
 	}
 	// We may have managed to save some files despite the error.
 	// If so, record what was saved.
@@ -352,16 +409,16 @@ func (recorder *APTRecorder) createGenericFiles(ingestState *models.IngestState,
 }
 
 // updateGenericFiles updates existing GenericFile records in Pharos
-func (recorder *APTRecorder) updateGenericFiles(ingestState *models.IngestState, files []*models.GenericFile) {
+func (recorder *APTRecorder) updateGenericFiles(ctx gocontext.Context, ingestState *models.IngestState, files []*models.GenericFile) {
 	if len(files) == 0 {
 		return
 	}
+	pharosClient := recorder.Context.PharosClient.WithContext(ctx)
 	for _, gf := range files {
 		clonedGenericFile := CloneWithoutSavedChildren(gf)
-		resp := recorder.Context.PharosClient.GenericFileSave(clonedGenericFile)
+		resp := pharosClient.GenericFileSave(clonedGenericFile)
 		if resp.Error != nil {
-			ingestState.IngestManifest.RecordResult.AddError(
-				"Error updating '%s': %v", gf.Identifier, resp.Error)
+			recorder.addPharosError(ingestState, "Error updating '"+gf.Identifier+"'", resp.Error)
 			continue
 		}
 		// Pick up updated timestamps in response from Pharos.
@@ -372,14 +429,15 @@ func (recorder *APTRecorder) updateGenericFiles(ingestState *models.IngestState,
 }
 
 // savePremisEventsForObject saves the object-level Premis events.
-func (recorder *APTRecorder) savePremisEventsForObject(ingestState *models.IngestState, obj *models.IntellectualObject) {
+func (recorder *APTRecorder) savePremisEventsForObject(ctx gocontext.Context, ingestState *models.IngestState, obj *models.IntellectualObject) {
+	pharosClient := recorder.Context.PharosClient.WithContext(ctx)
 	for i, event := range obj.PremisEvents {
 		if event.Id > 0 {
 			recorder.Context.MessageLog.Info("PremisEvent %d has already been saved", event.Id)
 			continue
 		}
 		event.IntellectualObjectId = obj.Id
-		resp := recorder.Context.PharosClient.PremisEventSave(event)
+		resp := pharosClient.PremisEventSave(event)
 		if resp.Error != nil {
 			method := "??"
 			url := "??"
@@ -400,7 +458,8 @@ func (recorder *APTRecorder) savePremisEventsForObject(ingestState *models.Inges
 }
 
 // deleteBagFromReceivingBucket deletes the original tar file from the
-// depositor's receiving bucket.
+// depositor's receiving bucket. For multipart bags, it deletes all
+// of the parts.
 func (recorder *APTRecorder) deleteBagFromReceivingBucket(ingestState *models.IngestState) {
 	var obj *models.IntellectualObject
 	db, err := storage.NewBoltDB(ingestState.IngestManifest.DBPath)
@@ -449,22 +508,21 @@ func (recorder *APTRecorder) deleteBagFromReceivingBucket(ingestState *models.In
 		ingestState.IngestManifest.CleanupResult.Finish()
 		return
 	}
-	deleter := network.NewS3ObjectDelete(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		constants.AWSVirginia,
-		ingestState.IngestManifest.S3Bucket,
-		[]string{ingestState.IngestManifest.S3Key})
-	deleter.DeleteList()
-	if deleter.ErrorMessage != "" {
-		message := fmt.Sprintf("In cleanup, error deleting S3 item %s/%s: %s",
-			ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key,
-			deleter.ErrorMessage)
+	backend := recorder.Context.StorageBackend(constants.AWSVirginia)
+	keys := []string{ingestState.IngestManifest.S3Key}
+	if IsMultipartBag(ingestState.WorkItem) {
+		keys = recorder.bagPartKeys(ingestState)
+	}
+	err = backend.Delete(ingestState.IngestManifest.S3Bucket, keys...)
+	if err != nil {
+		message := fmt.Sprintf("In cleanup, error deleting S3 item %s/%s: %v",
+			ingestState.IngestManifest.S3Bucket, strings.Join(keys, ", "),
+			err)
 		recorder.Context.MessageLog.Warning(message)
 		ingestState.IngestManifest.CleanupResult.AddError(message)
 	} else {
 		message := fmt.Sprintf("Deleted S3 item %s/%s",
-			ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key)
+			ingestState.IngestManifest.S3Bucket, strings.Join(keys, ", "))
 		recorder.Context.MessageLog.Info(message)
 		if obj != nil {
 			obj.IngestDeletedFromReceivingAt = time.Now().UTC()
@@ -519,28 +577,33 @@ func (recorder *APTRecorder) saveGenericFilesInBoltDB(ingestState *models.Ingest
 // Part of https://trello.com/c/GLURkoKW
 func (recorder *APTRecorder) bucketVersionMatchesCurrentVersion(ingestState *models.IngestState) bool {
 	eTagMatches := false
-	s3ObjectList := network.NewS3ObjectList(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		constants.AWSVirginia,
+	backend := recorder.Context.StorageBackend(constants.AWSVirginia)
+	if IsMultipartBag(ingestState.WorkItem) {
+		bag, err := ListBagParts(backend, ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key)
+		if err != nil {
+			recorder.Context.MessageLog.Warning(err.Error())
+			return false
+		}
+		return bag.ETag() == ingestState.WorkItem.ETag
+	}
+	objects, err := backend.List(
 		ingestState.IngestManifest.S3Bucket,
-		int64(100),
-	)
-	s3ObjectList.GetList(ingestState.IngestManifest.S3Key)
+		ingestState.IngestManifest.S3Key,
+		int64(100))
 
-	if s3ObjectList.ErrorMessage != "" {
+	if err != nil {
 		recorder.Context.MessageLog.Warning(
-			"Error checking receiving bucket %s for key %s: %s",
+			"Error checking receiving bucket %s for key %s: %v",
 			ingestState.IngestManifest.S3Bucket,
 			ingestState.IngestManifest.S3Key,
-			s3ObjectList.ErrorMessage)
+			err)
 	}
 	// There can really only be one object with this key,
 	// but we loop in case someone uploaded an object whose
 	// name starts with this key.
-	for _, s3Object := range s3ObjectList.Response.Contents {
-		if *s3Object.Key == ingestState.IngestManifest.S3Key &&
-			strings.Replace(*s3Object.ETag, "\"", "", -1) == ingestState.WorkItem.ETag {
+	for _, storageObj := range objects {
+		if storageObj.Key == ingestState.IngestManifest.S3Key &&
+			storageObj.ETag == ingestState.WorkItem.ETag {
 			eTagMatches = true
 			break
 		}
@@ -548,6 +611,24 @@ func (recorder *APTRecorder) bucketVersionMatchesCurrentVersion(ingestState *mod
 	return eTagMatches
 }
 
+// bagPartKeys returns the keys of all parts of a multipart bag
+// in the receiving bucket.
+func (recorder *APTRecorder) bagPartKeys(ingestState *models.IngestState) []string {
+	keys := []string{ingestState.IngestManifest.S3Key}
+	backend := recorder.Context.StorageBackend(constants.AWSVirginia)
+	bag, err := ListBagParts(backend, ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key)
+	if err != nil {
+		recorder.Context.MessageLog.Warning(err.Error())
+		return keys
+	}
+	for _, part := range bag.SortedParts() {
+		if part.Key != ingestState.IngestManifest.S3Key {
+			keys = append(keys, part.Key)
+		}
+	}
+	return keys
+}
+
 // CloneWithoutSavedChildren returns a clone of the GenericFile,
 // minus any Checksums and PremisEvents that have already been
 // saved to Pharos. Items saved to Pharos have a non-zero numeric
@@ -1,6 +1,7 @@
 package workers
 
 import (
+	gocontext "context"
 	"encoding/json"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
@@ -11,13 +12,11 @@ import (
 	"github.com/APTrust/exchange/util"
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/validation"
-	"github.com/nsqio/go-nsq"
 	"io"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -47,11 +46,15 @@ type APTRestorer struct {
 	// config directory. It describes what constitutes a valid
 	// APTrust bag.
 	BagValidationConfig *validation.BagValidationConfig
+	// InFlight tracks the messages we're working on, so we can
+	// checkpoint and requeue them when the process shuts down.
+	InFlight *InFlightRegistry
 }
 
 func NewAPTRestorer(_context *context.Context) *APTRestorer {
 	restorer := &APTRestorer{
-		Context: _context,
+		Context:  _context,
+		InFlight: NewInFlightRegistry(),
 	}
 
 	// Patch for https://trello.com/c/Ep4pKzZB
@@ -79,7 +82,7 @@ func NewAPTRestorer(_context *context.Context) *APTRestorer {
 }
 
 // This is the callback that NSQ workers use to handle messages from NSQ.
-func (restorer *APTRestorer) HandleMessage(message *nsq.Message) error {
+func (restorer *APTRestorer) HandleMessage(message models.QueueMessage) error {
 	// Build the RestoreState object by fetching WorkItem and IntellectualObject
 	// from Pharos.
 	restoreState, err := restorer.buildState(message)
@@ -103,6 +106,10 @@ func (restorer *APTRestorer) HandleMessage(message *nsq.Message) error {
 		return nil
 	}
 
+	if !restorer.InFlight.Add(message, func() { restorer.checkpoint(restoreState) }) {
+		return nil
+	}
+
 	// Disable auto response, so we can tell NSQ when we need to
 	// that we're still working on this item.
 	message.DisableAutoResponse()
@@ -141,9 +148,31 @@ func (restorer *APTRestorer) HandleMessage(message *nsq.Message) error {
 	return nil
 }
 
+// CheckpointAndRequeue saves the state of all in-flight restorations
+// to Pharos and requeues them. Call this when the process is shutting down.
+func (restorer *APTRestorer) CheckpointAndRequeue() {
+	restorer.InFlight.CheckpointAndRequeue()
+}
+
+// checkpoint saves the state of an in-flight restoration and resets
+// the WorkItem, so the next worker to get the message can resume
+// where this one left off.
+func (restorer *APTRestorer) checkpoint(restoreState *models.RestoreState) {
+	restorer.Context.MessageLog.Info("Checkpointing WorkItem %d (%s) for shutdown",
+		restoreState.WorkItem.Id, restoreState.WorkItem.ObjectIdentifier)
+	restoreState.WorkItem.Date = time.Now().UTC()
+	restoreState.WorkItem.Status = constants.StatusPending
+	restoreState.WorkItem.Note = MSG_SHUTDOWN_REQUEUE
+	restoreState.WorkItem.Node = ""
+	restoreState.WorkItem.Pid = 0
+	restoreState.WorkItem.StageStartedAt = nil
+	restorer.saveWorkItem(restoreState)
+	restorer.saveWorkItemState(restoreState)
+}
+
 func (restorer *APTRestorer) buildBag() {
 	for restoreState := range restorer.PackageChannel {
-		restoreState.TouchNSQ()
+		restoreState.TouchMessage()
 		restoreState.PackageSummary.Attempted = true
 		restoreState.PackageSummary.AttemptNumber += 1
 		restoreState.PackageSummary.Start()
@@ -155,17 +184,20 @@ func (restorer *APTRestorer) buildBag() {
 			restorer.PostProcessChannel <- restoreState
 			continue
 		}
-		restoreState.TouchNSQ()
+		restoreState.TouchMessage()
 
-		// Write info files and  md5 and sha256 manifests
+		// Write info files and manifests. We always write md5 and
+		// sha256 manifests, plus sha1 and sha512 manifests if we
+		// have those checksums for all of the files.
 		restorer.writeAPTrustInfoFile(restoreState)
 		restorer.writeBagitFile(restoreState)
 		restorer.writeBagInfoFile(restoreState)
 		restorer.WritePremisEventFile(restoreState)
-		restorer.writeManifest(constants.PAYLOAD_MANIFEST, constants.AlgMd5, restoreState)
-		restorer.writeManifest(constants.PAYLOAD_MANIFEST, constants.AlgSha256, restoreState)
-		restorer.writeManifest(constants.TAG_MANIFEST, constants.AlgMd5, restoreState)
-		restorer.writeManifest(constants.TAG_MANIFEST, constants.AlgSha256, restoreState)
+		for _, manifestType := range []string{constants.PAYLOAD_MANIFEST, constants.TAG_MANIFEST} {
+			for _, alg := range restorer.manifestAlgorithms(manifestType, restoreState) {
+				restorer.writeManifest(manifestType, alg, restoreState)
+			}
+		}
 
 		// Now that the heavy work is done, see if any errors
 		// occured anywhere along the line.
@@ -173,7 +205,7 @@ func (restorer *APTRestorer) buildBag() {
 			restorer.PostProcessChannel <- restoreState
 			continue
 		}
-		restoreState.TouchNSQ()
+		restoreState.TouchMessage()
 
 		// Tar the bag.
 		restorer.tarBag(restoreState)
@@ -181,7 +213,7 @@ func (restorer *APTRestorer) buildBag() {
 			restorer.PostProcessChannel <- restoreState
 			continue
 		}
-		restoreState.TouchNSQ()
+		restoreState.TouchMessage()
 
 		// Done with packaging. On to validation...
 		restoreState.PackageSummary.Finish()
@@ -193,7 +225,7 @@ func (restorer *APTRestorer) buildBag() {
 
 func (restorer *APTRestorer) validateBag() {
 	for restoreState := range restorer.ValidateChannel {
-		restoreState.TouchNSQ()
+		restoreState.TouchMessage()
 		restoreState.ValidateSummary.Attempted = true
 		restoreState.ValidateSummary.AttemptNumber += 1
 		restoreState.ValidateSummary.Start()
@@ -223,7 +255,7 @@ func (restorer *APTRestorer) validateBag() {
 			}
 		}
 		restoreState.ValidateSummary.Finish()
-		restoreState.TouchNSQ()
+		restoreState.TouchMessage()
 		if restoreState.ValidateSummary.HasErrors() {
 			restorer.Context.MessageLog.Info("Putting %s into PostProcess channel",
 				restoreState.WorkItem.ObjectIdentifier)
@@ -238,11 +270,13 @@ func (restorer *APTRestorer) validateBag() {
 
 func (restorer *APTRestorer) copyToRestorationBucket() {
 	for restoreState := range restorer.CopyChannel {
-		restoreState.TouchNSQ()
+		restoreState.TouchMessage()
 		restoreState.CopySummary.Attempted = true
 		restoreState.CopySummary.AttemptNumber += 1
 		restoreState.CopySummary.Start()
-		restorer.uploadBag(restoreState)
+		ctx, cancel := restorer.InFlight.StageContext(restoreState.Message, restorer.Context.Config.RestoreWorker)
+		restorer.uploadBag(ctx, restoreState)
+		cancel()
 		restoreState.CopySummary.Finish()
 		restorer.PostProcessChannel <- restoreState
 	}
@@ -250,12 +284,20 @@ func (restorer *APTRestorer) copyToRestorationBucket() {
 
 func (restorer *APTRestorer) postProcess() {
 	for restoreState := range restorer.PostProcessChannel {
+		// If we're shutting down, errors are probably from cancelled
+		// downloads or uploads. Don't count them as an attempt.
+		// CheckpointAndRequeue saves the state and requeues the message.
+		if restorer.InFlight.Stopping() && restoreState.HasErrors() {
+			restorer.InFlight.Done(restoreState.Message)
+			continue
+		}
 		// Mark item completed in Pharos and finish NSQ.
 		if restoreState.HasErrors() {
 			restorer.finishWithError(restoreState)
 		} else {
 			restorer.finishWithSuccess(restoreState)
 		}
+		restorer.InFlight.Done(restoreState.Message)
 	}
 }
 
@@ -324,12 +366,12 @@ func (restorer *APTRestorer) finishWithError(restoreState *models.RestoreState)
 	if mostRecentSummary.ErrorIsFatal {
 		restorer.Context.MessageLog.Error("Error for %s is fatal",
 			restoreState.WorkItem.ObjectIdentifier)
-		restoreState.NSQMessage.Finish()
+		restoreState.Message.Finish()
 	} else {
 		restorer.Context.MessageLog.Info("Requeuing WorkItem %d (%s)",
 			restoreState.WorkItem.Id,
 			restoreState.WorkItem.ObjectIdentifier)
-		restoreState.NSQMessage.Requeue(1 * time.Minute)
+		restoreState.Message.Requeue(1 * time.Minute)
 	}
 }
 
@@ -368,7 +410,7 @@ func (restorer *APTRestorer) finishWithSuccess(restoreState *models.RestoreState
 	// }
 
 	// Tell NSQ we're done storing this.
-	restoreState.NSQMessage.Finish()
+	restoreState.Message.Finish()
 }
 
 func (restorer *APTRestorer) deleteFiles(restoreState *models.RestoreState) {
@@ -406,20 +448,14 @@ func (restorer *APTRestorer) deleteBagDir(restoreState *models.RestoreState) {
 	}
 }
 
-func (restorer *APTRestorer) uploadBag(restoreState *models.RestoreState) {
+func (restorer *APTRestorer) uploadBag(ctx gocontext.Context, restoreState *models.RestoreState) {
 	// Each institution has its own restoration bucket.
 	restorationBucket := util.RestorationBucketFor(restoreState.IntellectualObject.Institution,
 		restorer.Context.Config.RestoreToTestBuckets)
 	s3Key := fmt.Sprintf("%s.tar", restoreState.IntellectualObject.BagName)
 	restorer.Context.MessageLog.Info("Uploading %s to %s/%s",
 		restoreState.LocalTarFile, restorationBucket, s3Key)
-	upload := network.NewS3Upload(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		constants.AWSVirginia,
-		restorationBucket,
-		s3Key,
-		"application/x-tar")
+	backend := restorer.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx)
 
 	// Open a reader for the tarred bag.
 	reader, err := os.Open(restoreState.LocalTarFile)
@@ -433,21 +469,21 @@ func (restorer *APTRestorer) uploadBag(restoreState *models.RestoreState) {
 	}
 
 	// Send the tarred bag to the depositor's restoration bucket.
-	upload.Send(reader)
-	if upload.ErrorMessage != "" {
+	url, err := backend.Put(restorationBucket, s3Key, "application/x-tar", nil, reader, 0)
+	if err != nil {
 		restoreState.CopySummary.AddError("Error uploading tar file %s: %s",
-			restoreState.LocalTarFile, upload.ErrorMessage)
+			restoreState.LocalTarFile, err.Error())
 		return
 	}
-	restoreState.RestoredToUrl = upload.Response.Location
+	restoreState.RestoredToUrl = url
 	restoreState.CopiedToRestorationAt = time.Now().UTC()
 }
 
 // buildState builds the RestoreState object, which keeps track of which
 // parts of the restore operation have been completed.
-func (restorer *APTRestorer) buildState(message *nsq.Message) (*models.RestoreState, error) {
+func (restorer *APTRestorer) buildState(message models.QueueMessage) (*models.RestoreState, error) {
 	restoreState := models.NewRestoreState(message)
-	restorer.Context.MessageLog.Info("Asking Pharos for WorkItem %s", string(message.Body))
+	restorer.Context.MessageLog.Info("Asking Pharos for WorkItem %s", string(message.Body()))
 	workItem, err := GetWorkItem(message, restorer.Context)
 	if err != nil {
 		return nil, err
@@ -716,26 +752,17 @@ func (restorer *APTRestorer) addFile(restoreState *models.RestoreState, absPath,
 	gf := models.NewGenericFile()
 	gf.IntellectualObjectIdentifier = restoreState.IntellectualObject.Identifier
 	gf.Identifier = fmt.Sprintf("%s/%s", restoreState.IntellectualObject.Identifier, relativePath)
-	md5, err := fileutil.CalculateChecksum(absPath, constants.AlgMd5)
-	if err != nil {
-		restoreState.PackageSummary.AddError("Can't get md5 digest of %s: %v", absPath, err)
-	}
-	sha256, err := fileutil.CalculateChecksum(absPath, constants.AlgSha256)
-	if err != nil {
-		restoreState.PackageSummary.AddError("Can't get sha256 digest of %s: %v", absPath, err)
-	}
-	checksumMd5 := &models.Checksum{
-		Algorithm: constants.AlgMd5,
-		Digest:    md5,
-		DateTime:  time.Now().UTC(),
-	}
-	checksumSha256 := &models.Checksum{
-		Algorithm: constants.AlgSha256,
-		Digest:    sha256,
-		DateTime:  time.Now().UTC(),
+	for _, alg := range constants.ChecksumAlgorithms {
+		digest, err := fileutil.CalculateChecksum(absPath, alg)
+		if err != nil {
+			restoreState.PackageSummary.AddError("Can't get %s digest of %s: %v", alg, absPath, err)
+		}
+		gf.Checksums = append(gf.Checksums, &models.Checksum{
+			Algorithm: alg,
+			Digest:    digest,
+			DateTime:  time.Now().UTC(),
+		})
 	}
-	gf.Checksums = append(gf.Checksums, checksumMd5)
-	gf.Checksums = append(gf.Checksums, checksumSha256)
 	//restorer.Context.MessageLog.Info("ObjIdentifer: %s, gf.OriginalPath: %s",
 	//	restoreState.IntellectualObject.Identifier, gf.OriginalPath())
 
@@ -766,10 +793,36 @@ func (restorer *APTRestorer) addFile(restoreState *models.RestoreState, absPath,
 		gf.Identifier, absPath, relativePath)
 }
 
-// writeManifest writes the manifest-md5.txt file or the manifest-sha256.txt file
-// for this bag.
+// manifestAlgorithms returns the algorithms for which we should write
+// manifests of the specified type. We always write md5 and sha256 manifests.
+// We write sha1 and sha512 manifests only if every file that belongs in the
+// manifest has a checksum for that algorithm. Bags ingested with sha1 or
+// sha512 manifests will have those checksums in Pharos.
+func (restorer *APTRestorer) manifestAlgorithms(manifestType string, restoreState *models.RestoreState) []string {
+	algorithms := []string{constants.AlgMd5, constants.AlgSha256}
+	for _, alg := range []string{constants.AlgSha1, constants.AlgSha512} {
+		allFilesHaveChecksum := false
+		for _, gf := range restoreState.IntellectualObject.GenericFiles {
+			if !restorer.fileBelongsInManifest(gf, manifestType) {
+				continue
+			}
+			if gf.GetChecksumByAlgorithm(alg) == nil {
+				allFilesHaveChecksum = false
+				break
+			}
+			allFilesHaveChecksum = true
+		}
+		if allFilesHaveChecksum {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	return algorithms
+}
+
+// writeManifest writes the manifest (or tag manifest) for the specified
+// algorithm for this bag. E.g. manifest-md5.txt or tagmanifest-sha512.txt.
 func (restorer *APTRestorer) writeManifest(manifestType, algorithm string, restoreState *models.RestoreState) {
-	if algorithm != constants.AlgMd5 && algorithm != constants.AlgSha256 {
+	if !util.StringListContains(constants.ChecksumAlgorithms, algorithm) {
 		restorer.Context.MessageLog.Fatalf("writeManifest: Unsupported algorithm: %s", algorithm)
 	}
 	manifestPath := restorer.getManifestPath(manifestType, algorithm, restoreState)
@@ -870,16 +923,15 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 		return
 	}
 
-	// Set up a downloader to fetch files from S3 long-term storage.
-	downloader := network.NewS3Download(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region,
-		bucket,
-		"",   // s3 key to fetch - to be set below
-		"",   // local path at which to save the s3 file - set below
-		true, // calculate md5 for manifest
-		true) // calculate sha256 for manifest and fixity verification
+	// Fetch files from long-term storage, calculating md5 for the
+	// manifest, and sha256 for the manifest and fixity verification.
+	backend := restorer.Context.StorageBackend(region)
+	algorithms := []string{constants.AlgMd5, constants.AlgSha256}
+
+	// We touch the NSQ message after every few downloads, and each
+	// touch gives us a new deadline.
+	ctx, cancel := restorer.InFlight.StageContext(restoreState.Message, restorer.Context.Config.RestoreWorker)
+	defer func() { cancel() }()
 
 	// Fetch all of the files from S3 to our local bag dir.
 	restorer.Context.MessageLog.Info("Starting fetch. Object %s has %d saved (active) files",
@@ -887,10 +939,6 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 	downloaded := 0
 	alreadyOnDisk := 0
 	for _, gf := range restoreState.IntellectualObject.GenericFiles {
-		downloader.Sha256Digest = ""
-		downloader.Md5Digest = ""
-		downloader.ErrorMessage = ""
-
 		// Except these losers. We don't want them.
 		if gf.State == "D" {
 			restorer.Context.MessageLog.Info("Skipping deleted file %s", gf.Identifier)
@@ -919,10 +967,9 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 			break
 		}
 
-		// Tell the downloader what we're downloading, and where to put it.
-		downloader.KeyName = s3KeyName
+		// Figure out where to put the file.
 		targetPath := gf.OriginalPath()
-		downloader.LocalPath = filepath.Join(restoreState.LocalBagDir, targetPath)
+		localPath := filepath.Join(restoreState.LocalBagDir, targetPath)
 
 		// See if we already have this file on disk. That may be the case if
 		// a recent prior attempt to restore this bag failed with a transient
@@ -930,11 +977,11 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 		// as the one we're fetching. If the file is bad, we'll catch that in the
 		// bag validation step. When bags have tens of thousands of files, or
 		// very large files, we want to avoid re-downloading them.
-		fileStat, err := os.Stat(downloader.LocalPath)
+		fileStat, err := os.Stat(localPath)
 		if err == nil && fileStat.Size() == gf.Size {
 			restorer.Context.MessageLog.Info("File %s is already on disk with size %d, "+
 				"so we won't download it again. Will verify checksum in validation step.",
-				downloader.LocalPath, fileStat.Size())
+				localPath, fileStat.Size())
 			alreadyOnDisk += 1
 			continue
 		}
@@ -942,10 +989,11 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 		// Fetch is the expensive part, so we don't even want to get to this
 		// point if we don't have the info above.
 		restorer.Context.MessageLog.Info("Downloading %s (%s) to %s", gf.Identifier,
-			s3KeyName, downloader.LocalPath)
-		downloader.Fetch()
-		if downloader.ErrorMessage != "" {
-			msg := fmt.Sprintf("Error fetching %s from S3: %s", gf.Identifier, downloader.ErrorMessage)
+			s3KeyName, localPath)
+		_, digests, err := network.DownloadFromStorage(backend.WithContext(ctx), bucket, s3KeyName, localPath, algorithms,
+			network.NewDownloadOptions(restorer.Context.Config.RestoreWorker))
+		if err != nil {
+			msg := fmt.Sprintf("Error fetching %s from S3: %s", gf.Identifier, err.Error())
 			restorer.Context.MessageLog.Error(msg)
 			restoreState.PackageSummary.AddError(msg)
 			break
@@ -953,10 +1001,10 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 
 		// Validate checksums now, so we don't have to re-calculate
 		// them when we create the file manifests.
-		if downloader.Sha256Digest != existingSha256.Digest {
+		if digests[constants.AlgSha256] != existingSha256.Digest {
 			msg := fmt.Sprintf("sha256 digest mismatch for for file %s."+
 				"Our digest: %s. Digest of fetched file: %s",
-				gf.Identifier, existingSha256.Digest, downloader.Sha256Digest)
+				gf.Identifier, existingSha256.Digest, digests[constants.AlgSha256])
 			restorer.Context.MessageLog.Error(msg)
 			restoreState.PackageSummary.AddError(msg)
 			break
@@ -965,7 +1013,9 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 
 		// Touch NSQ every now and then, so we don't time out.
 		if downloaded%10 == 0 {
-			restoreState.TouchNSQ()
+			restoreState.TouchMessage()
+			cancel()
+			ctx, cancel = restorer.InFlight.StageContext(restoreState.Message, restorer.Context.Config.RestoreWorker)
 		}
 	}
 
@@ -1003,31 +1053,26 @@ func (restorer *APTRestorer) WritePremisEventFile(restoreState *models.RestoreSt
 	// Write the open JSON array bracket.
 	io.WriteString(jsonFile, "[")
 
-	var events []*models.PremisEvent
-	hasMoreResults := true
-	pageNumber := 1
+	params := url.Values{}
+	params.Set("object_identifier", restoreState.WorkItem.ObjectIdentifier)
+	params.Set("per_page", "500")
+	iterator := restorer.Context.PharosClient.PremisEventIterator(params, true)
+	defer iterator.Close()
 	eventNumber := 0
 
-	// Keep getting batches, as long as we have more results.
-	for hasMoreResults {
-		events, hasMoreResults, err = restorer.getBatchOfPremisEvents(restoreState, pageNumber)
-		if err != nil {
-			restoreState.PackageSummary.AddError(
-				"Error getting page %d of Premis Events for %s from Pharos: %v",
-				pageNumber, restoreState.WorkItem.ObjectIdentifier, err)
-			break
-		} else {
-			// Stream each event record into the file.
-			for _, event := range events {
-				eventJson, _ := json.MarshalIndent(event, "", "  ")
-				if eventNumber > 0 {
-					io.WriteString(jsonFile, ",\n")
-				}
-				io.WriteString(jsonFile, string(eventJson))
-				eventNumber++
-			}
+	// Stream each event record into the file.
+	for iterator.Next() {
+		eventJson, _ := json.MarshalIndent(iterator.PremisEvent(), "", "  ")
+		if eventNumber > 0 {
+			io.WriteString(jsonFile, ",\n")
 		}
-		pageNumber++
+		io.WriteString(jsonFile, string(eventJson))
+		eventNumber++
+	}
+	if iterator.Err() != nil {
+		restoreState.PackageSummary.AddError(
+			"Error getting Premis Events for %s from Pharos after %d events: %v",
+			restoreState.WorkItem.ObjectIdentifier, eventNumber, iterator.Err())
 	}
 
 	// Closing JSON array bracket.
@@ -1038,26 +1083,6 @@ func (restorer *APTRestorer) WritePremisEventFile(restoreState *models.RestoreSt
 	restorer.addPremisFileChecksums(restoreState)
 }
 
-func (restorer *APTRestorer) getBatchOfPremisEvents(restoreState *models.RestoreState, pageNumber int) ([]*models.PremisEvent, bool, error) {
-	params := url.Values{}
-	params.Set("object_identifier", restoreState.WorkItem.ObjectIdentifier)
-	params.Set("page", strconv.Itoa(pageNumber))
-	params.Set("per_page", "500")
-	resp := restorer.Context.PharosClient.PremisEventList(params)
-	if resp.Error != nil {
-		return nil, false, resp.Error
-	}
-	events := resp.PremisEvents()
-	hasMoreItems := resp.HasNextPage()
-	restorer.Context.MessageLog.Info("Page %d of Premis events for %s returned %d items",
-		pageNumber, restoreState.WorkItem.ObjectIdentifier, len(events))
-	if !hasMoreItems {
-		restorer.Context.MessageLog.Info("Page %d is the last page of Premis events for %s",
-			pageNumber, restoreState.WorkItem.ObjectIdentifier)
-	}
-	return events, hasMoreItems, nil
-}
-
 // addPremisFileChecksums adds the PremisEvents.json file and its checksums
 // to the in-memory version of the IntellectualObject.
 //
@@ -1080,41 +1105,31 @@ func (restorer *APTRestorer) addPremisFileChecksums(restoreState *models.Restore
 		obj.GenericFiles = append(obj.GenericFiles, gf)
 	}
 	restorer.Context.MessageLog.Info("Calculating checksums for %s", premisFile)
-	md5Digest, err := fileutil.CalculateChecksum(premisFile, constants.AlgMd5)
-	if err != nil {
-		restoreState.PackageSummary.AddError(
-			"Error calculating md5 checksum for PremisEvent file %s: %v",
-			premisFile, err)
-		return
-	}
-	sha256Digest, err := fileutil.CalculateChecksum(premisFile, constants.AlgSha256)
-	if err != nil {
-		restoreState.PackageSummary.AddError(
-			"Error calculating sha256 checksum for PremisEvent file %s: %v",
-			premisFile, err)
-		return
+	digests := make(map[string]string)
+	for _, alg := range constants.ChecksumAlgorithms {
+		digest, err := fileutil.CalculateChecksum(premisFile, alg)
+		if err != nil {
+			restoreState.PackageSummary.AddError(
+				"Error calculating %s checksum for PremisEvent file %s: %v",
+				alg, premisFile, err)
+			return
+		}
+		digests[alg] = digest
 	}
 	// If there are any old checksums from a prior aborted run,
 	// we want to clear them out and make sure the CURRENT
 	// checksums are there.
 	gf.Checksums = make([]*models.Checksum, 0)
 	now := time.Now().UTC()
-	md5Checksum := &models.Checksum{
-		Algorithm: constants.AlgMd5,
-		Digest:    md5Digest,
-		DateTime:  now,
-		CreatedAt: now,
-		UpdatedAt: now,
-	}
-	sha256Checksum := &models.Checksum{
-		Algorithm: constants.AlgSha256,
-		Digest:    sha256Digest,
-		DateTime:  now,
-		CreatedAt: now,
-		UpdatedAt: now,
+	for _, alg := range constants.ChecksumAlgorithms {
+		gf.Checksums = append(gf.Checksums, &models.Checksum{
+			Algorithm: alg,
+			Digest:    digests[alg],
+			DateTime:  now,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
 	}
-	gf.Checksums = append(gf.Checksums, md5Checksum)
-	gf.Checksums = append(gf.Checksums, sha256Checksum)
 }
 
 // LogJson dumps the WorkItemState.State into the JSON log, surrounded by
@@ -1,6 +1,7 @@
 package workers
 
 import (
+	gocontext "context"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
@@ -9,10 +10,8 @@ import (
 	"github.com/APTrust/exchange/util"
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/util/storage"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/nsqio/go-nsq"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -44,12 +43,14 @@ type APTStorer struct {
 	CleanupChannel chan *models.IngestState
 	RecordChannel  chan *models.IngestState
 	SyncMap        *models.SynchronizedMap
+	InFlight       *InFlightRegistry
 }
 
 func NewAPTStorer(_context *context.Context) *APTStorer {
 	storer := &APTStorer{
-		Context: _context,
-		SyncMap: models.NewSynchronizedMap(),
+		Context:  _context,
+		SyncMap:  models.NewSynchronizedMap(),
+		InFlight: NewInFlightRegistry(),
 	}
 
 	// Patch for https://trello.com/c/Ep4pKzZB
@@ -73,13 +74,26 @@ func NewAPTStorer(_context *context.Context) *APTStorer {
 }
 
 // This is the callback that NSQ workers use to handle messages from NSQ.
-func (storer *APTStorer) HandleMessage(message *nsq.Message) error {
+func (storer *APTStorer) HandleMessage(message models.QueueMessage) error {
 	log := storer.Context.MessageLog
 	ingestState, err := GetIngestState(message, storer.Context, false)
 	if err != nil {
 		storer.Context.MessageLog.Error(err.Error())
 		return err
 	}
+	if !storer.InFlight.Add(message, func() {
+		checkpointIngestState(ingestState, storer.Context, ingestState.IngestManifest.StoreResult)
+	}) {
+		return nil
+	}
+	// Once the item goes into the storage channel, record() says
+	// when we're done with it.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			storer.InFlight.Done(message)
+		}
+	}()
 
 	// Skip this if it's already being worked on.
 	if ingestState.WorkItem.IsInProgress() {
@@ -107,12 +121,19 @@ func (storer *APTStorer) HandleMessage(message *nsq.Message) error {
 	storer.Context.MessageLog.Info("Putting %s/%s into storage channel",
 		ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key)
 
+	handedOff = true
 	storer.StorageChannel <- ingestState
 
 	// Return no error, so NSQ knows we're OK.
 	return nil
 }
 
+// CheckpointAndRequeue saves the state of all in-flight items to
+// Pharos and requeues them. Call this when the process is shutting down.
+func (storer *APTStorer) CheckpointAndRequeue() {
+	storer.InFlight.CheckpointAndRequeue()
+}
+
 // -------------------------------------------------------------------------
 // Step 1 of 3: Put the item in long-term storage
 //
@@ -223,8 +244,10 @@ func (storer *APTStorer) store() {
 			}
 			fileCount := len(storageSummaries)
 
-			// Save them concurrently...
+			// Save them concurrently. The batch has to finish before
+			// NSQ's timeout, because we touch the message after each one.
 			storer.Context.MessageLog.Info("Saving batch of %d files for %s", fileCount, objIdentifier)
+			ctx, cancel := storer.InFlight.StageContext(ingestState.Message, storer.Context.Config.StoreWorker)
 			wg := sync.WaitGroup{}
 			wg.Add(fileCount)
 			for i := 0; i < fileCount; i++ {
@@ -243,15 +266,16 @@ func (storer *APTStorer) store() {
 
 				go func(storageSummary *models.StorageSummary) {
 					defer wg.Done()
-					storer.saveFile(db, storageSummary)
+					storer.saveFile(ctx, db, storageSummary)
 				}(storageSummaries[i])
 			}
 			wg.Wait()
+			cancel()
 			storer.Context.MessageLog.Info("Finished batch of %d files for %s", fileCount, objIdentifier)
 
 			// Tell NSQ we're still on this. Very large files take a long time
 			// to copy, and if NSQ doesn't hear from us, it'll assume we timed out.
-			ingestState.TouchNSQ()
+			ingestState.TouchMessage()
 
 			// SaveFile and the functions it calls have a pointer to our
 			// GenericFile, so it updates that record directly. However,
@@ -286,13 +310,19 @@ func (storer *APTStorer) store() {
 // -------------------------------------------------------------------------
 func (storer *APTStorer) cleanup() {
 	for ingestState := range storer.CleanupChannel {
-		if ingestState.IngestManifest.StoreResult.HasErrors() == false &&
-			ingestState.IngestManifest.Object.AllFilesSaved() {
+		storedAllFiles := ingestState.IngestManifest.StoreResult.HasErrors() == false &&
+			ingestState.IngestManifest.Object.AllFilesSaved()
+		if storedAllFiles {
 			storer.logDeletingTarFile(ingestState)
 			// Delete the bag (the .tar file) but not the .valdb, because
 			// .valdb contains information about the object, generic files,
 			// and premis events that will be recorded by apt_recorder.
-			DeleteFileFromStaging(ingestState.IngestManifest.BagPath, storer.Context)
+			DeleteBagFromStaging(ingestState.IngestManifest, storer.Context)
+		}
+		// Keep partial uploads around if we're going to retry, so we
+		// can resume them. Otherwise, get rid of them.
+		if storedAllFiles || storer.itsTimeToGiveUp(ingestState) {
+			storer.abortMultipartUploads(ingestState)
 		}
 		storer.RecordChannel <- ingestState
 	}
@@ -315,15 +345,17 @@ func (storer *APTStorer) record() {
 			storer.clearHighResourceBag(objIdentifier)
 		}
 
-		// See if we have fatal errors, or too many recurring transient errors
-		attemptNumber := ingestState.IngestManifest.StoreResult.AttemptNumber
-		maxAttempts := storer.Context.Config.StoreWorker.MaxAttempts
-		itsTimeToGiveUp := (ingestState.IngestManifest.HasFatalErrors() ||
-			(ingestState.IngestManifest.HasErrors() && attemptNumber >= maxAttempts))
+		// If we're shutting down, errors are probably from cancelled
+		// uploads. Don't count them as an attempt. CheckpointAndRequeue
+		// saves the state and requeues the message.
+		if storer.InFlight.Stopping() && ingestState.IngestManifest.StoreResult.HasErrors() {
+			storer.InFlight.Done(ingestState.Message)
+			continue
+		}
 
-		if itsTimeToGiveUp {
+		if storer.itsTimeToGiveUp(ingestState) {
 			storer.logFailedToStore(ingestState)
-			ingestState.FinishNSQ()
+			ingestState.FinishMessage()
 			MarkWorkItemFailed(ingestState, storer.Context)
 		} else if ingestState.IngestManifest.StoreResult.HasErrors() {
 			timeout := 30000 // thirty seconds
@@ -332,20 +364,30 @@ func (storer *APTStorer) record() {
 				timeout = RESOURCE_REQUEUE_TIMEOUT
 			}
 			storer.logRequeued(ingestState)
-			ingestState.RequeueNSQ(timeout)
+			ingestState.RequeueMessage(timeout)
 			MarkWorkItemRequeued(ingestState, storer.Context)
 		} else {
 			storer.logFinishedStoring(ingestState)
-			ingestState.FinishNSQ()
+			ingestState.FinishMessage()
 			MarkWorkItemSucceeded(ingestState, storer.Context, constants.StageRecord)
 			PushToQueue(ingestState, storer.Context, storer.Context.Config.RecordWorker.NsqTopic)
 		}
 
 		LogJson(ingestState, storer.Context.JsonLog)
 		RecordWorkItemState(ingestState, storer.Context, ingestState.IngestManifest.FetchResult)
+		storer.InFlight.Done(ingestState.Message)
 	}
 }
 
+// itsTimeToGiveUp returns true if we have fatal errors, or too many
+// recurring transient errors.
+func (storer *APTStorer) itsTimeToGiveUp(ingestState *models.IngestState) bool {
+	attemptNumber := ingestState.IngestManifest.StoreResult.AttemptNumber
+	maxAttempts := storer.Context.Config.StoreWorker.MaxAttempts
+	return ingestState.IngestManifest.HasFatalErrors() ||
+		(ingestState.IngestManifest.HasErrors() && attemptNumber >= maxAttempts)
+}
+
 // getStorageSummaryBatch returns a batch of storage summary objects
 // and boolean indicating whether the object has more files to get.
 func (storer *APTStorer) getStorageSummaryBatch(db *storage.BoltDB, objIdentifier string, start, limit int) (storageSummaries []*models.StorageSummary, hasMoreFiles bool, err error) {
@@ -367,13 +409,16 @@ func (storer *APTStorer) getStorageSummaryBatch(db *storage.BoltDB, objIdentifie
 		if err != nil {
 			return nil, false, err
 		}
+		summary.S3Bucket = obj.IngestS3Bucket
+		summary.S3Key = obj.IngestS3Key
+		summary.ETag = obj.ETag
 		storer.Context.MessageLog.Info("Adding %s to batch", gf.Identifier)
 		storageSummaries[i] = summary
 	}
 	return storageSummaries, hasMoreFiles, nil
 }
 
-func (storer *APTStorer) saveFile(db *storage.BoltDB, storageSummary *models.StorageSummary) {
+func (storer *APTStorer) saveFile(ctx gocontext.Context, db *storage.BoltDB, storageSummary *models.StorageSummary) {
 	gf := storageSummary.GenericFile
 	if util.LooksLikeJunkFile(gf.OriginalPath()) && (gf.IngestManifestMd5 != "" || gf.IngestManifestSha256 != "") {
 		// A.D. 2017-09-21. Normally, we ignore Mac junk files that
@@ -390,7 +435,7 @@ func (storer *APTStorer) saveFile(db *storage.BoltDB, storageSummary *models.Sto
 		// We don't need to save bagit.txt, or certain manifests.
 		gf.IngestNeedsSave = false
 	} else {
-		existingSha256, err := storer.getExistingSha256(gf.Identifier)
+		existingSha256, err := storer.getExistingSha256(ctx, gf.Identifier)
 		if err != nil {
 			storer.Context.MessageLog.Error(err.Error())
 			storageSummary.StoreResult.AddError(err.Error())
@@ -402,7 +447,7 @@ func (storer *APTStorer) saveFile(db *storage.BoltDB, storageSummary *models.Sto
 			gf.Id = existingSha256.GenericFileId
 			// We don't need to save files that were ingested
 			// previously and have not changed.
-			storer.changedSincePreviousVersion(storageSummary, existingSha256)
+			storer.changedSincePreviousVersion(ctx, storageSummary, existingSha256)
 		}
 	}
 
@@ -411,17 +456,17 @@ func (storer *APTStorer) saveFile(db *storage.BoltDB, storageSummary *models.Sto
 		storer.Context.MessageLog.Info("File %s needs save", gf.Identifier)
 		if gf.StorageOption == constants.StorageStandard {
 			if gf.IngestStoredAt.IsZero() || gf.IngestStorageURL == "" {
-				storer.copyToLongTermStorage(storageSummary, "s3")
+				storer.copyToLongTermStorage(ctx, db, storageSummary, "s3")
 			}
 			if gf.IngestReplicatedAt.IsZero() || gf.IngestReplicationURL == "" {
-				storer.copyToLongTermStorage(storageSummary, "glacier")
+				storer.copyToLongTermStorage(ctx, db, storageSummary, "glacier")
 			}
 		} else {
 			// A.D. 2020-06-10: Don't re-upload unnecessarily.
 			if gf.IngestStoredAt.IsZero() || gf.IngestStorageURL == "" {
 				storer.Context.MessageLog.Info("Skipping S3 because file %s is %s", gf.Identifier, gf.StorageOption)
 				// Send directly to Glacier VA, OH or OR.
-				storer.copyToLongTermStorage(storageSummary, gf.StorageOption)
+				storer.copyToLongTermStorage(ctx, db, storageSummary, gf.StorageOption)
 			} else {
 				storer.Context.MessageLog.Info("Skipping upload of %s because it was stored at %s at %s", gf.Identifier, gf.IngestStorageURL, gf.IngestStoredAt.Format(time.RFC3339))
 			}
@@ -447,9 +492,9 @@ func (storer *APTStorer) saveFile(db *storage.BoltDB, storageSummary *models.Sto
 // exists from a prior ingest. If it does, and the checksum of the new
 // version matches the checksum of the prior version, we don't need to
 // re-save this file.
-func (storer *APTStorer) changedSincePreviousVersion(storageSummary *models.StorageSummary, existingSha256 *models.Checksum) {
+func (storer *APTStorer) changedSincePreviousVersion(ctx gocontext.Context, storageSummary *models.StorageSummary, existingSha256 *models.Checksum) {
 	gf := storageSummary.GenericFile
-	uuid, err := storer.getUuidOfExistingFile(gf.Identifier)
+	uuid, err := storer.getUuidOfExistingFile(ctx, gf.Identifier)
 	if err != nil {
 		message := fmt.Sprintf("Cannot find existing UUID for %s: %v", gf.Identifier, err.Error())
 		storageSummary.StoreResult.AddError(message)
@@ -496,7 +541,7 @@ func (storer *APTStorer) changedSincePreviousVersion(storageSummary *models.Stor
 // unchanged versions of some files. So we check the sha256 of the
 // existing version against the sha256 of the one just uploaded. If they're
 // the same, we don't bother overwriting the existing file.
-func (storer *APTStorer) getExistingSha256(gfIdentifier string) (*models.Checksum, error) {
+func (storer *APTStorer) getExistingSha256(ctx gocontext.Context, gfIdentifier string) (*models.Checksum, error) {
 	storer.Context.MessageLog.Info("Checking Pharos for existing sha256 digest for %s",
 		gfIdentifier)
 	params := url.Values{}
@@ -504,7 +549,7 @@ func (storer *APTStorer) getExistingSha256(gfIdentifier string) (*models.Checksu
 	params.Add("algorithm", constants.AlgSha256)
 	// PT #145151935: Sort by datetime, not created_at
 	params.Add("sort", "datetime DESC")
-	resp := storer.Context.PharosClient.ChecksumList(params)
+	resp := storer.Context.PharosClient.WithContext(ctx).ChecksumList(params)
 	if resp.Error != nil {
 		return nil, resp.Error
 	}
@@ -519,17 +564,20 @@ func (storer *APTStorer) getExistingSha256(gfIdentifier string) (*models.Checksu
 // of the S3 storage URL. When we are updating an existing GenericFile, we want
 // to overwrite the object in S3/Glacier rather than writing a new one and
 // leaving the old one hanging around. To overwrite it, we must know its UUID.
-func (storer *APTStorer) getUuidOfExistingFile(gfIdentifier string) (string, error) {
+func (storer *APTStorer) getUuidOfExistingFile(ctx gocontext.Context, gfIdentifier string) (string, error) {
 	storer.Context.MessageLog.Info("Checking Pharos for existing UUID for GenericFile %s",
 		gfIdentifier)
-	resp := storer.Context.PharosClient.GenericFileGet(gfIdentifier, false)
+	resp := storer.Context.PharosClient.WithContext(ctx).GenericFileGet(gfIdentifier, false)
 	if resp.Error != nil {
-		storer.Context.MessageLog.Warning("Error getting URL %s", resp.Request.URL.String())
+		// resp.Response is nil if the context expired before we
+		// got one, so log what we asked for and why it failed.
+		storer.Context.MessageLog.Warning("Error getting GenericFile %s from %s: %v",
+			gfIdentifier, resp.RequestURL(), resp.Error)
 		return "", resp.Error
 	}
 	uuid := ""
 	existingGenericFile := resp.GenericFile()
-	if resp.Error != nil {
+	if existingGenericFile == nil {
 		return "", fmt.Errorf("Pharos cannot find supposedly existing GenericFile '%s'", gfIdentifier)
 	}
 	parts := strings.Split(existingGenericFile.URI, "/")
@@ -550,13 +598,13 @@ func (storer *APTStorer) setStorageOption(db *storage.BoltDB, objIdentifier stri
 	resp := storer.Context.PharosClient.IntellectualObjectGet(objIdentifier, false, false)
 
 	// Not found should be common, as most ingests are first-time ingests.
-	if resp.Response.StatusCode == http.StatusNotFound {
+	if network.IsPharosNotFound(resp.Error) {
 		return "", nil
 	}
 
 	// If we have some other error, that's a problem.
 	if resp.Error != nil {
-		storer.Context.MessageLog.Error("Error getting URL %s", resp.Request.URL.String())
+		storer.Context.MessageLog.Error("Error getting URL %s: %v", resp.RequestURL(), resp.Error)
 		return "", resp.Error
 	}
 
@@ -593,7 +641,7 @@ func (storer *APTStorer) setStorageOption(db *storage.BoltDB, objIdentifier stri
 }
 
 // Copy the GenericFile to long-term storage in S3 or Glacier
-func (storer *APTStorer) copyToLongTermStorage(storageSummary *models.StorageSummary, sendWhere string) {
+func (storer *APTStorer) copyToLongTermStorage(ctx gocontext.Context, db *storage.BoltDB, storageSummary *models.StorageSummary, sendWhere string) {
 	gf := storageSummary.GenericFile
 	if !storer.uuidPresent(storageSummary) {
 		msg := fmt.Sprintf("Cannot copy GenericFile %s to long-term storage because UUID is missing",
@@ -604,7 +652,7 @@ func (storer *APTStorer) copyToLongTermStorage(storageSummary *models.StorageSum
 	}
 	storer.Context.MessageLog.Info("Sending %s to %s", gf.Identifier, sendWhere)
 	for attemptNumber := 1; attemptNumber <= MAX_UPLOAD_ATTEMPTS; attemptNumber++ {
-		storer.doUpload(storageSummary, sendWhere, attemptNumber)
+		storer.doUpload(ctx, db, storageSummary, sendWhere, attemptNumber)
 		// Stop trying if storage succeeded
 		if sendWhere == "glacier" && gf.IngestReplicatedAt.IsZero() == false {
 			break
@@ -612,57 +660,55 @@ func (storer *APTStorer) copyToLongTermStorage(storageSummary *models.StorageSum
 			// Covers "s3", "Glacier-VA", "Glacier-OH" and "Glacier-OR"
 			break
 		}
+		// Stop trying if we're out of time. The item will be
+		// requeued, and the next attempt can resume the upload.
+		if ctx.Err() != nil && attemptNumber < MAX_UPLOAD_ATTEMPTS {
+			msg := fmt.Sprintf("Gave up sending %s to %s: %v", gf.Identifier, sendWhere, ctx.Err())
+			storageSummary.StoreResult.AddError(msg)
+			storer.Context.MessageLog.Error(msg)
+			break
+		}
 	}
 }
 
-func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhere string, attemptNumber int) {
+func (storer *APTStorer) doUpload(ctx gocontext.Context, db *storage.BoltDB, storageSummary *models.StorageSummary, sendWhere string, attemptNumber int) {
 	gf := storageSummary.GenericFile
-	uploader := storer.initUploader(storageSummary, sendWhere)
-	if uploader == nil {
-		msg := "S3 uploader is nil. Cannot proceed."
+	region, bucket := storer.getRegionAndBucket(storageSummary, sendWhere)
+	if region == "" || bucket == "" {
+		msg := "Storage region or bucket is missing. Cannot proceed."
 		storageSummary.StoreResult.AddError(msg)
 		storer.Context.MessageLog.Error(msg)
 		return // We have some config problem here. Stop trying.
 	}
-	if !storer.assertRequiredMetadata(storageSummary, uploader) {
+	backend := storer.Context.StorageBackend(region).WithContext(ctx)
+	metadata := storer.getMetadata(storageSummary)
+	if !storer.assertRequiredMetadata(storageSummary, metadata) {
 		return
 	}
-	tarFileIterator, readCloser := storer.getReadCloser(storageSummary)
-	if readCloser != nil && tarFileIterator != nil {
+	readCloser := storer.getReadCloser(ctx, storageSummary)
+	if readCloser != nil {
 		defer readCloser.Close()
-		defer tarFileIterator.Close()
-
-		// Handle large files. Amazon's moronic uploader will read the
-		// entire file into memory, unless we give it a reader that
-		// supports both Seek() and ReadAt(). We cannot convert a tarReader
-		// to do that, because the underlying reader doesn't support
-		// ReadAt(). So we have to copy the entire file to disk and then
-		// pass the uploader a File object, which does support those
-		// methods. Fun.
-		reader := readCloser
+
+		storer.Context.MessageLog.Info("Starting to upload file %s (size: %d) to %s",
+			gf.Identifier, gf.Size, sendWhere)
+
+		// Large files go up in parts, and we record each part in the
+		// bag's BoltDB as soon as it's stored. If this attempt fails,
+		// or the worker dies, the next attempt resumes after the last
+		// stored part, instead of re-sending the whole file. Smaller
+		// files go straight from the tar file to storage.
+		var storageUrl string
+		var uploadErr error
 		if gf.Size > constants.S3LargeFileSize {
-			reader, err := storer.getFileReader(readCloser, gf, attemptNumber)
-			if err != nil {
-				errMsg := fmt.Sprintf("Error copying '%s' from tarfile to "+
-					"filesystem at '%s' for large file upload: %v", gf.Identifier,
-					storer.getTempFilePath(gf), err)
-				storer.Context.MessageLog.Error(errMsg)
-				storageSummary.StoreResult.AddError(errMsg)
-				return
-			}
-			defer reader.Close()
+			storageUrl, uploadErr = storer.uploadMultipart(db, backend, storageSummary,
+				region, bucket, metadata, readCloser)
 		} else {
 			storer.Context.MessageLog.Info("Upload file %s (size: %d) directly "+
 				"to %s from the tar file", gf.Identifier, gf.Size, sendWhere)
+			storageUrl, uploadErr = backend.Put(bucket, gf.IngestUUID, gf.FileFormat,
+				metadata, readCloser, gf.Size)
 		}
 
-		storer.Context.MessageLog.Info("Starting to upload file %s (size: %d) to %s",
-			gf.Identifier, gf.Size, sendWhere)
-
-		// Now do the upload using the tar file reader for smaller files
-		// and the File reader for very large files.
-		uploader.SendWithSize(reader, gf.Size)
-
 		// For large files, give S3 some time to catch up.
 		// On a 50GB+ upload with thousands of parts, S3 seems to always
 		// give the wrong size if we ask within milliseconds of the
@@ -674,7 +720,7 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 		// PT #143660373: S3 zero-size file bug.
 		// S3 returns some very weird stuff here,
 		// sometimes zero, sometimes 10x the actual file size.
-		s3Obj := storer.getS3FileDetail(uploader.AWSRegion, *uploader.UploadInput.Bucket, gf.IngestUUID)
+		s3Obj := storer.getS3FileDetail(backend, bucket, gf.IngestUUID)
 		if s3Obj == nil {
 			errMsg := fmt.Sprintf("%s returned nothing for %s (%s).", sendWhere, gf.IngestUUID, gf.Identifier)
 			if attemptNumber == MAX_UPLOAD_ATTEMPTS {
@@ -682,7 +728,7 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 			} else {
 				storer.Context.MessageLog.Warning(errMsg + ". Will retry.")
 			}
-		} else if *s3Obj.Size != gf.Size {
+		} else if s3Obj.Size != gf.Size {
 			errMsg := fmt.Sprintf("%s returned size %d for %s (%s), should be %d.",
 				sendWhere, s3Obj.Size, gf.IngestUUID, gf.Identifier, gf.Size)
 			if attemptNumber == MAX_UPLOAD_ATTEMPTS {
@@ -691,18 +737,18 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 				storer.Context.MessageLog.Warning(errMsg + " Will retry.")
 			}
 		}
-		uploadSucceeded := (s3Obj != nil && *s3Obj.Size == gf.Size && uploader.ErrorMessage == "")
+		uploadSucceeded := (s3Obj != nil && s3Obj.Size == gf.Size && uploadErr == nil)
 
 		if uploadSucceeded {
 			storer.Context.MessageLog.Info("Stored %s in %s after %d attempts",
 				gf.Identifier, sendWhere, attemptNumber)
-			storer.markFileAsStored(gf, sendWhere, uploader.Response.Location)
+			storer.markFileAsStored(gf, sendWhere, storageUrl)
 			return // Upload succeeded
-		} else if uploader.ErrorMessage != "" {
+		} else if uploadErr != nil {
 			storer.Context.MessageLog.Error("Upload error for %s: %s",
-				gf.Identifier, uploader.ErrorMessage)
+				gf.Identifier, uploadErr.Error())
 			if attemptNumber == MAX_UPLOAD_ATTEMPTS {
-				storageSummary.StoreResult.AddError(uploader.ErrorMessage)
+				storageSummary.StoreResult.AddError(uploadErr.Error())
 			}
 		}
 	} else {
@@ -710,125 +756,202 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 	}
 }
 
-// See the comment above, that begins "Handle large files."
-// We put temp files on the /mnt, not in /tmp, because they
-// may be too large for the root partition.
-func (storer *APTStorer) getFileReader(reader io.Reader, gf *models.GenericFile, attemptNumber int) (*os.File, error) {
-	var err error
-	var tempFile *os.File
-	filePath := storer.getTempFilePath(gf)
-	// PT #143660373: S3 zero-size file bug.
-	// We have to copy larger files from the tar archive to disk,
-	// so the AWS S3 uploader doesn't read them into memory.
-	// When creating large files on EFS, the first attempt to
-	// read them results in a zero-length read, and a zero-length
-	// file being written to S3. So here, we try copying the file
-	// to disk, closing the file handle, and re-opening it to see
-	// if we can get a reliable file reader from EFS.
-	if !fileutil.FileExists(filePath) {
-		err = storer.createTempFile(reader, gf, attemptNumber)
+// uploadMultipart sends a large file to storage in parts and returns
+// the URL of the stored object. After storage accepts each part, we
+// save the upload's progress in the bag's BoltDB. If an earlier attempt
+// left an upload in progress for this file, we skip the parts it
+// already stored and pick up where it left off.
+func (storer *APTStorer) uploadMultipart(db *storage.BoltDB, backend network.StorageBackend, storageSummary *models.StorageSummary, region, bucket string, metadata map[string]string, reader io.Reader) (string, error) {
+	gf := storageSummary.GenericFile
+	uploadKey := multipartUploadKey(gf, bucket)
+	upload, err := storer.startOrResumeUpload(db, backend, uploadKey, gf, region, bucket, metadata)
+	if err != nil {
+		return "", err
+	}
+
+	// Skip the parts we've already stored. We have to read through
+	// them, because we can't seek in the tar file.
+	offset := upload.BytesUploaded()
+	if offset > 0 {
+		storer.Context.MessageLog.Info("Resuming upload of %s to %s at part %d (byte %d of %d)",
+			gf.Identifier, bucket, upload.NextPartNumber(), offset, gf.Size)
+		_, err = io.CopyN(ioutil.Discard, reader, offset)
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("Error skipping to byte %d of %s in tar file: %v",
+				offset, gf.Identifier, err)
 		}
 	}
 
-	// Have to stat twice now, first to check for zero-length files
-	// that sometimes show up during heavy ingest. Possibly due to
-	// writes being started as services are shutting down.
-	stat, err := os.Stat(filePath)
-	if err != nil {
-		storer.Context.MessageLog.Error("Can't stat %s (%s): %v", filePath, gf.Identifier, err)
-	}
-	// If zero-size file exists, fix it by recopying.
-	if stat != nil && stat.Size() == int64(0) {
-		storer.Context.MessageLog.Error("Attempting to fix zero-length temp file %s (%s)", filePath, gf.Identifier)
-		err = storer.createTempFile(reader, gf, attemptNumber)
+	for !upload.IsComplete() {
+		partNumber := upload.NextPartNumber()
+		partSize := upload.PartSize
+		remaining := upload.FileSize - upload.BytesUploaded()
+		if remaining < partSize {
+			partSize = remaining
+		}
+		etag, err := storer.uploadPart(backend, upload, partNumber, partSize, reader, gf)
+		if err != nil {
+			if network.IsNoSuchUpload(err) {
+				// The upload expired or someone aborted it.
+				// Start a new one on the next attempt.
+				db.DeleteMultipartUpload(uploadKey)
+			}
+			return "", fmt.Errorf("Error uploading part %d of %s: %v", partNumber, gf.Identifier, err)
+		}
+		upload.AddPart(partNumber, etag, partSize)
+		err = db.Save(uploadKey, upload)
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("Error saving progress of upload for %s: %v", gf.Identifier, err)
 		}
-		storer.Context.MessageLog.Error("Fixed zero-length temp file %s (%s)", filePath, gf.Identifier)
 	}
 
-	// Now proceed to upload the temp file if all looks well.
-	stat, err = os.Stat(filePath)
+	storageUrl, err := backend.CompleteMultipartUpload(upload.Bucket, upload.Key,
+		upload.UploadId, upload.Parts)
 	if err != nil {
-		storer.Context.MessageLog.Error("Can't stat %s (%s): %v", filePath, gf.Identifier, err)
-	}
-
-	if stat != nil && stat.Size() == gf.Size {
-		tempFile, err = os.Open(filePath)
-		if err == nil {
-			storer.Context.MessageLog.Info("Using existing temp file at %s "+
-				"for %s (Attempt %d)", filePath, gf.Identifier, attemptNumber)
-		} else {
-			err = fmt.Errorf("Error opening %s (%s): %v", filePath, gf.Identifier, err)
-			storer.Context.MessageLog.Error(err.Error())
-			return nil, err
+		if network.IsNoSuchUpload(err) || strings.Contains(err.Error(), "InvalidPart") {
+			// We can't finish this upload, so start over next time.
+			storer.abortMultipartUpload(backend, upload)
+			db.DeleteMultipartUpload(uploadKey)
 		}
-		// PT #143660373: S3 zero-size file bug.
-		measuredSize := storer.getActualFileSize(tempFile, filePath)
-		if measuredSize != gf.Size {
-			err = fmt.Errorf("Wrong actual size for %s (%s). Should be %d, got %d",
-				filePath, gf.Identifier, gf.Size, measuredSize)
-			storer.Context.MessageLog.Error(err.Error())
-			return nil, err
-		} else {
-			storer.Context.MessageLog.Info("Actual measured size of %s is %d", filePath, measuredSize)
-		}
-	} else {
-		err = fmt.Errorf("Temp file for %s at %s is missing or wrong size", gf.Identifier, filePath)
+		return "", fmt.Errorf("Error completing upload of %s: %v", gf.Identifier, err)
 	}
-	return tempFile, err
+	storer.Context.MessageLog.Info("Completed multipart upload of %s to %s (%d parts)",
+		gf.Identifier, bucket, len(upload.Parts))
+	db.DeleteMultipartUpload(uploadKey)
+	return storageUrl, nil
 }
 
-// TODO: Move this to where it can be unit tested.
-func (storer *APTStorer) createTempFile(reader io.Reader, gf *models.GenericFile, attemptNumber int) error {
-	filePath := storer.getTempFilePath(gf)
-	storer.Context.MessageLog.Info("Copying file %s (size: %d) to %s "+
-		"before uploading. (Attempt %d)", gf.Identifier, gf.Size, filePath,
-		attemptNumber)
-	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+// startOrResumeUpload returns the multipart upload recorded for this
+// file, or starts a new one if there isn't one. If the recorded upload
+// is for some other size or key (e.g. because the depositor sent a new
+// version of the bag), we abort it and start over.
+func (storer *APTStorer) startOrResumeUpload(db *storage.BoltDB, backend network.StorageBackend, uploadKey string, gf *models.GenericFile, region, bucket string, metadata map[string]string) (*models.MultipartUpload, error) {
+	upload, err := db.GetMultipartUpload(uploadKey)
 	if err != nil {
-		return fmt.Errorf("MkdirAll failed: %v", err)
+		return nil, fmt.Errorf("Error reading upload progress for %s from BoltDB: %v", gf.Identifier, err)
 	}
-	// PT #143660373: S3 zero-size file bug. Lots of checks here...
-	tempFile, err := os.Create(filePath)
+	if upload != nil && upload.UploadId != "" && upload.Matches(bucket, gf.IngestUUID, gf.Size) {
+		return upload, nil
+	}
+	if upload != nil {
+		storer.Context.MessageLog.Info("Aborting stale upload of %s to %s/%s",
+			gf.Identifier, upload.Bucket, upload.Key)
+		storer.abortMultipartUpload(backend, upload)
+	}
+	upload = models.NewMultipartUpload(bucket, gf.IngestUUID, gf.Size, network.MultipartPartSize(gf.Size))
+	upload.Region = region
+
+	// Save this before we create the upload, so that if we die before
+	// we can record the upload id, cleanup still knows to look for it.
+	err = db.Save(uploadKey, upload)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving upload progress for %s to BoltDB: %v", gf.Identifier, err)
+	}
+	upload.UploadId, err = backend.CreateMultipartUpload(bucket, gf.IngestUUID, gf.FileFormat, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting multipart upload of %s: %v", gf.Identifier, err)
+	}
+	err = db.Save(uploadKey, upload)
 	if err != nil {
-		return fmt.Errorf("Cannot create file: %v", err)
+		return nil, fmt.Errorf("Error saving upload progress for %s to BoltDB: %v", gf.Identifier, err)
 	}
-	defer tempFile.Close()
+	storer.Context.MessageLog.Info("Started multipart upload %s of %s to %s/%s (%d parts of %d bytes)",
+		upload.UploadId, gf.Identifier, bucket, gf.IngestUUID,
+		(gf.Size+upload.PartSize-1)/upload.PartSize, upload.PartSize)
+	return upload, nil
+}
 
-	bytesCopied, err := io.Copy(tempFile, reader)
+// uploadPart copies the next partSize bytes from reader to a temp file,
+// and sends that to storage. The storage service needs a reader that
+// can seek, and a tar file reader can't. Spooling one part at a time
+// keeps memory use down, and means we never need disk space for more
+// than one part of the file.
+func (storer *APTStorer) uploadPart(backend network.StorageBackend, upload *models.MultipartUpload, partNumber, partSize int64, reader io.Reader, gf *models.GenericFile) (string, error) {
+	partPath := storer.getTempFilePath(gf) + ".part"
+	err := os.MkdirAll(filepath.Dir(partPath), 0755)
 	if err != nil {
-		return fmt.Errorf("Error copying data from tar file: %v", err)
+		return "", fmt.Errorf("MkdirAll failed: %v", err)
 	}
-	if bytesCopied != gf.Size {
-		return fmt.Errorf("Copied only %d of %d bytes for file %s", bytesCopied, gf.Size, gf.Identifier)
-	} else {
-		storer.Context.MessageLog.Info("Copied %d bytes for %s to %s", bytesCopied, gf.Identifier, filePath)
+	partFile, err := os.Create(partPath)
+	if err != nil {
+		return "", fmt.Errorf("Cannot create temp file for part: %v", err)
 	}
-	finfo, err := tempFile.Stat()
+	defer os.Remove(partPath)
+	defer partFile.Close()
+	_, err = io.CopyN(partFile, reader, partSize)
 	if err != nil {
-		return fmt.Errorf("Can't stat tempFile %s at %s", gf.Identifier, filePath)
+		return "", fmt.Errorf("Error copying part from tar file: %v", err)
 	}
-	if finfo.Size() != gf.Size {
-		return fmt.Errorf("Temp file has only %d of %d bytes for file %s",
-			finfo.Size(), gf.Size, gf.Identifier)
+	_, err = partFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return backend.UploadPart(upload.Bucket, upload.Key, upload.UploadId, partNumber, partFile, partSize)
 }
 
-// Read the actual number of bytes in the EFS file.
-// The AWS uploader keeps coming up with zero on the first try. Why?
-// Note that this rewinds the file to the beginning after the size check.
-func (storer *APTStorer) getActualFileSize(r io.ReadSeeker, filePath string) int64 {
-	defer r.Seek(0, io.SeekStart)
-	size, err := r.Seek(0, io.SeekEnd)
+// abortMultipartUpload aborts upload, along with any other uploads in
+// progress to the same key. Those would be uploads that an earlier
+// attempt started but didn't live long enough to record. Storage
+// services keep, and bill for, the parts of an upload until someone
+// completes or aborts it.
+func (storer *APTStorer) abortMultipartUpload(backend network.StorageBackend, upload *models.MultipartUpload) {
+	uploadIds := make(map[string]bool)
+	if upload.UploadId != "" {
+		uploadIds[upload.UploadId] = true
+	}
+	inProgress, err := backend.ListMultipartUploads(upload.Bucket, upload.Key)
 	if err != nil {
-		storer.Context.MessageLog.Error("Error seeking through %s: %v", filePath, err)
-		return -1
+		storer.Context.MessageLog.Warning("Cannot list multipart uploads for %s/%s: %v",
+			upload.Bucket, upload.Key, err)
+	}
+	for _, info := range inProgress {
+		if info.Key == upload.Key {
+			uploadIds[info.UploadId] = true
+		}
+	}
+	for uploadId := range uploadIds {
+		err = backend.AbortMultipartUpload(upload.Bucket, upload.Key, uploadId)
+		if err != nil && !network.IsNoSuchUpload(err) {
+			storer.Context.MessageLog.Warning("Cannot abort multipart upload %s for %s/%s: %v",
+				uploadId, upload.Bucket, upload.Key, err)
+		} else {
+			storer.Context.MessageLog.Info("Aborted multipart upload %s for %s/%s",
+				uploadId, upload.Bucket, upload.Key)
+		}
 	}
-	return size
+}
+
+// abortMultipartUploads aborts all of the multipart uploads recorded
+// in the bag's BoltDB. We call this once we're done with a bag, whether
+// we stored it or gave up on it.
+func (storer *APTStorer) abortMultipartUploads(ingestState *models.IngestState) {
+	dbPath := ingestState.IngestManifest.DBPath
+	if !fileutil.FileExists(dbPath) {
+		return
+	}
+	db, err := storage.NewBoltDB(dbPath)
+	if err != nil {
+		storer.Context.MessageLog.Error("Cannot open %s to clean up multipart uploads: %v", dbPath, err)
+		return
+	} else if db == nil {
+		return
+	}
+	defer db.Close()
+	uploads, err := db.MultipartUploads()
+	if err != nil {
+		storer.Context.MessageLog.Error("Cannot read multipart uploads from %s: %v", dbPath, err)
+		return
+	}
+	for uploadKey, upload := range uploads {
+		storer.abortMultipartUpload(storer.Context.StorageBackend(upload.Region), upload)
+		db.DeleteMultipartUpload(uploadKey)
+	}
+}
+
+// multipartUploadKey returns the key under which we record the
+// progress of a multipart upload of gf to bucket.
+func multipartUploadKey(gf *models.GenericFile, bucket string) string {
+	return bucket + ":" + gf.Identifier
 }
 
 func (storer *APTStorer) getTempFilePath(gf *models.GenericFile) string {
@@ -874,9 +997,8 @@ func (storer *APTStorer) uuidPresent(storageSummary *models.StorageSummary) bool
 	return true
 }
 
-// Initializes the uploader object with connection data and metadata
-// for this specific GenericFile.
-func (storer *APTStorer) initUploader(storageSummary *models.StorageSummary, sendWhere string) *network.S3Upload {
+// Returns the region and bucket to which we should send this GenericFile.
+func (storer *APTStorer) getRegionAndBucket(storageSummary *models.StorageSummary, sendWhere string) (string, string) {
 	gf := storageSummary.GenericFile
 	var region string
 	var bucket string
@@ -895,49 +1017,65 @@ func (storer *APTStorer) initUploader(storageSummary *models.StorageSummary, sen
 		storageSummary.StoreResult.AddError("Cannot save %s to %s because "+
 			"storer doesn't know where %s is", gf.Identifier, sendWhere, sendWhere)
 		storageSummary.StoreResult.ErrorIsFatal = true
-		return nil
+		return "", ""
 	}
-	uploader := network.NewS3Upload(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region,
-		bucket,
-		gf.IngestUUID,
-		gf.FileFormat,
-	)
+	return region, bucket
+}
+
+// Returns the metadata we store with this specific GenericFile.
+func (storer *APTStorer) getMetadata(storageSummary *models.StorageSummary) map[string]string {
+	gf := storageSummary.GenericFile
 	instIdentifier, err := gf.InstitutionIdentifier()
 	if err != nil {
 		storageSummary.StoreResult.AddError("Error setting institution in S3 metadata: %v. "+
 			"Storing without institution tag.", err)
 	}
-	uploader.AddMetadata("institution", instIdentifier)
-	uploader.AddMetadata("bag", gf.IntellectualObjectIdentifier)
-	uploader.AddMetadata("bagpath", gf.OriginalPath())
-	uploader.AddMetadata("md5", gf.IngestMd5)
-	uploader.AddMetadata("sha256", gf.IngestSha256)
-	return uploader
+	metadata := map[string]string{
+		"institution": instIdentifier,
+		"bag":         gf.IntellectualObjectIdentifier,
+		"bagpath":     gf.OriginalPath(),
+		"md5":         gf.IngestMd5,
+		"sha256":      gf.IngestSha256,
+	}
+	for _, alg := range []string{constants.AlgSha1, constants.AlgSha512} {
+		if digest := gf.IngestDigest(alg); digest != "" {
+			metadata[alg] = digest
+		}
+	}
+	return metadata
 }
 
-// Returns a reader that can read the file from within the tar archive.
-// The S3 uploader uses this reader to stream data to S3 and Glacier.
-func (storer *APTStorer) getReadCloser(storageSummary *models.StorageSummary) (*fileutil.TarFileIterator, io.ReadCloser) {
+// Returns a reader that can read the file from within the tar archive
+// (or zip or gzipped tar archive). The S3 uploader uses this reader to
+// stream data to S3 and Glacier. Closing the reader closes the archive. If the tar file isn't on
+// local disk, because apt_fetch validated the bag by streaming it
+// (see Config.StreamIngest), this reads the file straight from the
+// bag in the receiving bucket. Files from multipart bags come from
+// whichever part they were in.
+func (storer *APTStorer) getReadCloser(ctx gocontext.Context, storageSummary *models.StorageSummary) io.ReadCloser {
 	gf := storageSummary.GenericFile
 	tarFilePath := storageSummary.TarFilePath
-	tfi, err := fileutil.NewTarFileIterator(storageSummary.TarFilePath)
+	if gf.IngestBagPart != "" {
+		tarFilePath = filepath.Join(filepath.Dir(tarFilePath), gf.IngestBagPart)
+	} else if !fileutil.FileExists(tarFilePath) && gf.IngestTarOffset > 0 {
+		return storer.getReceivingBucketReader(ctx, storageSummary)
+	}
+	iterator, err := fileutil.NewArchiveIterator(tarFilePath)
 	if err != nil {
-		msg := fmt.Sprintf("Can't get TarFileIterator for %s: %v", tarFilePath, err)
+		msg := fmt.Sprintf("Can't get archive iterator for %s: %v", tarFilePath, err)
 		storer.Context.MessageLog.Error(msg)
 		storageSummary.StoreResult.AddError(msg)
-		return nil, nil
+		return nil
 	}
-	origPathWithBagName, err := gf.OriginalPathWithBagName()
+	pathInArchive, err := gf.PathInArchive()
 	if err != nil {
 		msg := fmt.Sprintf("Can't get original path for %s: %s", gf.Identifier, err.Error())
 		storer.Context.MessageLog.Error(msg)
 		storageSummary.StoreResult.AddError(msg)
-		return nil, nil
+		iterator.Close()
+		return nil
 	}
-	readCloser, err := tfi.Find(origPathWithBagName)
+	readCloser, err := iterator.Find(pathInArchive)
 	if err != nil {
 		msg := fmt.Sprintf("Can't get reader for %s: %v", gf.Identifier, err)
 		storer.Context.MessageLog.Error(msg)
@@ -945,18 +1083,68 @@ func (storer *APTStorer) getReadCloser(storageSummary *models.StorageSummary) (*
 		if readCloser != nil {
 			readCloser.Close()
 		}
-		return nil, nil
+		iterator.Close()
+		return nil
+	}
+	return &archiveEntryReadCloser{ReadCloser: readCloser, iterator: iterator}
+}
+
+// getReceivingBucketReader returns a reader for the file's bytes
+// within the tar file in the receiving bucket. It makes sure the tar
+// file is still the version we validated, because a depositor may
+// have uploaded a new version with the same name.
+func (storer *APTStorer) getReceivingBucketReader(ctx gocontext.Context, storageSummary *models.StorageSummary) io.ReadCloser {
+	gf := storageSummary.GenericFile
+	backend := storer.Context.StorageBackend(constants.AWSVirginia).WithContext(ctx)
+	storageObj, err := backend.Head(storageSummary.S3Bucket, storageSummary.S3Key)
+	if err != nil {
+		msg := fmt.Sprintf("Can't read %s from %s/%s in receiving bucket: %v",
+			gf.Identifier, storageSummary.S3Bucket, storageSummary.S3Key, err)
+		storer.Context.MessageLog.Error(msg)
+		storageSummary.StoreResult.AddError(msg)
+		return nil
+	}
+	if storageSummary.ETag != "" && storageObj.ETag != storageSummary.ETag {
+		msg := fmt.Sprintf("Can't read %s from %s/%s in receiving bucket: "+
+			"ETag is %s, but the bag we validated had ETag %s",
+			gf.Identifier, storageSummary.S3Bucket, storageSummary.S3Key,
+			storageObj.ETag, storageSummary.ETag)
+		storer.Context.MessageLog.Error(msg)
+		storageSummary.StoreResult.AddError(msg)
+		storageSummary.StoreResult.ErrorIsFatal = true
+		return nil
+	}
+	reader, err := backend.GetRange(storageSummary.S3Bucket, storageSummary.S3Key,
+		gf.IngestTarOffset, gf.Size, storageSummary.ETag)
+	if err != nil {
+		msg := fmt.Sprintf("Can't get reader for %s from %s/%s in receiving bucket: %v",
+			gf.Identifier, storageSummary.S3Bucket, storageSummary.S3Key, err)
+		storer.Context.MessageLog.Error(msg)
+		storageSummary.StoreResult.AddError(msg)
+		return nil
 	}
-	return tfi, readCloser
+	return reader
+}
+
+// archiveEntryReadCloser reads one file from a tar or zip file, and
+// closes the archive when it's closed.
+type archiveEntryReadCloser struct {
+	io.ReadCloser
+	iterator fileutil.ArchiveIterator
+}
+
+func (reader *archiveEntryReadCloser) Close() error {
+	err := reader.ReadCloser.Close()
+	reader.iterator.Close()
+	return err
 }
 
 // Make sure we send data to S3/Glacier with all of the required metadata.
-func (storer *APTStorer) assertRequiredMetadata(storageSummary *models.StorageSummary, s3Upload *network.S3Upload) bool {
+func (storer *APTStorer) assertRequiredMetadata(storageSummary *models.StorageSummary, metadata map[string]string) bool {
 	allKeysPresent := true
 	keys := []string{"institution", "bag", "bagpath", "md5", "sha256"}
 	for _, key := range keys {
-		value := s3Upload.UploadInput.Metadata[key]
-		if value == nil || *value == "" {
+		if metadata[key] == "" {
 			storageSummary.StoreResult.AddError("S3Upload is missing required "+
 				"metadata key %s", key)
 			storageSummary.StoreResult.ErrorIsFatal = true
@@ -997,14 +1185,14 @@ func (storer *APTStorer) markFileAsStored(gf *models.GenericFile, sendWhere, sto
 }
 
 // PT #143660373: S3 zero-size file bug.
-func (storer *APTStorer) getS3FileDetail(region, bucket, fileUUID string) *s3.Object {
-	s3Client := network.NewS3ObjectList(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region, bucket, 1)
-	s3Client.GetList(fileUUID)
-	if len(s3Client.Response.Contents) > 0 {
-		return s3Client.Response.Contents[0]
+func (storer *APTStorer) getS3FileDetail(backend network.StorageBackend, bucket, fileUUID string) *network.StorageObject {
+	objects, err := backend.List(bucket, fileUUID, 1)
+	if err != nil {
+		storer.Context.MessageLog.Warning("Error listing %s in %s: %v", fileUUID, bucket, err)
+		return nil
+	}
+	if len(objects) > 0 {
+		return objects[0]
 	}
 	return nil
 }
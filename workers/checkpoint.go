@@ -0,0 +1,213 @@
+package workers
+
+import (
+	gocontext "context"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MSG_SHUTDOWN_REQUEUE is the WorkItem note for items that were
+// requeued because the worker processing them shut down.
+const MSG_SHUTDOWN_REQUEUE = "Requeued because the worker shut down. Processing will resume where it left off."
+
+// How long RunUntilSignal waits for the queue to drain after
+// workers have checkpointed and requeued their messages.
+const SHUTDOWN_DRAIN_TIMEOUT = 30 * time.Second
+
+// Checkpointer is implemented by workers that can save the state
+// of their in-flight work and requeue it when the process shuts down.
+type Checkpointer interface {
+	// CheckpointAndRequeue tells the worker to stop taking new
+	// messages, save the state of each message it's working on
+	// to Pharos, and requeue those messages immediately.
+	CheckpointAndRequeue()
+}
+
+// InFlightRegistry tracks the messages a worker is working on,
+// along with a function that saves each message's state. Each message
+// gets a context that is cancelled when the worker shuts down, so the
+// worker's goroutines stop work on it. Entries drop out when the worker
+// calls Done.
+type InFlightRegistry struct {
+	// DoneTimeout is how long CheckpointAndRequeue waits for the
+	// worker's goroutines to be done with in-flight messages.
+	DoneTimeout time.Duration
+
+	mutex    sync.Mutex
+	items    map[models.QueueMessage]*inFlightItem
+	stopping bool
+}
+
+type inFlightItem struct {
+	checkpoint func()
+	ctx        gocontext.Context
+	cancel     gocontext.CancelFunc
+	done       chan struct{}
+}
+
+// NewInFlightRegistry returns a new, empty InFlightRegistry.
+func NewInFlightRegistry() *InFlightRegistry {
+	return &InFlightRegistry{
+		DoneTimeout: SHUTDOWN_DRAIN_TIMEOUT,
+		items:       make(map[models.QueueMessage]*inFlightItem),
+	}
+}
+
+// Add registers message, along with the function that saves its
+// state. If the worker is shutting down, Add requeues the message
+// immediately and returns false, and the worker should not process
+// the message any further. Otherwise, the worker must call Done
+// when its goroutines are finished with the message.
+func (registry *InFlightRegistry) Add(message models.QueueMessage, checkpoint func()) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.stopping {
+		message.RequeueWithoutBackoff(0)
+		return false
+	}
+	item := &inFlightItem{
+		checkpoint: checkpoint,
+		done:       make(chan struct{}),
+	}
+	item.ctx, item.cancel = gocontext.WithCancel(gocontext.Background())
+	registry.items[message] = item
+	return true
+}
+
+// Done tells the registry the worker's goroutines are finished with
+// message, whether or not they finished or requeued it. Call this
+// after the last thing the worker does with the message's state,
+// including recording it in Pharos and pushing it to the next queue.
+func (registry *InFlightRegistry) Done(message models.QueueMessage) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	item := registry.items[message]
+	if item == nil {
+		return
+	}
+	delete(registry.items, message)
+	item.cancel()
+	close(item.done)
+}
+
+// StageContext is like the StageContext function, but the context is
+// also cancelled when the worker starts shutting down, so network calls
+// for message stop right away.
+func (registry *InFlightRegistry) StageContext(message models.QueueMessage, workerConfig models.WorkerConfig) (gocontext.Context, gocontext.CancelFunc) {
+	parent := gocontext.Background()
+	registry.mutex.Lock()
+	if item := registry.items[message]; item != nil {
+		parent = item.ctx
+	}
+	registry.mutex.Unlock()
+	return stageContext(parent, workerConfig)
+}
+
+// Stopping returns true if the worker is shutting down.
+func (registry *InFlightRegistry) Stopping() bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.stopping
+}
+
+// Count returns the number of messages still in flight.
+func (registry *InFlightRegistry) Count() int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return len(registry.items)
+}
+
+// CheckpointAndRequeue stops the registry from accepting new messages
+// and cancels the contexts of the in-flight messages. Once the worker
+// is done with each message, this saves its state and requeues it,
+// unless the worker already finished or requeued it.
+//
+// We don't checkpoint a message the worker is still working on, since
+// the worker's goroutines are still changing its state. If they aren't
+// done within DoneTimeout, we leave those messages alone. The queue will
+// deliver them again when they time out.
+func (registry *InFlightRegistry) CheckpointAndRequeue() {
+	registry.mutex.Lock()
+	registry.stopping = true
+	items := make(map[models.QueueMessage]*inFlightItem, len(registry.items))
+	for message, item := range registry.items {
+		items[message] = item
+		item.cancel()
+	}
+	registry.mutex.Unlock()
+	timeout := time.After(registry.DoneTimeout)
+	timedOut := false
+	for message, item := range items {
+		if !timedOut {
+			select {
+			case <-item.done:
+			case <-timeout:
+				timedOut = true
+			}
+		}
+		select {
+		case <-item.done:
+		default:
+			continue
+		}
+		if !message.HasResponded() {
+			item.checkpoint()
+			message.RequeueWithoutBackoff(0)
+		}
+	}
+}
+
+// RunUntilSignal blocks until the queue stops or the process gets
+// SIGINT or SIGTERM. On a signal, it stops the queue, tells each
+// worker that is a Checkpointer to save and requeue its in-flight
+// messages, and then waits briefly for the queue to drain.
+func RunUntilSignal(_context *context.Context, handlers ...network.MessageHandler) {
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+	stopped := make(chan struct{})
+	go func() {
+		_context.Queue.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return
+	case sig := <-sigchan:
+		_context.MessageLog.Info("Received signal %s. Shutting down.", sig)
+	}
+	_context.Queue.Stop()
+	CheckpointAll(handlers...)
+	select {
+	case <-stopped:
+	case <-time.After(SHUTDOWN_DRAIN_TIMEOUT):
+		_context.MessageLog.Warning("Timed out waiting for queue to drain.")
+	}
+	_context.LogStats()
+}
+
+// CheckpointAll calls CheckpointAndRequeue on each handler that
+// is a Checkpointer.
+func CheckpointAll(handlers ...network.MessageHandler) {
+	for _, handler := range handlers {
+		if checkpointer, ok := handler.(Checkpointer); ok {
+			checkpointer.CheckpointAndRequeue()
+		}
+	}
+}
+
+// checkpointIngestState saves the IngestManifest for an in-flight
+// ingest to Pharos, and marks the WorkItem as requeued, so the next
+// worker to get the message picks up where this one left off.
+func checkpointIngestState(ingestState *models.IngestState, _context *context.Context, activeResult *models.WorkSummary) {
+	_context.MessageLog.Info("Checkpointing WorkItem %d (%s/%s) for shutdown",
+		ingestState.WorkItem.Id, ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
+	RecordWorkItemState(ingestState, _context, activeResult)
+	markWorkItemRequeued(ingestState, _context, MSG_SHUTDOWN_REQUEUE)
+}
@@ -0,0 +1,214 @@
+package workers_test
+
+import (
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/APTrust/exchange/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkpointHandler holds messages in flight until it's told
+// to checkpoint them. Like the real workers, it hands each message
+// off to a goroutine that works on it until its context is cancelled.
+type checkpointHandler struct {
+	InFlight     *workers.InFlightRegistry
+	Checkpointed []string
+}
+
+func (handler *checkpointHandler) HandleMessage(message models.QueueMessage) error {
+	body := string(message.Body())
+	if !handler.InFlight.Add(message, func() { handler.Checkpointed = append(handler.Checkpointed, body) }) {
+		return nil
+	}
+	message.DisableAutoResponse()
+	ctx, cancel := handler.InFlight.StageContext(message, models.WorkerConfig{})
+	go func() {
+		defer handler.InFlight.Done(message)
+		defer cancel()
+		<-ctx.Done()
+	}()
+	return nil
+}
+
+func (handler *checkpointHandler) CheckpointAndRequeue() {
+	handler.InFlight.CheckpointAndRequeue()
+}
+
+func TestInFlightRegistryAdd(t *testing.T) {
+	registry := workers.NewInFlightRegistry()
+	message1 := testutil.MakeQueueMessage("1")
+	message2 := testutil.MakeQueueMessage("2")
+	assert.True(t, registry.Add(message1, func() {}))
+	assert.True(t, registry.Add(message2, func() {}))
+	assert.Equal(t, 2, registry.Count())
+	assert.False(t, registry.Stopping())
+
+	// Messages stay in the registry until the worker is done with them,
+	// even if they've been finished.
+	message1.Finish()
+	assert.Equal(t, 2, registry.Count())
+	registry.Done(message1)
+	assert.Equal(t, 1, registry.Count())
+
+	// Done should cancel the message's context.
+	ctx, cancel := registry.StageContext(message2, models.WorkerConfig{})
+	defer cancel()
+	registry.Done(message2)
+	assert.NotNil(t, ctx.Err())
+	assert.Equal(t, 0, registry.Count())
+}
+
+func TestInFlightRegistryCheckpointAndRequeue(t *testing.T) {
+	registry := workers.NewInFlightRegistry()
+	registry.DoneTimeout = 100 * time.Millisecond
+	checkpointed := make([]string, 0)
+	checkpoint := func(body string) func() {
+		return func() { checkpointed = append(checkpointed, body) }
+	}
+	message1 := testutil.MakeQueueMessage("1")
+	message2 := testutil.MakeQueueMessage("2")
+	message3 := testutil.MakeQueueMessage("3")
+	require.True(t, registry.Add(message1, checkpoint("1")))
+	require.True(t, registry.Add(message2, checkpoint("2")))
+	require.True(t, registry.Add(message3, checkpoint("3")))
+
+	// Message 1 is in a pipeline goroutine that stops when its
+	// context is cancelled. Message 2 is finished. Message 3 is
+	// stuck in a goroutine that ignores its context.
+	ctx, cancel := registry.StageContext(message1, models.WorkerConfig{})
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		registry.Done(message1)
+	}()
+	message2.Finish()
+	registry.Done(message2)
+
+	registry.CheckpointAndRequeue()
+	assert.True(t, registry.Stopping())
+
+	// Only the message whose goroutine stopped should be
+	// checkpointed and requeued.
+	assert.Equal(t, []string{"1"}, checkpointed)
+	assert.Equal(t, "requeue", message1.Operation)
+	assert.Equal(t, time.Duration(0), message1.Delay)
+	assert.False(t, message1.Backoff)
+	assert.Equal(t, "finish", message2.Operation)
+	assert.False(t, message3.HasResponded())
+	assert.Equal(t, 1, registry.Count())
+
+	// Once stopping, the registry should requeue new messages
+	// right away, without checkpointing them.
+	message4 := testutil.MakeQueueMessage("4")
+	assert.False(t, registry.Add(message4, checkpoint("4")))
+	assert.Equal(t, "requeue", message4.Operation)
+	assert.Equal(t, []string{"1"}, checkpointed)
+}
+
+func TestCheckpointAll(t *testing.T) {
+	handler := &checkpointHandler{InFlight: workers.NewInFlightRegistry()}
+	message := testutil.MakeQueueMessage("1")
+	require.Nil(t, handler.HandleMessage(message))
+
+	// stuckHandler is not a Checkpointer, so CheckpointAll should skip it.
+	workers.CheckpointAll(&stuckHandler{}, handler)
+	assert.Equal(t, []string{"1"}, handler.Checkpointed)
+	assert.Equal(t, "requeue", message.Operation)
+}
+
+func TestAPTExchangeStopCheckpoints(t *testing.T) {
+	env := newE2EEnv(t, "embedded")
+	defer env.Close()
+
+	queue := env.Context.Queue.(*network.BoltQueue)
+	handler := &checkpointHandler{InFlight: workers.NewInFlightRegistry()}
+	require.Nil(t, queue.Subscribe(&models.WorkerConfig{NsqTopic: "checkpoint_topic", MaxInFlight: 1}, handler))
+	require.Nil(t, queue.Enqueue("checkpoint_topic", 1))
+	for queue.InFlight() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	exchange, err := workers.NewAPTExchange(env.Context, []string{"apt_fetch"})
+	require.Nil(t, err)
+	exchange.WorkerNames = append(exchange.WorkerNames, "checkpoint_worker")
+	exchange.Workers["checkpoint_worker"] = handler
+
+	// The handler never finishes its message, but it should
+	// checkpoint and requeue it when the drain times out.
+	assert.True(t, exchange.Stop(200*time.Millisecond))
+	assert.Equal(t, []string{"1"}, handler.Checkpointed)
+	assert.Equal(t, int64(0), queue.InFlight())
+	depth, err := queue.Depth("checkpoint_topic")
+	require.Nil(t, err)
+	assert.Equal(t, 1, depth)
+}
+
+// Run this with -race. The storer's goroutines are still working on
+// the IngestState when shutdown starts, so CheckpointAndRequeue must
+// stop them before it saves the state.
+func TestAPTStorerCheckpointDuringStore(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	item := env.queueIngest(t)
+	env.fetch(t, item)
+
+	// Put a proxy in front of Pharos that holds checksum lookups
+	// until the storer cancels them, so the store is in flight
+	// when we shut down.
+	pharosUrl, err := url.Parse(env.Pharos.URL())
+	require.Nil(t, err)
+	pharosProxy := httputil.NewSingleHostReverseProxy(pharosUrl)
+	blocked := make(chan struct{})
+	var blockOnce sync.Once
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/checksums/") {
+			blockOnce.Do(func() { close(blocked) })
+			<-r.Context().Done()
+			return
+		}
+		pharosProxy.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	env.Context.PharosClient, err = network.NewPharosClient(proxy.URL, "v2",
+		"system@aptrust.org", "fake-pharos-key")
+	require.Nil(t, err)
+
+	storer := workers.NewAPTStorer(env.Context)
+	message := testutil.MakeQueueMessage(strconv.Itoa(item.Id))
+	require.Nil(t, storer.HandleMessage(message))
+	select {
+	case <-blocked:
+	case <-time.After(e2eTimeout):
+		require.FailNow(t, "Storer never asked Pharos for checksums")
+	}
+
+	storer.CheckpointAndRequeue()
+	assert.Equal(t, 0, storer.InFlight.Count())
+	assert.Equal(t, "requeue", message.Operation)
+	assert.Equal(t, time.Duration(0), message.Delay)
+
+	// The WorkItem should be requeued for another try at store,
+	// and nothing should go on to the record queue.
+	workItem := env.getWorkItem(t, item.Id)
+	assert.Equal(t, workers.MSG_SHUTDOWN_REQUEUE, workItem.Note)
+	assert.Equal(t, constants.StatusStarted, workItem.Status)
+	assert.True(t, workItem.Retry)
+	assert.Equal(t, constants.StageStore, workItem.Stage)
+	select {
+	case pub := <-env.Published:
+		assert.Fail(t, "Storer published to "+pub.Topic+" during shutdown")
+	default:
+	}
+}
@@ -1,17 +1,17 @@
 package workers
 
 import (
+	gocontext "context"
 	"encoding/json"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util"
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/validation"
-	"github.com/nsqio/go-nsq"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -41,17 +41,33 @@ func CacheBucketNames(_context *context.Context) error {
 	return nil
 }
 
-// CreateNSQConsumer creates and returns an NSQ consumer for a worker process.
-func CreateNsqConsumer(config *models.Config, workerConfig *models.WorkerConfig) (*nsq.Consumer, error) {
-	nsqConfig := nsq.NewConfig()
-	nsqConfig.Set("max_in_flight", workerConfig.MaxInFlight)
-	nsqConfig.Set("heartbeat_interval", workerConfig.HeartbeatInterval)
-	nsqConfig.Set("max_attempts", workerConfig.MaxAttempts)
-	nsqConfig.Set("read_timeout", workerConfig.ReadTimeout)
-	nsqConfig.Set("write_timeout", workerConfig.WriteTimeout)
-	nsqConfig.Set("msg_timeout", workerConfig.MessageTimeout)
-	nsqConfig.Set("max_req_timeout", "4h0m")
-	return nsq.NewConsumer(workerConfig.NsqTopic, workerConfig.NsqChannel, nsqConfig)
+// StageTimeoutFraction is the part of a worker's MessageTimeout that
+// StageContext gives each stage. We leave the rest for recording the
+// failure and requeueing the item.
+const StageTimeoutFraction = 0.9
+
+// StageContext returns the context for one stage of a worker's work
+// on a message, such as fetching a bag or storing a batch of files.
+// The context is done when cancel is called, or when StageTimeoutFraction
+// of workerConfig.MessageTimeout has passed. That's about how long NSQ
+// waits to hear from us before it hands the message to another worker,
+// so each stage that ends by touching the message gets a context of its
+// own. Network calls made with the context give up when it's done, and
+// the worker requeues the item, instead of hanging on a stuck transfer
+// while NSQ gives the message to someone else.
+//
+// If MessageTimeout is empty or invalid, the context has no deadline.
+func StageContext(workerConfig models.WorkerConfig) (gocontext.Context, gocontext.CancelFunc) {
+	return stageContext(gocontext.Background(), workerConfig)
+}
+
+func stageContext(parent gocontext.Context, workerConfig models.WorkerConfig) (gocontext.Context, gocontext.CancelFunc) {
+	timeout, err := time.ParseDuration(workerConfig.MessageTimeout)
+	if err != nil || timeout <= 0 {
+		return gocontext.WithCancel(parent)
+	}
+	stageTimeout := time.Duration(float64(timeout) * StageTimeoutFraction)
+	return gocontext.WithTimeout(parent, stageTimeout)
 }
 
 // --------------------------------------------------------------------------------
@@ -62,7 +78,7 @@ func CreateNsqConsumer(config *models.Config, workerConfig *models.WorkerConfig)
 // if we can't find one in the IngestManifest. That should only happen
 // in apt_fetcher, where we're often fetching new bags that Pharos has
 // never seen before. All other workers should pass in false for initIfEmpty.
-func GetIngestState(message *nsq.Message, _context *context.Context, initIfEmpty bool) (*models.IngestState, error) {
+func GetIngestState(message models.QueueMessage, _context *context.Context, initIfEmpty bool) (*models.IngestState, error) {
 	workItem, err := GetWorkItem(message, _context)
 	if err != nil {
 		return nil, err
@@ -107,7 +123,7 @@ func GetIngestState(message *nsq.Message, _context *context.Context, initIfEmpty
 	workItemState.State = ""
 
 	ingestState := &models.IngestState{
-		NSQMessage:     message,
+		Message:        message,
 		WorkItem:       workItem,
 		WorkItemState:  workItemState,
 		IngestManifest: ingestManifest,
@@ -133,8 +149,8 @@ func GetIngestState(message *nsq.Message, _context *context.Context, initIfEmpty
 
 // GetWorkItem returns the WorkItem with the specified Id from Pharos,
 // or nil.
-func GetWorkItem(message *nsq.Message, _context *context.Context) (*models.WorkItem, error) {
-	msgBody := strings.TrimSpace(string(message.Body))
+func GetWorkItem(message models.QueueMessage, _context *context.Context) (*models.WorkItem, error) {
+	msgBody := strings.TrimSpace(string(message.Body()))
 	_context.MessageLog.Info("NSQ Message body: '%s'", msgBody)
 	workItemId, err := strconv.Atoi(string(msgBody))
 	if err != nil || workItemId == 0 {
@@ -142,7 +158,7 @@ func GetWorkItem(message *nsq.Message, _context *context.Context) (*models.WorkI
 	}
 	resp := _context.PharosClient.WorkItemGet(workItemId)
 	if resp.Error != nil {
-		return nil, fmt.Errorf("Error getting WorkItem %d from Pharos: %v", workItemId, resp.Error)
+		return nil, fmt.Errorf("Error getting WorkItem %d from Pharos: %w", workItemId, resp.Error)
 	}
 	workItem := resp.WorkItem()
 	if workItem == nil {
@@ -163,7 +179,7 @@ func GetWorkItemState(workItem *models.WorkItem, _context *context.Context, init
 		workItemStateId = *workItem.WorkItemStateId
 	}
 	resp := _context.PharosClient.WorkItemStateGet(workItemStateId)
-	if resp.Response.StatusCode == http.StatusNotFound {
+	if network.IsPharosNotFound(resp.Error) {
 		if initIfEmpty {
 			// Record has not been created yet, so build a new one now.
 			workItemState, err = InitWorkItemState(workItem)
@@ -175,11 +191,12 @@ func GetWorkItemState(workItem *models.WorkItem, _context *context.Context, init
 			// It means we're being called from some worker other than
 			// apt_fetcher, and those workers require that a WorkItemState
 			// record exist.
-			return nil, fmt.Errorf("HTTP 404. Pharos has no WorkItemState with WorkItemState id %d", workItem.WorkItemStateId)
+			return nil, fmt.Errorf("Pharos has no WorkItemState with WorkItemState id %d: %w", workItemStateId, resp.Error)
 		}
 	} else if resp.Error != nil {
-		// We got some other 4xx/5xx error from the Pharos REST service.
-		return nil, fmt.Errorf("Error getting WorkItemState for WorkItem %d from Pharos: %v", workItem.Id, resp.Error)
+		// We got some other error, or no response at all. We wrap it,
+		// so callers can use network.IsPharosUnavailable and friends.
+		return nil, fmt.Errorf("Error getting WorkItemState for WorkItem %d from Pharos: %w", workItem.Id, resp.Error)
 	} else {
 		// We didn't get a 404 or any other error. The WorkItemState should be in
 		// the response.
@@ -327,6 +344,12 @@ func MarkWorkItemCancelled(ingestState *models.IngestState, _context *context.Co
 // MarkWorkItemRequeued tells Pharos that this item has been requeued
 // due to transient errors.
 func MarkWorkItemRequeued(ingestState *models.IngestState, _context *context.Context) error {
+	return markWorkItemRequeued(ingestState, _context,
+		"Item has been requeued due to transient errors. "+
+			ingestState.IngestManifest.AllErrorsAsString())
+}
+
+func markWorkItemRequeued(ingestState *models.IngestState, _context *context.Context, note string) error {
 	_context.MessageLog.Info("Telling Pharos we are requeueing %s/%s",
 		ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
 	ingestState.WorkItem.Date = time.Now().UTC()
@@ -336,8 +359,7 @@ func MarkWorkItemRequeued(ingestState *models.IngestState, _context *context.Con
 	ingestState.WorkItem.Retry = true
 	ingestState.WorkItem.NeedsAdminReview = false
 	ingestState.WorkItem.Status = constants.StatusStarted
-	ingestState.WorkItem.Note = "Item has been requeued due to transient errors. " +
-		ingestState.IngestManifest.AllErrorsAsString()
+	ingestState.WorkItem.Note = note
 	resp := _context.PharosClient.WorkItemSave(ingestState.WorkItem)
 	if resp.Error != nil {
 		_context.MessageLog.Error("Could not mark WorkItem requeued for %s/%s: %v",
@@ -404,9 +426,9 @@ func MarkWorkItemSucceeded(ingestState *models.IngestState, _context *context.Co
 }
 
 // PushToQueue pushes the WorkItem in ingestState into the specified
-// NSQ topic.
+// queue topic.
 func PushToQueue(ingestState *models.IngestState, _context *context.Context, queueTopic string) {
-	err := _context.NSQClient.Enqueue(
+	err := _context.Queue.Enqueue(
 		queueTopic,
 		ingestState.WorkItem.Id)
 	if err != nil {
@@ -459,7 +481,7 @@ func DeleteFileFromStaging(pathToFile string, _context *context.Context) {
 		} else {
 			_context.MessageLog.Info("Deleted %s", pathToFile)
 		}
-		if _context.Config.UseVolumeService && strings.HasSuffix(pathToFile, ".tar") {
+		if _context.Config.UseVolumeService && util.SerializationSuffix(pathToFile) != "" {
 			err = _context.VolumeClient.Release(pathToFile)
 			if err != nil {
 				_context.MessageLog.Warning(err.Error())
@@ -470,9 +492,62 @@ func DeleteFileFromStaging(pathToFile string, _context *context.Context) {
 	}
 }
 
+// DeleteBagFromStaging deletes the tar file from the staging area,
+// or all of the tar files, if this is a multipart bag.
+func DeleteBagFromStaging(manifest *models.IngestManifest, _context *context.Context) {
+	for _, bagPath := range manifest.AllBagPaths() {
+		DeleteFileFromStaging(bagPath, _context)
+	}
+}
+
+// IsMultipartBag returns true if workItem describes the ingest of a
+// bag that the depositor uploaded in parts. The WorkItem name for
+// such bags is the name of part one, e.g. my_bag.b01.of03.tar.
+func IsMultipartBag(workItem *models.WorkItem) bool {
+	_, _, isMultipart := util.MultipartBagPart(workItem.Name)
+	return isMultipart
+}
+
+// ListBagParts returns the parts of the multipart bag that includes
+// key. It's up to the caller to check whether all the parts are there.
+func ListBagParts(backend network.StorageBackend, bucket, key string) (*models.MultipartBag, error) {
+	bag := models.NewMultipartBag(util.CleanBagName(key))
+	objects, err := backend.List(bucket, bag.BagName+".b", MAX_KEYS)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing parts of %s/%s: %v", bucket, bag.BagName, err)
+	}
+	for _, obj := range objects {
+		// The prefix may match other bags, like my_bag.backup.tar,
+		// so skip anything that isn't one of our parts.
+		bag.AddPart(obj.Key, obj.ETag, obj.Size, obj.LastModified)
+	}
+	return bag, nil
+}
+
+// ActiveFilePaths returns the original paths of the active files of
+// the object with the specified identifier, for the validator to check
+// for file name collisions. It returns an empty list if the object
+// isn't in Pharos yet.
+func ActiveFilePaths(client *network.PharosClient, objIdentifier string) ([]string, error) {
+	filePaths := make([]string, 0)
+	params := url.Values{}
+	params.Set("intellectual_object_identifier", objIdentifier)
+	params.Set("state", "A")
+	params.Set("per_page", "200")
+	iterator := client.GenericFileIterator(params, true)
+	defer iterator.Close()
+	for iterator.Next() {
+		filePaths = append(filePaths, iterator.GenericFile().OriginalPath())
+	}
+	if iterator.Err() != nil {
+		return nil, fmt.Errorf("Error getting files of %s from Pharos: %v", objIdentifier, iterator.Err())
+	}
+	return filePaths, nil
+}
+
 // SetupIngestState sets up the IngestState object that the
 // workers use during the ingest process.
-func SetupIngestState(message *nsq.Message, _context *context.Context) (*models.IngestState, error) {
+func SetupIngestState(message models.QueueMessage, _context *context.Context) (*models.IngestState, error) {
 	workItem, err := GetWorkItem(message, _context)
 	if err != nil {
 		return nil, err
@@ -495,12 +570,12 @@ func SetupIngestState(message *nsq.Message, _context *context.Context) (*models.
 
 	manifest.BagPath = filepath.Join(_context.Config.TarDirectory,
 		instIdentifier, workItem.Name)
-	manifest.DBPath = TAR_SUFFIX.ReplaceAllString(manifest.BagPath, ".valdb")
+	manifest.DBPath = constants.SerializedBagSuffix.ReplaceAllString(manifest.BagPath, ".valdb")
 
 	workItemState := models.NewWorkItemState(workItem.Id, workItem.Action, "")
 
 	ingestState := &models.IngestState{}
-	ingestState.NSQMessage = message
+	ingestState.Message = message
 	ingestState.WorkItem = workItem
 	ingestState.IngestManifest = manifest
 	ingestState.WorkItemState = workItemState
@@ -0,0 +1,155 @@
+package workers_test
+
+import (
+	gocontext "context"
+	"errors"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/APTrust/exchange/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pharosTestEnv is a context whose PharosClient talks to a FakePharos,
+// for testing how workers handle what Pharos tells them.
+type pharosTestEnv struct {
+	Context *context.Context
+	Pharos  *network.FakePharos
+	TempDir string
+}
+
+func newPharosTestEnv(t *testing.T) *pharosTestEnv {
+	tempDir, err := ioutil.TempDir("", "exchange_workers")
+	require.Nil(t, err)
+	env := &pharosTestEnv{
+		Pharos:  network.NewFakePharos(),
+		TempDir: tempDir,
+	}
+	config, err := models.LoadConfigFile(filepath.Join("config", "test.json"))
+	require.Nil(t, err)
+	config.ExpandFilePaths()
+	config.LogDirectory = filepath.Join(tempDir, "logs")
+	config.LogToStderr = false
+	config.StorageBackend = "local"
+	config.LocalStorageRoot = filepath.Join(tempDir, "storage")
+	config.UseVolumeService = false
+	config.PharosURL = env.Pharos.URL()
+	env.Context = context.NewContext(config)
+	env.Context.PharosClient, err = env.Pharos.Client()
+	require.Nil(t, err)
+	return env
+}
+
+func (env *pharosTestEnv) Close() {
+	env.Pharos.Close()
+	os.RemoveAll(env.TempDir)
+}
+
+func TestStageContext(t *testing.T) {
+	ctx, cancel := workers.StageContext(models.WorkerConfig{MessageTimeout: "10m"})
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	remaining := time.Until(deadline)
+	assert.True(t, remaining > 8*time.Minute+50*time.Second, remaining)
+	assert.True(t, remaining <= 9*time.Minute, remaining)
+	assert.Nil(t, ctx.Err())
+	cancel()
+	assert.Equal(t, gocontext.Canceled, ctx.Err())
+
+	// No deadline without a usable timeout.
+	for _, timeout := range []string{"", "whenever", "-5m"} {
+		ctx, cancel = workers.StageContext(models.WorkerConfig{MessageTimeout: timeout})
+		_, ok = ctx.Deadline()
+		assert.False(t, ok, timeout)
+		cancel()
+		assert.Equal(t, gocontext.Canceled, ctx.Err())
+	}
+}
+
+// Workers can tell from GetWorkItem's error that a WorkItem
+// doesn't exist, so they don't keep requeuing the message.
+func TestGetWorkItemNotFound(t *testing.T) {
+	env := newPharosTestEnv(t)
+	defer env.Close()
+	message := testutil.MakeQueueMessage("999999")
+	_, err := workers.GetWorkItem(message, env.Context)
+	require.NotNil(t, err)
+	assert.True(t, network.IsPharosNotFound(err))
+	assert.True(t, network.IsPharosFatal(err))
+
+	env.Pharos.Close()
+	_, err = workers.GetWorkItem(message, env.Context)
+	require.NotNil(t, err)
+	assert.True(t, network.IsPharosUnavailable(err))
+	assert.False(t, network.IsPharosFatal(err))
+}
+
+// GetWorkItemState creates a new WorkItemState only for apt_fetcher,
+// and only when Pharos says there isn't one. Callers can tell what
+// went wrong from the error.
+func TestGetWorkItemStateErrors(t *testing.T) {
+	env := newPharosTestEnv(t)
+	defer env.Close()
+	stateId := 999999
+	workItem := &models.WorkItem{Id: 5678, WorkItemStateId: &stateId}
+	state, err := workers.GetWorkItemState(workItem, env.Context, true)
+	require.Nil(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 5678, state.WorkItemId)
+
+	state, err = workers.GetWorkItemState(workItem, env.Context, false)
+	assert.Nil(t, state)
+	require.NotNil(t, err)
+	assert.True(t, network.IsPharosNotFound(err))
+
+	env.Pharos.Close()
+	for _, initIfEmpty := range []bool{true, false} {
+		state, err = workers.GetWorkItemState(workItem, env.Context, initIfEmpty)
+		assert.Nil(t, state)
+		require.NotNil(t, err)
+		assert.True(t, network.IsPharosUnavailable(err))
+	}
+}
+
+// When the circuit breaker is open, the Pharos client doesn't send
+// the request, so there's no HTTP response. GetWorkItemState has to
+// get by with just the error.
+func TestGetWorkItemStateCircuitOpen(t *testing.T) {
+	env := newPharosTestEnv(t)
+	defer env.Close()
+	require.Nil(t, env.Context.PharosClient.SetRetryConfig(models.PharosRetryConfig{
+		BreakerThreshold: 1,
+		BreakerCooldown:  "1h",
+	}))
+	env.Context.PharosClient.CircuitBreaker().RecordFailure()
+
+	stateId := 1234
+	workItem := &models.WorkItem{Id: 5678, WorkItemStateId: &stateId}
+	for _, initIfEmpty := range []bool{true, false} {
+		state, err := workers.GetWorkItemState(workItem, env.Context, initIfEmpty)
+		assert.Nil(t, state)
+		require.NotNil(t, err)
+		assert.True(t, errors.Is(err, network.ErrPharosCircuitOpen), err.Error())
+	}
+}
+
+// If the stage deadline has already passed, the storer gets an error
+// from Pharos without sending the request.
+func TestGetUuidOfExistingFileExpiredContext(t *testing.T) {
+	env := newPharosTestEnv(t)
+	defer env.Close()
+	storer := workers.NewAPTStorer(env.Context)
+	ctx, cancel := gocontext.WithDeadline(gocontext.Background(), time.Now().Add(-1*time.Minute))
+	defer cancel()
+	uuid, err := workers.GetUuidOfExistingFile(storer, ctx, "test.edu/bag/data/file.txt")
+	assert.Empty(t, uuid)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, gocontext.DeadlineExceeded), err.Error())
+}
@@ -0,0 +1,546 @@
+package workers_test
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/APTrust/exchange/validation"
+	"github.com/APTrust/exchange/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests run a bag through apt_fetch, apt_store, apt_record,
+// apt_restore and apt_file_delete, using a FakePharos server, a fake
+// nsqd and the local storage backend. Unlike the integration tests,
+// they need no Pharos, Postgres, NSQ or AWS.
+
+const e2eBagName = "example.edu.tagsample_good"
+const e2eObjIdentifier = "test.edu/" + e2eBagName
+const e2eReceivingBucket = "aptrust.receiving.test.edu"
+const e2eRestoreBucket = "aptrust.restore.test.edu"
+const e2eTimeout = 60 * time.Second
+
+// nsqPub is a message published to our fake nsqd.
+type nsqPub struct {
+	Topic string
+	Body  string
+}
+
+type e2eEnv struct {
+	Context   *context.Context
+	Pharos    *network.FakePharos
+	NsqServer *httptest.Server
+	Published chan nsqPub
+	Backend   network.StorageBackend
+	TempDir   string
+}
+
+func (env *e2eEnv) Close() {
+	if boltQueue, ok := env.Context.Queue.(*network.BoltQueue); ok {
+		boltQueue.Close()
+	}
+	env.Pharos.Close()
+	env.NsqServer.Close()
+	os.RemoveAll(env.TempDir)
+}
+
+// newE2EEnv sets up a context that uses FakePharos and local storage.
+// Param queueBackend is the config's QueueBackend setting. For "nsq",
+// workers publish to a fake nsqd, which passes messages on to the
+// Published channel.
+func newE2EEnv(t *testing.T, queueBackend string) *e2eEnv {
+	tempDir, err := ioutil.TempDir("", "exchange_e2e")
+	require.Nil(t, err)
+	env := &e2eEnv{
+		Pharos:    network.NewFakePharos(),
+		Published: make(chan nsqPub, 20),
+		TempDir:   tempDir,
+	}
+	env.Pharos.AddInstitution(&models.Institution{
+		Name:            "Test University",
+		BriefName:       "test",
+		Identifier:      "test.edu",
+		ReceivingBucket: e2eReceivingBucket,
+		RestoreBucket:   e2eRestoreBucket,
+	})
+
+	// Fake nsqd just records what the workers publish.
+	env.NsqServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		env.Published <- nsqPub{Topic: r.URL.Query().Get("topic"), Body: string(body)}
+		fmt.Fprint(w, "OK")
+	}))
+
+	config, err := models.LoadConfigFile(filepath.Join("config", "integration.json"))
+	require.Nil(t, err)
+	config.ExpandFilePaths()
+	config.TarDirectory = filepath.Join(tempDir, "tar")
+	config.RestoreDirectory = filepath.Join(tempDir, "restore")
+	config.LogDirectory = filepath.Join(tempDir, "logs")
+	config.LogToStderr = false
+	config.StorageBackend = "local"
+	config.LocalStorageRoot = filepath.Join(tempDir, "storage")
+	config.UseVolumeService = false
+	config.DeleteOnSuccess = true
+	config.RestoreToTestBuckets = false
+	config.PharosURL = env.Pharos.URL()
+	config.NsqdHttpAddress = env.NsqServer.URL
+	config.QueueBackend = queueBackend
+	config.EmbeddedQueuePath = filepath.Join(tempDir, "queue", "queue.db")
+	env.Context = context.NewContext(config)
+	env.Context.PharosClient, err = env.Pharos.Client()
+	require.Nil(t, err)
+	env.Backend = env.Context.StorageBackend(constants.AWSVirginia)
+	return env
+}
+
+// queueIngest puts our test bag into the receiving bucket and creates
+// the ingest WorkItem, as apt_bucket_reader would.
+func (env *e2eEnv) queueIngest(t *testing.T) *models.WorkItem {
+	return env.queueSerializedIngest(t, ".tar", "application/x-tar")
+}
+
+// queueSerializedIngest queues the version of our test bag that's
+// serialized with the specified suffix: .tar, .tar.gz or .zip.
+func (env *e2eEnv) queueSerializedIngest(t *testing.T, suffix, contentType string) *models.WorkItem {
+	_, filename, _, _ := runtime.Caller(0)
+	bagPath, _ := filepath.Abs(filepath.Join(filepath.Dir(filename),
+		"..", "testdata", "unit_test_bags", e2eBagName+suffix))
+	bagFile, err := os.Open(bagPath)
+	require.Nil(t, err)
+	defer bagFile.Close()
+	_, err = env.Backend.Put(e2eReceivingBucket, e2eBagName+suffix,
+		contentType, nil, bagFile, 0)
+	require.Nil(t, err)
+	storageObj, err := env.Backend.Head(e2eReceivingBucket, e2eBagName+suffix)
+	require.Nil(t, err)
+
+	resp := env.Context.PharosClient.InstitutionGet("test.edu")
+	require.Nil(t, resp.Error)
+	item := &models.WorkItem{
+		Name:          e2eBagName + suffix,
+		Bucket:        e2eReceivingBucket,
+		ETag:          storageObj.ETag,
+		Size:          storageObj.Size,
+		BagDate:       storageObj.LastModified,
+		InstitutionId: resp.Institution().Id,
+		Date:          time.Now().UTC(),
+		Note:          "Bag is in receiving bucket",
+		Action:        constants.ActionIngest,
+		Stage:         constants.StageReceive,
+		Status:        constants.StatusPending,
+		Outcome:       "Item is pending ingest",
+		Retry:         true,
+	}
+	resp = env.Context.PharosClient.WorkItemSave(item)
+	require.Nil(t, resp.Error)
+	return resp.WorkItem()
+}
+
+func e2eMessage(workItemId int) models.QueueMessage {
+	return testutil.MakeQueueMessage(strconv.Itoa(workItemId))
+}
+
+func (env *e2eEnv) getWorkItem(t *testing.T, id int) *models.WorkItem {
+	resp := env.Context.PharosClient.WorkItemGet(id)
+	require.Nil(t, resp.Error)
+	return resp.WorkItem()
+}
+
+// waitForIngestResult waits until the WorkItemState of the specified
+// WorkItem shows that the WorkSummary returned by getResult is finished.
+func (env *e2eEnv) waitForIngestResult(t *testing.T, workItemId int, getResult func(*models.IngestManifest) *models.WorkSummary) *models.IngestManifest {
+	deadline := time.Now().Add(e2eTimeout)
+	for time.Now().Before(deadline) {
+		item := env.getWorkItem(t, workItemId)
+		if item.WorkItemStateId != nil {
+			resp := env.Context.PharosClient.WorkItemStateGet(*item.WorkItemStateId)
+			require.Nil(t, resp.Error)
+			manifest, err := resp.WorkItemState().IngestManifest()
+			require.Nil(t, err)
+			if getResult(manifest).Finished() {
+				return manifest
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.FailNow(t, "Timed out waiting for ingest result",
+		"WorkItem %d: %s", workItemId, env.getWorkItem(t, workItemId).Note)
+	return nil
+}
+
+// waitForCompletion waits until the WorkItem is no longer pending or
+// in progress, and returns it.
+func (env *e2eEnv) waitForCompletion(t *testing.T, workItemId int) *models.WorkItem {
+	deadline := time.Now().Add(e2eTimeout)
+	for time.Now().Before(deadline) {
+		item := env.getWorkItem(t, workItemId)
+		if item.Status != constants.StatusPending && item.Status != constants.StatusStarted {
+			return item
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.FailNow(t, "Timed out waiting for WorkItem to complete",
+		"WorkItem %d: %s", workItemId, env.getWorkItem(t, workItemId).Note)
+	return nil
+}
+
+func (env *e2eEnv) assertPublished(t *testing.T, topic string, workItemId int) {
+	select {
+	case pub := <-env.Published:
+		assert.Equal(t, topic, pub.Topic)
+		assert.Equal(t, strconv.Itoa(workItemId), pub.Body)
+	case <-time.After(e2eTimeout):
+		assert.Fail(t, "Nothing was published to "+topic)
+	}
+}
+
+// ingest runs the bag through fetch, store and record.
+func (env *e2eEnv) ingest(t *testing.T) *models.WorkItem {
+	item := env.queueIngest(t)
+	env.fetch(t, item)
+	return env.storeAndRecord(t, item)
+}
+
+// fetch runs the fetcher on item, and returns the IngestManifest
+// once the bag has been validated.
+func (env *e2eEnv) fetch(t *testing.T, item *models.WorkItem) *models.IngestManifest {
+	fetcher := workers.NewAPTFetcher(env.Context)
+	require.Nil(t, fetcher.HandleMessage(e2eMessage(item.Id)))
+	manifest := env.waitForIngestResult(t, item.Id, func(m *models.IngestManifest) *models.WorkSummary { return m.ValidateResult })
+	require.False(t, manifest.HasErrors(), manifest.AllErrorsAsString())
+	env.assertPublished(t, env.Context.Config.StoreWorker.NsqTopic, item.Id)
+	return manifest
+}
+
+// storeAndRecord runs the storer and recorder on a bag the
+// fetcher has validated.
+func (env *e2eEnv) storeAndRecord(t *testing.T, item *models.WorkItem) *models.WorkItem {
+	config := env.Context.Config
+	storer := workers.NewAPTStorer(env.Context)
+	require.Nil(t, storer.HandleMessage(e2eMessage(item.Id)))
+	manifest := env.waitForIngestResult(t, item.Id, func(m *models.IngestManifest) *models.WorkSummary { return m.StoreResult })
+	require.False(t, manifest.HasErrors(), manifest.AllErrorsAsString())
+	env.assertPublished(t, config.RecordWorker.NsqTopic, item.Id)
+
+	recorder := workers.NewAPTRecorder(env.Context)
+	require.Nil(t, recorder.HandleMessage(e2eMessage(item.Id)))
+	manifest = env.waitForIngestResult(t, item.Id, func(m *models.IngestManifest) *models.WorkSummary { return m.RecordResult })
+	require.False(t, manifest.HasErrors(), manifest.AllErrorsAsString())
+
+	item = env.getWorkItem(t, item.Id)
+	assert.Equal(t, constants.StageCleanup, item.Stage)
+	assert.Equal(t, constants.StatusSuccess, item.Status)
+	return item
+}
+
+func (env *e2eEnv) getObjectWithFiles(t *testing.T) *models.IntellectualObject {
+	resp := env.Context.PharosClient.IntellectualObjectGet(e2eObjIdentifier, true, true)
+	require.Nil(t, resp.Error)
+	return resp.IntellectualObject()
+}
+
+func TestEndToEndIngestRestoreDelete(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	config := env.Context.Config
+
+	// ----- Ingest -----
+	env.ingest(t)
+
+	obj := env.getObjectWithFiles(t)
+	assert.Equal(t, "A", obj.State)
+	assert.Equal(t, "test.edu", obj.Institution)
+	assert.NotEmpty(t, obj.PremisEvents)
+	require.NotEmpty(t, obj.GenericFiles)
+	for _, gf := range obj.GenericFiles {
+		assert.NotNil(t, gf.GetChecksumByAlgorithm(constants.AlgMd5), gf.Identifier)
+		assert.NotNil(t, gf.GetChecksumByAlgorithm(constants.AlgSha256), gf.Identifier)
+		key, err := gf.PreservationStorageFileName()
+		require.Nil(t, err)
+		_, err = env.Backend.Head(config.PreservationBucket, key)
+		assert.Nil(t, err, gf.Identifier)
+		_, err = env.Backend.Head(config.ReplicationBucket, key)
+		assert.Nil(t, err, gf.Identifier)
+
+		resp := env.Context.PharosClient.GenericFileGet(gf.Identifier, true)
+		require.Nil(t, resp.Error)
+		assert.NotEmpty(t, resp.GenericFile().PremisEvents, gf.Identifier)
+	}
+
+	// DeleteOnSuccess is on, so the bag should be gone from the
+	// receiving bucket.
+	_, err := env.Backend.Head(e2eReceivingBucket, e2eBagName+".tar")
+	assert.True(t, network.IsNotFound(err))
+
+	// ----- Restore -----
+	resp := env.Context.PharosClient.IntellectualObjectRequestRestore(e2eObjIdentifier)
+	require.Nil(t, resp.Error)
+	restoreItem := resp.WorkItem()
+	restorer := workers.NewAPTRestorer(env.Context)
+	require.Nil(t, restorer.HandleMessage(e2eMessage(restoreItem.Id)))
+	restoreItem = env.waitForCompletion(t, restoreItem.Id)
+	require.Equal(t, constants.StatusSuccess, restoreItem.Status, restoreItem.Note)
+	assert.Equal(t, constants.StageResolve, restoreItem.Stage)
+	restored, err := env.Backend.Head(e2eRestoreBucket, e2eBagName+".tar")
+	require.Nil(t, err)
+	assert.True(t, restored.Size > 0)
+
+	// ----- Delete -----
+	resp = env.Context.PharosClient.IntellectualObjectRequestDelete(e2eObjIdentifier)
+	require.Nil(t, resp.Error)
+	params := url.Values{}
+	params.Set("item_action", constants.ActionDelete)
+	params.Set("object_identifier", e2eObjIdentifier)
+	resp = env.Context.PharosClient.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	deleteItems := resp.WorkItems()
+	require.Equal(t, len(obj.GenericFiles), len(deleteItems))
+
+	deleter := workers.NewAPTFileDeleter(env.Context)
+	for _, item := range deleteItems {
+		require.Nil(t, deleter.HandleMessage(e2eMessage(item.Id)))
+		item = env.waitForCompletion(t, item.Id)
+		require.Equal(t, constants.StatusSuccess, item.Status, item.Note)
+	}
+
+	resp = env.Context.PharosClient.IntellectualObjectGet(e2eObjIdentifier, false, false)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "D", resp.IntellectualObject().State)
+	for _, gf := range obj.GenericFiles {
+		resp = env.Context.PharosClient.GenericFileGet(gf.Identifier, true)
+		require.Nil(t, resp.Error)
+		assert.Equal(t, "D", resp.GenericFile().State, gf.Identifier)
+		assert.NotEmpty(t, resp.GenericFile().FindEventsByType(constants.EventDeletion))
+		key, _ := gf.PreservationStorageFileName()
+		_, err = env.Backend.Head(config.PreservationBucket, key)
+		assert.True(t, network.IsNotFound(err), gf.Identifier)
+		_, err = env.Backend.Head(config.ReplicationBucket, key)
+		assert.True(t, network.IsNotFound(err), gf.Identifier)
+	}
+}
+
+func TestEndToEndIngestWithEmbeddedQueue(t *testing.T) {
+	env := newE2EEnv(t, "embedded")
+	defer env.Close()
+	config := env.Context.Config
+	queue := env.Context.Queue
+
+	// Run fetch, store and record in one process, as apt_exchange
+	// would, with the embedded queue passing work from one worker
+	// to the next.
+	require.Nil(t, queue.Subscribe(&config.FetchWorker, workers.NewAPTFetcher(env.Context)))
+	require.Nil(t, queue.Subscribe(&config.StoreWorker, workers.NewAPTStorer(env.Context)))
+	require.Nil(t, queue.Subscribe(&config.RecordWorker, workers.NewAPTRecorder(env.Context)))
+
+	item := env.queueIngest(t)
+	require.Nil(t, queue.Enqueue(config.FetchWorker.NsqTopic, item.Id))
+	manifest := env.waitForIngestResult(t, item.Id, func(m *models.IngestManifest) *models.WorkSummary { return m.RecordResult })
+	require.False(t, manifest.HasErrors(), manifest.AllErrorsAsString())
+
+	item = env.getWorkItem(t, item.Id)
+	assert.Equal(t, constants.StageCleanup, item.Stage)
+	assert.Equal(t, constants.StatusSuccess, item.Status)
+	obj := env.getObjectWithFiles(t)
+	assert.Equal(t, "A", obj.State)
+	assert.NotEmpty(t, obj.GenericFiles)
+
+	// Nothing should have gone to nsqd, and every worker should
+	// have finished its message.
+	assert.Empty(t, env.Published)
+	boltQueue := queue.(*network.BoltQueue)
+	for _, topic := range []string{config.FetchWorker.NsqTopic, config.StoreWorker.NsqTopic, config.RecordWorker.NsqTopic} {
+		deadline := time.Now().Add(e2eTimeout)
+		depth := -1
+		for depth != 0 && time.Now().Before(deadline) {
+			depth, _ = boltQueue.Depth(topic)
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.Equal(t, 0, depth, topic)
+	}
+}
+
+func TestEndToEndStreamingIngest(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	config := env.Context.Config
+	config.StreamIngest = true
+
+	// The fetcher should validate the bag without putting
+	// the tar file on disk.
+	item := env.queueIngest(t)
+	manifest := env.fetch(t, item)
+	assert.False(t, fileutil.FileExists(manifest.BagPath))
+	assert.True(t, fileutil.FileExists(manifest.DBPath))
+
+	// The storer should read each file from the receiving bucket.
+	env.storeAndRecord(t, item)
+	obj := env.getObjectWithFiles(t)
+	require.NotEmpty(t, obj.GenericFiles)
+	for _, gf := range obj.GenericFiles {
+		key, err := gf.PreservationStorageFileName()
+		require.Nil(t, err)
+		stored, err := env.Backend.Head(config.PreservationBucket, key)
+		require.Nil(t, err, gf.Identifier)
+		assert.Equal(t, gf.Size, stored.Size, gf.Identifier)
+		checksum := gf.GetChecksumByAlgorithm(constants.AlgMd5)
+		require.NotNil(t, checksum, gf.Identifier)
+		assert.Equal(t, checksum.Digest, stored.ETag, gf.Identifier)
+	}
+}
+
+func TestEndToEndZipAndGzipIngest(t *testing.T) {
+	formats := map[string]string{
+		".zip":    "application/zip",
+		".tar.gz": "application/gzip",
+	}
+	for suffix, contentType := range formats {
+		env := newE2EEnv(t, "nsq")
+		config := env.Context.Config
+		// Zip and gzipped bags are always downloaded,
+		// even when StreamIngest is on.
+		config.StreamIngest = true
+
+		item := env.queueSerializedIngest(t, suffix, contentType)
+		manifest := env.fetch(t, item)
+		assert.True(t, fileutil.FileExists(manifest.BagPath), suffix)
+		assert.Equal(t, filepath.Join(config.TarDirectory, "test.edu", e2eBagName+".valdb"),
+			manifest.DBPath, suffix)
+
+		env.storeAndRecord(t, item)
+		obj := env.getObjectWithFiles(t)
+		assert.Equal(t, e2eObjIdentifier, obj.Identifier, suffix)
+		require.NotEmpty(t, obj.GenericFiles, suffix)
+		for _, gf := range obj.GenericFiles {
+			key, err := gf.PreservationStorageFileName()
+			require.Nil(t, err)
+			stored, err := env.Backend.Head(config.PreservationBucket, key)
+			require.Nil(t, err, gf.Identifier)
+			checksum := gf.GetChecksumByAlgorithm(constants.AlgMd5)
+			require.NotNil(t, checksum, gf.Identifier)
+			assert.Equal(t, checksum.Digest, stored.ETag, gf.Identifier)
+		}
+		env.Close()
+	}
+}
+
+// The parts of a multipart bag become a single object.
+func TestEndToEndMultipartIngest(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	config := env.Context.Config
+	// Multipart bags are always downloaded.
+	config.StreamIngest = true
+
+	_, filename, _, _ := runtime.Caller(0)
+	partNames := []string{"example.edu.multipart.b01.of02.tar", "example.edu.multipart.b02.of02.tar"}
+	for _, partName := range partNames {
+		partPath, _ := filepath.Abs(filepath.Join(filepath.Dir(filename),
+			"..", "testdata", "unit_test_bags", partName))
+		partFile, err := os.Open(partPath)
+		require.Nil(t, err)
+		_, err = env.Backend.Put(e2eReceivingBucket, partName, "application/x-tar", nil, partFile, 0)
+		partFile.Close()
+		require.Nil(t, err)
+	}
+
+	// Name, ETag and Size describe the whole set of parts,
+	// as apt_bucket_reader would record them.
+	bag, err := workers.ListBagParts(env.Backend, e2eReceivingBucket, partNames[0])
+	require.Nil(t, err)
+	require.True(t, bag.IsComplete(), bag.Problems())
+	resp := env.Context.PharosClient.InstitutionGet("test.edu")
+	require.Nil(t, resp.Error)
+	item := &models.WorkItem{
+		Name:          bag.FirstPartKey(),
+		Bucket:        e2eReceivingBucket,
+		ETag:          bag.ETag(),
+		Size:          bag.Size(),
+		BagDate:       bag.LastModified(),
+		InstitutionId: resp.Institution().Id,
+		Date:          time.Now().UTC(),
+		Action:        constants.ActionIngest,
+		Stage:         constants.StageReceive,
+		Status:        constants.StatusPending,
+		Retry:         true,
+	}
+	resp = env.Context.PharosClient.WorkItemSave(item)
+	require.Nil(t, resp.Error)
+	item = resp.WorkItem()
+
+	manifest := env.fetch(t, item)
+	require.Equal(t, 2, len(manifest.BagParts))
+	for i, partName := range partNames {
+		assert.Equal(t, filepath.Join(config.TarDirectory, "test.edu", partName), manifest.BagParts[i])
+		assert.True(t, fileutil.FileExists(manifest.BagParts[i]))
+	}
+
+	env.storeAndRecord(t, item)
+	objResp := env.Context.PharosClient.IntellectualObjectGet("test.edu/example.edu.multipart", true, false)
+	require.Nil(t, objResp.Error)
+	obj := objResp.IntellectualObject()
+	require.NotNil(t, obj)
+	payloadFiles := make([]string, 0)
+	for _, gf := range obj.GenericFiles {
+		originalPath := gf.OriginalPath()
+		if strings.HasPrefix(originalPath, "data/") {
+			payloadFiles = append(payloadFiles, originalPath)
+		}
+		key, err := gf.PreservationStorageFileName()
+		require.Nil(t, err)
+		_, err = env.Backend.Head(config.PreservationBucket, key)
+		assert.Nil(t, err, gf.Identifier)
+	}
+	assert.ElementsMatch(t, []string{
+		"data/multipart_file01.xml",
+		"data/multipart_file02.txt",
+		"data/multipart_file03.xml",
+		"data/multipart_file04.txt",
+	}, payloadFiles)
+
+	// All the parts are gone from the receiving bucket and staging area.
+	for i, partName := range partNames {
+		_, err = env.Backend.Head(e2eReceivingBucket, partName)
+		assert.True(t, network.IsNotFound(err), partName)
+		assert.False(t, fileutil.FileExists(manifest.BagParts[i]), partName)
+	}
+}
+
+// apt_fetch gives the validator the names of the files already
+// stored for an object, so it can catch file name collisions in
+// a new version of the bag.
+func TestEndToEndActiveFilePaths(t *testing.T) {
+	env := newE2EEnv(t, "nsq")
+	defer env.Close()
+	require.Equal(t, validation.COLLISION_WARN,
+		workers.LoadAPTrustBagValidationConfig(env.Context).FileNameCollisionPolicy)
+
+	filePaths, err := workers.ActiveFilePaths(env.Context.PharosClient, e2eObjIdentifier)
+	require.Nil(t, err)
+	assert.Empty(t, filePaths)
+
+	env.ingest(t)
+	filePaths, err = workers.ActiveFilePaths(env.Context.PharosClient, e2eObjIdentifier)
+	require.Nil(t, err)
+	assert.Equal(t, len(env.getObjectWithFiles(t).GenericFiles), len(filePaths))
+	assert.Contains(t, filePaths, "data/datastream-DC")
+
+	// Files with the same names in the next version are not collisions.
+	env.ingest(t)
+}
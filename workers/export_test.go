@@ -0,0 +1,5 @@
+package workers
+
+// Exports for tests in package workers_test.
+
+var GetUuidOfExistingFile = (*APTStorer).getUuidOfExistingFile
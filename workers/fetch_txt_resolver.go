@@ -0,0 +1,263 @@
+package workers
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/tarfile"
+	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/APTrust/exchange/validation"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FetchTxtResolver fills in a holey bag by downloading the files
+// listed in its fetch.txt, and appending them to the bag's tar file.
+// After that, the validator and storer treat them like any other
+// payload file, so the payload manifests must include them.
+type FetchTxtResolver struct {
+	// Backend reads files at s3:// URLs.
+	Backend network.StorageBackend
+	// Buckets lists the buckets that s3:// URLs may point to.
+	Buckets []string
+	// LocalRoots lists the directories that file:// URLs may
+	// point into.
+	LocalRoots []string
+}
+
+// fetchSource describes where to read the file for one line
+// of fetch.txt.
+type fetchSource struct {
+	item      *validation.FetchItem
+	bucket    string
+	key       string
+	localPath string
+	size      int64
+	modTime   time.Time
+}
+
+// NewFetchTxtResolver returns a FetchTxtResolver that reads s3://
+// URLs through backend. URLs must point into one of the buckets or
+// localRoots.
+func NewFetchTxtResolver(backend network.StorageBackend, buckets, localRoots []string) *FetchTxtResolver {
+	return &FetchTxtResolver{
+		Backend:    backend,
+		Buckets:    buckets,
+		LocalRoots: localRoots,
+	}
+}
+
+// Resolve fetches the files listed in the fetch.txt of the bag at
+// pathToBag, and appends them to the bag's tar file. It returns the
+// number of files it added, which is zero if the bag has no fetch.txt.
+//
+// Resolve adds an error to summary for each line of fetch.txt that it
+// can't resolve. Problems with the bag, such as a URL outside of our
+// buckets and local roots, or a file whose length doesn't match the
+// one in fetch.txt, are fatal. Resolve checks every line before it
+// downloads anything, and if anything goes wrong, it leaves the tar
+// file as it was.
+func (resolver *FetchTxtResolver) Resolve(pathToBag string, summary *models.WorkSummary) int {
+	items, parseErrors, filesInBag, err := readFetchTxt(pathToBag)
+	if err != nil {
+		summary.AddError("Can't read fetch.txt in %s: %v", pathToBag, err)
+		return 0
+	}
+	if items == nil {
+		return 0 // no fetch.txt
+	}
+	if !TAR_SUFFIX.MatchString(pathToBag) {
+		summary.AddError("Can't fetch the files in fetch.txt for %s, because only "+
+			"plain tar files can hold them", path.Base(pathToBag))
+		summary.ErrorIsFatal = true
+		return 0
+	}
+	errorCount := len(summary.Errors)
+	for _, parseError := range parseErrors {
+		summary.AddError("%s", parseError.Message)
+		summary.ErrorIsFatal = true
+	}
+	sources := make([]*fetchSource, 0)
+	for _, item := range items {
+		if filesInBag[item.FilePath] {
+			summary.AddError("Line %d of fetch.txt lists '%s', which is already in the bag",
+				item.LineNumber, item.FilePath)
+			summary.ErrorIsFatal = true
+			continue
+		}
+		filesInBag[item.FilePath] = true
+		source, err := resolver.locate(item)
+		if err != nil {
+			summary.AddError("Can't fetch '%s' from line %d of fetch.txt: %v",
+				item.FilePath, item.LineNumber, err)
+			_, transient := err.(transientFetchError)
+			summary.ErrorIsFatal = summary.ErrorIsFatal || !transient
+			continue
+		}
+		sources = append(sources, source)
+	}
+	if len(summary.Errors) > errorCount {
+		return 0
+	}
+	return resolver.appendToBag(pathToBag, sources, summary)
+}
+
+// readFetchTxt returns the entries in the fetch.txt file of the bag at
+// pathToBag, along with the paths of the files already in the bag. The
+// entries are nil if the bag has no fetch.txt.
+func readFetchTxt(pathToBag string) ([]*validation.FetchItem, []*validation.ValidationError, map[string]bool, error) {
+	iterator, err := fileutil.NewArchiveIterator(pathToBag)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer iterator.Close()
+	var items []*validation.FetchItem
+	var parseErrors []*validation.ValidationError
+	filesInBag := make(map[string]bool)
+	for {
+		reader, fileSummary, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+		if !fileSummary.IsRegularFile {
+			continue
+		}
+		filesInBag[fileSummary.RelPath] = true
+		if fileSummary.RelPath == validation.FetchTxtFile {
+			items, parseErrors = validation.ParseFetchTxt(reader)
+		}
+	}
+	return items, parseErrors, filesInBag, nil
+}
+
+// locate finds the file for one line of fetch.txt, and makes sure we're
+// allowed to read it and that its length matches the one in fetch.txt.
+func (resolver *FetchTxtResolver) locate(item *validation.FetchItem) (*fetchSource, error) {
+	fetchURL, err := url.Parse(item.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL %s: %v", item.URL, err)
+	}
+	source := &fetchSource{item: item}
+	switch fetchURL.Scheme {
+	case "s3":
+		source.bucket = fetchURL.Host
+		source.key = strings.TrimPrefix(fetchURL.Path, "/")
+		if !util.StringListContains(resolver.Buckets, source.bucket) {
+			return nil, fmt.Errorf("Bucket %s is not one of the buckets in Config.FetchTxtBuckets", source.bucket)
+		}
+		storageObj, err := resolver.Backend.Head(source.bucket, source.key)
+		if err != nil && network.IsNotFound(err) {
+			return nil, err
+		} else if err != nil {
+			return nil, transientFetchError{err}
+		}
+		source.size = storageObj.Size
+		source.modTime = storageObj.LastModified
+	case "file":
+		if fetchURL.Host != "" && fetchURL.Host != "localhost" {
+			return nil, fmt.Errorf("URL %s is not on this host", item.URL)
+		}
+		localPath, err := filepath.EvalSymlinks(filepath.Clean(fetchURL.Path))
+		if err != nil {
+			return nil, err
+		}
+		if !resolver.isUnderLocalRoot(localPath) {
+			return nil, fmt.Errorf("%s is not under any of the directories in Config.FetchTxtLocalRoots", localPath)
+		}
+		fileInfo, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", localPath)
+		}
+		source.localPath = localPath
+		source.size = fileInfo.Size()
+		source.modTime = fileInfo.ModTime()
+	default:
+		return nil, fmt.Errorf("Unsupported URL %s. URLs must start with s3:// or file://", item.URL)
+	}
+	if item.Length != validation.UnknownFetchLength && item.Length != source.size {
+		return nil, fmt.Errorf("fetch.txt says the file is %d bytes, but it's %d bytes", item.Length, source.size)
+	}
+	return source, nil
+}
+
+// isUnderLocalRoot returns true if localPath is inside one of
+// the resolver's LocalRoots.
+func (resolver *FetchTxtResolver) isUnderLocalRoot(localPath string) bool {
+	for _, localRoot := range resolver.LocalRoots {
+		root, err := filepath.EvalSymlinks(filepath.Clean(localRoot))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(localPath, root+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendToBag copies each source into the tar file at pathToBag, under
+// the bag's top-level directory. Errors here are usually transient, so
+// they're not fatal.
+func (resolver *FetchTxtResolver) appendToBag(pathToBag string, sources []*fetchSource, summary *models.WorkSummary) int {
+	topLevelDir := constants.SerializedBagSuffix.ReplaceAllString(path.Base(pathToBag), "")
+	writer := tarfile.NewWriter(pathToBag)
+	err := writer.OpenForAppend()
+	if err != nil {
+		summary.AddError("Can't add fetched files to %s: %v", pathToBag, err)
+		return 0
+	}
+	for _, source := range sources {
+		err = resolver.appendSource(writer, topLevelDir, source)
+		if err != nil {
+			summary.AddError("Can't fetch '%s' from line %d of fetch.txt: %v",
+				source.item.FilePath, source.item.LineNumber, err)
+			abortErr := writer.Abort()
+			if abortErr != nil {
+				summary.AddError("Can't remove fetched files from %s: %v", pathToBag, abortErr)
+				summary.ErrorIsFatal = true
+			}
+			return 0
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		summary.AddError("Can't add fetched files to %s: %v", pathToBag, err)
+		return 0
+	}
+	return len(sources)
+}
+
+// appendSource copies one file into the tar file.
+func (resolver *FetchTxtResolver) appendSource(writer *tarfile.Writer, topLevelDir string, source *fetchSource) error {
+	var reader io.ReadCloser
+	var err error
+	if source.localPath != "" {
+		reader, err = os.Open(source.localPath)
+	} else {
+		reader, err = resolver.Backend.Get(source.bucket, source.key)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// This fails if the file's length changed after we checked it.
+	return writer.AddFromReader(reader, topLevelDir+"/"+source.item.FilePath, source.size, source.modTime)
+}
+
+// transientFetchError is an error that may go away if we try
+// again, like a network error.
+type transientFetchError struct {
+	error
+}
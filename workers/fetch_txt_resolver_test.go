@@ -0,0 +1,127 @@
+package workers_test
+
+import (
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/testhelper"
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/APTrust/exchange/validation"
+	"github.com/APTrust/exchange/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const holeyBucket = "holey-bucket"
+
+// holeyTarBag builds a tarred bag whose fetch.txt lists one file in
+// a local directory and one in a bucket. Both are in the payload
+// manifests. Returns the temp dir, which the caller should delete,
+// the path to the tar file, and a resolver that can fetch the files.
+func holeyTarBag(t *testing.T, fetchTxt string) (string, string, *workers.FetchTxtResolver) {
+	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
+	require.Nil(t, err)
+	for _, name := range []string{"tagmanifest-md5.txt", "tagmanifest-sha256.txt"} {
+		require.Nil(t, os.Remove(filepath.Join(bagPath, name)))
+	}
+	sharedDir := filepath.Join(tempDir, "shared")
+	backend, err := network.NewLocalBackend(filepath.Join(tempDir, "s3"))
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(sharedDir, 0755))
+	for _, fileName := range []string{"local.txt", "remote.txt"} {
+		filePath := filepath.Join(bagPath, "data", fileName)
+		require.Nil(t, ioutil.WriteFile(filePath, []byte("Contents of "+fileName), 0644))
+		for _, alg := range []string{constants.AlgMd5, constants.AlgSha256} {
+			digest, err := fileutil.CalculateChecksum(filePath, alg)
+			require.Nil(t, err)
+			manifest, err := os.OpenFile(filepath.Join(bagPath, "manifest-"+alg+".txt"), os.O_APPEND|os.O_WRONLY, 0644)
+			require.Nil(t, err)
+			_, err = manifest.WriteString(digest + "  data/" + fileName + "\n")
+			require.Nil(t, err)
+			require.Nil(t, manifest.Close())
+		}
+	}
+	require.Nil(t, os.Rename(filepath.Join(bagPath, "data", "local.txt"), filepath.Join(sharedDir, "local.txt")))
+	remoteFile, err := os.Open(filepath.Join(bagPath, "data", "remote.txt"))
+	require.Nil(t, err)
+	_, err = backend.Put(holeyBucket, "files/remote.txt", "text/plain", nil, remoteFile, 22)
+	remoteFile.Close()
+	require.Nil(t, err)
+	require.Nil(t, os.Remove(filepath.Join(bagPath, "data", "remote.txt")))
+
+	fetchTxt = strings.Replace(fetchTxt, "SHARED", sharedDir, -1)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagPath, "fetch.txt"), []byte(fetchTxt), 0644))
+	tarFilePath := bagPath + ".tar"
+	cmd := exec.Command("tar", "cf", tarFilePath, "--directory", tempDir, path.Base(bagPath))
+	require.Nil(t, cmd.Run())
+	resolver := workers.NewFetchTxtResolver(backend, []string{holeyBucket}, []string{sharedDir})
+	return tempDir, tarFilePath, resolver
+}
+
+func TestFetchTxtResolver_Resolve(t *testing.T) {
+	tempDir, tarFilePath, resolver := holeyTarBag(t,
+		"file://SHARED/local.txt 21 data/local.txt\n"+
+			"s3://holey-bucket/files/remote.txt - data/remote.txt\n")
+	defer os.RemoveAll(tempDir)
+
+	summary := models.NewWorkSummary()
+	assert.Equal(t, 2, resolver.Resolve(tarFilePath, summary))
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	conf, errors := validation.LoadBagValidationConfig(path.Join("config", "aptrust_bag_validation_config.json"))
+	require.Empty(t, errors)
+	conf.AllowFetchTxt = true
+	validator, err := validation.NewValidator(tarFilePath, conf, true)
+	require.Nil(t, err)
+	summary, err = validator.Validate()
+	os.Remove(validator.DBName())
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	// Nothing to do for a bag with no fetch.txt.
+	summary = models.NewWorkSummary()
+	assert.Equal(t, 0, resolver.Resolve(testhelper.VbagGetPath("example.edu.tagsample_good.tar"), summary))
+	assert.False(t, summary.HasErrors())
+}
+
+func TestFetchTxtResolver_ResolveErrors(t *testing.T) {
+	tempDir, tarFilePath, resolver := holeyTarBag(t,
+		"file://SHARED/local.txt 100 data/local.txt\n"+
+			"file:///etc/hosts - data/hosts\n"+
+			"s3://other-bucket/files/remote.txt - data/remote.txt\n"+
+			"s3://holey-bucket/no/such/file.txt - data/missing.txt\n"+
+			"https://example.com/remote.txt - data/web.txt\n"+
+			"s3://holey-bucket/files/remote.txt - data/datastream-DC\n"+
+			"s3://holey-bucket/files/remote.txt - ../outside.txt\n")
+	defer os.RemoveAll(tempDir)
+	tarFileInfo, err := os.Stat(tarFilePath)
+	require.Nil(t, err)
+
+	summary := models.NewWorkSummary()
+	assert.Equal(t, 0, resolver.Resolve(tarFilePath, summary))
+	assert.True(t, summary.ErrorIsFatal)
+	require.Equal(t, 7, len(summary.Errors), summary.AllErrorsAsString())
+	assert.Equal(t, "File path '../outside.txt' on line 7 of fetch.txt is not in the payload directory", summary.Errors[0])
+	assert.Equal(t, "Can't fetch 'data/local.txt' from line 1 of fetch.txt: "+
+		"fetch.txt says the file is 100 bytes, but it's 21 bytes", summary.Errors[1])
+	assert.True(t, strings.HasPrefix(summary.Errors[2], "Can't fetch 'data/hosts' from line 2 of fetch.txt: "))
+	assert.True(t, strings.HasSuffix(summary.Errors[2], "is not under any of the directories in Config.FetchTxtLocalRoots"))
+	assert.Equal(t, "Can't fetch 'data/remote.txt' from line 3 of fetch.txt: "+
+		"Bucket other-bucket is not one of the buckets in Config.FetchTxtBuckets", summary.Errors[3])
+	assert.True(t, strings.HasPrefix(summary.Errors[4], "Can't fetch 'data/missing.txt' from line 4 of fetch.txt: "))
+	assert.Equal(t, "Can't fetch 'data/web.txt' from line 5 of fetch.txt: "+
+		"Unsupported URL https://example.com/remote.txt. URLs must start with s3:// or file://", summary.Errors[5])
+	assert.Equal(t, "Line 6 of fetch.txt lists 'data/datastream-DC', which is already in the bag", summary.Errors[6])
+
+	// The tar file should be as it was.
+	newTarFileInfo, err := os.Stat(tarFilePath)
+	require.Nil(t, err)
+	assert.Equal(t, tarFileInfo.Size(), newTarFileInfo.Size())
+}